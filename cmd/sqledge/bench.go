@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/bench"
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+)
+
+// benchApply measures how fast rows of each shape are applied, in a
+// scratch database next to the local database so it's on the same disk:
+//
+//	sqledge bench apply [-rows 100000] [-tx-rows 1] [-group-commit 1] [-shapes narrow,wide,json,blob] [-text]
+func benchApply(cfg *config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "apply" {
+		return errors.New("usage: sqledge bench apply [flags]")
+	}
+
+	flags := flag.NewFlagSet("bench apply", flag.ContinueOnError)
+	rows := flags.Int("rows", 100000, "rows inserted for each shape")
+	txRows := flags.Int("tx-rows", 1, "rows in each upstream transaction")
+	group := flags.Int("group-commit", cfg.Replication.GroupCommitMaxTransactions, "upstream transactions in each local commit")
+	shapes := flags.String("shapes", "narrow,wide,json,blob", "row shapes to benchmark")
+	text := flags.Bool("text", false, "format the values into the sql instead of binding them")
+	dir := flags.String("dir", filepath.Dir(cfg.Local.Path), "directory of the scratch database")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var selected []bench.Shape
+
+	for _, name := range strings.Split(*shapes, ",") {
+		shape, ok := bench.ShapeByName(strings.TrimSpace(name))
+		if !ok {
+			return fmt.Errorf("unknown shape %q", name)
+		}
+
+		selected = append(selected, shape)
+	}
+
+	scratch, err := os.MkdirTemp(*dir, "sqledge-bench-")
+	if err != nil {
+		return fmt.Errorf("create scratch dir: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	path := filepath.Join(scratch, "bench.db")
+	if len(cfg.Local.Pragmas) > 0 {
+		// the local database's pragmas, e.g. its journal mode
+		path += "?" + url.Values{"_pragma": cfg.Local.Pragmas}.Encode()
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("open scratch database: %w", err)
+	}
+	defer db.Close()
+
+	// the transactions are begun and committed with separate statements
+	db.SetMaxOpenConns(1)
+
+	benchCfg := bench.Config{
+		Rows:        *rows,
+		TxRows:      *txRows,
+		GroupCommit: *group,
+		Text:        *text,
+		Local:       replicate.LocalConfig(cfg),
+	}
+
+	fmt.Printf("%d rows per transaction, %d transactions per commit\n", benchCfg.TxRows, benchCfg.GroupCommit)
+
+	for _, shape := range selected {
+		res, err := bench.Apply(db, shape, benchCfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", shape.Name, err)
+		}
+
+		fmt.Println(res)
+	}
+
+	return nil
+}
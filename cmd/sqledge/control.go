@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/control"
+	"github.com/gemini-kenshi/pgreplsql/pkg/queryproxy"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// controller runs the commands sent to the node through the WAL:
+//
+//	set_log_level {"level": "info"}
+//	resync_table  {"table": "orders"}
+//	rotate_keys   reloads the listeners' TLS certificates and keys
+//
+// The commands the node ran are kept in a journal next to the local
+// database, so none runs twice.
+func controller(cfg *config.Config, proxy *queryproxy.Proxy, replicator *replicate.Replicator) (*control.Controller, error) {
+	journal, err := control.OpenJournal(cfg.Local.Path + ".control")
+	if err != nil {
+		return nil, err
+	}
+
+	c := control.New(cfg.Control.Secret, cfg.Replication.SlotName)
+	c.SetJournal(journal)
+
+	c.Handle("set_log_level", func(_ context.Context, args json.RawMessage) error {
+		var a struct {
+			Level string `json:"level"`
+		}
+
+		if err := json.Unmarshal(args, &a); err != nil {
+			return err
+		}
+
+		level, err := zerolog.ParseLevel(a.Level)
+		if err != nil {
+			return err
+		}
+
+		zerolog.SetGlobalLevel(level)
+		log.Info().Msgf("log level set to %s", level)
+
+		return nil
+	})
+
+	c.Handle("resync_table", func(_ context.Context, args json.RawMessage) error {
+		var a struct {
+			Table string `json:"table"`
+		}
+
+		if err := json.Unmarshal(args, &a); err != nil {
+			return err
+		}
+
+		if a.Table == "" {
+			return errors.New("no table")
+		}
+
+		if err := replicator.ResyncTable(a.Table); err != nil {
+			return err
+		}
+
+		log.Info().Msgf("queued %s to resync", a.Table)
+
+		return nil
+	})
+
+	c.Handle("rotate_keys", func(context.Context, json.RawMessage) error {
+		if err := proxy.ReloadKeys(); err != nil {
+			return err
+		}
+
+		log.Info().Msg("reloaded tls keys")
+
+		return nil
+	})
+
+	return c, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/gemini-kenshi/pgreplsql/pkg/tables"
+)
+
+// convertSchema prints the SQLite tables sqledge would create for the
+// upstream's tables (or the tables given), or for the tables of a
+// pg_dump schema file with -dump:
+//
+//	sqledge convert-schema [-dump schema.sql] [table...]
+func convertSchema(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("convert-schema", flag.ContinueOnError)
+	dump := flags.String("dump", "", "read the tables from a pg_dump schema file instead of the upstream")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	defs, err := schemaColDefs(cfg, *dump, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range sqlgen.ConvertSchema(cfg.Upstream.Schema, defs) {
+		fmt.Println(stmt)
+	}
+
+	return nil
+}
+
+func schemaColDefs(cfg *config.Config, dump string, names []string) (map[string][]sqlgen.ColDef, error) {
+	if dump == "" {
+		db, err := sql.Open("pgx", cfg.UpstreamConnString("convert-schema"))
+		if err != nil {
+			return nil, fmt.Errorf("open upstream: %w", err)
+		}
+		defer db.Close()
+
+		return tables.TableColDefs(db, cfg.Upstream.Schema, names)
+	}
+
+	f, err := os.Open(dump)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	defs, err := tables.DumpColDefs(f, cfg.Upstream.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return defs, nil
+	}
+
+	out := make(map[string][]sqlgen.ColDef, len(names))
+
+	for _, name := range names {
+		def, ok := defs[name]
+		if !ok {
+			return nil, fmt.Errorf("table %q isn't in %s", name, dump)
+		}
+
+		out[name] = def
+	}
+
+	return out, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// debugDump gathers what a bug report needs into a single archive: the
+// redacted config, the local schema and the pending dead letters, and
+// from the running node, through its admin API, its recent logs, status
+// and goroutine stacks, authenticated as the configured upstream user:
+//
+//	sqledge debug dump [-out sqledge-debug.tar.gz] [-admin http://localhost:5480]
+func debugDump(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "dump" {
+		return errors.New("usage: sqledge debug dump [-out file] [-admin url]")
+	}
+
+	flags := flag.NewFlagSet("debug dump", flag.ContinueOnError)
+	out := flags.String("out", fmt.Sprintf("sqledge-debug-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")), "archive to create")
+	admin := flags.String("admin", fmt.Sprintf("http://%s:%d", cfg.Admin.Address, cfg.Admin.Port), "the node's admin API")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", *out, err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	archive := &dumpArchive{tw: tar.NewWriter(gz), at: time.Now()}
+
+	redacted, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+
+	archive.add("config.json", redacted)
+	archive.gather("schema.sql", func() ([]byte, error) { return localSchema(ctx, cfg) })
+
+	if err := addDeadLetters(archive, cfg.Replication.DLQDir); err != nil {
+		archive.failed("dlq", err)
+	}
+
+	// the node may be down, the rest is still worth attaching
+	for _, part := range []struct{ name, path string }{
+		{"logs.ndjson", "/debug/logs"},
+		{"status.json", "/debug/status"},
+		{"goroutines.txt", "/debug/goroutines"},
+	} {
+		archive.gather(part.name, func() ([]byte, error) { return adminGet(ctx, cfg, *admin+part.path) })
+	}
+
+	if len(archive.errs) > 0 {
+		archive.add("errors.txt", []byte(strings.Join(archive.errs, "\n")+"\n"))
+	}
+
+	if archive.err != nil {
+		return fmt.Errorf("write %s: %w", *out, archive.err)
+	}
+
+	if err := archive.tw.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", *out, err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", *out, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", *out, err)
+	}
+
+	log.Info().Msgf("wrote %s, %d of its parts failed", *out, len(archive.errs))
+
+	return nil
+}
+
+// dumpArchive writes the files of a debug dump, recording the parts
+// that couldn't be gathered instead of failing the dump.
+type dumpArchive struct {
+	tw   *tar.Writer
+	at   time.Time
+	errs []string
+	err  error
+}
+
+func (a *dumpArchive) add(name string, data []byte) {
+	if a.err != nil {
+		return
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: a.at}
+
+	if a.err = a.tw.WriteHeader(hdr); a.err != nil {
+		return
+	}
+
+	_, a.err = a.tw.Write(data)
+}
+
+func (a *dumpArchive) gather(name string, get func() ([]byte, error)) {
+	data, err := get()
+	if err != nil {
+		a.failed(name, err)
+		return
+	}
+
+	a.add(name, data)
+}
+
+func (a *dumpArchive) failed(name string, err error) {
+	log.Warn().Err(err).Msgf("debug dump: no %s", name)
+	a.errs = append(a.errs, fmt.Sprintf("%s: %s", name, err))
+}
+
+// localSchema is the local database's schema, as SQLite keeps it.
+func localSchema(ctx context.Context, cfg *config.Config) ([]byte, error) {
+	if _, err := os.Stat(cfg.Local.Path); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", cfg.Local.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", cfg.Local.Path, err)
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, "SELECT sql FROM sqlite_master WHERE sql IS NOT NULL ORDER BY type DESC, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			return nil, err
+		}
+
+		b.WriteString(stmt + ";\n")
+	}
+
+	return []byte(b.String()), rows.Err()
+}
+
+// addDeadLetters adds the dead letter queue's entries, which have a
+// preview of their change, leaving out the full payloads.
+func addDeadLetters(a *dumpArchive, dir string) error {
+	entries, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, ".payload.json") {
+			continue
+		}
+
+		data, err := os.ReadFile(entry)
+		if err != nil {
+			return err
+		}
+
+		a.add("dlq/"+filepath.Base(entry), data)
+	}
+
+	return nil
+}
+
+// adminGet returns the body of a GET from the node's admin API,
+// authenticated as the configured upstream user.
+func adminGet(ctx context.Context, cfg *config.Config, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth(cfg.Upstream.User, cfg.Upstream.Pass)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin api: %s", res.Status)
+	}
+
+	return io.ReadAll(res.Body)
+}
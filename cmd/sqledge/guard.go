@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/rs/zerolog/log"
+)
+
+// guardSlots runs the slot guard on its own, e.g. next to the upstream,
+// to bound the WAL held back by nodes that are offline:
+//
+//	sqledge guard-slots [-once]
+func guardSlots(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("guard-slots", flag.ContinueOnError)
+	once := flags.Bool("once", false, "check the slots once and exit")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if cfg.Replication.SlotGuardMaxBytes <= 0 {
+		return errors.New("SQLEDGE_REPLICATION_SLOT_GUARD_MAX_BYTES isn't set")
+	}
+
+	db, err := sql.Open("pgx", cfg.UpstreamConnString("slot-guard"))
+	if err != nil {
+		return fmt.Errorf("open upstream: %w", err)
+	}
+	defer db.Close()
+
+	guardCfg := slotGuardConfig(cfg)
+
+	if !*once {
+		return replicate.GuardSlots(ctx, db, guardCfg)
+	}
+
+	dropped, err := replicate.GuardSlotsOnce(ctx, db, guardCfg)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("dropped %d slots", len(dropped))
+
+	return nil
+}
+
+func slotGuardConfig(cfg *config.Config) replicate.SlotGuardConfig {
+	return replicate.SlotGuardConfig{
+		Slots:            cfg.Replication.SlotGuardSlots,
+		MaxRetainedBytes: cfg.Replication.SlotGuardMaxBytes,
+		Interval:         cfg.Replication.SlotGuardInterval,
+	}
+}
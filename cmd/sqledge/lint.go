@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/lint"
+	"github.com/rs/zerolog/log"
+)
+
+// lintTables reports what sqledge can't translate in the published
+// tables (or the tables given):
+//
+//	sqledge lint [table...]
+func lintTables(ctx context.Context, cfg *config.Config, args []string) error {
+	warnings, err := checkSchema(ctx, cfg, args)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+
+	if len(warnings) > 0 {
+		return fmt.Errorf("%d warnings", len(warnings))
+	}
+
+	return nil
+}
+
+// logSchemaWarnings logs the lint warnings of the published tables,
+// before they're first copied.
+func logSchemaWarnings(ctx context.Context, cfg *config.Config) {
+	warnings, err := checkSchema(ctx, cfg, cfg.Replication.Tables)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to lint the upstream's tables")
+		return
+	}
+
+	for _, w := range warnings {
+		log.Warn().Msg(w.String())
+	}
+}
+
+func checkSchema(ctx context.Context, cfg *config.Config, tables []string) ([]lint.Warning, error) {
+	db, err := sql.Open("pgx", cfg.UpstreamConnString("lint"))
+	if err != nil {
+		return nil, fmt.Errorf("open upstream: %w", err)
+	}
+	defer db.Close()
+
+	return lint.Check(ctx, db, lint.Config{
+		Schema:      cfg.Upstream.Schema,
+		Tables:      tables,
+		Publication: cfg.Replication.Publication,
+		MaxRowBytes: int64(cfg.Replication.MaxChangeBytes),
+	})
+}
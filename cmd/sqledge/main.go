@@ -2,22 +2,42 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"os"
 
+	"github.com/gemini-kenshi/pgreplsql/pkg/admin"
+	"github.com/gemini-kenshi/pgreplsql/pkg/arrowflight"
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
 	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/events"
+	"github.com/gemini-kenshi/pgreplsql/pkg/graphql"
+	"github.com/gemini-kenshi/pgreplsql/pkg/leader"
+	"github.com/gemini-kenshi/pgreplsql/pkg/live"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
 	"github.com/gemini-kenshi/pgreplsql/pkg/queryproxy"
 	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/ship"
+	"github.com/gemini-kenshi/pgreplsql/pkg/snapshot"
+	"github.com/jackc/pglogrepl"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// recentLogLines is how many log lines a debug dump includes.
+const recentLogLines = 1000
+
 func main() {
 	flag.Parse()
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	// the recent lines are kept for debug dumps
+	logs := admin.NewLogs(recentLogLines)
+	log.Logger = log.Output(zerolog.MultiLevelWriter(zerolog.ConsoleWriter{Out: os.Stderr}, logs))
 	ctx := context.Background()
 
 	cfg, err := config.Load()
@@ -25,11 +45,249 @@ func main() {
 		log.Fatal().Err(err).Msg("failed to parse config")
 	}
 
-	if err := queryproxy.Run(ctx, cfg); err != nil {
+	if flag.Arg(0) == "replay" {
+		if err := replay(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to replay")
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "guard-slots" {
+		if err := guardSlots(ctx, cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to guard slots")
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "convert-schema" {
+		if err := convertSchema(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to convert schema")
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "lint" {
+		if err := lintTables(ctx, cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to lint")
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "verify" {
+		if err := verifyTables(ctx, cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to verify")
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "wait" {
+		if err := waitLSN(ctx, cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to wait")
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "bench" {
+		if err := benchApply(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to bench")
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "restore" {
+		if err := restore(ctx, cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to restore")
+		}
+
+		return
+	}
+
+	if flag.Arg(0) == "debug" {
+		if err := debugDump(ctx, cfg, flag.Args()[1:]); err != nil {
+			log.Fatal().Err(err).Msg("failed to dump")
+		}
+
+		return
+	}
+
+	var adminServer *admin.Server
+
+	if cfg.Admin.Enabled {
+		adminServer = admin.NewServer()
+
+		if err := adminServer.Run(ctx, fmt.Sprintf("%s:%d", cfg.Admin.Address, cfg.Admin.Port)); err != nil {
+			log.Fatal().Err(err).Msg("failed to start admin api")
+		}
+	}
+
+	if cfg.Leader.Enabled {
+		elector := leader.New(cfg.UpstreamConnString("leader"), leader.Key(cfg.Replication.SlotName), cfg.Leader.Interval)
+
+		if adminServer != nil {
+			adminServer.HandleHealth("leader", func() (any, error) {
+				if elector.IsLeader() {
+					return "leader", nil
+				}
+
+				return "standby", errors.New("not the leader")
+			})
+		}
+
+		log.Info().Msg("waiting to become the leader")
+
+		lost, err := elector.Acquire(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to become the leader")
+		}
+
+		log.Info().Msg("became the leader")
+
+		go func() {
+			<-lost
+			// the standby may already be taking over
+			log.Fatal().Msg("lost leadership")
+		}()
+	}
+
+	if _, err := os.Stat(cfg.Local.Path); errors.Is(err, fs.ErrNotExist) {
+		// the tables are about to be copied for the first time
+		logSchemaWarnings(ctx, cfg)
+	}
+
+	if cfg.Local.ShipDir != "" {
+		// before the proxy and the replication open the local
+		// database, as it's switched to WAL mode
+		shipper, err := ship.New(ctx, shipConfig(cfg))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to start shipping the local database")
+		}
+
+		go shipper.Run(ctx)
+	}
+
+	// the proxy and the replication share the memory budget
+	mem := budget.New(cfg.MemoryBudget)
+	// and the bus, the proxy reacts to what the replication applies
+	bus := events.New()
+
+	proxy, err := queryproxy.StartWith(ctx, cfg, queryproxy.Options{Budget: mem, Events: bus})
+	if err != nil {
 		log.Fatal().Err(err).Msg("failed to start sqledge")
 	}
 
-	if err := replicate.Run(ctx, cfg); err != nil {
+	if cfg.Leader.Enabled && cfg.Leader.PromoteHook != "" {
+		// exiting releases the lock, for the standby to try instead
+		if err := leader.Promote(ctx, cfg.Leader.PromoteHook, fmt.Sprintf("%s:%d", cfg.Proxy.Address, cfg.Proxy.Port)); err != nil {
+			log.Fatal().Err(err).Msg("failed to take over the advertised address")
+		}
+	}
+
+	replicator := replicate.New(cfg)
+	replicator.SetBudget(mem)
+	replicator.SetEvents(bus)
+	queryproxy.AddReplicationTables(proxy.Server, replicator.Stats)
+
+	if cfg.Proxy.ColdReadsUpstream {
+		proxy.RouteCold(replicator.Cold)
+	}
+
+	if cfg.Proxy.Startup == pgwire.StartupFailFast {
+		proxy.HoldReads(func() bool {
+			return replicator.Stats().CaughtUp(uint64(cfg.Proxy.StartupMaxLagBytes))
+		})
+	}
+
+	if adminServer != nil {
+		adminServer.HandleSessions(proxy)
+		adminServer.HandleHealth("upstream", func() (any, error) {
+			return proxy.Upstream.Health(), proxy.Upstream.Ready()
+		})
+		var auth admin.Authenticate
+
+		switch cfg.Admin.QueryAuth {
+		case pgwire.AuthTrust:
+		case pgwire.AuthUpstream:
+			auth = queryproxy.UpstreamAuth(cfg)
+		default:
+			log.Fatal().Msgf("unknown query api auth method: %q", cfg.Admin.QueryAuth)
+		}
+
+		if cfg.Admin.Query {
+			adminServer.HandleQuery(proxy, auth)
+		}
+
+		if cfg.Admin.Subscriptions {
+			adminServer.HandleSubscribe(live.Handler(replicator.Changes(), proxy, cfg.Admin.SubscribeOrigins), auth)
+		}
+
+		if cfg.Admin.GraphQL {
+			adminServer.HandleGraphQL(graphql.Handler(proxy), auth)
+		}
+
+		adminServer.HandleSchemas(replicator.Relations)
+
+		// debug logs have the applied rows' values, so like the
+		// snapshot they're served to upstream users whatever the
+		// query api's auth method is.
+		adminServer.HandleDebug(logs, func() any {
+			return replicator.Stats()
+		}, queryproxy.UpstreamAuth(cfg))
+
+		adminServer.HandleWait(func(lsn pglogrepl.LSN) bool {
+			return replicator.Stats().Reached(lsn)
+		}, bus)
+
+		// the snapshot is every replicated row, so it's served to
+		// upstream users whatever the query api's auth method is.
+		adminServer.HandleSnapshot(snapshot.Handler(cfg.Local.Path, replicate.LocalConfig(cfg), func() pglogrepl.LSN {
+			return replicator.Stats().AppliedLSN
+		}), queryproxy.UpstreamAuth(cfg))
+	}
+
+	if cfg.FlightSQL.Address != "" {
+		var auth arrowflight.Authenticate
+
+		switch cfg.FlightSQL.Auth {
+		case pgwire.AuthTrust:
+		case pgwire.AuthUpstream:
+			auth = queryproxy.UpstreamAuth(cfg)
+		default:
+			log.Fatal().Msgf("unknown flight sql auth method: %q", cfg.FlightSQL.Auth)
+		}
+
+		if err := arrowflight.Serve(ctx, cfg.FlightSQL.Address, proxy, auth); err != nil {
+			log.Fatal().Err(err).Msg("failed to start flight sql")
+		}
+	}
+
+	if cfg.Control.Secret != "" {
+		c, err := controller(cfg, proxy, replicator)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open the control journal")
+		}
+
+		replicator.HandleControl(c.Run)
+	}
+
+	if cfg.Replication.SlotGuardMaxBytes > 0 {
+		// a running node's slot is active, so it guards the
+		// slots of the other nodes sharing the upstream.
+		guardDB, err := sql.Open("pgx", cfg.UpstreamConnString("slot-guard"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open slot guard connection")
+		}
+
+		go replicate.GuardSlots(ctx, guardDB, slotGuardConfig(cfg))
+	}
+
+	if err := replicator.Run(ctx); err != nil {
 		log.Fatal().Err(err).Msg("failed in replicate")
 	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// replay rebuilds a local database from debug journals, on top of a base
+// snapshot when one is given:
+//
+//	sqledge replay [-snapshot base.db] [-out replay.db] journal.ndjson.1 journal.ndjson
+func replay(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	snapshotPath := flags.String("snapshot", "", "base snapshot, a copy of a local database, to replay on top of")
+	out := flags.String("out", "./replay.db", "database file to create")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New("usage: sqledge replay [-snapshot base.db] [-out replay.db] <journal>...")
+	}
+
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%s already exists", *out)
+	}
+
+	if *snapshotPath != "" {
+		if err := copyFile(*snapshotPath, *out); err != nil {
+			return fmt.Errorf("copy snapshot: %w", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", *out)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", *out, err)
+	}
+	defer db.Close()
+
+	// the transactions are begun and committed with separate statements
+	db.SetMaxOpenConns(1)
+
+	localCfg := replicate.LocalConfig(cfg)
+	driver := sqlgen.NewSqliteDriver(localCfg, db)
+
+	if _, err := driver.CheckFormat(config.Version); err != nil {
+		return err
+	}
+
+	if err := driver.InitPositionTable(); err != nil {
+		return err
+	}
+
+	if err := driver.InitPreparedTable(); err != nil {
+		return err
+	}
+
+	if localCfg.Provenance {
+		if err := driver.InitProvenanceTable(); err != nil {
+			return err
+		}
+	}
+
+	if len(localCfg.MessagePrefixes) > 0 {
+		if err := driver.InitMessagesTable(); err != nil {
+			return err
+		}
+	}
+
+	pos, err := driver.Pos()
+	if err != nil {
+		return err
+	}
+
+	var from pglogrepl.LSN
+
+	if pos != "" {
+		if from, err = pglogrepl.ParseLSN(pos); err != nil {
+			return fmt.Errorf("parse snapshot position: %w", err)
+		}
+	}
+
+	schema, err := driver.CurrentSchema()
+	if err != nil {
+		return fmt.Errorf("get current schema: %w", err)
+	}
+
+	var entries []replicate.JournalEntry
+
+	for _, path := range flags.Args() {
+		e, err := replicate.ReadJournal(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		entries = append(entries, e...)
+	}
+
+	log.Info().Msgf("replaying %d journal entries from %s", len(entries), from)
+
+	applied, err := replicate.Replay(entries, from, cfg.Upstream.Schema, driver, sqlgen.NewSqlite(localCfg, schema))
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("replayed to %s into %s", applied, *out)
+
+	return nil
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/ship"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// restore writes the local database shipped to a directory, after the
+// files are downloaded from object storage if they were uploaded there,
+// for the node to start from:
+//
+//	sqledge restore -out ./sqledge.db [-dir ./shipped] [-generation <generation>] [-lsn 0/16B3748]
+func restore(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dir := flags.String("dir", cfg.Local.ShipDir, "directory the local database was shipped to")
+	generation := flags.String("generation", "", "generation to restore, the latest by default")
+	lsnFlag := flags.String("lsn", "", "restore up to the upstream position, rather than all that was shipped")
+	out := flags.String("out", cfg.Local.Path, "the restored database, it mustn't exist")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		return errors.New("usage: sqledge restore -dir <dir> [-generation <generation>] [-lsn <lsn>] [-out <path>]")
+	}
+
+	var lsn pglogrepl.LSN
+
+	if *lsnFlag != "" {
+		var err error
+		if lsn, err = pglogrepl.ParseLSN(*lsnFlag); err != nil {
+			return fmt.Errorf("parse -lsn: %w", err)
+		}
+	}
+
+	restored, err := ship.Restore(ctx, *dir, *generation, lsn, *out)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("restored %s at %s", *out, restored)
+
+	return nil
+}
+
+func shipConfig(cfg *config.Config) ship.Config {
+	return ship.Config{
+		Path:            cfg.Local.Path,
+		DSN:             cfg.Local.DSN(),
+		Dir:             cfg.Local.ShipDir,
+		Interval:        cfg.Local.ShipInterval,
+		CheckpointBytes: cfg.Local.ShipCheckpointBytes,
+		Hook:            cfg.Local.ShipHook,
+		Retain:          cfg.Local.ShipRetain,
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/gemini-kenshi/pgreplsql/pkg/verify"
+	"github.com/rs/zerolog/log"
+)
+
+// verifyTables compares the local tables with the upstream's, and with
+// -repair copies the ranges of keys that diverged from the upstream again:
+//
+//	sqledge verify [-repair] [-chunk 10000] [table...]
+func verifyTables(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "replace the local rows of diverged ranges with the upstream's")
+	chunk := flags.Int64("chunk", 10000, "keys compared at a time, for tables with an integer primary key")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	upstream, err := sql.Open("pgx", cfg.UpstreamConnString("verify"))
+	if err != nil {
+		return fmt.Errorf("open upstream: %w", err)
+	}
+	defer upstream.Close()
+
+	local, err := sql.Open("sqlite", cfg.Local.DSN())
+	if err != nil {
+		return fmt.Errorf("open %s: %w", cfg.Local.Path, err)
+	}
+	defer local.Close()
+
+	names := flags.Args()
+
+	if len(names) == 0 {
+		rollups, err := replicate.ParseRollups(cfg.Local.Rollups)
+		if err != nil {
+			return err
+		}
+
+		if names, err = localTables(ctx, local, rollups); err != nil {
+			return err
+		}
+	}
+
+	var diverged int
+
+	for _, name := range names {
+		t, err := verify.Describe(ctx, upstream, local, cfg.Upstream.Schema, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		ranges, err := verify.Diff(ctx, upstream, local, t, *chunk)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if len(ranges) == 0 {
+			log.Info().Msgf("%s matches the upstream", name)
+			continue
+		}
+
+		for _, r := range ranges {
+			if !*repair {
+				log.Warn().Msgf("%s differs from the upstream", r)
+				diverged++
+
+				continue
+			}
+
+			n, err := verify.Repair(ctx, upstream, local, t, r)
+			if err != nil {
+				return fmt.Errorf("repair %s: %w", r, err)
+			}
+
+			log.Info().Msgf("repaired %s, copied %d rows", r, n)
+		}
+	}
+
+	if diverged > 0 {
+		return fmt.Errorf("%d ranges differ from the upstream", diverged)
+	}
+
+	return nil
+}
+
+// localTables lists the replicated tables of the local database, leaving
+// out sqledge's own tables and the rollups kept locally.
+func localTables(ctx context.Context, db *sql.DB, rollups []replicate.Rollup) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_schema
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+		ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("list local tables: %w", err)
+	}
+
+	var names []string
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("list local tables: %w", err)
+		}
+
+		rollup := slices.ContainsFunc(rollups, func(r replicate.Rollup) bool { return r.Name == name })
+		if !sqlgen.Internal(name) && !rollup {
+			names = append(names, name)
+		}
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, fmt.Errorf("list local tables: %w", err)
+	}
+
+	return names, nil
+}
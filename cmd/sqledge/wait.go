@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// waitLSN waits until a running node, through its admin API, has applied
+// the upstream's changes up to the lsn, e.g. the upstream's
+// pg_current_wal_lsn() after a migration:
+//
+//	sqledge wait -lsn 0/16B3748 [-timeout 10m] [-admin http://localhost:5480]
+func waitLSN(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("wait", flag.ContinueOnError)
+	lsnFlag := flags.String("lsn", "", "upstream position to wait for")
+	timeout := flags.Duration("timeout", 10*time.Minute, "how long to wait")
+	admin := flags.String("admin", fmt.Sprintf("http://%s:%d", cfg.Admin.Address, cfg.Admin.Port), "the node's admin API")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	lsn, err := pglogrepl.ParseLSN(*lsnFlag)
+	if err != nil {
+		return fmt.Errorf("usage: sqledge wait -lsn <lsn> [-timeout 10m] [-admin url]: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	for {
+		err := waitOnce(ctx, *admin, lsn)
+		if err == nil {
+			log.Info().Msgf("applied %s", lsn)
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s not applied after %s: %w", lsn, *timeout, err)
+		}
+
+		// the node may be restarting, as in a rollout
+		log.Debug().Err(err).Msg("waiting")
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitOnce waits on the admin API until the lsn is applied, or
+// its own timeout, returning an error when it's not applied yet.
+func waitOnce(ctx context.Context, admin string, lsn pglogrepl.LSN) error {
+	wait := time.Until(deadline(ctx))
+	if wait > time.Minute {
+		wait = time.Minute
+	}
+
+	q := url.Values{"lsn": {lsn.String()}, "timeout": {wait.String()}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, admin+"/wait?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.Error == "" {
+		return fmt.Errorf("admin api: %s", res.Status)
+	}
+
+	return errors.New(body.Error)
+}
+
+func deadline(ctx context.Context) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return d
+	}
+
+	return time.Now().Add(time.Minute)
+}
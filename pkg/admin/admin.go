@@ -0,0 +1,313 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/events"
+	"github.com/gemini-kenshi/pgreplsql/pkg/jsonschema"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// Sessions are the proxy's client sessions.
+type Sessions interface {
+	Sessions() []pgwire.SessionInfo
+	SetTrace(id uint32, on bool) error
+}
+
+// Server is the admin HTTP API.
+type Server struct {
+	mux *http.ServeMux
+}
+
+func NewServer() *Server {
+	return &Server{mux: http.NewServeMux()}
+}
+
+// HandleSessions serves the endpoints for listing and
+// tracing the proxy's client sessions:
+//
+//	GET    /sessions
+//	PUT    /sessions/{id}/trace
+//	DELETE /sessions/{id}/trace
+func (s *Server) HandleSessions(sessions Sessions) {
+	s.mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, sessions.Sessions())
+	})
+
+	trace := func(on bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid session id: %w", err))
+				return
+			}
+
+			if err := sessions.SetTrace(uint32(id), on); err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, pgwire.ErrUnknownSession) {
+					status = http.StatusNotFound
+				}
+
+				writeError(w, status, err)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+
+	s.mux.HandleFunc("PUT /sessions/{id}/trace", trace(true))
+	s.mux.HandleFunc("DELETE /sessions/{id}/trace", trace(false))
+}
+
+// Check returns a component's status, and an error when it isn't ready.
+type Check func() (status any, err error)
+
+// HandleHealth serves the component's status, with a
+// 503 when the check fails:
+//
+//	GET /health/{name}
+func (s *Server) HandleHealth(name string, check Check) {
+	s.mux.HandleFunc("GET /health/"+name, func(w http.ResponseWriter, r *http.Request) {
+		status, err := check()
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": status, "error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{"status": status})
+	})
+}
+
+// HandleSnapshot serves a copy of the local database for
+// bootstrapping other nodes, to clients authenticated with auth:
+//
+//	GET /snapshot?min_lsn={lsn}
+func (s *Server) HandleSnapshot(snapshot http.Handler, auth Authenticate) {
+	s.mux.Handle("GET /snapshot", authenticated(auth, snapshot))
+}
+
+// Reached reports whether the node has applied the upstream's changes up to lsn.
+type Reached func(lsn pglogrepl.LSN) bool
+
+// DefaultWaitTimeout is how long a wait lasts when it doesn't set a timeout.
+const DefaultWaitTimeout = 30 * time.Second
+
+// waitPoll is how often a wait checks the applied position, besides
+// when the bus publishes a change applied.
+const waitPoll = 100 * time.Millisecond
+
+// HandleWait serves waiting until the node has applied the upstream's
+// changes up to the lsn, with a 504 when it hasn't by the timeout. Waits
+// wake as the bus publishes the changes applied, when it isn't nil:
+//
+//	GET /wait?lsn={lsn}&timeout={duration}
+func (s *Server) HandleWait(reached Reached, bus *events.Bus) {
+	s.mux.HandleFunc("GET /wait", func(w http.ResponseWriter, r *http.Request) {
+		lsn, err := pglogrepl.ParseLSN(r.URL.Query().Get("lsn"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid lsn: %w", err))
+			return
+		}
+
+		timeout := DefaultWaitTimeout
+
+		if t := r.URL.Query().Get("timeout"); t != "" {
+			if timeout, err = time.ParseDuration(t); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout: %w", err))
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		applied, unsubscribe := bus.Subscribe(events.ChangeApplied)
+		defer unsubscribe()
+
+		tick := time.NewTicker(waitPoll)
+		defer tick.Stop()
+
+		for !reached(lsn) {
+			select {
+			case <-ctx.Done():
+				writeError(w, http.StatusGatewayTimeout, fmt.Errorf("%s not applied after %s", lsn, timeout))
+				return
+			case <-applied:
+			case <-tick.C:
+			}
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{"lsn": lsn.String(), "reached": true})
+	})
+}
+
+// Relations returns the relation metadata of the replicated tables.
+type Relations func() []*pglogrepl.RelationMessageV2
+
+// HandleSchemas serves JSON Schema documents of the replicated tables'
+// rows, all of them as OpenAPI components, or one table's, by its
+// schema qualified or bare name:
+//
+//	GET /schemas
+//	GET /schemas/{table}
+func (s *Server) HandleSchemas(relations Relations) {
+	s.mux.HandleFunc("GET /schemas", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jsonschema.Components(relations()))
+	})
+
+	s.mux.HandleFunc("GET /schemas/{table}", func(w http.ResponseWriter, r *http.Request) {
+		table := r.PathValue("table")
+
+		for _, rel := range relations() {
+			if table == rel.Namespace+"."+rel.RelationName || table == rel.RelationName {
+				writeJSON(w, http.StatusOK, jsonschema.Document(rel))
+				return
+			}
+		}
+
+		writeError(w, http.StatusNotFound, fmt.Errorf("no relation metadata for table %q", table))
+	})
+}
+
+// Authenticate checks a user's password.
+type Authenticate func(ctx context.Context, user, password string) error
+
+// QueryRequest is the body of a query, the params are
+// bound to the query's $n placeholders.
+type QueryRequest struct {
+	SQL    string `json:"sql"`
+	Params []any  `json:"params"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// HandleQuery serves reads from the local database as JSON, the
+// request's basic auth credentials are checked with auth, when set:
+//
+//	POST /query
+func (s *Server) HandleQuery(reader pgwire.Reader, auth Authenticate) {
+	s.mux.Handle("POST /query", authenticated(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req QueryRequest
+
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+
+		for i, p := range req.Params {
+			req.Params[i] = pgwire.Param(p)
+		}
+
+		res, err := reader.Read(r.Context(), req.Tenant, req.SQL, req.Params)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, pgwire.ErrNotRead) {
+				status = http.StatusForbidden
+			}
+
+			writeError(w, status, err)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	})))
+}
+
+// authenticated checks the request's basic auth credentials
+// with auth before serving it, when auth is set.
+func authenticated(auth Authenticate, next http.Handler) http.Handler {
+	if auth == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sqledge"`)
+			writeError(w, http.StatusUnauthorized, errors.New("authentication required"))
+
+			return
+		}
+
+		if err := auth(r.Context(), user, password); err != nil {
+			log.Info().Err(err).Msgf("admin api: authentication failed for user %q", user)
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="sqledge"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("password authentication failed for user %q", user))
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleSubscribe serves live query subscriptions over WebSocket, the
+// request's basic auth credentials are checked with auth, when set:
+//
+//	GET /subscribe
+func (s *Server) HandleSubscribe(subscribe http.Handler, auth Authenticate) {
+	s.mux.Handle("GET /subscribe", authenticated(auth, subscribe))
+}
+
+// HandleGraphQL serves a GraphQL API over the local database, the
+// request's basic auth credentials are checked with auth, when set:
+//
+//	GET  /graphql
+//	POST /graphql
+func (s *Server) HandleGraphQL(graphql http.Handler, auth Authenticate) {
+	s.mux.Handle("GET /graphql", authenticated(auth, graphql))
+	s.mux.Handle("POST /graphql", authenticated(auth, graphql))
+}
+
+// Run serves the admin API on addr until the context is done.
+func (s *Server) Run(ctx context.Context, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	srv := &http.Server{Handler: s.mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	go func() {
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("admin server")
+		}
+	}()
+
+	log.Debug().Msgf("admin api listening on %s", addr)
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("write admin response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
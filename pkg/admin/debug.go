@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"bytes"
+	"net/http"
+	"runtime/pprof"
+	"sync"
+)
+
+// Logs keeps the node's most recent log lines in memory, so a debug
+// dump can include them. It's a zerolog writer, one event per write.
+type Logs struct {
+	mu    sync.Mutex
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+// NewLogs keeps the last n log lines.
+func NewLogs(n int) *Logs {
+	return &Logs{lines: make([][]byte, max(n, 1))}
+}
+
+func (l *Logs) Write(p []byte) (int, error) {
+	line := bytes.Clone(p)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % len(l.lines)
+
+	if l.next == 0 {
+		l.full = true
+	}
+
+	return len(p), nil
+}
+
+// Bytes returns the kept log lines, oldest first.
+func (l *Logs) Bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf bytes.Buffer
+
+	if l.full {
+		for _, line := range l.lines[l.next:] {
+			buf.Write(line)
+		}
+	}
+
+	for _, line := range l.lines[:l.next] {
+		buf.Write(line)
+	}
+
+	return buf.Bytes()
+}
+
+// Status returns the node's status, e.g. the replication's stats.
+type Status func() any
+
+// HandleDebug serves what a debug dump gathers from a running node: its
+// recent log lines, its status and the stacks of its goroutines. The logs
+// and stacks can have rows' values in them, they're only served to clients
+// authenticated with auth:
+//
+//	GET /debug/logs
+//	GET /debug/status
+//	GET /debug/goroutines
+func (s *Server) HandleDebug(logs *Logs, status Status, auth Authenticate) {
+	s.mux.Handle("GET /debug/logs", authenticated(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write(logs.Bytes())
+	})))
+
+	s.mux.HandleFunc("GET /debug/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, status())
+	})
+
+	s.mux.Handle("GET /debug/goroutines", authenticated(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		pprof.Lookup("goroutine").WriteTo(w, 2)
+	})))
+}
@@ -0,0 +1,89 @@
+package arrowflight
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow/flight"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tokenTTL is how long a token from a handshake is accepted.
+const tokenTTL = time.Hour
+
+// Authenticate checks a user's password.
+type Authenticate func(ctx context.Context, user, password string) error
+
+// tokens authenticates clients with basic auth in the handshake, as the
+// Flight SQL drivers do, and then with the bearer token it returns.
+type tokens struct {
+	ctx  context.Context
+	auth Authenticate
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+	users   map[string]string
+}
+
+// middleware authenticates requests with auth, when set.
+func middleware(ctx context.Context, auth Authenticate) []flight.ServerMiddleware {
+	if auth == nil {
+		return nil
+	}
+
+	return []flight.ServerMiddleware{flight.CreateServerBasicAuthMiddleware(&tokens{
+		ctx:     ctx,
+		auth:    auth,
+		expires: map[string]time.Time{},
+		users:   map[string]string{},
+	})}
+}
+
+func (t *tokens) Validate(user, password string) (string, error) {
+	if err := t.auth(t.ctx, user, password); err != nil {
+		log.Info().Err(err).Msgf("flight sql: authentication failed for user %q", user)
+
+		return "", status.Errorf(codes.Unauthenticated, "password authentication failed for user %q", user)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", status.Errorf(codes.Internal, "create token: %s", err)
+	}
+
+	token := hex.EncodeToString(b)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	for tok, expires := range t.expires {
+		if now.After(expires) {
+			delete(t.expires, tok)
+			delete(t.users, tok)
+		}
+	}
+
+	t.expires[token] = now.Add(tokenTTL)
+	t.users[token] = user
+
+	return token, nil
+}
+
+func (t *tokens) IsValid(token string) (any, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expires, ok := t.expires[token]
+	if !ok || time.Now().After(expires) {
+		return nil, status.Error(codes.Unauthenticated, "invalid or expired token")
+	}
+
+	return t.users[token], nil
+}
@@ -0,0 +1,3 @@
+package arrowflight
+
+var Middleware = middleware
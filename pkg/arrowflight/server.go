@@ -0,0 +1,371 @@
+// Package arrowflight serves the local database over Arrow Flight SQL, so
+// analytics clients, like ADBC and JDBC drivers, can read columnar data.
+package arrowflight
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/flight"
+	"github.com/apache/arrow/go/v15/arrow/flight/flightsql"
+	"github.com/apache/arrow/go/v15/arrow/flight/flightsql/schema_ref"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// batchRows is the number of rows in each record batch.
+const batchRows = 64 * 1024
+
+// Server is a read-only Flight SQL server, statements are
+// read like the proxy's reads.
+type Server struct {
+	flightsql.BaseServer
+	reader pgwire.Reader
+}
+
+func NewServer(reader pgwire.Reader) (*Server, error) {
+	s := &Server{reader: reader}
+	s.Alloc = memory.DefaultAllocator
+
+	for info, v := range map[flightsql.SqlInfo]any{
+		flightsql.SqlInfoFlightSqlServerName:     "sqledge",
+		flightsql.SqlInfoFlightSqlServerReadOnly: true,
+		flightsql.SqlInfoFlightSqlServerSql:      true,
+	} {
+		if err := s.RegisterSqlInfo(info, v); err != nil {
+			return nil, fmt.Errorf("register sql info: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Serve serves Flight SQL on addr until the context is done, clients
+// are authenticated with auth when it's set.
+func Serve(ctx context.Context, addr string, reader pgwire.Reader, auth Authenticate) error {
+	srv, err := NewServer(reader)
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	server := flight.NewServerWithMiddleware(middleware(ctx, auth))
+	server.InitListener(lis)
+	server.RegisterFlightService(flightsql.NewFlightServer(srv))
+
+	go func() {
+		<-ctx.Done()
+		server.Shutdown()
+	}()
+
+	go func() {
+		if err := server.Serve(); err != nil {
+			log.Error().Err(err).Msg("flight sql server")
+		}
+	}()
+
+	log.Debug().Msgf("flight sql listening on %s", addr)
+
+	return nil
+}
+
+// GetFlightInfoStatement returns a ticket with the query, which
+// is read when the client gets the ticket.
+func (s *Server) GetFlightInfoStatement(_ context.Context, cmd flightsql.StatementQuery, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	if len(cmd.GetTransactionId()) > 0 {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't supported")
+	}
+
+	if !pgwire.IsRead(strings.TrimSpace(cmd.GetQuery())) {
+		return nil, status.Error(codes.PermissionDenied, pgwire.ErrNotRead.Error())
+	}
+
+	ticket, err := flightsql.CreateStatementQueryTicket([]byte(cmd.GetQuery()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "create ticket: %s", err)
+	}
+
+	return &flight.FlightInfo{
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: ticket}}},
+		FlightDescriptor: desc,
+		TotalRecords:     -1,
+		TotalBytes:       -1,
+	}, nil
+}
+
+func (s *Server) DoGetStatement(ctx context.Context, ticket flightsql.StatementQueryTicket) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	query := string(ticket.GetStatementHandle())
+
+	if !pgwire.IsRead(strings.TrimSpace(query)) {
+		return nil, nil, status.Error(codes.PermissionDenied, pgwire.ErrNotRead.Error())
+	}
+
+	rows, err := s.reader.ReadRows(ctx, "", query, nil)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	fields := make([]arrow.Field, len(rows.Columns))
+	for i, name := range rows.Columns {
+		fields[i] = arrow.Field{Name: name, Type: arrowType(rows.Types[i]), Nullable: true}
+	}
+
+	schema := arrow.NewSchema(fields, nil)
+
+	return schema, s.stream(ctx, schema, rows), nil
+}
+
+// rowReader reads rows one at a time, returning io.EOF after the
+// last one, like pgwire.Rows.
+type rowReader interface {
+	Next() ([]any, error)
+	Close()
+}
+
+// sliceRows reads rows already in memory.
+type sliceRows [][]any
+
+func (r *sliceRows) Next() ([]any, error) {
+	if len(*r) == 0 {
+		return nil, io.EOF
+	}
+
+	row := (*r)[0]
+	*r = (*r)[1:]
+
+	return row, nil
+}
+
+func (r *sliceRows) Close() {}
+
+// stream sends the rows in record batches of up to batchRows as they're
+// read, until the client's request is done. The rows are closed after.
+func (s *Server) stream(ctx context.Context, schema *arrow.Schema, rows rowReader) <-chan flight.StreamChunk {
+	ch := make(chan flight.StreamChunk)
+
+	go func() {
+		defer close(ch)
+		defer rows.Close()
+
+		b := array.NewRecordBuilder(s.Alloc, schema)
+		defer b.Release()
+
+		for sent := false; ; sent = true {
+			n, err := readBatch(b, rows)
+			if err != nil {
+				select {
+				case ch <- flight.StreamChunk{Err: status.Error(codes.Internal, err.Error())}:
+				case <-ctx.Done():
+				}
+
+				return
+			}
+
+			// an empty result is still sent as one empty batch
+			if n == 0 && sent {
+				return
+			}
+
+			rec := b.NewRecord()
+
+			select {
+			case ch <- flight.StreamChunk{Data: rec}:
+			case <-ctx.Done():
+				rec.Release()
+				return
+			}
+
+			if n < batchRows {
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// readBatch appends up to batchRows rows to the builder,
+// and returns how many were appended.
+func readBatch(b *array.RecordBuilder, rows rowReader) (int, error) {
+	for n := 0; n < batchRows; n++ {
+		row, err := rows.Next()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		for i, v := range row {
+			appendValue(b.Field(i), v)
+		}
+	}
+
+	return batchRows, nil
+}
+
+func arrowType(oid uint32) arrow.DataType {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+		return arrow.PrimitiveTypes.Int64
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		return arrow.PrimitiveTypes.Float64
+	case pgtype.ByteaOID:
+		return arrow.BinaryTypes.Binary
+	}
+
+	return arrow.BinaryTypes.String
+}
+
+// appendValue appends the read value, which is a json.Number for
+// numeric columns and a string otherwise. Values that don't fit
+// the column's type, which sqlite allows, are appended as nulls.
+func appendValue(b array.Builder, v any) {
+	if v == nil {
+		b.AppendNull()
+		return
+	}
+
+	text := fmt.Sprint(v)
+	if n, ok := v.(json.Number); ok {
+		text = n.String()
+	}
+
+	switch b := b.(type) {
+	case *array.Int64Builder:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			b.AppendNull()
+			return
+		}
+
+		b.Append(n)
+	case *array.Float64Builder:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			b.AppendNull()
+			return
+		}
+
+		b.Append(f)
+	case *array.BinaryBuilder:
+		b.Append([]byte(text))
+	case *array.StringBuilder:
+		b.Append(text)
+	default:
+		b.AppendNull()
+	}
+}
+
+func (s *Server) GetFlightInfoTables(_ context.Context, cmd flightsql.GetTables, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	schema := schema_ref.Tables
+	if cmd.GetIncludeSchema() {
+		schema = schema_ref.TablesWithIncludedSchema
+	}
+
+	return s.flightInfo(desc, schema), nil
+}
+
+// DoGetTables lists the replicated tables, the table name filter
+// is a LIKE pattern as in the Flight SQL spec.
+func (s *Server) DoGetTables(ctx context.Context, cmd flightsql.GetTables) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	query := "SELECT tbl_name, sql FROM sqlite_schema WHERE type = 'table' AND tbl_name NOT LIKE 'sqlite_%'"
+
+	var args []any
+
+	if p := cmd.GetTableNameFilterPattern(); p != nil {
+		query += " AND tbl_name LIKE $1"
+		args = append(args, *p)
+	}
+
+	res, err := s.reader.Read(ctx, "", query+" ORDER BY tbl_name", args)
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+
+	schema := schema_ref.Tables
+	if cmd.GetIncludeSchema() {
+		schema = schema_ref.TablesWithIncludedSchema
+	}
+
+	var rows sliceRows
+
+	for _, row := range res.Rows {
+		name, _ := row[0].(string)
+		if sqlgen.Internal(name) {
+			continue
+		}
+
+		out := []any{nil, nil, name, "table"}
+
+		if cmd.GetIncludeSchema() {
+			tableSchema, err := tableSchema(row[1])
+			if err != nil {
+				return nil, nil, status.Errorf(codes.Internal, "table %q: %s", name, err)
+			}
+
+			out = append(out, string(flight.SerializeSchema(tableSchema, s.Alloc)))
+		}
+
+		rows = append(rows, out)
+	}
+
+	return schema, s.stream(ctx, schema, &rows), nil
+}
+
+// tableSchema is the arrow schema of the table's columns.
+func tableSchema(ddl any) (*arrow.Schema, error) {
+	sql, _ := ddl.(string)
+
+	_, cols, err := sqlgen.NewParser(sql).Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]arrow.Field, len(cols))
+
+	for i, col := range cols {
+		oid, _ := col.Type.PgType()
+		fields[i] = arrow.Field{Name: col.Name, Type: arrowType(uint32(oid)), Nullable: !col.PrimaryKey}
+	}
+
+	return arrow.NewSchema(fields, nil), nil
+}
+
+func (s *Server) GetFlightInfoTableTypes(_ context.Context, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	return s.flightInfo(desc, schema_ref.TableTypes), nil
+}
+
+func (s *Server) DoGetTableTypes(ctx context.Context) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	return schema_ref.TableTypes, s.stream(ctx, schema_ref.TableTypes, &sliceRows{{"table"}}), nil
+}
+
+// flightInfo returns a ticket with the command, for the
+// metadata requests that are answered from the command.
+func (s *Server) flightInfo(desc *flight.FlightDescriptor, schema *arrow.Schema) *flight.FlightInfo {
+	return &flight.FlightInfo{
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: desc.Cmd}}},
+		FlightDescriptor: desc,
+		Schema:           flight.SerializeSchema(schema, s.Alloc),
+		TotalRecords:     -1,
+		TotalBytes:       -1,
+	}
+}
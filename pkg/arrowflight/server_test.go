@@ -0,0 +1,146 @@
+package arrowflight_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/flight"
+	"github.com/apache/arrow/go/v15/arrow/flight/flightsql"
+	"github.com/gemini-kenshi/pgreplsql/pkg/arrowflight"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestFlightSQL(t *testing.T) {
+	local, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+
+	local.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		"CREATE TABLE names (id integer, name text, score real, PRIMARY KEY (id));",
+		"CREATE TABLE postgres_pos (source_db text, plugin text, publication text, pos text);",
+		"INSERT INTO names VALUES (1, 'Hello', 1.5), (2, NULL, 2);",
+	} {
+		_, err := local.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	srv, err := arrowflight.NewServer(pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local))
+	require.NoError(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := flight.NewServerWithMiddleware(nil)
+	server.InitListener(lis)
+	server.RegisterFlightService(flightsql.NewFlightServer(srv))
+
+	go server.Serve()
+	t.Cleanup(server.Shutdown)
+
+	client, err := flightsql.NewClient(lis.Addr().String(), nil, nil, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	ctx := context.Background()
+
+	read := func(info *flight.FlightInfo) arrow.Record {
+		rdr, err := client.DoGet(ctx, info.Endpoint[0].Ticket)
+		require.NoError(t, err)
+		t.Cleanup(rdr.Release)
+
+		require.True(t, rdr.Next())
+
+		return rdr.Record()
+	}
+
+	info, err := client.Execute(ctx, "SELECT id, name, score FROM names ORDER BY id")
+	require.NoError(t, err)
+
+	rec := read(info)
+
+	assert.Equal(t, arrow.NewSchema([]arrow.Field{
+		{Name: "id", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		{Name: "name", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "score", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	}, nil), rec.Schema())
+	assert.Equal(t, []int64{1, 2}, rec.Column(0).(*array.Int64).Int64Values())
+	assert.Equal(t, "Hello", rec.Column(1).(*array.String).Value(0))
+	assert.True(t, rec.Column(1).IsNull(1))
+	assert.Equal(t, []float64{1.5, 2}, rec.Column(2).(*array.Float64).Float64Values())
+
+	info, err = client.GetTables(ctx, &flightsql.GetTablesOpts{})
+	require.NoError(t, err)
+
+	rec = read(info)
+	require.EqualValues(t, 1, rec.NumRows())
+	assert.Equal(t, "names", rec.Column(2).(*array.String).Value(0))
+
+	_, err = client.Execute(ctx, "DELETE FROM names")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestFlightSQLAuth(t *testing.T) {
+	local, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+
+	srv, err := arrowflight.NewServer(pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local))
+	require.NoError(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	auth := func(_ context.Context, user, password string) error {
+		if user != "app" || password != "secret" {
+			return errors.New("wrong password")
+		}
+
+		return nil
+	}
+
+	server := flight.NewServerWithMiddleware(arrowflight.Middleware(context.Background(), auth))
+	server.InitListener(lis)
+	server.RegisterFlightService(flightsql.NewFlightServer(srv))
+
+	go server.Serve()
+	t.Cleanup(server.Shutdown)
+
+	client, err := flightsql.NewClient(lis.Addr().String(), nil, nil, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	ctx := context.Background()
+
+	_, err = client.Execute(ctx, "SELECT 1")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.Client.AuthenticateBasicToken(ctx, "app", "wrong")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	authCtx, err := client.Client.AuthenticateBasicToken(ctx, "app", "secret")
+	require.NoError(t, err)
+
+	info, err := client.Execute(authCtx, "SELECT 1")
+	require.NoError(t, err)
+
+	rdr, err := client.DoGet(authCtx, info.Endpoint[0].Ticket)
+	require.NoError(t, err)
+	t.Cleanup(rdr.Release)
+
+	require.True(t, rdr.Next())
+	assert.EqualValues(t, 1, rdr.Record().NumRows())
+}
@@ -0,0 +1,304 @@
+// Package bench measures how fast row changes are applied to the local
+// database, so the batching and group commit settings can be chosen on
+// the hardware sqledge runs on.
+package bench
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Shape is the columns of a benchmarked table and the values of its rows.
+type Shape struct {
+	Name    string
+	Columns []*pglogrepl.RelationMessageColumn
+	// Row returns the text values of the i'th row.
+	Row func(i int) [][]byte
+}
+
+// Shapes are the row shapes benchmarked by default.
+var Shapes = []Shape{Narrow(), Wide(), JSON(), Blob()}
+
+// ShapeByName returns the shape of Shapes with the name.
+func ShapeByName(name string) (Shape, bool) {
+	for _, s := range Shapes {
+		if s.Name == name {
+			return s, true
+		}
+	}
+
+	return Shape{}, false
+}
+
+// Narrow rows are a key and a short name, like lookup tables.
+func Narrow() Shape {
+	return Shape{
+		Name: "narrow",
+		Columns: []*pglogrepl.RelationMessageColumn{
+			{Flags: 1, Name: "id", DataType: pgtype.Int8OID},
+			{Name: "name", DataType: pgtype.TextOID},
+		},
+		Row: func(i int) [][]byte {
+			return [][]byte{strconv.AppendInt(nil, int64(i), 10), []byte("name " + strconv.Itoa(i))}
+		},
+	}
+}
+
+// Wide rows have 32 columns of mixed types, like orders or events.
+func Wide() Shape {
+	cols := []*pglogrepl.RelationMessageColumn{{Flags: 1, Name: "id", DataType: pgtype.Int8OID}}
+
+	for c := 1; c < 32; c++ {
+		typ := uint32(pgtype.TextOID)
+
+		switch c % 4 {
+		case 1:
+			typ = pgtype.Int4OID
+		case 2:
+			typ = pgtype.Float8OID
+		case 3:
+			typ = pgtype.TimestamptzOID
+		}
+
+		cols = append(cols, &pglogrepl.RelationMessageColumn{Name: fmt.Sprintf("c%d", c), DataType: typ})
+	}
+
+	return Shape{
+		Name:    "wide",
+		Columns: cols,
+		Row: func(i int) [][]byte {
+			row := make([][]byte, len(cols))
+			row[0] = strconv.AppendInt(nil, int64(i), 10)
+
+			for c := 1; c < len(cols); c++ {
+				switch c % 4 {
+				case 1:
+					row[c] = strconv.AppendInt(nil, int64(i*c), 10)
+				case 2:
+					row[c] = strconv.AppendFloat(nil, float64(i)/float64(c), 'g', -1, 64)
+				case 3:
+					row[c] = []byte("2024-05-01 12:00:00+00")
+				default:
+					row[c] = []byte(fmt.Sprintf("value %d of %d", c, i))
+				}
+			}
+
+			return row
+		},
+	}
+}
+
+// JSON rows carry a document of about 1 KiB.
+func JSON() Shape {
+	doc := `{"items": [` + strings.Repeat(`{"sku": "abc-123", "qty": 1, "price": 9.99}, `, 22) + `{}]}`
+
+	return Shape{
+		Name: "json",
+		Columns: []*pglogrepl.RelationMessageColumn{
+			{Flags: 1, Name: "id", DataType: pgtype.Int8OID},
+			{Name: "doc", DataType: pgtype.JSONBOID},
+		},
+		Row: func(i int) [][]byte {
+			return [][]byte{strconv.AppendInt(nil, int64(i), 10), []byte(doc)}
+		},
+	}
+}
+
+// Blob rows carry 4 KiB of bytea, like thumbnails.
+func Blob() Shape {
+	data := `\x` + hex.EncodeToString(make([]byte, 4<<10))
+
+	return Shape{
+		Name: "blob",
+		Columns: []*pglogrepl.RelationMessageColumn{
+			{Flags: 1, Name: "id", DataType: pgtype.Int8OID},
+			{Name: "data", DataType: pgtype.ByteaOID},
+		},
+		Row: func(i int) [][]byte {
+			return [][]byte{strconv.AppendInt(nil, int64(i), 10), []byte(data)}
+		},
+	}
+}
+
+// Config is how the rows are applied.
+type Config struct {
+	// Rows is the number of rows inserted.
+	Rows int
+	// TxRows is the number of rows in each upstream transaction.
+	TxRows int
+	// GroupCommit is the number of upstream transactions committed in
+	// one local transaction, as with group commit in the replication.
+	GroupCommit int
+	// Text formats the values into the sql instead of binding them.
+	Text bool
+	// Local is the config of the local database.
+	Local sqlgen.SqliteConfig
+}
+
+// Result is how long applying the rows took.
+type Result struct {
+	Shape   string
+	Rows    int
+	Elapsed time.Duration
+}
+
+// RowsPerSecond is the apply throughput.
+func (r Result) RowsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(r.Rows) / r.Elapsed.Seconds()
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%-8s %9d rows %12s %12.0f rows/s", r.Shape, r.Rows, r.Elapsed.Round(time.Millisecond), r.RowsPerSecond())
+}
+
+// Apply inserts the shape's rows into a table of the database the way
+// the replication applies them, and times it. The database must only be
+// opened with one connection, as the transactions are begun and
+// committed with separate statements.
+func Apply(db *sql.DB, shape Shape, cfg Config) (Result, error) {
+	if cfg.Rows <= 0 {
+		return Result{}, errors.New("no rows to apply")
+	}
+
+	if cfg.TxRows <= 0 {
+		cfg.TxRows = 1
+	}
+
+	if cfg.GroupCommit <= 0 {
+		cfg.GroupCommit = 1
+	}
+
+	gen := sqlgen.NewSqlite(cfg.Local, map[string]map[string]sqlgen.ColDef{})
+	driver := sqlgen.NewSqliteDriver(cfg.Local, db)
+
+	if err := driver.InitPositionTable(); err != nil {
+		return Result{}, err
+	}
+
+	if cfg.Local.Provenance {
+		if err := driver.InitProvenanceTable(); err != nil {
+			return Result{}, err
+		}
+	}
+
+	table := "bench_" + shape.Name
+
+	if err := driver.Execute("DROP TABLE IF EXISTS " + table + ";"); err != nil {
+		return Result{}, fmt.Errorf("drop %s: %w", table, err)
+	}
+
+	rel := &pglogrepl.RelationMessageV2{
+		RelationMessage: pglogrepl.RelationMessage{
+			RelationID:   1,
+			Namespace:    "public",
+			RelationName: table,
+			Columns:      shape.Columns,
+		},
+	}
+
+	query, err := gen.Relation(rel)
+	if err != nil {
+		return Result{}, fmt.Errorf("create %s: %w", table, err)
+	}
+
+	if err := driver.Execute(query); err != nil {
+		return Result{}, fmt.Errorf("create %s: %w", table, err)
+	}
+
+	var (
+		lsn   pglogrepl.LSN
+		txns  int
+		start = time.Now()
+	)
+
+	for i := 0; i < cfg.Rows; i += cfg.TxRows {
+		lsn += pglogrepl.LSN(cfg.TxRows)
+
+		begin, err := gen.Begin(&pglogrepl.BeginMessage{FinalLSN: lsn, CommitTime: start, Xid: uint32(txns)})
+		if err != nil {
+			return Result{}, err
+		}
+
+		// a group's transactions share the local transaction
+		if txns%cfg.GroupCommit == 0 {
+			if err := driver.Execute(begin); err != nil {
+				return Result{}, fmt.Errorf("begin: %w", err)
+			}
+		}
+
+		for j := i; j < min(i+cfg.TxRows, cfg.Rows); j++ {
+			if err := insert(driver, gen, shape, j, cfg.Text); err != nil {
+				return Result{}, fmt.Errorf("insert row %d: %w", j, err)
+			}
+		}
+
+		txns++
+
+		if err := commit(driver, gen, lsn, txns%cfg.GroupCommit == 0 || i+cfg.TxRows >= cfg.Rows); err != nil {
+			return Result{}, err
+		}
+	}
+
+	return Result{Shape: shape.Name, Rows: cfg.Rows, Elapsed: time.Since(start)}, nil
+}
+
+func insert(driver *sqlgen.SqliteDriver, gen *sqlgen.Sqlite, shape Shape, i int, text bool) error {
+	values := shape.Row(i)
+	cols := make([]*pglogrepl.TupleDataColumn, len(values))
+
+	for c, v := range values {
+		cols[c] = &pglogrepl.TupleDataColumn{DataType: 't', Length: uint32(len(v)), Data: v}
+	}
+
+	msg := &pglogrepl.InsertMessageV2{
+		InsertMessage: pglogrepl.InsertMessage{RelationID: 1, Tuple: &pglogrepl.TupleData{Columns: cols}},
+	}
+
+	if text {
+		query, err := gen.Insert(msg)
+		if err != nil {
+			return err
+		}
+
+		return driver.Execute(query)
+	}
+
+	stmt, err := gen.BindInsert(msg)
+	if err != nil {
+		return err
+	}
+
+	return driver.ExecuteStatement(stmt)
+}
+
+// commit records the transaction's position, committing the local
+// transaction when it's the last of its group.
+func commit(driver *sqlgen.SqliteDriver, gen *sqlgen.Sqlite, lsn pglogrepl.LSN, last bool) error {
+	query := gen.Pos(lsn.String())
+
+	if last {
+		var err error
+		if query, err = gen.Commit(&pglogrepl.CommitMessage{CommitLSN: lsn}); err != nil {
+			return err
+		}
+	}
+
+	if err := driver.Execute(query); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
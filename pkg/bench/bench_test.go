@@ -0,0 +1,78 @@
+package bench_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/bench"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func open(tb testing.TB) *sql.DB {
+	tb.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(tb.TempDir(), "bench.db"))
+	require.NoError(tb, err)
+	tb.Cleanup(func() { db.Close() })
+
+	db.SetMaxOpenConns(1)
+
+	return db
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  bench.Config
+	}{
+		{name: "bound", cfg: bench.Config{Rows: 25, TxRows: 4}},
+		{name: "text", cfg: bench.Config{Rows: 25, TxRows: 4, Text: true}},
+		{name: "group commit", cfg: bench.Config{Rows: 25, TxRows: 2, GroupCommit: 3}},
+		{name: "provenance", cfg: bench.Config{Rows: 25, Local: sqlgen.SqliteConfig{Provenance: true}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, shape := range bench.Shapes {
+				db := open(t)
+
+				res, err := bench.Apply(db, shape, test.cfg)
+				require.NoError(t, err)
+				assert.Equal(t, 25, res.Rows)
+
+				var n int
+				require.NoError(t, db.QueryRow("SELECT count(*) FROM bench_"+shape.Name).Scan(&n))
+				assert.Equal(t, 25, n, shape.Name)
+
+				// every transaction is committed, none is left open
+				_, err = db.Exec("BEGIN TRANSACTION; COMMIT;")
+				assert.NoError(t, err, shape.Name)
+			}
+		})
+	}
+}
+
+func BenchmarkApply(b *testing.B) {
+	for _, shape := range bench.Shapes {
+		for _, text := range []bool{false, true} {
+			name := shape.Name + "/bound"
+			if text {
+				name = shape.Name + "/text"
+			}
+
+			b.Run(name, func(b *testing.B) {
+				db := open(b)
+				b.ResetTimer()
+
+				res, err := bench.Apply(db, shape, bench.Config{Rows: b.N, TxRows: 100, Text: text})
+				require.NoError(b, err)
+
+				b.ReportMetric(res.RowsPerSecond(), "rows/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package budget is a soft limit on the memory held by the rows and
+// changes in flight, shared by the proxy and the replication so that
+// either backs off while the other holds most of it.
+package budget
+
+import (
+	"context"
+	"sync"
+)
+
+// Budget counts the bytes held against a limit. It's soft: an amount
+// larger than the whole budget is taken once nothing else is held, so
+// it's only ever delayed. The methods of a nil Budget never limit.
+type Budget struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+	// freed is closed when bytes are released, waking the waiters.
+	freed chan struct{}
+}
+
+// New returns a budget of limit bytes, or nil when limit isn't positive.
+func New(limit int64) *Budget {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &Budget{limit: limit, freed: make(chan struct{})}
+}
+
+// TryAcquire takes n bytes if they fit in the budget.
+func (b *Budget) TryAcquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.fits(n) {
+		return false
+	}
+
+	b.used += n
+
+	return true
+}
+
+// Acquire takes n bytes, waiting until they fit or ctx is done.
+func (b *Budget) Acquire(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+
+		if b.fits(n) {
+			b.used += n
+			b.mu.Unlock()
+
+			return nil
+		}
+
+		freed := b.freed
+		b.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Take takes n bytes whether they fit or not.
+func (b *Budget) Take(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used += n
+}
+
+// Release gives back n bytes taken before.
+func (b *Budget) Release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used = max(b.used-n, 0)
+
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// Used returns the bytes held.
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.used
+}
+
+// Limit returns the budget's bytes, zero for a nil Budget.
+func (b *Budget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+
+	return b.limit
+}
+
+func (b *Budget) fits(n int64) bool {
+	return b.used == 0 || b.used+n <= b.limit
+}
@@ -0,0 +1,49 @@
+package budget_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudget(t *testing.T) {
+	b := budget.New(100)
+
+	assert.True(t, b.TryAcquire(60))
+	assert.False(t, b.TryAcquire(60))
+	assert.True(t, b.TryAcquire(40))
+	assert.Equal(t, int64(100), b.Used())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, b.Acquire(ctx, 10), context.DeadlineExceeded)
+
+	acquired := make(chan error)
+
+	go func() {
+		acquired <- b.Acquire(context.Background(), 50)
+	}()
+
+	b.Release(60)
+	require.NoError(t, <-acquired)
+	assert.Equal(t, int64(90), b.Used())
+
+	b.Release(90)
+
+	// more than the whole budget is taken once nothing is held
+	assert.True(t, b.TryAcquire(500))
+}
+
+func TestNilBudget(t *testing.T) {
+	var b *budget.Budget
+
+	assert.Nil(t, budget.New(0))
+	assert.True(t, b.TryAcquire(1<<40))
+	assert.NoError(t, b.Acquire(context.Background(), 1<<40))
+	assert.Zero(t, b.Used())
+}
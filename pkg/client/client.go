@@ -0,0 +1,243 @@
+// Package client reads from sqledge in Go apps, through its postgres wire
+// proxy or the local database file, with helpers for the freshness of the
+// reads, so apps don't query the stat tables themselves:
+//
+//	c, err := client.OpenProxy("postgres://app@localhost:5433/app")
+//	...
+//	rows, err := c.ReadAtLeastAsFreshAs(ctx, lsn, "SELECT * FROM orders WHERE id = $1", id)
+//
+// lsn is typically the upstream's pg_current_wal_lsn() after a write, so
+// the app reads its own writes.
+package client
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqledge"
+	"github.com/jackc/pglogrepl"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// ErrNoStats is returned for the stats of a local database file, they're
+// only kept by the running node and served through its proxy.
+var ErrNoStats = errors.New("client: stats are only available through the proxy")
+
+// pollInterval is how often the applied position is read while waiting.
+const pollInterval = 50 * time.Millisecond
+
+// Client reads from a sqledge node.
+type Client struct {
+	db *sql.DB
+	// local is set when db reads the local database file with the
+	// sqledge driver, rather than through the proxy.
+	local bool
+}
+
+// OpenProxy connects to the node's postgres wire proxy.
+func OpenProxy(connString string) (*Client, error) {
+	db, err := sql.Open("pgx", connString)
+	if err != nil {
+		return nil, fmt.Errorf("client: open proxy: %w", err)
+	}
+
+	return New(db), nil
+}
+
+// OpenLocal opens the node's local database file with the sqledge driver,
+// the dsn is the file's path with the driver's options, see package sqledge.
+func OpenLocal(dsn string) (*Client, error) {
+	db, err := sql.Open("sqledge", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("client: open local: %w", err)
+	}
+
+	return New(db), nil
+}
+
+// New wraps a database opened with the sqledge driver, or connected to
+// the proxy.
+func New(db *sql.DB) *Client {
+	_, local := db.Driver().(*sqledge.Driver)
+
+	return &Client{db: db, local: local}
+}
+
+// DB is the database the client reads from, for queries that
+// don't need to be fresh.
+func (c *Client) DB() *sql.DB {
+	return c.db
+}
+
+func (c *Client) Close() error {
+	return c.db.Close()
+}
+
+// Position returns the upstream position applied to the local database.
+func (c *Client) Position(ctx context.Context) (pglogrepl.LSN, error) {
+	if c.local {
+		return sqledge.Position(ctx, c.db)
+	}
+
+	var pos string
+	if err := c.db.QueryRowContext(ctx, "SELECT applied_lsn FROM sqledge_stat_replication").Scan(&pos); err != nil {
+		return 0, fmt.Errorf("client: read position: %w", err)
+	}
+
+	lsn, err := pglogrepl.ParseLSN(pos)
+	if err != nil {
+		return 0, fmt.Errorf("client: parse position %q: %w", pos, err)
+	}
+
+	return lsn, nil
+}
+
+// WaitForLSN waits until the node has applied the upstream's changes up
+// to lsn, or fails with sqledge.ErrStale once ctx is done.
+func (c *Client) WaitForLSN(ctx context.Context, lsn pglogrepl.LSN) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		applied, err := c.Position(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		if err == nil && applied >= lsn {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: at %s, need %s: %w", sqledge.ErrStale, applied, lsn, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReadAtLeastAsFreshAs runs the query once the node has applied the
+// upstream's changes up to lsn, failing with sqledge.ErrStale if it
+// hasn't by the time ctx is done.
+func (c *Client) ReadAtLeastAsFreshAs(ctx context.Context, lsn pglogrepl.LSN, query string, args ...any) (*sql.Rows, error) {
+	if c.local {
+		// the driver waits for the position itself
+		return c.db.QueryContext(sqledge.WithMinLSN(ctx, lsn), query, args...)
+	}
+
+	if err := c.WaitForLSN(ctx, lsn); err != nil {
+		return nil, err
+	}
+
+	return c.db.QueryContext(ctx, query, args...)
+}
+
+// Stats is the node's replication progress, from sqledge_stat_replication.
+type Stats struct {
+	State      string
+	AppliedLSN pglogrepl.LSN
+	ServerLSN  pglogrepl.LSN
+	// LagBytes is the WAL between the upstream and the local database.
+	LagBytes      int64
+	LastAppliedAt time.Time
+	// HeartbeatLatency and HeartbeatAge are the latency of the last
+	// heartbeat applied, and how long ago it was written upstream.
+	// They're zero unless the node writes heartbeats.
+	HeartbeatLatency time.Duration
+	HeartbeatAge     time.Duration
+}
+
+// Stats reads the node's replication progress through the proxy.
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	if c.local {
+		return Stats{}, ErrNoStats
+	}
+
+	var (
+		s                Stats
+		applied, server  string
+		lastAppliedAt    sql.NullString
+		heartbeatLatency sql.NullFloat64
+		heartbeatAge     sql.NullFloat64
+	)
+
+	err := c.db.QueryRowContext(ctx, `SELECT state, applied_lsn, server_lsn, lag_bytes, last_applied_at,
+			heartbeat_latency_seconds, heartbeat_age_seconds
+		FROM sqledge_stat_replication`).
+		Scan(&s.State, &applied, &server, &s.LagBytes, &lastAppliedAt, &heartbeatLatency, &heartbeatAge)
+	if err != nil {
+		return Stats{}, fmt.Errorf("client: read stats: %w", err)
+	}
+
+	if s.AppliedLSN, err = pglogrepl.ParseLSN(applied); err != nil {
+		return Stats{}, fmt.Errorf("client: parse applied position %q: %w", applied, err)
+	}
+
+	if s.ServerLSN, err = pglogrepl.ParseLSN(server); err != nil {
+		return Stats{}, fmt.Errorf("client: parse server position %q: %w", server, err)
+	}
+
+	if lastAppliedAt.Valid {
+		if s.LastAppliedAt, err = time.Parse(time.RFC3339, lastAppliedAt.String); err != nil {
+			return Stats{}, fmt.Errorf("client: parse last applied at %q: %w", lastAppliedAt.String, err)
+		}
+	}
+
+	s.HeartbeatLatency = seconds(heartbeatLatency)
+	s.HeartbeatAge = seconds(heartbeatAge)
+
+	return s, nil
+}
+
+// TableStats counts the changes applied to a table, from sqledge_stat_tables.
+type TableStats struct {
+	Name       string
+	Inserts    int64
+	Updates    int64
+	Deletes    int64
+	Truncates  int64
+	ApplyDelay time.Duration
+}
+
+// Tables reads the changes applied to each table through the proxy.
+func (c *Client) Tables(ctx context.Context) ([]TableStats, error) {
+	if c.local {
+		return nil, ErrNoStats
+	}
+
+	rows, err := c.db.QueryContext(ctx, `SELECT table_name, inserts, updates, deletes, truncates, apply_delay_seconds
+		FROM sqledge_stat_tables`)
+	if err != nil {
+		return nil, fmt.Errorf("client: read table stats: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []TableStats
+
+	for rows.Next() {
+		var (
+			t     TableStats
+			delay sql.NullFloat64
+		)
+
+		if err := rows.Scan(&t.Name, &t.Inserts, &t.Updates, &t.Deletes, &t.Truncates, &delay); err != nil {
+			return nil, fmt.Errorf("client: read table stats: %w", err)
+		}
+
+		t.ApplyDelay = seconds(delay)
+		tables = append(tables, t)
+	}
+
+	return tables, rows.Err()
+}
+
+func seconds(f sql.NullFloat64) time.Duration {
+	if !f.Valid {
+		return 0
+	}
+
+	return time.Duration(f.Float64 * float64(time.Second))
+}
@@ -0,0 +1,140 @@
+package client_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/client"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/queryproxy"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqledge"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLocal(t *testing.T) (string, *sql.DB) {
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge"}
+
+	path := filepath.Join(t.TempDir(), "sqledge.db")
+
+	local, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+
+	require.NoError(t, sqlgen.NewSqliteDriver(cfg, local).InitPositionTable())
+
+	for _, stmt := range []string{
+		"CREATE TABLE names (id integer, name text, PRIMARY KEY (id));",
+		"INSERT INTO names VALUES (1, 'Hello');",
+		sqlgen.NewSqlite(cfg, nil).Pos("0/16B3748"),
+	} {
+		_, err := local.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	return path, local
+}
+
+func TestLocal(t *testing.T) {
+	path, _ := newLocal(t)
+
+	c, err := client.OpenLocal(path + "?wait=50ms")
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	ctx := context.Background()
+
+	lsn, err := c.Position(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, pglogrepl.LSN(0x16B3748), lsn)
+
+	rows, err := c.ReadAtLeastAsFreshAs(ctx, 0x16B3748, "SELECT name FROM names WHERE id = $1", 1)
+	require.NoError(t, err)
+	rows.Close()
+
+	_, err = c.ReadAtLeastAsFreshAs(ctx, 0x16B3749, "SELECT name FROM names WHERE id = $1", 1)
+	assert.ErrorIs(t, err, sqledge.ErrStale)
+
+	_, err = c.Stats(ctx)
+	assert.ErrorIs(t, err, client.ErrNoStats)
+}
+
+func TestProxy(t *testing.T) {
+	_, local := newLocal(t)
+
+	var applied atomic.Uint64
+	applied.Store(0x100)
+
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local)
+	queryproxy.AddReplicationTables(server, func() replicate.Stats {
+		return replicate.Stats{
+			State:            replicate.StateStreaming,
+			AppliedLSN:       pglogrepl.LSN(applied.Load()),
+			ServerLSN:        0x300,
+			HeartbeatAt:      time.Now().Add(-3 * time.Second),
+			HeartbeatLatency: 1500 * time.Millisecond,
+		}
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go server.Handle(conn)
+		}
+	}()
+
+	c, err := client.OpenProxy(fmt.Sprintf("postgres://app@%s/app?sslmode=disable", ln.Addr()))
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	ctx := context.Background()
+
+	stats, err := c.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, replicate.StateStreaming, stats.State)
+	assert.Equal(t, pglogrepl.LSN(0x100), stats.AppliedLSN)
+	assert.Equal(t, int64(0x200), stats.LagBytes)
+	assert.Equal(t, 1500*time.Millisecond, stats.HeartbeatLatency)
+	assert.InDelta(t, 3*time.Second, stats.HeartbeatAge, float64(time.Second))
+
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, c.WaitForLSN(waitCtx, 0x200), sqledge.ErrStale)
+
+	// applied while the read waits
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		applied.Store(0x200)
+	}()
+
+	waitCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var name string
+	rows, err := c.ReadAtLeastAsFreshAs(waitCtx, 0x200, "SELECT name FROM names WHERE id = $1", 1)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Scan(&name))
+	assert.Equal(t, "Hello", name)
+}
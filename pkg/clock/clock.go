@@ -0,0 +1,63 @@
+// Package clock abstracts reading the time, so tests and simulations
+// can run with a clock they control instead of the system's.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time.
+type Clock interface {
+	Now() time.Time
+}
+
+// System is the system clock.
+type System struct{}
+
+func (System) Now() time.Time {
+	return time.Now()
+}
+
+// Or returns c, or the system clock when c is nil.
+func Or(c Clock) Clock {
+	if c == nil {
+		return System{}
+	}
+
+	return c
+}
+
+// Manual is a clock that only moves when it's told to.
+type Manual struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManual returns a clock stopped at t.
+func NewManual(t time.Time) *Manual {
+	return &Manual{now: t}
+}
+
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.now
+}
+
+// Set moves the clock to t.
+func (m *Manual) Set(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.now = t
+}
+
+// Advance moves the clock forward by d.
+func (m *Manual) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.now = m.now.Add(d)
+}
@@ -2,61 +2,493 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
 
 	"github.com/joeshaw/envdecode"
 )
 
+// Config is sqledge's configuration. It's read from environment variables
+// by Load, or built with Default and validated with Validate when sqledge
+// is embedded. Every field's variable and default is in its env tag.
 type Config struct {
-	Upstream struct {
-		User    string `env:"SQLEDGE_UPSTREAM_USER,default=postgres"`
-		Pass    string `env:"SQLEDGE_UPSTREAM_PASSWORD"`
-		Address string `env:"SQLEDGE_UPSTREAM_ADDRESS,default=localhost"`
-		Port    int    `env:"SQLEDGE_UPSTREAM_PORT,default=5432"`
-		DBName  string `env:"SQLEDGE_UPSTREAM_NAME,default=postgres"`
-		Schema  string `env:"SQLEDGE_UPSTREAM_SCHEMA,default=public"`
-	}
+	// Preset tunes the config for a class of hardware, see Presets.
+	// Variables that are set override the preset's values.
+	Preset string `env:"SQLEDGE_PRESET" validate:"omitempty,oneof=raspberry-pi gateway server"`
+	// NodeID identifies the node in the application_name of its upstream
+	// connections, defaulting to the slot name.
+	NodeID string `env:"SQLEDGE_NODE_ID"`
+	// MemoryBudget is a soft limit on the bytes of the proxy's results
+	// held in memory and the changes being applied. Results spill to
+	// disk and replication waits while it's used up. Zero disables it.
+	MemoryBudget int64 `env:"SQLEDGE_MEMORY_BUDGET,default=0" validate:"min=0"`
+
+	Upstream    UpstreamConfig
+	Replication ReplicationConfig
+	Failover    FailoverConfig
+	Copy        CopyConfig
+	Local       LocalConfig
+	Proxy       ProxyConfig
+	Tenant      TenantConfig
+	Leader      LeaderConfig
+	Admin       AdminConfig
+	FlightSQL   FlightSQLConfig
+	Control     ControlConfig
+}
+
+// UpstreamConfig is the upstream postgres database that is replicated.
+type UpstreamConfig struct {
+	User    string `env:"SQLEDGE_UPSTREAM_USER,default=postgres"`
+	Pass    string `env:"SQLEDGE_UPSTREAM_PASSWORD"`
+	Address string `env:"SQLEDGE_UPSTREAM_ADDRESS,default=localhost"`
+	Port    int    `env:"SQLEDGE_UPSTREAM_PORT,default=5432" validate:"min=1,max=65535"`
+	DBName  string `env:"SQLEDGE_UPSTREAM_NAME,default=postgres"`
+	Schema  string `env:"SQLEDGE_UPSTREAM_SCHEMA,default=public"`
+	// ApplicationName prefixes the application_name of the connections,
+	// followed by the node ID and what the connection is for.
+	ApplicationName string `env:"SQLEDGE_UPSTREAM_APPLICATION_NAME,default=sqledge"`
+}
+
+// ReplicationConfig configures the replication slot and how its changes
+// are applied to the local database.
+type ReplicationConfig struct {
+	Plugin               string `env:"SQLEDGE_REPLICATION_PLUGIN,default=pgoutput"`
+	SlotName             string `env:"SQLEDGE_REPLICATION_SLOT_NAME,default=sqledge"`
+	CreateSlotIfNoExists bool   `env:"SQLEDGE_REPLICATION_CREATE_SLOT,default=true"`
+	Temporary            bool   `env:"SQLEDGE_REPLICATION_TEMP_SLOT,default=true"`
+	Publication          string `env:"SQLEDGE_REPLICATION_PUBLICATION,default=sqledge"`
+	// StandbyTimeout is the seconds between standby status updates,
+	// it was set with SQLEDGE_REPLICATION_STANDBY_TIME, now deprecated.
+	StandbyTimeout int `env:"SQLEDGE_REPLICATION_STANDBY_TIMEOUT,default=15" validate:"min=1"`
+	// Tables limits the publication to the listed tables, separated by
+	// semicolons. When empty the publication covers all tables.
+	Tables []string `env:"SQLEDGE_REPLICATION_TABLES"`
+	// Publish lists the operations the publication publishes,
+	// separated by semicolons.
+	Publish []string `env:"SQLEDGE_REPLICATION_PUBLISH,default=insert;update;delete;truncate"`
+	// TwoPhase decodes prepared transactions at PREPARE TRANSACTION,
+	// rather than waiting for COMMIT PREPARED.
+	TwoPhase bool `env:"SQLEDGE_REPLICATION_TWO_PHASE,default=false"`
+	// PreparedVisibility controls when data from prepared transactions
+	// is visible to local reads, either "never" (staged until COMMIT
+	// PREPARED) or "prepared" (undone if they're rolled back).
+	PreparedVisibility string `env:"SQLEDGE_REPLICATION_PREPARED_VISIBILITY,default=never" validate:"oneof=never prepared"`
+	// Delivery is "exactly-once", committing the position with each
+	// transaction, or "at-least-once", recording it every few seconds
+	// and applying the transactions since again after a crash.
+	Delivery string `env:"SQLEDGE_REPLICATION_DELIVERY,default=exactly-once" validate:"oneof=exactly-once at-least-once"`
+	// Binary streams values in their types' binary format, which needs
+	// postgres 14 or later.
+	Binary bool `env:"SQLEDGE_REPLICATION_BINARY,default=false"`
+	// Provenance records the LSN, xid and commit time of the last
+	// change to each row in the postgres_provenance table.
+	Provenance bool `env:"SQLEDGE_REPLICATION_PROVENANCE,default=false"`
+	// MessagePrefixes records the logical decoding messages with one of
+	// these prefixes in the postgres_messages table, separated by semicolons.
+	MessagePrefixes []string `env:"SQLEDGE_REPLICATION_MESSAGE_PREFIXES"`
+	// GroupCommitMaxTransactions groups up to this many upstream
+	// transactions into one local commit, for at most
+	// GroupCommitMaxDelay. 1 commits every transaction.
+	GroupCommitMaxTransactions int           `env:"SQLEDGE_REPLICATION_GROUP_COMMIT_MAX_TRANSACTIONS,default=1" validate:"min=1"`
+	GroupCommitMaxDelay        time.Duration `env:"SQLEDGE_REPLICATION_GROUP_COMMIT_MAX_DELAY,default=100ms"`
+	// AckDelay and AckDelayBytes hold back the position confirmed to
+	// the upstream until it's this old and this far behind the applied
+	// position, so the slot keeps the recent WAL for other readers.
+	AckDelay      time.Duration `env:"SQLEDGE_REPLICATION_ACK_DELAY,default=0s"`
+	AckDelayBytes int64         `env:"SQLEDGE_REPLICATION_ACK_DELAY_BYTES,default=0" validate:"min=0"`
+	// MilestoneChannel and MilestoneTable signal the upstream, with
+	// NOTIFY on the channel or inserts into the table, once the local
+	// database is copied and as the applied position crosses each
+	// multiple of MilestoneWatermarkBytes.
+	MilestoneChannel        string `env:"SQLEDGE_REPLICATION_MILESTONE_CHANNEL"`
+	MilestoneTable          string `env:"SQLEDGE_REPLICATION_MILESTONE_TABLE"`
+	MilestoneWatermarkBytes int64  `env:"SQLEDGE_REPLICATION_MILESTONE_WATERMARK_BYTES,default=0" validate:"min=0"`
+	// BootstrapPeer is the admin API url of another node, an empty
+	// local database is filled from its snapshot instead of copying
+	// from the upstream.
+	BootstrapPeer string `env:"SQLEDGE_REPLICATION_BOOTSTRAP_PEER"`
+	// MigrationsDir writes schema changes to migration files in this
+	// directory for review, instead of applying them.
+	MigrationsDir string `env:"SQLEDGE_REPLICATION_MIGRATIONS_DIR"`
+	// TableSLOs are apply delay budgets of tables, separated by
+	// semicolons, e.g. "orders=5s;public.users=1m". Transactions
+	// applied later than the budget are logged and counted.
+	TableSLOs []string `env:"SQLEDGE_REPLICATION_TABLE_SLOS"`
+	// TableKeys designate the key columns of tables without a primary
+	// key, separated by semicolons, e.g. "events=device_id,seq". Rows of
+	// other keyless tables are matched by all their old values, which
+	// needs REPLICA IDENTITY FULL upstream.
+	TableKeys []string `env:"SQLEDGE_REPLICATION_TABLE_KEYS"`
+	// BackfillNewTables copies the existing rows of tables created
+	// locally while streaming, such as tables added to the publication,
+	// from the upstream.
+	BackfillNewTables bool `env:"SQLEDGE_REPLICATION_BACKFILL_NEW_TABLES,default=false"`
+	// MaxChangeBytes and MaxStatementBytes limit the size of a single
+	// row change and the statement generated for it. Larger changes
+	// are written to the dead letter queue in DLQDir and skipped.
+	// Zero disables a limit.
+	MaxChangeBytes    int    `env:"SQLEDGE_REPLICATION_MAX_CHANGE_BYTES,default=0" validate:"min=0"`
+	MaxStatementBytes int    `env:"SQLEDGE_REPLICATION_MAX_STATEMENT_BYTES,default=0" validate:"min=0"`
+	DLQDir            string `env:"SQLEDGE_REPLICATION_DLQ_DIR,default=./dlq"`
+	// JournalPath records every message received from the slot to this
+	// file as newline delimited JSON, for debugging. It's rotated at
+	// JournalMaxBytes, keeping JournalMaxFiles rotated files.
+	JournalPath     string `env:"SQLEDGE_REPLICATION_JOURNAL_PATH"`
+	JournalMaxBytes int64  `env:"SQLEDGE_REPLICATION_JOURNAL_MAX_BYTES,default=67108864" validate:"min=1"`
+	JournalMaxFiles int    `env:"SQLEDGE_REPLICATION_JOURNAL_MAX_FILES,default=4" validate:"min=0"`
+	// SlotGuardMaxBytes drops inactive slots matching the
+	// SlotGuardSlots pattern that retain more WAL than this, checked
+	// every SlotGuardInterval. Zero disables the guard.
+	SlotGuardMaxBytes int64         `env:"SQLEDGE_REPLICATION_SLOT_GUARD_MAX_BYTES,default=0" validate:"min=0"`
+	SlotGuardSlots    string        `env:"SQLEDGE_REPLICATION_SLOT_GUARD_SLOTS,default=sqledge%"`
+	SlotGuardInterval time.Duration `env:"SQLEDGE_REPLICATION_SLOT_GUARD_INTERVAL,default=1m"`
+	// WatchdogTimeout restarts the replication in-process when the apply
+	// loop has been stuck on a message this long while WAL is pending, at
+	// most WatchdogRestarts times. Zero disables the watchdog.
+	WatchdogTimeout  time.Duration `env:"SQLEDGE_REPLICATION_WATCHDOG_TIMEOUT,default=5m"`
+	WatchdogRestarts int           `env:"SQLEDGE_REPLICATION_WATCHDOG_RESTARTS,default=3" validate:"min=0"`
+	// HeartbeatTable is a table in the upstream schema the node writes a
+	// heartbeat row to every HeartbeatInterval, measuring the latency
+	// until it's applied locally. It's created if it doesn't exist,
+	// empty disables heartbeats.
+	HeartbeatTable    string        `env:"SQLEDGE_REPLICATION_HEARTBEAT_TABLE"`
+	HeartbeatInterval time.Duration `env:"SQLEDGE_REPLICATION_HEARTBEAT_INTERVAL,default=10s"`
+}
 
-	Replication struct {
-		Plugin               string `env:"SQLEDGE_REPLICATION_PLUGIN,default=pgoutput"`
-		SlotName             string `env:"SQLEDGE_REPLICATION_SLOT_NAME,default=sqledge"`
-		CreateSlotIfNoExists bool   `env:"SQLEDGE_REPLICATION_CREATE_SLOT,default=true"`
-		Temporary            bool   `env:"SQLEDGE_REPLICATION_TEMP_SLOT,default=true"`
-		Publication          string `env:"SQLEDGE_REPLICATION_PUBLICATION,default=sqledge"`
-		StandbyTimeout       int    `env:"SQLEDGE_REPLICATION_STANDBY_TIME",default=15"`
+// FailoverConfig configures a secondary upstream, a cluster kept in sync
+// with the upstream, e.g. by logical replication, that the replication
+// switches to once the upstream has been unreachable for After.
+type FailoverConfig struct {
+	// Address is the secondary's host, empty disables failover. The
+	// connections use the upstream's user and password, and the
+	// upstream's database, slot and publication names unless set.
+	Address     string        `env:"SQLEDGE_FAILOVER_ADDRESS"`
+	Port        int           `env:"SQLEDGE_FAILOVER_PORT,default=5432" validate:"min=1,max=65535"`
+	DBName      string        `env:"SQLEDGE_FAILOVER_NAME"`
+	SlotName    string        `env:"SQLEDGE_FAILOVER_SLOT_NAME"`
+	Publication string        `env:"SQLEDGE_FAILOVER_PUBLICATION"`
+	After       time.Duration `env:"SQLEDGE_FAILOVER_AFTER,default=1m"`
+	// Skew is how long before the commit time of the last transaction
+	// applied from the upstream the secondary's transactions are applied
+	// again, allowing for the clusters' clocks and replication delay.
+	Skew time.Duration `env:"SQLEDGE_FAILOVER_SKEW,default=10s"`
+}
+
+// CopyConfig configures the initial copy of the upstream's tables.
+type CopyConfig struct {
+	// ChunkBytes is the target size of each chunk of rows during the
+	// initial copy, chunks are sized from the upstream statistics.
+	ChunkBytes int64 `env:"SQLEDGE_COPY_CHUNK_BYTES,default=67108864" validate:"min=1"`
+	MaxWorkers int   `env:"SQLEDGE_COPY_MAX_WORKERS,default=4" validate:"min=1"`
+}
+
+// LocalConfig is the local SQLite database.
+type LocalConfig struct {
+	Path string `env:"SQLEDGE_LOCAL_DB_PATH,default=./sqledge.db"`
+	// Pragmas are applied to every connection to the local database,
+	// separated by semicolons, e.g. "cache_size=-2000;mmap_size=0".
+	Pragmas []string `env:"SQLEDGE_LOCAL_PRAGMAS"`
+	// MaxReadConns limits the proxy's connections to the local
+	// database, zero doesn't limit them.
+	MaxReadConns int `env:"SQLEDGE_LOCAL_MAX_READ_CONNS,default=0" validate:"min=0"`
+	// Timestamps is how timestamp and timestamptz values are stored:
+	// "postgres" text, "utc" or "local" RFC 3339 text, or "epoch"
+	// integer microseconds.
+	Timestamps string `env:"SQLEDGE_LOCAL_TIMESTAMPS,default=postgres" validate:"oneof=postgres utc epoch local"`
+	// Rollups are tables of aggregates of replicated tables kept up to
+	// date as changes are applied, separated by semicolons, e.g.
+	// "orders_daily=orders:status,date(created_at) as day:count,sum(total)",
+	// see replicate.ParseRollups.
+	Rollups []string `env:"SQLEDGE_LOCAL_ROLLUPS"`
+	// ShipDir enables shipping the local database, a base copy and the
+	// WAL frames committed after it, to the directory for disaster
+	// recovery, see package ship.
+	ShipDir             string        `env:"SQLEDGE_LOCAL_SHIP_DIR"`
+	ShipInterval        time.Duration `env:"SQLEDGE_LOCAL_SHIP_INTERVAL,default=1s"`
+	ShipCheckpointBytes int64         `env:"SQLEDGE_LOCAL_SHIP_CHECKPOINT_BYTES,default=4194304" validate:"min=1"`
+	// ShipHook is run for every file shipped, e.g. to upload it to
+	// object storage.
+	ShipHook   string `env:"SQLEDGE_LOCAL_SHIP_HOOK"`
+	ShipRetain int    `env:"SQLEDGE_LOCAL_SHIP_RETAIN,default=2" validate:"min=0"`
+}
+
+var pragma = regexp.MustCompile(`^[a-z_]+=[-\w.]+$`)
+
+// DSN is the local database's path, with the pragmas as _pragma
+// parameters for the modernc.org/sqlite driver.
+func (c LocalConfig) DSN() string {
+	pragmas := c.Pragmas[:len(c.Pragmas):len(c.Pragmas)]
+	if c.ShipDir != "" {
+		// the shipper checkpoints the WAL once its frames are shipped
+		pragmas = append(pragmas, "wal_autocheckpoint=0")
 	}
 
-	Local struct {
-		Path string `env:"SQLEDGE_LOCAL_DB_PATH,default=./sqledge.db"`
+	if len(c.Rollups) > 0 {
+		// so the rows INSERT OR REPLACE replaces are subtracted
+		// from the rollups by their delete triggers
+		pragmas = append(pragmas, "recursive_triggers=1")
 	}
 
-	Proxy struct {
-		Address string `env:"SQLEDGE_PROXY_ADDRESS,default=localhost"`
-		Port    int    `env:"SQLEDGE_PROXY_ADDRESS,default=5433"`
+	if len(pragmas) == 0 {
+		return c.Path
 	}
+
+	q := url.Values{"_pragma": pragmas}
+
+	return c.Path + "?" + q.Encode()
+}
+
+// ProxyConfig configures the postgres wire proxy.
+type ProxyConfig struct {
+	Address string `env:"SQLEDGE_PROXY_ADDRESS,default=localhost"`
+	Port    int    `env:"SQLEDGE_PROXY_PORT,default=5433" validate:"min=1,max=65535"`
+	// Listeners replaces the address and port with listener specs,
+	// separated by semicolons, see pkg/queryproxy/listen.go.
+	Listeners []string `env:"SQLEDGE_PROXY_LISTENERS"`
+	// HostRules allow or deny clients by address, user and database,
+	// separated by semicolons, e.g. "allow 10.0.0.0/8 app all".
+	HostRules []string `env:"SQLEDGE_PROXY_HOST_RULES"`
+	// Passthrough forwards requests the local database can't serve,
+	// such as large object function calls, to the upstream.
+	Passthrough bool `env:"SQLEDGE_PROXY_PASSTHROUGH,default=false"`
+	// IdleInTransactionTimeout closes sessions that leave a transaction
+	// open without sending anything for this long, zero disables it.
+	IdleInTransactionTimeout time.Duration `env:"SQLEDGE_PROXY_IDLE_IN_TRANSACTION_TIMEOUT,default=0s"`
+	// SpoolThreshold is the bytes of a result held in memory, larger
+	// results spill to a file in SpoolDir. Zero disables spooling.
+	SpoolThreshold int64  `env:"SQLEDGE_PROXY_SPOOL_THRESHOLD,default=0"`
+	SpoolDir       string `env:"SQLEDGE_PROXY_SPOOL_DIR"`
+	// UpstreamWarmConns is the upstream connections opened at startup
+	// and on every probe, so writes don't wait to connect.
+	UpstreamWarmConns int `env:"SQLEDGE_PROXY_UPSTREAM_WARM_CONNS,default=2" validate:"min=0"`
+	// UpstreamProbeInterval is how often the upstream is probed,
+	// writes fail fast while it's unreachable. Zero disables probing.
+	UpstreamProbeInterval time.Duration `env:"SQLEDGE_PROXY_UPSTREAM_PROBE_INTERVAL,default=10s"`
+	// ReadRetries retries local reads that fail with SQLITE_BUSY,
+	// SQLITE_LOCKED or SQLITE_SCHEMA, backing off between attempts.
+	ReadRetries      int           `env:"SQLEDGE_PROXY_READ_RETRIES,default=3" validate:"min=0"`
+	ReadRetryBackoff time.Duration `env:"SQLEDGE_PROXY_READ_RETRY_BACKOFF,default=10ms"`
+	// DDLAllow lists the DDL command tags forwarded upstream, separated
+	// by semicolons, e.g. "CREATE INDEX;DROP INDEX". Empty allows every
+	// command not in DDLDeny.
+	DDLAllow []string `env:"SQLEDGE_PROXY_DDL_ALLOW"`
+	DDLDeny  []string `env:"SQLEDGE_PROXY_DDL_DENY"`
+	// DDLLockTimeout is the lock_timeout of forwarded DDL, zero leaves
+	// the upstream's. DDL failing on lock contention is retried
+	// DDLRetries times, backing off between attempts.
+	DDLLockTimeout  time.Duration `env:"SQLEDGE_PROXY_DDL_LOCK_TIMEOUT,default=0s"`
+	DDLRetries      int           `env:"SQLEDGE_PROXY_DDL_RETRIES,default=3" validate:"min=0"`
+	DDLRetryBackoff time.Duration `env:"SQLEDGE_PROXY_DDL_RETRY_BACKOFF,default=100ms"`
+	// CatalogPassthrough answers reads of pg_catalog and
+	// information_schema from the upstream, caching the answers by
+	// statement for CatalogCacheTTL.
+	CatalogPassthrough bool          `env:"SQLEDGE_PROXY_CATALOG_PASSTHROUGH,default=false"`
+	CatalogCacheTTL    time.Duration `env:"SQLEDGE_PROXY_CATALOG_CACHE_TTL,default=1m"`
+	// ColdReadsUpstream serves reads of tables that haven't been fully
+	// copied yet from the upstream, instead of the incomplete local ones.
+	ColdReadsUpstream bool `env:"SQLEDGE_PROXY_COLD_READS_UPSTREAM,default=false"`
+	// KeyDefaults fill key columns left out of forwarded INSERTs with
+	// generated keys, separated by semicolons, each table.column=kind
+	// with kind uuidv7 or ulid, e.g. "orders.id=uuidv7".
+	KeyDefaults []string `env:"SQLEDGE_PROXY_KEY_DEFAULTS"`
+	// WriteBatchSize is the most pipelined INSERTs forwarded upstream
+	// in one round trip, zero forwards them one at a time.
+	WriteBatchSize int `env:"SQLEDGE_PROXY_WRITE_BATCH_SIZE,default=0" validate:"min=0"`
+	// MaxMessageBytes is the largest message accepted from a client,
+	// sessions sending larger ones are closed.
+	MaxMessageBytes int `env:"SQLEDGE_PROXY_MAX_MESSAGE_BYTES,default=67108864" validate:"min=0"`
+	// MaxJoins is the most joins in a local read, JOINs or tables listed
+	// after the first in a FROM, zero doesn't limit them.
+	MaxJoins int `env:"SQLEDGE_PROXY_MAX_JOINS,default=0" validate:"min=0"`
+	// DenyFunctions are functions local reads can't call, separated by
+	// semicolons, e.g. "randomblob;zeroblob".
+	DenyFunctions []string `env:"SQLEDGE_PROXY_DENY_FUNCTIONS"`
+	// LimitTables are large tables, separated by semicolons, reads of
+	// which without a LIMIT return at most LimitRows rows.
+	LimitTables []string `env:"SQLEDGE_PROXY_LIMIT_TABLES"`
+	LimitRows   int      `env:"SQLEDGE_PROXY_LIMIT_ROWS,default=1000" validate:"min=0"`
+	// Quotas limit the local reads by user and table, separated by
+	// semicolons, e.g. "throttle app events 1000 10485760 1m", see
+	// pgwire.ParseQuota.
+	Quotas []string `env:"SQLEDGE_PROXY_QUOTAS"`
+	// ShadowEvery also runs one in this many local reads on the
+	// upstream, logging those whose results differ. Zero disables it.
+	ShadowEvery int `env:"SQLEDGE_PROXY_SHADOW_EVERY,default=0" validate:"min=0"`
+	// Startup is whether local reads are served right after a restart
+	// from the local database as it is, "serve-stale", or fail with
+	// cannot_connect_now until the replication is streaming within
+	// StartupMaxLagBytes of the upstream, "fail-fast".
+	Startup            string `env:"SQLEDGE_PROXY_STARTUP,default=serve-stale" validate:"oneof=serve-stale fail-fast"`
+	StartupMaxLagBytes int64  `env:"SQLEDGE_PROXY_STARTUP_MAX_LAG_BYTES,default=1048576" validate:"min=0"`
+}
+
+// TenantConfig configures partitioning rows into a database per tenant.
+type TenantConfig struct {
+	// Column partitions the rows of tables with this column into a
+	// local database per tenant, in Dir. Empty disables partitioning.
+	Column string `env:"SQLEDGE_TENANT_COLUMN"`
+	Dir    string `env:"SQLEDGE_TENANT_DIR,default=./tenants"`
+	// ByDatabase reads a session's tenant from the database
+	// it connects to, otherwise it's set with SET sqledge.tenant.
+	ByDatabase bool `env:"SQLEDGE_TENANT_BY_DATABASE,default=false"`
+}
+
+// LeaderConfig configures leader election between a leader and standby.
+type LeaderConfig struct {
+	// Enabled runs the node as one of a leader/standby pair, only the
+	// leader replicates and serves clients.
+	Enabled bool `env:"SQLEDGE_LEADER_ELECTION,default=false"`
+	// Interval is how often the standby tries to take over, and
+	// the leader checks it still holds the lock.
+	Interval time.Duration `env:"SQLEDGE_LEADER_INTERVAL,default=5s"`
+	// PromoteHook is run once the node is the leader and its proxy is
+	// listening, to take over the address clients connect to.
+	PromoteHook string `env:"SQLEDGE_LEADER_PROMOTE_HOOK"`
 }
 
+// ControlConfig configures the commands sent to the nodes as logical
+// decoding messages, see package control.
+type ControlConfig struct {
+	// Secret signs the commands, commands are ignored without it.
+	Secret string `env:"SQLEDGE_CONTROL_SECRET"`
+}
+
+// AdminConfig configures the admin API.
+type AdminConfig struct {
+	Enabled bool   `env:"SQLEDGE_ADMIN_ENABLED,default=false"`
+	Address string `env:"SQLEDGE_ADMIN_ADDRESS,default=localhost"`
+	Port    int    `env:"SQLEDGE_ADMIN_PORT,default=5480" validate:"min=1,max=65535"`
+	// Query serves reads from the local database on POST /query,
+	// Subscriptions live queries on GET /subscribe, and GraphQL a
+	// GraphQL API on /graphql. QueryAuth is how their requests are
+	// authenticated, either "upstream" or "trust".
+	Query         bool   `env:"SQLEDGE_ADMIN_QUERY,default=false"`
+	Subscriptions bool   `env:"SQLEDGE_ADMIN_SUBSCRIPTIONS,default=false"`
+	GraphQL       bool   `env:"SQLEDGE_ADMIN_GRAPHQL,default=false"`
+	QueryAuth     string `env:"SQLEDGE_ADMIN_QUERY_AUTH,default=upstream" validate:"oneof=upstream trust"`
+	// SubscribeOrigins are the origins, e.g. https://app.example.com,
+	// browsers may open live queries from besides the admin API's own.
+	SubscribeOrigins []string `env:"SQLEDGE_ADMIN_SUBSCRIBE_ORIGINS"`
+}
+
+// FlightSQLConfig configures the Arrow Flight SQL server.
+type FlightSQLConfig struct {
+	// Address serves the local database over Arrow Flight SQL,
+	// e.g. localhost:5481. Empty disables it.
+	Address string `env:"SQLEDGE_FLIGHT_SQL_ADDRESS"`
+	// Auth is how clients are authenticated, either "upstream"
+	// or "trust", like the admin API's QueryAuth.
+	Auth string `env:"SQLEDGE_FLIGHT_SQL_AUTH,default=upstream" validate:"oneof=upstream trust"`
+}
+
+// PostgresConnString is the connection string of the upstream, see UpstreamConnString.
 func (c *Config) PostgresConnString() string {
+	return c.UpstreamConnString("")
+}
+
+// UpstreamConnString is the connection string of the upstream connections
+// used for role, e.g. replication, tagged with an application_name like
+// sqledge/edge-12/replication so pg_stat_activity tells the nodes apart.
+func (c *Config) UpstreamConnString(role string) string {
 	pass := ""
 	if c.Upstream.Pass != "" {
 		pass = ":" + c.Upstream.Pass
 	}
 
-	s := fmt.Sprintf("postgres://%s%s@%s:%d/%s?application_name=sqledge",
+	s := fmt.Sprintf("postgres://%s%s@%s:%d/%s?application_name=%s",
 		c.Upstream.User,
 		pass, c.Upstream.Address,
 		c.Upstream.Port,
 		c.Upstream.DBName,
+		url.QueryEscape(c.ApplicationName(role)),
 	)
 
 	return s
 }
 
+// ApplicationName is the application_name of the connections used for role.
+func (c *Config) ApplicationName(role string) string {
+	name := c.Upstream.ApplicationName
+	if name == "" {
+		name = "sqledge"
+	}
+
+	node := c.NodeID
+	if node == "" {
+		node = c.Replication.SlotName
+	}
+
+	for _, part := range []string{node, role} {
+		if part != "" {
+			name += "/" + part
+		}
+	}
+
+	return name
+}
+
+// Secondary is a copy of the config replicating from the failover's
+// secondary instead of the upstream, through its permanent slot.
+func (c Config) Secondary() *Config {
+	c.Upstream.Address = c.Failover.Address
+	c.Upstream.Port = c.Failover.Port
+
+	if c.Failover.DBName != "" {
+		c.Upstream.DBName = c.Failover.DBName
+	}
+
+	if c.Failover.SlotName != "" {
+		c.Replication.SlotName = c.Failover.SlotName
+	}
+
+	if c.Failover.Publication != "" {
+		c.Replication.Publication = c.Failover.Publication
+	}
+
+	// the slot is created when the node starts on the upstream
+	c.Replication.Temporary = false
+	c.Replication.CreateSlotIfNoExists = false
+
+	return &c
+}
+
+// Redacted is a copy of the config without its secrets, the upstream's
+// password and the control secret, e.g. for a debug dump.
+func (c Config) Redacted() Config {
+	for _, secret := range []*string{&c.Upstream.Pass, &c.Control.Secret} {
+		if *secret != "" {
+			*secret = "[redacted]"
+		}
+	}
+
+	return c
+}
+
+// Load reads the config from the environment, and validates it.
 func Load() (*Config, error) {
 	var c Config
 
+	if err := applyDeprecated(); err != nil {
+		return nil, err
+	}
+
 	if err := envdecode.StrictDecode(&c); err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
 
+	if c.Preset != "" {
+		// the preset's values are used for the variables that aren't set
+		c.applyPreset(c.Preset, func(env string) bool {
+			_, set := os.LookupEnv(env)
+			return !set
+		})
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
 	return &c, nil
 }
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Presets tune the copy's batch sizes, the proxy's result buffers and
+// connections, the memory budget and SQLite's cache for a class of
+// hardware. Each is the values of the variables it sets.
+var Presets = map[string]map[string]string{
+	// a single board computer with an SD card and 1-4GB of memory
+	"raspberry-pi": {
+		"SQLEDGE_COPY_CHUNK_BYTES":              "8388608",
+		"SQLEDGE_COPY_MAX_WORKERS":              "1",
+		"SQLEDGE_PROXY_SPOOL_THRESHOLD":         "4194304",
+		"SQLEDGE_PROXY_UPSTREAM_WARM_CONNS":     "1",
+		"SQLEDGE_LOCAL_MAX_READ_CONNS":          "2",
+		"SQLEDGE_LOCAL_PRAGMAS":                 "cache_size=-2000;mmap_size=0;temp_store=file",
+		"SQLEDGE_REPLICATION_JOURNAL_MAX_BYTES": "16777216",
+		"SQLEDGE_MEMORY_BUDGET":                 "67108864",
+	},
+	// an edge gateway with a few cores and SSD storage
+	"gateway": {
+		"SQLEDGE_COPY_CHUNK_BYTES":          "33554432",
+		"SQLEDGE_COPY_MAX_WORKERS":          "2",
+		"SQLEDGE_PROXY_SPOOL_THRESHOLD":     "33554432",
+		"SQLEDGE_PROXY_UPSTREAM_WARM_CONNS": "2",
+		"SQLEDGE_LOCAL_MAX_READ_CONNS":      "4",
+		"SQLEDGE_LOCAL_PRAGMAS":             "cache_size=-16000;mmap_size=67108864",
+		"SQLEDGE_MEMORY_BUDGET":             "268435456",
+	},
+	// a server with plenty of memory and cores
+	"server": {
+		"SQLEDGE_COPY_CHUNK_BYTES":          "134217728",
+		"SQLEDGE_COPY_MAX_WORKERS":          "8",
+		"SQLEDGE_PROXY_SPOOL_THRESHOLD":     "0",
+		"SQLEDGE_PROXY_UPSTREAM_WARM_CONNS": "8",
+		"SQLEDGE_LOCAL_MAX_READ_CONNS":      "0",
+		"SQLEDGE_LOCAL_PRAGMAS":             "cache_size=-262144;mmap_size=1073741824;temp_store=memory",
+	},
+}
+
+// ApplyPreset sets the fields the preset tunes, fields can be changed
+// after it to override the preset.
+func (c *Config) ApplyPreset(name string) error {
+	if _, ok := Presets[name]; !ok {
+		return fmt.Errorf("unknown preset %q", name)
+	}
+
+	c.Preset = name
+	c.applyPreset(name, func(string) bool { return true })
+
+	return nil
+}
+
+// applyPreset sets the fields of the preset's variables that apply.
+func (c *Config) applyPreset(name string, apply func(env string) bool) {
+	values := Presets[name]
+
+	walk(c, func(field reflect.Value, f reflect.StructField, env string) {
+		v, ok := values[env]
+		if !ok || !apply(env) {
+			return
+		}
+
+		// the presets are checked by the tests, so they always parse
+		if err := set(field, v); err != nil {
+			panic(fmt.Sprintf("preset %s of %s: %s", name, env, err))
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Deprecated maps the environment variables that were renamed to their
+// new names. Load reads a deprecated variable when the new one isn't set.
+var Deprecated = map[string]string{
+	"SQLEDGE_REPLICATION_STANDBY_TIME": "SQLEDGE_REPLICATION_STANDBY_TIMEOUT",
+}
+
+// applyDeprecated sets the new variables from the deprecated ones.
+func applyDeprecated() error {
+	for old, name := range Deprecated {
+		v, ok := os.LookupEnv(old)
+		if !ok {
+			continue
+		}
+
+		if _, ok := os.LookupEnv(name); ok {
+			log.Warn().Msgf("%s is deprecated and ignored, %s is set", old, name)
+			continue
+		}
+
+		log.Warn().Msgf("%s is deprecated, use %s", old, name)
+
+		if err := os.Setenv(name, v); err != nil {
+			return fmt.Errorf("set %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Default returns the config with every field set to its default, as
+// Load would read it from an empty environment.
+func Default() *Config {
+	var c Config
+
+	walk(&c, func(field reflect.Value, f reflect.StructField, env string) {
+		def, ok := tagOption(f.Tag.Get("env"), "default")
+		if !ok {
+			return
+		}
+
+		// the defaults are checked by the tests, so they always parse
+		if err := set(field, def); err != nil {
+			panic(fmt.Sprintf("default of %s: %s", env, err))
+		}
+	})
+
+	return &c
+}
+
+// Validate checks the fields against their validate tags, which are
+// a comma separated list of:
+//
+//	min=n     numbers are at least n
+//	max=n     numbers are at most n
+//	oneof=a b strings are one of the space separated values
+//	omitempty skips the rules after it for zero values
+func (c *Config) Validate() error {
+	var errs []error
+
+	walk(c, func(field reflect.Value, f reflect.StructField, env string) {
+		rules := f.Tag.Get("validate")
+		if rules == "" {
+			return
+		}
+
+		for _, rule := range strings.Split(rules, ",") {
+			name, arg, _ := strings.Cut(rule, "=")
+
+			if name == "omitempty" {
+				if field.IsZero() {
+					return
+				}
+
+				continue
+			}
+
+			if err := check(field, name, arg); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+	})
+
+	for _, p := range c.Local.Pragmas {
+		if !pragma.MatchString(p) {
+			errs = append(errs, fmt.Errorf("SQLEDGE_LOCAL_PRAGMAS: %q isn't name=value", p))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func check(field reflect.Value, rule, arg string) error {
+	switch rule {
+	case "min", "max":
+		limit, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid rule %s=%s", rule, arg)
+		}
+
+		n := field.Int()
+
+		if rule == "min" && n < limit {
+			return fmt.Errorf("%d is less than %d", n, limit)
+		}
+
+		if rule == "max" && n > limit {
+			return fmt.Errorf("%d is more than %d", n, limit)
+		}
+	case "oneof":
+		values := strings.Fields(arg)
+
+		for _, v := range values {
+			if field.String() == v {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%q isn't one of %s", field.String(), strings.Join(values, ", "))
+	default:
+		return fmt.Errorf("unknown rule %q", rule)
+	}
+
+	return nil
+}
+
+// walk calls fn with every field of the config and its sections that
+// has an env tag, and the field's variable name.
+func walk(c *Config, fn func(field reflect.Value, f reflect.StructField, env string)) {
+	walkStruct(reflect.ValueOf(c).Elem(), fn)
+}
+
+func walkStruct(v reflect.Value, fn func(field reflect.Value, f reflect.StructField, env string)) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+
+		if f.Type.Kind() == reflect.Struct {
+			walkStruct(v.Field(i), fn)
+			continue
+		}
+
+		env, _, _ := strings.Cut(f.Tag.Get("env"), ",")
+		if env == "" {
+			continue
+		}
+
+		fn(v.Field(i), f, env)
+	}
+}
+
+// tagOption returns the value of the option in the env tag.
+func tagOption(tag, option string) (string, bool) {
+	parts := strings.Split(tag, ",")
+
+	for _, p := range parts[1:] {
+		if v, ok := strings.CutPrefix(p, option+"="); ok {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// set parses the value into the field, like envdecode does.
+func set(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(d))
+
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(n)
+	case reflect.Slice:
+		field.Set(reflect.ValueOf(strings.Split(value, ";")))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
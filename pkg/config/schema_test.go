@@ -0,0 +1,160 @@
+package config_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefault(t *testing.T) {
+	cfg := config.Default()
+
+	assert.Equal(t, "postgres", cfg.Upstream.User)
+	assert.Equal(t, 5432, cfg.Upstream.Port)
+	assert.True(t, cfg.Replication.CreateSlotIfNoExists)
+	assert.Equal(t, []string{"insert", "update", "delete", "truncate"}, cfg.Replication.Publish)
+	assert.Equal(t, 100*time.Millisecond, cfg.Replication.GroupCommitMaxDelay)
+	assert.Equal(t, int64(67108864), cfg.Copy.ChunkBytes)
+	assert.Empty(t, cfg.Upstream.Pass)
+
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("SQLEDGE_UPSTREAM_ADDRESS", "db.internal")
+	t.Setenv("SQLEDGE_REPLICATION_STANDBY_TIME", "30")
+	// Load sets the new variable from the deprecated one
+	t.Cleanup(func() { os.Unsetenv("SQLEDGE_REPLICATION_STANDBY_TIMEOUT") })
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	want := config.Default()
+	want.Upstream.Address = "db.internal"
+	// read from the deprecated variable
+	want.Replication.StandbyTimeout = 30
+
+	assert.Equal(t, want, cfg)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func(cfg *config.Config)
+		err   string
+	}{
+		{
+			name:  "port out of range",
+			apply: func(cfg *config.Config) { cfg.Proxy.Port = 70000 },
+			err:   "SQLEDGE_PROXY_PORT: 70000 is more than 65535",
+		},
+		{
+			name:  "no workers",
+			apply: func(cfg *config.Config) { cfg.Copy.MaxWorkers = 0 },
+			err:   "SQLEDGE_COPY_MAX_WORKERS: 0 is less than 1",
+		},
+		{
+			name:  "unknown auth",
+			apply: func(cfg *config.Config) { cfg.Admin.QueryAuth = "password" },
+			err:   `SQLEDGE_ADMIN_QUERY_AUTH: "password" isn't one of upstream, trust`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			tt.apply(cfg)
+
+			assert.EqualError(t, cfg.Validate(), tt.err)
+		})
+	}
+}
+
+func TestPresets(t *testing.T) {
+	for name := range config.Presets {
+		t.Run(name, func(t *testing.T) {
+			cfg := config.Default()
+			require.NoError(t, cfg.ApplyPreset(name))
+			assert.NoError(t, cfg.Validate())
+		})
+	}
+
+	assert.Error(t, config.Default().ApplyPreset("mainframe"))
+}
+
+func TestLoadPreset(t *testing.T) {
+	t.Setenv("SQLEDGE_PRESET", "raspberry-pi")
+	t.Setenv("SQLEDGE_COPY_MAX_WORKERS", "2")
+
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(8388608), cfg.Copy.ChunkBytes)
+	assert.Equal(t, []string{"cache_size=-2000", "mmap_size=0", "temp_store=file"}, cfg.Local.Pragmas)
+	assert.Equal(t, "./sqledge.db?_pragma=cache_size%3D-2000&_pragma=mmap_size%3D0&_pragma=temp_store%3Dfile", cfg.Local.DSN())
+	// set variables override the preset
+	assert.Equal(t, 2, cfg.Copy.MaxWorkers)
+}
+
+func TestApplicationName(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*config.Config)
+		role   string
+		want   string
+	}{
+		{name: "default", role: "replication", want: "sqledge/sqledge/replication"},
+		{name: "node id", modify: func(c *config.Config) { c.NodeID = "edge-12" }, role: "proxy", want: "sqledge/edge-12/proxy"},
+		{name: "prefix", modify: func(c *config.Config) { c.Upstream.ApplicationName = "shop" }, role: "leader", want: "shop/sqledge/leader"},
+		{name: "no role", want: "sqledge/sqledge"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			if tt.modify != nil {
+				tt.modify(cfg)
+			}
+
+			assert.Equal(t, tt.want, cfg.ApplicationName(tt.role))
+		})
+	}
+
+	cfg := config.Default()
+	cfg.NodeID = "edge 12"
+	assert.Contains(t, cfg.UpstreamConnString("replication"), "application_name=sqledge%2Fedge+12%2Freplication")
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := config.Default()
+	cfg.Upstream.Pass = "hunter2"
+	cfg.Control.Secret = "s3cret"
+
+	redacted := cfg.Redacted()
+
+	assert.Equal(t, "[redacted]", redacted.Upstream.Pass)
+	assert.Equal(t, "[redacted]", redacted.Control.Secret)
+	assert.Equal(t, cfg.Upstream.Address, redacted.Upstream.Address)
+	// the config itself keeps its secrets
+	assert.Equal(t, "hunter2", cfg.Upstream.Pass)
+}
+
+func TestSecondary(t *testing.T) {
+	cfg := config.Default()
+	cfg.Failover.Address = "replica.internal"
+	cfg.Failover.SlotName = "sqledge_failover"
+
+	secondary := cfg.Secondary()
+
+	assert.Equal(t, "replica.internal", secondary.Upstream.Address)
+	assert.Equal(t, "sqledge_failover", secondary.Replication.SlotName)
+	// the names that aren't set are the upstream's
+	assert.Equal(t, cfg.Upstream.DBName, secondary.Upstream.DBName)
+	assert.Equal(t, cfg.Replication.Publication, secondary.Replication.Publication)
+	assert.False(t, secondary.Replication.Temporary)
+	assert.Equal(t, "localhost", cfg.Upstream.Address)
+}
@@ -0,0 +1,17 @@
+package config
+
+import "runtime/debug"
+
+// Version is sqledge's version, stamped in the local databases it writes.
+// Releases set it with
+// -ldflags "-X github.com/gemini-kenshi/pgreplsql/pkg/config.Version=v1.2.0",
+// other builds use the main module's version, "(devel)" for local builds.
+var Version = moduleVersion()
+
+func moduleVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+
+	return "(devel)"
+}
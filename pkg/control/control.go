@@ -0,0 +1,174 @@
+// Package control runs commands sent to every node through the WAL. An
+// operator emits a logical decoding message with the ControlPrefix prefix
+// on the upstream, signed with a secret shared with the nodes, and each
+// node replicating it runs the command:
+//
+//	SELECT pg_logical_emit_message(false, 'sqledge.control',
+//		encode(hmac(cmd, 'secret', 'sha256'), 'hex') || ' ' || cmd)
+//	FROM (SELECT '{"command": "set_log_level", "args": {"level": "debug"},
+//		"expires": "2024-05-01T12:00:00Z"}' AS cmd) c;
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+)
+
+// Prefix is the prefix of the logical decoding messages with commands.
+const Prefix = pgoutput.ControlPrefix
+
+var (
+	// ErrBadSignature is returned for commands that aren't signed
+	// with the secret.
+	ErrBadSignature = errors.New("bad command signature")
+	// ErrUnknownCommand is returned for commands without a handler.
+	ErrUnknownCommand = errors.New("unknown command")
+	// ErrNoExpiry is returned for commands without an expiry.
+	ErrNoExpiry = errors.New("command doesn't expire")
+	// ErrRan is returned for commands the node already ran.
+	ErrRan = errors.New("command already ran")
+)
+
+// Command is the signed JSON of a message.
+type Command struct {
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	// Nodes are the slot names of the nodes that run the command,
+	// when empty every node runs it.
+	Nodes []string `json:"nodes,omitempty"`
+	// Expires is when the command is too old to run, e.g. for nodes
+	// that were offline when it was sent. Every command expires, the
+	// journal remembers it ran until then.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Handler runs a command with its args.
+type Handler func(ctx context.Context, args json.RawMessage) error
+
+// Controller runs the commands sent to a node.
+type Controller struct {
+	secret   []byte
+	node     string
+	handlers map[string]Handler
+	journal  *Journal
+}
+
+// New returns a controller running the commands signed with secret,
+// and sent to every node or the node with the slot name node.
+func New(secret, node string) *Controller {
+	return &Controller{
+		secret:   []byte(secret),
+		node:     node,
+		handlers: make(map[string]Handler),
+		journal:  &Journal{ran: make(map[string]time.Time)},
+	}
+}
+
+// SetJournal keeps the commands the node ran in j, by default they're
+// only kept in memory and run again once the node restarts.
+func (c *Controller) SetJournal(j *Journal) {
+	c.journal = j
+}
+
+// Handle registers the handler of the command name.
+func (c *Controller) Handle(name string, h Handler) {
+	c.handlers[name] = h
+}
+
+// Run verifies and runs the command in a message's content. Commands
+// for other nodes are ignored, expired commands and those the node
+// already ran are refused. A command is recorded in the journal before
+// it runs, one that fails isn't run again.
+func (c *Controller) Run(ctx context.Context, content []byte) error {
+	sig, cmd, err := parse(c.secret, content)
+	if err != nil {
+		return err
+	}
+
+	if len(cmd.Nodes) > 0 && !slices.Contains(cmd.Nodes, c.node) {
+		return nil
+	}
+
+	now := time.Now()
+
+	if cmd.Expires.IsZero() {
+		return fmt.Errorf("%w: %q", ErrNoExpiry, cmd.Command)
+	} else if now.After(cmd.Expires) {
+		return fmt.Errorf("command %q expired at %s", cmd.Command, cmd.Expires)
+	}
+
+	h, ok := c.handlers[cmd.Command]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownCommand, cmd.Command)
+	}
+
+	if first, err := c.journal.record(sig, cmd.Expires, now); err != nil {
+		return fmt.Errorf("command %q: %w", cmd.Command, err)
+	} else if !first {
+		return fmt.Errorf("%w: %q", ErrRan, cmd.Command)
+	}
+
+	if err := h(ctx, cmd.Args); err != nil {
+		return fmt.Errorf("command %q: %w", cmd.Command, err)
+	}
+
+	return nil
+}
+
+// Parse returns the command of the content, the hex HMAC-SHA256 of
+// the command's JSON with secret, a space and the JSON.
+func Parse(secret, content []byte) (Command, error) {
+	_, cmd, err := parse(secret, content)
+	return cmd, err
+}
+
+// parse returns the command of the content and its signature, in
+// lowercase hex whatever the case it was sent in.
+func parse(secret, content []byte) (string, Command, error) {
+	sig, payload, ok := bytes.Cut(content, []byte(" "))
+	if !ok {
+		return "", Command{}, ErrBadSignature
+	}
+
+	want, err := hex.DecodeString(string(sig))
+	if err != nil {
+		return "", Command{}, ErrBadSignature
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return "", Command{}, ErrBadSignature
+	}
+
+	var cmd Command
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return "", Command{}, fmt.Errorf("parse command: %w", err)
+	}
+
+	return hex.EncodeToString(want), cmd, nil
+}
+
+// Sign returns the content of a message with the command signed with secret.
+func Sign(secret []byte, cmd Command) ([]byte, error) {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	return append([]byte(hex.EncodeToString(mac.Sum(nil))+" "), payload...), nil
+}
@@ -0,0 +1,146 @@
+package control_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/control"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	sign := func(secret string, cmd control.Command) []byte {
+		content, err := control.Sign([]byte(secret), cmd)
+		require.NoError(t, err)
+
+		return content
+	}
+
+	level := json.RawMessage(`{"level":"info"}`)
+	expires := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		content []byte
+		ran     bool
+		err     error
+	}{
+		{
+			name:    "signed",
+			content: sign("secret", control.Command{Command: "set_log_level", Args: level, Expires: expires}),
+			ran:     true,
+		},
+		{
+			name:    "for this node",
+			content: sign("secret", control.Command{Command: "set_log_level", Args: level, Nodes: []string{"edge_1"}, Expires: expires}),
+			ran:     true,
+		},
+		{
+			name:    "for other nodes",
+			content: sign("secret", control.Command{Command: "set_log_level", Args: level, Nodes: []string{"edge_2"}, Expires: expires}),
+		},
+		{
+			name:    "other secret",
+			content: sign("other", control.Command{Command: "set_log_level", Args: level, Expires: expires}),
+			err:     control.ErrBadSignature,
+		},
+		{
+			name:    "unsigned",
+			content: []byte(`{"command":"set_log_level"}`),
+			err:     control.ErrBadSignature,
+		},
+		{
+			name:    "unknown command",
+			content: sign("secret", control.Command{Command: "drop_everything", Expires: expires}),
+			err:     control.ErrUnknownCommand,
+		},
+		{
+			name:    "without expiry",
+			content: sign("secret", control.Command{Command: "set_log_level", Args: level}),
+			err:     control.ErrNoExpiry,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := control.New("secret", "edge_1")
+
+			var got json.RawMessage
+
+			c.Handle("set_log_level", func(_ context.Context, args json.RawMessage) error {
+				got = args
+				return nil
+			})
+
+			err := c.Run(context.Background(), tt.content)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			if tt.ran {
+				assert.JSONEq(t, string(level), string(got))
+			} else {
+				assert.Nil(t, got)
+			}
+		})
+	}
+}
+
+func TestRunExpired(t *testing.T) {
+	c := control.New("secret", "edge_1")
+	c.Handle("rotate_keys", func(context.Context, json.RawMessage) error {
+		t.Fatal("expired command ran")
+		return nil
+	})
+
+	content, err := control.Sign([]byte("secret"), control.Command{Command: "rotate_keys", Expires: time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+
+	assert.Error(t, c.Run(context.Background(), content))
+}
+
+func TestRunOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.json")
+
+	var ran int
+
+	controller := func() *control.Controller {
+		journal, err := control.OpenJournal(path)
+		require.NoError(t, err)
+
+		c := control.New("secret", "edge_1")
+		c.SetJournal(journal)
+		c.Handle("rotate_keys", func(context.Context, json.RawMessage) error {
+			ran++
+			return nil
+		})
+
+		return c
+	}
+
+	content, err := control.Sign([]byte("secret"), control.Command{Command: "rotate_keys", Expires: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	c := controller()
+	require.NoError(t, c.Run(context.Background(), content))
+	assert.ErrorIs(t, c.Run(context.Background(), content), control.ErrRan)
+
+	// the signature's case doesn't make it another command
+	sig, payload, _ := bytes.Cut(content, []byte(" "))
+	upper := append([]byte(strings.ToUpper(string(sig))+" "), payload...)
+	assert.ErrorIs(t, c.Run(context.Background(), upper), control.ErrRan)
+
+	// nor does restarting the node
+	assert.ErrorIs(t, controller().Run(context.Background(), content), control.ErrRan)
+
+	assert.Equal(t, 1, ran)
+}
@@ -0,0 +1,110 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Journal records the commands a node ran until they expire, so each
+// runs once even when its message is delivered again, e.g. after a
+// restart, or emitted again by someone who read it from the WAL.
+type Journal struct {
+	path string
+
+	mu  sync.Mutex
+	ran map[string]time.Time
+}
+
+// OpenJournal reads the journal kept in the file at path, which is
+// created on the first command. An empty path keeps it in memory.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path, ran: make(map[string]time.Time)}
+	if path == "" {
+		return j, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return j, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &j.ran); err != nil {
+		return nil, fmt.Errorf("parse journal %s: %w", path, err)
+	}
+
+	return j, nil
+}
+
+// record records the command with the signature sig until it expires,
+// it's false when the command was already recorded.
+func (j *Journal) record(sig string, expires, now time.Time) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.ran[sig]; ok {
+		return false, nil
+	}
+
+	// expired commands don't run anyway
+	for s, exp := range j.ran {
+		if now.After(exp) {
+			delete(j.ran, s)
+		}
+	}
+
+	j.ran[sig] = expires
+
+	if err := j.save(); err != nil {
+		delete(j.ran, sig)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// save replaces the journal's file, through a temporary file so
+// a crash leaves either the old or the new journal.
+func (j *Journal) save() error {
+	if j.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(j.ran)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return fmt.Errorf("save journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save journal: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save journal: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save journal: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return fmt.Errorf("save journal: %w", err)
+	}
+
+	return nil
+}
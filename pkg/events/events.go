@@ -0,0 +1,146 @@
+// Package events is the in-process bus between the replication and the
+// proxy. The replication publishes what it applies, and the proxy what
+// it sees of the upstream, so each can react right away instead of
+// polling the other: the proxy drops caches when a schema changes,
+// waits for positions wake as they're applied, and the upstream is
+// probed again as soon as the replication hears from it.
+package events
+
+import (
+	"sync"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// Kind is the kind of an event.
+type Kind int
+
+const (
+	// ChangeApplied is published once a transaction is committed
+	// locally, at its LSN.
+	ChangeApplied Kind = iota + 1
+	// SchemaChanged is published once a change to a local table's
+	// schema, or dropping it, is applied.
+	SchemaChanged
+	// LagUpdated is published as the upstream reports its position,
+	// the LSN, with the LagBytes the local database is behind it.
+	LagUpdated
+	// UpstreamDown and UpstreamUp are published as probes of the
+	// upstream start failing, with the Err, and succeed again.
+	UpstreamDown
+	UpstreamUp
+)
+
+func (k Kind) String() string {
+	switch k {
+	case ChangeApplied:
+		return "change_applied"
+	case SchemaChanged:
+		return "schema_changed"
+	case LagUpdated:
+		return "lag_updated"
+	case UpstreamDown:
+		return "upstream_down"
+	case UpstreamUp:
+		return "upstream_up"
+	}
+
+	return "unknown"
+}
+
+// Event is something that happened in the replication or the proxy, the
+// fields set depend on its kind.
+type Event struct {
+	Kind     Kind
+	LSN      pglogrepl.LSN
+	Table    string
+	LagBytes uint64
+	Err      error
+}
+
+// subscriptionBuffer is the size of a subscription's buffer, events
+// are dropped for subscribers that fall this far behind.
+const subscriptionBuffer = 64
+
+// Bus delivers the published events to handlers and subscribers. A nil
+// Bus drops every event, so publishers don't check for one.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[Kind][]func(Event)
+	subs     map[chan Event]map[Kind]bool
+}
+
+func New() *Bus {
+	return &Bus{handlers: make(map[Kind][]func(Event)), subs: make(map[chan Event]map[Kind]bool)}
+}
+
+// Handle calls f with every event of the kind, in the publisher's
+// goroutine before Publish returns, so f must be quick.
+func (b *Bus) Handle(kind Kind, f func(Event)) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[kind] = append(b.handlers[kind], f)
+}
+
+// Subscribe returns the events of the kinds published from now on, and a
+// func ending the subscription. Events are dropped while the subscriber
+// is behind, so they're hints to read the current state again rather
+// than a complete history.
+func (b *Bus) Subscribe(kinds ...Kind) (<-chan Event, func()) {
+	ch := make(chan Event, subscriptionBuffer)
+
+	if b == nil {
+		return ch, func() {}
+	}
+
+	want := make(map[Kind]bool, len(kinds))
+	for _, k := range kinds {
+		want[k] = true
+	}
+
+	b.mu.Lock()
+	b.subs[ch] = want
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs, ch)
+	}
+}
+
+// Publish delivers the event to the kind's handlers, then to the
+// subscribers of the kind.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers[e.Kind]
+	b.mu.RUnlock()
+
+	for _, f := range handlers {
+		f(e)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch, want := range b.subs {
+		if !want[e.Kind] {
+			continue
+		}
+
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
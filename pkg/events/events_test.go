@@ -0,0 +1,46 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	bus := events.New()
+
+	var handled []string
+	bus.Handle(events.SchemaChanged, func(e events.Event) { handled = append(handled, e.Table) })
+
+	applied, unsubscribe := bus.Subscribe(events.ChangeApplied)
+
+	bus.Publish(events.Event{Kind: events.SchemaChanged, Table: "names"})
+	bus.Publish(events.Event{Kind: events.ChangeApplied, LSN: 100})
+
+	// handlers run before Publish returns
+	assert.Equal(t, []string{"names"}, handled)
+
+	require.Len(t, applied, 1)
+	assert.Equal(t, events.Event{Kind: events.ChangeApplied, LSN: 100}, <-applied)
+
+	// events are dropped while a subscriber is behind
+	for i := 0; i < 1000; i++ {
+		bus.Publish(events.Event{Kind: events.ChangeApplied})
+	}
+
+	assert.Less(t, len(applied), 1000)
+
+	unsubscribe()
+	bus.Publish(events.Event{Kind: events.ChangeApplied, LSN: 200})
+
+	for len(applied) > 0 {
+		assert.NotEqual(t, events.Event{Kind: events.ChangeApplied, LSN: 200}, <-applied)
+	}
+
+	// a nil bus drops everything
+	var none *events.Bus
+	none.Handle(events.ChangeApplied, func(events.Event) { t.Fatal("handled on a nil bus") })
+	none.Publish(events.Event{Kind: events.ChangeApplied})
+}
@@ -0,0 +1,364 @@
+// Package graphql serves a read-only GraphQL API over the replicated
+// tables, with a schema generated from the local database.
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/rs/zerolog/log"
+)
+
+// Request is a GraphQL request, as described by
+// https://graphql.github.io/graphql-over-http/draft/.
+type Request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+type Response struct {
+	Data   map[string]any `json:"data"`
+	Errors []Error        `json:"errors,omitempty"`
+}
+
+type Error struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// Handler serves GraphQL requests, GET with the query in the url
+// or POST with a JSON body, and the schema's SDL on GET with ?sdl.
+func Handler(reader pgwire.Reader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		schema, err := LoadSchema(r.Context(), reader)
+		if err != nil {
+			log.Error().Err(err).Msg("graphql schema")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		var req Request
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Has("sdl"):
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, schema.SDL())
+
+			return
+		case r.Method == http.MethodGet:
+			q := r.URL.Query()
+			req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+
+			if v := q.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					writeResponse(w, http.StatusBadRequest, Response{Errors: []Error{{Message: "invalid variables: " + err.Error()}}})
+					return
+				}
+			}
+		default:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeResponse(w, http.StatusBadRequest, Response{Errors: []Error{{Message: "invalid request: " + err.Error()}}})
+				return
+			}
+		}
+
+		res, err := Execute(r.Context(), reader, schema, req)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, Response{Errors: []Error{{Message: err.Error()}}})
+			return
+		}
+
+		writeResponse(w, http.StatusOK, res)
+	})
+}
+
+func writeResponse(w http.ResponseWriter, status int, res Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error().Err(err).Msg("write graphql response")
+	}
+}
+
+// Execute runs the request's operation, the error is set when the
+// request can't be run, and errors reading a table are in the response.
+func Execute(ctx context.Context, reader pgwire.Reader, schema *Schema, req Request) (Response, error) {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return Response{}, err
+	}
+
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return Response{}, err
+	}
+
+	vars := make(map[string]any, len(op.variables))
+	for name, v := range op.variables {
+		vars[name] = v
+	}
+
+	for name, v := range req.Variables {
+		vars[name] = v
+	}
+
+	res := Response{Data: map[string]any{}}
+
+	for _, f := range op.selection {
+		if f.name == "__typename" {
+			res.Data[f.alias] = "Query"
+			continue
+		}
+
+		table, ok := schema.table(f.name)
+		if !ok {
+			return Response{}, fmt.Errorf("cannot query field %q on type \"Query\"", f.name)
+		}
+
+		q, err := selectQuery(table, f, vars)
+		if err != nil {
+			return Response{}, err
+		}
+
+		rows, err := q.run(ctx, reader)
+		if err != nil {
+			res.Data[f.alias] = nil
+			res.Errors = append(res.Errors, Error{Message: err.Error(), Path: []any{f.alias}})
+
+			continue
+		}
+
+		res.Data[f.alias] = rows
+	}
+
+	return res, nil
+}
+
+func (doc *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, errors.New("operationName is required for documents with several operations")
+		}
+
+		return doc.operations[0], nil
+	}
+
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+// query reads a table field's rows.
+type query struct {
+	table     Table
+	selection []*field
+	sql       string
+	args      []any
+}
+
+func selectQuery(table Table, f *field, vars map[string]any) (*query, error) {
+	if len(f.selection) == 0 {
+		return nil, fmt.Errorf("field %q of type \"[%s!]!\" must have a selection of subfields", f.name, table.Name)
+	}
+
+	q := &query{table: table, selection: f.selection}
+
+	var cols []string
+
+	for _, sf := range f.selection {
+		if len(sf.selection) > 0 || len(sf.arguments) > 0 {
+			return nil, fmt.Errorf("field %q of %q takes no arguments or subfields", sf.name, table.Name)
+		}
+
+		if sf.name == "__typename" {
+			continue
+		}
+
+		if _, ok := table.column(sf.name); !ok {
+			return nil, fmt.Errorf("cannot query field %q on type %q", sf.name, table.Name)
+		}
+
+		cols = append(cols, sqlgen.QuoteIdentifier(sf.name))
+	}
+
+	if len(cols) == 0 {
+		// __typename only, the rows are still counted
+		cols = append(cols, "1")
+	}
+
+	var (
+		where   []string
+		orderBy string
+		desc    bool
+		limit   any
+		offset  any
+	)
+
+	for name, v := range f.arguments {
+		v, err := resolve(v, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "where":
+			filter, ok := v.(map[string]any)
+			if !ok && v != nil {
+				return nil, fmt.Errorf("argument \"where\" of %q must be an object", table.Name)
+			}
+
+			for col, want := range filter {
+				if _, ok := table.column(col); !ok {
+					return nil, fmt.Errorf("unknown field %q in the filter of %q", col, table.Name)
+				}
+
+				if want == nil {
+					where = append(where, sqlgen.QuoteIdentifier(col)+" IS NULL")
+					continue
+				}
+
+				switch want.(type) {
+				case map[string]any, []any:
+					return nil, fmt.Errorf("filter %q of %q must be a scalar", col, table.Name)
+				}
+
+				q.args = append(q.args, pgwire.Param(want))
+				where = append(where, fmt.Sprintf("%s = $%d", sqlgen.QuoteIdentifier(col), len(q.args)))
+			}
+		case "order_by":
+			col := fmt.Sprint(v)
+			if _, ok := table.column(col); !ok {
+				return nil, fmt.Errorf("unknown column %q to order %q by", col, table.Name)
+			}
+
+			orderBy = col
+		case "desc":
+			desc, _ = v.(bool)
+		case "limit":
+			limit = pgwire.Param(v)
+		case "offset":
+			offset = pgwire.Param(v)
+		default:
+			return nil, fmt.Errorf("unknown argument %q on field %q", name, table.Name)
+		}
+	}
+
+	sql := "SELECT " + strings.Join(cols, ", ") + " FROM " + sqlgen.QuoteIdentifier(table.Name)
+
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	if orderBy != "" {
+		sql += " ORDER BY " + sqlgen.QuoteIdentifier(orderBy)
+
+		if desc {
+			sql += " DESC"
+		}
+	}
+
+	if limit != nil || offset != nil {
+		if limit == nil {
+			limit = int64(-1)
+		}
+
+		q.args = append(q.args, limit)
+		sql += fmt.Sprintf(" LIMIT $%d", len(q.args))
+
+		if offset != nil {
+			q.args = append(q.args, offset)
+			sql += fmt.Sprintf(" OFFSET $%d", len(q.args))
+		}
+	}
+
+	q.sql = sql
+
+	return q, nil
+}
+
+func (q *query) run(ctx context.Context, reader pgwire.Reader) ([]map[string]any, error) {
+	res, err := reader.Read(ctx, "", q.sql, q.args)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]map[string]any, 0, len(res.Rows))
+
+	for _, row := range res.Rows {
+		out := make(map[string]any, len(q.selection))
+
+		for _, sf := range q.selection {
+			if sf.name == "__typename" {
+				out[sf.alias] = q.table.Name
+				continue
+			}
+
+			for i, col := range res.Columns {
+				if col == sf.name {
+					out[sf.alias] = row[i]
+					break
+				}
+			}
+		}
+
+		rows = append(rows, out)
+	}
+
+	return rows, nil
+}
+
+// resolve replaces the variables in the value.
+func resolve(v any, vars map[string]any) (any, error) {
+	switch v := v.(type) {
+	case variable:
+		val, ok := vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("variable \"$%s\" is not defined", v)
+		}
+
+		return val, nil
+	case enum:
+		return string(v), nil
+	case map[string]any:
+		out := make(map[string]any, len(v))
+
+		for k, item := range v {
+			r, err := resolve(item, vars)
+			if err != nil {
+				return nil, err
+			}
+
+			out[k] = r
+		}
+
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+
+		for i, item := range v {
+			r, err := resolve(item, vars)
+			if err != nil {
+				return nil, err
+			}
+
+			out[i] = r
+		}
+
+		return out, nil
+	}
+
+	return v, nil
+}
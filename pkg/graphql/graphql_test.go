@@ -0,0 +1,98 @@
+package graphql_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/graphql"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecute(t *testing.T) {
+	local, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+
+	local.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		"CREATE TABLE names (id integer, name text, score real, PRIMARY KEY (id));",
+		"CREATE TABLE postgres_pos (source_db text, plugin text, publication text, pos text);",
+		"INSERT INTO names VALUES (1, 'Hello', 1.5), (2, 'World', NULL), (3, 'Again', 2);",
+	} {
+		_, err := local.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	reader := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local)
+
+	schema, err := graphql.LoadSchema(context.Background(), reader)
+	require.NoError(t, err)
+
+	assert.Equal(t, []graphql.Table{{Name: "names", Columns: []graphql.Column{
+		{Name: "id", Type: "Int"},
+		{Name: "name", Type: "String"},
+		{Name: "score", Type: "Float"},
+	}}}, schema.Tables)
+	assert.Contains(t, schema.SDL(), "names(where: names_filter, order_by: names_column, desc: Boolean, limit: Int, offset: Int): [names!]!")
+
+	for _, test := range []struct {
+		name    string
+		req     graphql.Request
+		want    string
+		wantErr string
+	}{
+		{
+			name: "rows",
+			req:  graphql.Request{Query: `{ names(order_by: id, desc: true, limit: 2) { id title: name } }`},
+			want: `{"data":{"names":[{"id":3,"title":"Again"},{"id":2,"title":"World"}]}}`,
+		},
+		{
+			name: "variables",
+			req: graphql.Request{
+				Query:     `query Named($id: Int = 1) { names(where: {id: $id}) { __typename name score } }`,
+				Variables: map[string]any{"id": float64(3)},
+			},
+			want: `{"data":{"names":[{"__typename":"names","name":"Again","score":2}]}}`,
+		},
+		{
+			name: "null filter",
+			req:  graphql.Request{Query: `query { names(where: {score: null}) { id } }`},
+			want: `{"data":{"names":[{"id":2}]}}`,
+		},
+		{
+			name:    "unknown table",
+			req:     graphql.Request{Query: `{ postgres_pos { pos } }`},
+			wantErr: `cannot query field "postgres_pos" on type "Query"`,
+		},
+		{
+			name:    "mutation",
+			req:     graphql.Request{Query: `mutation { names { id } }`},
+			wantErr: "mutation operations aren't supported, the schema is read only",
+		},
+		{
+			name:    "syntax",
+			req:     graphql.Request{Query: `{ names { id }`},
+			wantErr: "syntax error: unexpected end of document",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := graphql.Execute(context.Background(), reader, schema, test.req)
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+
+			b, err := json.Marshal(res)
+			require.NoError(t, err)
+			assert.JSONEq(t, test.want, string(b))
+		})
+	}
+}
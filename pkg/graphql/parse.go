@@ -0,0 +1,505 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The parser covers the parts of the GraphQL query language a read-only
+// schema needs, see https://spec.graphql.org/October2021/#sec-Language.
+// Fragments, directives and mutations aren't supported.
+
+type document struct {
+	operations []*operation
+}
+
+type operation struct {
+	name      string
+	variables map[string]any
+	selection []*field
+}
+
+type field struct {
+	alias     string
+	name      string
+	arguments map[string]any
+	selection []*field
+}
+
+// variable is a $name value, resolved when the query is executed.
+type variable string
+
+// enum is an enum value, which is used as a string.
+type enum string
+
+type parser struct {
+	src string
+	pos int
+	// tok is the current token, its kind is one of the punctuators,
+	// or 'n' for names, 's' for strings, 'i' and 'f' for numbers,
+	// and 0 at the end of the source.
+	tok  string
+	kind byte
+}
+
+func parse(src string) (*document, error) {
+	p := &parser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	doc := &document{}
+
+	for p.kind != 0 {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+
+		doc.operations = append(doc.operations, op)
+	}
+
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("no operations in the document")
+	}
+
+	return doc, nil
+}
+
+func (p *parser) operation() (*operation, error) {
+	op := &operation{variables: map[string]any{}}
+
+	if p.kind == 'n' {
+		switch p.tok {
+		case "query":
+		case "mutation", "subscription":
+			return nil, fmt.Errorf("%s operations aren't supported, the schema is read only", p.tok)
+		case "fragment":
+			return nil, fmt.Errorf("fragments aren't supported")
+		default:
+			return nil, p.unexpected()
+		}
+
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		if p.kind == 'n' {
+			op.name = p.tok
+
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+
+		if p.kind == '(' {
+			if err := p.variableDefinitions(op); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if p.kind != '{' {
+		return nil, p.unexpected()
+	}
+
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+
+	op.selection = sel
+
+	return op, nil
+}
+
+// variableDefinitions reads ($name: Type = default, ...), keeping the
+// defaults; the types aren't checked.
+func (p *parser) variableDefinitions(op *operation) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+
+	for p.kind != ')' {
+		if p.kind != '$' {
+			return p.unexpected()
+		}
+
+		if err := p.next(); err != nil {
+			return err
+		}
+
+		if p.kind != 'n' {
+			return p.unexpected()
+		}
+
+		name := p.tok
+
+		if err := p.expect(':'); err != nil {
+			return err
+		}
+
+		if err := p.next(); err != nil {
+			return err
+		}
+
+		// the type is a name, with list brackets and non-null marks
+		for p.kind == 'n' || p.kind == '[' || p.kind == ']' || p.kind == '!' {
+			if err := p.next(); err != nil {
+				return err
+			}
+		}
+
+		op.variables[name] = nil
+
+		if p.kind == '=' {
+			if err := p.next(); err != nil {
+				return err
+			}
+
+			v, err := p.value()
+			if err != nil {
+				return err
+			}
+
+			op.variables[name] = v
+		}
+	}
+
+	return p.next()
+}
+
+func (p *parser) selectionSet() ([]*field, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	var fields []*field
+
+	for p.kind != '}' {
+		if p.kind == '.' {
+			return nil, fmt.Errorf("fragments aren't supported")
+		}
+
+		if p.kind == '@' {
+			return nil, fmt.Errorf("directives aren't supported")
+		}
+
+		if p.kind != 'n' {
+			return nil, p.unexpected()
+		}
+
+		f := &field{name: p.tok}
+
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		if p.kind == ':' {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+
+			if p.kind != 'n' {
+				return nil, p.unexpected()
+			}
+
+			f.alias, f.name = f.name, p.tok
+
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+
+		if f.alias == "" {
+			f.alias = f.name
+		}
+
+		if p.kind == '(' {
+			args, err := p.object(')')
+			if err != nil {
+				return nil, err
+			}
+
+			f.arguments = args
+		}
+
+		if p.kind == '{' {
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+
+			f.selection = sel
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields, p.next()
+}
+
+// object reads name: value pairs up to the closing punctuator, for
+// arguments and input objects.
+func (p *parser) object(end byte) (map[string]any, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	out := map[string]any{}
+
+	for p.kind != end {
+		if p.kind != 'n' {
+			return nil, p.unexpected()
+		}
+
+		name := p.tok
+
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+
+		out[name] = v
+	}
+
+	return out, p.next()
+}
+
+func (p *parser) value() (any, error) {
+	var v any
+
+	switch p.kind {
+	case '$':
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		if p.kind != 'n' {
+			return nil, p.unexpected()
+		}
+
+		v = variable(p.tok)
+	case '[':
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		list := []any{}
+
+		for p.kind != ']' {
+			item, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+
+			list = append(list, item)
+		}
+
+		return list, p.next()
+	case '{':
+		return p.object('}')
+	case 's':
+		v = p.tok
+	case 'i':
+		i, err := strconv.ParseInt(p.tok, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %s: %w", p.tok, err)
+		}
+
+		v = i
+	case 'f':
+		f, err := strconv.ParseFloat(p.tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float %s: %w", p.tok, err)
+		}
+
+		v = f
+	case 'n':
+		switch p.tok {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = enum(p.tok)
+		}
+	default:
+		return nil, p.unexpected()
+	}
+
+	return v, p.next()
+}
+
+func (p *parser) expect(kind byte) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+
+	if p.kind != kind {
+		return p.unexpected()
+	}
+
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	if p.kind == 0 {
+		return fmt.Errorf("syntax error: unexpected end of document")
+	}
+
+	return fmt.Errorf("syntax error: unexpected %q at offset %d", p.tok, p.pos-len(p.tok))
+}
+
+// next reads the next token, skipping whitespace, commas and comments.
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return p.token()
+		}
+	}
+
+	p.tok, p.kind = "", 0
+
+	return nil
+}
+
+func (p *parser) token() error {
+	start := p.pos
+	c := p.src[p.pos]
+
+	switch {
+	case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+		p.pos++
+		p.tok, p.kind = p.src[start:p.pos], c
+	case c == '.':
+		if !strings.HasPrefix(p.src[p.pos:], "...") {
+			return fmt.Errorf("syntax error: unexpected %q at offset %d", c, p.pos)
+		}
+
+		p.pos += 3
+		p.tok, p.kind = "...", '.'
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+
+		p.tok, p.kind = p.src[start:p.pos], 'n'
+	case c == '-' || isDigit(c):
+		p.kind = 'i'
+		p.pos++
+
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c == '.' || c == 'e' || c == 'E' || ((c == '+' || c == '-') && p.kind == 'f') {
+				p.kind = 'f'
+			} else if !isDigit(c) {
+				break
+			}
+
+			p.pos++
+		}
+
+		p.tok = p.src[start:p.pos]
+	case c == '"':
+		return p.string()
+	default:
+		return fmt.Errorf("syntax error: unexpected %q at offset %d", c, p.pos)
+	}
+
+	return nil
+}
+
+// string reads a quoted string, block strings aren't supported.
+func (p *parser) string() error {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		return fmt.Errorf("block strings aren't supported")
+	}
+
+	var b strings.Builder
+
+	for p.pos++; p.pos < len(p.src); {
+		c := p.src[p.pos]
+
+		switch c {
+		case '"':
+			p.pos++
+			p.tok, p.kind = b.String(), 's'
+
+			return nil
+		case '\n':
+			return fmt.Errorf("syntax error: unterminated string")
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				return fmt.Errorf("syntax error: unterminated string")
+			}
+
+			esc := p.src[p.pos+1]
+			p.pos += 2
+
+			switch esc {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case '"', '\\', '/':
+				b.WriteByte(esc)
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return fmt.Errorf("syntax error: invalid unicode escape")
+				}
+
+				r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return fmt.Errorf("syntax error: invalid unicode escape: %w", err)
+				}
+
+				b.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				return fmt.Errorf("syntax error: invalid escape \\%c", esc)
+			}
+		default:
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			b.WriteRune(r)
+			p.pos += size
+		}
+	}
+
+	return fmt.Errorf("syntax error: unterminated string")
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,143 @@
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+)
+
+var validName = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// Schema is the GraphQL schema of the replicated tables, each table is a
+// field of the Query type returning a list of the table's rows.
+type Schema struct {
+	Tables []Table
+}
+
+type Table struct {
+	Name    string
+	Columns []Column
+}
+
+type Column struct {
+	Name string
+	// Type is the GraphQL scalar type of the column.
+	Type string
+}
+
+func (s *Schema) table(name string) (Table, bool) {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t, true
+		}
+	}
+
+	return Table{}, false
+}
+
+func (t Table) column(name string) (Column, bool) {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return Column{}, false
+}
+
+// LoadSchema builds the schema from the local database's tables. Tables
+// and columns whose names aren't valid GraphQL names are left out.
+func LoadSchema(ctx context.Context, reader pgwire.Reader) (*Schema, error) {
+	res, err := reader.Read(ctx, "", "SELECT tbl_name, sql FROM sqlite_schema WHERE type = 'table' AND tbl_name NOT LIKE 'sqlite_%'", nil)
+	if err != nil {
+		return nil, fmt.Errorf("read local schema: %w", err)
+	}
+
+	schema := &Schema{}
+
+	for _, row := range res.Rows {
+		name, _ := row[0].(string)
+		ddl, _ := row[1].(string)
+
+		if sqlgen.Internal(name) || !validName.MatchString(name) || strings.HasPrefix(name, "__") {
+			continue
+		}
+
+		_, cols, err := sqlgen.NewParser(ddl).Parse()
+		if err != nil {
+			return nil, fmt.Errorf("parse table %q: %w", name, err)
+		}
+
+		table := Table{Name: name}
+
+		for _, col := range cols {
+			if !validName.MatchString(col.Name) || strings.HasPrefix(col.Name, "__") {
+				continue
+			}
+
+			table.Columns = append(table.Columns, Column{Name: col.Name, Type: scalarType(col.Type)})
+		}
+
+		if len(table.Columns) > 0 {
+			schema.Tables = append(schema.Tables, table)
+		}
+	}
+
+	sort.Slice(schema.Tables, func(i, j int) bool { return schema.Tables[i].Name < schema.Tables[j].Name })
+
+	return schema, nil
+}
+
+func scalarType(t sqlgen.ColType) string {
+	switch t {
+	case sqlgen.SQLiteColTypeInteger:
+		return "Int"
+	case sqlgen.SQLiteColTypeReal:
+		return "Float"
+	}
+
+	return "String"
+}
+
+// SDL describes the schema in the GraphQL schema definition language.
+func (s *Schema) SDL() string {
+	var b strings.Builder
+
+	b.WriteString("type Query {\n")
+
+	for _, t := range s.Tables {
+		fmt.Fprintf(&b, "  %s(where: %s_filter, order_by: %s_column, desc: Boolean, limit: Int, offset: Int): [%s!]!\n",
+			t.Name, t.Name, t.Name, t.Name)
+	}
+
+	b.WriteString("}\n")
+
+	for _, t := range s.Tables {
+		fmt.Fprintf(&b, "\ntype %s {\n", t.Name)
+
+		for _, c := range t.Columns {
+			fmt.Fprintf(&b, "  %s: %s\n", c.Name, c.Type)
+		}
+
+		fmt.Fprintf(&b, "}\n\ninput %s_filter {\n", t.Name)
+
+		for _, c := range t.Columns {
+			fmt.Fprintf(&b, "  %s: %s\n", c.Name, c.Type)
+		}
+
+		fmt.Fprintf(&b, "}\n\nenum %s_column {\n", t.Name)
+
+		for _, c := range t.Columns {
+			fmt.Fprintf(&b, "  %s\n", c.Name)
+		}
+
+		b.WriteString("}\n")
+	}
+
+	return b.String()
+}
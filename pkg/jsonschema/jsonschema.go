@@ -0,0 +1,116 @@
+// Package jsonschema describes replicated tables as JSON Schema documents,
+// from the relation metadata of the replication stream. The documents
+// describe rows as they appear in change events and query results, with
+// numbers as JSON numbers and every other value in postgres' text format.
+package jsonschema
+
+import (
+	"strconv"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Draft is the JSON Schema dialect of the documents, which OpenAPI 3.1
+// components use too.
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is a JSON Schema document, or one of its properties.
+type Schema struct {
+	Schema      string             `json:"$schema,omitempty"`
+	ID          string             `json:"$id,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Type        any                `json:"type"`
+	Format      string             `json:"format,omitempty"`
+	Enum        []any              `json:"enum,omitempty"`
+	ContentType string             `json:"contentMediaType,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	// Additional is false for tables, rows have no other columns.
+	Additional *bool `json:"additionalProperties,omitempty"`
+	// PGType is the column's postgres type.
+	PGType string `json:"x-pg-type,omitempty"`
+}
+
+var types = pgtype.NewMap()
+
+// Table returns the schema of the relation's rows. Key columns are
+// required, the others may be null or, in change events, missing when
+// they're unchanged TOASTed values.
+func Table(rel *pglogrepl.RelationMessageV2) *Schema {
+	name := rel.Namespace + "." + rel.RelationName
+	closed := false
+
+	s := &Schema{
+		Title:      name,
+		Type:       "object",
+		Properties: make(map[string]*Schema, len(rel.Columns)),
+		Additional: &closed,
+	}
+
+	for _, col := range rel.Columns {
+		prop := column(col.DataType)
+
+		if col.Flags == 1 {
+			s.Required = append(s.Required, col.Name)
+		} else {
+			prop.Type = []string{prop.Type.(string), "null"}
+
+			if prop.Enum != nil {
+				prop.Enum = append(prop.Enum, nil)
+			}
+		}
+
+		s.Properties[col.Name] = prop
+	}
+
+	return s
+}
+
+// Document returns the table's schema as a standalone document.
+func Document(rel *pglogrepl.RelationMessageV2) *Schema {
+	s := Table(rel)
+	s.Schema = Draft
+	s.ID = s.Title
+
+	return s
+}
+
+// Components returns the tables' schemas as OpenAPI components, to
+// merge into a service's OpenAPI document.
+func Components(rels []*pglogrepl.RelationMessageV2) map[string]any {
+	schemas := make(map[string]*Schema, len(rels))
+
+	for _, rel := range rels {
+		s := Table(rel)
+		schemas[s.Title] = s
+	}
+
+	return map[string]any{"components": map[string]any{"schemas": schemas}}
+}
+
+// column returns the schema of a column of the type.
+func column(oid uint32) *Schema {
+	s := &Schema{Type: "string", PGType: strconv.FormatUint(uint64(oid), 10)}
+
+	if t, ok := types.TypeForOID(oid); ok {
+		s.PGType = t.Name
+	}
+
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+		s.Type = "integer"
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		s.Type = "number"
+	case pgtype.BoolOID:
+		s.Enum = []any{"t", "f"}
+	case pgtype.UUIDOID:
+		s.Format = "uuid"
+	case pgtype.DateOID:
+		s.Format = "date"
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		s.ContentType = "application/json"
+	}
+
+	return s
+}
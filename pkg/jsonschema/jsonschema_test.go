@@ -0,0 +1,60 @@
+package jsonschema_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/jsonschema"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDocument(t *testing.T) {
+	rel := &pglogrepl.RelationMessageV2{
+		RelationMessage: pglogrepl.RelationMessage{
+			Namespace:    "public",
+			RelationName: "orders",
+			Columns: []*pglogrepl.RelationMessageColumn{
+				{Flags: 1, Name: "id", DataType: pgtype.Int8OID},
+				{Name: "total", DataType: pgtype.NumericOID},
+				{Name: "paid", DataType: pgtype.BoolOID},
+				{Name: "ref", DataType: pgtype.UUIDOID},
+				{Name: "meta", DataType: pgtype.JSONBOID},
+			},
+		},
+	}
+
+	out, err := json.Marshal(jsonschema.Document(rel))
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id": "public.orders",
+		"title": "public.orders",
+		"type": "object",
+		"properties": {
+			"id": {"type": "integer", "x-pg-type": "int8"},
+			"total": {"type": ["number", "null"], "x-pg-type": "numeric"},
+			"paid": {"type": ["string", "null"], "enum": ["t", "f", null], "x-pg-type": "bool"},
+			"ref": {"type": ["string", "null"], "format": "uuid", "x-pg-type": "uuid"},
+			"meta": {"type": ["string", "null"], "contentMediaType": "application/json", "x-pg-type": "jsonb"}
+		},
+		"required": ["id"],
+		"additionalProperties": false
+	}`, string(out))
+
+	components, err := json.Marshal(jsonschema.Components([]*pglogrepl.RelationMessageV2{rel}))
+	require.NoError(t, err)
+
+	var doc struct {
+		Components struct {
+			Schemas map[string]map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+
+	require.NoError(t, json.Unmarshal(components, &doc))
+	require.Contains(t, doc.Components.Schemas, "public.orders")
+	assert.NotContains(t, doc.Components.Schemas["public.orders"], "$schema")
+}
@@ -0,0 +1,163 @@
+// Package keys generates primary keys that sort by creation time and
+// don't collide across nodes, so rows created at the edge can't clash
+// with each other or with the upstream's own keys.
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+)
+
+// Kinds of generated keys.
+const (
+	KindUUIDv7 = "uuidv7"
+	KindULID   = "ulid"
+)
+
+// Default is a column filled with a generated key when a row
+// is inserted without a value for it.
+type Default struct {
+	Table  string
+	Column string
+	Kind   string
+}
+
+// ParseDefaults parses the key defaults, each "table.column=kind" with
+// kind uuidv7 or ulid.
+func ParseDefaults(specs []string) ([]Default, error) {
+	defaults := make([]Default, 0, len(specs))
+
+	for _, spec := range specs {
+		name, kind, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		table, column, qualified := strings.Cut(name, ".")
+
+		if !ok || !qualified || table == "" || column == "" {
+			return nil, fmt.Errorf("invalid key default %q, expected table.column=kind", spec)
+		}
+
+		kind = strings.ToLower(kind)
+		if kind != KindUUIDv7 && kind != KindULID {
+			return nil, fmt.Errorf("invalid key default %q: unknown kind %q", spec, kind)
+		}
+
+		defaults = append(defaults, Default{Table: table, Column: column, Kind: kind})
+	}
+
+	return defaults, nil
+}
+
+// IDGenerator generates keys, see Generator.
+type IDGenerator interface {
+	New(kind string) (string, error)
+}
+
+// Generator generates keys from the time of its clock and the bytes
+// of its random source, both fixed in tests for repeatable keys.
+type Generator struct {
+	clock clock.Clock
+	rand  io.Reader
+}
+
+// NewGenerator returns a generator reading the time from c and random
+// bytes from r, the system clock and crypto/rand when they're nil.
+func NewGenerator(c clock.Clock, r io.Reader) *Generator {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	return &Generator{clock: clock.Or(c), rand: r}
+}
+
+// New returns a key of the kind.
+func (g *Generator) New(kind string) (string, error) {
+	var b [10]byte
+
+	if _, err := io.ReadFull(g.rand, b[:]); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
+	}
+
+	switch kind {
+	case KindUUIDv7:
+		return uuidv7(g.clock.Now(), b), nil
+	case KindULID:
+		return ulid(g.clock.Now(), b), nil
+	}
+
+	return "", fmt.Errorf("unknown key kind %q", kind)
+}
+
+var system = NewGenerator(nil, nil)
+
+// New returns a key of the kind, from the system clock and crypto/rand.
+func New(kind string) (string, error) {
+	return system.New(kind)
+}
+
+// UUIDv7 returns a version 7 UUID, the unix milliseconds of t
+// followed by 74 random bits, e.g. 018f2b6e-0c3a-7d41-9a5e-3b1f6c2d8e90.
+func UUIDv7(t time.Time) string {
+	return uuidv7(t, random())
+}
+
+func uuidv7(t time.Time, r [10]byte) string {
+	var b [16]byte
+
+	copy(b[6:], r[:])
+	binary.BigEndian.PutUint64(b[:8], uint64(t.UnixMilli())<<16|uint64(binary.BigEndian.Uint16(b[6:8])))
+
+	b[6] = b[6]&0x0f | 0x70 // version 7
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+
+	s := hex.EncodeToString(b[:])
+
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// crockford is the base32 alphabet of ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID returns a ULID, the unix milliseconds of t followed by 80 random
+// bits in Crockford's base32, e.g. 01HX5V3Q8Z4M7K2N9P6R1T0W3Y.
+func ULID(t time.Time) string {
+	return ulid(t, random())
+}
+
+func ulid(t time.Time, r [10]byte) string {
+	var b [16]byte
+
+	copy(b[6:], r[:])
+	ms := uint64(t.UnixMilli())
+
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+
+	// 128 bits as 26 characters of 5 bits, the first holding the top 3
+	out := make([]byte, 26)
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(out)
+}
+
+func random() [10]byte {
+	var b [10]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("read random bytes: %v", err))
+	}
+
+	return b
+}
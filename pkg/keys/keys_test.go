@@ -0,0 +1,48 @@
+package keys_test
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/keys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUIDv7(t *testing.T) {
+	at := time.UnixMilli(0x018f2b6e0c3a)
+
+	id := keys.UUIDv7(at)
+	assert.Regexp(t, regexp.MustCompile(`^018f2b6e-0c3a-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+
+	// later keys sort after earlier ones
+	assert.Less(t, id, keys.UUIDv7(at.Add(time.Millisecond)))
+	assert.NotEqual(t, id, keys.UUIDv7(at))
+}
+
+func TestULID(t *testing.T) {
+	at := time.UnixMilli(1469918176385)
+
+	id := keys.ULID(at)
+	assert.Len(t, id, 26)
+	// the time part of the spec's example
+	assert.Equal(t, "01ARYZ6S41", id[:10])
+
+	assert.Less(t, id, keys.ULID(at.Add(time.Millisecond)))
+	assert.NotEqual(t, id, keys.ULID(at))
+}
+
+func TestParseDefaults(t *testing.T) {
+	got, err := keys.ParseDefaults([]string{"orders.id=uuidv7", " events.event_id=ULID"})
+	require.NoError(t, err)
+	assert.Equal(t, []keys.Default{
+		{Table: "orders", Column: "id", Kind: keys.KindUUIDv7},
+		{Table: "events", Column: "event_id", Kind: keys.KindULID},
+	}, got)
+
+	for _, spec := range []string{"orders=uuidv7", "orders.id", "orders.id=serial"} {
+		_, err := keys.ParseDefaults([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
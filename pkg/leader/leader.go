@@ -0,0 +1,147 @@
+// Package leader elects one of a pair of nodes replicating the same
+// upstream to hold the replication slot and serve clients.
+//
+// Leadership is a Postgres session advisory lock on the upstream. The lock
+// is released when the leader's connection closes, so when the leader
+// crashes or loses the upstream, the standby takes the lock over.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Elector competes for leadership with the other nodes using the same key.
+type Elector struct {
+	connString string
+	key        int64
+	interval   time.Duration
+
+	leader atomic.Bool
+}
+
+// New returns an elector for the advisory lock key, trying for the lock
+// and checking it's still held every interval.
+func New(connString string, key int64, interval time.Duration) *Elector {
+	return &Elector{connString: connString, key: key, interval: interval}
+}
+
+// Key derives an advisory lock key from a name, such as the slot name,
+// so pairs replicating the same upstream with different slots don't
+// compete with each other.
+func Key(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("sqledge:" + name))
+
+	return int64(h.Sum64())
+}
+
+// IsLeader reports whether this node holds the lock.
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Acquire blocks until this node holds the lock or the context is done.
+// The returned channel is closed if the lock is lost, after which another
+// node may be the leader.
+func (e *Elector) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		conn, err := e.tryLock(ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("leader election")
+		}
+
+		if conn != nil {
+			e.leader.Store(true)
+
+			lost := make(chan struct{})
+			go e.hold(ctx, conn, lost)
+
+			return lost, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryLock returns the connection holding the lock,
+// or nil when another node holds it.
+func (e *Elector) tryLock(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, e.connString)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", e.key).Scan(&locked); err != nil {
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("try lock: %w", err)
+	}
+
+	if !locked {
+		conn.Close(context.Background())
+		return nil, nil
+	}
+
+	return conn, nil
+}
+
+// hold keeps the lock's connection open, checking it's still alive, until
+// the context is done or the connection fails.
+func (e *Elector) hold(ctx context.Context, conn *pgx.Conn, lost chan struct{}) {
+	defer func() {
+		e.leader.Store(false)
+		conn.Close(context.Background())
+		close(lost)
+	}()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, e.interval)
+		err := conn.Ping(pingCtx)
+		cancel()
+
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("leader lock connection lost")
+			return
+		}
+	}
+}
+
+// Promote runs the shell command taking over the address clients connect
+// to, e.g. moving a virtual IP or updating a DNS record, once this node is
+// the leader and listens on proxyAddress.
+func Promote(ctx context.Context, hook, proxyAddress string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook)
+	cmd.Env = append(os.Environ(), "SQLEDGE_LEADER_PROXY_ADDRESS="+proxyAddress)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("promote hook: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
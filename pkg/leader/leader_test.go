@@ -0,0 +1,24 @@
+package leader_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/leader"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromote(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "promoted")
+
+	require.NoError(t, leader.Promote(context.Background(), "echo $SQLEDGE_LEADER_PROXY_ADDRESS > "+out, "10.0.0.5:5433"))
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.5:5433\n", string(b))
+
+	assert.ErrorContains(t, leader.Promote(context.Background(), "echo address taken >&2; exit 1", "10.0.0.5:5433"), "address taken")
+}
@@ -0,0 +1,248 @@
+// Package lint checks the upstream's tables for what sqledge can't
+// replicate faithfully, before replication starts.
+package lint
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+)
+
+// DefaultMaxRowBytes is the average row width above which tables are
+// reported, when the config doesn't limit the size of changes.
+const DefaultMaxRowBytes = 1 << 20
+
+// nativeTypes are stored as an equivalent SQLite type, or as text that
+// reads back the same.
+var nativeTypes = []string{
+	"int2", "int4", "int8", "float4", "float8", "bytea", "bool",
+	"text", "varchar", "bpchar", "char", "name", "citext", "uuid", "json", "jsonb",
+	"date", "time", "timetz", "timestamp", "timestamptz",
+}
+
+// Config is what is checked.
+type Config struct {
+	Schema string
+	// Tables are the tables checked, when empty the tables in
+	// the publication, or every table in the schema.
+	Tables      []string
+	Publication string
+	// MaxRowBytes is the average row width above which tables are
+	// reported, defaulting to DefaultMaxRowBytes.
+	MaxRowBytes int64
+}
+
+// Warning is something in a table sqledge can't translate.
+type Warning struct {
+	Table string
+	// Column is empty for warnings about the whole table.
+	Column     string
+	Problem    string
+	Suggestion string
+}
+
+func (w Warning) String() string {
+	name := w.Table
+	if w.Column != "" {
+		name += "." + w.Column
+	}
+
+	return fmt.Sprintf("%s: %s, %s", name, w.Problem, w.Suggestion)
+}
+
+type column struct {
+	name      string
+	typ       string
+	udt       string
+	array     bool
+	generated bool
+}
+
+// Check returns the warnings of the tables, in the order of the tables.
+func Check(ctx context.Context, db *sql.DB, cfg Config) ([]Warning, error) {
+	if cfg.MaxRowBytes <= 0 {
+		cfg.MaxRowBytes = DefaultMaxRowBytes
+	}
+
+	tables := cfg.Tables
+
+	if len(tables) == 0 {
+		var err error
+		if tables, err = publishedTables(ctx, db, cfg.Schema, cfg.Publication); err != nil {
+			return nil, err
+		}
+	}
+
+	var warnings []Warning
+
+	for _, table := range tables {
+		w, err := checkTable(ctx, db, cfg, table)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+
+		warnings = append(warnings, w...)
+	}
+
+	return warnings, nil
+}
+
+func checkTable(ctx context.Context, db *sql.DB, cfg Config, table string) ([]Warning, error) {
+	var warnings []Warning
+
+	warn := func(col, problem, suggestion string) {
+		warnings = append(warnings, Warning{Table: table, Column: col, Problem: problem, Suggestion: suggestion})
+	}
+
+	if sqlgen.Internal(table) || strings.HasPrefix(table, "sqlite_") {
+		warn("", "the name is taken by a local table of sqledge or SQLite", "rename it or leave it out of the publication")
+	}
+
+	cols, err := columns(ctx, db, cfg.Schema, table)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, col := range cols {
+		switch {
+		case col.generated:
+			warn(col.name, "generated columns aren't replicated by pgoutput, so its values are missing locally",
+				"compute it in the queries reading it")
+		case col.array:
+			warn(col.name, fmt.Sprintf("%s is stored as text in postgres' array format", col.typ),
+				"parse it when reading, or "+leaveOut(cfg, table, cols, col.name))
+		case col.udt == "numeric":
+			warn(col.name, fmt.Sprintf("%s is stored as real, losing precision beyond 15 significant digits", col.typ),
+				"store amounts that must be exact as integers of the smallest unit")
+		case !slices.Contains(nativeTypes, col.udt):
+			warn(col.name, fmt.Sprintf("%s has no SQLite equivalent and is stored as text", col.typ),
+				"parse it when reading, or "+leaveOut(cfg, table, cols, col.name))
+		}
+	}
+
+	var (
+		identity   string
+		primaryKey bool
+		width      int64
+		exclusions string
+	)
+
+	err = db.QueryRowContext(ctx, `SELECT c.relreplident::text,
+			EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisprimary),
+			COALESCE((SELECT sum(s.avg_width) FROM pg_stats s WHERE s.schemaname = $1 AND s.tablename = $2), 0)::bigint,
+			COALESCE((SELECT string_agg(conname::text, ',' ORDER BY conname) FROM pg_constraint WHERE conrelid = c.oid AND contype = 'x'), '')
+		FROM pg_class c
+		WHERE c.oid = format('%I.%I', $1::text, $2::text)::regclass`, cfg.Schema, table).
+		Scan(&identity, &primaryKey, &width, &exclusions)
+	if err != nil {
+		return nil, fmt.Errorf("read table: %w", err)
+	}
+
+	switch {
+	case identity == "n", identity == "d" && !primaryKey:
+		warn("", "it has no replica identity, so updates and deletes fail upstream once it's published",
+			fmt.Sprintf("add a primary key, or ALTER TABLE %s.%s REPLICA IDENTITY FULL", cfg.Schema, table))
+	case identity == "f" && !primaryKey:
+		warn("", "it has no primary key, so the local table has none and updates and deletes match every column",
+			"add a primary key")
+	}
+
+	for _, name := range strings.Split(exclusions, ",") {
+		if name == "" {
+			continue
+		}
+
+		warn("", fmt.Sprintf("exclusion constraint %s isn't created locally", name),
+			"nothing to change, the upstream enforces it on writes")
+	}
+
+	if width > cfg.MaxRowBytes {
+		warn("", fmt.Sprintf("rows average %d bytes, changes this large stall replication while they're applied", width),
+			"set SQLEDGE_REPLICATION_MAX_CHANGE_BYTES to dead-letter them, or leave the widest columns out of the publication")
+	}
+
+	return warnings, nil
+}
+
+// leaveOut suggests a publication column list without the column.
+func leaveOut(cfg Config, table string, cols []column, name string) string {
+	var keep []string
+
+	for _, col := range cols {
+		if col.name != name {
+			keep = append(keep, col.name)
+		}
+	}
+
+	return fmt.Sprintf("leave it out of the publication (postgres 15+): ALTER PUBLICATION %s SET TABLE %s.%s (%s)",
+		cfg.Publication, cfg.Schema, table, strings.Join(keep, ", "))
+}
+
+func columns(ctx context.Context, db *sql.DB, schema, table string) ([]column, error) {
+	rows, err := db.QueryContext(ctx, `SELECT a.attname, format_type(a.atttypid, a.atttypmod),
+			COALESCE(e.typname, t.typname), e.oid IS NOT NULL, a.attgenerated <> ''
+		FROM pg_attribute a
+		JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_type e ON e.oid = t.typelem AND t.typcategory = 'A'
+		WHERE a.attrelid = format('%I.%I', $1::text, $2::text)::regclass AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("read columns: %w", err)
+	}
+
+	var cols []column
+
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.name, &c.typ, &c.udt, &c.array, &c.generated); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("read columns: %w", err)
+		}
+
+		cols = append(cols, c)
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, fmt.Errorf("read columns: %w", err)
+	}
+
+	return cols, nil
+}
+
+// publishedTables returns the schema's tables in the publication, or
+// every table in the schema when the publication doesn't exist yet.
+func publishedTables(ctx context.Context, db *sql.DB, schema, publication string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT c.relname::text
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relkind IN ('r', 'p')
+			AND (NOT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $2)
+				OR c.relname IN (SELECT tablename FROM pg_publication_tables WHERE pubname = $2 AND schemaname = $1))
+		ORDER BY c.relname`, schema, publication)
+	if err != nil {
+		return nil, fmt.Errorf("list tables: %w", err)
+	}
+
+	var tables []string
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("list tables: %w", err)
+		}
+
+		tables = append(tables, name)
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, fmt.Errorf("list tables: %w", err)
+	}
+
+	return tables, nil
+}
@@ -0,0 +1,213 @@
+// Package live serves live query subscriptions over WebSocket. A client
+// subscribes to a table's rows matching a filter, and gets the current
+// rows followed by each change the replication applies to them.
+package live
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+// Subscription is the first message sent by the client, where
+// matches rows with these column values. With a prefix, it also
+// gets the logical decoding messages whose prefix starts with it.
+type Subscription struct {
+	Table  string         `json:"table"`
+	Where  map[string]any `json:"where"`
+	Prefix string         `json:"prefix"`
+}
+
+// Message is sent to the client, first the initial rows and then
+// the changes. An error ends the subscription.
+type Message struct {
+	Type   string            `json:"type"`
+	Rows   []map[string]any  `json:"rows,omitempty"`
+	Change *replicate.Change `json:"change,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// Message types.
+const (
+	TypeInitial = "initial"
+	TypeChange  = "change"
+	TypeError   = "error"
+)
+
+// Handler serves subscriptions to the feed's changes,
+// with the initial rows read by the reader. Browsers may only
+// subscribe from the handler's own origin or one of origins.
+func Handler(feed *replicate.Feed, reader pgwire.Reader, origins []string) http.Handler {
+	return websocket.Server{
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			return checkOrigin(r, origins)
+		},
+		Handler: func(conn *websocket.Conn) {
+			defer conn.Close()
+
+			if err := serve(conn, feed, reader); err != nil {
+				log.Debug().Err(err).Msg("live subscription ended")
+			}
+		},
+	}
+}
+
+// checkOrigin refuses cross-origin handshakes, which browsers make
+// with the user's credentials. Other clients don't send an origin.
+func checkOrigin(r *http.Request, origins []string) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("parse origin: %w", err)
+	}
+
+	if strings.EqualFold(u.Host, r.Host) || slices.Contains(origins, origin) {
+		return nil
+	}
+
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+func serve(conn *websocket.Conn, feed *replicate.Feed, reader pgwire.Reader) error {
+	var sub Subscription
+	if err := websocket.JSON.Receive(conn, &sub); err != nil {
+		return fmt.Errorf("read subscription: %w", err)
+	}
+
+	if sub.Table == "" && sub.Prefix == "" {
+		return sendErr(conn, errors.New("subscription has no table or prefix"))
+	}
+
+	// subscribe before reading the initial rows, so no change is missed
+	// between them. Changes committed during the read may be in both.
+	changes, cancel := feed.Subscribe()
+	defer cancel()
+
+	res := &pgwire.ReadResult{}
+
+	if sub.Table != "" {
+		query, args := sub.query()
+
+		var err error
+		if res, err = reader.Read(conn.Request().Context(), "", query, args); err != nil {
+			return sendErr(conn, err)
+		}
+	}
+
+	initial := Message{Type: TypeInitial, Rows: make([]map[string]any, 0, len(res.Rows))}
+	for _, row := range res.Rows {
+		m := make(map[string]any, len(row))
+		for i, v := range row {
+			m[res.Columns[i]] = v
+		}
+
+		initial.Rows = append(initial.Rows, m)
+	}
+
+	if err := websocket.JSON.Send(conn, initial); err != nil {
+		return fmt.Errorf("send initial rows: %w", err)
+	}
+
+	// the client doesn't send anything else, reading
+	// notices when it closes the connection.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		var discard json.RawMessage
+		for websocket.JSON.Receive(conn, &discard) == nil {
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case change, ok := <-changes:
+			if !ok {
+				return sendErr(conn, errors.New("subscriber fell behind the replication"))
+			}
+
+			if !sub.matches(change) {
+				continue
+			}
+
+			if err := websocket.JSON.Send(conn, Message{Type: TypeChange, Change: &change}); err != nil {
+				return fmt.Errorf("send change: %w", err)
+			}
+		}
+	}
+}
+
+func sendErr(conn *websocket.Conn, err error) error {
+	return errors.Join(err, websocket.JSON.Send(conn, Message{Type: TypeError, Error: err.Error()}))
+}
+
+// query reads the rows matching the subscription.
+func (sub Subscription) query() (string, []any) {
+	var (
+		where []string
+		args  []any
+	)
+
+	for col, v := range sub.Where {
+		args = append(args, pgwire.Param(v))
+		where = append(where, fmt.Sprintf("%s = $%d", sqlgen.QuoteIdentifier(col), len(args)))
+	}
+
+	query := "SELECT * FROM " + sqlgen.QuoteIdentifier(sub.Table)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	return query, args
+}
+
+// matches reports whether the change is to a row matching the
+// subscription, before or after the change. Columns missing from
+// the change, like those outside a delete's replica identity,
+// are taken to match.
+func (sub Subscription) matches(c replicate.Change) bool {
+	if c.Op == "message" {
+		return sub.Prefix != "" && strings.HasPrefix(c.Prefix, sub.Prefix)
+	}
+
+	if c.Table != sub.Table {
+		return false
+	}
+
+	if c.Op == "truncate" {
+		return true
+	}
+
+	return sub.rowMatches(c.Row) || sub.rowMatches(c.Old)
+}
+
+func (sub Subscription) rowMatches(row map[string]any) bool {
+	if row == nil {
+		return false
+	}
+
+	for col, want := range sub.Where {
+		got, ok := row[col]
+		if ok && fmt.Sprint(got) != fmt.Sprint(want) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,118 @@
+package live_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/live"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestSubscribe(t *testing.T) {
+	local, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+
+	local.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		"CREATE TABLE names (id integer primary key, name text, team text);",
+		"INSERT INTO names VALUES (1, 'Hello', 'a'), (2, 'World', 'b');",
+	} {
+		_, err := local.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	feed := replicate.NewFeed()
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local)
+
+	srv := httptest.NewServer(live.Handler(feed, server, nil))
+	t.Cleanup(srv.Close)
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	require.NoError(t, websocket.JSON.Send(conn, live.Subscription{Table: "names", Where: map[string]any{"team": "a"}}))
+
+	var msg live.Message
+	require.NoError(t, websocket.JSON.Receive(conn, &msg))
+	assert.Equal(t, live.TypeInitial, msg.Type)
+	assert.Equal(t, []map[string]any{{"id": float64(1), "name": "Hello", "team": "a"}}, msg.Rows)
+
+	feed.Publish([]replicate.Change{
+		{Op: "insert", Table: "names", Row: map[string]any{"id": json.Number("3"), "team": "b"}, LSN: "0/1"},
+		{Op: "insert", Table: "teams", Row: map[string]any{"team": "a"}, LSN: "0/1"},
+		{Op: "update", Table: "names", Row: map[string]any{"id": json.Number("2"), "team": "a"}, LSN: "0/2"},
+		{Op: "delete", Table: "names", Old: map[string]any{"id": json.Number("1")}, LSN: "0/3"},
+	})
+
+	for _, want := range []struct {
+		op  string
+		lsn string
+	}{
+		{op: "update", lsn: "0/2"},
+		{op: "delete", lsn: "0/3"},
+	} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		require.NoError(t, websocket.JSON.Receive(conn, &msg))
+
+		assert.Equal(t, live.TypeChange, msg.Type)
+		require.NotNil(t, msg.Change)
+		assert.Equal(t, want.op, msg.Change.Op)
+		assert.Equal(t, want.lsn, msg.Change.LSN)
+	}
+}
+
+func TestSubscribeMessages(t *testing.T) {
+	feed := replicate.NewFeed()
+
+	srv := httptest.NewServer(live.Handler(feed, nil, nil))
+	t.Cleanup(srv.Close)
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	require.NoError(t, websocket.JSON.Send(conn, live.Subscription{Prefix: "app."}))
+
+	var msg live.Message
+	require.NoError(t, websocket.JSON.Receive(conn, &msg))
+	assert.Equal(t, live.TypeInitial, msg.Type)
+	assert.Empty(t, msg.Rows)
+
+	feed.Publish([]replicate.Change{
+		{Op: "insert", Table: "names", Row: map[string]any{"id": json.Number("3")}, LSN: "0/1"},
+		{Op: "message", Prefix: "other", Content: "ignored", LSN: "0/2"},
+		{Op: "message", Prefix: "app.flush", Content: "orders", LSN: "0/3"},
+	})
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	require.NoError(t, websocket.JSON.Receive(conn, &msg))
+
+	require.NotNil(t, msg.Change)
+	assert.Equal(t, replicate.Change{Op: "message", Prefix: "app.flush", Content: "orders", LSN: "0/3"}, *msg.Change)
+}
+
+func TestSubscribeOrigin(t *testing.T) {
+	srv := httptest.NewServer(live.Handler(replicate.NewFeed(), nil, []string{"https://app.example.com"}))
+	t.Cleanup(srv.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	_, err := websocket.Dial(wsURL, "", "https://evil.example.com")
+	assert.Error(t, err)
+
+	conn, err := websocket.Dial(wsURL, "", "https://app.example.com")
+	require.NoError(t, err)
+	conn.Close()
+}
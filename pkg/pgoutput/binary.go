@@ -0,0 +1,111 @@
+package pgoutput
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// typeMaps decode binary values, a map can't be shared between goroutines.
+var typeMaps = sync.Pool{New: func() any { return pgtype.NewMap() }}
+
+// pgEpoch is the unix time postgres' binary timestamps count from, in seconds.
+const pgEpoch = 946684800
+
+// DecodeBinary decodes a value sent in the binary format of the most
+// common types straight into Go values, without going through pgtype:
+// bool as bool, integers as int64, float4 as float32, float8 as float64,
+// timestamps as a time.Time in UTC, and text and json types as string.
+// It's false for other types, and for infinite timestamps.
+func DecodeBinary(oid uint32, data []byte) (any, bool) {
+	switch oid {
+	case pgtype.BoolOID:
+		if len(data) == 1 {
+			return data[0] != 0, true
+		}
+	case pgtype.Int2OID:
+		if len(data) == 2 {
+			return int64(int16(binary.BigEndian.Uint16(data))), true
+		}
+	case pgtype.Int4OID:
+		if len(data) == 4 {
+			return int64(int32(binary.BigEndian.Uint32(data))), true
+		}
+	case pgtype.Int8OID:
+		if len(data) == 8 {
+			return int64(binary.BigEndian.Uint64(data)), true
+		}
+	case pgtype.Float4OID:
+		if len(data) == 4 {
+			return math.Float32frombits(binary.BigEndian.Uint32(data)), true
+		}
+	case pgtype.Float8OID:
+		if len(data) == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), true
+		}
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		if len(data) != 8 {
+			return nil, false
+		}
+
+		// infinity and -infinity are the largest and smallest values
+		us := int64(binary.BigEndian.Uint64(data))
+		if us == math.MaxInt64 || us == math.MinInt64 {
+			return nil, false
+		}
+
+		return time.Unix(pgEpoch+us/1e6, us%1e6*1e3).UTC(), true
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID, pgtype.NameOID, pgtype.JSONOID:
+		return string(data), true
+	case pgtype.JSONBOID:
+		// prefixed with the format's version
+		if len(data) > 0 && data[0] == 1 {
+			return string(data[1:]), true
+		}
+	}
+
+	return nil, false
+}
+
+// BinaryToText returns the text format of a value sent in the binary
+// format, with the binary option. It's false for types that aren't
+// built into postgres, which can't be decoded.
+func BinaryToText(oid uint32, data []byte) ([]byte, bool) {
+	m := typeMaps.Get().(*pgtype.Map)
+	defer typeMaps.Put(m)
+
+	t, ok := m.TypeForOID(oid)
+	if !ok {
+		return nil, false
+	}
+
+	v, err := t.Codec.DecodeValue(m, oid, pgtype.BinaryFormatCode, data)
+	if err != nil {
+		return nil, false
+	}
+
+	text, err := m.Encode(oid, pgtype.TextFormatCode, v, nil)
+	if err != nil || text == nil {
+		return nil, false
+	}
+
+	return text, true
+}
+
+// TupleText returns the text format of a column's value, sent in either
+// format. It's false for nulls, unchanged TOAST values, and binary values
+// that can't be decoded.
+func TupleText(oid uint32, col *pglogrepl.TupleDataColumn) ([]byte, bool) {
+	switch col.DataType {
+	case pglogrepl.TupleDataTypeText:
+		return col.Data, true
+	case pglogrepl.TupleDataTypeBinary:
+		return BinaryToText(oid, col.Data)
+	}
+
+	return nil, false
+}
@@ -0,0 +1,52 @@
+package pgoutput_test
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeBinary(t *testing.T) {
+	be := binary.BigEndian
+
+	// 2024-05-01 12:00:00.5 UTC, in microseconds since 2000-01-01
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 500000000, time.UTC)
+	us := ts.Sub(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).Microseconds()
+	before := int64(-1500000)
+
+	tests := []struct {
+		name string
+		oid  uint32
+		data []byte
+		want any
+		ok   bool
+	}{
+		{"bool", pgtype.BoolOID, []byte{1}, true, true},
+		{"int2", pgtype.Int2OID, be.AppendUint16(nil, 0xffff), int64(-1), true},
+		{"int4", pgtype.Int4OID, be.AppendUint32(nil, 42), int64(42), true},
+		{"int8", pgtype.Int8OID, be.AppendUint64(nil, 1<<40), int64(1 << 40), true},
+		{"float4", pgtype.Float4OID, be.AppendUint32(nil, math.Float32bits(0.5)), float32(0.5), true},
+		{"float8", pgtype.Float8OID, be.AppendUint64(nil, math.Float64bits(2.25)), 2.25, true},
+		{"timestamptz", pgtype.TimestamptzOID, be.AppendUint64(nil, uint64(us)), ts, true},
+		{"before 2000", pgtype.TimestampOID, be.AppendUint64(nil, uint64(before)), time.Date(1999, 12, 31, 23, 59, 58, 500000000, time.UTC), true},
+		{"infinity", pgtype.TimestamptzOID, be.AppendUint64(nil, math.MaxInt64), nil, false},
+		{"text", pgtype.TextOID, []byte("hello"), "hello", true},
+		{"jsonb", pgtype.JSONBOID, append([]byte{1}, `{"a":1}`...), `{"a":1}`, true},
+		{"short int4", pgtype.Int4OID, []byte{0, 1}, nil, false},
+		// decoded through pgtype instead
+		{"numeric", pgtype.NumericOID, []byte{0, 0}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := pgoutput.DecodeBinary(tt.oid, tt.data)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
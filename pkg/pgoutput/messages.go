@@ -0,0 +1,10 @@
+package pgoutput
+
+// DropTablePrefix is the prefix of the logical decoding message sent with
+// a table drop, which pgoutput doesn't publish. The message's content is
+// the schema qualified name of the dropped table.
+const DropTablePrefix = "sqledge.drop_table"
+
+// ControlPrefix is the prefix of the logical decoding messages with
+// signed commands for the nodes, see package control.
+const ControlPrefix = "sqledge.control"
@@ -0,0 +1,227 @@
+package pgoutput
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// Two-phase commit messages are sent by pgoutput from protocol version 3
+// when the two_phase option is on. pglogrepl doesn't decode these yet.
+//
+// Message formats come from here:
+// - https://www.postgresql.org/docs/15/protocol-logicalrep-message-formats.html
+const (
+	MessageTypeBeginPrepare     pglogrepl.MessageType = 'b'
+	MessageTypePrepare          pglogrepl.MessageType = 'P'
+	MessageTypeCommitPrepared   pglogrepl.MessageType = 'K'
+	MessageTypeRollbackPrepared pglogrepl.MessageType = 'r'
+)
+
+// IsTwoPhase reports whether the WAL data holds a two-phase commit message.
+func IsTwoPhase(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	switch pglogrepl.MessageType(data[0]) {
+	case MessageTypeBeginPrepare, MessageTypePrepare, MessageTypeCommitPrepared, MessageTypeRollbackPrepared:
+		return true
+	}
+
+	return false
+}
+
+// ParseTwoPhase parses a two-phase commit message, data
+// includes the message type byte.
+func ParseTwoPhase(data []byte) (pglogrepl.Message, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty message")
+	}
+
+	var msg interface {
+		pglogrepl.Message
+		decode(d *decoder)
+	}
+
+	switch pglogrepl.MessageType(data[0]) {
+	case MessageTypeBeginPrepare:
+		msg = new(BeginPrepareMessage)
+	case MessageTypePrepare:
+		msg = new(PrepareMessage)
+	case MessageTypeCommitPrepared:
+		msg = new(CommitPreparedMessage)
+	case MessageTypeRollbackPrepared:
+		msg = new(RollbackPreparedMessage)
+	default:
+		return nil, fmt.Errorf("not a two-phase message: %q", data[0])
+	}
+
+	d := &decoder{src: data[1:]}
+	msg.decode(d)
+
+	if d.err != nil {
+		return nil, fmt.Errorf("decode %s: %w", msg.Type(), d.err)
+	}
+
+	return msg, nil
+}
+
+type BeginPrepareMessage struct {
+	PrepareLSN  pglogrepl.LSN
+	EndLSN      pglogrepl.LSN
+	PrepareTime time.Time
+	Xid         uint32
+	Gid         string
+}
+
+func (m *BeginPrepareMessage) Type() pglogrepl.MessageType { return MessageTypeBeginPrepare }
+
+func (m *BeginPrepareMessage) decode(d *decoder) {
+	m.PrepareLSN = d.lsn()
+	m.EndLSN = d.lsn()
+	m.PrepareTime = d.time()
+	m.Xid = d.uint32()
+	m.Gid = d.string()
+}
+
+type PrepareMessage struct {
+	Flags       uint8
+	PrepareLSN  pglogrepl.LSN
+	EndLSN      pglogrepl.LSN
+	PrepareTime time.Time
+	Xid         uint32
+	Gid         string
+}
+
+func (m *PrepareMessage) Type() pglogrepl.MessageType { return MessageTypePrepare }
+
+func (m *PrepareMessage) decode(d *decoder) {
+	m.Flags = d.uint8()
+	m.PrepareLSN = d.lsn()
+	m.EndLSN = d.lsn()
+	m.PrepareTime = d.time()
+	m.Xid = d.uint32()
+	m.Gid = d.string()
+}
+
+type CommitPreparedMessage struct {
+	Flags      uint8
+	CommitLSN  pglogrepl.LSN
+	EndLSN     pglogrepl.LSN
+	CommitTime time.Time
+	Xid        uint32
+	Gid        string
+}
+
+func (m *CommitPreparedMessage) Type() pglogrepl.MessageType { return MessageTypeCommitPrepared }
+
+func (m *CommitPreparedMessage) decode(d *decoder) {
+	m.Flags = d.uint8()
+	m.CommitLSN = d.lsn()
+	m.EndLSN = d.lsn()
+	m.CommitTime = d.time()
+	m.Xid = d.uint32()
+	m.Gid = d.string()
+}
+
+type RollbackPreparedMessage struct {
+	Flags        uint8
+	PrepareLSN   pglogrepl.LSN
+	EndLSN       pglogrepl.LSN
+	PrepareTime  time.Time
+	RollbackTime time.Time
+	Xid          uint32
+	Gid          string
+}
+
+func (m *RollbackPreparedMessage) Type() pglogrepl.MessageType { return MessageTypeRollbackPrepared }
+
+func (m *RollbackPreparedMessage) decode(d *decoder) {
+	m.Flags = d.uint8()
+	m.PrepareLSN = d.lsn()
+	m.EndLSN = d.lsn()
+	m.PrepareTime = d.time()
+	m.RollbackTime = d.time()
+	m.Xid = d.uint32()
+	m.Gid = d.string()
+}
+
+// decoder reads big endian fields, recording the first short read.
+type decoder struct {
+	src []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if len(d.src) < n {
+		d.err = fmt.Errorf("short message: want %d bytes, have %d", n, len(d.src))
+		return nil
+	}
+
+	b := d.src[:n]
+	d.src = d.src[n:]
+
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (d *decoder) lsn() pglogrepl.LSN {
+	if b := d.next(8); b != nil {
+		return pglogrepl.LSN(binary.BigEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+// postgres timestamps are microseconds since 2000-01-01 00:00:00 UTC
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (d *decoder) time() time.Time {
+	if b := d.next(8); b != nil {
+		micros := int64(binary.BigEndian.Uint64(b))
+		return postgresEpoch.Add(time.Duration(micros) * time.Microsecond)
+	}
+
+	return time.Time{}
+}
+
+func (d *decoder) string() string {
+	if d.err != nil {
+		return ""
+	}
+
+	idx := bytes.IndexByte(d.src, 0)
+	if idx == -1 {
+		d.err = errors.New("unterminated string")
+		return ""
+	}
+
+	s := string(d.src[:idx])
+	d.src = d.src[idx+1:]
+
+	return s
+}
@@ -0,0 +1,34 @@
+package pgoutput_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTwoPhase(t *testing.T) {
+	data := []byte{'K', 0}
+	data = binary.BigEndian.AppendUint64(data, 100)
+	data = binary.BigEndian.AppendUint64(data, 200)
+	data = binary.BigEndian.AppendUint64(data, 0)
+	data = binary.BigEndian.AppendUint32(data, 7)
+	data = append(data, "gid-1\x00"...)
+
+	assert.True(t, pgoutput.IsTwoPhase(data))
+
+	msg, err := pgoutput.ParseTwoPhase(data)
+	assert.NoError(t, err)
+
+	commit, ok := msg.(*pgoutput.CommitPreparedMessage)
+	assert.True(t, ok)
+	assert.Equal(t, pglogrepl.LSN(100), commit.CommitLSN)
+	assert.Equal(t, pglogrepl.LSN(200), commit.EndLSN)
+	assert.Equal(t, uint32(7), commit.Xid)
+	assert.Equal(t, "gid-1", commit.Gid)
+
+	_, err = pgoutput.ParseTwoPhase(data[:10])
+	assert.Error(t, err)
+}
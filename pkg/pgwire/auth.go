@@ -0,0 +1,101 @@
+package pgwire
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errTLSRequired = errors.New("tls required")
+	errAuthFailed  = errors.New("authentication failed")
+	errHostDenied  = errors.New("host denied")
+
+	errReadOnly = &pgconn.PgError{
+		Severity: "ERROR",
+		Code:     "25006",
+		Message:  "cannot write on a read-only listener",
+	}
+)
+
+// startTLS answers an SSLRequest, upgrading the session's
+// connection when the listener has a TLS config.
+func (sess *session) startTLS() error {
+	if sess.policy.TLS == nil {
+		if _, err := sess.conn.Write([]byte{'N'}); err != nil {
+			return fmt.Errorf("deny ssl: %w", err)
+		}
+
+		return nil
+	}
+
+	if _, err := sess.conn.Write([]byte{'S'}); err != nil {
+		return fmt.Errorf("accept ssl: %w", err)
+	}
+
+	conn := tls.Server(sess.conn, sess.policy.TLS)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("tls handshake: %w", err)
+	}
+
+	sess.setConn(conn, true)
+
+	return nil
+}
+
+// authenticate checks the client's credentials with the listener's auth method.
+// Upstream auth asks for the password in cleartext, so listeners using it
+// should require TLS.
+func (s *Server) authenticate(sess *session) error {
+	switch sess.policy.Auth {
+	case "", AuthTrust:
+		return nil
+	case AuthUpstream:
+	default:
+		return fmt.Errorf("unknown auth method: %q", sess.policy.Auth)
+	}
+
+	if err := sess.backend.SetAuthType(pgproto3.AuthTypeCleartextPassword); err != nil {
+		return fmt.Errorf("set auth type: %w", err)
+	}
+
+	sess.send(&pgproto3.AuthenticationCleartextPassword{})
+	if err := sess.flush(); err != nil {
+		return fmt.Errorf("request password: %w", err)
+	}
+
+	msg, err := sess.receive()
+	if err != nil {
+		return fmt.Errorf("read password: %w", err)
+	}
+
+	pw, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return fmt.Errorf("expected password message, got %T", msg)
+	}
+
+	if s.cfg.Authenticate == nil {
+		err = errors.New("no authenticator configured")
+	} else {
+		err = s.cfg.Authenticate(context.Background(), sess.user, pw.Password)
+	}
+
+	if err != nil {
+		log.Info().Err(err).Msgf("session %d: authentication failed for user %q", sess.id, sess.user)
+
+		sess.send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "28P01",
+			Message:  fmt.Sprintf("password authentication failed for user %q", sess.user),
+		})
+
+		return errors.Join(errAuthFailed, sess.flush())
+	}
+
+	return nil
+}
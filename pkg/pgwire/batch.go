@@ -0,0 +1,163 @@
+package pgwire
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog/log"
+)
+
+// writeBatch holds the pipelined INSERTs of a session until the client
+// waits for their results, so they're sent upstream in one round trip.
+type writeBatch struct {
+	execs []*portal
+	// held are the responses to the messages after the first batched
+	// Execute, sent in order once the batch has run. Nil entries stand
+	// for the batched Executes' CommandComplete.
+	held []pgproto3.BackendMessage
+}
+
+// batchable reports whether executing the portal can wait for the rest
+// of the pipeline, which is the case for INSERTs not returning rows.
+func (s *Server) batchable(sess *session, p *portal) bool {
+	if s.cfg.WriteBatchSize <= 0 || p.res != nil || sess.tx == txFailed || sess.policy.ReadOnly {
+		return false
+	}
+
+	query := strings.ToLower(strings.TrimSpace(p.stmt.query))
+
+	return strings.HasPrefix(query, "insert") && !strings.Contains(query, "returning")
+}
+
+// batchExecute adds the portal to the session's batch, which is run
+// once it's full.
+func (s *Server) batchExecute(sess *session, p *portal) {
+	if sess.batch == nil {
+		sess.batch = &writeBatch{}
+	}
+
+	sess.batch.execs = append(sess.batch.execs, p)
+	sess.batch.held = append(sess.batch.held, nil)
+
+	if len(sess.batch.execs) >= s.cfg.WriteBatchSize {
+		s.flushBatch(sess)
+	}
+}
+
+// flushBatch runs the session's batched INSERTs upstream, and sends the
+// responses held since the first of them. When an INSERT fails, the
+// responses after it are dropped, as postgres skips the messages after
+// an error until the next Sync.
+func (s *Server) flushBatch(sess *session) {
+	b := sess.batch
+	if b == nil {
+		return
+	}
+
+	sess.batch = nil
+
+	tags, err := s.runBatch(sess, b.execs)
+	if err != nil && len(tags) == len(b.execs) {
+		// the batch failed as it was committed
+		tags = tags[:len(tags)-1]
+	}
+
+	for i, p := range b.execs[:len(tags)] {
+		p.res = &result{tag: tags[i]}
+	}
+
+	n := 0
+
+	for _, msg := range b.held {
+		if msg != nil {
+			sess.send(msg)
+			continue
+		}
+
+		if n == len(tags) {
+			sess.failTx()
+			sess.extendedErr("XX000", err)
+
+			return
+		}
+
+		sess.send(&pgproto3.CommandComplete{CommandTag: []byte(tags[n])})
+		n++
+	}
+}
+
+// runBatch executes the portals upstream in a single round trip, returning
+// the command tags of the ones that succeeded and the error of the first
+// one that failed. Outside a transaction they're committed together, as
+// postgres does with the statements pipelined before a Sync.
+func (s *Server) runBatch(sess *session, execs []*portal) ([]string, error) {
+	var tags []string
+
+	log.Debug().Msgf("batching %d inserts", len(execs))
+
+	err := s.withUpstream(sess, func(conn *sql.Conn) error {
+		pgConn := pgConnOf(conn)
+		if pgConn == nil {
+			for _, p := range execs {
+				r, err := conn.ExecContext(context.Background(), s.fillKeys(p.stmt.query), p.params...)
+				if err != nil {
+					return fmt.Errorf("failed to query upstream: %w", err)
+				}
+
+				n, _ := r.RowsAffected()
+				tags = append(tags, fmt.Sprintf("INSERT 0 %d", n))
+			}
+
+			return nil
+		}
+
+		batch := &pgconn.Batch{}
+
+		for _, p := range execs {
+			values, formats := upstreamParams(p.params)
+			batch.ExecParams(s.fillKeys(p.stmt.query), values, nil, formats, nil)
+		}
+
+		mrr := pgConn.ExecBatch(context.Background(), batch)
+
+		for mrr.NextResult() {
+			tag, err := mrr.ResultReader().Close()
+			if err != nil {
+				break
+			}
+
+			tags = append(tags, tag.String())
+		}
+
+		if err := mrr.Close(); err != nil {
+			return fmt.Errorf("failed to query upstream: %w", err)
+		}
+
+		return nil
+	})
+
+	return tags, err
+}
+
+// upstreamParams encodes bound parameters for the upstream, strings
+// in the text format and raw bytes in the binary format.
+func upstreamParams(args []any) ([][]byte, []int16) {
+	values := make([][]byte, len(args))
+	formats := make([]int16, len(args))
+
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			values[i] = []byte(arg)
+		case []byte:
+			values[i], formats[i] = arg, pgtype.BinaryFormatCode
+		}
+	}
+
+	return values, formats
+}
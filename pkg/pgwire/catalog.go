@@ -0,0 +1,190 @@
+package pgwire
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/rs/zerolog/log"
+)
+
+// catalogRef matches reads of postgres' catalogs, which the local database
+// doesn't have, e.g. an ORM introspecting the schema.
+var catalogRef = regexp.MustCompile(`(?i)\b(pg_catalog|information_schema)\s*\.|\bpg_(class|namespace|attribute|attrdef|type|index|constraint|proc|enum|description|depend|inherits|extension|database|roles|user|settings|am|opclass|collation|sequence|sequences|tables|views|matviews|indexes|tablespace)\b`)
+
+// isCatalog reports whether the read should be answered by the upstream's
+// catalogs.
+func (s *Server) isCatalog(query string) bool {
+	return s.cfg.CatalogPassthrough && catalogRef.MatchString(query)
+}
+
+// catalogCache holds the upstream's answers to catalog reads, by session
+// user, statement text and parameters, for the TTL.
+type catalogCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]catalogEntry
+}
+
+type catalogEntry struct {
+	desc    *pgproto3.RowDescription
+	rows    [][][]byte
+	tag     string
+	expires time.Time
+}
+
+func newCatalogCache(ttl time.Duration) *catalogCache {
+	return &catalogCache{ttl: ttl, entries: make(map[string]catalogEntry)}
+}
+
+// catalogKey keys the read's answer by the session's user and database,
+// and its passthrough settings, since what the catalogs show depends on
+// the user's privileges and the search_path.
+func catalogKey(sess *session, query string, args []any) string {
+	names := make([]string, 0, len(sess.gucs))
+	for name := range sess.gucs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	settings := make([]string, len(names))
+	for i, name := range names {
+		settings[i] = sess.gucs[name]
+	}
+
+	return fmt.Sprintf("%q\x00%q\x00%q\x00%s\x00%q", sess.user, sess.database, settings, query, args)
+}
+
+func (c *catalogCache) get(key string, now time.Time) (catalogEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return catalogEntry{}, false
+	}
+
+	if now.After(e.expires) {
+		delete(c.entries, key)
+		return catalogEntry{}, false
+	}
+
+	return e, true
+}
+
+func (c *catalogCache) put(key string, e catalogEntry, now time.Time) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// expired entries are dropped as they're replaced, so the cache
+	// only grows with the distinct statements clients send.
+	for k, old := range c.entries {
+		if now.After(old.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	e.expires = now.Add(c.ttl)
+	c.entries[key] = e
+}
+
+// purge drops every answer, the catalogs changed.
+func (c *catalogCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+}
+
+// SchemaChanged drops what the server caches of the local table's schema,
+// once a change to it is applied, the catalogs' cached answers. Statements
+// prepared before the change are checked as they're executed instead, and
+// fail with postgres' "cached plan must not change result type" when
+// their result changed.
+func (s *Server) SchemaChanged(table string) {
+	log.Debug().Msgf("schema of %q changed, dropping the catalog cache", table)
+
+	s.catalog.purge()
+}
+
+// queryCatalog answers the catalog read from the upstream, or from the
+// cache when the same statement was answered within the TTL.
+func (s *Server) queryCatalog(sess *session, queryString string, args []any) (*result, error) {
+	key := catalogKey(sess, queryString, args)
+
+	if e, ok := s.catalog.get(key, s.clock.Now()); ok {
+		log.Debug().Msgf("catalog cache hit: %q", queryString)
+		return s.catalogResult(e)
+	}
+
+	res, err := s.query(sess, queryString, args)
+	if err != nil {
+		return nil, err
+	}
+
+	e := catalogEntry{desc: res.desc, tag: res.tag}
+
+	for {
+		row, err := res.rows.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			res.rows.close()
+			return nil, err
+		}
+
+		// the spool's rows are reused once it's closed
+		e.rows = append(e.rows, cloneRow(row))
+	}
+
+	res.rows.close()
+
+	s.catalog.put(key, e, s.clock.Now())
+
+	return s.catalogResult(e)
+}
+
+// describeCatalog describes the catalog read from the upstream, or from
+// the cache.
+func (s *Server) describeCatalog(sess *session, query string) (*pgproto3.RowDescription, error) {
+	key := catalogKey(sess, query, nil) + "\x00describe"
+
+	if e, ok := s.catalog.get(key, s.clock.Now()); ok {
+		return e.desc, nil
+	}
+
+	desc, err := s.describeUpstream(sess, query)
+	if err != nil {
+		return nil, err
+	}
+
+	s.catalog.put(key, catalogEntry{desc: desc}, s.clock.Now())
+
+	return desc, nil
+}
+
+func (s *Server) catalogResult(e catalogEntry) (*result, error) {
+	res := &result{desc: e.desc, tag: e.tag, rows: s.newSpool()}
+
+	for _, row := range e.rows {
+		if err := res.rows.add(row); err != nil {
+			res.rows.close()
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,37 @@
+package pgwire
+
+import "regexp"
+
+var identifierToken = regexp.MustCompile(`"(?:[^"]|"")+"|[A-Za-z_][\w$]*`)
+
+// RouteCold serves reads referencing a table cold reports as not fully
+// copied from the upstream instead of the local database, e.g. while the
+// initial copy is running. Reads of tenant databases stay local.
+func (s *Server) RouteCold(cold func(table string) bool) {
+	s.coldMu.Lock()
+	defer s.coldMu.Unlock()
+
+	s.cold = cold
+}
+
+// readsCold reports whether the read references a table that isn't fully
+// copied. Every identifier in the query is checked, so a column or alias
+// named like a cold table also sends the read upstream.
+func (s *Server) readsCold(sess *session, queryString string) bool {
+	s.coldMu.RLock()
+	cold := s.cold
+	s.coldMu.RUnlock()
+
+	if cold == nil || sess.tenant != "" {
+		return false
+	}
+
+	for _, token := range identifierToken.FindAllString(queryString, -1) {
+		// the parts of a qualified name are tokens of their own
+		if cold(identifier(token)) {
+			return true
+		}
+	}
+
+	return false
+}
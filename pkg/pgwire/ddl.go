@@ -0,0 +1,225 @@
+package pgwire
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rs/zerolog/log"
+)
+
+// ddlCommands are the DDL statements forwarded upstream, with the
+// command tag postgres completes them with.
+var ddlCommands = []struct {
+	tag     string
+	pattern *regexp.Regexp
+}{
+	{tag: "CREATE TABLE", pattern: regexp.MustCompile(`^create\s+(?:(?:global|local)\s+)?(?:(?:temp|temporary|unlogged)\s+)?table\s`)},
+	{tag: "ALTER TABLE", pattern: regexp.MustCompile(`^alter\s+table\s`)},
+	{tag: "DROP TABLE", pattern: regexp.MustCompile(`^drop\s+table\s`)},
+	{tag: "CREATE INDEX", pattern: regexp.MustCompile(`^create\s+(?:unique\s+)?index\s`)},
+	{tag: "DROP INDEX", pattern: regexp.MustCompile(`^drop\s+index\s`)},
+	{tag: "CREATE VIEW", pattern: regexp.MustCompile(`^create\s+(?:or\s+replace\s+)?(?:(?:temp|temporary)\s+)?(?:recursive\s+)?view\s`)},
+	{tag: "DROP VIEW", pattern: regexp.MustCompile(`^drop\s+view\s`)},
+	{tag: "TRUNCATE TABLE", pattern: regexp.MustCompile(`^truncate\s`)},
+	{tag: "GRANT", pattern: regexp.MustCompile(`^grant\s`)},
+	{tag: "REVOKE", pattern: regexp.MustCompile(`^revoke\s`)},
+}
+
+// classifyDDL returns the command tag of a DDL statement, the
+// query is lowercase.
+func classifyDDL(query string) (string, bool) {
+	query = strings.TrimSpace(query) + " "
+
+	for _, c := range ddlCommands {
+		if c.pattern.MatchString(query) {
+			return c.tag, true
+		}
+	}
+
+	return "", false
+}
+
+// IsDDLCommand reports whether the tag, e.g. "DROP TABLE", is one
+// of the DDL commands the proxy forwards.
+func IsDDLCommand(tag string) bool {
+	for _, c := range ddlCommands {
+		if strings.EqualFold(c.tag, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ddlAllowed reports whether the command can be forwarded, a
+// command in both DDLAllow and DDLDeny is denied.
+func (s *Server) ddlAllowed(tag string) bool {
+	for _, t := range s.cfg.DDLDeny {
+		if strings.EqualFold(t, tag) {
+			return false
+		}
+	}
+
+	if len(s.cfg.DDLAllow) == 0 {
+		return true
+	}
+
+	for _, t := range s.cfg.DDLAllow {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardDDL forwards the DDL statement upstream, when it's allowed.
+func (s *Server) forwardDDL(sess *session, tag, query string, args []any) (*result, error) {
+	if !s.ddlAllowed(tag) {
+		return nil, &pgconn.PgError{
+			Severity: "ERROR",
+			Code:     "42501",
+			Message:  fmt.Sprintf("%s is not allowed through the proxy", tag),
+		}
+	}
+
+	log.Debug().Msgf("handle %s: %q", strings.ToLower(tag), query)
+
+	res, err := s.retryDDL(sess, tag, query, args)
+	if err != nil || tag != "DROP TABLE" {
+		return res, err
+	}
+
+	// pgoutput doesn't publish table drops, a logical decoding message
+	// tells the replication to drop the local table. In a transaction
+	// it's sent on the pinned connection, and rolled back with the drop.
+	for _, table := range droppedTables(query, s.cfg.Schema) {
+		if _, err := s.forward(
+			sess,
+			"SELECT pg_logical_emit_message(true, $1, $2);",
+			[]any{pgoutput.DropTablePrefix, table},
+			func(int64) string { return "" },
+		); err != nil {
+			log.Warn().Err(err).Msgf("announce drop of %s", table)
+		}
+	}
+
+	return res, nil
+}
+
+// lockContention reports whether the DDL failed waiting for a lock
+// held by another session, and can be retried once it's released.
+func lockContention(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	// lock_not_available and deadlock_detected
+	return pgErr.Code == "55P03" || pgErr.Code == "40P01"
+}
+
+// retryDDL runs the DDL statement with DDLLockTimeout as its lock_timeout,
+// so it fails instead of queueing behind a long transaction, and retries
+// it up to DDLRetries times with a doubling backoff while it fails on
+// lock contention. In a transaction a failure aborts it, so it isn't
+// retried.
+func (s *Server) retryDDL(sess *session, tag, query string, args []any) (*result, error) {
+	backoff := s.cfg.DDLRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		res, err := s.execDDL(sess, tag, query, args)
+		if err == nil || sess.tx != txIdle || attempt >= s.cfg.DDLRetries || !lockContention(err) {
+			return res, err
+		}
+
+		log.Debug().Err(err).Msgf("retrying %s, attempt %d", strings.ToLower(tag), attempt+1)
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *Server) execDDL(sess *session, tag, query string, args []any) (*result, error) {
+	if s.cfg.DDLLockTimeout <= 0 {
+		return s.forward(sess, query, args, func(int64) string { return tag })
+	}
+
+	err := s.withUpstream(sess, func(conn *sql.Conn) error {
+		ctx := context.Background()
+
+		if _, err := conn.ExecContext(ctx, "SELECT set_config('lock_timeout', $1, false)",
+			fmt.Sprintf("%dms", s.cfg.DDLLockTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("failed to set lock_timeout upstream: %w", err)
+		}
+
+		_, err := conn.ExecContext(ctx, query, args...)
+
+		// an aborted transaction rolls the setting back with it,
+		// otherwise the connection is discarded rather than
+		// returned to the pool with the setting still applied.
+		if _, resetErr := conn.ExecContext(ctx, "RESET lock_timeout"); resetErr != nil && sess.tx == txIdle {
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to query upstream: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &result{tag: tag}, nil
+}
+
+var dropTable = regexp.MustCompile(`(?is)^\s*drop\s+table\s+(?:if\s+exists\s+)?(.*?)\s*(?:\s(?:cascade|restrict))?\s*;?\s*$`)
+
+// droppedTables returns the schema qualified names of the tables in
+// the DROP TABLE statement, unqualified names are in schema.
+func droppedTables(query, schema string) []string {
+	m := dropTable.FindStringSubmatch(query)
+	if m == nil {
+		return nil
+	}
+
+	var tables []string
+
+	for _, name := range strings.Split(m[1], ",") {
+		parts := strings.Split(strings.TrimSpace(name), ".")
+		if len(parts) == 1 {
+			parts = []string{schema, parts[0]}
+		}
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		tables = append(tables, identifier(parts[0])+"."+identifier(parts[1]))
+	}
+
+	return tables
+}
+
+// identifier folds unquoted identifiers to lowercase and truncates long
+// ones, as postgres does.
+func identifier(s string) string {
+	s = strings.TrimSpace(s)
+
+	if len(s) > 1 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		return sqlgen.TruncateIdentifier(strings.ReplaceAll(s[1:len(s)-1], `""`, `"`))
+	}
+
+	return sqlgen.TruncateIdentifier(strings.ToLower(s))
+}
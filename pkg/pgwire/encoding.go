@@ -0,0 +1,392 @@
+package pgwire
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// serverEncoding is the encoding of the local and upstream databases'
+// text, as the proxy reads and writes it.
+const serverEncoding = "UTF8"
+
+// clientEncodings are the client encodings that are converted to and
+// from UTF-8, by their postgres name. UTF8 and SQL_ASCII aren't converted.
+var clientEncodings = map[string]encoding.Encoding{
+	"LATIN1":     charmap.ISO8859_1,
+	"LATIN2":     charmap.ISO8859_2,
+	"LATIN3":     charmap.ISO8859_3,
+	"LATIN4":     charmap.ISO8859_4,
+	"LATIN5":     charmap.ISO8859_9,
+	"LATIN6":     charmap.ISO8859_10,
+	"LATIN7":     charmap.ISO8859_13,
+	"LATIN8":     charmap.ISO8859_14,
+	"LATIN9":     charmap.ISO8859_15,
+	"LATIN10":    charmap.ISO8859_16,
+	"ISO_8859_5": charmap.ISO8859_5,
+	"ISO_8859_6": charmap.ISO8859_6,
+	"ISO_8859_7": charmap.ISO8859_7,
+	"ISO_8859_8": charmap.ISO8859_8,
+	"KOI8R":      charmap.KOI8R,
+	"KOI8U":      charmap.KOI8U,
+	"WIN866":     charmap.CodePage866,
+	"WIN874":     charmap.Windows874,
+	"WIN1250":    charmap.Windows1250,
+	"WIN1251":    charmap.Windows1251,
+	"WIN1252":    charmap.Windows1252,
+	"WIN1253":    charmap.Windows1253,
+	"WIN1254":    charmap.Windows1254,
+	"WIN1255":    charmap.Windows1255,
+	"WIN1256":    charmap.Windows1256,
+	"WIN1257":    charmap.Windows1257,
+	"WIN1258":    charmap.Windows1258,
+	"EUC_JP":     japanese.EUCJP,
+	"SJIS":       japanese.ShiftJIS,
+	"EUC_KR":     korean.EUCKR,
+	"UHC":        korean.EUCKR,
+	"GBK":        simplifiedchinese.GBK,
+	"GB18030":    simplifiedchinese.GB18030,
+	"BIG5":       traditionalchinese.Big5,
+}
+
+// encodingAliases are the other names postgres accepts for encodings,
+// cleaned as cleanEncodingName does.
+var encodingAliases = map[string]string{
+	"unicode":     "UTF8",
+	"iso88591":    "LATIN1",
+	"iso88592":    "LATIN2",
+	"iso88593":    "LATIN3",
+	"iso88594":    "LATIN4",
+	"iso88599":    "LATIN5",
+	"iso885910":   "LATIN6",
+	"iso885913":   "LATIN7",
+	"iso885914":   "LATIN8",
+	"iso885915":   "LATIN9",
+	"iso885916":   "LATIN10",
+	"koi8":        "KOI8R",
+	"alt":         "WIN866",
+	"windows866":  "WIN866",
+	"windows874":  "WIN874",
+	"windows1250": "WIN1250",
+	"windows1251": "WIN1251",
+	"windows1252": "WIN1252",
+	"windows1253": "WIN1253",
+	"windows1254": "WIN1254",
+	"windows1255": "WIN1255",
+	"windows1256": "WIN1256",
+	"windows1257": "WIN1257",
+	"windows1258": "WIN1258",
+	"shiftjis":    "SJIS",
+	"mskanji":     "SJIS",
+	"windows932":  "SJIS",
+	"windows949":  "UHC",
+	"windows936":  "GBK",
+	"cp936":       "GBK",
+	"windows950":  "BIG5",
+}
+
+// clientEncoding converts the text a client sends and receives between
+// its encoding and UTF-8. A nil clientEncoding is UTF-8, or SQL_ASCII,
+// whose text isn't converted.
+type clientEncoding struct {
+	name string
+	enc  encoding.Encoding
+}
+
+// cleanEncodingName lowercases the name and drops the characters that
+// aren't letters or digits, as postgres does to look up encodings.
+func cleanEncodingName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+
+		return -1
+	}, name)
+}
+
+func errInvalidEncoding(severity, name string) *pgconn.PgError {
+	return &pgconn.PgError{
+		Severity: severity,
+		Code:     "22023",
+		Message:  fmt.Sprintf("invalid value for parameter \"client_encoding\": %q", name),
+		Detail:   "The proxy converts between UTF8 and the single byte encodings, EUC_JP, SJIS, EUC_KR, UHC, GBK, GB18030 and BIG5.",
+	}
+}
+
+// lookupEncoding returns the client encoding of the name, and its
+// postgres name. It's false for encodings that aren't supported.
+func lookupEncoding(name string) (*clientEncoding, string, bool) {
+	clean := cleanEncodingName(name)
+
+	canonical, ok := encodingAliases[clean]
+	if !ok {
+		for n := range clientEncodings {
+			if cleanEncodingName(n) == clean {
+				canonical = n
+			}
+		}
+	}
+
+	switch {
+	case clean == "utf8" || canonical == "UTF8":
+		return nil, "UTF8", true
+	case clean == "sqlascii":
+		return nil, "SQL_ASCII", true
+	case canonical != "":
+		return &clientEncoding{name: canonical, enc: clientEncodings[canonical]}, canonical, true
+	}
+
+	return nil, "", false
+}
+
+// decode converts the client's text to UTF-8.
+func (e *clientEncoding) decode(b []byte) ([]byte, error) {
+	if e == nil || isASCII(b) {
+		return b, nil
+	}
+
+	out, err := e.enc.NewDecoder().Bytes(b)
+	if err != nil || bytes.ContainsRune(out, utf8.RuneError) {
+		// the decoders replace the bytes they can't decode
+		return nil, &pgconn.PgError{
+			Severity: "ERROR",
+			Code:     "22021",
+			Message:  fmt.Sprintf("invalid byte sequence for encoding %q", e.name),
+		}
+	}
+
+	return out, nil
+}
+
+// encode converts UTF-8 text to the client's encoding.
+func (e *clientEncoding) encode(b []byte) ([]byte, error) {
+	if e == nil || isASCII(b) {
+		return b, nil
+	}
+
+	out, err := e.enc.NewEncoder().Bytes(b)
+	if err == nil {
+		return out, nil
+	}
+
+	// find the character that has no equivalent, to name it
+	char := ""
+
+	for _, r := range string(b) {
+		if _, err := e.enc.NewEncoder().String(string(r)); err != nil {
+			char = string(r)
+			break
+		}
+	}
+
+	return nil, &pgconn.PgError{
+		Severity: "ERROR",
+		Code:     "22P05",
+		Message: fmt.Sprintf("character with byte sequence % #x in encoding %q has no equivalent in encoding %q",
+			char, serverEncoding, e.name),
+	}
+}
+
+// encodeLossy converts UTF-8 text to the client's encoding, replacing
+// the characters it has no equivalent for, for messages.
+func (e *clientEncoding) encodeLossy(s string) string {
+	if e == nil || isASCII([]byte(s)) {
+		return s
+	}
+
+	out, err := encoding.ReplaceUnsupported(e.enc.NewEncoder()).String(s)
+	if err != nil {
+		return s
+	}
+
+	return out
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeMessage converts the text of the client's message to UTF-8, the
+// queries and the parameters sent in the text format.
+func (sess *session) decodeMessage(msg pgproto3.FrontendMessage) error {
+	if sess.encoding == nil {
+		return nil
+	}
+
+	var err error
+
+	switch msg := msg.(type) {
+	case *pgproto3.Query:
+		var b []byte
+		if b, err = sess.encoding.decode([]byte(msg.String)); err == nil {
+			msg.String = string(b)
+		}
+	case *pgproto3.Parse:
+		var b []byte
+		if b, err = sess.encoding.decode([]byte(msg.Query)); err == nil {
+			msg.Query = string(b)
+		}
+	case *pgproto3.Bind:
+		err = sess.decodeParams(msg.ParameterFormatCodes, msg.Parameters)
+	case *pgproto3.FunctionCall:
+		formats := make([]int16, len(msg.ArgFormatCodes))
+		for i, f := range msg.ArgFormatCodes {
+			formats[i] = int16(f)
+		}
+
+		err = sess.decodeParams(formats, msg.Arguments)
+	}
+
+	return err
+}
+
+func (sess *session) decodeParams(formats []int16, params [][]byte) error {
+	for i, p := range params {
+		if p == nil || formatCode(formats, i) == pgtype.BinaryFormatCode {
+			continue
+		}
+
+		b, err := sess.encoding.decode(p)
+		if err != nil {
+			return err
+		}
+
+		params[i] = b
+	}
+
+	return nil
+}
+
+// encodeRow converts the row's values to the client's encoding, but
+// for bytea columns, returning a new row when any are converted.
+func (sess *session) encodeRow(desc *pgproto3.RowDescription, row [][]byte) ([][]byte, error) {
+	if sess.encoding == nil {
+		return row, nil
+	}
+
+	var out [][]byte
+
+	for i, v := range row {
+		if v == nil || isASCII(v) || (desc != nil && i < len(desc.Fields) && desc.Fields[i].DataTypeOID == pgtype.ByteaOID) {
+			continue
+		}
+
+		b, err := sess.encoding.encode(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if out == nil {
+			out = append([][]byte(nil), row...)
+		}
+
+		out[i] = b
+	}
+
+	if out == nil {
+		return row, nil
+	}
+
+	return out, nil
+}
+
+// encodeMessage converts the text of a message to the client to its
+// encoding, other than the rows' values, which encodeRow converts.
+func (sess *session) encodeMessage(msg pgproto3.BackendMessage) pgproto3.BackendMessage {
+	if sess.encoding == nil {
+		return msg
+	}
+
+	switch msg := msg.(type) {
+	case *pgproto3.RowDescription:
+		out := &pgproto3.RowDescription{Fields: append([]pgproto3.FieldDescription(nil), msg.Fields...)}
+		for i := range out.Fields {
+			out.Fields[i].Name = []byte(sess.encoding.encodeLossy(string(out.Fields[i].Name)))
+		}
+
+		return out
+	case *pgproto3.ErrorResponse:
+		out := *msg
+		out.Message = sess.encoding.encodeLossy(out.Message)
+		out.Detail = sess.encoding.encodeLossy(out.Detail)
+		out.Hint = sess.encoding.encodeLossy(out.Hint)
+
+		return &out
+	case *pgproto3.NoticeResponse:
+		out := *msg
+		out.Message = sess.encoding.encodeLossy(out.Message)
+		out.Detail = sess.encoding.encodeLossy(out.Detail)
+		out.Hint = sess.encoding.encodeLossy(out.Hint)
+
+		return &out
+	}
+
+	return msg
+}
+
+var (
+	setEncodingStatement   = regexp.MustCompile(`(?i)^set\s+(?:session\s+)?(?:client_encoding\s*(?:=|\s+to\s+)|names\s+)\s*'?([^'\s;]*)'?\s*;?\s*$`)
+	resetEncodingStatement = regexp.MustCompile(`(?i)^(?:reset\s+client_encoding|set\s+(?:session\s+)?client_encoding\s*(?:=|\s+to\s+)\s*default)\s*;?\s*$`)
+)
+
+// setClientEncoding handles SET and RESET of client_encoding, and SET
+// NAMES, reporting the new encoding to the client.
+func (sess *session) setClientEncoding(queryString string) (*result, bool, error) {
+	queryString = strings.TrimSpace(queryString)
+
+	tag, name := "RESET", sess.startupEncoding
+	if !resetEncodingStatement.MatchString(queryString) {
+		m := setEncodingStatement.FindStringSubmatch(queryString)
+		if m == nil {
+			return nil, false, nil
+		}
+
+		tag, name = "SET", m[1]
+	}
+
+	if err := sess.useEncoding(name); err != nil {
+		return nil, true, err
+	}
+
+	return &result{tag: tag}, true, nil
+}
+
+// useEncoding sets the session's client encoding, by any of the names
+// postgres accepts, and reports it to the client.
+func (sess *session) useEncoding(name string) error {
+	if name == "" {
+		name = serverEncoding
+	}
+
+	enc, canonical, ok := lookupEncoding(name)
+	if !ok {
+		return errInvalidEncoding("ERROR", name)
+	}
+
+	sess.encoding = enc
+	sess.send(&pgproto3.ParameterStatus{Name: "client_encoding", Value: canonical})
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package pgwire
+
+import (
+	"errors"
+	"io"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// CatalogKey is the catalog cache's key for the read of a session with
+// the user, database and passthrough settings.
+func CatalogKey(user, database string, gucs map[string]string, query string) string {
+	return catalogKey(&session{user: user, database: database, gucs: gucs}, query, nil)
+}
+
+// SpoolRows adds the rows to a spool sharing mem, copied as the rows
+// read from the local database are, and returns the rows read back and
+// the most pooled buffers the spool held at once.
+func SpoolRows(dir string, mem *budget.Budget, rows [][][]byte) ([][][]byte, int, error) {
+	sp := &spool{dir: dir, budget: mem}
+	defer sp.close()
+
+	held := 0
+
+	for _, row := range rows {
+		if err := sp.add(sp.copyRow(row)); err != nil {
+			return nil, 0, err
+		}
+
+		held = max(held, len(sp.bufs))
+	}
+
+	var out [][][]byte
+
+	for {
+		row, err := sp.next()
+		if errors.Is(err, io.EOF) {
+			return out, held, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		out = append(out, cloneRow(row))
+	}
+}
+
+// DiffShadow describes where the shadowed read's rows differ.
+func DiffShadow(local, upstream [][]string) string {
+	diff, _, _ := diffShadow(local, upstream)
+	return diff
+}
+
+// Redact returns the message as it's traced.
+func Redact(msg pgproto3.Message) pgproto3.Message {
+	return redact(msg)
+}
@@ -0,0 +1,425 @@
+package pgwire
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// The extended query protocol is described here:
+// - https://www.postgresql.org/docs/15/protocol-flow.html#PROTOCOL-FLOW-EXT-QUERY
+
+type statement struct {
+	query     string
+	paramOIDs []uint32
+	// desc is the row description the statement was described with,
+	// clients may cache it until they prepare the statement again.
+	desc *pgproto3.RowDescription
+}
+
+// errResultChanged fails executing a statement whose result no longer
+// matches its description, since a table's schema changed. Clients
+// caching statements, such as pgx, prepare them again on this error.
+var errResultChanged = &pgconn.PgError{
+	Severity: "ERROR",
+	Code:     "0A000",
+	Message:  "cached plan must not change result type",
+}
+
+type portal struct {
+	stmt          *statement
+	params        []any
+	resultFormats []int16
+
+	// res is set when the portal is first described or executed,
+	// and sent is the number of rows already sent by Execute.
+	res  *result
+	sent int
+}
+
+func isExtended(msg pgproto3.FrontendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close, *pgproto3.Flush:
+		return true
+	}
+
+	return false
+}
+
+// extendedErr sends the error, and discards messages until the next Sync.
+func (sess *session) extendedErr(code string, err error) {
+	sess.send(errorResponse(code, err))
+	sess.skipToSync = true
+}
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// paramCount is the highest $n placeholder in the query.
+func paramCount(query string) int {
+	n := 0
+
+	for _, m := range placeholder.FindAllStringSubmatch(query, -1) {
+		if i, err := strconv.Atoi(m[1]); err == nil && i > n {
+			n = i
+		}
+	}
+
+	return n
+}
+
+// SQLiteParams rewrites postgres' $n placeholders to sqlite's
+// ?n, which bind by position rather than by name.
+func SQLiteParams(query string) string {
+	return placeholder.ReplaceAllString(query, "?$1")
+}
+
+func (s *Server) parse(sess *session, msg *pgproto3.Parse) {
+	stmt := &statement{
+		query:     msg.Query,
+		paramOIDs: make([]uint32, paramCount(msg.Query)),
+	}
+
+	// parameters the client doesn't give a type for are sent as
+	// unspecified (0), letting the client choose how to encode them.
+	copy(stmt.paramOIDs, msg.ParameterOIDs)
+
+	sess.statements[msg.Name] = stmt
+	sess.send(&pgproto3.ParseComplete{})
+}
+
+func (s *Server) bind(sess *session, msg *pgproto3.Bind) {
+	stmt, ok := sess.statements[msg.PreparedStatement]
+	if !ok {
+		sess.extendedErr("26000", fmt.Errorf("prepared statement %q does not exist", msg.PreparedStatement))
+		return
+	}
+
+	if len(msg.Parameters) != len(stmt.paramOIDs) {
+		sess.extendedErr("08P01", fmt.Errorf(
+			"bind message supplies %d parameters, but prepared statement %q requires %d",
+			len(msg.Parameters), msg.PreparedStatement, len(stmt.paramOIDs),
+		))
+
+		return
+	}
+
+	params := make([]any, len(msg.Parameters))
+
+	for i, p := range msg.Parameters {
+		if p == nil {
+			continue
+		}
+
+		// the message is reused by the next Receive, so copy the values
+		if formatCode(msg.ParameterFormatCodes, i) == pgtype.BinaryFormatCode {
+			params[i] = append([]byte(nil), p...)
+		} else {
+			params[i] = string(p)
+		}
+	}
+
+	sess.closePortal(msg.DestinationPortal)
+	sess.portals[msg.DestinationPortal] = &portal{
+		stmt:          stmt,
+		params:        params,
+		resultFormats: append([]int16(nil), msg.ResultFormatCodes...),
+	}
+
+	sess.send(&pgproto3.BindComplete{})
+}
+
+func (s *Server) describe(sess *session, msg *pgproto3.Describe) {
+	switch msg.ObjectType {
+	case 'S':
+		stmt, ok := sess.statements[msg.Name]
+		if !ok {
+			sess.extendedErr("26000", fmt.Errorf("prepared statement %q does not exist", msg.Name))
+			return
+		}
+
+		sess.send(&pgproto3.ParameterDescription{ParameterOIDs: stmt.paramOIDs})
+
+		desc, err := s.describeQuery(sess, stmt)
+		if err != nil {
+			sess.extendedErr("XX000", err)
+			return
+		}
+
+		if desc == nil {
+			sess.send(&pgproto3.NoData{})
+			return
+		}
+
+		stmt.desc = desc
+		sess.send(desc)
+	case 'P':
+		p, ok := sess.portals[msg.Name]
+		if !ok {
+			sess.extendedErr("34000", fmt.Errorf("portal %q does not exist", msg.Name))
+			return
+		}
+
+		if err := s.run(sess, p); err != nil {
+			sess.extendedErr("XX000", err)
+			return
+		}
+
+		if p.res.desc == nil {
+			sess.send(&pgproto3.NoData{})
+			return
+		}
+
+		desc := &pgproto3.RowDescription{Fields: make([]pgproto3.FieldDescription, len(p.res.desc.Fields))}
+		for i, f := range p.res.desc.Fields {
+			f.Format = formatCode(p.resultFormats, i)
+			desc.Fields[i] = f
+		}
+
+		sess.send(desc)
+	default:
+		sess.extendedErr("08P01", fmt.Errorf("invalid describe type: %q", msg.ObjectType))
+	}
+}
+
+// describeQuery returns the row description of a read, without reading any
+// rows, or nil for statements that don't return rows. In passthrough mode
+// the statements relayed to the upstream are described by the upstream.
+func (s *Server) describeQuery(sess *session, stmt *statement) (*pgproto3.RowDescription, error) {
+	if !IsRead(stmt.query) {
+		if s.cfg.Passthrough && isRelayed(stmt.query) {
+			return s.describeUpstream(sess, stmt.query)
+		}
+
+		return nil, nil
+	}
+
+	if s.isCatalog(stmt.query) {
+		return s.describeCatalog(sess, stmt.query)
+	}
+
+	if s.readsCold(sess, stmt.query) {
+		return s.describeUpstream(sess, stmt.query)
+	}
+
+	query := "SELECT * FROM (" + strings.TrimRight(strings.TrimSpace(stmt.query), ";") + ") LIMIT 0"
+	args := make([]any, len(stmt.paramOIDs))
+
+	var (
+		res *result
+		err error
+	)
+
+	if names := s.virtualTables(strings.ToLower(query)); len(names) > 0 {
+		res, err = s.queryVirtual(query, args, names)
+	} else {
+		var local *sql.DB
+		if local, err = s.localDB(sess); err == nil {
+			res, err = s.readLocal(context.Background(), local, query, args)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe local: %w", err)
+	}
+
+	res.rows.close()
+
+	return res.desc, nil
+}
+
+// run executes the portal's statement once, keeping the result
+// so it can be described and then executed.
+func (s *Server) run(sess *session, p *portal) error {
+	if p.res != nil {
+		return nil
+	}
+
+	res, err := s.execute(sess, p.stmt.query, p.params)
+	if err != nil {
+		return err
+	}
+
+	if p.stmt.desc != nil && res.desc != nil && !sameResult(p.stmt.desc, res.desc) {
+		res.rows.close()
+		sess.failTx()
+
+		return errResultChanged
+	}
+
+	p.res = res
+
+	return nil
+}
+
+// sameResult reports whether the rows have the described columns.
+func sameResult(described, desc *pgproto3.RowDescription) bool {
+	if len(described.Fields) != len(desc.Fields) {
+		return false
+	}
+
+	for i, f := range desc.Fields {
+		if !bytes.Equal(f.Name, described.Fields[i].Name) || f.DataTypeOID != described.Fields[i].DataTypeOID {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Server) executePortal(sess *session, msg *pgproto3.Execute) {
+	p, ok := sess.portals[msg.Portal]
+	if !ok {
+		sess.extendedErr("34000", fmt.Errorf("portal %q does not exist", msg.Portal))
+		return
+	}
+
+	if s.batchable(sess, p) {
+		s.batchExecute(sess, p)
+		return
+	}
+
+	if s.flushBatch(sess); sess.skipToSync {
+		return
+	}
+
+	if err := s.run(sess, p); err != nil {
+		sess.extendedErr("XX000", err)
+		return
+	}
+
+	for n := uint32(0); msg.MaxRows == 0 || n < msg.MaxRows; n++ {
+		row, err := p.res.rows.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			sess.extendedErr("XX000", err)
+			return
+		}
+
+		if row, err = sess.encodeRow(p.res.desc, row); err != nil {
+			sess.extendedErr("22P05", err)
+			return
+		}
+
+		values, err := encodeRow(p.res.desc, p.resultFormats, row)
+		if err != nil {
+			sess.extendedErr("22P03", err)
+			return
+		}
+
+		sess.send(&pgproto3.DataRow{Values: values})
+		p.sent++
+	}
+
+	if p.sent < p.res.rows.len() {
+		sess.send(&pgproto3.PortalSuspended{})
+		return
+	}
+
+	sess.send(&pgproto3.CommandComplete{CommandTag: []byte(p.res.tag)})
+}
+
+func (s *Server) close(sess *session, msg *pgproto3.Close) {
+	switch msg.ObjectType {
+	case 'S':
+		delete(sess.statements, msg.Name)
+	case 'P':
+		sess.closePortal(msg.Name)
+	default:
+		sess.extendedErr("08P01", fmt.Errorf("invalid close type: %q", msg.ObjectType))
+		return
+	}
+
+	sess.send(&pgproto3.CloseComplete{})
+}
+
+// closePortal removes the portal, dropping its result.
+func (sess *session) closePortal(name string) {
+	if p, ok := sess.portals[name]; ok && p.res != nil {
+		p.res.rows.close()
+	}
+
+	delete(sess.portals, name)
+}
+
+func (sess *session) closePortals() {
+	for name := range sess.portals {
+		sess.closePortal(name)
+	}
+}
+
+// sync ends the extended query messages, portals only live
+// until the end of the transaction they were created in.
+func (sess *session) sync() {
+	if sess.tx == txIdle {
+		sess.closePortals()
+	}
+
+	sess.readyForQuery()
+}
+
+// formatCode returns the format for column i, a single
+// format code applies to every column.
+func formatCode(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return pgtype.TextFormatCode
+	case 1:
+		return formats[0]
+	}
+
+	if i < len(formats) {
+		return formats[i]
+	}
+
+	return pgtype.TextFormatCode
+}
+
+var typeMap = pgtype.NewMap()
+
+// encodeRow re-encodes the text values of the row into the requested formats.
+func encodeRow(desc *pgproto3.RowDescription, formats []int16, row [][]byte) ([][]byte, error) {
+	out := make([][]byte, len(row))
+
+	for i, v := range row {
+		if v == nil || formatCode(formats, i) == pgtype.TextFormatCode {
+			out[i] = v
+			continue
+		}
+
+		oid := desc.Fields[i].DataTypeOID
+
+		switch oid {
+		case pgtype.TextOID, pgtype.ByteaOID:
+			// the binary format is the raw value
+			out[i] = v
+			continue
+		}
+
+		var value any
+		if err := typeMap.Scan(oid, pgtype.TextFormatCode, v, &value); err != nil {
+			return nil, fmt.Errorf("decode column %q: %w", desc.Fields[i].Name, err)
+		}
+
+		b, err := typeMap.Encode(oid, pgtype.BinaryFormatCode, value, nil)
+		if err != nil {
+			return nil, fmt.Errorf("encode column %q: %w", desc.Fields[i].Name, err)
+		}
+
+		out[i] = b
+	}
+
+	return out, nil
+}
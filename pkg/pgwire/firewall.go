@@ -0,0 +1,218 @@
+package pgwire
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ReadFirewall limits the reads served from the local database, protecting
+// small devices from expensive ad-hoc queries. The zero value allows every
+// read.
+type ReadFirewall struct {
+	// MaxJoins is the most joins in a read, JOINs or tables listed after
+	// the first in a FROM, zero doesn't limit them.
+	MaxJoins int
+	// DenyFunctions are functions reads can't call, e.g. "randomblob".
+	DenyFunctions []string
+	// LimitTables are large tables reads of which return at most
+	// LimitRows rows when they don't have a LIMIT of their own.
+	LimitTables []string
+	LimitRows   int
+}
+
+var (
+	joinKeyword  = regexp.MustCompile(`\bjoin\b`)
+	limitKeyword = regexp.MustCompile(`\blimit\b`)
+	// quoted as sqlite quotes them too, it calls "f"(), `f`() and [f]() alike
+	functionCall = regexp.MustCompile(`("(?:[^"]|"")+"|` + "`(?:[^`]|``)+`" + `|\[[^\]]+\]|[A-Za-z_][\w$]*)\s*\(`)
+	// words, quoted identifiers and the punctuation fromJoins follows
+	fromToken = regexp.MustCompile(`"(?:[^"]|"")*"|` + "`(?:[^`]|``)*`" + `|\[[^\]]*\]|[a-z_][\w$]*|[(),]`)
+)
+
+// fromEnds are the keywords ending a FROM clause.
+var fromEnds = map[string]bool{
+	"where": true, "group": true, "having": true, "window": true, "order": true, "limit": true,
+	"offset": true, "union": true, "intersect": true, "except": true, "returning": true,
+}
+
+// checkRead returns the read to run on the local database, with a LIMIT
+// when it reads a large table without one, or an error when the read
+// isn't allowed.
+func (f ReadFirewall) checkRead(query string) (string, error) {
+	code := strings.ToLower(stripLiterals(query))
+
+	if f.MaxJoins > 0 {
+		if n := len(joinKeyword.FindAllString(code, -1)) + fromJoins(code); n > f.MaxJoins {
+			return "", &pgconn.PgError{
+				Severity: "ERROR",
+				Code:     "54001",
+				Message:  fmt.Sprintf("read has %d joins, at most %d are allowed", n, f.MaxJoins),
+			}
+		}
+	}
+
+	for _, m := range functionCall.FindAllStringSubmatch(code, -1) {
+		called := unquote(m[1])
+
+		for _, name := range f.DenyFunctions {
+			if called == strings.ToLower(name) {
+				return "", &pgconn.PgError{
+					Severity: "ERROR",
+					Code:     "42501",
+					Message:  fmt.Sprintf("function %s is not allowed in reads", called),
+				}
+			}
+		}
+	}
+
+	if f.LimitRows > 0 && f.readsLimitTable(code) && !limitKeyword.MatchString(topLevel(code)) {
+		// wrapped like describe's queries, so ORDER BY and OFFSET still apply
+		query = fmt.Sprintf("SELECT * FROM (%s) LIMIT %d", strings.TrimRight(strings.TrimSpace(query), ";"), f.LimitRows)
+	}
+
+	return query, nil
+}
+
+// fromJoins counts the tables listed after the first in the FROM clauses
+// of the read and its subqueries, FROM a, b joins a and b like JOIN does.
+func fromJoins(code string) int {
+	var (
+		n int
+		// inFrom is whether each open parenthesis is in a FROM clause,
+		// the query's top level first
+		inFrom = []bool{false}
+		prev   string
+	)
+
+	for _, token := range fromToken.FindAllString(code, -1) {
+		depth := len(inFrom) - 1
+
+		switch {
+		case token == "(":
+			inFrom = append(inFrom, false)
+		case token == ")":
+			if depth > 0 {
+				inFrom = inFrom[:depth]
+			}
+		case token == ",":
+			if inFrom[depth] {
+				n++
+			}
+		case token == "from":
+			// not IS DISTINCT FROM
+			inFrom[depth] = prev != "distinct"
+		case fromEnds[token]:
+			inFrom[depth] = false
+		}
+
+		prev = token
+	}
+
+	return n
+}
+
+// unquote returns the name of a function called in the read, without
+// its quotes. sqlite's names aren't case sensitive, even quoted.
+func unquote(name string) string {
+	if len(name) < 2 {
+		return name
+	}
+
+	switch name[0] {
+	case '"':
+		return strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+	case '`':
+		return strings.ReplaceAll(name[1:len(name)-1], "``", "`")
+	case '[':
+		return name[1 : len(name)-1]
+	}
+
+	return name
+}
+
+// readsLimitTable reports whether the read references one of the large
+// tables. As with cold tables, every identifier in the read is checked.
+func (f ReadFirewall) readsLimitTable(code string) bool {
+	if len(f.LimitTables) == 0 {
+		return false
+	}
+
+	for _, token := range identifierToken.FindAllString(code, -1) {
+		for _, table := range f.LimitTables {
+			if identifier(token) == identifier(table) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// stripLiterals empties the string literals of the query and removes its
+// comments, so keywords in them aren't mistaken for the query's own.
+func stripLiterals(query string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '\'':
+			b.WriteString("''")
+
+			for i++; i < len(query); i++ {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i++
+						continue
+					}
+
+					break
+				}
+			}
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return b.String()
+			}
+
+			i += end
+			b.WriteByte('\n')
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+
+			i += end + 3
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(query[i])
+		}
+	}
+
+	return b.String()
+}
+
+// topLevel returns the query without anything in parentheses, such as
+// its subqueries.
+func topLevel(code string) string {
+	var (
+		b     strings.Builder
+		depth int
+	)
+
+	for _, r := range code {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,167 @@
+package pgwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// DefaultMaxMessageBytes is the largest message accepted from clients
+// when the config doesn't set one.
+const DefaultMaxMessageBytes = 64 << 20
+
+const (
+	// maxStartupBytes is MAX_STARTUP_PACKET_LENGTH in postgres.
+	maxStartupBytes = 10000
+	// maxSmallMessageBytes is PQ_SMALL_MESSAGE_LIMIT in postgres, the
+	// limit of the messages that never carry a query or values.
+	maxSmallMessageBytes = 10000
+)
+
+// errProtocolViolation is returned for malformed frames, the session
+// is told and closed as it can't find the start of the next message.
+var errProtocolViolation = errors.New("protocol violation")
+
+// frameReader reads the client's messages for pgproto3, checking each
+// frame's length before any of it is passed on, so malformed lengths
+// fail the session instead of allocating their size or panicking.
+type frameReader struct {
+	r io.Reader
+	// startup is set until the startup message is read, startup
+	// frames have no message type.
+	startup bool
+	max     int
+
+	hdr    [5]byte
+	hdrLen int
+	hdrOff int
+	body   int
+	// err is the last error reading or checking a frame, pgproto3
+	// errors without one come from decoding a malformed message.
+	err error
+}
+
+func newFrameReader(r io.Reader, maxBytes int) *frameReader {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxMessageBytes
+	}
+
+	// the frames are read in pieces, the buffer still reads
+	// the connection in large chunks.
+	return &frameReader{r: bufio.NewReader(r), startup: true, max: maxBytes}
+}
+
+// Read returns the bytes of at most one frame, so pgproto3 never
+// reads ahead into a frame that hasn't been checked.
+func (f *frameReader) Read(p []byte) (int, error) {
+	if f.hdrOff == f.hdrLen && f.body == 0 {
+		if err := f.next(); err != nil {
+			f.err = err
+			return 0, err
+		}
+	}
+
+	if f.hdrOff < f.hdrLen {
+		n := copy(p, f.hdr[f.hdrOff:f.hdrLen])
+		f.hdrOff += n
+
+		return n, nil
+	}
+
+	n, err := f.r.Read(p[:min(len(p), f.body)])
+	f.body -= n
+
+	if err != nil {
+		f.err = err
+	}
+
+	return n, err
+}
+
+// next reads and checks the header of the next frame.
+func (f *frameReader) next() error {
+	if f.startup {
+		if _, err := io.ReadFull(f.r, f.hdr[:4]); err != nil {
+			return err
+		}
+
+		n := int32(binary.BigEndian.Uint32(f.hdr[:4]))
+		if n < 8 || n > maxStartupBytes {
+			return fmt.Errorf("%w: invalid length of startup packet: %d", errProtocolViolation, n)
+		}
+
+		f.hdrLen, f.hdrOff, f.body = 4, 0, int(n)-4
+
+		return nil
+	}
+
+	if _, err := io.ReadFull(f.r, f.hdr[:5]); err != nil {
+		return err
+	}
+
+	typ := f.hdr[0]
+	n := int32(binary.BigEndian.Uint32(f.hdr[1:5]))
+
+	limit, ok := messageLimit(typ, f.max)
+	if !ok {
+		return fmt.Errorf("%w: invalid frontend message type %d", errProtocolViolation, typ)
+	}
+
+	if n < 4 || int64(n)-4 > int64(limit) {
+		return fmt.Errorf("%w: invalid message length %d for message type %q", errProtocolViolation, n, typ)
+	}
+
+	f.hdrLen, f.hdrOff, f.body = 5, 0, int(n)-4
+
+	return nil
+}
+
+// messageLimit returns the largest body of the message type, it's false
+// for types clients don't send.
+func messageLimit(typ byte, max int) (int, bool) {
+	switch typ {
+	case 'Q', 'P', 'B', 'F', 'd', 'p':
+		return max, true
+	case 'C', 'D', 'E', 'H', 'S', 'X', 'c', 'f':
+		return min(max, maxSmallMessageBytes), true
+	default:
+		return 0, false
+	}
+}
+
+// receive receives the next message with pgproto3, returning malformed
+// messages, including those pgproto3 panics decoding, as protocol
+// violations.
+func (f *frameReader) receive(backend *pgproto3.Backend) (msg pgproto3.FrontendMessage, err error) {
+	f.err = nil
+
+	defer func() {
+		if r := recover(); r != nil {
+			msg, err = nil, fmt.Errorf("%w: malformed message: %v", errProtocolViolation, r)
+		}
+	}()
+
+	msg, err = backend.Receive()
+	if err != nil && f.err == nil {
+		return nil, fmt.Errorf("%w: %w", errProtocolViolation, err)
+	}
+
+	return msg, err
+}
+
+// protocolViolation tells the client why the session is being closed,
+// for the errors of malformed frames.
+func (sess *session) protocolViolation(err error) {
+	if !errors.Is(err, errProtocolViolation) {
+		return
+	}
+
+	sess.batch = nil
+	sess.send(errorResponse("", &pgconn.PgError{Severity: "FATAL", Code: "08P01", Message: err.Error()}))
+	sess.flush()
+}
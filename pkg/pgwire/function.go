@@ -0,0 +1,120 @@
+package pgwire
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// errFunctionCall is returned for function calls without passthrough,
+// the local database has no postgres functions to call.
+var errFunctionCall = errors.New("function calls are not supported, enable passthrough to call upstream")
+
+// functionCall answers the legacy function call message, used by libpq for
+// the large object (lo_*) functions. With passthrough, the call is made on
+// the upstream as a SELECT of the function.
+func (s *Server) functionCall(sess *session, msg *pgproto3.FunctionCall) {
+	if sess.policy.ReadOnly {
+		sess.errReadyForQuery(errReadOnly)
+		return
+	}
+
+	if !s.cfg.Passthrough {
+		sess.send(errorResponse("0A000", errFunctionCall))
+		sess.readyForQuery()
+
+		return
+	}
+
+	if sess.tx == txFailed {
+		sess.errReadyForQuery(errTxAborted)
+		return
+	}
+
+	var res []byte
+
+	err := s.withUpstream(sess, func(conn *sql.Conn) (err error) {
+		res, err = callFunction(conn, msg)
+		return err
+	})
+	if err != nil {
+		sess.failTx()
+		sess.errReadyForQuery(err)
+
+		return
+	}
+
+	sess.send(&pgproto3.FunctionCallResponse{Result: res})
+	sess.readyForQuery()
+}
+
+func callFunction(conn *sql.Conn, msg *pgproto3.FunctionCall) ([]byte, error) {
+	ctx := context.Background()
+
+	var (
+		name     string
+		argTypes []uint32
+		retType  uint32
+	)
+
+	// arguments and the result are encoded by type, so
+	// look up the function's signature to convert them.
+	err := conn.QueryRowContext(
+		ctx,
+		"SELECT oid::regproc::text, proargtypes::oid[], prorettype FROM pg_proc WHERE oid = $1",
+		msg.Function,
+	).Scan(&name, typeMap.SQLScanner(&argTypes), &retType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find function %d: %w", msg.Function, err)
+	}
+
+	if len(msg.Arguments) != len(argTypes) {
+		return nil, fmt.Errorf("function %s takes %d arguments, got %d", name, len(argTypes), len(msg.Arguments))
+	}
+
+	argFormats := make([]int16, len(msg.ArgFormatCodes))
+	for i, f := range msg.ArgFormatCodes {
+		argFormats[i] = int16(f)
+	}
+
+	args := make([]any, len(msg.Arguments))
+	placeholders := make([]string, len(msg.Arguments))
+
+	for i, arg := range msg.Arguments {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+
+		if arg == nil {
+			continue
+		}
+
+		var value any
+		if err := typeMap.Scan(argTypes[i], formatCode(argFormats, i), arg, &value); err != nil {
+			return nil, fmt.Errorf("decode argument %d of %s: %w", i+1, name, err)
+		}
+
+		args[i] = value
+	}
+
+	// the name is quoted by regproc where needed
+	query := fmt.Sprintf("SELECT %s(%s)", name, strings.Join(placeholders, ", "))
+
+	var value any
+	if err := conn.QueryRowContext(ctx, query, args...).Scan(&value); err != nil {
+		return nil, fmt.Errorf("failed to call %s upstream: %w", name, err)
+	}
+
+	if value == nil {
+		return nil, nil
+	}
+
+	b, err := typeMap.Encode(retType, int16(msg.ResultFormatCode), value, nil)
+	if err != nil {
+		return nil, fmt.Errorf("encode result of %s: %w", name, err)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,99 @@
+package pgwire
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// passthroughGUCs are the settings a client can set in its session, which
+// are applied on the upstream connection used for the session's writes.
+var passthroughGUCs = map[string]bool{
+	"statement_timeout": true,
+	"search_path":       true,
+}
+
+var (
+	setStatement   = regexp.MustCompile(`^set\s+(?:session\s+)?(\w+)\s*(?:=|\s+to\s+)`)
+	resetStatement = regexp.MustCompile(`^reset\s+(\w+)\s*;?\s*$`)
+	setDefault     = regexp.MustCompile(`(?:=|\s+to\s+)\s*default\s*;?\s*$`)
+)
+
+// setGUC handles SET and RESET of the passthrough settings, returning
+// false when the query isn't one. query is the lowercased queryString.
+func (sess *session) setGUC(query, queryString string) (*result, bool) {
+	query = strings.TrimSpace(query)
+
+	if m := resetStatement.FindStringSubmatch(query); m != nil {
+		switch name := m[1]; {
+		case name == "all":
+			sess.gucs = make(map[string]string)
+		case passthroughGUCs[name]:
+			delete(sess.gucs, name)
+		default:
+			return nil, false
+		}
+
+		return &result{tag: "RESET"}, true
+	}
+
+	m := setStatement.FindStringSubmatch(query)
+	if m == nil || !passthroughGUCs[m[1]] {
+		return nil, false
+	}
+
+	if setDefault.MatchString(query) {
+		delete(sess.gucs, m[1])
+	} else {
+		// the value is kept as the client wrote it, the
+		// statement is run as is on the upstream connection.
+		sess.gucs[m[1]] = strings.TrimSuffix(strings.TrimSpace(queryString), ";")
+	}
+
+	return &result{tag: "SET"}, true
+}
+
+// startupGUCs keeps the passthrough settings sent as startup parameters.
+func (sess *session) startupGUCs(params map[string]string) {
+	for name, value := range params {
+		if passthroughGUCs[name] {
+			sess.gucs[name] = fmt.Sprintf("SELECT set_config('%s', '%s', false)", name, strings.ReplaceAll(value, "'", "''"))
+		}
+	}
+}
+
+// applyGUCs sets the session's settings on the upstream connection,
+// returning a func to reset them before the connection is reused.
+func (sess *session) applyGUCs(conn *sql.Conn) (func(), error) {
+	ctx := context.Background()
+
+	names := make([]string, 0, len(sess.gucs))
+	for name := range sess.gucs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	reset := func() {
+		for _, name := range names {
+			// the connection is discarded on error, rather than returned
+			// to the pool with the setting still applied.
+			if _, err := conn.ExecContext(ctx, "RESET "+name); err != nil {
+				conn.Raw(func(any) error { return driver.ErrBadConn })
+			}
+		}
+	}
+
+	for _, name := range names {
+		if _, err := conn.ExecContext(ctx, sess.gucs[name]); err != nil {
+			reset()
+			return nil, fmt.Errorf("failed to set %s upstream: %w", name, err)
+		}
+	}
+
+	return reset, nil
+}
@@ -0,0 +1,111 @@
+package pgwire
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// HostRule allows or denies sessions by client address, user and
+// database, like a pg_hba.conf entry. Rules are checked in order
+// before authentication, and the first match applies.
+type HostRule struct {
+	Allow bool
+	// Local matches clients on a unix socket, otherwise Network
+	// matches tcp clients, or any client when it is nil.
+	Local    bool
+	Network  *net.IPNet
+	User     string
+	Database string
+}
+
+// ParseHostRule parses a rule of the form:
+//
+//	allow|deny <cidr|local|all> <user|all> <database|all>
+//
+// where local matches clients on a unix socket.
+func ParseHostRule(rule string) (HostRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 4 {
+		return HostRule{}, fmt.Errorf("host rule %q: want 4 fields, got %d", rule, len(fields))
+	}
+
+	var r HostRule
+
+	switch fields[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return HostRule{}, fmt.Errorf("host rule %q: unknown action %q", rule, fields[0])
+	}
+
+	switch addr := fields[1]; addr {
+	case "local":
+		r.Local = true
+	case "all":
+	default:
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return HostRule{}, fmt.Errorf("host rule %q: %w", rule, err)
+		}
+
+		r.Network = network
+	}
+
+	r.User, r.Database = fields[2], fields[3]
+
+	return r, nil
+}
+
+func (r HostRule) matches(addr net.Addr, user, database string) bool {
+	if r.User != "all" && r.User != user {
+		return false
+	}
+
+	if r.Database != "all" && r.Database != database {
+		return false
+	}
+
+	tcp, isTCP := addr.(*net.TCPAddr)
+
+	switch {
+	case r.Local:
+		return !isTCP
+	case r.Network == nil:
+		return true
+	default:
+		return isTCP && r.Network.Contains(tcp.IP)
+	}
+}
+
+// checkHost applies the host rules to the session, with no
+// rules every client is allowed and otherwise denied by default.
+func (s *Server) checkHost(sess *session) error {
+	if len(s.cfg.HostRules) == 0 {
+		return nil
+	}
+
+	addr := sess.conn.RemoteAddr()
+
+	for _, r := range s.cfg.HostRules {
+		if r.matches(addr, sess.user, sess.database) {
+			if r.Allow {
+				return nil
+			}
+
+			break
+		}
+	}
+
+	sess.send(&pgproto3.ErrorResponse{
+		Severity: "FATAL",
+		Code:     "28000",
+		Message:  fmt.Sprintf("no host rule allows host %q, user %q, database %q", addr, sess.user, sess.database),
+	})
+
+	return errors.Join(errHostDenied, sess.flush())
+}
@@ -0,0 +1,78 @@
+package pgwire_test
+
+import (
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHostRule(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  bool
+	}{
+		{rule: "allow 10.0.0.0/8 app mydb"},
+		{rule: "deny all all all"},
+		{rule: "allow local postgres all"},
+		{rule: "allow 2001:db8::/32 all all"},
+		{rule: "allow 10.0.0.0/8 app", err: true},
+		{rule: "permit all all all", err: true},
+		{rule: "allow 10.0.0.1 all all", err: true},
+	}
+
+	for _, test := range tests {
+		_, err := pgwire.ParseHostRule(test.rule)
+		if test.err {
+			assert.Error(t, err, test.rule)
+		} else {
+			assert.NoError(t, err, test.rule)
+		}
+	}
+}
+
+func TestHostRules(t *testing.T) {
+	// test sessions connect over a pipe, so they're local clients
+	tests := []struct {
+		name  string
+		rules []string
+		allow bool
+	}{
+		{name: "no rules", allow: true},
+		{name: "allow local", rules: []string{"allow local all all"}, allow: true},
+		{name: "allow user", rules: []string{"deny local other all", "allow local postgres test"}, allow: true},
+		{name: "deny first match", rules: []string{"deny all postgres all", "allow local all all"}},
+		{name: "tcp rules only", rules: []string{"allow 0.0.0.0/0 all all"}},
+		{name: "other database", rules: []string{"allow local all other"}},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			var rules []pgwire.HostRule
+
+			for _, r := range test.rules {
+				rule, err := pgwire.ParseHostRule(r)
+				require.NoError(t, err)
+
+				rules = append(rules, rule)
+			}
+
+			server := pgwire.NewServer(pgwire.Config{Schema: "public", HostRules: rules}, nil, newLocal(t))
+			frontend := startup(t, server, pgwire.Policy{})
+
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+
+			if test.allow {
+				assert.IsType(t, &pgproto3.AuthenticationOk{}, msg)
+				return
+			}
+
+			require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+			assert.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+		})
+	}
+}
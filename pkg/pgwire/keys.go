@@ -0,0 +1,155 @@
+package pgwire
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/keys"
+	"github.com/rs/zerolog/log"
+)
+
+var insertInto = regexp.MustCompile(`(?is)^\s*insert\s+into\s+((?:"[^"]+"|\w+)(?:\s*\.\s*(?:"[^"]+"|\w+))?)\s*\(`)
+
+var valuesKeyword = regexp.MustCompile(`(?is)^\s*values\s*`)
+
+func (s *Server) fillKeys(query string) string {
+	return FillKeys(query, s.cfg.Schema, s.cfg.KeyDefaults, s.ids)
+}
+
+// FillKeys adds generated keys to an INSERT into a table of schema that
+// leaves out a column with a key default, one for each row. Only
+// INSERT ... (columns) VALUES (...) is rewritten, other statements are
+// returned as they are. The keys are generated by ids.
+func FillKeys(query, schema string, defaults []keys.Default, ids keys.IDGenerator) string {
+	if len(defaults) == 0 {
+		return query
+	}
+
+	m := insertInto.FindStringSubmatchIndex(query)
+	if m == nil {
+		return query
+	}
+
+	tableSchema, table := schema, identifier(query[m[2]:m[3]])
+	if parts := strings.Split(query[m[2]:m[3]], "."); len(parts) == 2 {
+		tableSchema, table = identifier(parts[0]), identifier(parts[1])
+	}
+
+	if tableSchema != schema {
+		return query
+	}
+
+	colsEnd := closingParen(query, m[1])
+	if colsEnd < 0 {
+		return query
+	}
+
+	columns := make(map[string]bool)
+	for _, col := range strings.Split(query[m[1]:colsEnd], ",") {
+		columns[identifier(col)] = true
+	}
+
+	var missing []keys.Default
+
+	for _, d := range defaults {
+		if d.Table == table && !columns[d.Column] {
+			missing = append(missing, d)
+		}
+	}
+
+	if len(missing) == 0 {
+		return query
+	}
+
+	v := valuesKeyword.FindStringIndex(query[colsEnd+1:])
+	if v == nil {
+		return query
+	}
+
+	// the closing parentheses of the rows
+	var rows []int
+
+	for i := colsEnd + 1 + v[1]; i < len(query) && query[i] == '('; {
+		end := closingParen(query, i+1)
+		if end < 0 {
+			return query
+		}
+
+		rows = append(rows, end)
+
+		i = end + 1
+		for i < len(query) && strings.ContainsRune(" \t\r\n", rune(query[i])) {
+			i++
+		}
+
+		if i >= len(query) || query[i] != ',' {
+			break
+		}
+
+		i++
+		for i < len(query) && strings.ContainsRune(" \t\r\n", rune(query[i])) {
+			i++
+		}
+	}
+
+	if len(rows) == 0 {
+		return query
+	}
+
+	var b strings.Builder
+
+	b.WriteString(query[:colsEnd])
+
+	for _, d := range missing {
+		b.WriteString(`, "` + strings.ReplaceAll(d.Column, `"`, `""`) + `"`)
+	}
+
+	last := colsEnd
+
+	for _, end := range rows {
+		b.WriteString(query[last:end])
+
+		for _, d := range missing {
+			key, err := ids.New(d.Kind)
+			if err != nil {
+				log.Error().Err(err).Msgf("generate key for %s.%s", d.Table, d.Column)
+				return query
+			}
+
+			b.WriteString(", '" + key + "'")
+		}
+
+		last = end
+	}
+
+	b.WriteString(query[last:])
+
+	return b.String()
+}
+
+// closingParen returns the index of the parenthesis closing the one
+// before start, skipping quoted strings and identifiers, or -1.
+func closingParen(s string, start int) int {
+	depth := 1
+	var quote byte
+
+	for i := start; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,84 @@
+package pgwire
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maintenanceCommands are the maintenance statements clients and tools
+// issue, with the command tag postgres completes them with.
+var maintenanceCommands = []struct {
+	tag     string
+	pattern *regexp.Regexp
+}{
+	{tag: "VACUUM", pattern: regexp.MustCompile(`^vacuum[\s;(]`)},
+	{tag: "ANALYZE", pattern: regexp.MustCompile(`^analy[sz]e[\s;(]`)},
+	{tag: "REINDEX", pattern: regexp.MustCompile(`^reindex[\s;(]`)},
+}
+
+// classifyMaintenance returns the command tag of a maintenance
+// statement, the query is lowercase.
+func classifyMaintenance(query string) (string, bool) {
+	query = strings.TrimSpace(query) + " "
+
+	for _, c := range maintenanceCommands {
+		if c.pattern.MatchString(query) {
+			return c.tag, true
+		}
+	}
+
+	return "", false
+}
+
+// localAnalyze matches the ANALYZE statements sqlite understands too,
+// of every table or a single unqualified table.
+var localAnalyze = regexp.MustCompile(`^analy[sz]e(?:\s+([a-z_][a-z0-9_]*))?\s*;?\s*$`)
+
+// maintenance forwards the statement upstream, and refreshes the planner
+// statistics of the local database for ANALYZE. On read-only listeners
+// nothing is forwarded, and the statements are no-ops locally other than
+// ANALYZE, as the local database is maintained by the replication.
+func (s *Server) maintenance(sess *session, tag, query, queryString string, args []any) (*result, error) {
+	log.Debug().Msgf("handle %s: %q", strings.ToLower(tag), queryString)
+
+	res := &result{tag: tag}
+
+	if !sess.policy.ReadOnly {
+		var err error
+		if res, err = s.forward(sess, queryString, args, func(int64) string { return tag }); err != nil {
+			return nil, err
+		}
+	}
+
+	m := localAnalyze.FindStringSubmatch(strings.TrimSpace(query))
+	if m == nil {
+		return res, nil
+	}
+
+	local, err := s.localDB(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := "ANALYZE"
+	if m[1] != "" {
+		stmt += " " + m[1]
+	}
+
+	if s.cfg.Analyze != nil {
+		err = s.cfg.Analyze(context.Background(), sess.tenant, stmt)
+	} else {
+		_, err = local.ExecContext(context.Background(), stmt)
+	}
+
+	// the local statistics only help local reads, the
+	// statement already succeeded as far as the client knows.
+	if err != nil {
+		log.Warn().Err(err).Msgf("analyze local database")
+	}
+
+	return res, nil
+}
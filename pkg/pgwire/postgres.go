@@ -1,15 +1,25 @@
 package pgwire
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/keys"
 	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgproto3"
 	"github.com/rs/zerolog/log"
 )
@@ -29,314 +39,704 @@ const (
 
 var withStatement = regexp.MustCompile(`with .* as (.*) select`)
 
+// Config configures how the server handles client sessions.
+type Config struct {
+	Schema string
+	// Passthrough forwards requests the local database can't
+	// serve, such as function calls, to the upstream.
+	Passthrough bool
+	// IdleInTransactionTimeout ends sessions left idle in a
+	// transaction for longer than this, zero disables it.
+	IdleInTransactionTimeout time.Duration
+	// SpoolThreshold is the bytes of a result's rows held in memory, larger
+	// results spill to a file in SpoolDir. Zero keeps every row in memory.
+	SpoolThreshold int64
+	SpoolDir       string
+	// HostRules allow or deny sessions before they authenticate.
+	HostRules []HostRule
+	// Authenticate checks a user's password, for listeners using upstream auth.
+	Authenticate func(ctx context.Context, user, password string) error
+	// UpstreamReady returns an error while the upstream is unreachable,
+	// statements that need it fail straight away instead of waiting
+	// to connect.
+	UpstreamReady func() error
+	// ReadRetries is how many times a local read that fails because
+	// the database is busy or its schema changed is retried, starting
+	// ReadRetryBackoff after the failure and doubling each time.
+	ReadRetries      int
+	ReadRetryBackoff time.Duration
+	// Tenant returns a tenant's local database, sessions with a tenant
+	// read from it instead of the main local database.
+	Tenant func(name string) (*sql.DB, error)
+	// TenantByDatabase sets a session's tenant to the database it
+	// connects to, otherwise it's set with SET sqledge.tenant.
+	TenantByDatabase bool
+	// Analyze runs ANALYZE on the tenant's local database, or the main
+	// local database when tenant is empty, for local databases that are
+	// opened read only. Nil runs it on the database reads use.
+	Analyze func(ctx context.Context, tenant, stmt string) error
+	// DDLAllow lists the DDL commands forwarded upstream by command
+	// tag, e.g. "CREATE INDEX", all of them when empty. Commands in
+	// DDLDeny are rejected.
+	DDLAllow []string
+	DDLDeny  []string
+	// DDLLockTimeout is the lock_timeout of forwarded DDL, so it fails
+	// rather than blocking the session and every query queued behind
+	// it while another transaction holds the table. Zero waits for the
+	// upstream's lock_timeout. DDL failing on lock contention outside
+	// a transaction is retried DDLRetries times, starting
+	// DDLRetryBackoff after the failure and doubling each time.
+	DDLLockTimeout  time.Duration
+	DDLRetries      int
+	DDLRetryBackoff time.Duration
+	// CatalogPassthrough answers reads of postgres' catalogs, which the
+	// local database doesn't have, from the upstream. The answers are
+	// cached by statement for CatalogCacheTTL, zero disables the cache.
+	CatalogPassthrough bool
+	CatalogCacheTTL    time.Duration
+	// KeyDefaults fill columns left out of forwarded INSERTs with
+	// generated keys, see package keys.
+	KeyDefaults []keys.Default
+	// Clock tells the time of session starts and catalog cache
+	// expiry, and IDs generates the keys of KeyDefaults. They default
+	// to the system clock and random keys, tests fix them.
+	Clock clock.Clock
+	IDs   keys.IDGenerator
+	// MaxMessageBytes is the largest message accepted from clients,
+	// sessions sending a larger one, or a frame with a malformed
+	// length, are closed with a protocol violation. Zero defaults
+	// to DefaultMaxMessageBytes.
+	MaxMessageBytes int
+	// Budget is the memory budget shared with the replication, results
+	// spill to SpoolDir while it's used up. Nil doesn't limit them.
+	Budget *budget.Budget
+	// WriteBatchSize is the most pipelined INSERTs sent upstream in one
+	// round trip, they're held until the client sends Sync or Flush, or
+	// a statement that isn't an INSERT. Zero sends each on its own.
+	WriteBatchSize int
+	// Firewall limits the joins, functions and rows of local reads.
+	Firewall ReadFirewall
+	// Quotas limit the local reads of sessions by user and table,
+	// their usage is listed in sqledge_stat_quotas.
+	Quotas []Quota
+	// Timestamps is the local timestamp policy, times read locally are
+	// sent as it stores them.
+	Timestamps string
+	// ShadowEvery runs one in this many local reads on the upstream too,
+	// in the background, logging the reads whose results differ. Their
+	// counts are listed in sqledge_stat_shadow. Zero disables shadowing.
+	ShadowEvery int
+}
+
+// Auth methods for a listener's sessions.
+const (
+	AuthTrust    = "trust"
+	AuthUpstream = "upstream"
+)
+
+// Policy configures the sessions accepted on one listener.
+type Policy struct {
+	// Listener names the listener in the session info.
+	Listener string
+	// TLS accepts SSLRequest with this config, RequireTLS
+	// rejects sessions that don't upgrade to TLS.
+	TLS        *tls.Config
+	RequireTLS bool
+	// Auth is how sessions are authenticated, AuthTrust when empty.
+	Auth string
+	// ReadOnly rejects statements that would write upstream.
+	ReadOnly bool
+}
+
+// Server serves the postgres wire protocol, reading from
+// the local database and forwarding writes upstream.
+type Server struct {
+	cfg      Config
+	upstream *sql.DB
+	local    *sql.DB
+
+	sessions *registry
+
+	noticesMu sync.Mutex
+	notices   map[*pgconn.PgConn]*session
+
+	virtualMu sync.RWMutex
+	virtual   map[string]VirtualTable
+
+	coldMu sync.RWMutex
+	cold   func(table string) bool
+
+	// held is set while hold is, so reads only lock holdMu until
+	// they're released.
+	held   atomic.Bool
+	holdMu sync.Mutex
+	hold   func() bool
+
+	catalog *catalogCache
+	quotas  *quotas
+	shadow  *shadower
+
+	clock clock.Clock
+	ids   keys.IDGenerator
+}
+
+func NewServer(cfg Config, upstream, local *sql.DB) *Server {
+	s := &Server{
+		cfg:      cfg,
+		upstream: upstream,
+		local:    local,
+		sessions: newRegistry(),
+		notices:  make(map[*pgconn.PgConn]*session),
+		virtual:  make(map[string]VirtualTable),
+		catalog:  newCatalogCache(cfg.CatalogCacheTTL),
+		shadow:   newShadower(cfg.ShadowEvery),
+		clock:    clock.Or(cfg.Clock),
+		ids:      cfg.IDs,
+	}
+
+	if s.ids == nil {
+		s.ids = keys.NewGenerator(s.clock, nil)
+	}
+
+	s.quotas = newQuotas(cfg.Quotas, s.clock)
+
+	s.AddVirtualTable("sqledge_stat_activity", s.statActivity())
+
+	if len(cfg.Quotas) > 0 {
+		s.AddVirtualTable("sqledge_stat_quotas", s.statQuotas())
+	}
+
+	if cfg.ShadowEvery > 0 {
+		s.AddVirtualTable("sqledge_stat_shadow", s.statShadow())
+	}
+
+	return s
+}
+
+// Handle serves a single client connection on a new server.
 func Handle(schema string, upstream, local *sql.DB, conn net.Conn) {
-	if err := onStart(conn); err != nil {
+	NewServer(Config{Schema: schema}, upstream, local).Handle(conn)
+}
+
+// Handle serves the client connection until it exits.
+func (s *Server) Handle(conn net.Conn) {
+	s.HandlePolicy(conn, Policy{})
+}
+
+// HandlePolicy serves the client connection with the listener's policy.
+func (s *Server) HandlePolicy(conn net.Conn, policy Policy) {
+	sess := s.sessions.add(conn, policy, s.clock.Now(), s.cfg.MaxMessageBytes)
+	defer s.sessions.remove(sess.id)
+	defer conn.Close()
+
+	// an open transaction is rolled back when the client goes away
+	defer sess.endTx()
+	defer sess.closePortals()
+
+	if err := s.onStart(sess); err != nil {
 		log.Error().Err(err).Msg("on start error")
+		return
 	}
 
-	log.Debug().Msg("completed startup")
+	log.Debug().Msgf("session %d: completed startup from %s", sess.id, conn.RemoteAddr())
 
 	for {
-		b := make([]byte, 5)
+		msg, err := s.receive(sess)
+		if errors.Is(err, errIdleInTransaction) {
+			log.Info().Msgf("session %d: %s", sess.id, err)
+			return
+		}
 
-		if _, err := conn.Read(b); err != nil {
-			log.Error().Err(err).Msg("read initial")
+		if err != nil {
+			log.Error().Err(err).Msg("read message")
 			return
 		}
 
-		switch b[0] {
-		case SimpleQuery:
-		case Exit:
-			conn.Close()
+		if !deferrable(msg) {
+			// the responses to pipelined INSERTs are due
+			s.flushBatch(sess)
+		}
+
+		if sess.skipToSync && isExtended(msg) {
+			// after an error, the extended query messages
+			// are discarded until the next Sync.
+			continue
+		}
+
+		if err := sess.decodeMessage(msg); err != nil {
+			if isExtended(msg) {
+				sess.extendedErr("22021", err)
+				continue
+			}
+
+			sess.errReadyForQuery(err)
+
+			if err := sess.flush(); err != nil {
+				log.Error().Err(err).Msg("write response")
+				return
+			}
+
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			s.simpleQuery(sess, msg.String)
+		case *pgproto3.FunctionCall:
+			s.functionCall(sess, msg)
+		case *pgproto3.Parse:
+			s.parse(sess, msg)
+		case *pgproto3.Bind:
+			s.bind(sess, msg)
+		case *pgproto3.Describe:
+			s.describe(sess, msg)
+		case *pgproto3.Execute:
+			s.executePortal(sess, msg)
+		case *pgproto3.Close:
+			s.close(sess, msg)
+		case *pgproto3.Sync:
+			sess.skipToSync = false
+			sess.sync()
+		case *pgproto3.Flush:
+		case *pgproto3.Terminate:
 			return
 		default:
-			log.Error().Msgf("unknown message type: %q", string(b[0]))
+			log.Error().Msgf("unknown message type: %T", msg)
 			return
 		}
 
-		l := binary.BigEndian.Uint32(b[1:5]) - 4
+		if !needsFlush(msg) {
+			// pipelined extended query messages are answered
+			// together when the client asks with Sync or Flush.
+			continue
+		}
+
+		if err := sess.flush(); err != nil {
+			log.Error().Err(err).Msg("write response")
+			return
+		}
+	}
+}
+
+// deferrable reports whether the message can be handled before the
+// batched INSERTs ahead of it have run.
+func deferrable(msg pgproto3.FrontendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Execute, *pgproto3.Close:
+		return true
+	}
+
+	return false
+}
+
+func needsFlush(msg pgproto3.FrontendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.Query, *pgproto3.FunctionCall, *pgproto3.Sync, *pgproto3.Flush:
+		return true
+	}
+
+	return false
+}
+
+// result is the outcome of executing a statement.
+type result struct {
+	// desc is nil for statements that don't return rows.
+	desc *pgproto3.RowDescription
+	rows *spool
+	tag  string
+}
+
+// relayedStatement matches the statements returning rows that aren't
+// read locally, which passthrough mode runs on the upstream.
+var relayedStatement = regexp.MustCompile(`^\s*(show|explain|values|table)\b`)
+
+func isRelayed(query string) bool {
+	return relayedStatement.MatchString(strings.ToLower(query))
+}
+
+// IsRead reports whether the query is a read, which is served from the local database.
+func IsRead(query string) bool {
+	query = strings.ToLower(query)
+	return strings.HasPrefix(query, "select") || withStatement.MatchString(query)
+}
+
+func (s *Server) simpleQuery(sess *session, queryString string) {
+	res, err := s.execute(sess, queryString, nil)
+	if err != nil {
+		sess.errReadyForQuery(err)
+		return
+	}
 
-		body := make([]byte, l)
+	defer res.rows.close()
 
-		if _, err := conn.Read(body); err != nil {
-			log.Error().Err(err).Msg("read query body")
+	if res.desc != nil {
+		sess.send(res.desc)
+	}
+
+	for {
+		row, err := res.rows.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			sess.errReadyForQuery(err)
 			return
 		}
 
-		query := strings.ToLower(string(body[:len(body)-1]))
+		if row, err = sess.encodeRow(res.desc, row); err != nil {
+			sess.errReadyForQuery(err)
+			return
+		}
 
-		switch {
-		case strings.HasPrefix(query, "select") || withStatement.MatchString(query):
-			log.Debug().Msgf("querying: %q", string(query))
+		sess.send(&pgproto3.DataRow{Values: row})
+	}
 
-			rows, err := local.Query(query)
-			if err != nil {
-				log.Error().Err(err).Msg("local query")
+	sess.send(&pgproto3.CommandComplete{CommandTag: []byte(res.tag)})
+	sess.readyForQuery()
+}
 
-				errReadyForQuery(fmt.Errorf("failed to query local: %w", err), conn)
+// execute runs the query for the session, an error
+// fails the session's open transaction.
+func (s *Server) execute(sess *session, queryString string, args []any) (*result, error) {
+	query := strings.ToLower(queryString)
 
-				continue
-			}
+	if res, ok, err := sess.transaction(query); ok {
+		return res, err
+	}
 
-			desc := rowDesc(rows)
-			out := desc.Encode(nil)
+	if sess.tx == txFailed {
+		return nil, errTxAborted
+	}
 
-			data := rowData(rows)
-			for _, row := range data {
-				out = row.Encode(out)
-			}
+	res, err := s.route(sess, query, queryString, args)
+	if err != nil {
+		sess.failTx()
+	}
 
-			log.Debug().Msgf("found %d rows", len(data))
+	return res, err
+}
 
-			cmd := &pgproto3.CommandComplete{CommandTag: []byte("")}
-			out = cmd.Encode(out)
+// route sends the query to the local database for reads, or the upstream
+// for writes. args are the bound parameters for the $n placeholders.
+func (s *Server) route(sess *session, query, queryString string, args []any) (*result, error) {
+	if res, ok, err := s.setTenant(sess, queryString); ok {
+		return res, err
+	}
 
-			ready := &pgproto3.ReadyForQuery{TxStatus: 'I'}
-			out = ready.Encode(out)
+	if res, ok, err := sess.setClientEncoding(queryString); ok {
+		return res, err
+	}
 
-			if _, err := conn.Write(out); err != nil {
-				log.Error().Err(err).Msg("write response")
+	if res, ok := sess.setGUC(query, queryString); ok {
+		return res, nil
+	}
 
-				continue
-			}
-		case strings.HasPrefix(query, "update"):
-			r, err := upstream.Exec(query)
-			if err != nil {
-				errReadyForQuery(fmt.Errorf("failed to query upstream: %w", err), conn)
+	ddlTag, isDDL := classifyDDL(query)
+	maintenanceTag, isMaintenance := classifyMaintenance(query)
 
-				continue
-			}
+	switch {
+	case IsRead(query):
+		log.Debug().Msgf("querying: %q", queryString)
 
-			updates, err := r.RowsAffected()
-			cmd := pgproto3.CommandComplete{CommandTag: []byte("UPDATE " + fmt.Sprintf("%d", updates))}
+		if names := s.virtualTables(query); len(names) > 0 {
+			return s.queryVirtual(queryString, args, names)
+		}
 
-			out := cmd.Encode(nil)
-			ready := &pgproto3.ReadyForQuery{TxStatus: 'I'}
-			out = ready.Encode(out)
+		if s.isCatalog(query) {
+			return s.queryCatalog(sess, queryString, args)
+		}
 
-			if _, err := conn.Write(out); err != nil {
-				log.Error().Err(err).Msg("write response")
+		if s.readsCold(sess, queryString) {
+			log.Debug().Msgf("reading from upstream, the local tables are still being copied: %q", queryString)
+			return s.query(sess, queryString, args)
+		}
 
-				continue
-			}
-		case strings.HasPrefix(query, "insert"):
-			r, err := upstream.Exec(query)
-			if err != nil {
-				errReadyForQuery(fmt.Errorf("failed to query upstream: %w", err), conn)
+		local, err := s.localDB(sess)
+		if err != nil {
+			return nil, err
+		}
 
-				continue
-			}
+		quotas, err := s.quotas.admit(context.Background(), sess.user, query)
+		if err != nil {
+			return nil, err
+		}
 
-			updates, err := r.RowsAffected()
-			cmd := pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 " + fmt.Sprintf("%d", updates))}
+		res, err := s.readLocal(context.Background(), local, queryString, args)
+		if err == nil {
+			s.quotas.served(quotas, res.rows.bytes())
+			s.shadowRead(sess, queryString, args)
+		}
 
-			out := cmd.Encode(nil)
-			ready := &pgproto3.ReadyForQuery{TxStatus: 'I'}
-			out = ready.Encode(out)
+		return res, err
+	case isMaintenance:
+		return s.maintenance(sess, maintenanceTag, query, queryString, args)
+	case sess.policy.ReadOnly:
+		return nil, errReadOnly
+	case strings.HasPrefix(query, "update"):
+		return s.forward(sess, queryString, args, func(n int64) string { return fmt.Sprintf("UPDATE %d", n) })
+	case strings.HasPrefix(query, "insert"):
+		return s.forward(sess, s.fillKeys(queryString), args, func(n int64) string { return fmt.Sprintf("INSERT 0 %d", n) })
+	case strings.HasPrefix(query, "delete"):
+		return s.forward(sess, queryString, args, func(n int64) string { return fmt.Sprintf("DELETE %d", n) })
+	case isDDL:
+		return s.forwardDDL(sess, ddlTag, queryString, args)
+	case s.cfg.Passthrough && isRelayed(query):
+		return s.query(sess, queryString, args)
+	default:
+		// this covers all unknown queries
+		return nil, fmt.Errorf("unknown query type: %q", query)
+	}
+}
 
-			if _, err := conn.Write(out); err != nil {
-				log.Error().Err(err).Msg("write response")
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
 
-				continue
-			}
-		case strings.HasPrefix(query, "delete"):
-			r, err := upstream.Exec(query)
-			if err != nil {
-				errReadyForQuery(fmt.Errorf("failed to query upstream: %w", err), conn)
+// readLocal runs the read on the local database, retrying
+// it while the local database is busy.
+func (s *Server) readLocal(ctx context.Context, db queryer, queryString string, args []any) (*result, error) {
+	queryString, err := s.cfg.Firewall.checkRead(queryString)
+	if err != nil {
+		return nil, err
+	}
 
-				continue
-			}
+	if len(args) > 0 {
+		queryString = SQLiteParams(queryString)
+	}
 
-			updates, err := r.RowsAffected()
-			cmd := pgproto3.CommandComplete{CommandTag: []byte("DELETE " + fmt.Sprintf("%d", updates))}
+	return s.retryRead(ctx, func() (*result, error) {
+		return s.readLocalOnce(ctx, db, queryString, args)
+	})
+}
 
-			out := cmd.Encode(nil)
-			ready := &pgproto3.ReadyForQuery{TxStatus: 'I'}
-			out = ready.Encode(out)
+func (s *Server) readLocalOnce(ctx context.Context, db queryer, queryString string, args []any) (*result, error) {
+	rows, err := db.QueryContext(ctx, queryString, args...)
+	if err != nil {
+		log.Error().Err(err).Msg("local query")
 
-			if _, err := conn.Write(out); err != nil {
-				log.Error().Err(err).Msg("write response")
+		return nil, fmt.Errorf("failed to query local: %w", err)
+	}
+	defer rows.Close()
 
-				continue
-			}
-		case strings.HasPrefix(query, "create table"):
-			log.Debug().Msgf("handle create table: %q", query)
-			_, err := upstream.Exec(query)
-			if err != nil {
-				errReadyForQuery(fmt.Errorf("failed to query upstream: %w", err), conn)
+	res := &result{desc: rowDesc(rows)}
+	if res.desc == nil {
+		return nil, fmt.Errorf("failed to describe local rows")
+	}
 
-				continue
-			}
-			log.Debug().Msgf("upstream for create table: %q", query)
+	res.rows = s.newSpool()
+	if err := rowData(rows, res.rows, s.cfg.Timestamps); err != nil {
+		res.rows.close()
+		return nil, err
+	}
 
-			cmd := pgproto3.CommandComplete{CommandTag: []byte("CREATE TABLE")}
-			out := cmd.Encode(nil)
+	res.tag = fmt.Sprintf("SELECT %d", res.rows.len())
 
-			ready := &pgproto3.ReadyForQuery{TxStatus: 'I'}
-			out = ready.Encode(out)
+	log.Debug().Msgf("found %d rows", res.rows.len())
 
-			if _, err := conn.Write(out); err != nil {
-				log.Error().Err(err).Msg("write response")
+	return res, nil
+}
 
-				continue
-			}
-			log.Debug().Msgf("success create table: %q", query)
-		case strings.HasPrefix(query, "delete table"):
-			_, err := upstream.Exec(query)
-			if err != nil {
-				errReadyForQuery(fmt.Errorf("failed to query upstream: %w", err), conn)
+// forward executes the query on the upstream, and completes
+// with the command tag built from the rows affected.
+func (s *Server) forward(sess *session, query string, args []any, tag func(rowsAffected int64) string) (*result, error) {
+	var n int64
 
-				continue
-			}
+	err := s.withUpstream(sess, func(conn *sql.Conn) error {
+		r, err := conn.ExecContext(context.Background(), query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to query upstream: %w", err)
+		}
 
-			cmd := pgproto3.CommandComplete{CommandTag: []byte("DELETE TABLE")}
-			out := cmd.Encode(nil)
+		n, _ = r.RowsAffected()
 
-			ready := &pgproto3.ReadyForQuery{TxStatus: 'I'}
-			out = ready.Encode(out)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			if _, err := conn.Write(out); err != nil {
-				log.Error().Err(err).Msg("write response")
+	return &result{tag: tag(n)}, nil
+}
 
-				continue
-			}
-		case strings.HasPrefix(query, "alter table"):
-			_, err := upstream.Exec(query)
-			if err != nil {
-				errReadyForQuery(fmt.Errorf("failed to query upstream: %w", err), conn)
+// onStart negotiates encryption, reads the startup message
+// and authenticates the session.
+func (s *Server) onStart(sess *session) error {
+	for {
+		sess.frames.err = nil
 
-				continue
+		msg, err := sess.backend.ReceiveStartupMessage()
+		if err != nil {
+			if sess.frames.err == nil {
+				err = fmt.Errorf("%w: %w", errProtocolViolation, err)
 			}
 
-			cmd := pgproto3.CommandComplete{CommandTag: []byte("ALTER TABLE")}
-			out := cmd.Encode(nil)
+			sess.protocolViolation(err)
 
-			ready := &pgproto3.ReadyForQuery{TxStatus: 'I'}
-			out = ready.Encode(out)
+			return fmt.Errorf("read startup message: %w", err)
+		}
 
-			if _, err := conn.Write(out); err != nil {
-				log.Error().Err(err).Msg("write response")
+		switch msg := msg.(type) {
+		case *pgproto3.SSLRequest:
+			if err := sess.startTLS(); err != nil {
+				return err
+			}
 
-				continue
+			continue
+		case *pgproto3.GSSEncRequest:
+			if _, err := sess.conn.Write([]byte{'N'}); err != nil {
+				return fmt.Errorf("deny gss encryption: %w", err)
 			}
-		default:
-			// this covers all unknown queries
-			errReadyForQuery(fmt.Errorf("unknown query type: %q", query), conn)
 
 			continue
-		}
+		case *pgproto3.StartupMessage:
+			sess.mu.Lock()
+			sess.user = msg.Parameters["user"]
+			sess.database = msg.Parameters["database"]
+			sess.mu.Unlock()
 
-	}
-}
+			sess.startupEncoding = msg.Parameters["client_encoding"]
+			sess.startupGUCs(msg.Parameters)
+			sess.frames.startup = false
 
-// Eventually this method should parse the connection
-// details and connect to the upstream database using them.
-func onStart(conn net.Conn) error {
-	readBuf := make([]byte, 4)
+			log.Debug().Msgf("startup message: user: %q, database: %q", sess.user, sess.database)
+		default:
+			return fmt.Errorf("unsupported startup message: %T", msg)
+		}
 
-	if _, err := conn.Read(readBuf); err != nil {
-		return fmt.Errorf("read msg len: %w", err)
+		break
 	}
 
-	l := binary.BigEndian.Uint32(readBuf) - 4
+	if sess.policy.RequireTLS && !sess.tls {
+		sess.send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "28000",
+			Message:  "connections on this listener must use SSL",
+		})
 
-	if l < 4 || l > 10000 {
-		return fmt.Errorf("invalid msg len: %d", l)
+		return errors.Join(errTLSRequired, sess.flush())
 	}
 
-	b := make([]byte, l)
+	if _, _, ok := lookupEncoding(sess.startupEncoding); !ok && sess.startupEncoding != "" {
+		pgErr := errInvalidEncoding("FATAL", sess.startupEncoding)
+		sess.send(errorResponse("", pgErr))
 
-	if _, err := conn.Read(b); err != nil {
-		return fmt.Errorf("read msg: %w", err)
+		return errors.Join(pgErr, sess.flush())
 	}
 
-	log.Debug().Msgf("startup message size: %d", l)
+	if err := s.checkHost(sess); err != nil {
+		return err
+	}
 
-	msgType := binary.BigEndian.Uint32(b)
+	if err := s.authenticate(sess); err != nil {
+		return err
+	}
 
-	switch msgType {
-	case SSLRequest:
-		conn.Write([]byte{'N'})
-		return onStart(conn)
+	if err := s.startTenant(sess); err != nil {
+		return err
+	}
 
-	case StartupMessage:
-		// AuthenticationOk
-		{
-			success := uint32(0)
-			l := uint32(8)
-			d := make([]byte, l)
+	sess.send(&pgproto3.AuthenticationOk{})
+	sess.send(&pgproto3.ParameterStatus{Name: "server_encoding", Value: serverEncoding})
 
-			binary.BigEndian.PutUint32(d[0:4], l)
-			binary.BigEndian.PutUint32(d[4:], success)
+	if err := sess.useEncoding(sess.startupEncoding); err != nil {
+		return err
+	}
 
-			conn.Write([]byte{AuthenticationOk})
-			conn.Write(d)
+	sess.send(&pgproto3.BackendKeyData{ProcessID: sess.id, SecretKey: sess.secret})
+	sess.send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
 
-			log.Debug().Msgf("auth ok: len: %d, %s", l, string(AuthenticationOk))
-		}
+	return sess.flush()
+}
 
-		// BackendKeyData
-		{
-			l := uint32(12)
-			id := uint32(1234)
-			secret := uint32(5678)
+func rowData(rows *sql.Rows, data *spool, timestamps string) error {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return fmt.Errorf("column types: %w", err)
+	}
 
-			d := make([]byte, l)
-			binary.BigEndian.PutUint32(d[0:4], l)
-			binary.BigEndian.PutUint32(d[4:8], id)
-			binary.BigEndian.PutUint32(d[8:], secret)
+	// the values are scanned without copying, and copied
+	// into the spool's pooled buffers.
+	values := make([]rawValue, len(types))
+	raw := make([][]byte, len(types))
+	dsts := make([]any, len(types))
 
-			conn.Write([]byte{BackendKeyData})
-			conn.Write(d)
+	for i := range values {
+		values[i].timestamps = timestamps
+		values[i].typ = sqlgen.ColType(strings.ToLower(types[i].DatabaseTypeName()))
+		dsts[i] = &values[i]
+	}
 
-			log.Debug().Msgf("backend key data: len: %d, id: %d, secret: %d, %s", l, id, secret, string(BackendKeyData))
+	for rows.Next() {
+		if err := rows.Scan(dsts...); err != nil {
+			log.Error().Err(err).Msg("row scan")
+			continue
 		}
 
-		// ReadyForQuery
-		{
-			l := uint32(5)
-			d := make([]byte, l)
-
-			binary.BigEndian.PutUint32(d[0:4], l)
-			d[4] = 'I'
-
-			conn.Write([]byte{ReadyForQuery})
-			conn.Write(d)
+		for i, v := range values {
+			raw[i] = v.b
+		}
 
-			log.Debug().Msgf("ready for query: len: %d %s", l, string(ReadyForQuery))
+		if err := data.add(data.copyRow(raw)); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	return rows.Err()
 }
 
-func rowData(rows *sql.Rows) []*pgproto3.DataRow {
-	cols, err := rows.Columns()
-	if err != nil {
-		log.Error().Err(err).Msg("columns")
+// rawValue scans a column's text without copying it, like sql.RawBytes,
+// which reads empty values as nulls. It's valid until the next row.
+type rawValue struct {
+	b   []byte
+	buf []byte
+	// timestamps is the local timestamp policy times are formatted with.
+	timestamps string
+	// typ is the column's declared type, intervals and ranges are sent
+	// in postgres' format.
+	typ sqlgen.ColType
+}
 
-		return nil
-	}
+func (v *rawValue) Scan(src any) error {
+	buf := v.buf[:0]
 
-	data := []*pgproto3.DataRow{}
+	switch src := src.(type) {
+	case nil:
+		v.b = nil
+		return nil
+	case []byte:
+		if src == nil {
+			src = []byte{}
+		}
 
-	for rows.Next() {
-		row := make([][]byte, len(cols))
-		dsts := make([]any, len(cols))
+		v.b = src
 
-		for i := range row {
-			dsts[i] = &row[i]
+		return nil
+	case string:
+		if v.typ.Structured() {
+			src = sqlgen.PostgresText(v.typ, src)
 		}
 
-		if err := rows.Scan(dsts...); err != nil {
-			log.Error().Err(err).Msg("row scan")
-			continue
-		}
+		buf = append(buf, src...)
+	case int64:
+		buf = strconv.AppendInt(buf, src, 10)
+	case float64:
+		buf = strconv.AppendFloat(buf, src, 'g', -1, 64)
+	case bool:
+		buf = strconv.AppendBool(buf, src)
+	case time.Time:
+		buf = append(buf, sqlgen.FormatTimestamp(v.timestamps, src, true)...)
+	default:
+		buf = fmt.Append(buf, src)
+	}
 
-		data = append(data, &pgproto3.DataRow{Values: row})
+	if buf == nil {
+		buf = []byte{}
 	}
 
-	return data
+	v.buf, v.b = buf, buf
+
+	return nil
 }
 
 func rowDesc(rows *sql.Rows) *pgproto3.RowDescription {
@@ -359,6 +759,10 @@ func rowDesc(rows *sql.Rows) *pgproto3.RowDescription {
 
 	for i, c := range cols {
 		oid, size := sqlgen.ColType(strings.ToLower(types[i].DatabaseTypeName())).PgType()
+		if oid < 0 {
+			// expressions have no declared type, so send them as text
+			oid, size = sqlgen.SQLiteColTypeText.PgType()
+		}
 
 		rowDesc.Fields = append(rowDesc.Fields, pgproto3.FieldDescription{
 			Name:         []byte(c),
@@ -371,13 +775,31 @@ func rowDesc(rows *sql.Rows) *pgproto3.RowDescription {
 	return rowDesc
 }
 
-func errReadyForQuery(err error, w io.Writer) {
+func (sess *session) errReadyForQuery(err error) {
 	log.Error().Err(err).Msg("error in pgwire")
-	errResponse := pgproto3.ErrorResponse{Message: err.Error()}
-	out := errResponse.Encode(nil)
 
-	ready := pgproto3.ReadyForQuery{TxStatus: 'I'}
-	out = ready.Encode(out)
+	sess.send(errorResponse("XX000", err))
+	sess.readyForQuery()
+}
+
+// errorResponse describes the error, using the upstream's error
+// fields when there are some, or the code otherwise.
+func errorResponse(code string, err error) *pgproto3.ErrorResponse {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return &pgproto3.ErrorResponse{
+			Severity:       pgErr.Severity,
+			Code:           pgErr.Code,
+			Message:        pgErr.Message,
+			Detail:         pgErr.Detail,
+			Hint:           pgErr.Hint,
+			SchemaName:     pgErr.SchemaName,
+			TableName:      pgErr.TableName,
+			ColumnName:     pgErr.ColumnName,
+			DataTypeName:   pgErr.DataTypeName,
+			ConstraintName: pgErr.ConstraintName,
+		}
+	}
 
-	w.Write(out)
+	return &pgproto3.ErrorResponse{Severity: "ERROR", Code: code, Message: err.Error()}
 }
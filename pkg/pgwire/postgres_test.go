@@ -0,0 +1,1447 @@
+package pgwire_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/keys"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLocal(t testing.TB, statements ...string) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+
+	// each connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range statements {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// connect starts a session on the server, and returns
+// the client side once startup has completed.
+func connect(t *testing.T, server *pgwire.Server) *pgproto3.Frontend {
+	frontend := startup(t, server, pgwire.Policy{})
+	receiveUntilReady(t, frontend)
+
+	return frontend
+}
+
+// startup sends the startup message for a session with the policy.
+func startup(t *testing.T, server *pgwire.Server, policy pgwire.Policy) *pgproto3.Frontend {
+	client, conn := net.Pipe()
+
+	go server.HandlePolicy(conn, policy)
+	t.Cleanup(func() { client.Close() })
+
+	frontend := pgproto3.NewFrontend(client, client)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres", "database": "test"},
+	})
+	require.NoError(t, frontend.Flush())
+
+	return frontend
+}
+
+func receiveUntilReady(t *testing.T, frontend *pgproto3.Frontend) []pgproto3.BackendMessage {
+	var out []pgproto3.BackendMessage
+
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+
+		switch msg := msg.(type) {
+		case *pgproto3.ReadyForQuery:
+			return append(out, &pgproto3.ReadyForQuery{TxStatus: msg.TxStatus})
+		case *pgproto3.DataRow:
+			values := make([][]byte, len(msg.Values))
+			for i, v := range msg.Values {
+				values[i] = append([]byte(nil), v...)
+			}
+
+			out = append(out, &pgproto3.DataRow{Values: values})
+		case *pgproto3.CommandComplete:
+			out = append(out, &pgproto3.CommandComplete{CommandTag: append([]byte(nil), msg.CommandTag...)})
+		case *pgproto3.ErrorResponse:
+			m := *msg
+			out = append(out, &m)
+		case *pgproto3.ParameterStatus:
+			m := *msg
+			out = append(out, &m)
+		default:
+			out = append(out, msg)
+		}
+	}
+}
+
+func TestSimpleQuery(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, 'Hello'), (2, 'World');",
+	)
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local))
+
+	frontend.Send(&pgproto3.Query{String: "SELECT name FROM names ORDER BY id;"})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 5)
+
+	assert.IsType(t, &pgproto3.RowDescription{}, msgs[0])
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("Hello")}}, msgs[1])
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("World")}}, msgs[2])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msgs[4])
+}
+
+func TestStructuredTypes(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE bookings (id integer primary key, length interval, seats int4range, during tsrange);",
+		`INSERT INTO bookings VALUES (1, 'P1DT2H30M', '{"lower":1,"upper":5,"lower_inc":true,"upper_inc":false}',
+			'{"lower":"2024-05-01 12:00:00","upper":null,"lower_inc":true,"upper_inc":false}');`,
+	)
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local))
+
+	frontend.Send(&pgproto3.Query{String: "SELECT length, seats, during FROM bookings;"})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 4)
+
+	desc, ok := msgs[0].(*pgproto3.RowDescription)
+	require.True(t, ok)
+
+	oids := make([]uint32, len(desc.Fields))
+	for i, f := range desc.Fields {
+		oids[i] = f.DataTypeOID
+	}
+
+	assert.Equal(t, []uint32{1186, 3904, 3908}, oids)
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{
+		[]byte("1 day 02:30:00"), []byte("[1,5)"), []byte(`["2024-05-01 12:00:00",)`),
+	}}, msgs[1])
+}
+
+func TestClientEncoding(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, 'café'), (2, '€uro');",
+	)
+
+	connectWith := func(encoding string) *pgproto3.Frontend {
+		client, conn := net.Pipe()
+
+		go pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local).HandlePolicy(conn, pgwire.Policy{})
+		t.Cleanup(func() { client.Close() })
+
+		frontend := pgproto3.NewFrontend(client, client)
+		frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres", "database": "test", "client_encoding": encoding},
+		})
+		require.NoError(t, frontend.Flush())
+
+		return frontend
+	}
+
+	t.Run("latin1", func(t *testing.T) {
+		frontend := connectWith("latin1")
+
+		startup := receiveUntilReady(t, frontend)
+		assert.Contains(t, startup, &pgproto3.ParameterStatus{Name: "client_encoding", Value: "LATIN1"})
+		assert.Contains(t, startup, &pgproto3.ParameterStatus{Name: "server_encoding", Value: "UTF8"})
+
+		frontend.Send(&pgproto3.Query{String: "SELECT id, name FROM names WHERE name = 'caf\xe9';"})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		require.Len(t, msgs, 4)
+		assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("1"), []byte("caf\xe9")}}, msgs[1])
+
+		// € has no equivalent in LATIN1
+		frontend.Send(&pgproto3.Query{String: "SELECT name FROM names WHERE id = 2;"})
+		require.NoError(t, frontend.Flush())
+
+		msgs = receiveUntilReady(t, frontend)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msgs[1])
+		assert.Equal(t, "22P05", msgs[1].(*pgproto3.ErrorResponse).Code)
+
+		frontend.Send(&pgproto3.Query{String: "SET client_encoding TO 'UTF8';"})
+		require.NoError(t, frontend.Flush())
+
+		msgs = receiveUntilReady(t, frontend)
+		assert.Equal(t, &pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"}, msgs[0])
+
+		frontend.Send(&pgproto3.Query{String: "SELECT name FROM names WHERE id = 2;"})
+		require.NoError(t, frontend.Flush())
+
+		msgs = receiveUntilReady(t, frontend)
+		assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("€uro")}}, msgs[1])
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		frontend := connectWith("EBCDIC")
+
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		assert.Equal(t, "22023", msg.(*pgproto3.ErrorResponse).Code)
+		assert.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+	})
+}
+
+func TestUnknownQuery(t *testing.T) {
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, newLocal(t)))
+
+	frontend.Send(&pgproto3.Query{String: "LISTEN foo;"})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 2)
+
+	assert.IsType(t, &pgproto3.ErrorResponse{}, msgs[0])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msgs[1])
+}
+
+func TestPassthroughStatements(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{
+		Schema:      "public",
+		Passthrough: true,
+		UpstreamReady: func() error {
+			return errors.New("upstream unreachable: connection refused")
+		},
+	}, nil, newLocal(t))
+
+	frontend := connect(t, server)
+
+	for query, code := range map[string]string{
+		// relayed to the upstream, which is unreachable
+		"SHOW work_mem;":    "57P03",
+		"EXPLAIN SELECT 1;": "57P03",
+		"VALUES (1, 2);":    "57P03",
+		"table names;":      "57P03",
+		// not run upstream
+		"LISTEN foo;":              "XX000",
+		"NOTIFY foo;":              "XX000",
+		"SHOWS_NOTHING_AS_SHOW 1;": "XX000",
+	} {
+		frontend.Send(&pgproto3.Query{String: query})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0], query)
+		assert.Equal(t, code, msgs[0].(*pgproto3.ErrorResponse).Code, query)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, newLocal(t))
+	connect(t, server)
+
+	sessions := server.Sessions()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "postgres", sessions[0].User)
+	assert.Equal(t, "test", sessions[0].Database)
+
+	assert.NoError(t, server.SetTrace(sessions[0].ID, true))
+	assert.True(t, server.Sessions()[0].Trace)
+
+	assert.ErrorIs(t, server.SetTrace(sessions[0].ID+1, true), pgwire.ErrUnknownSession)
+}
+
+func TestSessionsStarting(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, newLocal(t))
+
+	done := make(chan struct{})
+	listed := make(chan struct{})
+
+	// sessions are listed while they start up
+	go func() {
+		defer close(listed)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.Sessions()
+				runtime.Gosched()
+			}
+		}
+	}()
+
+	var frontends []*pgproto3.Frontend
+	for range 10 {
+		frontends = append(frontends, startup(t, server, pgwire.Policy{}))
+	}
+
+	for _, frontend := range frontends {
+		receiveUntilReady(t, frontend)
+	}
+
+	close(done)
+	<-listed
+
+	assert.Len(t, server.Sessions(), 10)
+}
+
+func TestRedact(t *testing.T) {
+	assert.Equal(t, &pgproto3.Query{String: "SELECT * FROM t WHERE a = '?' AND b = ?"},
+		pgwire.Redact(&pgproto3.Query{String: "SELECT * FROM t WHERE a = 'secret' AND b = 42"}))
+	assert.Equal(t, &pgproto3.FunctionCall{Function: 1, Arguments: [][]byte{[]byte("?"), nil}},
+		pgwire.Redact(&pgproto3.FunctionCall{Function: 1, Arguments: [][]byte{[]byte("secret"), nil}}))
+	assert.Equal(t, &pgproto3.FunctionCallResponse{Result: []byte("?")},
+		pgwire.Redact(&pgproto3.FunctionCallResponse{Result: []byte("secret")}))
+	assert.Equal(t, &pgproto3.FunctionCallResponse{},
+		pgwire.Redact(&pgproto3.FunctionCallResponse{}))
+	assert.Equal(t, &pgproto3.CopyData{Data: []byte("?")},
+		pgwire.Redact(&pgproto3.CopyData{Data: []byte("1\tsecret\n")}))
+}
+
+func TestPipeline(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, 'Hello'), (2, 'World');",
+	)
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local))
+
+	frontend.Send(&pgproto3.Parse{Name: "by_id", Query: "SELECT name FROM names WHERE id = $1;"})
+	frontend.Send(&pgproto3.Describe{ObjectType: 'S', Name: "by_id"})
+	frontend.Send(&pgproto3.Flush{})
+	require.NoError(t, frontend.Flush())
+
+	// Flush sends the pending responses without a Sync
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	assert.IsType(t, &pgproto3.ParseComplete{}, msg)
+
+	msg, err = frontend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.ParameterDescription{ParameterOIDs: []uint32{0}}, msg)
+
+	msg, err = frontend.Receive()
+	require.NoError(t, err)
+	assert.IsType(t, &pgproto3.RowDescription{}, msg)
+
+	// pipeline several queries, the error skips the rest until Sync
+	for _, id := range []string{"1", "2"} {
+		frontend.Send(&pgproto3.Bind{PreparedStatement: "by_id", Parameters: [][]byte{[]byte(id)}})
+		frontend.Send(&pgproto3.Execute{})
+	}
+	frontend.Send(&pgproto3.Sync{})
+	frontend.Send(&pgproto3.Bind{PreparedStatement: "missing"})
+	frontend.Send(&pgproto3.Execute{})
+	frontend.Send(&pgproto3.Sync{})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.BindComplete{},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("Hello")}},
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.BindComplete{},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("World")}},
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}, msgs)
+
+	msgs = receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 2)
+	assert.IsType(t, &pgproto3.ErrorResponse{}, msgs[0])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msgs[1])
+}
+
+func TestPortalSuspended(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, 'Hello'), (2, 'World');",
+	)
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local))
+
+	frontend.Send(&pgproto3.Parse{Query: "SELECT id FROM names ORDER BY id;"})
+	frontend.Send(&pgproto3.Bind{ResultFormatCodes: []int16{1}})
+	frontend.Send(&pgproto3.Execute{MaxRows: 1})
+	frontend.Send(&pgproto3.Execute{MaxRows: 1})
+	frontend.Send(&pgproto3.Sync{})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.ParseComplete{},
+		&pgproto3.BindComplete{},
+		&pgproto3.DataRow{Values: [][]byte{{0, 0, 0, 1}}},
+		&pgproto3.PortalSuspended{},
+		&pgproto3.DataRow{Values: [][]byte{{0, 0, 0, 2}}},
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 2")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	}, msgs)
+}
+
+func TestFunctionCall(t *testing.T) {
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, newLocal(t)))
+
+	// lo_open(oid, integer)
+	frontend.Send(&pgproto3.FunctionCall{
+		Function:       952,
+		ArgFormatCodes: []uint16{1},
+		Arguments:      [][]byte{{0, 0, 0x40, 0}, {0, 0x4, 0, 0}},
+	})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 2)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0])
+	assert.Equal(t, "0A000", msgs[0].(*pgproto3.ErrorResponse).Code)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msgs[1])
+
+	// the session is still usable after the error
+	frontend.Send(&pgproto3.Query{String: "SELECT 1;"})
+	require.NoError(t, frontend.Flush())
+
+	msgs = receiveUntilReady(t, frontend)
+	assert.Equal(t, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}, msgs[2])
+}
+
+func TestSetPassthroughSettings(t *testing.T) {
+	tests := []struct {
+		query string
+		tag   string
+	}{
+		{query: "SET statement_timeout = '5s';", tag: "SET"},
+		{query: "set session search_path to public, other", tag: "SET"},
+		{query: "SET search_path TO DEFAULT;", tag: "SET"},
+		{query: "RESET statement_timeout;", tag: "RESET"},
+		{query: "RESET ALL", tag: "RESET"},
+	}
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, newLocal(t)))
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			frontend.Send(&pgproto3.Query{String: test.query})
+			require.NoError(t, frontend.Flush())
+
+			msgs := receiveUntilReady(t, frontend)
+			assert.Equal(t, []pgproto3.BackendMessage{
+				&pgproto3.CommandComplete{CommandTag: []byte(test.tag)},
+				&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			}, msgs)
+		})
+	}
+
+	// other settings aren't passed through
+	frontend.Send(&pgproto3.Query{String: "SET work_mem = '64MB';"})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 2)
+	assert.IsType(t, &pgproto3.ErrorResponse{}, msgs[0])
+}
+
+func TestTransactionStatus(t *testing.T) {
+	tests := []struct {
+		query  string
+		tag    string
+		code   string
+		status byte
+	}{
+		{query: "BEGIN;", tag: "BEGIN", status: 'T'},
+		{query: "SELECT 1;", tag: "SELECT 1", status: 'T'},
+		{query: "LISTEN foo;", code: "XX000", status: 'E'},
+		{query: "SELECT 1;", code: "25P02", status: 'E'},
+		{query: "COMMIT;", tag: "ROLLBACK", status: 'I'},
+		{query: "START TRANSACTION;", tag: "BEGIN", status: 'T'},
+		{query: "ROLLBACK;", tag: "ROLLBACK", status: 'I'},
+	}
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, newLocal(t)))
+
+	for _, test := range tests {
+		frontend.Send(&pgproto3.Query{String: test.query})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+
+		if test.code != "" {
+			require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0], test.query)
+			assert.Equal(t, test.code, msgs[0].(*pgproto3.ErrorResponse).Code, test.query)
+		} else {
+			assert.Equal(t, &pgproto3.CommandComplete{CommandTag: []byte(test.tag)}, msgs[len(msgs)-2], test.query)
+		}
+
+		assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: test.status}, msgs[len(msgs)-1], test.query)
+	}
+}
+
+func TestIdleInTransactionTimeout(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{
+		Schema:                   "public",
+		IdleInTransactionTimeout: 50 * time.Millisecond,
+	}, nil, newLocal(t))
+
+	frontend := connect(t, server)
+
+	// idle outside a transaction is fine
+	<-time.After(100 * time.Millisecond)
+
+	frontend.Send(&pgproto3.Query{String: "BEGIN;"})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'T'}, msgs[len(msgs)-1])
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	assert.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+	assert.Equal(t, "25P03", msg.(*pgproto3.ErrorResponse).Code)
+
+	_, err = frontend.Receive()
+	assert.Error(t, err)
+}
+
+func TestSpool(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, 'Hello'), (2, NULL), (3, 'World');",
+	)
+
+	dir := t.TempDir()
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{
+		Schema:         "public",
+		SpoolThreshold: 1,
+		SpoolDir:       dir,
+	}, nil, local))
+
+	frontend.Send(&pgproto3.Query{String: "SELECT name FROM names ORDER BY id;"})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 6)
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("Hello")}}, msgs[1])
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{nil}}, msgs[2])
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("World")}}, msgs[3])
+	assert.Equal(t, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 3")}, msgs[4])
+
+	// the spool file is removed once the rows are sent
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSpoolBudget(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, ''), (2, 'Hello'), (3, NULL), (4, 'World');",
+	)
+
+	mem := budget.New(4)
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{
+		Schema:   "public",
+		SpoolDir: t.TempDir(),
+		Budget:   mem,
+	}, nil, local))
+
+	frontend.Send(&pgproto3.Query{String: "SELECT name FROM names ORDER BY id;"})
+	require.NoError(t, frontend.Flush())
+
+	var values [][]byte
+
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+
+		if row, ok := msg.(*pgproto3.DataRow); ok {
+			// empty values are kept apart from nulls
+			v := row.Values[0]
+			if v != nil {
+				v = append([]byte{}, v...)
+			}
+
+			values = append(values, v)
+		}
+
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+
+	// past the budget, the rows spilled to disk
+	assert.Equal(t, [][]byte{{}, []byte("Hello"), nil, []byte("World")}, values)
+	assert.Zero(t, mem.Used())
+}
+
+func TestSpoolBuffers(t *testing.T) {
+	var rows [][][]byte
+	for i := range 100 {
+		rows = append(rows, [][]byte{[]byte(fmt.Sprintf("row %d", i)), nil})
+	}
+
+	// past the budget the rows go to disk, without keeping their buffers
+	read, held, err := pgwire.SpoolRows(t.TempDir(), budget.New(20), rows)
+	require.NoError(t, err)
+	assert.Equal(t, rows, read)
+	assert.LessOrEqual(t, held, 4)
+}
+
+func TestVirtualTables(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, newLocal(t))
+	server.AddVirtualTable("sqledge_stat_test", pgwire.VirtualTable{
+		Columns: []pgwire.VirtualColumn{
+			{Name: "name", Type: sqlgen.SQLiteColTypeText},
+			{Name: "count", Type: sqlgen.SQLiteColTypeInteger},
+		},
+		Rows: func() [][]any {
+			return [][]any{{"a", 1}, {"b", 2}}
+		},
+	})
+
+	frontend := connect(t, server)
+
+	tests := []struct {
+		query string
+		want  []*pgproto3.DataRow
+	}{
+		{
+			query: "SELECT name FROM sqledge_stat_test WHERE count > 1;",
+			want:  []*pgproto3.DataRow{{Values: [][]byte{[]byte("b")}}},
+		},
+		{
+			query: "SELECT user, database FROM sqledge_stat_activity;",
+			want:  []*pgproto3.DataRow{{Values: [][]byte{[]byte("postgres"), []byte("test")}}},
+		},
+	}
+
+	for _, test := range tests {
+		frontend.Send(&pgproto3.Query{String: test.query})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		require.Len(t, msgs, len(test.want)+3, test.query)
+
+		for i, row := range test.want {
+			assert.Equal(t, row, msgs[i+1], test.query)
+		}
+	}
+}
+
+func TestListenerPolicy(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{
+		Schema: "public",
+		Authenticate: func(_ context.Context, user, password string) error {
+			if user == "postgres" && password == "secret" {
+				return nil
+			}
+
+			return errors.New("bad password")
+		},
+	}, nil, newLocal(t))
+
+	t.Run("read only", func(t *testing.T) {
+		frontend := startup(t, server, pgwire.Policy{ReadOnly: true})
+		receiveUntilReady(t, frontend)
+
+		frontend.Send(&pgproto3.Query{String: "INSERT INTO names VALUES (1, 'Hello');"})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0])
+		assert.Equal(t, "25006", msgs[0].(*pgproto3.ErrorResponse).Code)
+	})
+
+	t.Run("tls required", func(t *testing.T) {
+		frontend := startup(t, server, pgwire.Policy{RequireTLS: true})
+
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		assert.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+	})
+
+	for _, test := range []struct {
+		password string
+		ok       bool
+	}{
+		{password: "secret", ok: true},
+		{password: "wrong"},
+	} {
+		t.Run("upstream auth "+test.password, func(t *testing.T) {
+			frontend := startup(t, server, pgwire.Policy{Auth: pgwire.AuthUpstream})
+
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.AuthenticationCleartextPassword{}, msg)
+
+			frontend.Send(&pgproto3.PasswordMessage{Password: test.password})
+			require.NoError(t, frontend.Flush())
+
+			msg, err = frontend.Receive()
+			require.NoError(t, err)
+
+			if test.ok {
+				assert.IsType(t, &pgproto3.AuthenticationOk{}, msg)
+				return
+			}
+
+			require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+			assert.Equal(t, "28P01", msg.(*pgproto3.ErrorResponse).Code)
+		})
+	}
+}
+
+func TestUpstreamUnavailable(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{
+		Schema: "public",
+		UpstreamReady: func() error {
+			return errors.New("upstream unreachable: connection refused")
+		},
+	}, nil, newLocal(t))
+
+	frontend := startup(t, server, pgwire.Policy{})
+	receiveUntilReady(t, frontend)
+
+	frontend.Send(&pgproto3.Query{String: "INSERT INTO names VALUES (1, 'Hello');"})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0])
+	assert.Equal(t, "57P03", msgs[0].(*pgproto3.ErrorResponse).Code)
+
+	// reads are still served locally
+	frontend.Send(&pgproto3.Query{String: "SELECT 1;"})
+	require.NoError(t, frontend.Flush())
+
+	msgs = receiveUntilReady(t, frontend)
+	assert.IsType(t, &pgproto3.RowDescription{}, msgs[0])
+}
+
+func TestShadowReads(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{
+		Schema: "public",
+		UpstreamReady: func() error {
+			return errors.New("upstream unreachable: connection refused")
+		},
+		ShadowEvery: 2,
+	}, nil, newLocal(t))
+
+	frontend := connect(t, server)
+
+	// the shadowed read fails upstream, it's still served locally
+	for range 4 {
+		frontend.Send(&pgproto3.Query{String: "SELECT 1;"})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		assert.IsType(t, &pgproto3.RowDescription{}, msgs[0])
+	}
+
+	want := &pgproto3.DataRow{Values: [][]byte{[]byte("2"), []byte("2"), []byte("0")}}
+
+	assert.Eventually(t, func() bool {
+		frontend.Send(&pgproto3.Query{String: "SELECT shadowed, failed, mismatched FROM sqledge_stat_shadow;"})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+
+		return len(msgs) == 4 && assert.ObjectsAreEqual(want, msgs[1])
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDiffShadow(t *testing.T) {
+	// differences are described without the values, which aren't logged
+	assert.Empty(t, pgwire.DiffShadow([][]string{{"1", "a"}, {"2", "b"}}, [][]string{{"2", "b"}, {"1", "a"}}))
+	assert.Equal(t, "1 rows locally, 2 upstream", pgwire.DiffShadow([][]string{{"1", "a"}}, [][]string{{"1", "a"}, {"2", "b"}}))
+	assert.Equal(t, "sorted row 2 of 2 differs in column 2",
+		pgwire.DiffShadow([][]string{{"1", "a"}, {"2", "secret"}}, [][]string{{"1", "a"}, {"2", "b"}}))
+}
+
+func TestDDL(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{
+		Schema:   "public",
+		DDLAllow: []string{"CREATE TABLE", "CREATE INDEX", "DROP TABLE"},
+		DDLDeny:  []string{"DROP TABLE"},
+		// allowed statements are forwarded, and fail on the upstream
+		UpstreamReady: func() error {
+			return errors.New("upstream unreachable: connection refused")
+		},
+	}, nil, newLocal(t))
+
+	frontend := startup(t, server, pgwire.Policy{})
+	receiveUntilReady(t, frontend)
+
+	tests := []struct {
+		query string
+		code  string
+	}{
+		{query: "CREATE TABLE names (id int);", code: "57P03"},
+		{query: "create unique index names_id on names (id);", code: "57P03"},
+		{query: "DROP TABLE names;", code: "42501"},
+		{query: "GRANT SELECT ON names TO app;", code: "42501"},
+		{query: "TRUNCATE names;", code: "42501"},
+	}
+
+	for _, tt := range tests {
+		frontend.Send(&pgproto3.Query{String: tt.query})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0], tt.query)
+		assert.Equal(t, tt.code, msgs[0].(*pgproto3.ErrorResponse).Code, tt.query)
+	}
+}
+
+func TestSchemaChanged(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, 'Hello');",
+	)
+
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local)
+	frontend := connect(t, server)
+
+	prepare := func() {
+		frontend.Send(&pgproto3.Parse{Name: "all", Query: "SELECT * FROM names;"})
+		frontend.Send(&pgproto3.Describe{ObjectType: 'S', Name: "all"})
+		frontend.Send(&pgproto3.Sync{})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		require.Len(t, msgs, 4)
+		require.IsType(t, &pgproto3.RowDescription{}, msgs[2])
+	}
+
+	execute := func() []pgproto3.BackendMessage {
+		frontend.Send(&pgproto3.Bind{PreparedStatement: "all"})
+		frontend.Send(&pgproto3.Execute{})
+		frontend.Send(&pgproto3.Sync{})
+		require.NoError(t, frontend.Flush())
+
+		return receiveUntilReady(t, frontend)
+	}
+
+	prepare()
+
+	_, err := local.Exec("ALTER TABLE names ADD COLUMN score real;")
+	require.NoError(t, err)
+	server.SchemaChanged("names")
+
+	// the client's description of the statement is stale
+	msgs := execute()
+	require.Len(t, msgs, 3)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msgs[1])
+	assert.Equal(t, "0A000", msgs[1].(*pgproto3.ErrorResponse).Code)
+
+	// until it prepares the statement again
+	prepare()
+
+	msgs = execute()
+	require.Len(t, msgs, 4)
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("1"), []byte("Hello"), nil}}, msgs[1])
+}
+
+func TestCatalogPassthrough(t *testing.T) {
+	tests := []struct {
+		passthrough bool
+		query       string
+		code        string
+	}{
+		// catalog reads go to the upstream, which is unreachable
+		{passthrough: true, query: "SELECT relname FROM pg_catalog.pg_class;", code: "57P03"},
+		{passthrough: true, query: "select table_name from information_schema.tables;", code: "57P03"},
+		{passthrough: true, query: "SELECT typname FROM pg_type WHERE oid = 23;", code: "57P03"},
+		// without passthrough they fail on the local database
+		{passthrough: false, query: "SELECT relname FROM pg_catalog.pg_class;", code: "XX000"},
+	}
+
+	for _, tt := range tests {
+		server := pgwire.NewServer(pgwire.Config{
+			Schema:             "public",
+			CatalogPassthrough: tt.passthrough,
+			CatalogCacheTTL:    time.Minute,
+			UpstreamReady: func() error {
+				return errors.New("upstream unreachable: connection refused")
+			},
+		}, nil, newLocal(t, "CREATE TABLE pg_names (id INTEGER);"))
+
+		frontend := connect(t, server)
+
+		frontend.Send(&pgproto3.Query{String: tt.query})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0], tt.query)
+		assert.Equal(t, tt.code, msgs[0].(*pgproto3.ErrorResponse).Code, tt.query)
+
+		// other reads are still served locally
+		frontend.Send(&pgproto3.Query{String: "SELECT id FROM pg_names;"})
+		require.NoError(t, frontend.Flush())
+
+		msgs = receiveUntilReady(t, frontend)
+		assert.IsType(t, &pgproto3.RowDescription{}, msgs[0], tt.query)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id INTEGER PRIMARY KEY, name TEXT);",
+		"CREATE INDEX names_name ON names (name);",
+		"INSERT INTO names VALUES (1, 'Hello');",
+	)
+
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local)
+
+	// read-only listeners don't forward, so the statements only apply locally
+	frontend := startup(t, server, pgwire.Policy{ReadOnly: true})
+	receiveUntilReady(t, frontend)
+
+	for _, tt := range []struct {
+		query string
+		tag   string
+	}{
+		{query: "VACUUM;", tag: "VACUUM"},
+		{query: "vacuum (verbose, analyze) names;", tag: "VACUUM"},
+		{query: "ANALYZE names;", tag: "ANALYZE"},
+		{query: "REINDEX TABLE names;", tag: "REINDEX"},
+	} {
+		frontend.Send(&pgproto3.Query{String: tt.query})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		assert.Equal(t, &pgproto3.CommandComplete{CommandTag: []byte(tt.tag)}, msgs[0], tt.query)
+	}
+
+	var n int
+	require.NoError(t, local.QueryRow("SELECT count(*) FROM sqlite_stat1 WHERE tbl = 'names';").Scan(&n))
+	assert.Equal(t, 1, n)
+}
+
+func TestReadRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "local.db")
+
+	// without a busy timeout, reads fail while the lock is held
+	local, err := sql.Open("sqlite3", path+"?_busy_timeout=0")
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+
+	_, err = local.Exec("CREATE TABLE names (id integer, name text); INSERT INTO names VALUES (1, 'Hello');")
+	require.NoError(t, err)
+
+	writer, err := local.Conn(context.Background())
+	require.NoError(t, err)
+
+	_, err = writer.ExecContext(context.Background(), "BEGIN EXCLUSIVE")
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writer.ExecContext(context.Background(), "COMMIT")
+		writer.Close()
+	}()
+
+	server := pgwire.NewServer(pgwire.Config{
+		Schema:           "public",
+		ReadRetries:      5,
+		ReadRetryBackoff: 20 * time.Millisecond,
+	}, nil, local)
+
+	frontend := connect(t, server)
+
+	frontend.Send(&pgproto3.Query{String: "SELECT name FROM names;"})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.IsType(t, &pgproto3.RowDescription{}, msgs[0])
+	assert.Equal(t, []byte("Hello"), msgs[1].(*pgproto3.DataRow).Values[0])
+}
+
+func TestTenants(t *testing.T) {
+	tenants := map[string]*sql.DB{
+		"acme": newLocal(t, "CREATE TABLE names (id integer, name text);", "INSERT INTO names VALUES (1, 'acme');"),
+	}
+
+	server := pgwire.NewServer(pgwire.Config{
+		Schema: "public",
+		Tenant: func(name string) (*sql.DB, error) {
+			if db, ok := tenants[name]; ok {
+				return db, nil
+			}
+
+			return nil, fmt.Errorf("unknown tenant %q", name)
+		},
+	}, nil, newLocal(t, "CREATE TABLE names (id integer, name text);", "INSERT INTO names VALUES (1, 'main');"))
+
+	frontend := connect(t, server)
+
+	for _, test := range []struct {
+		query string
+		code  string
+		name  string
+	}{
+		{query: "SELECT name FROM names;", name: "main"},
+		{query: "SET sqledge.tenant = 'acme';"},
+		{query: "SELECT name FROM names;", name: "acme"},
+		{query: "SET sqledge.tenant TO 'globex';", code: "3D000"},
+		{query: "SELECT name FROM names;", name: "acme"},
+		{query: "RESET sqledge.tenant;"},
+		{query: "SELECT name FROM names;", name: "main"},
+	} {
+		frontend.Send(&pgproto3.Query{String: test.query})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+
+		switch {
+		case test.code != "":
+			require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0], test.query)
+			assert.Equal(t, test.code, msgs[0].(*pgproto3.ErrorResponse).Code)
+		case test.name != "":
+			require.IsType(t, &pgproto3.DataRow{}, msgs[1], test.query)
+			assert.Equal(t, test.name, string(msgs[1].(*pgproto3.DataRow).Values[0]))
+		default:
+			assert.IsType(t, &pgproto3.CommandComplete{}, msgs[0], test.query)
+		}
+	}
+}
+
+func TestCatalogKey(t *testing.T) {
+	const query = "SELECT relname FROM pg_catalog.pg_class"
+
+	key := pgwire.CatalogKey("app", "db", map[string]string{"search_path": "SET search_path TO app"}, query)
+
+	assert.Equal(t, key, pgwire.CatalogKey("app", "db", map[string]string{"search_path": "SET search_path TO app"}, query))
+	assert.NotEqual(t, key, pgwire.CatalogKey("admin", "db", map[string]string{"search_path": "SET search_path TO app"}, query))
+	assert.NotEqual(t, key, pgwire.CatalogKey("app", "other", map[string]string{"search_path": "SET search_path TO app"}, query))
+	assert.NotEqual(t, key, pgwire.CatalogKey("app", "db", nil, query))
+}
+
+func TestRead(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text, score real);",
+		"INSERT INTO names VALUES (1, 'Hello', 1.5), (2, NULL, 2);",
+	)
+
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local)
+
+	res, err := server.Read(context.Background(), "", "SELECT id, name, score FROM names WHERE id >= $1 ORDER BY id", []any{int64(1)})
+	require.NoError(t, err)
+
+	assert.Equal(t, &pgwire.ReadResult{
+		Columns: []string{"id", "name", "score"},
+		Types:   []uint32{23, 25, 700},
+		Rows: [][]any{
+			{json.Number("1"), "Hello", json.Number("1.5")},
+			{json.Number("2"), nil, json.Number("2")},
+		},
+	}, res)
+
+	_, err = server.Read(context.Background(), "", "DELETE FROM names", nil)
+	assert.ErrorIs(t, err, pgwire.ErrNotRead)
+}
+
+func TestReadRows(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, 'Hello'), (2, 'World');",
+	)
+
+	// the rows are spooled to a file, and read back one at a time
+	server := pgwire.NewServer(pgwire.Config{Schema: "public", SpoolThreshold: 1, SpoolDir: t.TempDir()}, nil, local)
+
+	rows, err := server.ReadRows(context.Background(), "", "SELECT id, name FROM names ORDER BY id", nil)
+	require.NoError(t, err)
+	t.Cleanup(rows.Close)
+
+	assert.Equal(t, []string{"id", "name"}, rows.Columns)
+
+	for _, want := range [][]any{{json.Number("1"), "Hello"}, {json.Number("2"), "World"}} {
+		row, err := rows.Next()
+		require.NoError(t, err)
+		assert.Equal(t, want, row)
+	}
+
+	_, err = rows.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestParam(t *testing.T) {
+	assert.Equal(t, int64(2), pgwire.Param(json.Number("2")))
+	assert.Equal(t, 2.5, pgwire.Param(json.Number("2.5")))
+	assert.Equal(t, int64(2), pgwire.Param(2.0))
+	assert.Equal(t, 2.5, pgwire.Param(2.5))
+	assert.Equal(t, "2", pgwire.Param("2"))
+}
+
+func TestReadFirewall(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE events (id integer primary key, kind text);",
+		"INSERT INTO events VALUES (1, 'a'), (2, 'b'), (3, 'c');",
+	)
+
+	server := pgwire.NewServer(pgwire.Config{
+		Schema: "public",
+		Firewall: pgwire.ReadFirewall{
+			MaxJoins:      1,
+			DenyFunctions: []string{"randomblob"},
+			LimitTables:   []string{"events"},
+			LimitRows:     2,
+		},
+	}, nil, local)
+
+	read := func(query string) (*pgwire.ReadResult, error) {
+		return server.Read(context.Background(), "", query, nil)
+	}
+
+	res, err := read("SELECT id FROM events ORDER BY id DESC;")
+	require.NoError(t, err)
+	assert.Equal(t, [][]any{{json.Number("3")}, {json.Number("2")}}, res.Rows)
+
+	// a LIMIT of the read's own, even above LimitRows, is kept
+	res, err = read("SELECT id FROM events ORDER BY id LIMIT 3")
+	require.NoError(t, err)
+	assert.Len(t, res.Rows, 3)
+
+	// a LIMIT in a subquery doesn't bound the read
+	res, err = read("SELECT a.id FROM events a WHERE a.id IN (SELECT id FROM events LIMIT 3)")
+	require.NoError(t, err)
+	assert.Len(t, res.Rows, 2)
+
+	_, err = read("SELECT a.id FROM events a JOIN events b ON a.id = b.id LIMIT 1")
+	assert.NoError(t, err)
+
+	_, err = read("SELECT a.id FROM events a JOIN events b ON a.id = b.id JOIN events c ON b.id = c.id LIMIT 1")
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "54001", pgErr.Code)
+
+	// tables listed in a FROM are joins too
+	_, err = read("SELECT a.id FROM events a, events b LIMIT 1")
+	assert.NoError(t, err)
+
+	_, err = read("SELECT a.id FROM events a, (SELECT id FROM events) b, events c LIMIT 1")
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "54001", pgErr.Code)
+
+	_, err = read("SELECT a.id FROM events a WHERE a.id IN (SELECT b.id FROM events b, events c JOIN events d ON c.id = d.id)")
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "54001", pgErr.Code)
+
+	// unlike the select list, function arguments and the ORDER BY
+	_, err = read("SELECT a.id, max(a.kind, b.kind) FROM events a JOIN events b ON a.id = b.id ORDER BY a.id, b.id LIMIT 1")
+	assert.NoError(t, err)
+
+	for _, query := range []string{
+		"SELECT RandomBlob (1000000000) FROM events LIMIT 1",
+		`SELECT "randomblob"(1000000000) FROM events LIMIT 1`,
+		"SELECT `RANDOMBLOB`(1000000000) FROM events LIMIT 1",
+		"SELECT [randomblob](1000000000) FROM events LIMIT 1",
+	} {
+		_, err = read(query)
+		require.ErrorAs(t, err, &pgErr, query)
+		assert.Equal(t, "42501", pgErr.Code, query)
+	}
+
+	// keywords and names in literals and comments don't count
+	res, err = read("SELECT 'join join randomblob(1)' -- from events join\n")
+	require.NoError(t, err)
+	assert.Equal(t, [][]any{{"join join randomblob(1)"}}, res.Rows)
+}
+
+func TestWriteBatch(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{
+		Schema:         "public",
+		WriteBatchSize: 10,
+		UpstreamReady: func() error {
+			return errors.New("upstream unreachable: connection refused")
+		},
+	}, nil, newLocal(t))
+
+	frontend := startup(t, server, pgwire.Policy{})
+	receiveUntilReady(t, frontend)
+
+	// the inserts are held until Sync, the batch fails on the first
+	// and the responses after it are dropped.
+	frontend.Send(&pgproto3.Parse{Name: "insert", Query: "INSERT INTO names VALUES ($1, $2);"})
+	for _, id := range []string{"1", "2"} {
+		frontend.Send(&pgproto3.Bind{PreparedStatement: "insert", Parameters: [][]byte{[]byte(id), []byte("hello")}})
+		frontend.Send(&pgproto3.Execute{})
+	}
+	frontend.Send(&pgproto3.Sync{})
+	require.NoError(t, frontend.Flush())
+
+	msgs := receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 4)
+	assert.IsType(t, &pgproto3.ParseComplete{}, msgs[0])
+	assert.IsType(t, &pgproto3.BindComplete{}, msgs[1])
+	require.IsType(t, &pgproto3.ErrorResponse{}, msgs[2])
+	assert.Equal(t, "57P03", msgs[2].(*pgproto3.ErrorResponse).Code)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msgs[3])
+
+	// a statement that isn't an INSERT runs the batch first, and is
+	// skipped after its error
+	frontend.Send(&pgproto3.Bind{PreparedStatement: "insert", Parameters: [][]byte{[]byte("3"), []byte("world")}})
+	frontend.Send(&pgproto3.Execute{})
+	frontend.Send(&pgproto3.Parse{Query: "SELECT 1;"})
+	frontend.Send(&pgproto3.Bind{})
+	frontend.Send(&pgproto3.Execute{})
+	frontend.Send(&pgproto3.Sync{})
+	require.NoError(t, frontend.Flush())
+
+	msgs = receiveUntilReady(t, frontend)
+	require.Len(t, msgs, 3)
+	assert.IsType(t, &pgproto3.BindComplete{}, msgs[0])
+	assert.IsType(t, &pgproto3.ErrorResponse{}, msgs[1])
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msgs[2])
+}
+
+func TestRouteCold(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"CREATE TABLE orders (id integer primary key);",
+		"INSERT INTO orders VALUES (1);",
+	)
+
+	server := pgwire.NewServer(pgwire.Config{
+		Schema: "public",
+		UpstreamReady: func() error {
+			return errors.New("upstream unreachable: connection refused")
+		},
+	}, nil, local)
+
+	// names is still being copied
+	server.RouteCold(func(table string) bool { return table == "names" })
+
+	frontend := startup(t, server, pgwire.Policy{})
+	receiveUntilReady(t, frontend)
+
+	tests := []struct {
+		query string
+		code  string
+	}{
+		{query: "SELECT name FROM names;", code: "57P03"},
+		{query: `SELECT o.id FROM orders o JOIN public."names" n ON n.id = o.id;`, code: "57P03"},
+		{query: "SELECT id FROM orders;"},
+	}
+
+	for _, tt := range tests {
+		frontend.Send(&pgproto3.Query{String: tt.query})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+
+		if tt.code == "" {
+			assert.IsType(t, &pgproto3.RowDescription{}, msgs[0], tt.query)
+			continue
+		}
+
+		require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0], tt.query)
+		assert.Equal(t, tt.code, msgs[0].(*pgproto3.ErrorResponse).Code, tt.query)
+	}
+}
+
+func TestHoldReads(t *testing.T) {
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+	))
+
+	var caughtUp atomic.Bool
+
+	server.HoldReads(caughtUp.Load)
+
+	frontend := startup(t, server, pgwire.Policy{})
+	receiveUntilReady(t, frontend)
+
+	read := func() pgproto3.BackendMessage {
+		frontend.Send(&pgproto3.Query{String: "SELECT name FROM names;"})
+		require.NoError(t, frontend.Flush())
+
+		return receiveUntilReady(t, frontend)[0]
+	}
+
+	msg := read()
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	assert.Equal(t, "57P03", msg.(*pgproto3.ErrorResponse).Code)
+
+	caughtUp.Store(true)
+	assert.IsType(t, &pgproto3.RowDescription{}, read())
+
+	// held only until startup caught up
+	caughtUp.Store(false)
+	assert.IsType(t, &pgproto3.RowDescription{}, read())
+}
+
+func TestFillKeys(t *testing.T) {
+	defaults := []keys.Default{{Table: "orders", Column: "id", Kind: keys.KindULID}}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: "INSERT INTO orders (name, qty) VALUES ('a, (b)', 1), ($1, $2) RETURNING id;",
+			want:  `INSERT INTO orders (name, qty, "id") VALUES ('a, (b)', 1, '01HWT0D7G00000000000000000'), ($1, $2, '01HWT0D7G00000000000000000') RETURNING id;`,
+		},
+		{
+			query: `insert into public."orders" (name) values ('a')`,
+			want:  `insert into public."orders" (name, "id") values ('a', '01HWT0D7G00000000000000000')`,
+		},
+		// the key is given, another table or schema, or no column list
+		{query: "INSERT INTO orders (id, name) VALUES ('1', 'a')", want: "INSERT INTO orders (id, name) VALUES ('1', 'a')"},
+		{query: "INSERT INTO names (name) VALUES ('a')", want: "INSERT INTO names (name) VALUES ('a')"},
+		{query: "INSERT INTO other.orders (name) VALUES ('a')", want: "INSERT INTO other.orders (name) VALUES ('a')"},
+		{query: "INSERT INTO orders SELECT * FROM staged", want: "INSERT INTO orders SELECT * FROM staged"},
+	}
+
+	for _, tt := range tests {
+		// a fixed clock and random source generate the same keys every run
+		ids := keys.NewGenerator(clock.NewManual(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)), bytes.NewReader(make([]byte, 100)))
+
+		assert.Equal(t, tt.want, pgwire.FillKeys(tt.query, "public", defaults, ids), tt.query)
+	}
+}
+
+// frame encodes a message with the length in its header.
+func frame(typ byte, length int32, body ...byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(length))
+	if typ != 0 {
+		b = append([]byte{typ}, b...)
+	}
+
+	return append(b, body...)
+}
+
+func TestMalformedMessages(t *testing.T) {
+	startupMsg := (&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	}).Encode(nil)
+
+	tests := []struct {
+		name string
+		// startup is false for the messages sent after startup
+		startup bool
+		data    []byte
+	}{
+		{name: "startup length too short", startup: true, data: frame(0, 3)},
+		{name: "startup length too long", startup: true, data: frame(0, 1<<20)},
+		{name: "unknown startup code", startup: true, data: frame(0, 8, 0, 0, 4, 210)},
+		{name: "negative length", data: frame('Q', -1)},
+		{name: "length shorter than the header", data: frame('Q', 3)},
+		{name: "query over the limit", data: frame('Q', 1<<20)},
+		{name: "sync over the limit", data: frame('S', 20000)},
+		{name: "unknown message type", data: frame('z', 4)},
+		{name: "truncated bind", data: frame('B', 8, 0, 0, 0xff, 0xff)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := pgwire.NewServer(pgwire.Config{Schema: "public", MaxMessageBytes: 1024}, nil, newLocal(t))
+
+			client, conn := net.Pipe()
+			t.Cleanup(func() { client.Close() })
+
+			go server.HandlePolicy(conn, pgwire.Policy{})
+
+			frontend := pgproto3.NewFrontend(client, client)
+
+			if !tt.startup {
+				_, err := client.Write(startupMsg)
+				require.NoError(t, err)
+				receiveUntilReady(t, frontend)
+			}
+
+			_, err := client.Write(tt.data)
+			require.NoError(t, err)
+
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+			assert.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+			assert.Equal(t, "08P01", msg.(*pgproto3.ErrorResponse).Code)
+
+			// the session is closed
+			_, err = frontend.Receive()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func FuzzMessages(f *testing.F) {
+	startupMsg := (&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	}).Encode(nil)
+
+	f.Add(startupMsg)
+	f.Add(frame(0, 3))
+	f.Add(frame(0, 100, 0, 3, 0, 0))
+	f.Add(append(startupMsg, (&pgproto3.Query{String: "SELECT 1"}).Encode(nil)...))
+	f.Add(append(startupMsg, frame('Q', -1)...))
+	f.Add(append(startupMsg, frame('B', 8, 0, 0, 0xff, 0xff)...))
+	f.Add(append(startupMsg, frame('P', 12, 0, 'x', 0, 0, 0, 2, 0, 0)...))
+
+	server := pgwire.NewServer(pgwire.Config{
+		Schema:          "public",
+		MaxMessageBytes: 1 << 16,
+		UpstreamReady: func() error {
+			return errors.New("upstream unreachable")
+		},
+	}, nil, newLocal(f))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, conn := net.Pipe()
+
+		done := make(chan struct{})
+
+		go func() {
+			server.HandlePolicy(conn, pgwire.Policy{})
+			close(done)
+		}()
+
+		go io.Copy(io.Discard, client)
+
+		// a session that stops reading fails the write
+		client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		client.Write(data)
+		client.Close()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the session didn't end")
+		}
+	})
+}
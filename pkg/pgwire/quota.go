@@ -0,0 +1,251 @@
+package pgwire
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Quota limits the queries and bytes a user reads from the local database
+// in each period, from one table or every table. A quota for all users
+// gives each user a quota of their own.
+type Quota struct {
+	// Throttle holds reads past the quota until the next period,
+	// instead of rejecting them.
+	Throttle bool
+	// User and Table are "all" to match any.
+	User  string
+	Table string
+	// Queries and Bytes are the most served in a period, zero
+	// doesn't limit them.
+	Queries int64
+	Bytes   int64
+	Period  time.Duration
+}
+
+// ParseQuota parses a quota of the form:
+//
+//	reject|throttle <user|all> <table|all> <queries> <bytes> <period>
+//
+// e.g. "throttle app events 1000 10485760 1m".
+func ParseQuota(quota string) (Quota, error) {
+	fields := strings.Fields(quota)
+	if len(fields) != 6 {
+		return Quota{}, fmt.Errorf("quota %q: want 6 fields, got %d", quota, len(fields))
+	}
+
+	var (
+		q   Quota
+		err error
+	)
+
+	switch fields[0] {
+	case "throttle":
+		q.Throttle = true
+	case "reject":
+	default:
+		return Quota{}, fmt.Errorf("quota %q: unknown action %q", quota, fields[0])
+	}
+
+	q.User, q.Table = fields[1], fields[2]
+
+	if q.Queries, err = strconv.ParseInt(fields[3], 10, 64); err != nil || q.Queries < 0 {
+		return Quota{}, fmt.Errorf("quota %q: bad queries %q", quota, fields[3])
+	}
+
+	if q.Bytes, err = strconv.ParseInt(fields[4], 10, 64); err != nil || q.Bytes < 0 {
+		return Quota{}, fmt.Errorf("quota %q: bad bytes %q", quota, fields[4])
+	}
+
+	if q.Period, err = time.ParseDuration(fields[5]); err != nil || q.Period <= 0 {
+		return Quota{}, fmt.Errorf("quota %q: bad period %q", quota, fields[5])
+	}
+
+	return q, nil
+}
+
+// matches reports whether the quota applies to the user's read.
+func (q Quota) matches(user, query string) bool {
+	if q.User != "all" && q.User != user {
+		return false
+	}
+
+	if q.Table == "all" {
+		return true
+	}
+
+	// as with cold tables, every identifier in the read is checked
+	for _, token := range identifierToken.FindAllString(query, -1) {
+		if identifier(token) == identifier(q.Table) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// quotas tracks the usage of each quota, by user.
+type quotas struct {
+	rules []Quota
+	clock clock.Clock
+
+	mu    sync.Mutex
+	usage map[quotaKey]*quotaUsage
+}
+
+type quotaKey struct {
+	rule int
+	user string
+}
+
+type quotaUsage struct {
+	start   time.Time
+	queries int64
+	bytes   int64
+}
+
+func newQuotas(rules []Quota, c clock.Clock) *quotas {
+	return &quotas{rules: rules, clock: c, usage: make(map[quotaKey]*quotaUsage)}
+}
+
+// admit counts the read against the user's quotas, rejecting it or
+// waiting for the next period when one is used up. The keys of the
+// matching quotas are returned, to record the bytes served with.
+func (qs *quotas) admit(ctx context.Context, user, query string) ([]quotaKey, error) {
+	if len(qs.rules) == 0 {
+		return nil, nil
+	}
+
+	var keys []quotaKey
+
+	for i, q := range qs.rules {
+		if q.matches(user, query) {
+			keys = append(keys, quotaKey{rule: i, user: user})
+		}
+	}
+
+	for {
+		wait, err := qs.take(keys)
+		if err != nil || wait == 0 {
+			return keys, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// take counts a query against the quotas, or returns how long to wait
+// for a throttled quota's next period.
+func (qs *quotas) take(keys []quotaKey) (time.Duration, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	now := qs.clock.Now()
+
+	for _, key := range keys {
+		q, u := qs.rules[key.rule], qs.current(key, now)
+
+		if (q.Queries == 0 || u.queries < q.Queries) && (q.Bytes == 0 || u.bytes < q.Bytes) {
+			continue
+		}
+
+		if q.Throttle {
+			return u.start.Add(q.Period).Sub(now), nil
+		}
+
+		return 0, &pgconn.PgError{
+			Severity: "ERROR",
+			Code:     "53400",
+			Message:  fmt.Sprintf("quota of user %s on %s used up until %s", key.user, q.Table, u.start.Add(q.Period).Format(time.RFC3339)),
+		}
+	}
+
+	for _, key := range keys {
+		qs.usage[key].queries++
+	}
+
+	return 0, nil
+}
+
+// current returns the usage of the quota's period at now.
+func (qs *quotas) current(key quotaKey, now time.Time) *quotaUsage {
+	u, ok := qs.usage[key]
+	if !ok || !now.Before(u.start.Add(qs.rules[key.rule].Period)) {
+		u = &quotaUsage{start: now}
+		qs.usage[key] = u
+	}
+
+	return u
+}
+
+// served records the bytes of a read admitted with the keys.
+func (qs *quotas) served(keys []quotaKey, n int64) {
+	if len(keys) == 0 {
+		return
+	}
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	for _, key := range keys {
+		if u, ok := qs.usage[key]; ok {
+			u.bytes += n
+		}
+	}
+}
+
+// statQuotas lists the usage of the quotas in their current periods.
+func (s *Server) statQuotas() VirtualTable {
+	return VirtualTable{
+		Columns: []VirtualColumn{
+			{Name: "user", Type: sqlgen.SQLiteColTypeText},
+			{Name: "table_name", Type: sqlgen.SQLiteColTypeText},
+			{Name: "queries", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "max_queries", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "bytes", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "max_bytes", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "period_start", Type: sqlgen.SQLiteColTypeText},
+		},
+		Rows: func() [][]any {
+			qs := s.quotas
+
+			qs.mu.Lock()
+			defer qs.mu.Unlock()
+
+			keys := make([]quotaKey, 0, len(qs.usage))
+			for key := range qs.usage {
+				keys = append(keys, key)
+			}
+
+			sort.Slice(keys, func(i, j int) bool {
+				if keys[i].rule != keys[j].rule {
+					return keys[i].rule < keys[j].rule
+				}
+
+				return keys[i].user < keys[j].user
+			})
+
+			var rows [][]any
+
+			for _, key := range keys {
+				q, u := qs.rules[key.rule], qs.usage[key]
+
+				rows = append(rows, []any{key.user, q.Table, u.queries, q.Queries, u.bytes, q.Bytes, u.start.Format(time.RFC3339)})
+			}
+
+			return rows
+		},
+	}
+}
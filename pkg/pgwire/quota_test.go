@@ -0,0 +1,104 @@
+package pgwire_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuota(t *testing.T) {
+	tests := []struct {
+		quota string
+		err   bool
+	}{
+		{quota: "throttle app events 1000 10485760 1m"},
+		{quota: "reject all all 0 1024 1h"},
+		{quota: "reject all all 10 0", err: true},
+		{quota: "limit all all 10 0 1m", err: true},
+		{quota: "reject all all -1 0 1m", err: true},
+		{quota: "reject all all 10 0 0s", err: true},
+	}
+
+	for _, test := range tests {
+		_, err := pgwire.ParseQuota(test.quota)
+		if test.err {
+			assert.Error(t, err, test.quota)
+		} else {
+			assert.NoError(t, err, test.quota)
+		}
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	local := newLocal(t,
+		"CREATE TABLE names (id integer primary key, name text);",
+		"INSERT INTO names VALUES (1, 'Hello'), (2, 'World');",
+	)
+
+	now := clock.NewManual(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{
+		Schema: "public",
+		Clock:  now,
+		Quotas: []pgwire.Quota{
+			{User: "postgres", Table: "names", Queries: 2, Period: time.Minute},
+			{User: "all", Table: "all", Bytes: 1 << 20, Period: time.Hour},
+		},
+	}, nil, local))
+
+	query := func(sql string) []pgproto3.BackendMessage {
+		frontend.Send(&pgproto3.Query{String: sql})
+		require.NoError(t, frontend.Flush())
+
+		return receiveUntilReady(t, frontend)
+	}
+
+	for i := 0; i < 2; i++ {
+		msgs := query("SELECT name FROM names ORDER BY id;")
+		require.Len(t, msgs, 5)
+	}
+
+	msgs := query("SELECT name FROM names ORDER BY id;")
+	require.Len(t, msgs, 2)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msgs[0])
+	assert.Equal(t, "53400", msgs[0].(*pgproto3.ErrorResponse).Code)
+
+	// reads of other tables aren't limited by the names quota
+	msgs = query("SELECT 1;")
+	require.Len(t, msgs, 4)
+
+	now.Advance(time.Minute)
+
+	msgs = query("SELECT name FROM names ORDER BY id;")
+	require.Len(t, msgs, 5)
+
+	msgs = query("SELECT user, table_name, queries, bytes FROM sqledge_stat_quotas;")
+	require.Len(t, msgs, 5)
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("postgres"), []byte("names"), []byte("1"), []byte("10")}}, msgs[1])
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("postgres"), []byte("all"), []byte("4"), []byte("31")}}, msgs[2])
+}
+
+func TestQuotaThrottle(t *testing.T) {
+	frontend := connect(t, pgwire.NewServer(pgwire.Config{
+		Schema: "public",
+		Quotas: []pgwire.Quota{{Throttle: true, User: "all", Table: "all", Queries: 1, Period: 200 * time.Millisecond}},
+	}, nil, newLocal(t)))
+
+	start := time.Now()
+
+	for i := 0; i < 2; i++ {
+		frontend.Send(&pgproto3.Query{String: "SELECT 1;"})
+		require.NoError(t, frontend.Flush())
+
+		msgs := receiveUntilReady(t, frontend)
+		require.Len(t, msgs, 4)
+	}
+
+	// the second read waited for the next period
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
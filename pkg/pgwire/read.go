@@ -0,0 +1,171 @@
+package pgwire
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ErrNotRead is returned by Read for statements that aren't reads.
+var ErrNotRead = errors.New("only reads are served from the local database")
+
+// Reader serves reads from the local database, see Server.Read. The
+// HTTP, GraphQL, live query and Flight SQL APIs read through it.
+type Reader interface {
+	Read(ctx context.Context, tenant, query string, args []any) (*ReadResult, error)
+	ReadRows(ctx context.Context, tenant, query string, args []any) (*Rows, error)
+}
+
+// ReadResult is the result of a read, with the values in
+// postgres' text format and numbers as JSON numbers.
+type ReadResult struct {
+	Columns []string `json:"columns"`
+	// Types are the postgres type OIDs of the columns.
+	Types []uint32 `json:"-"`
+	Rows  [][]any  `json:"rows"`
+}
+
+// Read runs a read on the local database outside of a session, for the
+// tenant's database when tenant is set. It's served like a session's
+// reads, including the virtual tables.
+func (s *Server) Read(ctx context.Context, tenant, query string, args []any) (*ReadResult, error) {
+	rows, err := s.ReadRows(ctx, tenant, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := &ReadResult{Columns: rows.Columns, Types: rows.Types, Rows: [][]any{}}
+
+	for {
+		values, err := rows.Next()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		out.Rows = append(out.Rows, values)
+	}
+}
+
+// Rows are the rows of a read, see ReadRows. They're read back one
+// at a time from the spool, which is released by Close.
+type Rows struct {
+	Columns []string
+	// Types are the postgres type OIDs of the columns.
+	Types []uint32
+	res   *result
+}
+
+// ReadRows runs a read like Read, but returns its rows to be read one at
+// a time, so large results aren't held in memory as values.
+func (s *Server) ReadRows(ctx context.Context, tenant, query string, args []any) (*Rows, error) {
+	if !IsRead(strings.TrimSpace(query)) {
+		return nil, ErrNotRead
+	}
+
+	var (
+		res *result
+		err error
+	)
+
+	if names := s.virtualTables(strings.ToLower(query)); len(names) > 0 {
+		res, err = s.queryVirtual(query, args, names)
+	} else {
+		local, dbErr := s.tenantDB(tenant)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+
+		res, err = s.readLocal(ctx, local, query, args)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &Rows{
+		Columns: make([]string, len(res.desc.Fields)),
+		Types:   make([]uint32, len(res.desc.Fields)),
+		res:     res,
+	}
+
+	for i, f := range res.desc.Fields {
+		rows.Columns[i] = string(f.Name)
+		rows.Types[i] = f.DataTypeOID
+	}
+
+	return rows, nil
+}
+
+// Next returns the values of the next row, as in ReadResult,
+// and io.EOF after the last row.
+func (r *Rows) Next() ([]any, error) {
+	row, err := r.res.rows.next()
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read rows: %w", err)
+	}
+
+	values := make([]any, len(row))
+
+	for i, v := range row {
+		values[i] = jsonValue(r.Types[i], v)
+	}
+
+	return values, nil
+}
+
+// Close releases the rows left.
+func (r *Rows) Close() {
+	r.res.rows.close()
+}
+
+// Param converts a number decoded from JSON, a json.Number or a float64,
+// to an int64 when it's an integer, so it compares equal to sqlite's
+// integers. Other json.Numbers are converted to a float64, and other
+// values are returned unchanged.
+func Param(v any) any {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+
+		f, _ := n.Float64()
+
+		return f
+	case float64:
+		if n == float64(int64(n)) {
+			return int64(n)
+		}
+	}
+
+	return v
+}
+
+func jsonValue(oid uint32, v []byte) any {
+	if v == nil {
+		return nil
+	}
+
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		if json.Valid(v) {
+			return json.Number(v)
+		}
+	}
+
+	return string(v)
+}
@@ -0,0 +1,50 @@
+package pgwire
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+)
+
+// retryable reports whether a failed local read can be retried, the
+// applier holding the write lock or changing a table's schema
+// fails reads that succeed moments later.
+func retryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrSchema:
+		return true
+	}
+
+	return false
+}
+
+// retryRead runs the read, retrying it up to ReadRetries times with a
+// doubling backoff when it fails with a retryable error.
+func (s *Server) retryRead(ctx context.Context, read func() (*result, error)) (*result, error) {
+	backoff := s.cfg.ReadRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		res, err := read()
+		if err == nil || attempt >= s.cfg.ReadRetries || !retryable(err) {
+			return res, err
+		}
+
+		log.Debug().Err(err).Msgf("retrying local read, attempt %d", attempt+1)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
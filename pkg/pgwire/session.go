@@ -0,0 +1,215 @@
+package pgwire
+
+import (
+	"database/sql"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// ErrUnknownSession is returned when no session has the given id.
+var ErrUnknownSession = errors.New("unknown session")
+
+// SessionInfo describes a connected client session.
+type SessionInfo struct {
+	ID         uint32    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user"`
+	Database   string    `json:"database"`
+	StartedAt  time.Time `json:"started_at"`
+	Trace      bool      `json:"trace"`
+	Listener   string    `json:"listener,omitempty"`
+	TLS        bool      `json:"tls"`
+}
+
+type session struct {
+	id      uint32
+	secret  uint32
+	backend *pgproto3.Backend
+	started time.Time
+	policy  Policy
+
+	// mu guards the fields set during startup that info reads, as the
+	// session is listed from other goroutines while it starts up. The
+	// session's own goroutine reads them without it.
+	mu       sync.Mutex
+	conn     net.Conn
+	tls      bool
+	user     string
+	database string
+
+	// frames checks the frames read by backend, limiting
+	// messages to maxMessage bytes.
+	frames     *frameReader
+	maxMessage int
+
+	// tenant chooses the local database for reads, when set.
+	tenant string
+	// encoding converts the client's text from and to UTF-8, when it
+	// isn't UTF-8, startupEncoding is the one it started with.
+	encoding        *clientEncoding
+	startupEncoding string
+
+	// gucs are the statements that apply the session's
+	// passthrough settings, keyed by setting name.
+	gucs map[string]string
+
+	// prepared statements and portals of the extended query protocol
+	statements map[string]*statement
+	portals    map[string]*portal
+	skipToSync bool
+	// batch holds pipelined INSERTs until the client waits for them.
+	batch *writeBatch
+
+	// tx is the session's transaction status, pinned is the upstream
+	// connection held by an open transaction, until release is called.
+	tx      txState
+	pinned  *sql.Conn
+	release func()
+
+	trace atomic.Bool
+}
+
+func (sess *session) info() SessionInfo {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	return SessionInfo{
+		ID:         sess.id,
+		RemoteAddr: sess.conn.RemoteAddr().String(),
+		User:       sess.user,
+		Database:   sess.database,
+		StartedAt:  sess.started,
+		Trace:      sess.trace.Load(),
+		Listener:   sess.policy.Listener,
+		TLS:        sess.tls,
+	}
+}
+
+func (sess *session) receive() (pgproto3.FrontendMessage, error) {
+	msg, err := sess.frames.receive(sess.backend)
+	if err != nil {
+		sess.protocolViolation(err)
+		return nil, err
+	}
+
+	sess.traceMessage('F', msg)
+
+	return msg, nil
+}
+
+// setConn reads and writes the session's messages on conn,
+// starting with the startup message, tls is set when conn is
+// encrypted.
+func (sess *session) setConn(conn net.Conn, tls bool) {
+	sess.mu.Lock()
+	sess.conn, sess.tls = conn, tls
+	sess.mu.Unlock()
+
+	sess.frames = newFrameReader(conn, sess.maxMessage)
+	sess.backend = pgproto3.NewBackend(sess.frames, conn)
+}
+
+func (sess *session) send(msg pgproto3.BackendMessage) {
+	if sess.batch != nil {
+		sess.batch.held = append(sess.batch.held, msg)
+		return
+	}
+
+	msg = sess.encodeMessage(msg)
+
+	sess.traceMessage('B', msg)
+	sess.backend.Send(msg)
+}
+
+func (sess *session) flush() error {
+	return sess.backend.Flush()
+}
+
+type registry struct {
+	mu       sync.Mutex
+	nextID   uint32
+	sessions map[uint32]*session
+}
+
+func newRegistry() *registry {
+	return &registry{sessions: make(map[uint32]*session)}
+}
+
+func (r *registry) add(conn net.Conn, policy Policy, started time.Time, maxMessage int) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+
+	sess := &session{
+		id:         r.nextID,
+		secret:     rand.Uint32(),
+		started:    started,
+		policy:     policy,
+		maxMessage: maxMessage,
+
+		tx:         txIdle,
+		gucs:       make(map[string]string),
+		statements: make(map[string]*statement),
+		portals:    make(map[string]*portal),
+	}
+
+	sess.setConn(conn, false)
+	r.sessions[sess.id] = sess
+
+	return sess
+}
+
+func (r *registry) remove(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, id)
+}
+
+func (r *registry) get(id uint32) (*session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sess, ok := r.sessions[id]
+
+	return sess, ok
+}
+
+func (r *registry) list() []SessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]SessionInfo, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		out = append(out, sess.info())
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	return out
+}
+
+// Sessions lists the connected client sessions.
+func (s *Server) Sessions() []SessionInfo {
+	return s.sessions.list()
+}
+
+// SetTrace turns protocol tracing on or off for the session.
+func (s *Server) SetTrace(id uint32, on bool) error {
+	sess, ok := s.sessions.get(id)
+	if !ok {
+		return ErrUnknownSession
+	}
+
+	sess.trace.Store(on)
+
+	return nil
+}
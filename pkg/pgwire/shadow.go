@@ -0,0 +1,364 @@
+package pgwire
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// shadowMaxInFlight is the most shadowed reads running at once,
+	// reads sampled while they're all in use aren't shadowed.
+	shadowMaxInFlight = 4
+	// shadowMaxRows is the most rows of a shadowed read compared,
+	// larger results aren't.
+	shadowMaxRows = 10000
+	shadowTimeout = 30 * time.Second
+	// shadowRecheck is how long a mismatch waits to be compared again
+	// before it's reported, the replication may not have applied the
+	// change the upstream returned yet.
+	shadowRecheck = 2 * time.Second
+)
+
+var errShadowTooLarge = fmt.Errorf("more than %d rows", shadowMaxRows)
+
+// shadower runs a sample of the local reads on the upstream too and
+// compares their results, see Config.ShadowEvery.
+type shadower struct {
+	every    int64
+	reads    atomic.Int64
+	inFlight chan struct{}
+
+	shadowed   atomic.Int64
+	matched    atomic.Int64
+	mismatched atomic.Int64
+	failed     atomic.Int64
+	dropped    atomic.Int64
+}
+
+func newShadower(every int) *shadower {
+	return &shadower{every: int64(every), inFlight: make(chan struct{}, shadowMaxInFlight)}
+}
+
+// shadowRead shadows the local read if it's sampled, in the background,
+// so the session doesn't wait for the upstream.
+func (s *Server) shadowRead(sess *session, queryString string, args []any) {
+	sh := s.shadow
+
+	if sh.every <= 0 || sess.tenant != "" || sh.reads.Add(1)%sh.every != 0 {
+		return
+	}
+
+	select {
+	case sh.inFlight <- struct{}{}:
+	default:
+		sh.dropped.Add(1)
+		return
+	}
+
+	// the read runs with the session's settings as they are now, the
+	// session goes on changing its own
+	shadow := &session{id: sess.id, gucs: maps.Clone(sess.gucs)}
+	shadow.trace.Store(sess.trace.Load())
+
+	go func() {
+		defer func() { <-sh.inFlight }()
+
+		s.compareShadow(shadow, queryString, args)
+	}()
+}
+
+// compareShadow runs the read on the upstream and the local database and
+// logs where their results differ. A mismatch is compared again after
+// shadowRecheck before it's reported, as the local database lags the
+// upstream. The rows' values are only logged for traced sessions.
+func (s *Server) compareShadow(sess *session, queryString string, args []any) {
+	sh := s.shadow
+	sh.shadowed.Add(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		local, upstream, err := s.shadowResults(ctx, sess, queryString, args)
+		if err != nil {
+			sh.failed.Add(1)
+			log.Debug().Err(err).Msgf("shadow read not compared: %q", redactQuery(queryString))
+
+			return
+		}
+
+		diff, localRow, upstreamRow := diffShadow(local, upstream)
+		if diff == "" {
+			sh.matched.Add(1)
+			return
+		}
+
+		if attempt == 0 {
+			select {
+			case <-time.After(shadowRecheck):
+				continue
+			case <-ctx.Done():
+			}
+		}
+
+		sh.mismatched.Add(1)
+		log.Warn().Uint32("session", sess.id).Msgf("shadow read mismatch, %s: %q", diff, redactQuery(queryString))
+
+		if sess.trace.Load() && localRow != nil {
+			log.Info().Uint32("session", sess.id).
+				Msgf("shadow read mismatch, local row %s, upstream row %s: %q", shadowRow(localRow), shadowRow(upstreamRow), queryString)
+		}
+
+		return
+	}
+}
+
+// shadowResults reads the rows of the read from the local database and the
+// upstream, normalized so the same values compare equal.
+func (s *Server) shadowResults(ctx context.Context, sess *session, queryString string, args []any) (local, upstream [][]string, err error) {
+	queryString, err = s.cfg.Firewall.checkRead(queryString)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.upstreamReady(); err != nil {
+		return nil, nil, err
+	}
+
+	if s.upstream == nil {
+		return nil, nil, errNoPassthrough
+	}
+
+	localQuery := queryString
+	if len(args) > 0 {
+		localQuery = SQLiteParams(localQuery)
+	}
+
+	if local, err = s.shadowLocal(ctx, localQuery, args); err != nil {
+		return nil, nil, fmt.Errorf("local: %w", err)
+	}
+
+	if upstream, err = s.shadowUpstream(ctx, sess, queryString, args); err != nil {
+		return nil, nil, fmt.Errorf("upstream: %w", err)
+	}
+
+	return local, upstream, nil
+}
+
+func (s *Server) shadowLocal(ctx context.Context, query string, args []any) ([][]string, error) {
+	rows, err := s.local.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]rawValue, len(types))
+	dsts := make([]any, len(types))
+
+	for i := range values {
+		values[i].timestamps = s.cfg.Timestamps
+		values[i].typ = sqlgen.ColType(strings.ToLower(types[i].DatabaseTypeName()))
+		dsts[i] = &values[i]
+	}
+
+	var res [][]string
+
+	for rows.Next() {
+		if len(res) == shadowMaxRows {
+			return nil, errShadowTooLarge
+		}
+
+		if err := rows.Scan(dsts...); err != nil {
+			return nil, err
+		}
+
+		row := make([]string, len(values))
+		for i, v := range values {
+			row[i] = shadowValue(v.b)
+		}
+
+		res = append(res, row)
+	}
+
+	return res, rows.Err()
+}
+
+// shadowUpstream reads the rows on the upstream, with the
+// session's settings, e.g. its search_path and TimeZone.
+func (s *Server) shadowUpstream(ctx context.Context, sess *session, query string, args []any) ([][]string, error) {
+	conn, release, err := s.upstreamConn(sess)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	pgConn := pgConnOf(conn)
+	if pgConn == nil {
+		return nil, errNoPassthrough
+	}
+
+	values, formats := upstreamParams(args)
+	rr := pgConn.ExecParams(ctx, query, values, nil, formats, nil)
+
+	var res [][]string
+
+	for rr.NextRow() {
+		if len(res) == shadowMaxRows {
+			rr.Close()
+			return nil, errShadowTooLarge
+		}
+
+		row := make([]string, len(rr.Values()))
+		for i, v := range rr.Values() {
+			row[i] = shadowValue(v)
+		}
+
+		res = append(res, row)
+	}
+
+	if _, err := rr.Close(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// shadowNull stands for NULL in normalized rows.
+const shadowNull = "\x00NULL"
+
+// shadowValue normalizes a value's text, so values stored differently
+// locally, such as booleans as integers or timestamps under a policy,
+// compare equal to the upstream's text of them.
+func shadowValue(b []byte) string {
+	if b == nil {
+		return shadowNull
+	}
+
+	text := string(b)
+
+	switch text {
+	case "t", "true":
+		return "1"
+	case "f", "false":
+		return "0"
+	}
+
+	if t, ok := parseShadowTime(text); ok {
+		return strconv.FormatFloat(float64(t.UnixMicro()), 'g', -1, 64)
+	}
+
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+
+	return text
+}
+
+// shadowTimeLayouts are the layouts of timestamps as postgres sends them
+// and as the Timestamps policies store them.
+var shadowTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+func parseShadowTime(text string) (time.Time, bool) {
+	if len(text) < len("2006-01-02 15:04:05") || text[4] != '-' {
+		return time.Time{}, false
+	}
+
+	for _, layout := range shadowTimeLayouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// diffShadow describes where the local and upstream rows first differ,
+// compared regardless of their order, without their values, and returns
+// the rows that differ. It's empty when they match.
+func diffShadow(local, upstream [][]string) (string, []string, []string) {
+	if len(local) != len(upstream) {
+		return fmt.Sprintf("%d rows locally, %d upstream", len(local), len(upstream)), nil, nil
+	}
+
+	sortRows := func(rows [][]string) {
+		slices.SortFunc(rows, func(a, b []string) int { return slices.Compare(a, b) })
+	}
+
+	sortRows(local)
+	sortRows(upstream)
+
+	for i := range local {
+		if len(local[i]) != len(upstream[i]) {
+			return fmt.Sprintf("%d columns locally, %d upstream", len(local[i]), len(upstream[i])), local[i], upstream[i]
+		}
+
+		for j := range local[i] {
+			if local[i][j] != upstream[i][j] {
+				return fmt.Sprintf("sorted row %d of %d differs in column %d", i+1, len(local), j+1), local[i], upstream[i]
+			}
+		}
+	}
+
+	return "", nil, nil
+}
+
+// shadowRow formats a row for a mismatch's log message, truncating it.
+func shadowRow(row []string) string {
+	const maxLen = 200
+
+	values := make([]string, len(row))
+	for i, v := range row {
+		if v == shadowNull {
+			values[i] = "NULL"
+		} else {
+			values[i] = strconv.Quote(v)
+		}
+	}
+
+	text := "(" + strings.Join(values, ", ") + ")"
+	if len(text) > maxLen {
+		text = text[:maxLen] + "..."
+	}
+
+	return text
+}
+
+// statShadow lists the counts of the shadowed reads.
+func (s *Server) statShadow() VirtualTable {
+	return VirtualTable{
+		Columns: []VirtualColumn{
+			{Name: "sample_every", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "shadowed", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "matched", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "mismatched", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "failed", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "dropped", Type: sqlgen.SQLiteColTypeInteger},
+		},
+		Rows: func() [][]any {
+			sh := s.shadow
+
+			return [][]any{{
+				sh.every, sh.shadowed.Load(), sh.matched.Load(), sh.mismatched.Load(), sh.failed.Load(), sh.dropped.Load(),
+			}}
+		},
+	}
+}
@@ -0,0 +1,298 @@
+package pgwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
+)
+
+// rowBuffers hold the values of the rows copied into spools, a row's
+// values share one buffer, reused once its spool is closed.
+var rowBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// maxPooledRowBytes is the largest buffer put back in the pool, so a
+// few wide rows don't keep their memory.
+const maxPooledRowBytes = 64 << 10
+
+// spool holds the rows of a result, in memory until their size passes the
+// threshold, or the memory budget is used up, and then in a temporary file.
+// Rows are read back in order.
+type spool struct {
+	// threshold is the bytes of rows kept in memory, zero keeps every row.
+	threshold int64
+	dir       string
+	// budget is shared with the other spools and the replication,
+	// held is the part of it taken by the rows in memory.
+	budget *budget.Budget
+	held   int64
+
+	size  int64
+	count int
+	// served is the bytes of every row added, in memory or not.
+	served int64
+	rows   [][][]byte
+	// bufs are the pooled buffers of the rows copied in.
+	bufs []*[]byte
+
+	file *os.File
+	w    *bufio.Writer
+	r    *bufio.Reader
+	read int
+	// buf holds the values of the last row read back from the file.
+	buf []byte
+}
+
+func (s *Server) newSpool() *spool {
+	return &spool{threshold: s.cfg.SpoolThreshold, dir: s.cfg.SpoolDir, budget: s.cfg.Budget}
+}
+
+func (sp *spool) len() int {
+	if sp == nil {
+		return 0
+	}
+
+	return sp.count
+}
+
+// bytes returns the bytes of the rows added.
+func (sp *spool) bytes() int64 {
+	if sp == nil {
+		return 0
+	}
+
+	return sp.served
+}
+
+func (sp *spool) add(row [][]byte) error {
+	var n int64
+	for _, v := range row {
+		n += int64(len(v))
+	}
+
+	sp.count++
+	sp.served += n
+
+	if sp.file == nil {
+		sp.size += n
+		sp.rows = append(sp.rows, row)
+
+		inBudget := sp.budget.TryAcquire(n)
+		if inBudget {
+			sp.held += n
+		}
+
+		if inBudget && (sp.threshold <= 0 || sp.size <= sp.threshold) {
+			return nil
+		}
+
+		// past the threshold, move the rows so far to disk
+		f, err := os.CreateTemp(sp.dir, "sqledge-spool-*")
+		if err != nil {
+			return fmt.Errorf("create spool file: %w", err)
+		}
+
+		sp.file, sp.w = f, bufio.NewWriter(f)
+
+		rows := sp.rows
+		sp.rows = nil
+
+		for _, r := range rows {
+			if err := sp.write(r); err != nil {
+				return err
+			}
+		}
+
+		sp.release()
+
+		return nil
+	}
+
+	return sp.write(row)
+}
+
+// copyRow copies the values into a pooled buffer owned by the spool,
+// for values only valid until the next row is read, like sql.RawBytes.
+// Once the spool is on disk the values are written out when added, so
+// they're returned as they are.
+func (sp *spool) copyRow(values [][]byte) [][]byte {
+	if sp.file != nil {
+		return values
+	}
+
+	n := 0
+	for _, v := range values {
+		n += len(v)
+	}
+
+	buf := rowBuffers.Get().(*[]byte)
+	if *buf == nil || cap(*buf) < n {
+		// never nil, so the empty values aren't mistaken for nulls
+		*buf = make([]byte, 0, max(n, 64))
+	}
+
+	b := (*buf)[:0]
+
+	for _, v := range values {
+		b = append(b, v...)
+	}
+
+	row := make([][]byte, len(values))
+	off := 0
+
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+
+		row[i] = b[off : off+len(v) : off+len(v)]
+		off += len(v)
+	}
+
+	*buf = b
+	sp.bufs = append(sp.bufs, buf)
+
+	return row
+}
+
+// cloneRow copies the row's values, for rows kept after
+// their spool is closed.
+func cloneRow(row [][]byte) [][]byte {
+	out := make([][]byte, len(row))
+
+	for i, v := range row {
+		if v != nil {
+			out[i] = append([]byte{}, v...)
+		}
+	}
+
+	return out
+}
+
+// release gives back the memory of the rows held, once they're on
+// disk or dropped.
+func (sp *spool) release() {
+	sp.budget.Release(sp.held)
+	sp.held = 0
+
+	for _, buf := range sp.bufs {
+		if cap(*buf) <= maxPooledRowBytes {
+			rowBuffers.Put(buf)
+		}
+	}
+
+	sp.bufs = nil
+}
+
+// write appends the row to the file, as the column count followed
+// by each value's length and bytes. Null values have length -1.
+func (sp *spool) write(row [][]byte) error {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(row)))
+
+	for _, v := range row {
+		if v == nil {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(0xffffffff))
+			continue
+		}
+
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(v)))
+		buf = append(buf, v...)
+	}
+
+	if _, err := sp.w.Write(buf); err != nil {
+		return fmt.Errorf("write spool file: %w", err)
+	}
+
+	return nil
+}
+
+// next returns the next row, or io.EOF after the last one. The row is
+// only valid until the next call, and until the spool is closed.
+func (sp *spool) next() ([][]byte, error) {
+	if sp == nil || sp.read >= sp.count {
+		return nil, io.EOF
+	}
+
+	sp.read++
+
+	if sp.file == nil {
+		return sp.rows[sp.read-1], nil
+	}
+
+	if sp.r == nil {
+		if err := sp.w.Flush(); err != nil {
+			return nil, fmt.Errorf("flush spool file: %w", err)
+		}
+
+		if _, err := sp.file.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seek spool file: %w", err)
+		}
+
+		sp.r = bufio.NewReader(sp.file)
+	}
+
+	var n uint16
+	if err := binary.Read(sp.r, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("read spool file: %w", err)
+	}
+
+	row := make([][]byte, n)
+	lens := make([]int32, n)
+
+	if sp.buf == nil {
+		// never nil, so the empty values aren't mistaken for nulls
+		sp.buf = make([]byte, 0, 64)
+	}
+
+	sp.buf = sp.buf[:0]
+
+	for i := range row {
+		if err := binary.Read(sp.r, binary.BigEndian, &lens[i]); err != nil {
+			return nil, fmt.Errorf("read spool file: %w", err)
+		}
+
+		if lens[i] < 0 {
+			continue
+		}
+
+		// the values are read into one buffer, reused for the next row
+		start := len(sp.buf)
+		sp.buf = append(sp.buf, make([]byte, lens[i])...)
+
+		if _, err := io.ReadFull(sp.r, sp.buf[start:]); err != nil {
+			return nil, fmt.Errorf("read spool file: %w", err)
+		}
+	}
+
+	off := 0
+
+	for i, l := range lens {
+		if l < 0 {
+			continue
+		}
+
+		row[i] = sp.buf[off : off+int(l) : off+int(l)]
+		off += int(l)
+	}
+
+	return row, nil
+}
+
+// close drops the rows, removing the spool file if they were spilled to disk.
+func (sp *spool) close() {
+	if sp == nil {
+		return
+	}
+
+	if sp.file != nil {
+		sp.file.Close()
+		os.Remove(sp.file.Name())
+	}
+
+	sp.release()
+	*sp = spool{}
+}
@@ -0,0 +1,55 @@
+package pgwire
+
+import (
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rs/zerolog/log"
+)
+
+// Startup policies, whether local reads are served from the local
+// database as it is after a restart, or held until it has caught up.
+const (
+	StartupServeStale = "serve-stale"
+	StartupFailFast   = "fail-fast"
+)
+
+// HoldReads fails the local reads with cannot_connect_now until ready
+// first reports true, e.g. until the replication has caught up after a
+// restart, so clients retry instead of reading stale rows. Reads of the
+// virtual tables and of cold tables, which go upstream, are still served.
+func (s *Server) HoldReads(ready func() bool) {
+	s.holdMu.Lock()
+	defer s.holdMu.Unlock()
+
+	s.hold = ready
+	s.held.Store(ready != nil)
+}
+
+// readsHeld returns a cannot_connect_now error while the local reads are
+// held. Once ready, they're served from then on.
+func (s *Server) readsHeld() error {
+	if !s.held.Load() {
+		return nil
+	}
+
+	s.holdMu.Lock()
+	defer s.holdMu.Unlock()
+
+	if s.hold == nil {
+		return nil
+	}
+
+	if !s.hold() {
+		return &pgconn.PgError{
+			Severity: "ERROR",
+			Code:     "57P03",
+			Message:  "the local database is catching up after startup",
+		}
+	}
+
+	log.Info().Msg("the local database caught up, serving local reads")
+
+	s.hold = nil
+	s.held.Store(false)
+
+	return nil
+}
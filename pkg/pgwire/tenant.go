@@ -0,0 +1,92 @@
+package pgwire
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+var (
+	setTenantStatement   = regexp.MustCompile(`(?i)^set\s+(?:session\s+)?sqledge\.tenant\s*(?:=|\s+to\s+)\s*'?([^'\s;]*)'?\s*;?\s*$`)
+	resetTenantStatement = regexp.MustCompile(`(?i)^(?:reset\s+sqledge\.tenant|set\s+(?:session\s+)?sqledge\.tenant\s*(?:=|\s+to\s+)\s*default)\s*;?\s*$`)
+)
+
+func errUnknownTenant(severity string, err error) *pgconn.PgError {
+	return &pgconn.PgError{Severity: severity, Code: "3D000", Message: err.Error()}
+}
+
+// setTenant handles SET and RESET of sqledge.tenant, which choose
+// the local database the session reads from.
+func (s *Server) setTenant(sess *session, queryString string) (*result, bool, error) {
+	if s.cfg.Tenant == nil {
+		return nil, false, nil
+	}
+
+	queryString = strings.TrimSpace(queryString)
+
+	if resetTenantStatement.MatchString(queryString) {
+		sess.tenant = ""
+		return &result{tag: "RESET"}, true, nil
+	}
+
+	m := setTenantStatement.FindStringSubmatch(queryString)
+	if m == nil {
+		return nil, false, nil
+	}
+
+	if _, err := s.cfg.Tenant(m[1]); err != nil {
+		return nil, true, errUnknownTenant("ERROR", err)
+	}
+
+	sess.tenant = m[1]
+
+	return &result{tag: "SET"}, true, nil
+}
+
+// startTenant sets the session's tenant to the database it
+// connects to, closing the session when there's no such tenant.
+func (s *Server) startTenant(sess *session) error {
+	if s.cfg.Tenant == nil || !s.cfg.TenantByDatabase {
+		return nil
+	}
+
+	if _, err := s.cfg.Tenant(sess.database); err != nil {
+		pgErr := errUnknownTenant("FATAL", err)
+
+		sess.send(&pgproto3.ErrorResponse{Severity: pgErr.Severity, Code: pgErr.Code, Message: pgErr.Message})
+
+		return errors.Join(err, sess.flush())
+	}
+
+	sess.tenant = sess.database
+
+	return nil
+}
+
+// localDB is the local database the session reads from.
+func (s *Server) localDB(sess *session) (*sql.DB, error) {
+	return s.tenantDB(sess.tenant)
+}
+
+// tenantDB is the tenant's local database, or the main
+// local database when there's no tenant, once reads aren't held.
+func (s *Server) tenantDB(tenant string) (*sql.DB, error) {
+	if err := s.readsHeld(); err != nil {
+		return nil, err
+	}
+
+	if tenant == "" || s.cfg.Tenant == nil {
+		return s.local, nil
+	}
+
+	db, err := s.cfg.Tenant(tenant)
+	if err != nil {
+		return nil, errUnknownTenant("ERROR", err)
+	}
+
+	return db, nil
+}
@@ -0,0 +1,85 @@
+package pgwire
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	stringLiteral  = regexp.MustCompile(`'(?:[^']|'')*'`)
+	numericLiteral = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+
+	redacted = []byte("?")
+)
+
+// redactQuery replaces the string and numeric literals in the query.
+func redactQuery(query string) string {
+	query = stringLiteral.ReplaceAllString(query, "'?'")
+	return numericLiteral.ReplaceAllString(query, "?")
+}
+
+func redactValues(values [][]byte) [][]byte {
+	out := make([][]byte, len(values))
+	for i, v := range values {
+		if v != nil {
+			out[i] = redacted
+		}
+	}
+
+	return out
+}
+
+// redact returns a copy of the message without any values
+// sent by, or returned to, the client.
+func redact(msg pgproto3.Message) pgproto3.Message {
+	switch msg := msg.(type) {
+	case *pgproto3.Query:
+		return &pgproto3.Query{String: redactQuery(msg.String)}
+	case *pgproto3.Parse:
+		m := *msg
+		m.Query = redactQuery(msg.Query)
+		return &m
+	case *pgproto3.Bind:
+		m := *msg
+		m.Parameters = redactValues(msg.Parameters)
+		return &m
+	case *pgproto3.DataRow:
+		return &pgproto3.DataRow{Values: redactValues(msg.Values)}
+	case *pgproto3.FunctionCall:
+		m := *msg
+		m.Arguments = redactValues(msg.Arguments)
+		return &m
+	case *pgproto3.FunctionCallResponse:
+		return &pgproto3.FunctionCallResponse{Result: redactValues([][]byte{msg.Result})[0]}
+	case *pgproto3.CopyData:
+		return &pgproto3.CopyData{Data: redacted}
+	case *pgproto3.PasswordMessage:
+		return &pgproto3.PasswordMessage{Password: "?"}
+	}
+
+	return msg
+}
+
+// traceMessage logs the decoded message when the session is being traced.
+// sender is 'F' for messages from the client (frontend), and 'B' for the
+// messages sent by sqledge (backend).
+func (sess *session) traceMessage(sender byte, msg pgproto3.Message) {
+	if !sess.trace.Load() {
+		return
+	}
+
+	b, err := json.Marshal(redact(msg))
+	if err != nil {
+		log.Warn().Err(err).Uint32("session", sess.id).Msgf("trace %T", msg)
+		return
+	}
+
+	log.Info().
+		Uint32("session", sess.id).
+		Str("sender", string(sender)).
+		RawJSON("msg", b).
+		Msg("trace")
+}
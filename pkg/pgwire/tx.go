@@ -0,0 +1,156 @@
+package pgwire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/rs/zerolog/log"
+)
+
+// txState is the transaction status sent in ReadyForQuery.
+type txState byte
+
+const (
+	txIdle   txState = 'I'
+	txOpen   txState = 'T'
+	txFailed txState = 'E'
+)
+
+var (
+	beginStatement    = regexp.MustCompile(`^\s*(begin|start\s+transaction)\b`)
+	commitStatement   = regexp.MustCompile(`^\s*(commit|end)\s*(transaction|work)?\s*;?\s*$`)
+	rollbackStatement = regexp.MustCompile(`^\s*(rollback|abort)\s*(transaction|work)?\s*;?\s*$`)
+)
+
+var errTxAborted = &pgconn.PgError{
+	Severity: "ERROR",
+	Code:     "25P02",
+	Message:  "current transaction is aborted, commands ignored until end of transaction block",
+}
+
+var errIdleInTransaction = &pgconn.PgError{
+	Severity: "FATAL",
+	Code:     "25P03",
+	Message:  "terminating connection due to idle-in-transaction timeout",
+}
+
+// receive reads the next message for the session. When the session is in a
+// transaction, the read times out after the idle in transaction timeout, the
+// client is told and the transaction is rolled back as the session ends.
+func (s *Server) receive(sess *session) (pgproto3.FrontendMessage, error) {
+	timeout := s.cfg.IdleInTransactionTimeout
+	if timeout <= 0 {
+		return sess.receive()
+	}
+
+	deadline := time.Time{}
+	if sess.tx != txIdle {
+		deadline = time.Now().Add(timeout)
+	}
+
+	if err := sess.conn.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("set read deadline: %w", err)
+	}
+
+	msg, err := sess.receive()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		sess.send(errorResponse("", errIdleInTransaction))
+		sess.flush()
+
+		return nil, errIdleInTransaction
+	}
+
+	return msg, err
+}
+
+func (sess *session) readyForQuery() {
+	sess.send(&pgproto3.ReadyForQuery{TxStatus: byte(sess.tx)})
+}
+
+// transaction handles the transaction control statements, returning
+// false when the query isn't one. query is lowercased.
+//
+// BEGIN doesn't touch the upstream, the upstream transaction starts
+// with the first write, see withUpstream.
+func (sess *session) transaction(query string) (*result, bool, error) {
+	switch {
+	case beginStatement.MatchString(query):
+		if sess.tx == txIdle {
+			sess.tx = txOpen
+		}
+
+		return &result{tag: "BEGIN"}, true, nil
+	case commitStatement.MatchString(query):
+		if sess.tx == txFailed {
+			sess.endTx()
+			return &result{tag: "ROLLBACK"}, true, nil
+		}
+
+		if err := sess.finishTx("COMMIT"); err != nil {
+			return nil, true, err
+		}
+
+		return &result{tag: "COMMIT"}, true, nil
+	case rollbackStatement.MatchString(query):
+		if err := sess.finishTx("ROLLBACK"); err != nil {
+			return nil, true, err
+		}
+
+		return &result{tag: "ROLLBACK"}, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// finishTx commits or rolls back the pinned upstream transaction, the
+// session's transaction ends either way.
+func (sess *session) finishTx(statement string) error {
+	defer sess.endTx()
+
+	if sess.pinned == nil {
+		return nil
+	}
+
+	if _, err := sess.pinned.ExecContext(context.Background(), statement); err != nil {
+		return fmt.Errorf("failed to %s upstream: %w", statement, err)
+	}
+
+	return nil
+}
+
+// failTx marks the transaction failed after an error, the upstream
+// transaction is rolled back and its connection released straight away.
+func (sess *session) failTx() {
+	if sess.tx != txOpen {
+		return
+	}
+
+	sess.rollbackPinned()
+	sess.tx = txFailed
+}
+
+// endTx returns the session to idle, rolling back any upstream
+// transaction that is still open.
+func (sess *session) endTx() {
+	sess.rollbackPinned()
+	sess.tx = txIdle
+}
+
+func (sess *session) rollbackPinned() {
+	if sess.pinned == nil {
+		return
+	}
+
+	if _, err := sess.pinned.ExecContext(context.Background(), "ROLLBACK"); err != nil && !errors.Is(err, context.Canceled) {
+		log.Error().Err(err).Msg("rollback upstream")
+	}
+
+	sess.release()
+	sess.pinned, sess.release = nil, nil
+}
@@ -0,0 +1,234 @@
+package pgwire
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// errNoPassthrough is returned when the upstream driver isn't pgx,
+// passthrough queries need its connection to relay the raw rows.
+var errNoPassthrough = errors.New("upstream connection doesn't support passthrough")
+
+// withUpstream runs fn on an upstream connection for the session, any
+// notices the upstream raises on the connection are relayed to the client.
+//
+// Inside a transaction the connection is pinned to the session on first use,
+// so every statement lands in the same upstream transaction.
+func (s *Server) withUpstream(sess *session, fn func(conn *sql.Conn) error) error {
+	conn := sess.pinned
+
+	if conn == nil {
+		if err := s.upstreamReady(); err != nil {
+			return err
+		}
+
+		c, release, err := s.upstreamConn(sess)
+		if err != nil {
+			return err
+		}
+
+		if sess.tx == txOpen {
+			if _, err := c.ExecContext(context.Background(), "BEGIN"); err != nil {
+				release()
+				return fmt.Errorf("failed to begin upstream: %w", err)
+			}
+
+			sess.pinned, sess.release = c, release
+		} else {
+			defer release()
+		}
+
+		conn = c
+	}
+
+	if pgConn := pgConnOf(conn); pgConn != nil {
+		s.noticesMu.Lock()
+		s.notices[pgConn] = sess
+		s.noticesMu.Unlock()
+
+		defer func() {
+			s.noticesMu.Lock()
+			delete(s.notices, pgConn)
+			s.noticesMu.Unlock()
+		}()
+	}
+
+	return fn(conn)
+}
+
+// upstreamReady returns a cannot_connect_now error while
+// the upstream is known to be unreachable.
+func (s *Server) upstreamReady() error {
+	if s.cfg.UpstreamReady == nil {
+		return nil
+	}
+
+	if err := s.cfg.UpstreamReady(); err != nil {
+		return &pgconn.PgError{Severity: "ERROR", Code: "57P03", Message: err.Error()}
+	}
+
+	return nil
+}
+
+// upstreamConn takes a connection from the pool with the session's
+// settings applied, release resets them and returns it to the pool.
+func (s *Server) upstreamConn(sess *session) (*sql.Conn, func(), error) {
+	conn, err := s.upstream.Conn(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect upstream: %w", err)
+	}
+
+	reset, err := sess.applyGUCs(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, func() {
+		reset()
+		conn.Close()
+	}, nil
+}
+
+// query runs the query on the upstream, e.g. in passthrough mode. Every
+// row is read into the result's spool before any is sent to the client,
+// so large results can spill to disk rather than being held in memory.
+func (s *Server) query(sess *session, query string, args []any) (*result, error) {
+	res := &result{rows: s.newSpool()}
+
+	err := s.withUpstream(sess, func(conn *sql.Conn) error {
+		pgConn := pgConnOf(conn)
+		if pgConn == nil {
+			return errNoPassthrough
+		}
+
+		values, formats := upstreamParams(args)
+		rr := pgConn.ExecParams(context.Background(), query, values, nil, formats, nil)
+
+		if fields := rr.FieldDescriptions(); len(fields) > 0 {
+			res.desc = rowDescOf(fields)
+		}
+
+		for rr.NextRow() {
+			if err := res.rows.add(res.rows.copyRow(rr.Values())); err != nil {
+				rr.Close()
+				return err
+			}
+		}
+
+		tag, err := rr.Close()
+		if err != nil {
+			return fmt.Errorf("failed to query upstream: %w", err)
+		}
+
+		res.tag = tag.String()
+
+		return nil
+	})
+	if err != nil {
+		res.rows.close()
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// describeUpstream returns the row description of the query from the
+// upstream, or nil for statements that don't return rows.
+func (s *Server) describeUpstream(sess *session, query string) (*pgproto3.RowDescription, error) {
+	var desc *pgproto3.RowDescription
+
+	err := s.withUpstream(sess, func(conn *sql.Conn) error {
+		pgConn := pgConnOf(conn)
+		if pgConn == nil {
+			return errNoPassthrough
+		}
+
+		sd, err := pgConn.Prepare(context.Background(), "", query, nil)
+		if err != nil {
+			return fmt.Errorf("failed to describe upstream: %w", err)
+		}
+
+		if len(sd.Fields) > 0 {
+			desc = rowDescOf(sd.Fields)
+		}
+
+		return nil
+	})
+
+	return desc, err
+}
+
+func rowDescOf(fields []pgconn.FieldDescription) *pgproto3.RowDescription {
+	desc := &pgproto3.RowDescription{Fields: make([]pgproto3.FieldDescription, len(fields))}
+
+	for i, f := range fields {
+		desc.Fields[i] = pgproto3.FieldDescription{
+			Name:                 []byte(f.Name),
+			TableOID:             f.TableOID,
+			TableAttributeNumber: f.TableAttributeNumber,
+			DataTypeOID:          f.DataTypeOID,
+			DataTypeSize:         f.DataTypeSize,
+			TypeModifier:         f.TypeModifier,
+			Format:               pgtype.TextFormatCode,
+		}
+	}
+
+	return desc
+}
+
+func pgConnOf(conn *sql.Conn) *pgconn.PgConn {
+	var pgConn *pgconn.PgConn
+
+	conn.Raw(func(driverConn any) error {
+		if c, ok := driverConn.(*stdlib.Conn); ok {
+			pgConn = c.Conn().PgConn()
+		}
+
+		return nil
+	})
+
+	return pgConn
+}
+
+// OnNotice relays a notice raised on an upstream connection to the
+// session using it. The upstream must be opened with OnNotice set
+// in its connection config for notices to reach the clients.
+func (s *Server) OnNotice(c *pgconn.PgConn, n *pgconn.Notice) {
+	s.noticesMu.Lock()
+	sess, ok := s.notices[c]
+	s.noticesMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// notices are raised while the session is waiting on the
+	// upstream, so they're sent before the command completes.
+	sess.send(&pgproto3.NoticeResponse{
+		Severity:         n.Severity,
+		Code:             n.Code,
+		Message:          n.Message,
+		Detail:           n.Detail,
+		Hint:             n.Hint,
+		Position:         n.Position,
+		InternalPosition: n.InternalPosition,
+		InternalQuery:    n.InternalQuery,
+		Where:            n.Where,
+		SchemaName:       n.SchemaName,
+		TableName:        n.TableName,
+		ColumnName:       n.ColumnName,
+		DataTypeName:     n.DataTypeName,
+		ConstraintName:   n.ConstraintName,
+		File:             n.File,
+		Line:             n.Line,
+		Routine:          n.Routine,
+	})
+}
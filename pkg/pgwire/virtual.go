@@ -0,0 +1,133 @@
+package pgwire
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+)
+
+// VirtualTable is a table of sqledge's internal state, that can be
+// queried through the proxy like any local table.
+type VirtualTable struct {
+	Columns []VirtualColumn
+	// Rows returns the current rows, with a value for each column.
+	Rows func() [][]any
+}
+
+type VirtualColumn struct {
+	Name string
+	Type sqlgen.ColType
+}
+
+// AddVirtualTable makes the table queryable by name.
+func (s *Server) AddVirtualTable(name string, table VirtualTable) {
+	s.virtualMu.Lock()
+	defer s.virtualMu.Unlock()
+
+	s.virtual[name] = table
+}
+
+// statActivity lists the connected sessions, like pg_stat_activity.
+func (s *Server) statActivity() VirtualTable {
+	return VirtualTable{
+		Columns: []VirtualColumn{
+			{Name: "id", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "remote_addr", Type: sqlgen.SQLiteColTypeText},
+			{Name: "user", Type: sqlgen.SQLiteColTypeText},
+			{Name: "database", Type: sqlgen.SQLiteColTypeText},
+			{Name: "started_at", Type: sqlgen.SQLiteColTypeText},
+			{Name: "trace", Type: sqlgen.SQLiteColTypeInteger},
+		},
+		Rows: func() [][]any {
+			var rows [][]any
+
+			for _, info := range s.Sessions() {
+				rows = append(rows, []any{
+					info.ID,
+					info.RemoteAddr,
+					info.User,
+					info.Database,
+					info.StartedAt.Format(time.RFC3339),
+					info.Trace,
+				})
+			}
+
+			return rows
+		},
+	}
+}
+
+// virtualTables returns the names of the virtual tables in the query.
+func (s *Server) virtualTables(query string) []string {
+	s.virtualMu.RLock()
+	defer s.virtualMu.RUnlock()
+
+	var names []string
+
+	for name := range s.virtual {
+		if strings.Contains(query, name) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// queryVirtual fills temporary tables with the current rows of the virtual
+// tables, and runs the query against them. Temporary tables are only seen
+// by the connection that created them, so every statement uses one conn.
+func (s *Server) queryVirtual(query string, args []any, names []string) (*result, error) {
+	ctx := context.Background()
+
+	conn, err := s.local.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect local: %w", err)
+	}
+	defer conn.Close()
+
+	for _, name := range names {
+		s.virtualMu.RLock()
+		table := s.virtual[name]
+		s.virtualMu.RUnlock()
+
+		if err := createVirtual(ctx, conn, name, table); err != nil {
+			return nil, err
+		}
+
+		defer conn.ExecContext(ctx, fmt.Sprintf("DROP TABLE temp.%q", name))
+	}
+
+	return s.readLocal(ctx, conn, query, args)
+}
+
+func createVirtual(ctx context.Context, conn *sql.Conn, name string, table VirtualTable) error {
+	cols := make([]string, len(table.Columns))
+	placeholders := make([]string, len(table.Columns))
+
+	for i, c := range table.Columns {
+		cols[i] = fmt.Sprintf("%q %s", c.Name, c.Type)
+		placeholders[i] = "?"
+	}
+
+	create := fmt.Sprintf("CREATE TEMP TABLE %q (%s)", name, strings.Join(cols, ", "))
+	if _, err := conn.ExecContext(ctx, create); err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+
+	insert := fmt.Sprintf("INSERT INTO temp.%q VALUES (%s)", name, strings.Join(placeholders, ", "))
+
+	for _, row := range table.Rows() {
+		if _, err := conn.ExecContext(ctx, insert, row...); err != nil {
+			return fmt.Errorf("failed to fill %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
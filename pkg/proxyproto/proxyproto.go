@@ -0,0 +1,216 @@
+// Package proxyproto reads the PROXY protocol header sent by load balancers
+// such as HAProxy and AWS NLB, so the client's real address is known.
+//
+// The header formats are described here:
+// - https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoHeader is returned when the connection doesn't start with a header.
+	ErrNoHeader = errors.New("no proxy protocol header")
+
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1 headers are at most 107 bytes, including the CRLF
+const v1MaxLength = 107
+
+// Conn is a connection read past its proxy protocol header.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// RemoteAddr is the client's address from the header.
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// LocalAddr is the address the client connected to, from the header.
+func (c *Conn) LocalAddr() net.Addr { return c.local }
+
+// Read reads the header from the connection, which must be sent before
+// the timeout. Headers with the LOCAL command, sent by health checks,
+// keep the connection's own addresses.
+func Read(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("set read deadline: %w", err)
+	}
+
+	c := &Conn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	if err := c.readHeader(); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("clear read deadline: %w", err)
+	}
+
+	return c, nil
+}
+
+func (c *Conn) readHeader() error {
+	start, err := c.r.Peek(len(v1Prefix))
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+
+	if bytes.Equal(start, v1Prefix) {
+		return c.readV1()
+	}
+
+	sig, err := c.r.Peek(len(v2Signature))
+	if err != nil || !bytes.Equal(sig, v2Signature) {
+		return ErrNoHeader
+	}
+
+	return c.readV2()
+}
+
+// readV1 reads the text header: "PROXY TCP4 src dst sport dport\r\n".
+func (c *Conn) readV1() error {
+	var line []byte
+
+	for len(line) < v1MaxLength {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("read v1 header: %w", err)
+		}
+
+		line = append(line, b)
+
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+
+	switch {
+	case len(fields) == 2 && fields[1] == "UNKNOWN":
+		return nil
+	case len(fields) != 6:
+		return fmt.Errorf("malformed v1 header: %q", line)
+	case fields[1] != "TCP4" && fields[1] != "TCP6":
+		return fmt.Errorf("unsupported v1 protocol: %q", fields[1])
+	}
+
+	src, err := tcpAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+
+	dst, err := tcpAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	c.remote, c.local = src, dst
+
+	return nil
+}
+
+func tcpAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("malformed address: %q", ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed port: %q", port)
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// v2 commands and address families
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famTCP4 = 0x11
+	famTCP6 = 0x21
+	famUnix = 0x31
+)
+
+// readV2 reads the binary header: the signature, version and command,
+// address family, length, then the addresses and any TLVs.
+func (c *Conn) readV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return fmt.Errorf("read v2 header: %w", err)
+	}
+
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("unsupported version: %d", hdr[12]>>4)
+	}
+
+	// the length is bounded by the uint16, so this can't over allocate
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return fmt.Errorf("read v2 addresses: %w", err)
+	}
+
+	switch cmd := hdr[12] & 0xf; cmd {
+	case cmdLocal:
+		return nil
+	case cmdProxy:
+	default:
+		return fmt.Errorf("unsupported command: %d", cmd)
+	}
+
+	switch fam := hdr[13]; fam {
+	case famTCP4:
+		if len(body) < 12 {
+			return errors.New("short tcp4 addresses")
+		}
+
+		c.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		c.local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case famTCP6:
+		if len(body) < 36 {
+			return errors.New("short tcp6 addresses")
+		}
+
+		c.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		c.local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	case famUnix:
+		if len(body) < 216 {
+			return errors.New("short unix addresses")
+		}
+
+		c.remote = &net.UnixAddr{Name: string(bytes.TrimRight(body[0:108], "\x00")), Net: "unix"}
+		c.local = &net.UnixAddr{Name: string(bytes.TrimRight(body[108:216], "\x00")), Net: "unix"}
+	default:
+		// unspecified or datagram families keep the connection's addresses
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package proxyproto_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/proxyproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	h := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20|cmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+		err    bool
+	}{
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 5433\r\n"),
+			remote: "192.168.0.1:56324",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 5433\r\n"),
+			remote: "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+			remote: "pipe",
+		},
+		{
+			name: "v2 tcp4",
+			header: v2Header(0x1, 0x11, []byte{
+				10, 0, 0, 1, 10, 0, 0, 2,
+				0x1f, 0x90, 0x15, 0x39,
+			}),
+			remote: "10.0.0.1:8080",
+		},
+		{
+			name:   "v2 local",
+			header: v2Header(0x0, 0x00, nil),
+			remote: "pipe",
+		},
+		{
+			name:   "v2 short addresses",
+			header: v2Header(0x1, 0x11, []byte{10, 0, 0, 1}),
+			err:    true,
+		},
+		{
+			name:   "no header",
+			header: []byte("\x00\x00\x00\x08\x04\xd2\x16\x2f"),
+			err:    true,
+		},
+		{
+			name:   "v1 malformed",
+			header: []byte("PROXY TCP4 nope\r\n"),
+			err:    true,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				client.Write(append(test.header, "hello"...))
+			}()
+
+			conn, err := proxyproto.Read(server, time.Second)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.remote, conn.RemoteAddr().String())
+
+			// the data after the header is still read
+			b := make([]byte, 5)
+			_, err = io.ReadFull(conn, b)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(b))
+		})
+	}
+}
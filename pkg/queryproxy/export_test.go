@@ -0,0 +1,3 @@
+package queryproxy
+
+var OpenLocal = openLocal
@@ -0,0 +1,227 @@
+package queryproxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/events"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUpstreamUnavailable is returned while the upstream can't be reached,
+// it's the same error the replication returns.
+var ErrUpstreamUnavailable = replicate.ErrUpstreamUnavailable
+
+// UpstreamHealth is the result of the latest upstream probe.
+type UpstreamHealth struct {
+	Reachable       bool      `json:"reachable"`
+	CheckedAt       time.Time `json:"checked_at"`
+	LastOKAt        time.Time `json:"last_ok_at"`
+	LatencyMS       float64   `json:"latency_ms"`
+	Error           string    `json:"error,omitempty"`
+	OpenConnections int       `json:"open_connections"`
+	IdleConnections int       `json:"idle_connections"`
+}
+
+// Upstream probes the upstream pool, keeping it warm
+// and recording whether the upstream is reachable.
+type Upstream struct {
+	db       *sql.DB
+	warmConn int
+	timeout  time.Duration
+	clock    clock.Clock
+	// events publishes the upstream going down and coming back up, and
+	// reprobe probes it again before the next interval.
+	events  *events.Bus
+	reprobe chan struct{}
+
+	mu     sync.Mutex
+	health UpstreamHealth
+}
+
+func newUpstream(db *sql.DB, warmConns int, c clock.Clock, bus *events.Bus) *Upstream {
+	// idle connections above the limit are closed as they're released
+	db.SetMaxIdleConns(max(warmConns, 2))
+
+	u := &Upstream{
+		db:       db,
+		warmConn: warmConns,
+		timeout:  3 * time.Second,
+		clock:    clock.Or(c),
+		events:   bus,
+		reprobe:  make(chan struct{}, 1),
+	}
+
+	// the replication hearing from the upstream while it's unreachable
+	// means it's likely back, so writes don't wait for the next probe.
+	bus.Handle(events.LagUpdated, func(events.Event) {
+		if u.Ready() == nil {
+			return
+		}
+
+		select {
+		case u.reprobe <- struct{}{}:
+		default:
+		}
+	})
+
+	return u
+}
+
+// Health returns the latest probe result.
+func (u *Upstream) Health() UpstreamHealth {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.health
+}
+
+// Ready returns an error when the latest probe failed.
+func (u *Upstream) Ready() error {
+	h := u.Health()
+	if h.Reachable {
+		return nil
+	}
+
+	if h.Error == "" {
+		return fmt.Errorf("%w: not probed yet", ErrUpstreamUnavailable)
+	}
+
+	return fmt.Errorf("%w: %s", ErrUpstreamUnavailable, h.Error)
+}
+
+// probe pings the upstream on warmConn connections at once, so the pool
+// holds that many established connections for the next writes.
+func (u *Upstream) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	start := u.clock.Now()
+
+	conns := make([]*sql.Conn, 0, u.warmConn)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	err := u.db.PingContext(ctx)
+
+	for i := 1; err == nil && i < u.warmConn; i++ {
+		var c *sql.Conn
+
+		if c, err = u.db.Conn(ctx); err == nil {
+			conns = append(conns, c)
+			err = c.PingContext(ctx)
+		}
+	}
+
+	stats := u.db.Stats()
+
+	if e, ok := u.record(err, start, stats); ok {
+		// published once unlocked, handlers may read the health
+		u.events.Publish(e)
+	}
+
+	return err
+}
+
+// record stores the result of a probe, and returns the event to publish
+// when the upstream went down or came back up.
+func (u *Upstream) record(err error, start time.Time, stats sql.DBStats) (events.Event, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var (
+		e       events.Event
+		changed bool
+	)
+
+	switch {
+	case err != nil && (u.health.Reachable || u.health.CheckedAt.IsZero()):
+		if u.health.Reachable {
+			log.Error().Err(err).Msg("upstream became unreachable")
+		}
+
+		e, changed = events.Event{Kind: events.UpstreamDown, Err: err}, true
+	case err == nil && !u.health.Reachable && !u.health.CheckedAt.IsZero():
+		log.Info().Msg("upstream is reachable again")
+
+		e, changed = events.Event{Kind: events.UpstreamUp}, true
+	}
+
+	u.health.Reachable = err == nil
+	u.health.CheckedAt = u.clock.Now()
+	u.health.LatencyMS = float64(u.health.CheckedAt.Sub(start).Microseconds()) / 1000
+	u.health.OpenConnections = stats.OpenConnections
+	u.health.IdleConnections = stats.Idle
+	u.health.Error = ""
+
+	if err != nil {
+		u.health.Error = err.Error()
+	} else {
+		u.health.LastOKAt = u.health.CheckedAt
+	}
+
+	return e, changed
+}
+
+// run probes the upstream on the interval until the context is done.
+func (u *Upstream) run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.probe(ctx)
+		case <-u.reprobe:
+			u.probe(ctx)
+		}
+	}
+}
+
+func (u *Upstream) statTable() pgwire.VirtualTable {
+	return pgwire.VirtualTable{
+		Columns: []pgwire.VirtualColumn{
+			{Name: "reachable", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "checked_at", Type: sqlgen.SQLiteColTypeText},
+			{Name: "last_ok_at", Type: sqlgen.SQLiteColTypeText},
+			{Name: "latency_ms", Type: sqlgen.SQLiteColTypeReal},
+			{Name: "error", Type: sqlgen.SQLiteColTypeText},
+			{Name: "open_connections", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "idle_connections", Type: sqlgen.SQLiteColTypeInteger},
+		},
+		Rows: func() [][]any {
+			h := u.Health()
+
+			var errMsg any
+			if h.Error != "" {
+				errMsg = h.Error
+			}
+
+			return [][]any{{
+				h.Reachable,
+				timestamp(h.CheckedAt),
+				timestamp(h.LastOKAt),
+				h.LatencyMS,
+				errMsg,
+				h.OpenConnections,
+				h.IdleConnections,
+			}}
+		},
+	}
+}
@@ -0,0 +1,178 @@
+package queryproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/proxyproto"
+	"github.com/rs/zerolog/log"
+)
+
+type listener struct {
+	network string
+	address string
+	policy  pgwire.Policy
+
+	// proxyProtocol reads the PROXY protocol header
+	// sent by a load balancer in front of the listener.
+	proxyProtocol bool
+
+	keys *keyPair
+}
+
+// keyPair is a listener's TLS certificate, loaded from its
+// files again by reload when they've been rotated.
+type keyPair struct {
+	cert, key string
+	pair      atomic.Pointer[tls.Certificate]
+}
+
+func loadKeyPair(cert, key string) (*keyPair, error) {
+	k := &keyPair{cert: cert, key: key}
+
+	return k, k.reload()
+}
+
+func (k *keyPair) reload() error {
+	pair, err := tls.LoadX509KeyPair(k.cert, k.key)
+	if err != nil {
+		return err
+	}
+
+	k.pair.Store(&pair)
+
+	return nil
+}
+
+func (k *keyPair) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.pair.Load(), nil
+}
+
+// proxyHeaderTimeout bounds the wait for a PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// parseListener parses a listener spec, one of:
+//
+//	tcp://host:port
+//	tls://host:port?cert=/path/cert.pem&key=/path/key.pem
+//	unix:///path/to/.s.PGSQL.5433
+//
+// with the options auth (trust or upstream), readonly and proxyprotocol. A tcp
+// listener given a cert and key accepts TLS, a tls listener requires it.
+func parseListener(spec string) (listener, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return listener{}, fmt.Errorf("parse listener %q: %w", spec, err)
+	}
+
+	l := listener{policy: pgwire.Policy{Listener: spec}}
+
+	switch u.Scheme {
+	case "tcp", "tls":
+		l.network, l.address = "tcp", u.Host
+	case "unix":
+		l.network, l.address = "unix", u.Path
+	default:
+		return listener{}, fmt.Errorf("listener %q: unknown scheme %q", spec, u.Scheme)
+	}
+
+	opts := u.Query()
+
+	switch auth := opts.Get("auth"); auth {
+	case "", pgwire.AuthTrust, pgwire.AuthUpstream:
+		l.policy.Auth = auth
+	default:
+		return listener{}, fmt.Errorf("listener %q: unknown auth %q", spec, auth)
+	}
+
+	if v := opts.Get("readonly"); v != "" {
+		if l.policy.ReadOnly, err = strconv.ParseBool(v); err != nil {
+			return listener{}, fmt.Errorf("listener %q: parse readonly: %w", spec, err)
+		}
+	}
+
+	if v := opts.Get("proxyprotocol"); v != "" {
+		if l.proxyProtocol, err = strconv.ParseBool(v); err != nil {
+			return listener{}, fmt.Errorf("listener %q: parse proxyprotocol: %w", spec, err)
+		}
+	}
+
+	if cert, key := opts.Get("cert"), opts.Get("key"); cert != "" || key != "" {
+		if l.keys, err = loadKeyPair(cert, key); err != nil {
+			return listener{}, fmt.Errorf("listener %q: load tls key pair: %w", spec, err)
+		}
+
+		l.policy.TLS = &tls.Config{GetCertificate: l.keys.certificate, MinVersion: tls.VersionTLS12}
+	}
+
+	if u.Scheme == "tls" {
+		if l.policy.TLS == nil {
+			return listener{}, fmt.Errorf("listener %q: tls needs a cert and key", spec)
+		}
+
+		l.policy.RequireTLS = true
+	}
+
+	return l, nil
+}
+
+func (l listener) listen() (net.Listener, error) {
+	if l.network == "unix" {
+		// a socket left behind by an unclean exit stops the listen
+		if fi, err := os.Stat(l.address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.address)
+		}
+	}
+
+	lis, err := net.Listen(l.network, l.address)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s %s: %w", l.network, l.address, err)
+	}
+
+	return lis, nil
+}
+
+// serve accepts connections until the listener is closed.
+func (l listener) serve(ctx context.Context, lis net.Listener, server *pgwire.Server) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Error().Err(err).Msg("accept err")
+
+			continue
+		}
+
+		go l.handle(conn, server)
+	}
+}
+
+func (l listener) handle(conn net.Conn, server *pgwire.Server) {
+	if l.proxyProtocol {
+		// connections without a header are refused, the
+		// listener should only be reachable by the proxy.
+		c, err := proxyproto.Read(conn, proxyHeaderTimeout)
+		if err != nil {
+			log.Error().Err(err).Msgf("proxy protocol from %s", conn.RemoteAddr())
+			conn.Close()
+
+			return
+		}
+
+		conn = c
+	}
+
+	server.HandlePolicy(conn, l.policy)
+}
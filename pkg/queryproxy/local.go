@@ -0,0 +1,91 @@
+package queryproxy
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/mattn/go-sqlite3"
+)
+
+// openLocal opens the local database for reads, applying the configured
+// pragmas to each connection as it's opened. The connections are read only
+// and can't attach other databases, so writes smuggled into a read, e.g.
+// "SELECT 1; DELETE FROM names", fail.
+func openLocal(cfg config.LocalConfig) *sql.DB {
+	db := sql.OpenDB(localConnector{
+		dsn:    readOnly(cfg.Path),
+		driver: localDriver(cfg.Pragmas, true),
+	})
+
+	if cfg.MaxReadConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxReadConns)
+	}
+
+	return db
+}
+
+// openAnalyze opens the local database for ANALYZE, which the read
+// connections can't run as it writes the planner statistics.
+func openAnalyze(cfg config.LocalConfig) *sql.DB {
+	db := sql.OpenDB(localConnector{
+		dsn:    cfg.Path,
+		driver: localDriver(cfg.Pragmas, false),
+	})
+
+	db.SetMaxOpenConns(1)
+
+	return db
+}
+
+// readOnly is the dsn opening the database file read only.
+func readOnly(path string) string {
+	return "file:" + path + "?mode=ro"
+}
+
+func localDriver(pragmas []string, readOnly bool) *sqlite3.SQLiteDriver {
+	return &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if readOnly {
+				conn.SetLimit(sqlite3.SQLITE_LIMIT_ATTACHED, 0)
+			}
+
+			for _, p := range pragmas {
+				// the journal mode is stored in the file, the
+				// replication sets it, read connections can't
+				if readOnly && strings.HasPrefix(strings.ToLower(strings.TrimSpace(p)), "journal_mode") {
+					continue
+				}
+
+				if _, err := conn.Exec("PRAGMA "+p, nil); err != nil {
+					return fmt.Errorf("pragma %s: %w", p, err)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// readDriver is the sql driver of the tenants' read connections.
+const readDriver = "sqledge-read"
+
+func init() {
+	sql.Register(readDriver, localDriver(nil, true))
+}
+
+type localConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c localConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c localConnector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,71 @@
+package queryproxy_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/queryproxy"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sqledge.db")
+
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec("PRAGMA journal_mode=wal; CREATE TABLE names (id integer primary key, name text); INSERT INTO names VALUES (1, 'Hello');")
+	require.NoError(t, err)
+
+	local := queryproxy.OpenLocal(config.LocalConfig{Path: path, Pragmas: []string{"journal_mode=wal", "busy_timeout=5000"}})
+	t.Cleanup(func() { local.Close() })
+
+	server := pgwire.NewServer(pgwire.Config{Schema: "public"}, nil, local)
+	server.AddVirtualTable("sqledge_stat_test", pgwire.VirtualTable{
+		Columns: []pgwire.VirtualColumn{{Name: "name", Type: sqlgen.SQLiteColTypeText}},
+		Rows:    func() [][]any { return [][]any{{"a"}} },
+	})
+
+	ctx := context.Background()
+
+	for _, query := range []string{
+		"SELECT 1; DELETE FROM names",
+		"WITH ids AS (SELECT 1) SELECT 1; INSERT INTO names VALUES (2, 'World')",
+		"SELECT 1; ATTACH '" + filepath.Join(t.TempDir(), "other.db") + "' AS other",
+	} {
+		_, err := server.Read(ctx, "", query, nil)
+		assert.Error(t, err, query)
+	}
+
+	var names []string
+
+	rows, err := db.Query("SELECT name FROM names")
+	require.NoError(t, err)
+
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+
+		names = append(names, name)
+	}
+
+	require.NoError(t, rows.Close())
+	assert.Equal(t, []string{"Hello"}, names)
+
+	// reads, and the virtual tables' temporary tables, still work
+	res, err := server.Read(ctx, "", "SELECT name FROM names", nil)
+	require.NoError(t, err)
+	assert.Equal(t, [][]any{{"Hello"}}, res.Rows)
+
+	res, err = server.Read(ctx, "", "SELECT name FROM sqledge_stat_test", nil)
+	require.NoError(t, err)
+	assert.Equal(t, [][]any{{"a"}}, res.Rows)
+}
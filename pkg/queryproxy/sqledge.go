@@ -3,71 +3,328 @@ package queryproxy
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
 	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/events"
+	"github.com/gemini-kenshi/pgreplsql/pkg/keys"
 	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/gemini-kenshi/pgreplsql/pkg/tenant"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog/log"
 )
 
 func Run(ctx context.Context, cfg *config.Config) error {
-	localDB, err := sql.Open("sqlite3", cfg.Local.Path)
-	if err != nil {
-		return fmt.Errorf("connect to local db: %w", err)
+	_, err := Start(ctx, cfg)
+	return err
+}
+
+// Proxy is a started proxy.
+type Proxy struct {
+	// Server handles the client connections.
+	*pgwire.Server
+	// Upstream tracks the upstream's reachability.
+	Upstream *Upstream
+
+	listeners []listener
+}
+
+// ReloadKeys loads the listeners' TLS certificates and keys from their
+// files again, new connections use the rotated ones.
+func (p *Proxy) ReloadKeys() error {
+	var errs []error
+
+	for _, l := range p.listeners {
+		if l.keys == nil {
+			continue
+		}
+
+		if err := l.keys.reload(); err != nil {
+			errs = append(errs, fmt.Errorf("listener %q: reload tls key pair: %w", l.policy.Listener, err))
+		}
 	}
 
+	return errors.Join(errs...)
+}
+
+// Options are the proxy's dependencies that aren't configured, the
+// defaults are used for the zero values.
+type Options struct {
+	// Clock stamps the sessions and upstream probes, and the generated
+	// keys, the system clock when nil.
+	Clock clock.Clock
+	// IDs generates the keys filled into forwarded inserts, from the
+	// clock and crypto/rand when nil.
+	IDs keys.IDGenerator
+	// Budget is the memory budget shared with the replication, nil
+	// doesn't limit the results held in memory.
+	Budget *budget.Budget
+	// Events is the bus shared with the replication, schema changes
+	// drop the proxy's caches and the upstream's health is published
+	// on it. Nil leaves the proxy on its own.
+	Events *events.Bus
+}
+
+// Start starts the proxy, returning the server
+// handling the client connections.
+func Start(ctx context.Context, cfg *config.Config) (*Proxy, error) {
+	return StartWith(ctx, cfg, Options{})
+}
+
+// StartWith starts the proxy with the options, for tests and
+// simulations replacing the clock or the key generator.
+func StartWith(ctx context.Context, cfg *config.Config, opts Options) (*Proxy, error) {
+	localDB := openLocal(cfg.Local)
+
 	log.Debug().Msg("connected to local")
 
-	remoteDB, err := sql.Open("pgx", cfg.PostgresConnString())
+	connCfg, err := pgx.ParseConfig(cfg.UpstreamConnString("proxy"))
 	if err != nil {
-		return fmt.Errorf("connect to upstream db: %w", err)
+		return nil, fmt.Errorf("parse upstream config: %w", err)
+	}
+
+	var server *pgwire.Server
+
+	// notices are relayed to the session using the connection,
+	// there's no session for the notices raised before serving.
+	connCfg.OnNotice = func(c *pgconn.PgConn, n *pgconn.Notice) {
+		if server != nil {
+			server.OnNotice(c, n)
+		}
 	}
 
-	log.Debug().Msgf("connected to remote %q, pinging", cfg.PostgresConnString())
+	remoteDB := stdlib.OpenDB(*connCfg)
+
+	log.Debug().Msgf("connected to remote %q, pinging", cfg.UpstreamConnString("proxy"))
 
-	pingCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
+	upstream := newUpstream(remoteDB, cfg.Proxy.UpstreamWarmConns, opts.Clock, opts.Events)
 
-	if err := remoteDB.PingContext(pingCtx); err != nil {
-		return fmt.Errorf("ping upstream db: %w", err)
+	// the warm-up probe opens the pool's connections before the
+	// first client write needs one.
+	if err := upstream.probe(ctx); err != nil {
+		return nil, fmt.Errorf("ping upstream db: %w", err)
 	}
 
-	log.Debug().Msgf("connected to remote db, listening on %s:%d", cfg.Proxy.Address, cfg.Proxy.Port)
+	listeners, err := proxyListeners(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Proxy.Address, cfg.Proxy.Port))
+	keyDefaults, err := keys.ParseDefaults(cfg.Proxy.KeyDefaults)
 	if err != nil {
-		log.Fatal().Msg(err.Error())
+		return nil, err
+	}
+
+	var hostRules []pgwire.HostRule
+
+	for _, r := range cfg.Proxy.HostRules {
+		rule, err := pgwire.ParseHostRule(r)
+		if err != nil {
+			return nil, err
+		}
+
+		hostRules = append(hostRules, rule)
+	}
+
+	var quotas []pgwire.Quota
+
+	for _, q := range cfg.Proxy.Quotas {
+		quota, err := pgwire.ParseQuota(q)
+		if err != nil {
+			return nil, err
+		}
+
+		quotas = append(quotas, quota)
+	}
+
+	for _, tag := range append(cfg.Proxy.DDLAllow, cfg.Proxy.DDLDeny...) {
+		if !pgwire.IsDDLCommand(tag) {
+			return nil, fmt.Errorf("unknown ddl command: %q", tag)
+		}
+	}
+
+	var (
+		tenants func(name string) (*sql.DB, error)
+		// analyzed are the tenants' databases opened for ANALYZE
+		analyzed *tenant.Files
+	)
+
+	if cfg.Tenant.Column != "" {
+		files := tenant.NewReadOnlyFiles(cfg.Tenant.Dir, readDriver)
+		analyzed = tenant.NewFiles(cfg.Tenant.Dir, "sqlite3")
+
+		go func() {
+			<-ctx.Done()
+			files.Close()
+			analyzed.Close()
+		}()
+
+		tenants = func(name string) (*sql.DB, error) {
+			db, _, err := files.Open(name, false)
+			return db, err
+		}
+	}
+
+	analyzeDB := openAnalyze(cfg.Local)
+
+	analyze := func(ctx context.Context, name, stmt string) error {
+		db := analyzeDB
+
+		if name != "" && analyzed != nil {
+			var err error
+			if db, _, err = analyzed.Open(name, false); err != nil {
+				return err
+			}
+		}
+
+		_, err := db.ExecContext(ctx, stmt)
+
+		return err
+	}
+
+	server = pgwire.NewServer(pgwire.Config{
+		Schema:      cfg.Upstream.Schema,
+		Passthrough: cfg.Proxy.Passthrough,
+
+		IdleInTransactionTimeout: cfg.Proxy.IdleInTransactionTimeout,
+
+		SpoolThreshold: cfg.Proxy.SpoolThreshold,
+		SpoolDir:       cfg.Proxy.SpoolDir,
+
+		HostRules:    hostRules,
+		Authenticate: UpstreamAuth(cfg),
+
+		UpstreamReady: upstream.Ready,
+
+		ReadRetries:      cfg.Proxy.ReadRetries,
+		ReadRetryBackoff: cfg.Proxy.ReadRetryBackoff,
+
+		Tenant:           tenants,
+		TenantByDatabase: cfg.Tenant.ByDatabase,
+		Analyze:          analyze,
+
+		DDLAllow: cfg.Proxy.DDLAllow,
+		DDLDeny:  cfg.Proxy.DDLDeny,
+
+		DDLLockTimeout:  cfg.Proxy.DDLLockTimeout,
+		DDLRetries:      cfg.Proxy.DDLRetries,
+		DDLRetryBackoff: cfg.Proxy.DDLRetryBackoff,
+
+		CatalogPassthrough: cfg.Proxy.CatalogPassthrough,
+		CatalogCacheTTL:    cfg.Proxy.CatalogCacheTTL,
+
+		WriteBatchSize:  cfg.Proxy.WriteBatchSize,
+		KeyDefaults:     keyDefaults,
+		MaxMessageBytes: cfg.Proxy.MaxMessageBytes,
+
+		Firewall: pgwire.ReadFirewall{
+			MaxJoins:      cfg.Proxy.MaxJoins,
+			DenyFunctions: cfg.Proxy.DenyFunctions,
+			LimitTables:   cfg.Proxy.LimitTables,
+			LimitRows:     cfg.Proxy.LimitRows,
+		},
+		Quotas:      quotas,
+		ShadowEvery: cfg.Proxy.ShadowEvery,
+
+		Timestamps: cfg.Local.Timestamps,
+
+		Clock:  opts.Clock,
+		IDs:    opts.IDs,
+		Budget: opts.Budget,
+	}, remoteDB, localDB)
+
+	server.AddVirtualTable("sqledge_stat_upstream", upstream.statTable())
+
+	opts.Events.Handle(events.SchemaChanged, func(e events.Event) {
+		server.SchemaChanged(e.Table)
+	})
+
+	go upstream.run(ctx, cfg.Proxy.UpstreamProbeInterval)
+
+	var liss []net.Listener
+
+	for _, l := range listeners {
+		lis, err := l.listen()
+		if err != nil {
+			for _, lis := range liss {
+				lis.Close()
+			}
+
+			return nil, err
+		}
+
+		log.Debug().Msgf("listening on %s %s", l.network, l.address)
+
+		liss = append(liss, lis)
+
+		go l.serve(ctx, lis, server)
 	}
 
 	go func() {
 		defer remoteDB.Close()
 		defer localDB.Close()
-		defer lis.Close()
+		defer analyzeDB.Close()
+
 		<-ctx.Done()
+
+		for _, lis := range liss {
+			lis.Close()
+		}
 	}()
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
+	return &Proxy{Server: server, Upstream: upstream, listeners: listeners}, nil
+}
 
-			conn, err := lis.Accept()
-			if err != nil {
-				log.Error().Err(err).Msg("accept err")
+// proxyListeners returns the configured listeners, or
+// a single tcp listener on the proxy address and port.
+func proxyListeners(cfg *config.Config) ([]listener, error) {
+	if len(cfg.Proxy.Listeners) == 0 {
+		return []listener{{
+			network: "tcp",
+			address: fmt.Sprintf("%s:%d", cfg.Proxy.Address, cfg.Proxy.Port),
+		}}, nil
+	}
 
-				continue
-			}
+	listeners := make([]listener, 0, len(cfg.Proxy.Listeners))
 
-			pgwire.Handle(cfg.Upstream.Schema, remoteDB, localDB, conn)
+	for _, spec := range cfg.Proxy.Listeners {
+		l, err := parseListener(spec)
+		if err != nil {
+			return nil, err
 		}
-	}()
 
-	return nil
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// UpstreamAuth checks passwords by connecting to the upstream as the user.
+func UpstreamAuth(cfg *config.Config) func(ctx context.Context, user, password string) error {
+	return func(ctx context.Context, user, password string) error {
+		connCfg, err := pgconn.ParseConfig(cfg.UpstreamConnString("auth"))
+		if err != nil {
+			return fmt.Errorf("parse upstream config: %w", err)
+		}
+
+		connCfg.User, connCfg.Password = user, password
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		conn, err := pgconn.ConnectConfig(ctx, connCfg)
+		if err != nil {
+			return fmt.Errorf("connect upstream as %q: %w", user, err)
+		}
+
+		return conn.Close(ctx)
+	}
 }
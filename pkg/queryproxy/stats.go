@@ -0,0 +1,110 @@
+package queryproxy
+
+import (
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+)
+
+// AddReplicationTables makes the replication stats queryable through the
+// proxy, as the sqledge_stat_replication and sqledge_stat_tables tables.
+func AddReplicationTables(server *pgwire.Server, stats func() replicate.Stats) {
+	server.AddVirtualTable("sqledge_stat_replication", pgwire.VirtualTable{
+		Columns: []pgwire.VirtualColumn{
+			{Name: "slot_name", Type: sqlgen.SQLiteColTypeText},
+			{Name: "publication", Type: sqlgen.SQLiteColTypeText},
+			{Name: "state", Type: sqlgen.SQLiteColTypeText},
+			{Name: "received_lsn", Type: sqlgen.SQLiteColTypeText},
+			{Name: "applied_lsn", Type: sqlgen.SQLiteColTypeText},
+			{Name: "server_lsn", Type: sqlgen.SQLiteColTypeText},
+			{Name: "snapshot_lsn", Type: sqlgen.SQLiteColTypeText},
+			{Name: "acked_lsn", Type: sqlgen.SQLiteColTypeText},
+			{Name: "lag_bytes", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "last_message_at", Type: sqlgen.SQLiteColTypeText},
+			{Name: "last_applied_at", Type: sqlgen.SQLiteColTypeText},
+			{Name: "apply_rate_bytes", Type: sqlgen.SQLiteColTypeReal},
+			{Name: "catch_up_progress", Type: sqlgen.SQLiteColTypeReal},
+			{Name: "eta_seconds", Type: sqlgen.SQLiteColTypeReal},
+			{Name: "dead_lettered", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "heartbeat_at", Type: sqlgen.SQLiteColTypeText},
+			{Name: "heartbeat_latency_seconds", Type: sqlgen.SQLiteColTypeReal},
+			{Name: "heartbeat_age_seconds", Type: sqlgen.SQLiteColTypeReal},
+		},
+		Rows: func() [][]any {
+			s := stats()
+
+			var eta any
+			if d, ok := s.ETA(); ok {
+				eta = d.Seconds()
+			}
+
+			var latency, age any
+			if d, ok := s.HeartbeatAge(time.Now()); ok {
+				latency, age = s.HeartbeatLatency.Seconds(), d.Seconds()
+			}
+
+			return [][]any{{
+				s.SlotName,
+				s.Publication,
+				s.State,
+				s.ReceivedLSN.String(),
+				s.AppliedLSN.String(),
+				s.ServerLSN.String(),
+				s.SnapshotLSN.String(),
+				s.AckedLSN.String(),
+				int64(s.Lag()),
+				timestamp(s.LastMessageAt),
+				timestamp(s.LastAppliedAt),
+				s.ApplyRate,
+				s.Progress(),
+				eta,
+				s.DeadLettered,
+				timestamp(s.HeartbeatAt),
+				latency,
+				age,
+			}}
+		},
+	})
+
+	server.AddVirtualTable("sqledge_stat_tables", pgwire.VirtualTable{
+		Columns: []pgwire.VirtualColumn{
+			{Name: "table_name", Type: sqlgen.SQLiteColTypeText},
+			{Name: "inserts", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "updates", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "deletes", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "truncates", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "apply_delay_seconds", Type: sqlgen.SQLiteColTypeReal},
+			{Name: "slo_seconds", Type: sqlgen.SQLiteColTypeReal},
+			{Name: "slo_violations", Type: sqlgen.SQLiteColTypeInteger},
+			{Name: "last_violation_at", Type: sqlgen.SQLiteColTypeText},
+		},
+		Rows: func() [][]any {
+			var rows [][]any
+
+			for _, t := range stats().Tables {
+				var slo any
+				if t.SLO > 0 {
+					slo = t.SLO.Seconds()
+				}
+
+				rows = append(rows, []any{
+					t.Name, t.Inserts, t.Updates, t.Deletes, t.Truncates,
+					t.ApplyDelay.Seconds(), slo, t.SLOViolations, timestamp(t.LastViolationAt),
+				})
+			}
+
+			return rows
+		},
+	})
+}
+
+// timestamp formats the time, or null when it isn't set.
+func timestamp(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,66 @@
+package replicate
+
+import (
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// AckDelayConfig holds back the position confirmed to the upstream, so
+// the slot keeps the recent WAL for another consumer, e.g. a backup
+// verifier re-reading it from a slot created at the confirmed position.
+type AckDelayConfig struct {
+	// Duration is how long a flushed position waits to be confirmed.
+	Duration time.Duration
+	// Bytes is how far the confirmed position stays behind the
+	// flushed position.
+	Bytes uint64
+}
+
+func (c AckDelayConfig) enabled() bool {
+	return c.Duration > 0 || c.Bytes > 0
+}
+
+// AckWindow is the position confirmed to the upstream with a delay,
+// a position is confirmed once it's outside both windows.
+type AckWindow struct {
+	cfg     AckDelayConfig
+	acked   pglogrepl.LSN
+	pending []flushedAt
+}
+
+type flushedAt struct {
+	lsn pglogrepl.LSN
+	at  time.Time
+}
+
+// NewAckWindow returns the window confirming positions from start.
+func NewAckWindow(cfg AckDelayConfig, start pglogrepl.LSN) *AckWindow {
+	return &AckWindow{cfg: cfg, acked: start}
+}
+
+// Ack records the flushed position, and returns the position to confirm.
+func (w *AckWindow) Ack(flushed pglogrepl.LSN, now time.Time) pglogrepl.LSN {
+	if w == nil {
+		return flushed
+	}
+
+	if n := len(w.pending); flushed > w.acked && (n == 0 || flushed > w.pending[n-1].lsn) {
+		w.pending = append(w.pending, flushedAt{lsn: flushed, at: now})
+	}
+
+	ready := 0
+
+	for _, p := range w.pending {
+		if flushed < p.lsn || now.Sub(p.at) < w.cfg.Duration || uint64(flushed-p.lsn) < w.cfg.Bytes {
+			break
+		}
+
+		w.acked = p.lsn
+		ready++
+	}
+
+	w.pending = w.pending[ready:]
+
+	return w.acked
+}
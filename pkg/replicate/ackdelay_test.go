@@ -0,0 +1,79 @@
+package replicate_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAckWindow(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	type ack struct {
+		after   time.Duration
+		flushed pglogrepl.LSN
+		want    pglogrepl.LSN
+	}
+
+	for _, test := range []struct {
+		name string
+		cfg  replicate.AckDelayConfig
+		acks []ack
+	}{
+		{
+			name: "duration",
+			cfg:  replicate.AckDelayConfig{Duration: time.Minute},
+			acks: []ack{
+				{after: 0, flushed: 200, want: 100},
+				{after: 30 * time.Second, flushed: 300, want: 100},
+				{after: time.Minute, flushed: 400, want: 200},
+				{after: 2 * time.Minute, flushed: 400, want: 400},
+			},
+		},
+		{
+			name: "bytes",
+			cfg:  replicate.AckDelayConfig{Bytes: 150},
+			acks: []ack{
+				{after: 0, flushed: 200, want: 100},
+				{after: time.Second, flushed: 300, want: 100},
+				{after: 2 * time.Second, flushed: 360, want: 200},
+				{after: 3 * time.Second, flushed: 1000, want: 360},
+			},
+		},
+		{
+			name: "both",
+			cfg:  replicate.AckDelayConfig{Duration: time.Minute, Bytes: 150},
+			acks: []ack{
+				{after: 0, flushed: 200, want: 100},
+				// old enough, but not far enough behind
+				{after: 2 * time.Minute, flushed: 300, want: 100},
+				{after: 3 * time.Minute, flushed: 500, want: 300},
+			},
+		},
+		{
+			name: "held back flush position",
+			cfg:  replicate.AckDelayConfig{Duration: time.Minute},
+			acks: []ack{
+				{after: 0, flushed: 200, want: 100},
+				// a group commit holds the flush position back
+				{after: 2 * time.Minute, flushed: 150, want: 100},
+				{after: 3 * time.Minute, flushed: 250, want: 200},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := replicate.NewAckWindow(test.cfg, 100)
+
+			for _, a := range test.acks {
+				assert.Equal(t, a.want, w.Ack(a.flushed, start.Add(a.after)), "after %s", a.after)
+			}
+		})
+	}
+
+	// without a window positions are confirmed as they're flushed
+	var w *replicate.AckWindow
+	assert.Equal(t, pglogrepl.LSN(200), w.Ack(200, start))
+}
@@ -0,0 +1,66 @@
+package replicate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/verify"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// backfill copies the rows of the tables with copyTable, between transactions,
+// e.g. those created by the transaction just committed. Inserts into a
+// table replace its copied rows until the stream reaches the position it
+// was copied at, as the copy already has the transactions before it.
+func (c *Conn) backfill(ctx context.Context, copyTable func(context.Context, string) (pglogrepl.LSN, error), gen SQLGen, tables []string) {
+	// the apply loop waits for the copies, which the watchdog allows
+	c.stats.setState(StateCopying)
+
+	defer func() {
+		c.stats.looped()
+		c.stats.setState(StateStreaming)
+	}()
+
+	for _, table := range tables {
+		lsn, err := copyTable(ctx, table)
+		if err != nil {
+			// the table is still replicated, only without the rows it missed
+			log.Error().Err(err).Msgf("copy %s, resync it with the resync_table command", table)
+			continue
+		}
+
+		gen.Backfilling(table, lsn)
+		c.stats.copied(table)
+
+		log.Info().Msgf("copied %s at %s", table, lsn)
+	}
+}
+
+// Backfill replaces the local table's rows with the upstream's, and
+// returns the upstream position they were read by.
+func Backfill(ctx context.Context, connStr, schema string, local *sql.DB, table string) (pglogrepl.LSN, error) {
+	upstream, err := upstreamDB(connStr)
+	if err != nil {
+		return 0, err
+	}
+	defer upstream.Close()
+
+	t, err := verify.Describe(ctx, upstream, local, schema, table)
+	if err != nil {
+		return 0, fmt.Errorf("describe %s: %w", table, err)
+	}
+
+	if _, err := verify.Repair(ctx, upstream, local, t, verify.Range{Table: table, Whole: true}); err != nil {
+		return 0, fmt.Errorf("copy %s: %w", table, err)
+	}
+
+	// read after the copy, so it's at or past the copy's snapshot
+	var pos string
+	if err := upstream.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&pos); err != nil {
+		return 0, fmt.Errorf("current position: %w", err)
+	}
+
+	return pglogrepl.ParseLSN(pos)
+}
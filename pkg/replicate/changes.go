@@ -0,0 +1,200 @@
+package replicate
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Change is a row change applied to the local database, or a logical
+// decoding message emitted upstream.
+type Change struct {
+	// Op is insert, update, delete, truncate or message.
+	Op    string `json:"op"`
+	Table string `json:"table,omitempty"`
+	// Row is the new row of inserts and updates, and Old the old row of
+	// updates and deletes, when the upstream sends it; deletes only have
+	// the replica identity's columns. Unchanged TOAST columns are left
+	// out, values are in postgres' text format and numbers are JSON
+	// numbers.
+	Row map[string]any `json:"row,omitempty"`
+	Old map[string]any `json:"old,omitempty"`
+	// Prefix and Content are the message's, emitted upstream with
+	// pg_logical_emit_message(transactional, prefix, content).
+	Prefix  string `json:"prefix,omitempty"`
+	Content string `json:"content,omitempty"`
+	// LSN is the commit position of the change's transaction, or the
+	// message's position for messages emitted outside a transaction.
+	LSN string `json:"lsn"`
+}
+
+// changeBuffer is the size of a subscription's buffer, subscribers
+// that fall this far behind are dropped.
+const changeBuffer = 1024
+
+// Feed publishes the changes of each transaction once it's committed locally.
+type Feed struct {
+	mu   sync.Mutex
+	subs map[chan Change]struct{}
+}
+
+func NewFeed() *Feed {
+	return &Feed{subs: make(map[chan Change]struct{})}
+}
+
+// Subscribe returns the changes committed from now on, and a func ending
+// the subscription. The channel is closed when the subscriber doesn't keep up.
+func (f *Feed) Subscribe() (<-chan Change, func()) {
+	ch := make(chan Change, changeBuffer)
+
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if _, ok := f.subs[ch]; ok {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends the changes to every subscriber.
+func (f *Feed) Publish(changes []Change) {
+	if f == nil || len(changes) == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.subs {
+		for _, c := range changes {
+			select {
+			case ch <- c:
+				continue
+			default:
+			}
+
+			delete(f.subs, ch)
+			close(ch)
+
+			break
+		}
+	}
+}
+
+// changes collects the changes of the transactions being applied,
+// until they're committed locally.
+type changes struct {
+	relations map[uint32]*pglogrepl.RelationMessageV2
+	pending   []Change
+}
+
+func newChanges() *changes {
+	return &changes{relations: make(map[uint32]*pglogrepl.RelationMessageV2)}
+}
+
+// add collects the message's change, or tracks its relation.
+func (c *changes) add(msg pglogrepl.Message, lsn pglogrepl.LSN) {
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessageV2:
+		c.relations[msg.RelationID] = msg
+	case *pglogrepl.InsertMessageV2:
+		c.row("insert", msg.RelationID, msg.Tuple, nil, lsn)
+	case *pglogrepl.UpdateMessageV2:
+		c.row("update", msg.RelationID, msg.NewTuple, msg.OldTuple, lsn)
+	case *pglogrepl.DeleteMessageV2:
+		c.row("delete", msg.RelationID, nil, msg.OldTuple, lsn)
+	case *pglogrepl.TruncateMessageV2:
+		for _, id := range msg.RelationIDs {
+			if rel, ok := c.relations[id]; ok {
+				c.pending = append(c.pending, Change{Op: "truncate", Table: rel.RelationName, LSN: lsn.String()})
+			}
+		}
+	case *pglogrepl.LogicalDecodingMessageV2:
+		if msg.Transactional {
+			for _, m := range messageChanges(msg) {
+				m.LSN = lsn.String()
+				c.pending = append(c.pending, m)
+			}
+		}
+	}
+}
+
+// messageChanges returns the change of a logical decoding message, or
+// nothing for the messages sqledge sends itself.
+func messageChanges(msg *pglogrepl.LogicalDecodingMessageV2) []Change {
+	if msg.Prefix == pgoutput.DropTablePrefix || msg.Prefix == pgoutput.ControlPrefix {
+		return nil
+	}
+
+	return []Change{{Op: "message", Prefix: msg.Prefix, Content: string(msg.Content), LSN: msg.LSN.String()}}
+}
+
+func (c *changes) row(op string, id uint32, row, old *pglogrepl.TupleData, lsn pglogrepl.LSN) {
+	rel, ok := c.relations[id]
+	if !ok {
+		return
+	}
+
+	c.pending = append(c.pending, Change{
+		Op:    op,
+		Table: rel.RelationName,
+		Row:   tupleValues(rel, row),
+		Old:   tupleValues(rel, old),
+		LSN:   lsn.String(),
+	})
+}
+
+// take returns the collected changes, and starts collecting again.
+func (c *changes) take() []Change {
+	out := c.pending
+	c.pending = nil
+
+	return out
+}
+
+func tupleValues(rel *pglogrepl.RelationMessageV2, tuple *pglogrepl.TupleData) map[string]any {
+	if tuple == nil {
+		return nil
+	}
+
+	out := make(map[string]any, len(tuple.Columns))
+
+	for i, col := range tuple.Columns {
+		if i >= len(rel.Columns) {
+			break
+		}
+
+		name := rel.Columns[i].Name
+
+		switch col.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			out[name] = nil
+		case pglogrepl.TupleDataTypeText, pglogrepl.TupleDataTypeBinary:
+			if text, ok := pgoutput.TupleText(rel.Columns[i].DataType, col); ok {
+				out[name] = textValue(rel.Columns[i].DataType, text)
+			}
+		}
+	}
+
+	return out
+}
+
+func textValue(oid uint32, v []byte) any {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		if json.Valid(v) {
+			return json.Number(v)
+		}
+	}
+
+	return string(v)
+}
@@ -0,0 +1,109 @@
+package replicate
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// committed records the transaction the message committed locally. With
+// exactly-once delivery its position was committed with it, so the slot
+// can confirm it right away. With at-least-once delivery it's confirmed
+// once record has recorded the position.
+func (s *slot) committed(msg pglogrepl.Message) {
+	end, ok := commitLSN(msg)
+	if !ok {
+		return
+	}
+
+	if s.delivery != sqlgen.DeliveryAtLeastOnce {
+		s.release(end)
+		return
+	}
+
+	s.unrecorded, s.unrecordedEnd = commitStart(msg), end
+}
+
+// record records the position of the transactions committed locally since
+// the last call, with at-least-once delivery. It must be called between
+// transactions.
+func (s *slot) record(d DBDriver, gen SQLGen) error {
+	if s.unrecordedEnd == 0 {
+		return nil
+	}
+
+	if err := d.Execute(gen.Pos(s.unrecorded.String())); err != nil {
+		return fmt.Errorf("record position: %w", err)
+	}
+
+	s.release(s.unrecordedEnd)
+	s.unrecorded, s.unrecordedEnd = 0, 0
+
+	return nil
+}
+
+// commitStart returns the start of the commit record of the transaction
+// the message commits, the position the local database records.
+func commitStart(msg pglogrepl.Message) pglogrepl.LSN {
+	switch msg := msg.(type) {
+	case *pglogrepl.CommitMessage:
+		return msg.CommitLSN
+	case *pglogrepl.StreamCommitMessageV2:
+		return msg.CommitLSN
+	case *pgoutput.CommitPreparedMessage:
+		return msg.CommitLSN
+	}
+
+	return 0
+}
+
+// duplicates skips transactions that are already committed locally. The
+// upstream streams from the later of the requested position and the
+// slot's confirmed one, so it resends the last local transaction when
+// sqledge stopped after committing it but before confirming it.
+type duplicates struct {
+	// committed is the commit position of the last transaction
+	// applied, starting with the one recorded locally.
+	committed pglogrepl.LSN
+	// before skips the transactions committed before it, after
+	// failing over to a secondary, see SlotConfig.SkipCommittedBefore.
+	before   time.Time
+	skipping bool
+}
+
+// skip reports whether the message belongs to a transaction that's
+// already committed locally.
+func (d *duplicates) skip(msg pglogrepl.Message) bool {
+	switch msg := msg.(type) {
+	case *pglogrepl.BeginMessage:
+		d.skipping = msg.FinalLSN <= d.committed
+
+		if d.skipping {
+			log.Warn().Msgf("skipping transaction %d at %s, it's already committed locally", msg.Xid, msg.FinalLSN)
+		} else if msg.CommitTime.Before(d.before) {
+			log.Debug().Msgf("skipping transaction %d at %s, it was committed before failing over", msg.Xid, msg.FinalLSN)
+
+			d.skipping = true
+		}
+
+		return d.skipping
+	case *pglogrepl.CommitMessage:
+		if d.skipping {
+			d.skipping = false
+			return true
+		}
+
+		d.committed = msg.CommitLSN
+
+		return false
+	case *pglogrepl.RelationMessageV2, *pglogrepl.TypeMessageV2:
+		// the relations are still needed for the transactions after
+		return false
+	}
+
+	return d.skipping
+}
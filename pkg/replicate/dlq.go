@@ -0,0 +1,164 @@
+package replicate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// LimitsConfig bounds the size of a single change, so one pathological
+// row can't wedge the applier. Changes over a limit are written to the
+// dead letter queue in DLQDir and skipped. Zero disables a limit.
+type LimitsConfig struct {
+	// MaxChangeBytes is the largest decoded row change, the sum
+	// of its new and old column values.
+	MaxChangeBytes int
+	// MaxStatementBytes is the largest statement generated for a change,
+	// the values bound as its parameters aren't counted.
+	MaxStatementBytes int
+	DLQDir            string
+}
+
+// dlqPreviewBytes is how much of a dead lettered change's
+// payload is kept in its entry, the rest is only in its payload file.
+const dlqPreviewBytes = 4096
+
+// DeadLetter is an entry of the dead letter queue, the change's full
+// payload is in PayloadFile.
+type DeadLetter struct {
+	LSN    string    `json:"lsn"`
+	Table  string    `json:"table"`
+	Op     string    `json:"op"`
+	Reason string    `json:"reason"`
+	Bytes  int       `json:"bytes"`
+	At     time.Time `json:"at"`
+	// Preview is the start of the payload, truncated to dlqPreviewBytes.
+	Preview     string `json:"preview"`
+	PayloadFile string `json:"payload_file"`
+}
+
+// changeBytes is the size of the row change's column values.
+func changeBytes(msg pglogrepl.Message) int {
+	n := 0
+
+	for _, tuple := range changeTuples(msg) {
+		if tuple == nil {
+			continue
+		}
+
+		for _, col := range tuple.Columns {
+			n += len(col.Data)
+		}
+	}
+
+	return n
+}
+
+func changeTuples(msg pglogrepl.Message) []*pglogrepl.TupleData {
+	switch msg := msg.(type) {
+	case *pglogrepl.InsertMessageV2:
+		return []*pglogrepl.TupleData{msg.Tuple}
+	case *pglogrepl.UpdateMessageV2:
+		return []*pglogrepl.TupleData{msg.NewTuple, msg.OldTuple}
+	case *pglogrepl.DeleteMessageV2:
+		return []*pglogrepl.TupleData{msg.OldTuple}
+	}
+
+	return nil
+}
+
+// exceeded returns why the row change is over the limits, or an empty
+// reason. query is the generated statement, empty before generating it.
+func (l LimitsConfig) exceeded(msg pglogrepl.Message, query string) string {
+	if changeTuples(msg) == nil {
+		return ""
+	}
+
+	if n := changeBytes(msg); l.MaxChangeBytes > 0 && n > l.MaxChangeBytes {
+		return fmt.Sprintf("change of %d bytes is over the %d byte limit", n, l.MaxChangeBytes)
+	}
+
+	if l.MaxStatementBytes > 0 && len(query) > l.MaxStatementBytes {
+		return fmt.Sprintf("statement of %d bytes is over the %d byte limit", len(query), l.MaxStatementBytes)
+	}
+
+	return ""
+}
+
+// deadLetter writes the row change to the dead letter queue, as an entry
+// with a truncated preview and a file with the change's full payload.
+func (c *Conn) deadLetter(dir string, lsn pglogrepl.LSN, msg pglogrepl.Message, reason string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create dlq dir: %w", err)
+	}
+
+	change := Change{LSN: lsn.String()}
+
+	var id uint32
+
+	switch msg := msg.(type) {
+	case *pglogrepl.InsertMessageV2:
+		change.Op, id = "insert", msg.RelationID
+	case *pglogrepl.UpdateMessageV2:
+		change.Op, id = "update", msg.RelationID
+	case *pglogrepl.DeleteMessageV2:
+		change.Op, id = "delete", msg.RelationID
+	}
+
+	tuples := changeTuples(msg)
+
+	if rel, ok := c.changes.relations[id]; ok {
+		change.Table = rel.Namespace + "." + rel.RelationName
+
+		switch change.Op {
+		case "insert":
+			change.Row = tupleValues(rel, tuples[0])
+		case "update":
+			change.Row, change.Old = tupleValues(rel, tuples[0]), tupleValues(rel, tuples[1])
+		case "delete":
+			change.Old = tupleValues(rel, tuples[0])
+		}
+	}
+
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("encode dead letter: %w", err)
+	}
+
+	c.dlqSeq++
+	name := fmt.Sprintf("%016X_%d", uint64(lsn), c.dlqSeq)
+
+	payloadFile := filepath.Join(dir, name+".payload.json")
+	if err := os.WriteFile(payloadFile, payload, 0o644); err != nil {
+		return fmt.Errorf("write dead letter payload: %w", err)
+	}
+
+	entry := DeadLetter{
+		LSN:         change.LSN,
+		Table:       change.Table,
+		Op:          change.Op,
+		Reason:      reason,
+		Bytes:       changeBytes(msg),
+		At:          c.clock.Now().UTC(),
+		Preview:     string(payload[:min(len(payload), dlqPreviewBytes)]),
+		PayloadFile: filepath.Base(payloadFile),
+	}
+
+	b, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode dead letter: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), b, 0o644); err != nil {
+		return fmt.Errorf("write dead letter: %w", err)
+	}
+
+	log.Warn().Msgf("skipped %s on %s at %s: %s, written to %s", change.Op, change.Table, change.LSN, reason, dir)
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package replicate_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func textTuple(values ...string) *pglogrepl.TupleData {
+	tuple := &pglogrepl.TupleData{}
+	for _, v := range values {
+		tuple.Columns = append(tuple.Columns, &pglogrepl.TupleDataColumn{DataType: pglogrepl.TupleDataTypeText, Data: []byte(v)})
+	}
+
+	return tuple
+}
+
+func TestLimitsExceeded(t *testing.T) {
+	insert := &pglogrepl.InsertMessageV2{InsertMessage: pglogrepl.InsertMessage{Tuple: textTuple("1", "0123456789")}}
+	update := &pglogrepl.UpdateMessageV2{UpdateMessage: pglogrepl.UpdateMessage{
+		NewTuple: textTuple("1", "01234"),
+		OldTuple: textTuple("1", "56789"),
+	}}
+
+	// the change is the sum of its new and old values
+	limits := replicate.LimitsConfig{MaxChangeBytes: 11}
+	assert.Empty(t, limits.Exceeded(insert, ""))
+	assert.Equal(t, "change of 12 bytes is over the 11 byte limit", limits.Exceeded(update, ""))
+
+	limits.MaxChangeBytes = 10
+	assert.Equal(t, "change of 11 bytes is over the 10 byte limit", limits.Exceeded(insert, ""))
+
+	// the statement is only checked once it's generated
+	limits = replicate.LimitsConfig{MaxStatementBytes: 20}
+	assert.Empty(t, limits.Exceeded(insert, ""))
+	assert.Empty(t, limits.Exceeded(insert, "INSERT INTO t VALUES"))
+	assert.Equal(t, "statement of 21 bytes is over the 20 byte limit", limits.Exceeded(insert, "INSERT INTO t VALUES "))
+
+	// other messages and zero limits aren't limited
+	assert.Empty(t, limits.Exceeded(&pglogrepl.RelationMessageV2{}, strings.Repeat("x", 100)))
+	assert.Empty(t, replicate.LimitsConfig{}.Exceeded(update, strings.Repeat("x", 100)))
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dlq")
+
+	rel := &pglogrepl.RelationMessageV2{RelationMessage: pglogrepl.RelationMessage{
+		RelationID:   1,
+		Namespace:    "public",
+		RelationName: "names",
+		Columns: []*pglogrepl.RelationMessageColumn{
+			{Name: "id", DataType: pgtype.Int4OID},
+			{Name: "name", DataType: pgtype.TextOID},
+		},
+	}}
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	conn := replicate.NewDLQConn(rel, clock.NewManual(at))
+
+	name := strings.Repeat("a", 5000)
+	msg := &pglogrepl.UpdateMessageV2{UpdateMessage: pglogrepl.UpdateMessage{
+		RelationID: 1,
+		NewTuple:   textTuple("1", name),
+		OldTuple:   textTuple("1", "b"),
+	}}
+
+	require.NoError(t, conn.DeadLetter(dir, 0x16B3748, msg, "too big"))
+	require.NoError(t, conn.DeadLetter(dir, 0x16B3748, msg, "too big"))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	// changes at the same position get their own files
+	b, err := os.ReadFile(filepath.Join(dir, "00000000016B3748_1.json"))
+	require.NoError(t, err)
+
+	var entry replicate.DeadLetter
+	require.NoError(t, json.Unmarshal(b, &entry))
+
+	assert.Equal(t, "0/16B3748", entry.LSN)
+	assert.Equal(t, "public.names", entry.Table)
+	assert.Equal(t, "update", entry.Op)
+	assert.Equal(t, "too big", entry.Reason)
+	assert.Equal(t, 5003, entry.Bytes)
+	assert.Equal(t, at, entry.At)
+	assert.Equal(t, "00000000016B3748_1.payload.json", entry.PayloadFile)
+	assert.Len(t, entry.Preview, 4096)
+
+	// the payload file has the whole change
+	b, err = os.ReadFile(filepath.Join(dir, entry.PayloadFile))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), entry.Preview))
+
+	var change replicate.Change
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	require.NoError(t, dec.Decode(&change))
+	assert.Equal(t, replicate.Change{
+		Op:    "update",
+		Table: "public.names",
+		Row:   map[string]any{"id": json.Number("1"), "name": name},
+		Old:   map[string]any{"id": json.Number("1"), "name": "b"},
+		LSN:   "0/16B3748",
+	}, change)
+
+	_, err = os.Stat(filepath.Join(dir, "00000000016B3748_2.json"))
+	assert.NoError(t, err)
+}
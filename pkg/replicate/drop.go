@@ -0,0 +1,74 @@
+package replicate
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// droppedTable returns the table dropped by the message, or
+// an empty name when the message isn't a drop of a table in schema.
+func droppedTable(msg *pglogrepl.LogicalDecodingMessageV2, schema string) string {
+	if msg.Prefix != pgoutput.DropTablePrefix {
+		return ""
+	}
+
+	ns, name, ok := strings.Cut(string(msg.Content), ".")
+	if !ok || ns != schema {
+		return ""
+	}
+
+	return name
+}
+
+// DropMissingTables drops the local tables that no longer exist upstream,
+// as tables dropped while replication wasn't running aren't streamed.
+func (c *Conn) DropMissingTables(schema string, local map[string]map[string]sqlgen.ColDef, d DBDriver, gen SQLGen) error {
+	upstream, err := c.queryStrings(fmt.Sprintf(
+		"SELECT tablename FROM pg_tables WHERE schemaname = '%s';",
+		schema,
+	))
+	if err != nil {
+		return fmt.Errorf("find upstream tables: %w", err)
+	}
+
+	var missing []string
+
+	for name := range local {
+		if sqlgen.Internal(name) || strings.HasPrefix(name, "sqlite_") || slices.Contains(upstream, name) {
+			continue
+		}
+
+		missing = append(missing, name)
+	}
+
+	sort.Strings(missing)
+
+	for _, name := range missing {
+		log.Info().Msgf("dropping local table %q, it no longer exists upstream", name)
+
+		msg := &pglogrepl.LogicalDecodingMessageV2{
+			LogicalDecodingMessage: pglogrepl.LogicalDecodingMessage{
+				Prefix:  pgoutput.DropTablePrefix,
+				Content: []byte(schema + "." + name),
+			},
+		}
+
+		query, err := gen.DropTable(name)
+		if err != nil {
+			return fmt.Errorf("generate sql: %w", err)
+		}
+
+		if err := apply(d, msg, sqlgen.Statement{Query: query}); err != nil {
+			return fmt.Errorf("drop table %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package replicate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// The errors replication fails with are wrapped in these, so callers can
+// tell the failures apart with errors.Is.
+var (
+	// ErrUpstreamUnavailable is returned when the upstream can't be
+	// connected to.
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	// ErrSlotMissing is returned when the replication slot doesn't
+	// exist, e.g. it wasn't created or it was dropped by the slot guard.
+	ErrSlotMissing = errors.New("replication slot missing")
+	// ErrSchemaMismatch is returned when a change doesn't match the
+	// local table, e.g. its table or columns are missing.
+	ErrSchemaMismatch = errors.New("change doesn't match the local schema")
+	// ErrApplyConflict is returned when a change conflicts with a local
+	// row, e.g. it violates a unique constraint.
+	ErrApplyConflict = errors.New("change conflicts with the local rows")
+)
+
+// generateError wraps the errors of generating a change's sql.
+func generateError(err error) error {
+	if errors.Is(err, sqlgen.ErrUnknownRelation) || errors.Is(err, sqlgen.ErrUnknownType) {
+		return fmt.Errorf("%w: %w", ErrSchemaMismatch, err)
+	}
+
+	return err
+}
+
+// applyError wraps the errors of applying a change to the local database.
+func applyError(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_CONSTRAINT:
+		return fmt.Errorf("%w: %w", ErrApplyConflict, err)
+	case sqlite3.SQLITE_ERROR:
+		msg := sqliteErr.Error()
+
+		if strings.Contains(msg, "no such table") || strings.Contains(msg, "no such column") ||
+			strings.Contains(msg, "has no column named") {
+			return fmt.Errorf("%w: %w", ErrSchemaMismatch, err)
+		}
+	}
+
+	return err
+}
+
+// startError wraps the errors of starting replication from the slot.
+func startError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42704" {
+		// undefined_object, the slot doesn't exist
+		return fmt.Errorf("%w: %w", ErrSlotMissing, err)
+	}
+
+	return err
+}
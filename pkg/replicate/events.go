@@ -0,0 +1,28 @@
+package replicate
+
+import (
+	"github.com/gemini-kenshi/pgreplsql/pkg/events"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/jackc/pglogrepl"
+)
+
+// publishApplied publishes the transaction the message committed locally.
+func (c *Conn) publishApplied(msg pglogrepl.Message) {
+	if lsn, ok := commitLSN(msg); ok {
+		c.events.Publish(events.Event{Kind: events.ChangeApplied, LSN: lsn})
+	}
+}
+
+// commitLSN returns the end of the transaction the message commits.
+func commitLSN(msg pglogrepl.Message) (pglogrepl.LSN, bool) {
+	switch msg := msg.(type) {
+	case *pglogrepl.CommitMessage:
+		return msg.TransactionEndLSN, true
+	case *pglogrepl.StreamCommitMessageV2:
+		return msg.TransactionEndLSN, true
+	case *pgoutput.CommitPreparedMessage:
+		return msg.EndLSN, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,64 @@
+package replicate
+
+import (
+	"context"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/jackc/pglogrepl"
+)
+
+// Ack exposes the slot's flush position bookkeeping to the tests.
+type Ack struct{ ack }
+
+func (a *Ack) HandOff(msg pglogrepl.Message)                { a.handOff(msg) }
+func (a *Ack) Release(lsn pglogrepl.LSN)                    { a.release(lsn) }
+func (a *Ack) Flushed(received pglogrepl.LSN) pglogrepl.LSN { return a.flushed(received) }
+
+var (
+	WriteMigration  = writeMigration
+	MigrationLSN    = migrationLSN
+	QualifiedTables = qualifiedTables
+)
+
+func (l LimitsConfig) Exceeded(msg pglogrepl.Message, query string) string {
+	return l.exceeded(msg, query)
+}
+
+// NewDLQConn returns a connection that only dead letters changes,
+// of the relation's table and stamped by the clock.
+func NewDLQConn(rel *pglogrepl.RelationMessageV2, clk clock.Clock) *Conn {
+	c := &Conn{changes: newChanges(), clock: clk}
+	c.changes.add(rel, 0)
+
+	return c
+}
+
+func (c *Conn) DeadLetter(dir string, lsn pglogrepl.LSN, msg pglogrepl.Message, reason string) error {
+	return c.deadLetter(dir, lsn, msg, reason)
+}
+
+// AdvanceTarget is advanceTarget with the samples of the positions at
+// the times, it returns how many samples are left.
+func AdvanceTarget(lsns []pglogrepl.LSN, at []time.Time, cutoff time.Time) (pglogrepl.LSN, int, bool) {
+	samples := make([]walSample, len(lsns))
+	for i := range lsns {
+		samples[i] = walSample{lsn: lsns[i], at: at[i]}
+	}
+
+	target, rest, ok := advanceTarget(samples, cutoff)
+
+	return target, len(rest), ok
+}
+
+// SetReplicate replaces the replication the watchdog runs and restarts.
+func (r *Replicator) SetReplicate(run func(ctx context.Context) error) {
+	r.replicate = run
+}
+
+// Receive marks the replication streaming, with the WAL up to lsn
+// received and none of it applied.
+func (r *Replicator) Receive(lsn pglogrepl.LSN) {
+	r.stats.streaming(0)
+	r.stats.received(lsn)
+}
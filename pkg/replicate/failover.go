@@ -0,0 +1,376 @@
+package replicate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rs/zerolog/log"
+)
+
+// The keys of the failover's state in the local database's postgres_meta
+// table: the upstream streamed from, "secondary" once failed over, and
+// the commit time before which the secondary's transactions are skipped.
+const (
+	metaUpstream   = "upstream"
+	metaSkipBefore = "failover_skip_before"
+)
+
+// secondarySource suffixes the secondary's source database in the
+// recorded positions, which are kept apart from the upstream's.
+const secondarySource = "@secondary"
+
+// failoverProbeInterval is how often a lost upstream is probed,
+// until it's reachable again or the replication fails over.
+const failoverProbeInterval = 5 * time.Second
+
+// secondaryAdvanceInterval is how often the secondary's slot is advanced
+// while the replication streams from the upstream.
+const secondaryAdvanceInterval = time.Minute
+
+// source is the upstream the replication streams from.
+type source struct {
+	cfg *config.Config
+	// secondary is set once the replication failed over, the secondary's
+	// transactions committed before skipBefore were already applied.
+	secondary  bool
+	skipBefore time.Time
+}
+
+// source returns the upstream to stream from, the failover's
+// secondary once the replication failed over to it.
+func (r *Replicator) source() (source, error) {
+	if r.cfg.Failover.Address == "" {
+		return source{cfg: r.cfg}, nil
+	}
+
+	db, err := sql.Open("sqlite", r.cfg.Local.DSN())
+	if err != nil {
+		return source{}, fmt.Errorf("connect to local db: %w", err)
+	}
+	defer db.Close()
+
+	driver := sqlgen.NewSqliteDriver(LocalConfig(r.cfg), db)
+
+	upstream, err := driver.Meta(metaUpstream)
+	if err != nil || upstream != "secondary" {
+		return source{cfg: r.cfg}, err
+	}
+
+	v, err := driver.Meta(metaSkipBefore)
+	if err != nil {
+		return source{}, err
+	}
+
+	before, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return source{}, fmt.Errorf("parse %s: %w", metaSkipBefore, err)
+	}
+
+	return source{cfg: r.cfg.Secondary(), secondary: true, skipBefore: before}, nil
+}
+
+// prepareSecondary creates the publication and a permanent slot on the
+// secondary, which keeps the secondary's WAL to fail over with, as far
+// back as advanceSecondary lets it. A secondary that can't be prepared
+// is logged, it's prepared again on the next start. It isn't while the upstream is unreachable,
+// a slot created then would miss the transactions since the last one
+// applied from the upstream.
+func (r *Replicator) prepareSecondary(ctx context.Context) {
+	if err := probe(ctx, r.cfg.UpstreamConnString("failover")); err != nil {
+		return
+	}
+
+	cfg := r.cfg.Secondary()
+
+	pubCfg := PublicationConfig{
+		Schema:  cfg.Upstream.Schema,
+		Tables:  cfg.Replication.Tables,
+		Publish: cfg.Replication.Publish,
+	}
+
+	conn, _, err := replicateConnection(ctx, cfg.UpstreamConnString("replication")+"&replication=database", cfg.Replication.Publication, pubCfg)
+	if err != nil {
+		log.Warn().Err(err).Msgf("failed to prepare the secondary %s for failover", cfg.Upstream.Address)
+		return
+	}
+	defer conn.Close()
+
+	if _, ok, err := conn.confirmedFlush(cfg.Replication.SlotName); err != nil || ok {
+		if err != nil {
+			log.Warn().Err(err).Msgf("failed to prepare the secondary %s for failover", cfg.Upstream.Address)
+		}
+
+		return
+	}
+
+	_, err = pglogrepl.CreateReplicationSlot(ctx, conn.conn, cfg.Replication.SlotName, cfg.Replication.Plugin,
+		pglogrepl.CreateReplicationSlotOptions{SnapshotAction: "NOEXPORT_SNAPSHOT"})
+	if err != nil {
+		log.Warn().Err(err).Msgf("failed to create slot %q on the secondary %s", cfg.Replication.SlotName, cfg.Upstream.Address)
+		return
+	}
+
+	log.Info().Msgf("created slot %q on the secondary %s for failover", cfg.Replication.SlotName, cfg.Upstream.Address)
+}
+
+// walSample is the secondary's WAL position at a time of its clock, the
+// secondary's transactions before it were committed before that time.
+type walSample struct {
+	lsn pglogrepl.LSN
+	at  time.Time
+}
+
+// advanceSecondary advances the secondary's slot while the replication
+// streams from the upstream, so it only keeps the WAL a failover would
+// stream: the transactions committed since the last one applied from the
+// upstream, less the skew. Nothing streams the slot until then, so its
+// position is sampled with the secondary's clock every interval, and the
+// slot is advanced to the latest sample taken before those transactions.
+func (r *Replicator) advanceSecondary(ctx context.Context) {
+	ticker := time.NewTicker(secondaryAdvanceInterval)
+	defer ticker.Stop()
+
+	var samples []walSample
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		src, err := r.source()
+		if err != nil || src.secondary {
+			// the slot is streamed once failed over
+			return
+		}
+
+		if samples, err = r.advanceSecondarySlot(ctx, samples); err != nil {
+			log.Warn().Err(err).Msgf("failed to advance slot %q on the secondary %s", r.cfg.Secondary().Replication.SlotName, r.cfg.Failover.Address)
+		}
+	}
+}
+
+// advanceSecondarySlot samples the secondary's WAL position and advances
+// its slot, returning the samples it may still be advanced to.
+func (r *Replicator) advanceSecondarySlot(ctx context.Context, samples []walSample) ([]walSample, error) {
+	cfg := r.cfg.Secondary()
+
+	secondary, err := upstreamDB(cfg.UpstreamConnString("failover"))
+	if err != nil {
+		return samples, err
+	}
+	defer secondary.Close()
+
+	var (
+		pos    string
+		sample walSample
+	)
+
+	if err := secondary.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()::text, now()").Scan(&pos, &sample.at); err != nil {
+		return samples, fmt.Errorf("sample the secondary's position: %w", err)
+	}
+
+	if sample.lsn, err = pglogrepl.ParseLSN(pos); err != nil {
+		return samples, fmt.Errorf("parse the secondary's position: %w", err)
+	}
+
+	samples = append(samples, sample)
+
+	local, err := sql.Open("sqlite", r.cfg.Local.DSN())
+	if err != nil {
+		return samples, fmt.Errorf("connect to local db: %w", err)
+	}
+	defer local.Close()
+
+	positions, err := sqlgen.NewSqliteDriver(LocalConfig(r.cfg), local).Positions()
+	if err != nil {
+		return samples, err
+	}
+
+	committed, err := time.Parse(time.RFC3339Nano, positions.CommitTime)
+	if err != nil {
+		// nothing applied from the upstream yet
+		return samples, nil
+	}
+
+	target, samples, ok := advanceTarget(samples, committed.Add(-r.cfg.Failover.Skew))
+	if !ok {
+		return samples, nil
+	}
+
+	// a slot already past the target, or dropped by the guard, is left alone
+	if _, err := secondary.ExecContext(ctx,
+		`SELECT pg_replication_slot_advance(slot_name, $2::pg_lsn) FROM pg_replication_slots
+		WHERE slot_name = $1 AND confirmed_flush_lsn < $2::pg_lsn`,
+		cfg.Replication.SlotName, target.String(),
+	); err != nil {
+		return samples, fmt.Errorf("advance to %s: %w", target, err)
+	}
+
+	log.Debug().Msgf("advanced slot %q on the secondary %s to %s", cfg.Replication.SlotName, cfg.Upstream.Address, target)
+
+	return samples, nil
+}
+
+// advanceTarget returns the latest of the samples taken before the
+// cutoff, and the samples after it. It's false when there's none.
+func advanceTarget(samples []walSample, cutoff time.Time) (pglogrepl.LSN, []walSample, bool) {
+	n := 0
+	for n < len(samples) && samples[n].at.Before(cutoff) {
+		n++
+	}
+
+	if n == 0 {
+		return 0, samples, false
+	}
+
+	return samples[n-1].lsn, samples[n:], true
+}
+
+// failOver is called when the replication stopped with err while
+// failover is configured. It probes the upstream until it's reachable
+// again, to restart the replication, and fails over to the secondary
+// once it's been unreachable for Failover.After. It returns err when
+// the upstream wasn't lost, or the replication already failed over.
+func (r *Replicator) failOver(ctx context.Context, err error) error {
+	src, serr := r.source()
+	if serr != nil || src.secondary {
+		return errors.Join(err, serr)
+	}
+
+	lost := time.Now()
+
+	for probes := 0; ; probes++ {
+		perr := probe(ctx, r.cfg.UpstreamConnString("failover"))
+		if perr == nil {
+			if probes == 0 {
+				return err
+			}
+
+			log.Info().Msg("upstream is reachable again, restarting the replication")
+
+			return nil
+		}
+
+		down := time.Since(lost)
+		if down >= r.cfg.Failover.After {
+			return r.switchToSecondary(ctx, err)
+		}
+
+		log.Warn().Err(perr).Msgf("upstream unreachable for %s, failing over to %s after %s",
+			down.Round(time.Second), r.cfg.Failover.Address, r.cfg.Failover.After)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(failoverProbeInterval):
+		}
+	}
+}
+
+// switchToSecondary records the failover to the secondary in the local
+// database: its slot is streamed from its confirmed position, skipping
+// the transactions committed before the last one applied from the
+// upstream, less the allowed skew.
+func (r *Replicator) switchToSecondary(ctx context.Context, err error) error {
+	db, lerr := sql.Open("sqlite", r.cfg.Local.DSN())
+	if lerr != nil {
+		return fmt.Errorf("%w, and failing over: connect to local db: %w", err, lerr)
+	}
+	defer db.Close()
+
+	positions, lerr := sqlgen.NewSqliteDriver(LocalConfig(r.cfg), db).Positions()
+	if lerr != nil {
+		return fmt.Errorf("%w, and failing over: %w", err, lerr)
+	}
+
+	committed, lerr := time.Parse(time.RFC3339Nano, positions.CommitTime)
+	if lerr != nil {
+		return fmt.Errorf("%w, and can't fail over without the commit time of a transaction applied from the upstream", err)
+	}
+
+	cfg := r.cfg.Secondary()
+
+	conn, cerr := NewConn(ctx, cfg.UpstreamConnString("replication")+"&replication=database", cfg.Replication.Publication)
+	if cerr != nil {
+		return fmt.Errorf("%w, and failing over: %w", err, cerr)
+	}
+	defer conn.Close()
+
+	confirmed, ok, cerr := conn.confirmedFlush(cfg.Replication.SlotName)
+	if cerr != nil {
+		return fmt.Errorf("%w, and failing over: %w", err, cerr)
+	}
+
+	if !ok {
+		return fmt.Errorf("%w, and the secondary has no slot %q to fail over to", err, cfg.Replication.SlotName)
+	}
+
+	localCfg := LocalConfig(cfg)
+	localCfg.SourceDB += secondarySource
+
+	driver := sqlgen.NewSqliteDriver(localCfg, db)
+	skipBefore := committed.Add(-r.cfg.Failover.Skew)
+
+	if lerr := driver.Execute(sqlgen.NewSqlite(localCfg, nil).Pos(confirmed.String())); lerr != nil {
+		return fmt.Errorf("%w, and failing over: record position: %w", err, lerr)
+	}
+
+	if lerr := driver.SetMeta(metaSkipBefore, skipBefore.UTC().Format(time.RFC3339Nano)); lerr != nil {
+		return fmt.Errorf("%w, and failing over: %w", err, lerr)
+	}
+
+	// the last write switches the source
+	if lerr := driver.SetMeta(metaUpstream, "secondary"); lerr != nil {
+		return fmt.Errorf("%w, and failing over: %w", err, lerr)
+	}
+
+	log.Warn().Msgf("failed over to the secondary %s: streaming slot %q from %s, skipping transactions committed before %s",
+		cfg.Upstream.Address, cfg.Replication.SlotName, confirmed, skipBefore.Format(time.RFC3339Nano))
+
+	return nil
+}
+
+// confirmedFlush returns the confirmed position of the slot, it's
+// false when the upstream has no such slot.
+func (c *Conn) confirmedFlush(slot string) (pglogrepl.LSN, bool, error) {
+	pos, err := c.queryStrings(fmt.Sprintf(
+		"SELECT coalesce(confirmed_flush_lsn::text, '0/0') FROM pg_replication_slots WHERE slot_name = '%s';",
+		slot,
+	))
+	if err != nil {
+		return 0, false, fmt.Errorf("find slot: %w", err)
+	}
+
+	if len(pos) == 0 {
+		return 0, false, nil
+	}
+
+	lsn, err := pglogrepl.ParseLSN(pos[0])
+	if err != nil {
+		return 0, false, fmt.Errorf("parse slot position: %w", err)
+	}
+
+	return lsn, true, nil
+}
+
+// probe reports whether the database can be connected to.
+func probe(ctx context.Context, connString string) error {
+	ctx, cancel := context.WithTimeout(ctx, failoverProbeInterval)
+	defer cancel()
+
+	conn, err := pgconn.Connect(ctx, connString)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close(ctx)
+}
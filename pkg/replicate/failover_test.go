@@ -0,0 +1,32 @@
+package replicate_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvanceTarget(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lsns := []pglogrepl.LSN{100, 200, 300}
+	at := []time.Time{start, start.Add(time.Minute), start.Add(2 * time.Minute)}
+
+	// every sample is after the transactions a failover applies again
+	_, left, ok := replicate.AdvanceTarget(lsns, at, start)
+	assert.False(t, ok)
+	assert.Equal(t, 3, left)
+
+	// the latest sample before them
+	target, left, ok := replicate.AdvanceTarget(lsns, at, start.Add(90*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, pglogrepl.LSN(200), target)
+	assert.Equal(t, 1, left)
+
+	target, left, ok = replicate.AdvanceTarget(lsns, at, start.Add(time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, pglogrepl.LSN(300), target)
+	assert.Equal(t, 0, left)
+}
@@ -0,0 +1,156 @@
+package replicate
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// GroupCommitConfig groups upstream transactions into one local commit,
+// amortising the cost of syncing each commit on slow storage.
+type GroupCommitConfig struct {
+	// MaxTransactions is the most upstream transactions in one local
+	// commit, grouping is disabled when it's 1 or less.
+	MaxTransactions int
+	// MaxDelay is the longest an applied transaction waits to be
+	// committed locally.
+	MaxDelay time.Duration
+}
+
+func (g GroupCommitConfig) enabled() bool {
+	return g.MaxTransactions > 1
+}
+
+// group is the local transaction holding the upstream
+// transactions applied since the last local commit.
+type group struct {
+	cfg GroupCommitConfig
+
+	open     bool
+	txns     int
+	deadline time.Time
+	timer    *time.Timer
+	last     *pglogrepl.CommitMessage
+}
+
+// begin opens the group if it isn't already, returning
+// false when the local transaction is already open.
+func (g *group) begin() bool {
+	if g.open {
+		return false
+	}
+
+	g.open = true
+	g.deadline = time.Now().Add(g.cfg.MaxDelay)
+	g.timer = time.NewTimer(g.cfg.MaxDelay)
+
+	return true
+}
+
+// commit adds the committed upstream transaction to the group,
+// returning true when the group should be committed locally.
+func (g *group) commit(msg *pglogrepl.CommitMessage) bool {
+	g.txns++
+	g.last = msg
+
+	return g.txns >= g.cfg.MaxTransactions || !time.Now().Before(g.deadline)
+}
+
+// expired fires when the group's delay is up, it never fires
+// while the group is closed.
+func (g *group) expired() <-chan time.Time {
+	if g.timer == nil {
+		return nil
+	}
+
+	return g.timer.C
+}
+
+func (g *group) reset() {
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+
+	*g = group{cfg: g.cfg}
+}
+
+// groupable reports whether the message can be applied inside
+// a group, other messages begin and commit their own transactions.
+func groupable(msg pglogrepl.Message) bool {
+	switch msg.(type) {
+	case *pglogrepl.BeginMessage, *pglogrepl.CommitMessage,
+		*pglogrepl.RelationMessageV2, *pglogrepl.TypeMessageV2, *pglogrepl.OriginMessage,
+		*pglogrepl.InsertMessageV2, *pglogrepl.UpdateMessageV2, *pglogrepl.DeleteMessageV2,
+		*pglogrepl.TruncateMessageV2, *pglogrepl.LogicalDecodingMessageV2:
+		return true
+	}
+
+	return false
+}
+
+// flushGroup commits the group locally, and lets the slot
+// acknowledge the transactions in it.
+func (c *Conn) flushGroup(d DBDriver, s *slot, g *group) error {
+	if !g.open {
+		return nil
+	}
+
+	if err := d.Execute("COMMIT;"); err != nil {
+		return fmt.Errorf("commit group: %w", err)
+	}
+
+	c.feed.Publish(c.changes.take())
+
+	if g.last != nil {
+		c.stats.applied(g.last)
+		c.milestones.applied(g.last)
+		c.publishApplied(g.last)
+		s.committed(g.last)
+	}
+
+	g.reset()
+
+	return nil
+}
+
+// ack bounds the slot's flush position by the last durable commit, the
+// upstream can only discard WAL that has been committed locally.
+type ack struct {
+	// handed is the end of the last transaction handed to the stream,
+	// and durable of the last one whose position is committed locally.
+	handed  atomic.Uint64
+	durable atomic.Uint64
+}
+
+// handOff records the message is about to be handed to the stream.
+func (a *ack) handOff(msg pglogrepl.Message) {
+	if lsn, ok := commitLSN(msg); ok {
+		a.handed.Store(uint64(lsn))
+	}
+}
+
+// release records the transactions up to lsn as durable. The position
+// never goes back, confirming an earlier position would have the
+// upstream resend transactions that are already applied.
+func (a *ack) release(lsn pglogrepl.LSN) {
+	if durable := pglogrepl.LSN(a.durable.Load()); lsn < durable {
+		log.Error().Msgf("durable position going back from %s to %s, ignoring it", durable, lsn)
+		return
+	}
+
+	a.durable.Store(uint64(lsn))
+}
+
+// flushed is the position to report as flushed, given the received
+// position. While transactions handed to the stream aren't durable yet
+// it's the last durable position.
+func (a *ack) flushed(received pglogrepl.LSN) pglogrepl.LSN {
+	if durable := a.durable.Load(); a.handed.Load() > durable {
+		return pglogrepl.LSN(durable)
+	}
+
+	return received
+}
@@ -0,0 +1,31 @@
+package replicate_test
+
+import (
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAckFlushed(t *testing.T) {
+	var a replicate.Ack
+
+	a.Release(100)
+
+	// nothing handed to the stream yet
+	assert.Equal(t, pglogrepl.LSN(150), a.Flushed(150))
+
+	// received, but still waiting in the stream or in an open group
+	a.HandOff(&pglogrepl.BeginMessage{FinalLSN: 200})
+	a.HandOff(&pglogrepl.CommitMessage{CommitLSN: 200, TransactionEndLSN: 210})
+	assert.Equal(t, pglogrepl.LSN(100), a.Flushed(300))
+
+	a.HandOff(&pglogrepl.CommitMessage{CommitLSN: 290, TransactionEndLSN: 300})
+	a.Release(210)
+	assert.Equal(t, pglogrepl.LSN(210), a.Flushed(400))
+
+	// everything handed off is committed locally
+	a.Release(300)
+	assert.Equal(t, pglogrepl.LSN(400), a.Flushed(400))
+}
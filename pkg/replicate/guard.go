@@ -0,0 +1,164 @@
+package replicate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// SlotGuardConfig bounds the WAL the upstream retains for the slots of
+// nodes that stopped consuming them.
+type SlotGuardConfig struct {
+	// Slots is a LIKE pattern of the slot names guarded.
+	Slots string
+	// MaxRetainedBytes is the WAL an inactive slot can hold back before
+	// it's dropped.
+	MaxRetainedBytes int64
+	// Interval is how often the slots are checked.
+	Interval time.Duration
+}
+
+// GuardSlots drops the inactive slots that retain more than the limit
+// of WAL, or that the upstream already invalidated, until ctx is done.
+// Their nodes copy every table again when they reconnect.
+func GuardSlots(ctx context.Context, db *sql.DB, cfg SlotGuardConfig) error {
+	if cfg.MaxRetainedBytes <= 0 {
+		return errors.New("slot guard needs a max retained bytes limit")
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := GuardSlotsOnce(ctx, db, cfg); err != nil {
+			log.Warn().Err(err).Msg("guard slots")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// GuardSlotsOnce checks the slots once, and returns the dropped slots.
+func GuardSlotsOnce(ctx context.Context, db *sql.DB, cfg SlotGuardConfig) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT slot_name,
+			coalesce(pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn), 0)::bigint,
+			coalesce(wal_status, '')
+		FROM pg_replication_slots
+		WHERE slot_type = 'logical' AND NOT active AND slot_name LIKE $1`, cfg.Slots)
+	if err != nil {
+		return nil, fmt.Errorf("read slots: %w", err)
+	}
+
+	type slotLag struct {
+		name      string
+		retained  int64
+		walStatus string
+	}
+
+	var slots []slotLag
+
+	for rows.Next() {
+		var s slotLag
+		if err := rows.Scan(&s.name, &s.retained, &s.walStatus); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("read slots: %w", err)
+		}
+
+		slots = append(slots, s)
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, fmt.Errorf("read slots: %w", err)
+	}
+
+	var dropped []string
+
+	for _, s := range slots {
+		if s.retained <= cfg.MaxRetainedBytes && s.walStatus != "lost" {
+			continue
+		}
+
+		log.Warn().Msgf("dropping slot %q, it retains %d bytes of WAL (wal status %q)", s.name, s.retained, s.walStatus)
+
+		// the slot may have become active since it was read
+		if _, err := db.ExecContext(ctx, "SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1 AND NOT active", s.name); err != nil {
+			return dropped, fmt.Errorf("drop slot %q: %w", s.name, err)
+		}
+
+		dropped = append(dropped, s.name)
+	}
+
+	return dropped, nil
+}
+
+// SlotLost reports whether the slot no longer exists, or can't stream
+// because the upstream removed the WAL it needs.
+func (c *Conn) SlotLost(name string) (bool, error) {
+	status, err := c.queryStrings(fmt.Sprintf(
+		"SELECT coalesce(wal_status, '') FROM pg_replication_slots WHERE slot_name = '%s';",
+		name,
+	))
+	if err != nil {
+		return false, fmt.Errorf("find slot: %w", err)
+	}
+
+	return len(status) == 0 || status[0] == "lost", nil
+}
+
+// DropLostSlot drops the slot when it still exists, invalidated by the
+// upstream, so it can be created again.
+func (c *Conn) DropLostSlot(name string) error {
+	exists, err := c.slotExists(name)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return nil
+	}
+
+	if err := pglogrepl.DropReplicationSlot(context.Background(), c.conn, name, pglogrepl.DropReplicationSlotOptions{}); err != nil {
+		return fmt.Errorf("drop lost slot %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// slotExists reports whether the upstream has a slot with the name.
+func (c *Conn) slotExists(name string) (bool, error) {
+	found, err := c.queryStrings(fmt.Sprintf("SELECT slot_name FROM pg_replication_slots WHERE slot_name = '%s';", name))
+	if err != nil {
+		return false, fmt.Errorf("find slot: %w", err)
+	}
+
+	return len(found) != 0, nil
+}
+
+// ResyncTables returns the local tables to copy again after the node's
+// slot was lost. They're marked as pending copies rather than dropped,
+// so they keep serving their rows until they're copied.
+func ResyncTables(local map[string]map[string]sqlgen.ColDef) []string {
+	var names []string
+
+	for name := range local {
+		if !sqlgen.Internal(name) && !strings.HasPrefix(name, "sqlite_") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,126 @@
+package replicate
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// HeartbeatConfig writes a heartbeat row upstream at an interval, stamped
+// with the node's clock, and the latency until the row is applied locally
+// measures how fresh the local database is, whatever the WAL lag.
+type HeartbeatConfig struct {
+	// Node names the node's row, each node sharing the table
+	// measures its own heartbeats.
+	Node string
+	// Schema and Table are the upstream table the heartbeats are
+	// written to, it's created with the columns node and beat_at if
+	// it doesn't exist.
+	Schema   string
+	Table    string
+	Interval time.Duration
+}
+
+func (c HeartbeatConfig) name() string {
+	return c.Schema + "." + c.Table
+}
+
+// createHeartbeatTable creates the heartbeat table upstream, before the
+// publication is ensured, so it's published with the other tables.
+func createHeartbeatTable(ctx context.Context, db *sql.DB, cfg HeartbeatConfig) error {
+	table := pgx.Identifier{cfg.Schema, cfg.Table}.Sanitize()
+
+	_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (node text PRIMARY KEY, beat_at timestamptz NOT NULL)", table))
+	if err != nil {
+		return fmt.Errorf("create heartbeat table %s: %w", cfg.name(), err)
+	}
+
+	return nil
+}
+
+// heartbeats writes the node's heartbeat row until ctx is done, failed
+// writes are logged and retried at the next beat.
+func heartbeats(ctx context.Context, db *sql.DB, cfg HeartbeatConfig, stats *tracker, c clock.Clock) {
+	query := fmt.Sprintf(`INSERT INTO %s (node, beat_at) VALUES ($1, $2)
+		ON CONFLICT (node) DO UPDATE SET beat_at = excluded.beat_at`, pgx.Identifier{cfg.Schema, cfg.Table}.Sanitize())
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		at := c.Now()
+
+		if _, err := db.ExecContext(ctx, query, cfg.Node, at); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Warn().Err(err).Msgf("write heartbeat to %s", cfg.name())
+		} else {
+			stats.heartbeatSent(at)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeatTimeLayouts are the layouts of timestamptz text in the
+// upstream's ISO date style, with whole hour offsets or not.
+var heartbeatTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999Z07:00",
+}
+
+// postgresEpoch is the zero of binary timestamps.
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// heartbeatBeat returns the time the node's heartbeat in the tuple was
+// written, it's false for other nodes' heartbeats.
+func heartbeatBeat(rel *pglogrepl.RelationMessageV2, tuple *pglogrepl.TupleData, node string) (time.Time, bool) {
+	if rel == nil || tuple == nil || len(tuple.Columns) != len(rel.Columns) {
+		return time.Time{}, false
+	}
+
+	var (
+		beatAt  time.Time
+		matched bool
+		parsed  bool
+	)
+
+	for i, col := range rel.Columns {
+		data := tuple.Columns[i]
+
+		switch col.Name {
+		case "node":
+			matched = string(data.Data) == node
+		case "beat_at":
+			switch data.DataType {
+			case pglogrepl.TupleDataTypeText:
+				for _, layout := range heartbeatTimeLayouts {
+					if t, err := time.Parse(layout, string(data.Data)); err == nil {
+						beatAt, parsed = t, true
+						break
+					}
+				}
+			case pglogrepl.TupleDataTypeBinary:
+				if len(data.Data) == 8 {
+					micros := int64(binary.BigEndian.Uint64(data.Data))
+					beatAt, parsed = postgresEpoch.Add(time.Duration(micros)*time.Microsecond), true
+				}
+			}
+		}
+	}
+
+	return beatAt, matched && parsed
+}
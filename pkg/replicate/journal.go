@@ -0,0 +1,248 @@
+package replicate
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/jackc/pglogrepl"
+)
+
+// JournalConfig configures the debug journal, which records every
+// message received from the slot as newline delimited JSON.
+type JournalConfig struct {
+	// Path is the journal file, empty disables the journal.
+	Path string
+	// MaxBytes is the size the journal is rotated at, and MaxFiles
+	// the rotated files kept, as Path.1 (the newest) to Path.MaxFiles.
+	MaxBytes int64
+	MaxFiles int
+	// Clock stamps the entries, the system clock when nil.
+	Clock clock.Clock
+}
+
+// JournalEntry is a message received from the slot.
+type JournalEntry struct {
+	// LSN is the position of the WAL data the message was sent in.
+	LSN  string `json:"lsn"`
+	Type string `json:"type"`
+	// Table, Row and Old are the decoded row change, in the same
+	// format as the changes of live subscriptions.
+	Table string         `json:"table,omitempty"`
+	Row   map[string]any `json:"row,omitempty"`
+	Old   map[string]any `json:"old,omitempty"`
+	At    time.Time      `json:"at"`
+	// Data is the message as it was received, so it can be replayed.
+	Data []byte `json:"data"`
+}
+
+// Journal appends the received messages to the journal file.
+type Journal struct {
+	cfg       JournalConfig
+	f         *os.File
+	w         *bufio.Writer
+	size      int64
+	relations map[uint32]*pglogrepl.RelationMessageV2
+}
+
+// OpenJournal opens the journal file, appending to it if it exists.
+func OpenJournal(cfg JournalConfig) (*Journal, error) {
+	j := &Journal{cfg: cfg, relations: make(map[uint32]*pglogrepl.RelationMessageV2)}
+
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open journal: %w", err)
+	}
+
+	j.f, j.w, j.size = f, bufio.NewWriter(f), info.Size()
+
+	return nil
+}
+
+// Record appends the message, decoded from data, to the journal.
+func (j *Journal) Record(lsn pglogrepl.LSN, data []byte, msg pglogrepl.Message) error {
+	entry := JournalEntry{
+		LSN:  lsn.String(),
+		Type: messageType(msg),
+		At:   clock.Or(j.cfg.Clock).Now().UTC(),
+		Data: data,
+	}
+
+	var (
+		id          uint32
+		row, old    *pglogrepl.TupleData
+		isRowChange = true
+	)
+
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessageV2:
+		j.relations[msg.RelationID] = msg
+		entry.Table = msg.Namespace + "." + msg.RelationName
+		isRowChange = false
+	case *pglogrepl.InsertMessageV2:
+		id, row = msg.RelationID, msg.Tuple
+	case *pglogrepl.UpdateMessageV2:
+		id, row, old = msg.RelationID, msg.NewTuple, msg.OldTuple
+	case *pglogrepl.DeleteMessageV2:
+		id, old = msg.RelationID, msg.OldTuple
+	default:
+		isRowChange = false
+	}
+
+	if rel, ok := j.relations[id]; ok && isRowChange {
+		entry.Table = rel.Namespace + "." + rel.RelationName
+		entry.Row, entry.Old = tupleValues(rel, row), tupleValues(rel, old)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encode journal entry: %w", err)
+	}
+
+	line = append(line, '\n')
+
+	if j.cfg.MaxBytes > 0 && j.size > 0 && j.size+int64(len(line)) > j.cfg.MaxBytes {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := j.w.Write(line); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	j.size += int64(len(line))
+
+	// entries are flushed as they're written, so the journal
+	// has every message received before a crash.
+	if err := j.w.Flush(); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	return nil
+}
+
+// rotate moves the journal to Path.1, shifting the rotated
+// files up and removing the ones past MaxFiles.
+func (j *Journal) rotate() error {
+	if err := j.f.Close(); err != nil {
+		return fmt.Errorf("close journal: %w", err)
+	}
+
+	for i := j.cfg.MaxFiles; i >= 1; i-- {
+		from := j.cfg.Path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", j.cfg.Path, i-1)
+		}
+
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", j.cfg.Path, i)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("rotate journal: %w", err)
+		}
+	}
+
+	if j.cfg.MaxFiles < 1 {
+		if err := os.Remove(j.cfg.Path); err != nil {
+			return fmt.Errorf("rotate journal: %w", err)
+		}
+	}
+
+	return j.open()
+}
+
+func (j *Journal) Close() error {
+	if err := j.w.Flush(); err != nil {
+		j.f.Close()
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	return j.f.Close()
+}
+
+// ReadJournal reads the entries of a journal file.
+func ReadJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+
+	for dec.More() {
+		var e JournalEntry
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("read journal entry %d: %w", len(entries)+1, err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// messageType names the logical replication message's type.
+func messageType(msg pglogrepl.Message) string {
+	switch msg.(type) {
+	case *pglogrepl.BeginMessage:
+		return "begin"
+	case *pglogrepl.CommitMessage:
+		return "commit"
+	case *pglogrepl.RelationMessageV2:
+		return "relation"
+	case *pglogrepl.TypeMessageV2:
+		return "type"
+	case *pglogrepl.OriginMessage:
+		return "origin"
+	case *pglogrepl.InsertMessageV2:
+		return "insert"
+	case *pglogrepl.UpdateMessageV2:
+		return "update"
+	case *pglogrepl.DeleteMessageV2:
+		return "delete"
+	case *pglogrepl.TruncateMessageV2:
+		return "truncate"
+	case *pglogrepl.LogicalDecodingMessageV2:
+		return "message"
+	case *pglogrepl.StreamStartMessageV2:
+		return "stream_start"
+	case *pglogrepl.StreamStopMessageV2:
+		return "stream_stop"
+	case *pglogrepl.StreamCommitMessageV2:
+		return "stream_commit"
+	case *pglogrepl.StreamAbortMessageV2:
+		return "stream_abort"
+	case *pgoutput.BeginPrepareMessage:
+		return "begin_prepare"
+	case *pgoutput.PrepareMessage:
+		return "prepare"
+	case *pgoutput.CommitPreparedMessage:
+		return "commit_prepared"
+	case *pgoutput.RollbackPreparedMessage:
+		return "rollback_prepared"
+	}
+
+	return "unknown"
+}
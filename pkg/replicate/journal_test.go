@@ -0,0 +1,76 @@
+package replicate_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.ndjson")
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	j, err := replicate.OpenJournal(replicate.JournalConfig{Path: path, MaxBytes: 500, MaxFiles: 1, Clock: clock.NewManual(at)})
+	require.NoError(t, err)
+
+	rel := &pglogrepl.RelationMessageV2{
+		RelationMessage: pglogrepl.RelationMessage{
+			RelationID:   1,
+			Namespace:    "public",
+			RelationName: "names",
+			Columns: []*pglogrepl.RelationMessageColumn{
+				{Flags: 1, Name: "id", DataType: 23},
+				{Name: "name", DataType: 25},
+			},
+		},
+	}
+
+	require.NoError(t, j.Record(0x10, []byte("R"), rel))
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		insert := &pglogrepl.InsertMessageV2{
+			InsertMessage: pglogrepl.InsertMessage{
+				RelationID: 1,
+				Tuple: &pglogrepl.TupleData{
+					Columns: []*pglogrepl.TupleDataColumn{
+						{DataType: 't', Data: []byte("1")},
+						{DataType: 't', Data: []byte(name)},
+					},
+				},
+			},
+		}
+
+		require.NoError(t, j.Record(0x20, []byte("I"+name), insert))
+	}
+
+	require.NoError(t, j.Close())
+
+	current, err := replicate.ReadJournal(path)
+	require.NoError(t, err)
+
+	rotated, err := replicate.ReadJournal(path + ".1")
+	require.NoError(t, err)
+
+	// every entry is kept across the current and rotated files
+	entries := append(rotated, current...)
+	require.Len(t, entries, 5)
+	assert.Less(t, len(current), 5)
+
+	assert.Equal(t, "relation", entries[0].Type)
+	assert.Equal(t, "public.names", entries[0].Table)
+	assert.Equal(t, at, entries[0].At)
+
+	last := entries[4]
+	assert.Equal(t, "insert", last.Type)
+	assert.Equal(t, "0/20", last.LSN)
+	assert.Equal(t, map[string]any{"id": json.Number("1"), "name": "d"}, last.Row)
+	assert.Equal(t, []byte("Id"), last.Data)
+}
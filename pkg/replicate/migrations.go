@@ -0,0 +1,78 @@
+package replicate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// ErrPendingMigration is returned when streaming stops for a
+// schema change to be reviewed and applied to the local database.
+var ErrPendingMigration = errors.New("pending schema migration")
+
+// migrationLSN is the version of a schema change's migration file, the
+// commit position of its transaction. Streamed transactions' commit
+// position isn't known until they're committed, so their changes are
+// versioned by their position in the stream instead.
+func migrationLSN(txLSN, msgLSN pglogrepl.LSN, inStream bool) pglogrepl.LSN {
+	if inStream {
+		return msgLSN
+	}
+
+	return txLSN
+}
+
+// writeMigration writes the ddl to a migration file in dir, versioned by the
+// position of the transaction changing the schema, so the file sorts after
+// earlier migrations and is rewritten in place if the change is streamed again.
+func writeMigration(dir string, lsn pglogrepl.LSN, msg *pglogrepl.RelationMessageV2, ddl string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("create migrations dir: %w", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%016X_%s.sql", uint64(lsn), migrationName(msg.RelationName)))
+
+	// names quoted upstream can have line breaks, which would end
+	// the comment
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+
+		return r
+	}, msg.Namespace+"."+msg.RelationName)
+
+	content := &strings.Builder{}
+	fmt.Fprintf(content, "-- schema change of %s at %s\n", name, lsn)
+
+	for _, stmt := range strings.SplitAfter(ddl, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			content.WriteString(stmt + "\n")
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(content.String()), 0o644); err != nil {
+		return "", fmt.Errorf("write migration: %w", err)
+	}
+
+	return path, nil
+}
+
+// migrationName returns the table's name as part of a migration file's
+// name, with anything but letters, digits and underscores replaced, so
+// names quoted upstream, e.g. with slashes, stay in the directory.
+func migrationName(table string) string {
+	return strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+
+		return '_'
+	}, table)
+}
@@ -0,0 +1,70 @@
+package replicate_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMigration(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "migrations")
+
+	msg := &pglogrepl.RelationMessageV2{RelationMessage: pglogrepl.RelationMessage{Namespace: "public", RelationName: "names"}}
+
+	path, err := replicate.WriteMigration(dir, 0x16B3748, msg, "ALTER TABLE names ADD COLUMN age integer; ALTER TABLE names DROP COLUMN nick;")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "00000000016B3748_names.sql"), path)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `-- schema change of public.names at 0/16B3748
+ALTER TABLE names ADD COLUMN age integer;
+ALTER TABLE names DROP COLUMN nick;
+`, string(b))
+
+	// streamed again, the file is rewritten in place
+	again, err := replicate.WriteMigration(dir, 0x16B3748, msg, "ALTER TABLE names ADD COLUMN age integer;")
+	require.NoError(t, err)
+	assert.Equal(t, path, again)
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "-- schema change of public.names at 0/16B3748\nALTER TABLE names ADD COLUMN age integer;\n", string(b))
+
+	// later changes sort after it
+	later, err := replicate.WriteMigration(dir, 0x1000000A0, msg, "ALTER TABLE names ADD COLUMN nick text;")
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, filepath.Base(path), entries[0].Name())
+	assert.Equal(t, filepath.Base(later), entries[1].Name())
+}
+
+func TestWriteMigrationName(t *testing.T) {
+	dir := t.TempDir()
+
+	// quoted upstream, the name can have any character
+	msg := &pglogrepl.RelationMessageV2{RelationMessage: pglogrepl.RelationMessage{Namespace: "public", RelationName: "../../etc/passwd\nDROP TABLE names;"}}
+
+	path, err := replicate.WriteMigration(dir, 0x16B3748, msg, "ALTER TABLE names ADD COLUMN age integer;")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "00000000016B3748_______etc_passwd_DROP_TABLE_names_.sql"), path)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "-- schema change of public.../../etc/passwd DROP TABLE names; at 0/16B3748\nALTER TABLE names ADD COLUMN age integer;\n", string(b))
+}
+
+func TestMigrationLSN(t *testing.T) {
+	// versioned by the transaction's commit position
+	assert.Equal(t, pglogrepl.LSN(300), replicate.MigrationLSN(300, 120, false))
+	// which isn't known inside streamed transactions
+	assert.Equal(t, pglogrepl.LSN(120), replicate.MigrationLSN(0, 120, true))
+}
@@ -0,0 +1,147 @@
+package replicate
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MilestoneSnapshot is signalled once the local database has been
+	// copied or bootstrapped, at the snapshot's position.
+	MilestoneSnapshot = "snapshot"
+	// MilestoneApplied is signalled at the applied position when it
+	// crosses a watermark, a multiple of MilestoneConfig.WatermarkBytes.
+	MilestoneApplied = "applied"
+)
+
+// MilestoneConfig signals the upstream as the node reaches milestones,
+// so workflows there can wait for their writes to reach the edge.
+type MilestoneConfig struct {
+	// Node names the node in the signals.
+	Node string
+	// Channel is the channel the milestones are sent to with NOTIFY,
+	// as JSON payloads with the node, event and lsn.
+	Channel string
+	// Table is a table the milestones are inserted into, with the
+	// columns node, event and lsn.
+	Table string
+	// WatermarkBytes is the distance between the watermarks signalled
+	// as they're applied, zero only signals the snapshot.
+	WatermarkBytes uint64
+}
+
+func (c MilestoneConfig) enabled() bool {
+	return c.Channel != "" || c.Table != ""
+}
+
+// Milestone is a position the node has reached.
+type Milestone struct {
+	Node  string `json:"node"`
+	Event string `json:"event"`
+	LSN   string `json:"lsn"`
+}
+
+// milestones sends the milestones to the upstream in the background,
+// signalling is best effort and never holds up applying changes.
+type milestones struct {
+	cfg    MilestoneConfig
+	db     *sql.DB
+	queue  chan Milestone
+	marked pglogrepl.LSN
+}
+
+// maxQueuedMilestones is how many milestones wait to be sent while the
+// upstream is slow, later ones are dropped.
+const maxQueuedMilestones = 64
+
+func newMilestones(cfg MilestoneConfig, db *sql.DB) *milestones {
+	return &milestones{cfg: cfg, db: db, queue: make(chan Milestone, maxQueuedMilestones)}
+}
+
+// run sends the queued milestones until the context is done.
+func (m *milestones) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ms := <-m.queue:
+			if err := m.send(ctx, ms); err != nil {
+				log.Warn().Err(err).Msgf("signal %s milestone at %s", ms.Event, ms.LSN)
+			}
+		}
+	}
+}
+
+func (m *milestones) send(ctx context.Context, ms Milestone) error {
+	if m.cfg.Channel != "" {
+		payload, err := json.Marshal(ms)
+		if err != nil {
+			return err
+		}
+
+		if _, err := m.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", m.cfg.Channel, string(payload)); err != nil {
+			return fmt.Errorf("notify: %w", err)
+		}
+	}
+
+	if m.cfg.Table != "" {
+		table := pgx.Identifier(strings.Split(m.cfg.Table, ".")).Sanitize()
+
+		_, err := m.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (node, event, lsn) VALUES ($1, $2, $3)", table),
+			ms.Node, ms.Event, ms.LSN)
+		if err != nil {
+			return fmt.Errorf("insert into %s: %w", m.cfg.Table, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *milestones) signal(event string, lsn pglogrepl.LSN) {
+	select {
+	case m.queue <- Milestone{Node: m.cfg.Node, Event: event, LSN: lsn.String()}:
+	default:
+		log.Warn().Msgf("dropped %s milestone at %s, the upstream is behind", event, lsn)
+	}
+}
+
+// snapshot signals the local database was copied or bootstrapped.
+func (m *milestones) snapshot(lsn pglogrepl.LSN) {
+	if m == nil {
+		return
+	}
+
+	m.signal(MilestoneSnapshot, lsn)
+}
+
+// applied signals the watermarks the committed transaction crossed.
+func (m *milestones) applied(msg pglogrepl.Message) {
+	if m == nil || m.cfg.WatermarkBytes == 0 {
+		return
+	}
+
+	lsn, ok := commitLSN(msg)
+	if !ok {
+		return
+	}
+
+	w := pglogrepl.LSN(m.cfg.WatermarkBytes)
+
+	if m.marked == 0 {
+		// the first watermark is the one after the starting position
+		m.marked = lsn / w * w
+		return
+	}
+
+	if lsn/w > m.marked/w {
+		m.marked = lsn / w * w
+		m.signal(MilestoneApplied, lsn)
+	}
+}
@@ -0,0 +1,76 @@
+package replicate
+
+import (
+	"fmt"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+)
+
+// Replay applies the journal's messages to the local database, skipping
+// the transactions committed at or before from, the position of the base
+// snapshot. It returns the position of the last applied transaction.
+func Replay(entries []JournalEntry, from pglogrepl.LSN, schema string, d DBDriver, gen SQLGen) (pglogrepl.LSN, error) {
+	var (
+		inStream bool
+		skip     bool
+		pos      = from
+	)
+
+	for i, e := range entries {
+		msg, err := parseMessage(e.Data, inStream)
+		if err != nil {
+			return pos, fmt.Errorf("decode journal entry %d at %s: %w", i+1, e.LSN, err)
+		}
+
+		var stmt sqlgen.Statement
+
+		switch msg := msg.(type) {
+		case *pglogrepl.StreamStartMessageV2:
+			inStream = true
+			stmt.Query, err = gen.StreamStart(msg)
+		case *pglogrepl.StreamStopMessageV2:
+			inStream = false
+			stmt.Query, err = gen.StreamStop(msg)
+		case *pglogrepl.RelationMessageV2:
+			// relations are tracked even in skipped transactions,
+			// as the later changes refer to them.
+			stmt.Query, err = gen.Relation(msg)
+		case *pglogrepl.BeginMessage:
+			if skip = msg.FinalLSN <= from; !skip {
+				stmt.Query, err = gen.Begin(msg)
+			}
+		case *pglogrepl.CommitMessage:
+			if skip {
+				skip = false
+				continue
+			}
+
+			stmt.Query, err = gen.Commit(msg)
+			pos = msg.CommitLSN
+		default:
+			if skip {
+				continue
+			}
+
+			var ok bool
+			if stmt, ok, err = generate(d, gen, msg, schema); !ok {
+				continue
+			}
+		}
+
+		if err != nil {
+			return pos, fmt.Errorf("generate sql for journal entry %d at %s: %w", i+1, e.LSN, err)
+		}
+
+		if stmt.Query == "" {
+			continue
+		}
+
+		if err := apply(d, msg, stmt); err != nil {
+			return pos, fmt.Errorf("apply journal entry %d at %s: %w", i+1, e.LSN, err)
+		}
+	}
+
+	return pos, nil
+}
@@ -0,0 +1,198 @@
+package replicate_test
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cstring(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
+
+func beginData(finalLSN uint64) []byte {
+	b := binary.BigEndian.AppendUint64([]byte{'B'}, finalLSN)
+	b = binary.BigEndian.AppendUint64(b, 0)
+	return binary.BigEndian.AppendUint32(b, 1)
+}
+
+func commitData(lsn uint64) []byte {
+	b := binary.BigEndian.AppendUint64([]byte{'C', 0}, lsn)
+	b = binary.BigEndian.AppendUint64(b, lsn+1)
+	return binary.BigEndian.AppendUint64(b, 0)
+}
+
+func relationData() []byte {
+	b := binary.BigEndian.AppendUint32([]byte{'R'}, 1)
+	b = cstring(b, "public")
+	b = cstring(b, "names")
+	b = append(b, 'd')
+	b = binary.BigEndian.AppendUint16(b, 2)
+
+	b = cstring(append(b, 1), "id")
+	b = binary.BigEndian.AppendUint32(b, 23)
+	b = binary.BigEndian.AppendUint32(b, 0xFFFFFFFF)
+
+	b = cstring(append(b, 0), "name")
+	b = binary.BigEndian.AppendUint32(b, 25)
+	return binary.BigEndian.AppendUint32(b, 0xFFFFFFFF)
+}
+
+func insertData(id, name string) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{'I'}, 1)
+	b = binary.BigEndian.AppendUint16(append(b, 'N'), 2)
+
+	for _, v := range []string{id, name} {
+		b = binary.BigEndian.AppendUint32(append(b, 't'), uint32(len(v)))
+		b = append(b, v...)
+	}
+
+	return b
+}
+
+func messageData(lsn uint64, prefix, content string) []byte {
+	b := binary.BigEndian.AppendUint64([]byte{'M', 1}, lsn)
+	b = cstring(b, prefix)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(content)))
+
+	return append(b, content...)
+}
+
+func TestReplay(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "replay.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	// the transactions are begun and committed with separate statements
+	db.SetMaxOpenConns(1)
+
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge"}
+	driver := sqlgen.NewSqliteDriver(cfg, db)
+	require.NoError(t, driver.InitPositionTable())
+
+	entries := []replicate.JournalEntry{
+		// committed before the base snapshot
+		{LSN: "0/10", Data: beginData(0x20)},
+		{LSN: "0/10", Data: relationData()},
+		{LSN: "0/10", Data: insertData("1", "skipped")},
+		{LSN: "0/20", Data: commitData(0x20)},
+		{LSN: "0/30", Data: beginData(0x40)},
+		{LSN: "0/30", Data: insertData("2", "hello")},
+		{LSN: "0/30", Data: insertData("3", "world")},
+		{LSN: "0/40", Data: commitData(0x40)},
+	}
+
+	gen := sqlgen.NewSqlite(cfg, map[string]map[string]sqlgen.ColDef{})
+
+	pos, err := replicate.Replay(entries, 0x20, "public", driver, gen)
+	require.NoError(t, err)
+	assert.Equal(t, pglogrepl.LSN(0x40), pos)
+
+	rows, err := db.Query("SELECT name FROM names ORDER BY id")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var names []string
+
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+
+	assert.Equal(t, []string{"hello", "world"}, names)
+
+	stored, err := driver.Pos()
+	require.NoError(t, err)
+	assert.Equal(t, "0/40", stored)
+}
+
+func TestReplayErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []replicate.JournalEntry
+		err     error
+	}{
+		{
+			name: "duplicate key",
+			entries: []replicate.JournalEntry{
+				{LSN: "0/10", Data: beginData(0x20)},
+				{LSN: "0/10", Data: relationData()},
+				{LSN: "0/10", Data: insertData("1", "hello")},
+				{LSN: "0/10", Data: insertData("1", "again")},
+				{LSN: "0/20", Data: commitData(0x20)},
+			},
+			err: replicate.ErrApplyConflict,
+		},
+		{
+			name: "unknown relation",
+			entries: []replicate.JournalEntry{
+				{LSN: "0/10", Data: beginData(0x20)},
+				{LSN: "0/10", Data: insertData("1", "hello")},
+				{LSN: "0/20", Data: commitData(0x20)},
+			},
+			err: replicate.ErrSchemaMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "replay.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+
+			db.SetMaxOpenConns(1)
+
+			cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge"}
+			driver := sqlgen.NewSqliteDriver(cfg, db)
+			require.NoError(t, driver.InitPositionTable())
+
+			gen := sqlgen.NewSqlite(cfg, map[string]map[string]sqlgen.ColDef{})
+
+			_, err = replicate.Replay(tt.entries, 0, "public", driver, gen)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestReplayMessages(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "replay.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	db.SetMaxOpenConns(1)
+
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge", MessagePrefixes: []string{"app."}}
+	driver := sqlgen.NewSqliteDriver(cfg, db)
+	require.NoError(t, driver.InitPositionTable())
+	require.NoError(t, driver.InitMessagesTable())
+
+	entries := []replicate.JournalEntry{
+		{LSN: "0/10", Data: beginData(0x20)},
+		{LSN: "0/18", Data: messageData(0x18, "app.flush", "orders")},
+		{LSN: "0/19", Data: messageData(0x19, "other", "ignored")},
+		{LSN: "0/20", Data: commitData(0x20)},
+	}
+
+	gen := sqlgen.NewSqlite(cfg, map[string]map[string]sqlgen.ColDef{})
+
+	_, err = replicate.Replay(entries, 0, "public", driver, gen)
+	require.NoError(t, err)
+
+	var lsn, prefix, content string
+
+	require.NoError(t, db.QueryRow("SELECT lsn, prefix, content FROM postgres_messages").Scan(&lsn, &prefix, &content))
+	assert.Equal(t, []string{"0/18", "app.flush", "orders"}, []string{lsn, prefix, content})
+
+	var n int
+
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM postgres_messages").Scan(&n))
+	assert.Equal(t, 1, n)
+}
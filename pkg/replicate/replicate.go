@@ -7,11 +7,17 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/events"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
 	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
 	"github.com/gemini-kenshi/pgreplsql/pkg/tables"
 	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgproto3"
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -24,19 +30,40 @@ type Conn struct {
 	conn        *pgconn.PgConn
 	connStr     string
 
-	pos pglogrepl.LSN
+	pos   pglogrepl.LSN
+	stats *tracker
+
+	// feed publishes the applied changes, changes are
+	// the ones not yet committed locally.
+	feed    *Feed
+	changes *changes
+
+	// dlqSeq numbers the dead lettered changes.
+	dlqSeq int
+
+	// clock stamps the dead lettered changes.
+	clock clock.Clock
+	// budget is the memory budget shared with the proxy.
+	budget *budget.Budget
+	// milestones signals the upstream as the node reaches
+	// milestones, nil when it isn't configured.
+	milestones *milestones
+	// events is the bus shared with the proxy, nil without one.
+	events *events.Bus
 }
 
 func NewConn(ctx context.Context, connString, publication string) (*Conn, error) {
 	conn, err := pgconn.Connect(context.Background(), connString)
 	if err != nil {
-		return nil, fmt.Errorf("pgconnect: %w", err)
+		return nil, fmt.Errorf("pgconnect: %w: %w", ErrUpstreamUnavailable, err)
 	}
 
 	c := &Conn{
 		publication: publication,
 		conn:        conn,
+		clock:       clock.System{},
 		connStr:     connString,
+		stats:       newTracker("", publication),
 	}
 
 	if err := c.identify(); err != nil {
@@ -62,10 +89,80 @@ func (c *Conn) DropPublication() error {
 	return nil
 }
 
-func (c *Conn) CreatePublication() error {
-	result := c.conn.Exec(context.Background(), fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES;", c.publication))
+// PublicationConfig describes what the publication should cover.
+type PublicationConfig struct {
+	Schema string
+	// Tables published, when empty all tables are published.
+	Tables []string
+	// Publish is the list of operations published, when empty
+	// postgres' default of all operations is used.
+	Publish []string
+	// Pending, when set, records the tables about to be added to the
+	// publication before they're added, so they're still copied if
+	// sqledge stops before copying them.
+	Pending func(tables []string) error
+}
 
-	_, err := result.ReadAll()
+// createAttempts is how many times creating the publication is tried.
+const createAttempts = 3
+
+// retryableCreate reports whether creating the publication failed in a
+// way that's worth trying again, e.g. another node created it at the
+// same time, or the create lost a lock to a concurrent transaction.
+func retryableCreate(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	switch pgErr.Code {
+	case "42710", "40001", "40P01", "55P03":
+		// duplicate_object, serialization_failure, deadlock_detected, lock_not_available
+		return true
+	}
+
+	return false
+}
+
+var publishOperations = map[string]bool{
+	"insert":   true,
+	"update":   true,
+	"delete":   true,
+	"truncate": true,
+}
+
+func (p PublicationConfig) publishOption() (string, error) {
+	if len(p.Publish) == 0 {
+		return "", nil
+	}
+
+	for _, op := range p.Publish {
+		if !publishOperations[op] {
+			return "", fmt.Errorf("unknown publish operation: %q", op)
+		}
+	}
+
+	return fmt.Sprintf("publish = '%s'", strings.Join(p.Publish, ", ")), nil
+}
+
+func (c *Conn) CreatePublication(cfg PublicationConfig) error {
+	query := fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES", c.publication)
+	if len(cfg.Tables) > 0 {
+		query = fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", c.publication, qualifiedTables(cfg.Schema, cfg.Tables))
+	}
+
+	publish, err := cfg.publishOption()
+	if err != nil {
+		return fmt.Errorf("create publication: %w", err)
+	}
+
+	if publish != "" {
+		query += " WITH (" + publish + ")"
+	}
+
+	result := c.conn.Exec(context.Background(), query+";")
+
+	_, err = result.ReadAll()
 	if err != nil {
 		return fmt.Errorf("create publication: %w", err)
 	}
@@ -73,6 +170,236 @@ func (c *Conn) CreatePublication() error {
 	return nil
 }
 
+// EnsurePublication creates the publication if it doesn't exist yet, and
+// otherwise alters it so that it covers exactly the tables given (or all
+// tables when none are given). It returns the tables that weren't
+// previously published, and so need to be copied before streaming.
+func (c *Conn) EnsurePublication(cfg PublicationConfig) ([]string, error) {
+	for attempt := 1; ; attempt++ {
+		added, err := c.ensurePublication(cfg)
+		if err == nil || attempt == createAttempts || !retryableCreate(err) {
+			return added, err
+		}
+
+		log.Warn().Err(err).Msgf("ensure publication %q, attempt %d of %d", c.publication, attempt, createAttempts)
+
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (c *Conn) ensurePublication(cfg PublicationConfig) ([]string, error) {
+	publish, err := cfg.publishOption()
+	if err != nil {
+		return nil, fmt.Errorf("ensure publication: %w", err)
+	}
+
+	allTables, err := c.queryStrings(fmt.Sprintf(
+		"SELECT puballtables::text FROM pg_publication WHERE pubname = '%s';",
+		c.publication,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("find publication: %w", err)
+	}
+
+	if len(allTables) == 0 {
+		log.Debug().Msgf("creating publication %q", c.publication)
+
+		if err := c.CreatePublication(cfg); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	if publish != "" {
+		if err := c.exec(fmt.Sprintf("ALTER PUBLICATION %s SET (%s);", c.publication, publish)); err != nil {
+			return nil, fmt.Errorf("alter publication publish: %w", err)
+		}
+	}
+
+	if len(cfg.Tables) == 0 {
+		if allTables[0] == "true" {
+			return nil, nil
+		}
+
+		// a publication can't be altered to cover all tables,
+		// but dropping it doesn't affect the position held by the slot.
+		current, err := c.publishedTables(cfg.Schema)
+		if err != nil {
+			return nil, err
+		}
+
+		schemaTables, err := c.queryStrings(fmt.Sprintf(
+			"SELECT tablename FROM pg_tables WHERE schemaname = '%s';",
+			cfg.Schema,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("find tables: %w", err)
+		}
+
+		added := difference(schemaTables, current)
+
+		if err := cfg.pending(added); err != nil {
+			return nil, err
+		}
+
+		if err := c.DropPublication(); err != nil {
+			return nil, err
+		}
+
+		if err := c.CreatePublication(cfg); err != nil {
+			return nil, err
+		}
+
+		return added, nil
+	}
+
+	if allTables[0] == "true" {
+		// every listed table is already published, only the
+		// extra tables go away.
+		if err := c.DropPublication(); err != nil {
+			return nil, err
+		}
+
+		if err := c.CreatePublication(cfg); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	current, err := c.publishedTables(cfg.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	added := difference(cfg.Tables, current)
+	dropped := difference(current, cfg.Tables)
+
+	if len(added) > 0 {
+		log.Debug().Msgf("adding tables to publication %q: %v", c.publication, added)
+
+		if err := cfg.pending(added); err != nil {
+			return nil, err
+		}
+
+		if err := c.exec(fmt.Sprintf(
+			"ALTER PUBLICATION %s ADD TABLE %s;",
+			c.publication, qualifiedTables(cfg.Schema, added),
+		)); err != nil {
+			return nil, fmt.Errorf("alter publication add table: %w", err)
+		}
+	}
+
+	if len(dropped) > 0 {
+		log.Debug().Msgf("dropping tables from publication %q: %v", c.publication, dropped)
+
+		if err := c.exec(fmt.Sprintf(
+			"ALTER PUBLICATION %s DROP TABLE %s;",
+			c.publication, qualifiedTables(cfg.Schema, dropped),
+		)); err != nil {
+			return nil, fmt.Errorf("alter publication drop table: %w", err)
+		}
+	}
+
+	return added, nil
+}
+
+func (p PublicationConfig) pending(tables []string) error {
+	if p.Pending == nil || len(tables) == 0 {
+		return nil
+	}
+
+	if err := p.Pending(tables); err != nil {
+		return fmt.Errorf("record pending copies: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Conn) publishedTables(schema string) ([]string, error) {
+	tables, err := c.queryStrings(fmt.Sprintf(
+		"SELECT tablename FROM pg_publication_tables WHERE pubname = '%s' AND schemaname = '%s';",
+		c.publication, schema,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("find published tables: %w", err)
+	}
+
+	return tables, nil
+}
+
+func (c *Conn) exec(query string) error {
+	_, err := c.conn.Exec(context.Background(), query).ReadAll()
+	return err
+}
+
+// queryStrings runs the query and returns the first column of each row.
+func (c *Conn) queryStrings(query string) ([]string, error) {
+	results, err := c.conn.Exec(context.Background(), query).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+
+	for _, result := range results {
+		for _, row := range result.Rows {
+			out = append(out, string(row[0]))
+		}
+	}
+
+	return out, nil
+}
+
+// backfilling records the tables were copied by the upstream's current
+// position, read after the copy, so inserts replace their copied rows
+// until the stream reaches it.
+func (c *Conn) backfilling(gen SQLGen, tables []string) error {
+	pos, err := c.queryStrings("SELECT pg_current_wal_lsn()::text;")
+	if err != nil || len(pos) == 0 {
+		return fmt.Errorf("current position: %w", err)
+	}
+
+	lsn, err := pglogrepl.ParseLSN(pos[0])
+	if err != nil {
+		return fmt.Errorf("current position: %w", err)
+	}
+
+	for _, table := range tables {
+		gen.Backfilling(table, lsn)
+	}
+
+	return nil
+}
+
+func qualifiedTables(schema string, tables []string) string {
+	qualified := make([]string, len(tables))
+	for i, t := range tables {
+		qualified[i] = pgx.Identifier{schema, t}.Sanitize()
+	}
+
+	return strings.Join(qualified, ", ")
+}
+
+// difference returns the items in a that aren't in b.
+func difference(a, b []string) []string {
+	seen := make(map[string]bool, len(b))
+	for _, v := range b {
+		seen[v] = true
+	}
+
+	var out []string
+
+	for _, v := range a {
+		if !seen[v] {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
 type SlotConfig struct {
 	SlotName             string
 	OutputPlugin         string
@@ -80,11 +407,245 @@ type SlotConfig struct {
 	Temporary            bool
 	Schema               string
 	StandbyTimeout       int
+	// Tables limits the initial copy to these tables, when empty all
+	// tables in the schema are copied.
+	Tables []string
+	// CopyTables are tables newly added to the publication, they're
+	// copied before streaming even when a position is already stored.
+	// Their local rows, if any, are replaced, and so are the rows the
+	// stream inserts until the position they were copied at.
+	CopyTables []string
+	// Resync is set when the slot was lost and is created again, the
+	// CopyTables are every table, copied from the new slot's snapshot.
+	Resync bool
+	// Copied, when set, is called with the CopyTables once they're
+	// copied, to forget the pending copies.
+	Copied func(tables []string) error
+	// TwoPhase enables decoding of prepared transactions.
+	TwoPhase bool
+	// Binary has the upstream send values in their types' binary
+	// format, which is cheaper to produce than the text format.
+	Binary      bool
+	Copy        CopyConfig
+	GroupCommit GroupCommitConfig
+	// Bootstrap fills an empty local database from elsewhere than the
+	// upstream, once the source has applied minLSN, and returns the
+	// position to stream from. The initial copy runs if it fails.
+	Bootstrap func(ctx context.Context, minLSN pglogrepl.LSN) (pglogrepl.LSN, error)
+	// Control runs the commands of the control messages, see package
+	// control. Streaming waits for it to return.
+	Control func(ctx context.Context, content []byte) error
+	// Backfill copies the rows of a table created locally while
+	// streaming, e.g. one added to the publication, and returns the
+	// upstream position it copied them at. Streaming waits for it to
+	// return, tables aren't backfilled when it's nil.
+	Backfill func(ctx context.Context, table string) (pglogrepl.LSN, error)
+	// Resyncs are the tables to copy again with CopyTable, queued by
+	// Replicator.ResyncTable. They're copied between transactions,
+	// like backfilled tables.
+	Resyncs   <-chan string
+	CopyTable func(ctx context.Context, table string) (pglogrepl.LSN, error)
+	// MigrationsDir is where schema changes are written as migration files,
+	// instead of being applied. Streaming stops until they're applied.
+	MigrationsDir string
+	// Limits bounds the size of single changes.
+	Limits LimitsConfig
+	// Journal records the received messages for debugging.
+	Journal JournalConfig
+	// AckDelay holds back the position confirmed to the upstream.
+	AckDelay AckDelayConfig
+	// Delivery is one of the sqlgen Delivery constants, and must match
+	// the local database's config.
+	Delivery string
+	// SkipCommittedBefore skips the transactions committed before it,
+	// which were applied from another upstream before failing over.
+	SkipCommittedBefore time.Time
+}
+
+func (cfg SlotConfig) copied() error {
+	if cfg.Copied == nil || len(cfg.CopyTables) == 0 {
+		return nil
+	}
+
+	if err := cfg.Copied(cfg.CopyTables); err != nil {
+		return fmt.Errorf("forget pending copies: %w", err)
+	}
+
+	return nil
 }
 
 type DBDriver interface {
 	Pos() (string, error)
 	Execute(query string) error
+	PreparedQueries(gid string) ([]string, error)
+	PreparedUndo(gid string) ([]string, error)
+}
+
+// router is a DBDriver that applies each message's
+// sql to the databases the message's rows belong to.
+type router interface {
+	Apply(msg pglogrepl.Message, query string) error
+}
+
+// copyRouter is a DBDriver writing the tables and rows of the initial
+// copy to the databases the rows belong to.
+type copyRouter interface {
+	CopyTable(query string) error
+	CopyRow(columns []sqlgen.ColDef, row []string, query string) error
+}
+
+// binder is a DBDriver executing sql with bound parameters, the values
+// of row changes are bound instead of formatted into their sql.
+type binder interface {
+	ExecuteStatement(stmt sqlgen.Statement) error
+}
+
+// invalidator is a DBDriver caching the statements prepared for each
+// table's changes, which are dropped when the table's schema changes.
+type invalidator interface {
+	Invalidate(table string)
+}
+
+// binds reports whether the driver executes row changes with bound
+// parameters, routers split the sql by message and get it as text.
+func binds(d DBDriver) bool {
+	if _, ok := d.(router); ok {
+		return false
+	}
+
+	_, ok := d.(binder)
+
+	return ok
+}
+
+// apply executes the message's statement, routing it when the driver is a router.
+func apply(d DBDriver, msg pglogrepl.Message, stmt sqlgen.Statement) error {
+	if r, ok := d.(router); ok {
+		return applyError(r.Apply(msg, stmt.Query))
+	}
+
+	if b, ok := d.(binder); ok && len(stmt.Args) > 0 {
+		return applyError(b.ExecuteStatement(stmt))
+	}
+
+	if err := d.Execute(stmt.Query); err != nil {
+		return applyError(err)
+	}
+
+	if i, ok := d.(invalidator); ok {
+		invalidate(i, msg)
+	}
+
+	return nil
+}
+
+// invalidate drops the statements prepared for the table the message
+// changed the schema of, or dropped.
+func invalidate(i invalidator, msg pglogrepl.Message) {
+	if table, ok := schemaChange(msg); ok {
+		i.Invalidate(table)
+	}
+}
+
+// schemaChange returns the local table the message changes the schema
+// of, or drops.
+func schemaChange(msg pglogrepl.Message) (string, bool) {
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessageV2:
+		return msg.RelationName, true
+	case *pglogrepl.LogicalDecodingMessageV2:
+		if msg.Prefix != pgoutput.DropTablePrefix {
+			return "", false
+		}
+
+		_, name, ok := strings.Cut(string(msg.Content), ".")
+
+		return name, ok
+	}
+
+	return "", false
+}
+
+// generate returns the sql of the messages applied the same way whether
+// they're streamed or replayed, it's false for unknown messages.
+func generate(d DBDriver, gen SQLGen, msg pglogrepl.Message, schema string) (sqlgen.Statement, bool, error) {
+	var (
+		query string
+		err   error
+	)
+
+	switch msg := msg.(type) {
+	case *pglogrepl.InsertMessageV2:
+		if binds(d) {
+			stmt, err := gen.BindInsert(msg)
+			return stmt, true, generateError(err)
+		}
+
+		query, err = gen.Insert(msg)
+	case *pglogrepl.UpdateMessageV2:
+		if binds(d) {
+			stmt, err := gen.BindUpdate(msg)
+			return stmt, true, generateError(err)
+		}
+
+		query, err = gen.Update(msg)
+	case *pglogrepl.DeleteMessageV2:
+		if binds(d) {
+			stmt, err := gen.BindDelete(msg)
+			return stmt, true, generateError(err)
+		}
+
+		query, err = gen.Delete(msg)
+	case *pglogrepl.TruncateMessageV2:
+		query, err = gen.Truncate(msg)
+	case *pglogrepl.TypeMessageV2:
+	case *pglogrepl.OriginMessage:
+		query, err = gen.Origin(msg)
+	case *pglogrepl.LogicalDecodingMessageV2:
+		log.Debug().Msgf("Logical decoding message: %q, %q, %d", msg.Prefix, msg.Content, msg.Xid)
+
+		if table := droppedTable(msg, schema); table != "" {
+			query, err = gen.DropTable(table)
+		} else {
+			query, err = gen.Message(msg)
+		}
+	case *pglogrepl.StreamStartMessageV2:
+		query, err = gen.StreamStart(msg)
+	case *pglogrepl.StreamStopMessageV2:
+		query, err = gen.StreamStop(msg)
+	case *pglogrepl.StreamCommitMessageV2:
+		query, err = gen.StreamCommit(msg)
+	case *pglogrepl.StreamAbortMessageV2:
+		query, err = gen.StreamAbort(msg)
+	case *pgoutput.BeginPrepareMessage:
+		query, err = gen.BeginPrepare(msg)
+	case *pgoutput.PrepareMessage:
+		query, err = gen.Prepare(msg)
+	case *pgoutput.CommitPreparedMessage:
+		staged, err := d.PreparedQueries(msg.Gid)
+		if err != nil {
+			return sqlgen.Statement{}, true, fmt.Errorf("read prepared transaction %q: %w", msg.Gid, err)
+		}
+
+		query, err = gen.CommitPrepared(msg, staged)
+		if err != nil {
+			return sqlgen.Statement{}, true, err
+		}
+	case *pgoutput.RollbackPreparedMessage:
+		undo, err := d.PreparedUndo(msg.Gid)
+		if err != nil {
+			return sqlgen.Statement{}, true, fmt.Errorf("read prepared transaction %q: %w", msg.Gid, err)
+		}
+
+		query, err = gen.RollbackPrepared(msg, undo)
+		if err != nil {
+			return sqlgen.Statement{}, true, err
+		}
+	default:
+		return sqlgen.Statement{}, false, nil
+	}
+
+	return sqlgen.Statement{Query: query}, true, generateError(err)
 }
 
 type SQLGen interface {
@@ -94,18 +655,33 @@ type SQLGen interface {
 	Insert(*pglogrepl.InsertMessageV2) (string, error)
 	Update(*pglogrepl.UpdateMessageV2) (string, error)
 	Delete(*pglogrepl.DeleteMessageV2) (string, error)
+	BindInsert(*pglogrepl.InsertMessageV2) (sqlgen.Statement, error)
+	BindUpdate(*pglogrepl.UpdateMessageV2) (sqlgen.Statement, error)
+	BindDelete(*pglogrepl.DeleteMessageV2) (sqlgen.Statement, error)
 	Truncate(*pglogrepl.TruncateMessageV2) (string, error)
 	StreamStart(*pglogrepl.StreamStartMessageV2) (string, error)
 	StreamStop(*pglogrepl.StreamStopMessageV2) (string, error)
 	StreamCommit(*pglogrepl.StreamCommitMessageV2) (string, error)
 	StreamAbort(*pglogrepl.StreamAbortMessageV2) (string, error)
+	BeginPrepare(*pgoutput.BeginPrepareMessage) (string, error)
+	Prepare(*pgoutput.PrepareMessage) (string, error)
+	CommitPrepared(msg *pgoutput.CommitPreparedMessage, staged []string) (string, error)
+	RollbackPrepared(*pgoutput.RollbackPreparedMessage, []string) (string, error)
+	DropTable(table string) (string, error)
+	Message(*pglogrepl.LogicalDecodingMessageV2) (string, error)
+	Origin(*pglogrepl.OriginMessage) (string, error)
+	Backfilling(table string, lsn pglogrepl.LSN)
 
 	Pos(p string) string
+	SnapshotPos(p string) string
+	AckedPos(p string) string
 	CopyCreateTable(schema, tableName string, colDefs []sqlgen.ColDef) (string, error)
 	InsertCopyRow(schema, tableName string, colDefs []sqlgen.ColDef, rowValues []string) (string, error)
 }
 
 func (c *Conn) Stream(ctx context.Context, cfg SlotConfig, d DBDriver, gen SQLGen) error {
+	defer c.stats.setState(StateStopped)
+
 	pos, err := d.Pos()
 	if err != nil {
 		return fmt.Errorf("find starting pos: %w", err)
@@ -124,23 +700,96 @@ func (c *Conn) Stream(ctx context.Context, cfg SlotConfig, d DBDriver, gen SQLGe
 		}
 	}
 
-	slot, err := c.slot(cfg.SlotName, cfg.OutputPlugin, cfg.CreateSlotIfNoExists, cfg.Temporary, c.pos, cfg.StandbyTimeout)
+	slot, err := c.slot(cfg, c.pos)
 	if err != nil {
 		return fmt.Errorf("build slot: %w", err)
 	}
 
+	if pos == "" || len(cfg.CopyTables) > 0 {
+		c.stats.setState(StateCopying)
+	}
+
 	if pos == "" {
+		c.stats.copyPending()
+	}
+
+	bootstrapped := false
+
+	if pos == "" && cfg.Bootstrap != nil {
+		lsn, err := cfg.Bootstrap(ctx, slot.consistentPoint)
+		if err != nil {
+			log.Warn().Err(err).Msg("bootstrap failed, copying from upstream")
+		} else {
+			log.Debug().Msgf("bootstrapped at %s", lsn)
+
+			c.pos, bootstrapped = lsn, true
+
+			if err := d.Execute(gen.Pos(c.pos.String()) + gen.SnapshotPos(lsn.String())); err != nil {
+				return fmt.Errorf("track position after bootstrap: %w", err)
+			}
+
+			c.stats.snapshotted(lsn)
+			c.milestones.snapshot(lsn)
+			c.stats.warm()
+		}
+	}
+
+	if pos == "" && !bootstrapped {
 		log.Debug().Msg("starting copy")
 
-		if err := c.InitialCopy(ctx, cfg.Schema, slot.startSnapshot, d, gen); err != nil {
+		if err := c.InitialCopy(ctx, cfg.Copy, cfg.Schema, slot.startSnapshot, cfg.Tables, d, gen); err != nil {
 			return fmt.Errorf("copy: %w", err)
 		}
 
 		log.Debug().Msg("finished copy")
 
-		if err := d.Execute(gen.Pos(c.pos.String())); err != nil {
+		if err := d.Execute(gen.Pos(c.pos.String()) + gen.SnapshotPos(slot.consistentPoint.String())); err != nil {
 			return fmt.Errorf("track position after copy: %w", err)
 		}
+
+		// the added tables were copied with the rest
+		if err := cfg.copied(); err != nil {
+			return err
+		}
+
+		c.stats.snapshotted(slot.consistentPoint)
+		c.milestones.snapshot(slot.consistentPoint)
+		c.stats.warm()
+	} else if len(cfg.CopyTables) > 0 && !bootstrapped {
+		log.Debug().Msgf("starting copy of added tables: %v", cfg.CopyTables)
+
+		// the tables may have rows, from a copy that was interrupted
+		// or from before the slot was lost
+		copyCfg := cfg.Copy
+		copyCfg.replace = true
+
+		if err := c.InitialCopy(ctx, copyCfg, cfg.Schema, slot.startSnapshot, cfg.CopyTables, d, gen); err != nil {
+			return fmt.Errorf("copy added tables: %w", err)
+		}
+
+		if slot.startSnapshot == "" {
+			// the slot already existed, so the tables were copied without
+			// its snapshot, with changes the stream replays on top
+			if err := c.backfilling(gen, cfg.CopyTables); err != nil {
+				return err
+			}
+		}
+
+		log.Debug().Msg("finished copy of added tables")
+
+		if cfg.Resync {
+			if err := d.Execute(gen.SnapshotPos(slot.consistentPoint.String())); err != nil {
+				return fmt.Errorf("track position after resync: %w", err)
+			}
+
+			c.stats.snapshotted(slot.consistentPoint)
+			c.milestones.snapshot(slot.consistentPoint)
+		}
+
+		if err := cfg.copied(); err != nil {
+			return err
+		}
+		c.stats.warm()
 	}
 
 	log.Debug().Msgf("starting slot from pos: %q", c.pos)
@@ -149,72 +798,310 @@ func (c *Conn) Stream(ctx context.Context, cfg SlotConfig, d DBDriver, gen SQLGe
 		return fmt.Errorf("start slot: %w", err)
 	}
 
+	c.stats.streaming(c.pos)
+
+	c.changes = newChanges()
+
 	var (
 		logicalMsg pglogrepl.Message
-		query      string
+		stmt       sqlgen.Statement
 	)
 
 	stream := slot.Stream()
 
+	grp := &group{cfg: cfg.GroupCommit}
+	defer grp.reset()
+
+	// inTxn is set between an upstream transaction's begin and commit,
+	// a group can only be committed between transactions.
+	inTxn := false
+
+	// txLSN is the commit position of the current transaction,
+	// msgLSN the stream position of the current message, and
+	// ackedLSN the acked position last recorded locally.
+	var txLSN, msgLSN, ackedLSN pglogrepl.LSN
+
+	// inStream is set between the start and stop of a chunk of
+	// a streamed transaction.
+	inStream := false
+
+	atLeastOnce := cfg.Delivery == sqlgen.DeliveryAtLeastOnce
+	dups := &duplicates{committed: c.pos, before: cfg.SkipCommittedBefore}
+
+	// created are the tables created by the current transaction,
+	// backfilled once it's committed, and resyncs the tables queued
+	// to be copied again once no transaction is open.
+	var created, resyncs []string
+
+	progress := time.NewTicker(progressInterval)
+	defer progress.Stop()
+
 	for {
+		c.stats.looped()
+
 		select {
 		case <-ctx.Done():
 			slot.Close()
+
+			if !inTxn {
+				if err := c.flushGroup(d, slot, grp); err != nil {
+					log.Error().Err(err).Msg("commit group on shutdown")
+				} else if err := slot.record(d, gen); err != nil {
+					log.Error().Err(err).Msg("record position on shutdown")
+				}
+			}
+
 			return ctx.Err()
 		case <-slot.errs:
 			return fmt.Errorf("slot error: %w", err)
-		case logicalMsg = <-stream:
+		case <-progress.C:
+			stats := c.Stats()
+			logProgress(stats)
+
+			// the acked position is recorded between transactions,
+			// outside any local transaction.
+			if !inTxn && !grp.open && stats.AckedLSN != ackedLSN {
+				if err := d.Execute(gen.AckedPos(stats.AckedLSN.String())); err != nil {
+					return fmt.Errorf("track acked position: %w", err)
+				}
+
+				ackedLSN = stats.AckedLSN
+			}
+
+			if !inTxn && !grp.open {
+				if err := slot.record(d, gen); err != nil {
+					return err
+				}
+			}
+
+			continue
+		case <-grp.expired():
+			if !inTxn {
+				if err := c.flushGroup(d, slot, grp); err != nil {
+					return err
+				}
+			}
+
+			continue
+		case table := <-cfg.Resyncs:
+			resyncs = append(resyncs, table)
+
+			if !inTxn && !inStream {
+				if err := c.resync(ctx, d, cfg, gen, slot, grp, resyncs); err != nil {
+					return err
+				}
+
+				resyncs = nil
+			}
+
+			continue
+		case r := <-stream:
+			logicalMsg, msgLSN = r.msg, r.lsn
+		}
+
+		switch logicalMsg.(type) {
+		case *pglogrepl.StreamStartMessageV2:
+			inStream = true
+		case *pglogrepl.StreamStopMessageV2:
+			inStream = false
 		}
 
+		// with at-least-once delivery resent transactions are applied
+		// again, unless they were applied before failing over
+		if (!atLeastOnce || !dups.before.IsZero()) && dups.skip(logicalMsg) {
+			slot.committed(logicalMsg)
+			continue
+		}
+
+		if !groupable(logicalMsg) {
+			if err := c.flushGroup(d, slot, grp); err != nil {
+				return err
+			}
+		}
+
+		// oversized changes are skipped before generating their sql
+		if reason := cfg.Limits.exceeded(logicalMsg, ""); reason != "" {
+			if err := c.deadLetter(cfg.Limits.DLQDir, txLSN, logicalMsg, reason); err != nil {
+				return err
+			}
+
+			c.stats.deadLettered()
+
+			continue
+		}
+
+		stmt = sqlgen.Statement{}
+
 		switch logicalMsg := logicalMsg.(type) {
 		case *pglogrepl.RelationMessageV2:
-			query, err = gen.Relation(logicalMsg)
+			stmt.Query, err = gen.Relation(logicalMsg)
+
+			if err == nil && stmt.Query != "" && cfg.MigrationsDir != "" {
+				path, err := writeMigration(cfg.MigrationsDir, migrationLSN(txLSN, msgLSN, inStream), logicalMsg, stmt.Query)
+				if err != nil {
+					return err
+				}
+
+				return fmt.Errorf("%w: review and apply %s, then restart", ErrPendingMigration, path)
+			}
+
+			if err == nil && cfg.Backfill != nil && strings.HasPrefix(stmt.Query, "CREATE TABLE") {
+				// the local database didn't have the table
+				created = append(created, logicalMsg.RelationName)
+				c.stats.cooling(logicalMsg.RelationName)
+			}
 		case *pglogrepl.BeginMessage:
-			query, err = gen.Begin(logicalMsg)
+			stmt.Query, err = gen.Begin(logicalMsg)
+			inTxn = true
+			txLSN = logicalMsg.FinalLSN
+
+			if grp.cfg.enabled() && !grp.begin() {
+				// the group's local transaction is already open
+				stmt.Query = ""
+			}
 		case *pglogrepl.CommitMessage:
-			query, err = gen.Commit(logicalMsg)
-		case *pglogrepl.InsertMessageV2:
-			query, err = gen.Insert(logicalMsg)
-		case *pglogrepl.UpdateMessageV2:
-			query, err = gen.Update(logicalMsg)
-		case *pglogrepl.DeleteMessageV2:
-			query, err = gen.Delete(logicalMsg)
-		case *pglogrepl.TruncateMessageV2:
-			query, err = gen.Truncate(logicalMsg)
-		case *pglogrepl.TypeMessageV2:
-		case *pglogrepl.OriginMessage:
-		case *pglogrepl.LogicalDecodingMessageV2:
-			log.Debug().Msgf("Logical decoding message: %q, %q, %d", logicalMsg.Prefix, logicalMsg.Content, logicalMsg.Xid)
-		case *pglogrepl.StreamStartMessageV2:
-			query, err = gen.StreamStart(logicalMsg)
-		case *pglogrepl.StreamStopMessageV2:
-			query, err = gen.StreamStop(logicalMsg)
-		case *pglogrepl.StreamCommitMessageV2:
-			query, err = gen.StreamCommit(logicalMsg)
-		case *pglogrepl.StreamAbortMessageV2:
-			query, err = gen.StreamAbort(logicalMsg)
+			inTxn = false
+
+			switch {
+			case !grp.cfg.enabled():
+				stmt.Query, err = gen.Commit(logicalMsg)
+			case !atLeastOnce:
+				// the position is committed with the group, with
+				// at-least-once delivery it's recorded later
+				stmt.Query = gen.Pos(logicalMsg.CommitLSN.String())
+			}
 		default:
-			log.Debug().Msgf("Unknown message type in pgoutput stream: %T", logicalMsg)
-			continue
+			var ok bool
+			if stmt, ok, err = generate(d, gen, logicalMsg, cfg.Schema); !ok {
+				log.Debug().Msgf("Unknown message type in pgoutput stream: %T", logicalMsg)
+				continue
+			}
 		}
 
-		log.Debug().Msg(query)
+		log.Debug().Msg(stmt.Query)
 
 		if err != nil {
 			return fmt.Errorf("generate sql: %w", err)
 		}
 
-		if err = d.Execute(query); err != nil {
-			return fmt.Errorf("apply sql: %w", err)
+		if reason := cfg.Limits.exceeded(logicalMsg, stmt.Query); reason != "" {
+			if err := c.deadLetter(cfg.Limits.DLQDir, txLSN, logicalMsg, reason); err != nil {
+				return err
+			}
+
+			c.stats.deadLettered()
+
+			continue
+		}
+
+		if stmt.Query != "" {
+			if err := apply(d, logicalMsg, stmt); err != nil {
+				return fmt.Errorf("apply sql: %w", err)
+			}
+
+			if table, ok := schemaChange(logicalMsg); ok {
+				c.events.Publish(events.Event{Kind: events.SchemaChanged, Table: table})
+			}
+		}
+
+		if _, ok := logicalMsg.(*pglogrepl.RelationMessageV2); ok || inTxn {
+			c.changes.add(logicalMsg, txLSN)
+		}
+
+		if m, ok := logicalMsg.(*pglogrepl.LogicalDecodingMessageV2); ok {
+			if !m.Transactional {
+				// sent as soon as it's emitted, outside of any transaction
+				c.feed.Publish(messageChanges(m))
+			}
+
+			if m.Prefix == pgoutput.ControlPrefix && cfg.Control != nil {
+				// a failed command doesn't stop the replication
+				if err := cfg.Control(ctx, m.Content); err != nil {
+					log.Error().Err(err).Msgf("control message at %s", m.LSN)
+				}
+			}
+		}
+
+		commit, ok := logicalMsg.(*pglogrepl.CommitMessage)
+		if !ok || !grp.cfg.enabled() {
+			if ok {
+				c.feed.Publish(c.changes.take())
+			}
+
+			c.stats.applied(logicalMsg)
+			c.milestones.applied(logicalMsg)
+			c.publishApplied(logicalMsg)
+			slot.committed(logicalMsg)
+		} else if grp.commit(commit) || len(created) > 0 {
+			// grouped commits are counted once they're committed locally
+			if err := c.flushGroup(d, slot, grp); err != nil {
+				return err
+			}
+		}
+
+		if ok && len(created) > 0 {
+			c.backfill(ctx, cfg.Backfill, gen, created)
+			created = nil
+		}
+
+		if !inTxn && !inStream && len(resyncs) > 0 {
+			if err := c.resync(ctx, d, cfg, gen, slot, grp, resyncs); err != nil {
+				return err
+			}
+
+			resyncs = nil
 		}
 	}
 }
 
+// resync copies the tables queued by Replicator.ResyncTable again, once
+// the group is committed, as the copies write through another connection.
+func (c *Conn) resync(ctx context.Context, d DBDriver, cfg SlotConfig, gen SQLGen, s *slot, g *group, tables []string) error {
+	if err := c.flushGroup(d, s, g); err != nil {
+		return err
+	}
+
+	c.backfill(ctx, cfg.CopyTable, gen, tables)
+
+	return nil
+}
+
+const (
+	// progressInterval is how often the catch-up progress is logged.
+	progressInterval = 10 * time.Second
+	// catchUpLag is the lag in bytes above which the stream is catching up.
+	catchUpLag = 1 << 20
+)
+
+// logProgress logs how far behind the upstream the stream is,
+// and how long until it's caught up, while it's catching up.
+func logProgress(stats Stats) {
+	lag := stats.Lag()
+	if lag < catchUpLag {
+		return
+	}
+
+	eta := "unknown"
+	if d, ok := stats.ETA(); ok {
+		eta = d.Round(time.Second).String()
+	}
+
+	log.Info().Msgf(
+		"catching up: %.1f%% applied, %d MiB behind, applying %.1f MiB/s, eta %s",
+		stats.Progress()*100, lag>>20, stats.ApplyRate/(1<<20), eta,
+	)
+}
+
+// Stats returns the progress of the connection's replication stream.
+func (c *Conn) Stats() Stats {
+	return c.stats.snapshot()
+}
+
 func (c *Conn) GetSlot(cfg SlotConfig, pos pglogrepl.LSN) (*slot, error) {
-	return c.slot(cfg.SlotName, cfg.OutputPlugin, cfg.CreateSlotIfNoExists, cfg.Temporary, pos, cfg.StandbyTimeout)
+	return c.slot(cfg, pos)
 }
 
-func (c *Conn) slot(slotName, outputPlugin string, createSlot, temporary bool, pos pglogrepl.LSN, standbyTimeout int) (*slot, error) {
+func (c *Conn) slot(cfg SlotConfig, pos pglogrepl.LSN) (*slot, error) {
 	pluginArguments := []string{
 		"proto_version '2'",
 		fmt.Sprintf("publication_names '%s'", c.publication),
@@ -222,28 +1109,89 @@ func (c *Conn) slot(slotName, outputPlugin string, createSlot, temporary bool, p
 		"streaming 'false'",
 	}
 
+	opts := pglogrepl.CreateReplicationSlotOptions{Temporary: cfg.Temporary}
+
+	if cfg.TwoPhase {
+		// two phase decoding needs protocol version 3, and
+		// the slot must be created with two phase enabled.
+		pluginArguments[0] = "proto_version '3'"
+		pluginArguments = append(pluginArguments, "two_phase 'on'")
+		opts.SnapshotAction = "TWO_PHASE"
+	}
+
+	if cfg.Binary {
+		pluginArguments = append(pluginArguments, "binary 'true'")
+	}
+
 	s := &slot{
 		conn:           c.conn,
 		args:           pluginArguments,
-		name:           slotName,
+		name:           cfg.SlotName,
 		pos:            c.pos,
-		standbyTimeout: standbyTimeout,
+		standbyTimeout: cfg.StandbyTimeout,
+		stats:          c.stats,
+		events:         c.events,
+		budget:         c.budget,
+		delivery:       cfg.Delivery,
 	}
 
-	// TODO: automatically work out if slot exists
-	if createSlot {
+	s.durable.Store(uint64(c.pos))
+
+	if cfg.AckDelay.enabled() {
+		s.delay = NewAckWindow(cfg.AckDelay, c.pos)
+	}
+
+	// an existing slot streams from at least its confirmed position
+	s.consistentPoint = c.pos
+
+	create := cfg.CreateSlotIfNoExists
+	if create {
+		exists, err := c.slotExists(cfg.SlotName)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case exists && pos == 0:
+			// the node has nothing to stream on top of, it copies
+			// the tables from a new slot's snapshot
+			log.Warn().Msgf("slot %q exists without a local position, creating it again", cfg.SlotName)
+
+			if err := pglogrepl.DropReplicationSlot(context.Background(), c.conn, cfg.SlotName, pglogrepl.DropReplicationSlotOptions{}); err != nil {
+				return nil, fmt.Errorf("drop slot: %w", err)
+			}
+		case exists:
+			// e.g. a persistent slot of a node restarting
+			create = false
+		}
+	}
+
+	if create {
 		res, err := pglogrepl.CreateReplicationSlot(
 			context.Background(),
 			c.conn,
-			slotName,
-			outputPlugin,
-			pglogrepl.CreateReplicationSlotOptions{Temporary: temporary},
+			cfg.SlotName,
+			cfg.OutputPlugin,
+			opts,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("create slot: %w", err)
 		}
 
 		s.startSnapshot = res.SnapshotName
+
+		if lsn, err := pglogrepl.ParseLSN(res.ConsistentPoint); err == nil {
+			s.consistentPoint = lsn
+		}
+	}
+
+	if cfg.Journal.Path != "" {
+		j, err := OpenJournal(cfg.Journal)
+		if err != nil {
+			return nil, err
+		}
+
+		s.journal = j
 	}
 
 	return s, nil
@@ -259,26 +1207,54 @@ func (c *Conn) identify() error {
 	return nil
 }
 
-func tableColDefs(connStr, schema string) (map[string][]sqlgen.ColDef, error) {
+func upstreamDB(connStr string) (*sql.DB, error) {
 	db, err := sql.Open("pgx", strings.Replace(connStr, "replication=database", "", 1))
 	if err != nil {
 		return nil, fmt.Errorf("open connection: %w", err)
 	}
 
-	defs, err := tables.TableColDefs(db, schema, nil)
-	if err != nil {
-		return nil, fmt.Errorf("load col definitions: %w", err)
+	return db, nil
+}
+
+// CopyConfig controls how tables are split up during the initial copy.
+type CopyConfig struct {
+	// ChunkBytes is the target size of each chunk of rows, sized
+	// using the upstream table statistics. Zero disables chunking.
+	ChunkBytes int64
+	// MaxWorkers is the maximum number of chunks copied in parallel,
+	// each on its own connection sharing the slot's snapshot.
+	MaxWorkers int
+
+	// replace copies over the tables' rows, which are kept until the
+	// table's copy is committed.
+	replace bool
+}
+
+// beginSnapshot starts a read only transaction on conn,
+// using the exported snapshot if there is one.
+func beginSnapshot(ctx context.Context, conn *pgconn.PgConn, snapshotName string) {
+	query := `BEGIN TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY;`
+	if snapshotName != "" {
+		query += fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s';", snapshotName)
 	}
 
-	return defs, nil
+	log.Debug().Msg(query)
+
+	conn.Exec(ctx, query).Close()
 }
 
-func (c *Conn) InitialCopy(ctx context.Context, schema, snapshotName string, dst DBDriver, gen SQLGen) (err error) {
+func (c *Conn) InitialCopy(ctx context.Context, cfg CopyConfig, schema, snapshotName string, filterTables []string, dst DBDriver, gen SQLGen) (err error) {
 	if schema == "" {
 		return fmt.Errorf("cannot copy for empty schema")
 	}
 
-	defs, err := tableColDefs(c.connStr, schema)
+	db, err := upstreamDB(c.connStr)
+	if err != nil {
+		return fmt.Errorf("upstream db: %w", err)
+	}
+	defer db.Close()
+
+	defs, err := tables.TableColDefs(db, schema, filterTables)
 	if err != nil {
 		return fmt.Errorf("load col defs: %w", err)
 	}
@@ -288,61 +1264,162 @@ func (c *Conn) InitialCopy(ctx context.Context, schema, snapshotName string, dst
 		return fmt.Errorf("pgconnect: %w", err)
 	}
 
-	query := `BEGIN TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY;`
-	if snapshotName != "" {
-		query += fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s';", snapshotName)
-	}
-
-	log.Debug().Msg(query)
+	beginSnapshot(ctx, copyConn, snapshotName)
 
-	copyConn.Exec(ctx, query).Close()
+	copyConns := []*pgconn.PgConn{copyConn}
 
 	defer func() {
-		defer copyConn.Close(ctx)
-
 		if e := recover(); e != nil {
-			copyConn.Exec(ctx, `ROLLBACK;`).Close()
 			err = fmt.Errorf("recover: %v", e)
-			log.Debug().Msg("ROLLBACK")
 		}
 
-		if err != nil {
-			copyConn.Exec(ctx, `ROLLBACK;`).Close()
-			log.Debug().Msg("ROLLBACK")
-		}
+		for _, copyConn := range copyConns {
+			if err != nil {
+				copyConn.Exec(ctx, `ROLLBACK;`).Close()
+				log.Debug().Msg("ROLLBACK")
+			} else {
+				copyConn.Exec(ctx, `COMMIT;`).Close()
+				log.Debug().Msg("COMMIT")
+			}
 
-		copyConn.Exec(ctx, `COMMIT;`).Close()
-		log.Debug().Msg("COMMIT")
+			copyConn.Close(ctx)
+		}
 	}()
 
+	// parallel copies only see the same data when they share the
+	// exported snapshot, without one everything is copied on copyConn.
+	if snapshotName != "" {
+		for i := 1; i < cfg.MaxWorkers; i++ {
+			workerConn, err := pgconn.Connect(context.Background(), c.connStr)
+			if err != nil {
+				return fmt.Errorf("pgconnect copy worker: %w", err)
+			}
+
+			beginSnapshot(ctx, workerConn, snapshotName)
+			copyConns = append(copyConns, workerConn)
+		}
+	}
+
+	names := make([]string, 0, len(defs))
+	for table := range defs {
+		names = append(names, table)
+	}
+
+	c.stats.copying(names)
+
 	for table, columns := range defs {
-		var (
-			query string
-			vals  [][]string
-		)
+		plan := tables.CopyPlan{Chunks: 1, Workers: 1}
+
+		if cfg.ChunkBytes > 0 {
+			stats, err := tables.Stats(db, schema, table)
+			if err != nil {
+				return fmt.Errorf("table stats: %w", err)
+			}
+
+			plan = tables.PlanCopy(stats, cfg.ChunkBytes, len(copyConns))
+		}
+
+		var query string
 
 		query, err = gen.CopyCreateTable(schema, table, columns)
+		if err != nil {
+			return fmt.Errorf("generate sql: %w", err)
+		}
+
+		// the tenants' databases are replaced outside a transaction,
+		// since the copy's rows are routed to them one at a time.
+		_, routed := dst.(copyRouter)
+		inTx := cfg.replace && !routed
+
+		if cfg.replace {
+			query += " DELETE FROM " + table + ";"
+		}
+
+		if inTx {
+			query = "BEGIN TRANSACTION; " + query
+		}
+
+		// the table keeps its rows when its copy fails
+		rollback := func() {
+			if !inTx {
+				return
+			}
+
+			if err := dst.Execute("ROLLBACK;"); err != nil {
+				log.Warn().Err(err).Msgf("roll back copy of %q", table)
+			}
+		}
 
-		if err = dst.Execute(query); err != nil {
+		if r, ok := dst.(copyRouter); ok {
+			err = r.CopyTable(query)
+		} else {
+			err = dst.Execute(query)
+		}
+
+		if err != nil {
+			rollback()
 			return fmt.Errorf("execute inital copy: %w", err)
 		}
 
 		log.Debug().Msg(query)
-		vals, err = tables.Copy(ctx, table, columns, copyConn)
+		log.Debug().Msgf("copying %q in %d chunks with %d workers", table, plan.Chunks, plan.Workers)
+
+		if err = copyTable(ctx, copyConns[:plan.Workers], plan, schema, table, columns, dst, gen); err != nil {
+			rollback()
+			return err
+		}
+
+		if inTx {
+			if err = dst.Execute("COMMIT;"); err != nil {
+				rollback()
+				return fmt.Errorf("commit copy of %q: %w", table, err)
+			}
+		}
+
+		c.stats.copied(table)
+	}
+
+	return nil
+}
+
+func copyTable(ctx context.Context, conns []*pgconn.PgConn, plan tables.CopyPlan, schema, table string, columns []sqlgen.ColDef, dst DBDriver, gen SQLGen) error {
+	if plan.Chunks <= 1 {
+		vals, err := tables.Copy(ctx, table, columns, conns[0])
 		if err != nil {
 			return fmt.Errorf("copy table: %w", err)
 		}
 
-		for _, row := range vals {
-			query, err = gen.InsertCopyRow(schema, table, columns, row)
-			if err != nil {
-				return fmt.Errorf("generate sql: %w", err)
-			}
+		return insertCopyRows(schema, table, columns, vals, dst, gen)
+	}
+
+	for first := 0; first < plan.Chunks; first += len(conns) {
+		n := min(len(conns), plan.Chunks-first)
 
-			log.Debug().Msg(query)
+		vals := make([][][]string, n)
+		errs := make([]error, n)
 
-			if err = dst.Execute(query); err != nil {
-				return fmt.Errorf("execute inital copy: %w", err)
+		wg := sync.WaitGroup{}
+
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				startPage, endPage := plan.Range(first + i)
+				vals[i], errs[i] = tables.CopyRange(ctx, table, columns, conns[i], startPage, endPage)
+			}(i)
+		}
+
+		wg.Wait()
+
+		for i := 0; i < n; i++ {
+			if errs[i] != nil {
+				return fmt.Errorf("copy table chunk %d: %w", first+i, errs[i])
+			}
+
+			if err := insertCopyRows(schema, table, columns, vals[i], dst, gen); err != nil {
+				return err
 			}
 		}
 	}
@@ -350,16 +1427,61 @@ func (c *Conn) InitialCopy(ctx context.Context, schema, snapshotName string, dst
 	return nil
 }
 
+func insertCopyRows(schema, table string, columns []sqlgen.ColDef, vals [][]string, dst DBDriver, gen SQLGen) error {
+	for _, row := range vals {
+		query, err := gen.InsertCopyRow(schema, table, columns, row)
+		if err != nil {
+			return fmt.Errorf("generate sql: %w", err)
+		}
+
+		log.Debug().Msg(query)
+
+		if r, ok := dst.(copyRouter); ok {
+			err = r.CopyRow(columns, row, query)
+		} else {
+			err = dst.Execute(query)
+		}
+
+		if err != nil {
+			return fmt.Errorf("execute inital copy: %w", err)
+		}
+	}
+
+	return nil
+}
+
 type slot struct {
 	conn *pgconn.PgConn
 
-	args           []string
-	name           string
-	pos            pglogrepl.LSN
-	startSnapshot  string
-	standbyTimeout int
-
-	msgs chan pglogrepl.Message
+	args          []string
+	name          string
+	pos           pglogrepl.LSN
+	startSnapshot string
+	// consistentPoint is the slot's first position, changes
+	// before it can't be streamed from the slot.
+	consistentPoint pglogrepl.LSN
+	standbyTimeout  int
+	stats           *tracker
+	events          *events.Bus
+	ack
+	// delay holds back the confirmed position, nil when
+	// positions are confirmed as soon as they're flushed.
+	delay *AckWindow
+	// delivery is one of the sqlgen Delivery constants, with at-least-once
+	// delivery unrecorded is the position of the last local commit that
+	// isn't recorded yet, and unrecordedEnd its end.
+	delivery                  string
+	unrecorded, unrecordedEnd pglogrepl.LSN
+
+	// journal records the received messages, when it's enabled.
+	journal *Journal
+
+	// budget is the memory budget shared with the proxy, held is
+	// the part of it taken by the change being applied.
+	budget *budget.Budget
+	held   int64
+
+	msgs chan received
 	errs chan error
 	done chan struct{}
 }
@@ -378,10 +1500,10 @@ func (s *slot) Start(ctx context.Context) error {
 		pglogrepl.StartReplicationOptions{PluginArgs: s.args},
 	)
 	if err != nil {
-		return fmt.Errorf("start replication: %w", err)
+		return fmt.Errorf("start replication: %w", startError(err))
 	}
 
-	s.msgs = make(chan pglogrepl.Message)
+	s.msgs = make(chan received)
 	s.errs = make(chan error)
 	s.done = make(chan struct{})
 
@@ -394,12 +1516,25 @@ func (s *slot) Errors() <-chan error {
 	return s.errs
 }
 
+// received is a message of the stream, with the position
+// its data starts at in the upstream's WAL.
+type received struct {
+	msg pglogrepl.Message
+	lsn pglogrepl.LSN
+}
+
 // Stream return replication message channel
-func (s *slot) Stream() <-chan pglogrepl.Message {
+func (s *slot) Stream() <-chan received {
 	return s.msgs
 }
 
 func (s *slot) listen() {
+	if s.journal != nil {
+		defer s.journal.Close()
+	}
+
+	defer func() { s.budget.Release(s.held) }()
+
 	standbyMessageTimeout := time.Second * time.Duration(s.standbyTimeout)
 	nextStandbyMessageDeadline := time.Now().Add(standbyMessageTimeout)
 
@@ -414,13 +1549,22 @@ func (s *slot) listen() {
 
 		if time.Now().After(nextStandbyMessageDeadline) {
 			log.Trace().Msg("status heartbeat")
+
+			flushed := s.delay.Ack(s.flushed(s.pos), time.Now())
+
 			err := pglogrepl.SendStandbyStatusUpdate(
 				context.Background(),
 				s.conn,
-				pglogrepl.StandbyStatusUpdate{WALWritePosition: s.pos},
+				pglogrepl.StandbyStatusUpdate{
+					WALWritePosition: s.pos,
+					WALFlushPosition: flushed,
+					WALApplyPosition: flushed,
+				},
 			)
 			if err != nil {
 				go s.sendErr(err)
+			} else {
+				s.stats.acked(flushed)
 			}
 
 			nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
@@ -457,6 +1601,9 @@ func (s *slot) listen() {
 				continue
 			}
 
+			s.stats.keepalive(pkm.ServerWALEnd)
+			s.events.Publish(events.Event{Kind: events.LagUpdated, LSN: pkm.ServerWALEnd, LagBytes: s.stats.lag()})
+
 			if pkm.ReplyRequested {
 				nextStandbyMessageDeadline = time.Time{}
 			}
@@ -470,7 +1617,9 @@ func (s *slot) listen() {
 				continue
 			}
 
-			logicalMsg, err := pglogrepl.ParseV2(xld.WALData, inStream)
+			s.reserve(int64(len(xld.WALData)), nextStandbyMessageDeadline)
+
+			logicalMsg, err := parseMessage(xld.WALData, inStream)
 			if err != nil {
 				go s.sendErr(fmt.Errorf("parse logical replication message failed: %w", err))
 				continue
@@ -484,18 +1633,55 @@ func (s *slot) listen() {
 				inStream = false
 			}
 
+			if s.journal != nil {
+				if err := s.journal.Record(xld.WALStart, xld.WALData, logicalMsg); err != nil {
+					log.Warn().Err(err).Msg("journal message")
+				}
+			}
+
 			log.Trace().Msg("sending logical message")
 
+			// before the stream can commit it
+			s.handOff(logicalMsg)
+
 			select {
-			case s.msgs <- logicalMsg:
+			case s.msgs <- received{msg: logicalMsg, lsn: xld.WALStart}:
 			case <-s.done:
 			}
 
 			s.pos = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+			s.stats.received(s.pos)
 		}
 	}
 }
 
+// reserve takes n bytes of the memory budget for the next change, giving
+// back those of the last one, which has been applied as the changes are
+// passed on one at a time. While the proxy's results use up the budget,
+// reading the upstream waits, at most until the next status update is
+// due so the upstream doesn't time out the connection.
+func (s *slot) reserve(n int64, deadline time.Time) {
+	s.budget.Release(s.held)
+	s.held = n
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if err := s.budget.Acquire(ctx, n); err != nil {
+		log.Debug().Msg("memory budget used up, applying the change over it")
+		s.budget.Take(n)
+	}
+}
+
+// parseMessage decodes the pgoutput message in the WAL data.
+func parseMessage(data []byte, inStream bool) (pglogrepl.Message, error) {
+	if pgoutput.IsTwoPhase(data) {
+		return pgoutput.ParseTwoPhase(data)
+	}
+
+	return pglogrepl.ParseV2(data, inStream)
+}
+
 func (s *slot) Close() error {
 	close(s.done)
 	return nil
@@ -0,0 +1,15 @@
+package replicate_test
+
+import (
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQualifiedTables(t *testing.T) {
+	assert.Equal(t,
+		`"public"."names", "public"."Orders", "public"."order ""items"""`,
+		replicate.QualifiedTables("public", []string{"names", "Orders", `order "items"`}),
+	)
+}
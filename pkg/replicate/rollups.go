@@ -0,0 +1,553 @@
+package replicate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Rollup is a local table of aggregates of a replicated table's rows,
+// e.g. the count of orders per status per day, kept up to date by
+// triggers on the table as changes are applied, instead of aggregating
+// the rows on every read.
+type Rollup struct {
+	Name  string
+	Table string
+	// Groups are the rollup's key columns, each an expression of the
+	// table's columns. Without groups the rollup has a single row.
+	Groups []RollupColumn
+	// Aggregates are sums of an expression of each row, count is
+	// the sum of 1. A count is always kept, to tell when a group has
+	// no rows left.
+	Aggregates []RollupColumn
+}
+
+// countColumn returns the name of the aggregate counting the rows.
+func (r Rollup) countColumn() string {
+	for _, a := range r.Aggregates {
+		if a.Expr == "1" {
+			return a.Name
+		}
+	}
+
+	return ""
+}
+
+// RollupColumn is a column of a rollup, and the expression of the
+// table's row it's computed from.
+type RollupColumn struct {
+	Name string
+	Expr string
+}
+
+// ParseRollups parses the rollup definitions, each
+// "name=table:group,group:aggregate,aggregate", e.g.
+// "orders_daily=orders:status,date(created_at) as day:count,sum(total)".
+// Groups are columns, or expressions named with "as". Aggregates are
+// count, count(expr) of the rows where expr isn't null, and sum(expr),
+// named count, count_<column> and sum_<column> unless they're named
+// with "as".
+func ParseRollups(specs []string) ([]Rollup, error) {
+	rollups := make([]Rollup, 0, len(specs))
+	names := map[string]bool{}
+
+	for _, spec := range specs {
+		name, def, _ := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		parts := splitTopLevel(def, ':')
+
+		if !identifier.MatchString(name) || len(parts) != 3 || !identifier.MatchString(strings.TrimSpace(parts[0])) {
+			return nil, fmt.Errorf("invalid rollup %q, expected name=table:group,group:aggregate,aggregate", spec)
+		}
+
+		if names[name] {
+			return nil, fmt.Errorf("invalid rollup %q: %s is defined twice", spec, name)
+		}
+
+		names[name] = true
+
+		r := Rollup{Name: name, Table: strings.TrimSpace(parts[0])}
+
+		for _, group := range splitTopLevel(parts[1], ',') {
+			col, err := rollupColumn(group, "")
+			if err != nil {
+				return nil, fmt.Errorf("invalid rollup %q: %w", spec, err)
+			}
+
+			r.Groups = append(r.Groups, col)
+		}
+
+		for _, agg := range splitTopLevel(parts[2], ',') {
+			col, err := rollupAggregate(agg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rollup %q: %w", spec, err)
+			}
+
+			r.Aggregates = append(r.Aggregates, col)
+		}
+
+		if r.countColumn() == "" {
+			// groups are removed once they have no rows left
+			r.Aggregates = append(r.Aggregates, RollupColumn{Name: "count", Expr: "1"})
+		}
+
+		seen := map[string]bool{}
+
+		for _, col := range append(slices.Clone(r.Groups), r.Aggregates...) {
+			if seen[strings.ToLower(col.Name)] {
+				return nil, fmt.Errorf("invalid rollup %q: column %s is defined twice", spec, col.Name)
+			}
+
+			seen[strings.ToLower(col.Name)] = true
+		}
+
+		rollups = append(rollups, r)
+	}
+
+	return rollups, nil
+}
+
+// rollupColumn parses "expr" or "expr as name", a plain column is
+// named after itself, and expressions after prefix and their column.
+func rollupColumn(s, prefix string) (RollupColumn, error) {
+	s = strings.TrimSpace(s)
+
+	if i := strings.LastIndex(strings.ToLower(s), " as "); i >= 0 {
+		name := strings.TrimSpace(s[i+4:])
+		if !identifier.MatchString(name) {
+			return RollupColumn{}, fmt.Errorf("invalid column name %q", name)
+		}
+
+		return RollupColumn{Name: name, Expr: strings.TrimSpace(s[:i])}, nil
+	}
+
+	if !identifier.MatchString(s) {
+		return RollupColumn{}, fmt.Errorf("expression %q needs a name, e.g. %s as name", s, s)
+	}
+
+	return RollupColumn{Name: prefix + s, Expr: s}, nil
+}
+
+// rollupAggregate parses an aggregate into the expression of each row
+// it sums.
+func rollupAggregate(s string) (RollupColumn, error) {
+	s = strings.TrimSpace(s)
+
+	alias := ""
+	if i := strings.LastIndex(strings.ToLower(s), " as "); i >= 0 && !strings.Contains(s[i:], ")") {
+		alias = " as " + strings.TrimSpace(s[i+4:])
+		s = strings.TrimSpace(s[:i])
+	}
+
+	fn, arg, ok := strings.Cut(s, "(")
+	fn = strings.ToLower(strings.TrimSpace(fn))
+
+	if !ok {
+		if fn != "count" {
+			return RollupColumn{}, fmt.Errorf("unsupported aggregate %q, expected count, count(expr) or sum(expr)", s)
+		}
+
+		return rollupColumn("1"+orDefault(alias, " as count"), "")
+	}
+
+	arg, ok = strings.CutSuffix(strings.TrimSpace(arg), ")")
+	if !ok || strings.TrimSpace(arg) == "" {
+		return RollupColumn{}, fmt.Errorf("invalid aggregate %q", s)
+	}
+
+	arg = strings.TrimSpace(arg)
+
+	var col RollupColumn
+
+	switch fn {
+	case "count":
+		if arg == "*" {
+			return rollupColumn("1"+orDefault(alias, " as count"), "")
+		}
+
+		var err error
+		if col, err = rollupColumn(arg+alias, "count_"); err != nil {
+			return RollupColumn{}, err
+		}
+
+		col.Expr = fmt.Sprintf("(%s) IS NOT NULL", col.Expr)
+	case "sum":
+		var err error
+		if col, err = rollupColumn(arg+alias, "sum_"); err != nil {
+			return RollupColumn{}, err
+		}
+
+		col.Expr = fmt.Sprintf("coalesce(%s, 0)", col.Expr)
+	default:
+		// min and max can't be kept without the other rows
+		return RollupColumn{}, fmt.Errorf("unsupported aggregate %q, expected count, count(expr) or sum(expr)", s)
+	}
+
+	return col, nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+
+	return s
+}
+
+// splitTopLevel splits s at sep outside of parentheses and quotes,
+// leaving out empty parts.
+func splitTopLevel(s string, sep byte) []string {
+	var (
+		parts  []string
+		depth  int
+		quoted bool
+		start  int
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	parts = append(parts, s[start:])
+
+	if sep == ',' {
+		out := parts[:0]
+
+		for _, p := range parts {
+			if strings.TrimSpace(p) != "" {
+				out = append(out, p)
+			}
+		}
+
+		return out
+	}
+
+	return parts
+}
+
+func quoteIdent(name string) string {
+	return `"` + name + `"`
+}
+
+// triggers are the names of the rollup's triggers, by the event they're on.
+func (r Rollup) triggers() map[string]string {
+	return map[string]string{
+		"AFTER INSERT":  r.Name + "_after_insert",
+		"BEFORE DELETE": r.Name + "_before_delete",
+		"BEFORE UPDATE": r.Name + "_before_update",
+		"AFTER UPDATE":  r.Name + "_after_update",
+	}
+}
+
+// rollupEvents are the trigger events in the order they're created,
+// with the sign of the row's change to the rollup and the row's alias.
+var rollupEvents = []struct {
+	event, sign, row string
+}{
+	{"AFTER INSERT", "+", "NEW"},
+	{"BEFORE DELETE", "-", "OLD"},
+	{"BEFORE UPDATE", "-", "OLD"},
+	{"AFTER UPDATE", "+", "NEW"},
+}
+
+// drop returns the sql dropping the rollup's triggers and table.
+func (r Rollup) drop() string {
+	var b strings.Builder
+
+	for _, e := range rollupEvents {
+		fmt.Fprintf(&b, "DROP TRIGGER IF EXISTS %s;\n", quoteIdent(r.triggers()[e.event]))
+	}
+
+	fmt.Fprintf(&b, "DROP TABLE IF EXISTS %s;\n", quoteIdent(r.Name))
+
+	return b.String()
+}
+
+// build returns the sql recreating the rollup from the table's rows,
+// and the triggers keeping it up to date. The rows are read by rowid
+// in the triggers, before they're deleted or updated and after they're
+// inserted or updated, so the expressions are of the table's columns.
+// Rows replaced by INSERT OR REPLACE are only subtracted with recursive
+// triggers enabled.
+func (r Rollup) build() string {
+	var b strings.Builder
+
+	b.WriteString(r.drop())
+
+	cols := make([]string, 0, len(r.Groups)+len(r.Aggregates))
+	for _, g := range r.Groups {
+		cols = append(cols, quoteIdent(g.Name))
+	}
+
+	for _, a := range r.Aggregates {
+		cols = append(cols, quoteIdent(a.Name)+" NOT NULL DEFAULT 0")
+	}
+
+	fmt.Fprintf(&b, "CREATE TABLE %s (%s);\n", quoteIdent(r.Name), strings.Join(cols, ", "))
+
+	if len(r.Groups) > 0 {
+		names := make([]string, len(r.Groups))
+		for i, g := range r.Groups {
+			names[i] = quoteIdent(g.Name)
+		}
+
+		fmt.Fprintf(&b, "CREATE INDEX %s ON %s (%s);\n", quoteIdent(r.Name+"_groups"), quoteIdent(r.Name), strings.Join(names, ", "))
+	}
+
+	b.WriteString(r.fill())
+
+	for _, e := range rollupEvents {
+		b.WriteString(r.trigger(e.event, e.sign, e.row))
+	}
+
+	return b.String()
+}
+
+// fill returns the sql aggregating the table's rows into the rollup.
+func (r Rollup) fill() string {
+	cols := make([]string, 0, len(r.Groups)+len(r.Aggregates))
+	exprs := make([]string, 0, len(r.Groups)+len(r.Aggregates))
+	groupBy := make([]string, 0, len(r.Groups))
+
+	for i, g := range r.Groups {
+		cols = append(cols, quoteIdent(g.Name))
+		exprs = append(exprs, g.Expr)
+		groupBy = append(groupBy, fmt.Sprint(i+1))
+	}
+
+	for _, a := range r.Aggregates {
+		cols = append(cols, quoteIdent(a.Name))
+		exprs = append(exprs, fmt.Sprintf("sum(%s)", a.Expr))
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteIdent(r.Name), strings.Join(cols, ", "), strings.Join(exprs, ", "), r.Table)
+
+	if len(groupBy) > 0 {
+		query += " GROUP BY " + strings.Join(groupBy, ", ")
+	} else {
+		// a single row, even of an empty table
+		query += " HAVING count(*) > 0"
+	}
+
+	return query + ";\n"
+}
+
+// trigger returns the trigger adding the row to its group, or
+// subtracting it and removing the group once it has no rows.
+func (r Rollup) trigger(event, sign, row string) string {
+	rollup := quoteIdent(r.Name)
+
+	rowCols := make([]string, 0, len(r.Groups)+len(r.Aggregates))
+	groups := make([]string, 0, len(r.Groups))
+	zeros := make([]string, 0, len(r.Groups)+len(r.Aggregates))
+	set := make([]string, 0, len(r.Aggregates))
+
+	for _, g := range r.Groups {
+		name := quoteIdent(g.Name)
+
+		rowCols = append(rowCols, fmt.Sprintf("%s AS %s", g.Expr, name))
+		groups = append(groups, name)
+		zeros = append(zeros, "k."+name)
+	}
+
+	// the group of the row, the updated table can't be aliased in triggers
+	match := func(table string) string {
+		conds := []string{"1"}
+
+		for _, g := range r.Groups {
+			name := quoteIdent(g.Name)
+			conds = append(conds, fmt.Sprintf("%s.%s IS k.%s", table, name, name))
+		}
+
+		return strings.Join(conds, " AND ")
+	}
+
+	for _, a := range r.Aggregates {
+		name := quoteIdent(a.Name)
+
+		rowCols = append(rowCols, fmt.Sprintf("%s AS %s", a.Expr, name))
+		set = append(set, fmt.Sprintf("%s = %s.%s %s k.%s", name, rollup, name, sign, name))
+		groups = append(groups, name)
+		zeros = append(zeros, "0")
+	}
+
+	k := fmt.Sprintf("(SELECT %s FROM %s WHERE rowid = %s.rowid) AS k", strings.Join(rowCols, ", "), r.Table, row)
+
+	var body string
+
+	if sign == "+" {
+		body = fmt.Sprintf(
+			"INSERT INTO %s (%s) SELECT %s FROM %s WHERE NOT EXISTS (SELECT 1 FROM %s AS r WHERE %s);\n"+
+				"UPDATE %s SET %s FROM %s WHERE %s;\n",
+			rollup, strings.Join(groups, ", "), strings.Join(zeros, ", "), k, rollup, match("r"),
+			rollup, strings.Join(set, ", "), k, match(rollup),
+		)
+	} else {
+		body = fmt.Sprintf(
+			"UPDATE %s SET %s FROM %s WHERE %s;\n"+
+				"DELETE FROM %s WHERE rowid IN (SELECT r.rowid FROM %s AS r, %s WHERE %s AND r.%s <= 0);\n",
+			rollup, strings.Join(set, ", "), k, match(rollup),
+			rollup, rollup, k, match("r"), quoteIdent(r.countColumn()),
+		)
+	}
+
+	return fmt.Sprintf("CREATE TRIGGER %s %s ON %s BEGIN\n%sEND;\n", quoteIdent(r.triggers()[event]), event, r.Table, body)
+}
+
+// EnsureRollups builds the rollups of the tables in the local database
+// that aren't built yet, or whose definition changed since.
+func EnsureRollups(ctx context.Context, db *sql.DB, rollups []Rollup) error {
+	for _, r := range rollups {
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", r.Table).Scan(&n); err != nil {
+			return fmt.Errorf("rollup %s: %w", r.Name, err)
+		}
+
+		if n == 0 {
+			// built when the table is created
+			continue
+		}
+
+		built, err := r.built(ctx, db)
+		if err != nil {
+			return fmt.Errorf("rollup %s: %w", r.Name, err)
+		}
+
+		if built {
+			continue
+		}
+
+		log.Info().Msgf("building rollup %s of %s", r.Name, r.Table)
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("rollup %s: %w", r.Name, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, r.build()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("build rollup %s: %w", r.Name, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("build rollup %s: %w", r.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// built reports whether the rollup's triggers are the ones its
+// definition creates.
+func (r Rollup) built(ctx context.Context, db *sql.DB) (bool, error) {
+	for _, e := range rollupEvents {
+		var stmt string
+
+		err := db.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = ?", r.triggers()[e.event]).Scan(&stmt)
+		if err == sql.ErrNoRows {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if stmt+";\n" != r.trigger(e.event, e.sign, e.row) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// rollupGen keeps the rollups up to date as their tables change: they're
+// built when the table is created, rebuilt when its columns change, and
+// dropped with it.
+type rollupGen struct {
+	SQLGen
+	rollups map[string][]Rollup
+}
+
+// WithRollups returns gen, maintaining the rollups of the tables.
+func WithRollups(gen SQLGen, rollups []Rollup) SQLGen {
+	if len(rollups) == 0 {
+		return gen
+	}
+
+	byTable := make(map[string][]Rollup, len(rollups))
+	for _, r := range rollups {
+		byTable[r.Table] = append(byTable[r.Table], r)
+	}
+
+	return rollupGen{SQLGen: gen, rollups: byTable}
+}
+
+func (g rollupGen) Relation(msg *pglogrepl.RelationMessageV2) (string, error) {
+	query, err := g.SQLGen.Relation(msg)
+	if err != nil || query == "" || len(g.rollups[msg.RelationName]) == 0 {
+		return query, err
+	}
+
+	var b strings.Builder
+
+	if !strings.HasPrefix(query, "CREATE TABLE") {
+		// the triggers are dropped first, as columns they use can't be
+		for _, r := range g.rollups[msg.RelationName] {
+			b.WriteString(r.drop())
+		}
+	}
+
+	b.WriteString(query)
+	b.WriteString("\n")
+
+	for _, r := range g.rollups[msg.RelationName] {
+		b.WriteString(r.build())
+	}
+
+	return b.String(), nil
+}
+
+func (g rollupGen) CopyCreateTable(schema, tableName string, colDefs []sqlgen.ColDef) (string, error) {
+	query, err := g.SQLGen.CopyCreateTable(schema, tableName, colDefs)
+	if err != nil || len(g.rollups[tableName]) == 0 {
+		return query, err
+	}
+
+	// built on the empty table, its copied rows are added by the triggers
+	for _, r := range g.rollups[tableName] {
+		query += "\n" + r.build()
+	}
+
+	return query, nil
+}
+
+func (g rollupGen) DropTable(table string) (string, error) {
+	query, err := g.SQLGen.DropTable(table)
+	if err != nil {
+		return query, err
+	}
+
+	for _, r := range g.rollups[table] {
+		query += "\n" + r.drop()
+	}
+
+	return query, nil
+}
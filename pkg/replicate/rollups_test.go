@@ -0,0 +1,148 @@
+package replicate_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func TestParseRollups(t *testing.T) {
+	rollups, err := replicate.ParseRollups([]string{
+		"orders_daily=orders:status,date(created_at) as day:count,sum(total),count(shipped_at) as shipped",
+		"orders_total = orders::sum(round(total, 2)) as revenue",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []replicate.Rollup{
+		{
+			Name:   "orders_daily",
+			Table:  "orders",
+			Groups: []replicate.RollupColumn{{Name: "status", Expr: "status"}, {Name: "day", Expr: "date(created_at)"}},
+			Aggregates: []replicate.RollupColumn{
+				{Name: "count", Expr: "1"},
+				{Name: "sum_total", Expr: "coalesce(total, 0)"},
+				{Name: "shipped", Expr: "(shipped_at) IS NOT NULL"},
+			},
+		},
+		{
+			Name:       "orders_total",
+			Table:      "orders",
+			Aggregates: []replicate.RollupColumn{{Name: "revenue", Expr: "coalesce(round(total, 2), 0)"}, {Name: "count", Expr: "1"}},
+		},
+	}, rollups)
+
+	for _, spec := range []string{
+		"orders_daily=orders:status",
+		"orders_daily=orders:date(created_at):count",
+		"orders_daily=orders:status:max(total)",
+		"orders_daily=orders:status:count,count",
+		"orders daily=orders:status:count",
+	} {
+		_, err := replicate.ParseRollups([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestRollups(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "sqledge.db")+"?_pragma=recursive_triggers%3D1")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	rollups, err := replicate.ParseRollups([]string{"orders_daily=orders:status,date(created_at) as day:count,sum(total)"})
+	require.NoError(t, err)
+
+	gen := replicate.WithRollups(sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{}), rollups)
+
+	create, err := gen.CopyCreateTable("public", "orders", []sqlgen.ColDef{
+		{Name: "id", Type: sqlgen.PgColTypeInt4, PrimaryKey: true},
+		{Name: "status", Type: sqlgen.PgColTypeText},
+		{Name: "created_at", Type: sqlgen.PgColTypeText},
+		{Name: "total", Type: sqlgen.PgColTypeFloat8},
+	})
+	require.NoError(t, err)
+
+	// copied tables have no primary key
+	_, err = db.Exec(create + "\nCREATE UNIQUE INDEX orders_id ON orders (id);")
+	require.NoError(t, err)
+
+	rollup := func() [][]any {
+		rows, err := db.Query("SELECT status, day, count, sum_total FROM orders_daily ORDER BY status, day")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var out [][]any
+
+		for rows.Next() {
+			var (
+				status, day sql.NullString
+				count       int64
+				total       float64
+			)
+
+			require.NoError(t, rows.Scan(&status, &day, &count, &total))
+			out = append(out, []any{status.String, day.String, count, total})
+		}
+
+		return out
+	}
+
+	for _, stmt := range []string{
+		"INSERT INTO orders VALUES (1, 'new', '2026-10-01 10:00:00', 10)",
+		"INSERT INTO orders VALUES (2, 'new', '2026-10-01 11:00:00', 5.5)",
+		"INSERT INTO orders VALUES (3, 'paid', '2026-10-02 09:00:00', NULL)",
+		"INSERT INTO orders VALUES (4, NULL, '2026-10-02 09:00:00', 1)",
+	} {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, [][]any{
+		{"", "2026-10-02", int64(1), 1.0},
+		{"new", "2026-10-01", int64(2), 15.5},
+		{"paid", "2026-10-02", int64(1), 0.0},
+	}, rollup())
+
+	for _, stmt := range []string{
+		"UPDATE orders SET status = 'paid' WHERE id = 1",
+		"DELETE FROM orders WHERE id = 4",
+		// replaced, not added
+		"INSERT OR REPLACE INTO orders VALUES (2, 'paid', '2026-10-01 11:00:00', 6)",
+	} {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, [][]any{
+		{"paid", "2026-10-01", int64(2), 16.0},
+		{"paid", "2026-10-02", int64(1), 0.0},
+	}, rollup())
+
+	// rebuilt from the rows when the definition changes
+	rollups, err = replicate.ParseRollups([]string{"orders_daily=orders:status,date(created_at) as day:count,sum(total * 2) as sum_total"})
+	require.NoError(t, err)
+	require.NoError(t, replicate.EnsureRollups(ctx, db, rollups))
+
+	assert.Equal(t, [][]any{
+		{"paid", "2026-10-01", int64(2), 32.0},
+		{"paid", "2026-10-02", int64(1), 0.0},
+	}, rollup())
+
+	drop, err := replicate.WithRollups(sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{}), rollups).DropTable("orders")
+	require.NoError(t, err)
+
+	_, err = db.Exec(drop)
+	require.NoError(t, err)
+
+	var n int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name LIKE 'orders_daily%'").Scan(&n))
+	assert.Zero(t, n)
+}
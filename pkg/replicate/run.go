@@ -3,58 +3,494 @@ package replicate
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
 
+	"github.com/gemini-kenshi/pgreplsql/pkg/budget"
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
 	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/events"
+	"github.com/gemini-kenshi/pgreplsql/pkg/snapshot"
 	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/gemini-kenshi/pgreplsql/pkg/tenant"
+	"github.com/jackc/pglogrepl"
 	"github.com/rs/zerolog/log"
 	_ "modernc.org/sqlite"
 )
 
+// Replicator streams changes from the upstream into the local database.
+type Replicator struct {
+	cfg   *config.Config
+	stats *tracker
+	feed  *Feed
+
+	control func(ctx context.Context, content []byte) error
+	resyncs chan string
+	events  *events.Bus
+	clock   clock.Clock
+	budget  *budget.Budget
+
+	// replicate runs the replication until it stops, the watchdog
+	// restarts it in-process when its apply loop hangs.
+	replicate func(ctx context.Context) error
+}
+
+func New(cfg *config.Config) *Replicator {
+	r := &Replicator{
+		cfg:   cfg,
+		stats: newTracker(cfg.Replication.SlotName, cfg.Replication.Publication),
+		feed:  NewFeed(),
+		clock: clock.System{},
+		// a few, as each waits for the copies queued before it
+		resyncs: make(chan string, 16),
+	}
+
+	r.replicate = r.run
+
+	return r
+}
+
+// Stats returns the progress of the replication stream.
+func (r *Replicator) Stats() Stats {
+	return r.stats.snapshot()
+}
+
+// Relations returns the relation metadata of the replicated tables, as of
+// the latest relation message of each since the stream started, which
+// the upstream sends before a table's first change.
+func (r *Replicator) Relations() []*pglogrepl.RelationMessageV2 {
+	return r.stats.relationMessages()
+}
+
+// Cold reports whether the local table is still being copied, so
+// reads of it aren't complete yet. Every table is cold until Run has
+// read the local database's position.
+func (r *Replicator) Cold(table string) bool {
+	return r.stats.isCold(table)
+}
+
+// SetClock sets the clock stamping the stats, journal and dead letters,
+// for tests and simulations that control time.
+func (r *Replicator) SetClock(c clock.Clock) {
+	r.clock = c
+	r.stats.setClock(c)
+}
+
+// SetBudget shares the memory budget with the proxy, reading the
+// upstream waits while the proxy's results use it up.
+func (r *Replicator) SetBudget(b *budget.Budget) {
+	r.budget = b
+}
+
+// Changes is the feed of the changes applied to the local database.
+func (r *Replicator) Changes() *Feed {
+	return r.feed
+}
+
+// SetEvents publishes what the replication applies on the bus shared
+// with the proxy, see package events.
+func (r *Replicator) SetEvents(bus *events.Bus) {
+	r.events = bus
+}
+
+// HandleControl runs f with the content of every control message,
+// see package control.
+func (r *Replicator) HandleControl(f func(ctx context.Context, content []byte) error) {
+	r.control = f
+}
+
+// ResyncTable queues the table to replace its local rows with the
+// upstream's. The stream copies it once no transaction is open, and
+// replaces the copied rows with the changes before the copy's position.
+func (r *Replicator) ResyncTable(table string) error {
+	if r.cfg.Tenant.Column != "" {
+		return errors.New("resyncing tables isn't supported with tenant partitioning")
+	}
+
+	select {
+	case r.resyncs <- table:
+		return nil
+	default:
+		return fmt.Errorf("resync %s: too many tables queued", table)
+	}
+}
+
 func Run(ctx context.Context, cfg *config.Config) error {
-	connStr := cfg.PostgresConnString() + "&replication=database"
+	return New(cfg).Run(ctx)
+}
+
+func (r *Replicator) Run(ctx context.Context) error {
+	if r.cfg.Failover.Address != "" {
+		if r.cfg.Replication.Delivery != sqlgen.DeliveryAtLeastOnce {
+			return errors.New("failover needs at-least-once delivery, the transactions around the switch are applied again")
+		}
+
+		src, err := r.source()
+		if err != nil {
+			return err
+		}
+
+		if !src.secondary {
+			r.prepareSecondary(ctx)
+
+			go r.advanceSecondary(ctx)
+		}
+	}
+
+	for restarts := 0; ; {
+		err := r.watched(ctx)
+
+		if errors.Is(err, errApplyHung) {
+			if restarts >= r.cfg.Replication.WatchdogRestarts {
+				return fmt.Errorf("%w, after %d restarts", err, restarts)
+			}
 
-	conn, err := replicateConnection(ctx, connStr, cfg.Replication.Publication)
+			restarts++
+			log.Warn().Msgf("restarting the replication, restart %d of %d", restarts, r.cfg.Replication.WatchdogRestarts)
+
+			continue
+		}
+
+		if r.cfg.Failover.Address == "" || ctx.Err() != nil {
+			return err
+		}
+
+		// restarted once the upstream is back, or on the secondary
+		if err := r.failOver(ctx, err); err != nil {
+			return err
+		}
+	}
+}
+
+// run replicates until ctx is done or the stream fails.
+func (r *Replicator) run(ctx context.Context) error {
+	src, err := r.source()
+	if err != nil {
+		return err
+	}
+
+	cfg := src.cfg
+	connStr := cfg.UpstreamConnString("replication") + "&replication=database"
+
+	slos, err := ParseSLOs(cfg.Replication.TableSLOs, cfg.Upstream.Schema)
+	if err != nil {
+		return err
+	}
+
+	r.stats.setSLOs(slos)
+
+	if _, err := sqlgen.ParseKeys(cfg.Replication.TableKeys); err != nil {
+		return err
+	}
+
+	rollups, err := ParseRollups(cfg.Local.Rollups)
+	if err != nil {
+		return err
+	}
+
+	pubCfg := PublicationConfig{
+		Schema:  cfg.Upstream.Schema,
+		Tables:  cfg.Replication.Tables,
+		Publish: cfg.Replication.Publish,
+	}
+
+	if cfg.Replication.HeartbeatTable != "" {
+		heartbeatCfg := HeartbeatConfig{
+			Node:     r.cfg.Replication.SlotName,
+			Schema:   cfg.Upstream.Schema,
+			Table:    cfg.Replication.HeartbeatTable,
+			Interval: cfg.Replication.HeartbeatInterval,
+		}
+
+		upstream, err := upstreamDB(cfg.UpstreamConnString("heartbeat"))
+		if err != nil {
+			return fmt.Errorf("connect to upstream for heartbeats: %w", err)
+		}
+		defer upstream.Close()
+
+		if err := createHeartbeatTable(ctx, upstream, heartbeatCfg); err != nil {
+			return err
+		}
+
+		if len(pubCfg.Tables) > 0 && !slices.Contains(pubCfg.Tables, heartbeatCfg.Table) {
+			pubCfg.Tables = append(slices.Clone(pubCfg.Tables), heartbeatCfg.Table)
+		}
+
+		// stopped before the connection is closed, when the run ends
+		beatCtx, stop := context.WithCancel(ctx)
+		defer stop()
+
+		r.stats.setHeartbeat(heartbeatCfg.name(), heartbeatCfg.Node)
+		go heartbeats(beatCtx, upstream, heartbeatCfg, r.stats, r.clock)
+	}
+
+	// the publication is ensured once the local database
+	// can record the tables added to it
+	conn, err := NewConn(ctx, connStr, cfg.Replication.Publication)
 	if err != nil {
 		return fmt.Errorf("create replicate connection: %w", err)
 	}
 	defer conn.Close()
 
+	conn.stats = r.stats
+	conn.feed = r.feed
+	conn.clock = r.clock
+	conn.budget = r.budget
+	conn.events = r.events
+
+	milestoneCfg := MilestoneConfig{
+		Node:           cfg.Replication.SlotName,
+		Channel:        cfg.Replication.MilestoneChannel,
+		Table:          cfg.Replication.MilestoneTable,
+		WatermarkBytes: uint64(cfg.Replication.MilestoneWatermarkBytes),
+	}
+
+	if milestoneCfg.enabled() {
+		upstream, err := upstreamDB(cfg.UpstreamConnString("milestones"))
+		if err != nil {
+			return fmt.Errorf("connect to upstream for milestones: %w", err)
+		}
+		defer upstream.Close()
+
+		conn.milestones = newMilestones(milestoneCfg, upstream)
+		go conn.milestones.run(ctx)
+	}
+
 	// TODO: this is shared across reader and writer
-	db, err := sql.Open("sqlite", cfg.Local.Path)
+	db, err := sql.Open("sqlite", cfg.Local.DSN())
 	if err != nil {
 		return fmt.Errorf("connect to local db: %w", err)
 	}
 
-	sqliteCfg := sqlgen.SqliteConfig{
-		SourceDB:    cfg.Upstream.DBName,
-		Plugin:      cfg.Replication.Plugin,
-		Publication: cfg.Replication.Publication,
+	sqliteCfg := LocalConfig(cfg)
+
+	switch sqliteCfg.PreparedVisibility {
+	case "", sqlgen.PreparedVisibilityNever, sqlgen.PreparedVisibilityPrepared:
+	default:
+		return fmt.Errorf("unknown prepared visibility: %q", sqliteCfg.PreparedVisibility)
+	}
+
+	switch sqliteCfg.Delivery {
+	case "", sqlgen.DeliveryExactlyOnce, sqlgen.DeliveryAtLeastOnce:
+	default:
+		return fmt.Errorf("unknown delivery: %q", sqliteCfg.Delivery)
+	}
+
+	if src.secondary {
+		sqliteCfg.SourceDB += secondarySource
+	}
+
+	switch sqliteCfg.Timestamps {
+	case "", sqlgen.TimestampsPostgres, sqlgen.TimestampsUTC, sqlgen.TimestampsEpoch, sqlgen.TimestampsLocal:
+	default:
+		return fmt.Errorf("unknown timestamps policy: %q", sqliteCfg.Timestamps)
 	}
 
 	driver := sqlgen.NewSqliteDriver(sqliteCfg, db)
 
+	// before anything is written in a format the database isn't in
+	if _, err := driver.CheckFormat(config.Version); err != nil {
+		return fmt.Errorf("check local database format: %w", err)
+	}
+
+	if sqliteCfg.Provenance {
+		// before the tenant databases copy the main schema
+		if err := driver.InitProvenanceTable(); err != nil {
+			return fmt.Errorf("init provenance: %w", err)
+		}
+	}
+
+	if len(sqliteCfg.MessagePrefixes) > 0 {
+		if err := driver.InitMessagesTable(); err != nil {
+			return fmt.Errorf("init messages: %w", err)
+		}
+	}
+
+	var d DBDriver = driver
+
+	if cfg.Tenant.Column != "" {
+		if cfg.Replication.GroupCommitMaxTransactions > 1 {
+			return errors.New("group commit isn't supported with tenant partitioning")
+		}
+
+		if cfg.Replication.BackfillNewTables {
+			return errors.New("backfilling new tables isn't supported with tenant partitioning")
+		}
+
+		if len(rollups) > 0 {
+			return errors.New("rollups aren't supported with tenant partitioning")
+		}
+
+		// the undo of the prepared changes is recorded in the database
+		// they're applied to, but read back from the main one.
+		if sqliteCfg.PreparedVisibility == sqlgen.PreparedVisibilityPrepared {
+			return errors.New("prepared visibility isn't supported with tenant partitioning")
+		}
+
+		// the tenant driver reads the main schema inside the open
+		// transaction, so it must use the same connection.
+		db.SetMaxOpenConns(1)
+
+		files := tenant.NewFiles(cfg.Tenant.Dir, "sqlite")
+		defer files.Close()
+
+		if d, err = tenant.NewDriver(driver, db, cfg.Tenant.Column, files); err != nil {
+			return fmt.Errorf("init tenants: %w", err)
+		}
+	}
+
 	if err := driver.InitPositionTable(); err != nil {
 		return fmt.Errorf("init position tracking: %w", err)
 	}
 
+	if err := driver.InitPendingCopiesTable(); err != nil {
+		return fmt.Errorf("init pending copies: %w", err)
+	}
+
+	pubCfg.Pending = driver.AddPendingCopies
+
+	if _, err := conn.EnsurePublication(pubCfg); err != nil {
+		return fmt.Errorf("ensure publication: %w", err)
+	}
+
+	added, err := pendingCopies(driver, pubCfg.Tables)
+	if err != nil {
+		return err
+	}
+
+	positions, err := driver.Positions()
+	if err != nil {
+		return fmt.Errorf("read positions: %w", err)
+	}
+
+	if positions.Streaming != "" {
+		// tables added to the publication are marked cold before
+		// they're copied, see Stream.
+		r.stats.warm()
+	}
+
+	snapshotLSN, _ := pglogrepl.ParseLSN(positions.Snapshot)
+	ackedLSN, _ := pglogrepl.ParseLSN(positions.Acked)
+	r.stats.positions(snapshotLSN, ackedLSN)
+
+	if err := driver.InitPreparedTable(); err != nil {
+		return fmt.Errorf("init prepared transactions: %w", err)
+	}
+
 	schema, err := driver.CurrentSchema()
 	if err != nil {
 		return fmt.Errorf("get current schema: %w", err)
 	}
 
+	for _, r := range rollups {
+		// kept locally, not replicated
+		delete(schema, r.Name)
+	}
+
+	if err := EnsureRollups(ctx, db, rollups); err != nil {
+		return err
+	}
+
 	sqlite := sqlgen.NewSqlite(sqliteCfg, schema)
 	if err != nil {
 		return fmt.Errorf("init sqlgen: %w", err)
 	}
 
+	gen := WithRollups(sqlite, rollups)
+
+	if err := conn.DropMissingTables(cfg.Upstream.Schema, schema, d, gen); err != nil {
+		return fmt.Errorf("drop missing tables: %w", err)
+	}
+
+	createSlot := cfg.Replication.CreateSlotIfNoExists
+	resynced := false
+
+	if !cfg.Replication.Temporary && positions.Streaming != "" {
+		lost, err := conn.SlotLost(cfg.Replication.SlotName)
+		if err != nil {
+			return err
+		}
+
+		if lost {
+			// e.g. dropped by the slot guard while the node was offline,
+			// the changes since the position can't be streamed anymore.
+			log.Warn().Msgf("slot %q was lost, copying every table again", cfg.Replication.SlotName)
+
+			if err := conn.DropLostSlot(cfg.Replication.SlotName); err != nil {
+				return err
+			}
+
+			resync := ResyncTables(schema)
+			if err := driver.AddPendingCopies(resync); err != nil {
+				return fmt.Errorf("mark tables to resync: %w", err)
+			}
+
+			r.stats.copyPending()
+
+			added = append(added, difference(resync, added)...)
+			resynced = true
+			createSlot = true
+		}
+	}
+
 	slot := SlotConfig{
 		SlotName:             cfg.Replication.SlotName,
 		OutputPlugin:         cfg.Replication.Plugin,
-		CreateSlotIfNoExists: cfg.Replication.CreateSlotIfNoExists,
+		CreateSlotIfNoExists: createSlot,
 		Temporary:            cfg.Replication.Temporary,
 		Schema:               cfg.Upstream.Schema,
 		StandbyTimeout:       cfg.Replication.StandbyTimeout,
+		Tables:               pubCfg.Tables,
+		CopyTables:           added,
+		Resync:               resynced,
+		Copied:               driver.RemovePendingCopies,
+		TwoPhase:             cfg.Replication.TwoPhase,
+		Binary:               cfg.Replication.Binary,
+		Copy: CopyConfig{
+			ChunkBytes: cfg.Copy.ChunkBytes,
+			MaxWorkers: cfg.Copy.MaxWorkers,
+		},
+		MigrationsDir: cfg.Replication.MigrationsDir,
+		Control:       r.control,
+		Limits: LimitsConfig{
+			MaxChangeBytes:    cfg.Replication.MaxChangeBytes,
+			MaxStatementBytes: cfg.Replication.MaxStatementBytes,
+			DLQDir:            cfg.Replication.DLQDir,
+		},
+		Journal: JournalConfig{
+			Path:     cfg.Replication.JournalPath,
+			MaxBytes: cfg.Replication.JournalMaxBytes,
+			MaxFiles: cfg.Replication.JournalMaxFiles,
+			Clock:    r.clock,
+		},
+		GroupCommit: GroupCommitConfig{
+			MaxTransactions: cfg.Replication.GroupCommitMaxTransactions,
+			MaxDelay:        cfg.Replication.GroupCommitMaxDelay,
+		},
+		AckDelay: AckDelayConfig{
+			Duration: cfg.Replication.AckDelay,
+			Bytes:    uint64(cfg.Replication.AckDelayBytes),
+		},
+		Delivery:            cfg.Replication.Delivery,
+		SkipCommittedBefore: src.skipBefore,
+	}
+
+	if cfg.Tenant.Column == "" {
+		slot.Resyncs = r.resyncs
+		slot.CopyTable = func(ctx context.Context, table string) (pglogrepl.LSN, error) {
+			return Backfill(ctx, connStr, cfg.Upstream.Schema, db, table)
+		}
+	}
+
+	if cfg.Replication.BackfillNewTables {
+		slot.Backfill = slot.CopyTable
+	}
+
+	if peer := cfg.Replication.BootstrapPeer; peer != "" {
+		slot.Bootstrap = func(ctx context.Context, minLSN pglogrepl.LSN) (pglogrepl.LSN, error) {
+			return snapshot.Fetch(ctx, peer, cfg.Upstream.User, cfg.Upstream.Pass, minLSN, db)
+		}
 	}
 
 	log.Debug().Msg("starting streaming")
@@ -62,8 +498,8 @@ func Run(ctx context.Context, cfg *config.Config) error {
 	if err := conn.Stream(
 		ctx,
 		slot,
-		driver,
-		sqlite,
+		d,
+		gen,
 	); err != nil {
 		return fmt.Errorf("streaming failed: %w", err)
 	}
@@ -71,19 +507,58 @@ func Run(ctx context.Context, cfg *config.Config) error {
 	return nil
 }
 
-func replicateConnection(ctx context.Context, connectionString, publication string) (*Conn, error) {
-	conn, err := NewConn(ctx, connectionString, publication)
+// LocalConfig is the config of the local database's sql.
+func LocalConfig(cfg *config.Config) sqlgen.SqliteConfig {
+	// the keys are checked by Run
+	keys, _ := sqlgen.ParseKeys(cfg.Replication.TableKeys)
+
+	return sqlgen.SqliteConfig{
+		SourceDB:    cfg.Upstream.DBName,
+		Plugin:      cfg.Replication.Plugin,
+		Publication: cfg.Replication.Publication,
+		Publish:     cfg.Replication.Publish,
+
+		PreparedVisibility: cfg.Replication.PreparedVisibility,
+		Provenance:         cfg.Replication.Provenance,
+		MessagePrefixes:    cfg.Replication.MessagePrefixes,
+		Delivery:           cfg.Replication.Delivery,
+		Keys:               keys,
+		Timestamps:         cfg.Local.Timestamps,
+		CommitTimes:        cfg.Failover.Address != "",
+	}
+}
+
+// pendingCopies returns the tables added to the publication that haven't
+// been copied yet, by this run or an earlier one that stopped before
+// copying them. Tables no longer published are forgotten.
+func pendingCopies(driver *sqlgen.SqliteDriver, published []string) ([]string, error) {
+	pending, err := driver.PendingCopies()
 	if err != nil {
-		return nil, fmt.Errorf("new conn: %w", err)
+		return nil, err
 	}
 
-	if err := conn.DropPublication(); err != nil {
-		return nil, fmt.Errorf("drop publication: %w", err)
+	if len(published) == 0 {
+		return pending, nil
 	}
 
-	if err := conn.CreatePublication(); err != nil {
-		return nil, fmt.Errorf("create publication: %w", err)
+	dropped := difference(pending, published)
+	if err := driver.RemovePendingCopies(dropped); err != nil {
+		return nil, err
+	}
+
+	return difference(pending, dropped), nil
+}
+
+func replicateConnection(ctx context.Context, connectionString, publication string, pubCfg PublicationConfig) (*Conn, []string, error) {
+	conn, err := NewConn(ctx, connectionString, publication)
+	if err != nil {
+		return nil, nil, fmt.Errorf("new conn: %w", err)
+	}
+
+	added, err := conn.EnsurePublication(pubCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ensure publication: %w", err)
 	}
 
-	return conn, nil
+	return conn, added, nil
 }
@@ -0,0 +1,24 @@
+package replicate_test
+
+import (
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResyncTable(t *testing.T) {
+	r := replicate.New(&config.Config{})
+
+	// queued until the stream copies them
+	for range 16 {
+		require.NoError(t, r.ResyncTable("orders"))
+	}
+
+	assert.Error(t, r.ResyncTable("orders"))
+
+	tenants := replicate.New(&config.Config{Tenant: config.TenantConfig{Column: "tenant_id"}})
+	assert.Error(t, tenants.ResyncTable("orders"))
+}
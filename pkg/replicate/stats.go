@@ -0,0 +1,627 @@
+package replicate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// States of the replication stream.
+const (
+	StateStarting  = "starting"
+	StateCopying   = "copying"
+	StateStreaming = "streaming"
+	StateStopped   = "stopped"
+)
+
+// Stats is a snapshot of the replication stream's progress.
+type Stats struct {
+	SlotName    string
+	Publication string
+	State       string
+	// ReceivedLSN is the end of the last WAL data received, and AppliedLSN
+	// the end of the last transaction applied to the local database.
+	ReceivedLSN pglogrepl.LSN
+	AppliedLSN  pglogrepl.LSN
+	// ServerLSN is the upstream's WAL end at the last keepalive.
+	ServerLSN pglogrepl.LSN
+	// SnapshotLSN is the consistent position of the snapshot the local
+	// database was copied or bootstrapped from, and AckedLSN the last
+	// position acknowledged to the upstream as flushed.
+	SnapshotLSN   pglogrepl.LSN
+	AckedLSN      pglogrepl.LSN
+	LastMessageAt time.Time
+	LastAppliedAt time.Time
+	// LoopedAt is when the apply loop was last between messages, it
+	// returns there at least every progressInterval while streaming.
+	LoopedAt time.Time
+	// StartLSN is the applied LSN when streaming started, the
+	// progress of catching up is measured from it.
+	StartLSN pglogrepl.LSN
+	// ApplyRate is the recent rate of applying WAL, in bytes per second.
+	ApplyRate float64
+	// DeadLettered counts the changes over the size limits, which
+	// were written to the dead letter queue instead of being applied.
+	DeadLettered int64
+	// HeartbeatSentAt is when the last heartbeat was written upstream,
+	// and HeartbeatAt when the last one applied locally was written.
+	// HeartbeatLatency is the time between the two for the last one
+	// applied, from the upstream write to the local apply.
+	HeartbeatSentAt  time.Time
+	HeartbeatAt      time.Time
+	HeartbeatLatency time.Duration
+	Tables           []TableStats
+}
+
+// Lag is the WAL in bytes between the upstream and the local database.
+func (s Stats) Lag() uint64 {
+	if s.ServerLSN <= s.AppliedLSN {
+		return 0
+	}
+
+	return uint64(s.ServerLSN - s.AppliedLSN)
+}
+
+// CaughtUp reports whether the local database is streaming within
+// maxLag bytes of the upstream, once the upstream's WAL end is known.
+func (s Stats) CaughtUp(maxLag uint64) bool {
+	return s.State == StateStreaming && s.ServerLSN != 0 && s.Lag() <= maxLag
+}
+
+// Hung reports whether the apply loop has been stuck on a message for
+// longer than the timeout while streaming, with WAL pending that it
+// would otherwise be applying.
+func (s Stats) Hung(now time.Time, timeout time.Duration) bool {
+	if s.State != StateStreaming || s.LoopedAt.IsZero() {
+		return false
+	}
+
+	pending := s.ReceivedLSN > s.AppliedLSN || s.Lag() > 0
+
+	return pending && now.Sub(s.LoopedAt) > timeout
+}
+
+// HeartbeatAge is how old the last heartbeat applied locally is, the
+// local database has every change the upstream committed before it.
+// It's false until a heartbeat has been applied.
+func (s Stats) HeartbeatAge(now time.Time) (time.Duration, bool) {
+	if s.HeartbeatAt.IsZero() {
+		return 0, false
+	}
+
+	return now.Sub(s.HeartbeatAt), true
+}
+
+// Progress is the fraction, from 0 to 1, of the WAL behind the
+// upstream when streaming started that has since been applied.
+func (s Stats) Progress() float64 {
+	if s.ServerLSN <= s.StartLSN || s.AppliedLSN >= s.ServerLSN {
+		return 1
+	}
+
+	if s.AppliedLSN <= s.StartLSN {
+		return 0
+	}
+
+	return float64(s.AppliedLSN-s.StartLSN) / float64(s.ServerLSN-s.StartLSN)
+}
+
+// ETA estimates how long until the lag is applied at the current
+// apply rate, it's false while there's no rate to estimate from.
+func (s Stats) ETA() (time.Duration, bool) {
+	lag := s.Lag()
+	if lag == 0 {
+		return 0, true
+	}
+
+	if s.ApplyRate <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(float64(lag) / s.ApplyRate * float64(time.Second)), true
+}
+
+// Reached reports whether the upstream's changes up to lsn have been
+// applied locally. An lsn after the last transaction, e.g. the upstream's
+// pg_current_wal_lsn() once it's idle, is reached once the upstream has
+// sent its WAL past it and every message received has been applied.
+func (s Stats) Reached(lsn pglogrepl.LSN) bool {
+	if s.AppliedLSN >= lsn {
+		return true
+	}
+
+	return s.State == StateStreaming && s.ServerLSN >= lsn && !s.LastAppliedAt.Before(s.LastMessageAt)
+}
+
+// TableStats counts the changes applied to a table since starting.
+type TableStats struct {
+	Name      string
+	Inserts   int64
+	Updates   int64
+	Deletes   int64
+	Truncates int64
+	// ApplyDelay is the time between the upstream committing the last
+	// transaction changing the table, and it being applied locally.
+	ApplyDelay time.Duration
+	// SLO is the table's apply delay budget, zero when it has none.
+	// SLOViolations counts the transactions applied later than it.
+	SLO             time.Duration
+	SLOViolations   int64
+	LastViolationAt time.Time
+}
+
+// ParseSLOs parses the per-table apply delay budgets, each
+// "table=duration". Tables that aren't schema qualified are in schema.
+func ParseSLOs(specs []string, schema string) (map[string]time.Duration, error) {
+	slos := make(map[string]time.Duration, len(specs))
+
+	for _, spec := range specs {
+		table, budget, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		if !ok || table == "" {
+			return nil, fmt.Errorf("invalid table slo %q, expected table=duration", spec)
+		}
+
+		d, err := time.ParseDuration(budget)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid table slo %q: duration must be positive", spec)
+		}
+
+		if !strings.Contains(table, ".") {
+			table = schema + "." + table
+		}
+
+		slos[table] = d
+	}
+
+	return slos, nil
+}
+
+// tracker records the stream's progress, it is updated by the stream
+// and slot goroutines and read by the proxy.
+type tracker struct {
+	mu        sync.Mutex
+	stats     Stats
+	relations map[uint32]string
+	tables    map[string]*TableStats
+	// schemas are the latest relation messages, by table.
+	schemas map[string]*pglogrepl.RelationMessageV2
+
+	// slos are the tables' apply delay budgets, and changed
+	// the tables changed by the transaction being applied.
+	slos    map[string]time.Duration
+	changed map[string]*TableStats
+
+	// the apply rate is sampled over windows from rateLSN at rateAt.
+	rateLSN pglogrepl.LSN
+	rateAt  time.Time
+
+	// coldAll is set until it's known which tables the local database
+	// is missing, and cold holds the tables still being copied.
+	coldAll bool
+	cold    map[string]bool
+
+	// heartbeat is the node's heartbeat table, the arrival of whose
+	// rows for the node heartbeatNode is measured.
+	heartbeat     string
+	heartbeatNode string
+	// beat is the heartbeat in the transaction being applied,
+	// measured once it's committed.
+	beat time.Time
+
+	clock clock.Clock
+}
+
+const (
+	// rateWindow is the shortest window the apply rate is sampled over.
+	rateWindow = time.Second
+	// rateSmoothing is the weight of the latest sample in the apply rate.
+	rateSmoothing = 0.3
+)
+
+func newTracker(slotName, publication string) *tracker {
+	return &tracker{
+		stats: Stats{
+			SlotName:    slotName,
+			Publication: publication,
+			State:       StateStarting,
+		},
+		relations: make(map[uint32]string),
+		tables:    make(map[string]*TableStats),
+		schemas:   make(map[string]*pglogrepl.RelationMessageV2),
+		changed:   make(map[string]*TableStats),
+		coldAll:   true,
+		cold:      make(map[string]bool),
+		clock:     clock.System{},
+	}
+}
+
+func (t *tracker) setClock(c clock.Clock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.clock = c
+}
+
+// setSLOs sets the tables' apply delay budgets.
+func (t *tracker) setSLOs(slos map[string]time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.slos = slos
+
+	for name, ts := range t.tables {
+		ts.SLO = slos[name]
+	}
+}
+
+// setHeartbeat sets the table the node's heartbeats arrive in.
+func (t *tracker) setHeartbeat(table, node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.heartbeat, t.heartbeatNode = table, node
+}
+
+// heartbeatSent records a heartbeat written upstream.
+func (t *tracker) heartbeatSent(at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.HeartbeatSentAt = at
+}
+
+// heartbeatApplied keeps the node's heartbeat in the tuple of a
+// change to the heartbeat table, until its transaction commits.
+func (t *tracker) heartbeatApplied(relationID uint32, tuple *pglogrepl.TupleData) {
+	name, ok := t.relations[relationID]
+	if !ok || t.heartbeat == "" || name != t.heartbeat {
+		return
+	}
+
+	if at, ok := heartbeatBeat(t.schemas[name], tuple, t.heartbeatNode); ok {
+		t.beat = at
+	}
+}
+
+func (t *tracker) setState(state string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.State = state
+}
+
+// streaming records where streaming started from.
+func (t *tracker) streaming(from pglogrepl.LSN) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.State = StateStreaming
+	t.stats.StartLSN = from
+	t.stats.AppliedLSN = max(t.stats.AppliedLSN, from)
+	t.stats.LoopedAt = t.clock.Now()
+	t.rateLSN, t.rateAt = from, t.clock.Now()
+}
+
+// looped records that the apply loop is between messages.
+func (t *tracker) looped() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.LoopedAt = t.clock.Now()
+}
+
+// positions records the positions persisted by an earlier run.
+func (t *tracker) positions(snapshot, acked pglogrepl.LSN) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.SnapshotLSN = snapshot
+	t.stats.AckedLSN = acked
+}
+
+func (t *tracker) snapshotted(lsn pglogrepl.LSN) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.SnapshotLSN = lsn
+}
+
+// copyPending marks every table cold, before the tables to copy are known.
+func (t *tracker) copyPending() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.coldAll = true
+}
+
+// copying marks the tables cold until they're copied, the others are warm.
+func (t *tracker) copying(tables []string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.coldAll = false
+	clear(t.cold)
+
+	for _, table := range tables {
+		t.cold[table] = true
+	}
+}
+
+// cooling marks the table cold until it's copied, e.g. a table created
+// while streaming until it's backfilled.
+func (t *tracker) cooling(table string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cold[table] = true
+}
+
+// copied marks the table warm once every row has been copied.
+func (t *tracker) copied(table string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.cold, table)
+}
+
+// warm marks every table warm, after the copy or when there's none.
+func (t *tracker) warm() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.coldAll = false
+	clear(t.cold)
+}
+
+// isCold reports whether the local table is missing rows the copy
+// hasn't reached yet.
+func (t *tracker) isCold(table string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.coldAll || t.cold[table]
+}
+
+func (t *tracker) acked(lsn pglogrepl.LSN) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.AckedLSN = lsn
+}
+
+func (t *tracker) deadLettered() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.DeadLettered++
+}
+
+func (t *tracker) received(lsn pglogrepl.LSN) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.ReceivedLSN = lsn
+	t.stats.LastMessageAt = t.clock.Now()
+}
+
+func (t *tracker) keepalive(serverLSN pglogrepl.LSN) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.ServerLSN = serverLSN
+}
+
+// lag returns the bytes the local database is behind the upstream.
+func (t *tracker) lag() uint64 {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stats.Lag()
+}
+
+// applied records a message once its sql has been applied locally.
+func (t *tracker) applied(msg pglogrepl.Message) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessageV2:
+		t.relations[msg.RelationID] = msg.Namespace + "." + msg.RelationName
+		t.schemas[msg.Namespace+"."+msg.RelationName] = msg
+	case *pglogrepl.InsertMessageV2:
+		t.table(msg.RelationID).Inserts++
+		t.heartbeatApplied(msg.RelationID, msg.Tuple)
+	case *pglogrepl.UpdateMessageV2:
+		t.table(msg.RelationID).Updates++
+		t.heartbeatApplied(msg.RelationID, msg.NewTuple)
+	case *pglogrepl.DeleteMessageV2:
+		t.table(msg.RelationID).Deletes++
+	case *pglogrepl.TruncateMessageV2:
+		for _, id := range msg.RelationIDs {
+			t.table(id).Truncates++
+		}
+	case *pglogrepl.CommitMessage:
+		t.commit(msg.TransactionEndLSN, msg.CommitTime)
+	case *pglogrepl.StreamCommitMessageV2:
+		t.commit(msg.TransactionEndLSN, msg.CommitTime)
+	case *pgoutput.CommitPreparedMessage:
+		t.commit(msg.EndLSN, msg.CommitTime)
+	}
+}
+
+func (t *tracker) commit(lsn pglogrepl.LSN, commitTime time.Time) {
+	now := t.clock.Now()
+
+	t.stats.AppliedLSN = lsn
+	t.stats.LastAppliedAt = now
+
+	t.applyDelay(now.Sub(commitTime), now)
+
+	if t.beat.After(t.stats.HeartbeatAt) {
+		t.stats.HeartbeatAt = t.beat
+		t.stats.HeartbeatLatency = now.Sub(t.beat)
+	}
+
+	t.beat = time.Time{}
+
+	if t.rateAt.IsZero() {
+		t.rateLSN, t.rateAt = lsn, now
+		return
+	}
+
+	elapsed := now.Sub(t.rateAt)
+	if elapsed < rateWindow || lsn < t.rateLSN {
+		return
+	}
+
+	sample := float64(lsn-t.rateLSN) / elapsed.Seconds()
+
+	if t.stats.ApplyRate == 0 {
+		t.stats.ApplyRate = sample
+	} else {
+		t.stats.ApplyRate += rateSmoothing * (sample - t.stats.ApplyRate)
+	}
+
+	t.rateLSN, t.rateAt = lsn, now
+}
+
+// applyDelay records the delay of applying the committed
+// transaction to the tables it changed.
+func (t *tracker) applyDelay(delay time.Duration, now time.Time) {
+	for name, ts := range t.changed {
+		delete(t.changed, name)
+
+		ts.ApplyDelay = delay
+
+		if ts.SLO == 0 || delay <= ts.SLO {
+			continue
+		}
+
+		ts.SLOViolations++
+		ts.LastViolationAt = now
+
+		log.Warn().Msgf("apply delay slo violated: %s applied %s after commit, budget %s", name, delay.Round(time.Millisecond), ts.SLO)
+	}
+}
+
+func (t *tracker) table(relationID uint32) *TableStats {
+	name, ok := t.relations[relationID]
+	if !ok {
+		name = "unknown"
+	}
+
+	ts, ok := t.tables[name]
+	if !ok {
+		ts = &TableStats{Name: name, SLO: t.slos[name]}
+		t.tables[name] = ts
+	}
+
+	t.changed[name] = ts
+
+	return ts
+}
+
+// relationMessages returns the latest relation message of each table,
+// sorted by name.
+func (t *tracker) relationMessages() []*pglogrepl.RelationMessageV2 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rels := make([]*pglogrepl.RelationMessageV2, 0, len(t.schemas))
+	for _, rel := range t.schemas {
+		rels = append(rels, rel)
+	}
+
+	sort.Slice(rels, func(i, j int) bool {
+		return rels[i].Namespace+"."+rels[i].RelationName < rels[j].Namespace+"."+rels[j].RelationName
+	})
+
+	return rels
+}
+
+func (t *tracker) snapshot() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.stats
+	stats.Tables = make([]TableStats, 0, len(t.tables))
+
+	for _, ts := range t.tables {
+		stats.Tables = append(stats.Tables, *ts)
+	}
+
+	sort.Slice(stats.Tables, func(i, j int) bool { return stats.Tables[i].Name < stats.Tables[j].Name })
+
+	return stats
+}
@@ -0,0 +1,209 @@
+package replicate_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsCatchUp(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		stats    replicate.Stats
+		lag      uint64
+		progress float64
+		eta      time.Duration
+		etaOK    bool
+	}{
+		{
+			name:     "caught up",
+			stats:    replicate.Stats{StartLSN: 100, AppliedLSN: 200, ServerLSN: 200},
+			progress: 1,
+			etaOK:    true,
+		},
+		{
+			name:     "halfway",
+			stats:    replicate.Stats{StartLSN: 100, AppliedLSN: 150, ServerLSN: 200, ApplyRate: 10},
+			lag:      50,
+			progress: 0.5,
+			eta:      5 * time.Second,
+			etaOK:    true,
+		},
+		{
+			name:  "no rate yet",
+			stats: replicate.Stats{StartLSN: 100, AppliedLSN: 100, ServerLSN: 200},
+			lag:   100,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.lag, test.stats.Lag())
+			assert.InDelta(t, test.progress, test.stats.Progress(), 0.001)
+
+			eta, ok := test.stats.ETA()
+			assert.Equal(t, test.etaOK, ok)
+			assert.Equal(t, test.eta, eta)
+		})
+	}
+}
+
+func TestStatsHung(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name  string
+		stats replicate.Stats
+		hung  bool
+	}{
+		{
+			name:  "applying",
+			stats: replicate.Stats{State: replicate.StateStreaming, ReceivedLSN: 200, AppliedLSN: 100, LoopedAt: now.Add(-time.Second)},
+		},
+		{
+			name:  "stuck with received wal",
+			stats: replicate.Stats{State: replicate.StateStreaming, ReceivedLSN: 200, AppliedLSN: 100, LoopedAt: now.Add(-10 * time.Minute)},
+			hung:  true,
+		},
+		{
+			name:  "stuck behind the upstream",
+			stats: replicate.Stats{State: replicate.StateStreaming, ServerLSN: 200, AppliedLSN: 100, LoopedAt: now.Add(-10 * time.Minute)},
+			hung:  true,
+		},
+		{
+			name:  "nothing pending",
+			stats: replicate.Stats{State: replicate.StateStreaming, ReceivedLSN: 100, AppliedLSN: 100, LoopedAt: now.Add(-10 * time.Minute)},
+		},
+		{
+			name:  "copying",
+			stats: replicate.Stats{State: replicate.StateCopying, ReceivedLSN: 200, AppliedLSN: 100, LoopedAt: now.Add(-10 * time.Minute)},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.hung, test.stats.Hung(now, 5*time.Minute))
+		})
+	}
+}
+
+func TestParseSLOs(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		specs []string
+		want  map[string]time.Duration
+		err   bool
+	}{
+		{
+			name: "none",
+			want: map[string]time.Duration{},
+		},
+		{
+			name:  "qualified and unqualified",
+			specs: []string{"orders=5s", "billing.invoices=1m"},
+			want: map[string]time.Duration{
+				"public.orders":    5 * time.Second,
+				"billing.invoices": time.Minute,
+			},
+		},
+		{
+			name:  "missing duration",
+			specs: []string{"orders"},
+			err:   true,
+		},
+		{
+			name:  "negative duration",
+			specs: []string{"orders=-1s"},
+			err:   true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := replicate.ParseSLOs(test.specs, "public")
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestStatsReached(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name  string
+		stats replicate.Stats
+		lsn   pglogrepl.LSN
+		want  bool
+	}{
+		{
+			name:  "applied",
+			stats: replicate.Stats{State: replicate.StateStreaming, AppliedLSN: 200},
+			lsn:   200,
+			want:  true,
+		},
+		{
+			name:  "behind",
+			stats: replicate.Stats{State: replicate.StateStreaming, AppliedLSN: 100, ServerLSN: 150},
+			lsn:   200,
+		},
+		{
+			name: "idle upstream past the lsn",
+			stats: replicate.Stats{
+				State: replicate.StateStreaming, AppliedLSN: 100, ServerLSN: 300,
+				LastMessageAt: at, LastAppliedAt: at.Add(time.Millisecond),
+			},
+			lsn:  200,
+			want: true,
+		},
+		{
+			name: "transaction being applied",
+			stats: replicate.Stats{
+				State: replicate.StateStreaming, AppliedLSN: 100, ServerLSN: 300,
+				LastMessageAt: at.Add(time.Millisecond), LastAppliedAt: at,
+			},
+			lsn: 200,
+		},
+		{
+			name:  "copying",
+			stats: replicate.Stats{State: replicate.StateCopying, ServerLSN: 300},
+			lsn:   200,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, test.stats.Reached(test.lsn))
+		})
+	}
+}
+
+func TestStatsHeartbeatAge(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	_, ok := replicate.Stats{}.HeartbeatAge(now)
+	assert.False(t, ok, "no heartbeat applied yet")
+
+	stats := replicate.Stats{HeartbeatAt: now.Add(-30 * time.Second), HeartbeatLatency: 200 * time.Millisecond}
+
+	age, ok := stats.HeartbeatAge(now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, age)
+}
+
+func TestStatsCaughtUp(t *testing.T) {
+	tests := []struct {
+		stats    replicate.Stats
+		caughtUp bool
+	}{
+		{stats: replicate.Stats{State: replicate.StateCopying, AppliedLSN: 0x100, ServerLSN: 0x100}},
+		{stats: replicate.Stats{State: replicate.StateStreaming, AppliedLSN: 0x100}},
+		{stats: replicate.Stats{State: replicate.StateStreaming, AppliedLSN: 0x100, ServerLSN: 0x200}},
+		{stats: replicate.Stats{State: replicate.StateStreaming, AppliedLSN: 0x100, ServerLSN: 0x180}, caughtUp: true},
+		{stats: replicate.Stats{State: replicate.StateStreaming, AppliedLSN: 0x200, ServerLSN: 0x100}, caughtUp: true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.caughtUp, tt.stats.CaughtUp(0x80), "%+v", tt.stats)
+	}
+}
@@ -0,0 +1,77 @@
+package replicate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errApplyHung stops a replication whose apply loop the watchdog found
+// stuck, Run restarts it.
+var errApplyHung = errors.New("apply loop hung")
+
+// stopTimeout is how long a hung replication has to stop once it's
+// cancelled. A loop stuck where cancelling can't reach it, e.g. in a
+// local statement, can't be restarted in-process.
+const stopTimeout = 30 * time.Second
+
+// watched runs the replication, cancelling it with errApplyHung when
+// the apply loop hangs for the watchdog timeout.
+func (r *Replicator) watched(ctx context.Context) error {
+	timeout := r.cfg.Replication.WatchdogTimeout
+	if timeout <= 0 {
+		return r.replicate(ctx)
+	}
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	done := make(chan error, 1)
+	go func() { done <- r.replicate(runCtx) }()
+
+	check := time.NewTicker(max(timeout/4, time.Second))
+	defer check.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-check.C:
+		}
+
+		stats := r.stats.snapshot()
+		if !stats.Hung(r.clock.Now(), timeout) {
+			continue
+		}
+
+		logHung(stats, r.clock.Now())
+		cancel(errApplyHung)
+
+		select {
+		case <-done:
+			return errApplyHung
+		case <-time.After(stopTimeout):
+			return fmt.Errorf("apply loop hung and didn't stop within %s", stopTimeout)
+		}
+	}
+}
+
+// logHung logs the diagnostics of a hung apply loop: where the
+// replication is, and the stacks of every goroutine.
+func logHung(stats Stats, now time.Time) {
+	log.Error().Msgf(
+		"apply loop stuck for %s with WAL pending: state %s, received %s, applied %s, upstream at %s, "+
+			"acked %s, last message at %s, last applied at %s",
+		now.Sub(stats.LoopedAt).Round(time.Second), stats.State, stats.ReceivedLSN, stats.AppliedLSN,
+		stats.ServerLSN, stats.AckedLSN, stats.LastMessageAt.Format(time.RFC3339), stats.LastAppliedAt.Format(time.RFC3339),
+	)
+
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	log.Error().Msgf("goroutines of the hung apply loop:\n%s", buf)
+}
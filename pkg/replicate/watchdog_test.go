@@ -0,0 +1,78 @@
+package replicate_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/clock"
+	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchdogRestart(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Replication.WatchdogTimeout = time.Second
+	cfg.Replication.WatchdogRestarts = 1
+
+	clk := clock.NewManual(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	r := replicate.New(cfg)
+	r.SetClock(clk)
+
+	stopped := errors.New("stopped")
+	runs := 0
+
+	r.SetReplicate(func(ctx context.Context) error {
+		runs++
+
+		if runs > 1 {
+			// the restarted replication resumes
+			return stopped
+		}
+
+		// WAL received that the apply loop never gets to
+		r.Receive(100)
+		clk.Advance(2 * time.Minute)
+
+		<-ctx.Done()
+
+		return ctx.Err()
+	})
+
+	err := r.Run(context.Background())
+	require.ErrorIs(t, err, stopped)
+	assert.Equal(t, 2, runs)
+}
+
+func TestWatchdogRestarts(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Replication.WatchdogTimeout = time.Second
+
+	clk := clock.NewManual(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	r := replicate.New(cfg)
+	r.SetClock(clk)
+
+	runs := 0
+
+	r.SetReplicate(func(ctx context.Context) error {
+		runs++
+
+		r.Receive(100)
+		clk.Advance(2 * time.Minute)
+
+		<-ctx.Done()
+
+		return ctx.Err()
+	})
+
+	// without restarts left, the hung replication stops Run
+	err := r.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "apply loop hung")
+	assert.Equal(t, 1, runs)
+}
@@ -0,0 +1,182 @@
+package ship
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqledge"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNotReached is returned when the segments shipped don't reach the
+// position to restore to.
+var ErrNotReached = errors.New("position not reached")
+
+// Restore writes the database shipped to dir to out, from the base copy
+// of the generation, the latest if it's empty, and its segments. With a
+// lsn, it stops at the first segment that reaches it, rather than
+// applying them all. It returns the position of the restored database.
+func Restore(ctx context.Context, dir, generation string, lsn pglogrepl.LSN, out string) (pglogrepl.LSN, error) {
+	if generation == "" {
+		generations, err := Generations(dir)
+		if err != nil {
+			return 0, fmt.Errorf("list generations: %w", err)
+		}
+
+		if len(generations) == 0 {
+			return 0, fmt.Errorf("no generations in %s", dir)
+		}
+
+		generation = generations[len(generations)-1]
+	}
+
+	if _, err := os.Stat(out); err == nil {
+		return 0, fmt.Errorf("%s already exists", out)
+	}
+
+	genDir := filepath.Join(dir, generation)
+
+	if err := copyFile(filepath.Join(genDir, baseFile), out); err != nil {
+		return 0, fmt.Errorf("copy base: %w", err)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(genDir, "*.wal"))
+	if err != nil {
+		return 0, err
+	}
+
+	// the segments' names start with their index
+	sort.Strings(segments)
+
+	f, err := os.OpenFile(out, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		wal walHeader
+		sum [2]uint32
+	)
+
+	for _, segment := range segments {
+		label, err := segmentLSN(segment)
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+
+		if wal, sum, err = applySegment(f, segment, wal, sum); err != nil {
+			f.Close()
+			return 0, fmt.Errorf("apply %s: %w", filepath.Base(segment), err)
+		}
+
+		// the label is the position when the segment was shipped,
+		// its frames have at least the changes up to it
+		if lsn != 0 && label >= lsn {
+			break
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	restored, err := restoredPosition(ctx, out)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Info().Msgf("restored generation %s to %s at %s", generation, out, restored)
+
+	if restored < lsn {
+		return restored, fmt.Errorf("%w: restored to %s, need %s", ErrNotReached, restored, lsn)
+	}
+
+	return restored, nil
+}
+
+// applySegment writes the segment's frames to the pages of the database
+// file, truncating it to the database's size at each commit. The frames'
+// checksums continue from the previous segment's, when it's of the same
+// WAL.
+func applySegment(f *os.File, segment string, prev walHeader, sum [2]uint32) (walHeader, [2]uint32, error) {
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		return walHeader{}, sum, err
+	}
+
+	hdr, err := parseWALHeader(data)
+	if err != nil {
+		return walHeader{}, sum, err
+	}
+
+	if !hdr.sameWAL(prev) {
+		sum = hdr.sum
+	}
+
+	frames := data[walHeaderSize:]
+
+	n, sum := hdr.committedFrames(frames, sum)
+	if n != len(frames) {
+		return walHeader{}, sum, fmt.Errorf("%w: %d of %d bytes of frames committed", errBadWAL, n, len(frames))
+	}
+
+	size := hdr.frameSize()
+
+	for off := int64(0); off < int64(n); off += size {
+		frame := frames[off : off+size]
+
+		pgno := int64(binary.BigEndian.Uint32(frame))
+		if _, err := f.WriteAt(frame[walFrameHeaderSize:], (pgno-1)*int64(hdr.pageSize)); err != nil {
+			return walHeader{}, sum, err
+		}
+
+		if pages := int64(binary.BigEndian.Uint32(frame[4:])); pages != 0 {
+			if err := f.Truncate(pages * int64(hdr.pageSize)); err != nil {
+				return walHeader{}, sum, err
+			}
+		}
+	}
+
+	return hdr, sum, nil
+}
+
+// segmentLSN parses the position from a segment's name, <index>-<lsn>.wal.
+func segmentLSN(segment string) (pglogrepl.LSN, error) {
+	name := strings.TrimSuffix(filepath.Base(segment), ".wal")
+
+	_, hex, ok := strings.Cut(name, "-")
+	if !ok {
+		return 0, fmt.Errorf("segment %s: no position", segment)
+	}
+
+	var lsn uint64
+	if _, err := fmt.Sscanf(hex, "%X", &lsn); err != nil {
+		return 0, fmt.Errorf("segment %s: %w", segment, err)
+	}
+
+	return pglogrepl.LSN(lsn), nil
+}
+
+func restoredPosition(ctx context.Context, path string) (pglogrepl.LSN, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return 0, fmt.Errorf("open restored: %w", err)
+	}
+	defer db.Close()
+
+	return sqledge.Position(ctx, db)
+}
@@ -0,0 +1,411 @@
+// Package ship continuously copies the local database, as a base copy
+// and the WAL frames committed after it, to a directory, so an edge node
+// lost with its disk can be restored to a recent position. Each file
+// shipped can be uploaded to object storage with a hook command.
+//
+// The shipped frames are never checkpointed away before they're copied:
+// the shipper holds a read transaction, which a checkpoint can't pass,
+// and refreshes it only just before copying the frames up to the end of
+// the WAL. The other connections to the local database must not
+// checkpoint it, the shipper checkpoints it once it grows past a limit.
+package ship
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqledge"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite"
+)
+
+// baseFile is the copy of the database file a generation starts from.
+const baseFile = "base.db"
+
+// Config configures shipping the local database.
+type Config struct {
+	// Path is the local database, and DSN how it's opened.
+	Path string
+	DSN  string
+	// Dir is where the generations are shipped to, a directory per
+	// generation with its base copy and the segments of WAL frames
+	// after it.
+	Dir      string
+	Interval time.Duration
+	// CheckpointBytes is the size the WAL is checkpointed at, once its
+	// frames are shipped.
+	CheckpointBytes int64
+	// Hook is a shell command run for every file shipped, e.g. to
+	// upload it, with the environment variables SQLEDGE_SHIP_FILE,
+	// SQLEDGE_SHIP_KEY (the file's path in Dir), SQLEDGE_SHIP_GENERATION
+	// and SQLEDGE_SHIP_LSN. Files whose hook fails are retried in order
+	// before the files shipped after them.
+	Hook string
+	// Retain is how many generations are kept in Dir, older ones are
+	// removed when a new one starts. Zero keeps them all.
+	Retain int
+}
+
+// Shipper ships the local database's WAL frames as they're committed.
+type Shipper struct {
+	cfg Config
+	db  *sql.DB
+	// hold is the connection holding the read transaction that stops
+	// checkpoints passing the frames shipped.
+	hold *sql.Conn
+
+	generation string
+	index      int
+	wal        walHeader
+	offset     int64
+	sum        [2]uint32
+	// backfilled is how far into the WAL the last checkpoint got, it
+	// passes the frames shipped if the WAL was fully checkpointed when
+	// the read transaction started, and the frames after were written
+	// before the checkpoint.
+	backfilled int64
+
+	// hooks are the files whose hook hasn't succeeded yet.
+	hooks []hookFile
+}
+
+type hookFile struct {
+	key string
+	lsn pglogrepl.LSN
+}
+
+// New switches the local database to WAL mode, it must be done before
+// other connections open it, and starts holding back checkpoints.
+func New(ctx context.Context, cfg Config) (*Shipper, error) {
+	db, err := sql.Open("sqlite", cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("open local: %w", err)
+	}
+
+	var mode string
+	if err := db.QueryRowContext(ctx, "PRAGMA journal_mode=WAL").Scan(&mode); err != nil || mode != "wal" {
+		db.Close()
+		return nil, fmt.Errorf("switch local database to wal mode, in %q mode: %w", mode, err)
+	}
+
+	s := &Shipper{cfg: cfg, db: db}
+
+	if s.hold, err = db.Conn(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open local: %w", err)
+	}
+
+	if err := s.holdCheckpoints(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Shipper) Close() error {
+	s.hold.ExecContext(context.Background(), "ROLLBACK")
+	s.hold.Close()
+
+	return s.db.Close()
+}
+
+// Run ships every Interval until ctx is done. A failed round is logged,
+// the next one picks up where it left off.
+func (s *Shipper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Ship(ctx); err != nil {
+			log.Warn().Err(err).Msg("ship local database")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ship copies the frames committed since the last round into a new
+// segment, starting a new generation from a base copy the first time,
+// and checkpoints the WAL once it's over CheckpointBytes.
+func (s *Shipper) Ship(ctx context.Context) error {
+	// the position is read before the frames, so the segment has at
+	// least the changes up to it
+	lsn, err := s.position(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.holdCheckpoints(ctx); err != nil {
+		return err
+	}
+
+	if s.generation == "" {
+		if err := s.newGeneration(lsn); err != nil {
+			return err
+		}
+	}
+
+	size, err := s.shipFrames(lsn)
+	if err != nil {
+		return err
+	}
+
+	s.runHooks(ctx)
+
+	if size < s.cfg.CheckpointBytes {
+		return nil
+	}
+
+	// the checkpoint stops at the frames visible to the held read
+	// transaction, which have been shipped
+	var busy, frames, checkpointed int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &frames, &checkpointed); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+
+	s.backfilled = walHeaderSize + int64(checkpointed)*s.wal.frameSize()
+
+	log.Debug().Msgf("checkpointed %d of %d wal frames", checkpointed, frames)
+
+	// a read transaction on a checkpointed WAL lets the next write
+	// restart it
+	return s.holdCheckpoints(ctx)
+}
+
+// holdCheckpoints refreshes the read transaction holding back
+// checkpoints, to the latest commit, before its frames are shipped.
+func (s *Shipper) holdCheckpoints(ctx context.Context) error {
+	s.hold.ExecContext(ctx, "ROLLBACK")
+
+	if _, err := s.hold.ExecContext(ctx, "BEGIN"); err != nil {
+		return fmt.Errorf("hold checkpoints: %w", err)
+	}
+
+	var n int
+	if err := s.hold.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master").Scan(&n); err != nil {
+		return fmt.Errorf("hold checkpoints: %w", err)
+	}
+
+	return nil
+}
+
+// newGeneration starts a generation from a copy of the database file,
+// the frames in the WAL at the time are shipped on top of it.
+func (s *Shipper) newGeneration(lsn pglogrepl.LSN) error {
+	generation := fmt.Sprintf("%016x", time.Now().UnixNano())
+	dir := filepath.Join(s.cfg.Dir, generation)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create generation: %w", err)
+	}
+
+	// checkpoints only write the frames the held read transaction
+	// can see, which are shipped from the start of the WAL on top
+	if err := copyFile(s.cfg.Path, filepath.Join(dir, baseFile)); err != nil {
+		return fmt.Errorf("copy base: %w", err)
+	}
+
+	s.generation, s.index = generation, 0
+	s.wal, s.offset = walHeader{}, 0
+	s.hooks = append(s.hooks, hookFile{key: filepath.Join(generation, baseFile), lsn: lsn})
+
+	log.Info().Msgf("shipping local database generation %s from %s", generation, lsn)
+
+	s.prune()
+
+	return nil
+}
+
+// shipFrames copies the committed frames after the offset shipped to a
+// segment, and returns the WAL's size.
+func (s *Shipper) shipFrames(lsn pglogrepl.LSN) (int64, error) {
+	f, err := os.Open(s.cfg.Path + "-wal")
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("open wal: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, fmt.Errorf("read wal: %w", err)
+	}
+
+	if len(data) < walHeaderSize {
+		// restarted, not written to yet
+		return int64(len(data)), nil
+	}
+
+	hdr, err := parseWALHeader(data)
+	if err != nil {
+		return 0, err
+	}
+
+	if !hdr.sameWAL(s.wal) {
+		if s.wal.raw != nil && (hdr.salt1 != s.wal.salt1+1 || s.backfilled > s.offset) {
+			// restarted more than once since the last round, or after
+			// a checkpoint past the frames shipped, frames may have
+			// been checkpointed before they were shipped
+			log.Warn().Msgf("wal restarted from %d to %d after frames not shipped, starting a new generation", s.wal.salt1, hdr.salt1)
+
+			if err := s.newGeneration(lsn); err != nil {
+				return 0, err
+			}
+		}
+
+		// the frames of the previous wal have all been shipped and
+		// checkpointed, as it was restarted
+		s.wal, s.offset, s.sum, s.backfilled = hdr, walHeaderSize, hdr.sum, 0
+	}
+
+	n, sum := hdr.committedFrames(data[s.offset:], s.sum)
+	if n == 0 {
+		return int64(len(data)), nil
+	}
+
+	key := filepath.Join(s.generation, fmt.Sprintf("%08d-%016X.wal", s.index, uint64(lsn)))
+
+	segment := append(append([]byte(nil), hdr.raw...), data[s.offset:s.offset+int64(n)]...)
+	if err := writeFile(filepath.Join(s.cfg.Dir, key), segment); err != nil {
+		return 0, fmt.Errorf("write segment: %w", err)
+	}
+
+	s.index++
+	s.offset += int64(n)
+	s.sum = sum
+	s.hooks = append(s.hooks, hookFile{key: key, lsn: lsn})
+
+	log.Debug().Msgf("shipped %d wal frames to %s", n/int(hdr.frameSize()), key)
+
+	return int64(len(data)), nil
+}
+
+// runHooks runs the hook for the files shipped, in order, stopping
+// at the first that fails to retry it in the next round.
+func (s *Shipper) runHooks(ctx context.Context) {
+	if s.cfg.Hook == "" {
+		s.hooks = nil
+		return
+	}
+
+	for len(s.hooks) > 0 {
+		h := s.hooks[0]
+
+		cmd := exec.CommandContext(ctx, "sh", "-c", s.cfg.Hook)
+		cmd.Env = append(os.Environ(),
+			"SQLEDGE_SHIP_FILE="+filepath.Join(s.cfg.Dir, h.key),
+			"SQLEDGE_SHIP_KEY="+filepath.ToSlash(h.key),
+			"SQLEDGE_SHIP_GENERATION="+filepath.Dir(h.key),
+			"SQLEDGE_SHIP_LSN="+h.lsn.String(),
+		)
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Warn().Err(err).Msgf("ship hook for %s: %s", h.key, strings.TrimSpace(string(out)))
+			return
+		}
+
+		s.hooks = s.hooks[1:]
+	}
+}
+
+// prune removes the generations before the last Retain.
+func (s *Shipper) prune() {
+	if s.cfg.Retain <= 0 {
+		return
+	}
+
+	generations, err := Generations(s.cfg.Dir)
+	if err != nil {
+		log.Warn().Err(err).Msg("list shipped generations")
+		return
+	}
+
+	for _, generation := range generations[:max(len(generations)-s.cfg.Retain, 0)] {
+		if err := os.RemoveAll(filepath.Join(s.cfg.Dir, generation)); err != nil {
+			log.Warn().Err(err).Msgf("remove shipped generation %s", generation)
+		}
+	}
+}
+
+// position reads the local database's position, zero before the
+// tables are first copied.
+func (s *Shipper) position(ctx context.Context) (pglogrepl.LSN, error) {
+	lsn, err := sqledge.Position(ctx, s.db)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return 0, nil
+	}
+
+	return lsn, err
+}
+
+// Generations lists the generations shipped to dir, oldest first.
+func Generations(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []string
+
+	for _, e := range entries {
+		if e.IsDir() {
+			generations = append(generations, e.Name())
+		}
+	}
+
+	sort.Strings(generations)
+
+	return generations, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// writeFile writes the file through a temporary file, so a file in the
+// directory is always complete.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
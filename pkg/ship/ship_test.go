@@ -0,0 +1,101 @@
+package ship_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/ship"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func TestShipRestore(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "sqledge.db")
+	dir := filepath.Join(tmp, "shipped")
+	dsn := path + "?_pragma=wal_autocheckpoint%3D0"
+
+	shipper, err := ship.New(ctx, ship.Config{
+		Path: path,
+		DSN:  dsn,
+		Dir:  dir,
+		// checkpointed every round, so the wal is restarted
+		CheckpointBytes: 1,
+		Hook:            fmt.Sprintf("echo $SQLEDGE_SHIP_KEY $SQLEDGE_SHIP_LSN >> %s", filepath.Join(tmp, "hooks")),
+	})
+	require.NoError(t, err)
+
+	local, err := sql.Open("sqlite", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge"}
+	require.NoError(t, sqlgen.NewSqliteDriver(cfg, local).InitPositionTable())
+
+	_, err = local.Exec("CREATE TABLE names (id integer, name text, PRIMARY KEY (id))")
+	require.NoError(t, err)
+
+	for i := 1; i <= 20; i++ {
+		_, err := local.Exec(fmt.Sprintf("INSERT INTO names VALUES (%d, '%s'); %s",
+			i, strings.Repeat("x", 1000), sqlgen.NewSqlite(cfg, nil).Pos(pglogrepl.LSN(i*0x100).String())))
+		require.NoError(t, err)
+
+		if i%3 == 0 {
+			require.NoError(t, shipper.Ship(ctx))
+		}
+	}
+
+	require.NoError(t, shipper.Ship(ctx))
+	require.NoError(t, shipper.Close())
+
+	generations, err := ship.Generations(dir)
+	require.NoError(t, err)
+	require.Len(t, generations, 1)
+
+	files, err := os.ReadDir(filepath.Join(dir, generations[0]))
+	require.NoError(t, err)
+
+	hooks, err := os.ReadFile(filepath.Join(tmp, "hooks"))
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(hooks)), "\n"), len(files))
+
+	restored := func(out string) int {
+		db, err := sql.Open("sqlite", out)
+		require.NoError(t, err)
+		defer db.Close()
+
+		var n int
+		require.NoError(t, db.QueryRow("SELECT count(*) FROM names").Scan(&n))
+
+		return n
+	}
+
+	out := filepath.Join(tmp, "restored.db")
+
+	lsn, err := ship.Restore(ctx, dir, "", 0, out)
+	require.NoError(t, err)
+	assert.Equal(t, pglogrepl.LSN(20*0x100), lsn)
+	assert.Equal(t, 20, restored(out))
+
+	_, err = ship.Restore(ctx, dir, "", 0, out)
+	assert.Error(t, err, "restores over an existing file")
+
+	out = filepath.Join(tmp, "restored-at.db")
+
+	lsn, err = ship.Restore(ctx, dir, generations[0], 7*0x100, out)
+	require.NoError(t, err)
+	assert.Equal(t, pglogrepl.LSN(9*0x100), lsn, "stops at the segment reaching the position")
+	assert.Equal(t, 9, restored(out))
+
+	_, err = ship.Restore(ctx, dir, generations[0], 21*0x100, filepath.Join(tmp, "restored-after.db"))
+	assert.ErrorIs(t, err, ship.ErrNotReached)
+}
@@ -0,0 +1,122 @@
+package ship
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The SQLite WAL file format, see https://www.sqlite.org/fileformat.html#the_write_ahead_log.
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+
+	walMagicLE = 0x377f0682
+	walMagicBE = 0x377f0683
+)
+
+var errBadWAL = errors.New("invalid wal")
+
+// walHeader is the header of a WAL file. Its salts change every time the
+// WAL is restarted, frames with other salts are left over from before.
+type walHeader struct {
+	raw       []byte
+	bigEndian bool
+	pageSize  uint32
+	seq       uint32
+	salt1     uint32
+	salt2     uint32
+	sum       [2]uint32
+}
+
+func parseWALHeader(b []byte) (walHeader, error) {
+	if len(b) < walHeaderSize {
+		return walHeader{}, fmt.Errorf("%w: %d byte header", errBadWAL, len(b))
+	}
+
+	h := walHeader{raw: append([]byte(nil), b[:walHeaderSize]...)}
+
+	switch binary.BigEndian.Uint32(b) {
+	case walMagicLE:
+	case walMagicBE:
+		h.bigEndian = true
+	default:
+		return walHeader{}, fmt.Errorf("%w: magic %x", errBadWAL, b[:4])
+	}
+
+	h.pageSize = binary.BigEndian.Uint32(b[8:])
+	h.seq = binary.BigEndian.Uint32(b[12:])
+	h.salt1 = binary.BigEndian.Uint32(b[16:])
+	h.salt2 = binary.BigEndian.Uint32(b[20:])
+	h.sum = [2]uint32{binary.BigEndian.Uint32(b[24:]), binary.BigEndian.Uint32(b[28:])}
+
+	if h.pageSize < 512 || h.pageSize > 65536 || h.pageSize&(h.pageSize-1) != 0 {
+		return walHeader{}, fmt.Errorf("%w: page size %d", errBadWAL, h.pageSize)
+	}
+
+	if walChecksum(h.bigEndian, [2]uint32{}, b[:24]) != h.sum {
+		return walHeader{}, fmt.Errorf("%w: header checksum", errBadWAL)
+	}
+
+	return h, nil
+}
+
+func (h walHeader) sameWAL(o walHeader) bool {
+	return h.salt1 == o.salt1 && h.salt2 == o.salt2
+}
+
+func (h walHeader) frameSize() int64 {
+	return walFrameHeaderSize + int64(h.pageSize)
+}
+
+// walChecksum continues the checksum from sum over b, whose length is a
+// multiple of 8.
+func walChecksum(bigEndian bool, sum [2]uint32, b []byte) [2]uint32 {
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		order = binary.BigEndian
+	}
+
+	s1, s2 := sum[0], sum[1]
+
+	for i := 0; i+8 <= len(b); i += 8 {
+		s1 += order.Uint32(b[i:]) + s2
+		s2 += order.Uint32(b[i+4:]) + s1
+	}
+
+	return [2]uint32{s1, s2}
+}
+
+// committedFrames returns the length of the frames in b, following
+// frames checksummed up to sum, that end with a commit frame, and the
+// checksum after them. Frames after the last commit, of another WAL or
+// torn by a write in progress, are left out.
+func (h walHeader) committedFrames(b []byte, sum [2]uint32) (int, [2]uint32) {
+	var (
+		n         int
+		committed = sum
+	)
+
+	size := int(h.frameSize())
+
+	for off := 0; off+size <= len(b); off += size {
+		frame := b[off : off+size]
+
+		if binary.BigEndian.Uint32(frame[8:]) != h.salt1 || binary.BigEndian.Uint32(frame[12:]) != h.salt2 {
+			break
+		}
+
+		sum = walChecksum(h.bigEndian, sum, frame[:8])
+		sum = walChecksum(h.bigEndian, sum, frame[walFrameHeaderSize:])
+
+		if sum != [2]uint32{binary.BigEndian.Uint32(frame[16:]), binary.BigEndian.Uint32(frame[20:])} {
+			break
+		}
+
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			n, committed = off+size, sum
+		}
+	}
+
+	return n, committed
+}
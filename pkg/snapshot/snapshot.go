@@ -0,0 +1,310 @@
+// Package snapshot bootstraps a new node from a copy of another
+// node's local database, instead of copying every table from
+// the upstream.
+package snapshot
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+)
+
+// LSNHeader is the response header holding the snapshot's position,
+// the new node streams from the upstream starting there.
+const LSNHeader = "Sqledge-Lsn"
+
+// waitTimeout is how long a snapshot request waits for the
+// node to apply the requested position.
+const waitTimeout = 30 * time.Second
+
+// Handler serves a consistent copy of the local database at path. With a
+// min_lsn parameter the copy waits until applied reaches that position, so
+// the new node's slot, created at min_lsn, can stream everything after it.
+func Handler(path string, cfg sqlgen.SqliteConfig, applied func() pglogrepl.LSN) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var minLSN pglogrepl.LSN
+
+		if v := r.URL.Query().Get("min_lsn"); v != "" {
+			lsn, err := pglogrepl.ParseLSN(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid min_lsn: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			minLSN = lsn
+		}
+
+		if err := waitApplied(r.Context(), minLSN, applied); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		dir, err := os.MkdirTemp("", "sqledge-snapshot")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, "snapshot.db")
+
+		pos, err := copyLocal(r.Context(), path, file, cfg)
+		if err != nil {
+			log.Error().Err(err).Msg("snapshot local database")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		if pos == "" {
+			http.Error(w, "no position recorded yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set(LSNHeader, pos)
+
+		if _, err := io.Copy(w, f); err != nil {
+			log.Error().Err(err).Msg("send snapshot")
+		}
+	})
+}
+
+func waitApplied(ctx context.Context, minLSN pglogrepl.LSN, applied func() pglogrepl.LSN) error {
+	ctx, cancel := context.WithTimeout(ctx, waitTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for applied() < minLSN {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("position %s not applied yet, at %s", minLSN, applied())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// copyLocal writes a consistent copy of the database to file,
+// and returns the position recorded in the copy.
+func copyLocal(ctx context.Context, path, file string, cfg sqlgen.SqliteConfig) (string, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return "", fmt.Errorf("open local: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", file); err != nil {
+		return "", fmt.Errorf("vacuum into: %w", err)
+	}
+
+	snap, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return "", fmt.Errorf("open snapshot: %w", err)
+	}
+	defer snap.Close()
+
+	return sqlgen.NewSqliteDriver(cfg, snap).Pos()
+}
+
+// Fetch downloads a snapshot from the peer's admin API, once the peer has
+// applied minLSN, and copies its tables into db. It returns the position
+// to stream from. The request authenticates with the user and password in
+// the peer's url, or else with user and password.
+func Fetch(ctx context.Context, peer, user, password string, minLSN pglogrepl.LSN, db *sql.DB) (pglogrepl.LSN, error) {
+	u, err := url.Parse(strings.TrimRight(peer, "/") + "/snapshot")
+	if err != nil {
+		return 0, fmt.Errorf("parse peer url: %w", err)
+	}
+
+	u.RawQuery = url.Values{"min_lsn": {minLSN.String()}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("build request: %w", err)
+	}
+
+	if u.User == nil {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("request snapshot: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	lsn, err := pglogrepl.ParseLSN(resp.Header.Get(LSNHeader))
+	if err != nil {
+		return 0, fmt.Errorf("parse snapshot position: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "sqledge-snapshot")
+	if err != nil {
+		return 0, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "snapshot.db")
+
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, fmt.Errorf("create snapshot file: %w", err)
+	}
+
+	n, err := io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("download snapshot: %w", err)
+	}
+
+	log.Debug().Msgf("downloaded %d byte snapshot at %s from %s", n, lsn, peer)
+
+	if err := checkFormat(file); err != nil {
+		return 0, err
+	}
+
+	if err := restore(ctx, db, file); err != nil {
+		return 0, err
+	}
+
+	return lsn, nil
+}
+
+// restore recreates the snapshot's tables and indexes in db, replacing
+// any tables with the same name.
+func restore(ctx context.Context, db *sql.DB, file string) (err error) {
+	// attached databases belong to the connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to local db: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS peer", file); err != nil {
+		return fmt.Errorf("attach snapshot: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "DETACH DATABASE peer")
+
+	type object struct {
+		typ, name, table, sql string
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT type, name, tbl_name, sql FROM peer.sqlite_schema
+		WHERE type IN ('table', 'index') AND sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+		ORDER BY type = 'index'`)
+	if err != nil {
+		return fmt.Errorf("read snapshot schema: %w", err)
+	}
+
+	var objects []object
+
+	for rows.Next() {
+		var o object
+		if err := rows.Scan(&o.typ, &o.name, &o.table, &o.sql); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan snapshot schema: %w", err)
+		}
+
+		// the new node tracks its own replication
+		if !slices.Contains(sqlgen.NodeTables, o.table) {
+			objects = append(objects, o)
+		}
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return fmt.Errorf("read snapshot schema: %w", err)
+	}
+
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return fmt.Errorf("begin restore: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			conn.ExecContext(context.Background(), "ROLLBACK")
+		}
+	}()
+
+	for _, o := range objects {
+		var stmts []string
+
+		switch o.typ {
+		case "table":
+			stmts = []string{
+				fmt.Sprintf("DROP TABLE IF EXISTS main.%q", o.name),
+				o.sql,
+				fmt.Sprintf("INSERT INTO main.%q SELECT * FROM peer.%q", o.name, o.name),
+			}
+		case "index":
+			stmts = []string{sqlgen.IfNotExists(o.sql)}
+		}
+
+		for _, stmt := range stmts {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("restore %s %q: %w", o.typ, o.name, err)
+			}
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return fmt.Errorf("commit restore: %w", err)
+	}
+
+	return nil
+}
+
+// checkFormat returns an error when the snapshot's rows are stored in
+// another on-disk format than this binary's, e.g. when the peer runs
+// a newer release.
+func checkFormat(file string) error {
+	snap, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer snap.Close()
+
+	f, stamped, err := sqlgen.NewSqliteDriver(sqlgen.SqliteConfig{}, snap).Format()
+	if err != nil {
+		return fmt.Errorf("read snapshot format: %w", err)
+	}
+
+	if stamped && f.Version != sqlgen.FormatVersion {
+		return fmt.Errorf("%w: the peer's snapshot is in format %d, written by sqledge %s, this binary writes format %d",
+			sqlgen.ErrIncompatibleFormat, f.Version, f.WrittenBy, sqlgen.FormatVersion)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package snapshot_test
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/snapshot"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func open(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestFetch(t *testing.T) {
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge"}
+
+	path := filepath.Join(t.TempDir(), "peer.db")
+	peer := open(t, path)
+
+	driver := sqlgen.NewSqliteDriver(cfg, peer)
+	require.NoError(t, driver.InitPositionTable())
+
+	for _, stmt := range []string{
+		"CREATE TABLE names (id integer, name text, PRIMARY KEY (id));",
+		"CREATE INDEX names_name ON names (name);",
+		"INSERT INTO names VALUES (1, 'Hello'), (2, 'World');",
+		sqlgen.NewSqlite(cfg, nil).Pos("0/16B3748"),
+	} {
+		_, err := peer.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	applied := pglogrepl.LSN(0x16B3748)
+
+	handler := snapshot.Handler(path, cfg, func() pglogrepl.LSN { return applied })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "postgres" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	local := open(t, filepath.Join(t.TempDir(), "local.db"))
+
+	_, err := local.Exec("CREATE TABLE names (id integer);")
+	require.NoError(t, err)
+
+	_, err = snapshot.Fetch(context.Background(), srv.URL, "postgres", "wrong", applied, local)
+	require.ErrorContains(t, err, "401 Unauthorized")
+
+	// the url's credentials take precedence
+	peerURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	peerURL.User = url.UserPassword("postgres", "secret")
+
+	lsn, err := snapshot.Fetch(context.Background(), peerURL.String(), "postgres", "wrong", applied, local)
+	require.NoError(t, err)
+	assert.Equal(t, applied, lsn)
+
+	var count int
+	require.NoError(t, local.QueryRow("SELECT count(*) FROM names WHERE name IS NOT NULL").Scan(&count))
+	assert.Equal(t, 2, count)
+
+	// the peer's position isn't copied
+	var tables int
+	require.NoError(t, local.QueryRow("SELECT count(*) FROM sqlite_schema WHERE name = 'postgres_pos'").Scan(&tables))
+	assert.Zero(t, tables)
+
+	var index string
+	require.NoError(t, local.QueryRow("SELECT name FROM sqlite_schema WHERE type = 'index' AND tbl_name = 'names' AND sql IS NOT NULL").Scan(&index))
+	assert.Equal(t, "names_name", index)
+}
@@ -0,0 +1,360 @@
+// Package sqledge is a database/sql driver for Go apps running next to
+// sqledge, reading from the local replica without the wire protocol:
+//
+//	db, err := sql.Open("sqledge", "./sqledge.db?upstream=postgres://app@primary/app&max_lag=16777216")
+//
+// Like the proxy, reads are served from the local database, and other
+// statements are forwarded to the upstream when one is configured.
+// Queries use postgres' $n placeholders.
+package sqledge
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgwire"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrReadOnly is returned for writes when there's no upstream to forward them to.
+var ErrReadOnly = errors.New("sqledge: writes need an upstream")
+
+func init() {
+	sql.Register("sqledge", &Driver{})
+}
+
+// Driver is the sqledge database/sql driver.
+type Driver struct{}
+
+// Open opens a connection, prefer sql.Open which shares one
+// connector between the connections.
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Connect(context.Background())
+}
+
+// OpenConnector parses the dsn, the local database's path with the options:
+//
+//	upstream   postgres connection string that writes are forwarded to
+//	max_lag    bytes of upstream WAL the replica may be behind for reads
+//	wait       how long reads wait for the replica to be fresh, default 5s
+//	lag_check  how often the upstream's WAL position is checked, default 1s
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	path, rawQuery, _ := strings.Cut(dsn, "?")
+
+	opts, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("sqledge: parse dsn: %w", err)
+	}
+
+	c := &Connector{
+		driver:   d,
+		wait:     5 * time.Second,
+		lagCheck: time.Second,
+	}
+
+	if v := opts.Get("max_lag"); v != "" {
+		if c.maxLag, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("sqledge: parse max_lag: %w", err)
+		}
+	}
+
+	for name, dst := range map[string]*time.Duration{"wait": &c.wait, "lag_check": &c.lagCheck} {
+		if v := opts.Get(name); v != "" {
+			if *dst, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("sqledge: parse %s: %w", name, err)
+			}
+		}
+	}
+
+	if c.local, err = sql.Open("sqlite3", "file:"+path+"?mode=ro"); err != nil {
+		return nil, fmt.Errorf("sqledge: open local: %w", err)
+	}
+
+	if upstream := opts.Get("upstream"); upstream != "" {
+		if c.upstream, err = sql.Open("pgx", upstream); err != nil {
+			c.local.Close()
+			return nil, fmt.Errorf("sqledge: open upstream: %w", err)
+		}
+	}
+
+	if c.maxLag > 0 && c.upstream == nil {
+		c.Close()
+		return nil, errors.New("sqledge: max_lag needs an upstream")
+	}
+
+	return c, nil
+}
+
+// Connector shares the local and upstream databases between its connections.
+type Connector struct {
+	driver   *Driver
+	local    *sql.DB
+	upstream *sql.DB
+
+	maxLag   uint64
+	wait     time.Duration
+	lagCheck time.Duration
+	lag      lagCache
+}
+
+func (c *Connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{c: c}, nil
+}
+
+func (c *Connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close closes the local and upstream databases, it's called by sql.DB.Close.
+func (c *Connector) Close() error {
+	errs := []error{c.local.Close()}
+
+	if c.upstream != nil {
+		errs = append(errs, c.upstream.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+type conn struct {
+	c *Connector
+	// tx is the open transaction, its writes run in the upstream transaction.
+	tx *tx
+}
+
+var (
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.NamedValueChecker  = (*conn)(nil)
+	_ driver.ConnPrepareContext = (*conn)(nil)
+)
+
+// CheckNamedValue passes the arguments through to the
+// local or upstream driver, which converts them.
+func (cn *conn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+func (cn *conn) Prepare(query string) (driver.Stmt, error) {
+	return cn.PrepareContext(context.Background(), query)
+}
+
+func (cn *conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	return &stmt{cn: cn, query: query}, nil
+}
+
+func (cn *conn) Close() error {
+	return nil
+}
+
+func (cn *conn) Begin() (driver.Tx, error) {
+	return cn.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx begins a transaction on the upstream for the transaction's writes.
+func (cn *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	t := &tx{cn: cn}
+
+	if cn.c.upstream != nil && !opts.ReadOnly {
+		upstreamTx, err := cn.c.upstream.BeginTx(ctx, &sql.TxOptions{Isolation: sql.IsolationLevel(opts.Isolation)})
+		if err != nil {
+			return nil, fmt.Errorf("sqledge: begin upstream: %w", err)
+		}
+
+		t.upstream = upstreamTx
+	}
+
+	cn.tx = t
+
+	return t, nil
+}
+
+func (cn *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !pgwire.IsRead(strings.TrimSpace(query)) {
+		if cn.c.upstream == nil {
+			return nil, ErrReadOnly
+		}
+
+		if cn.tx != nil && cn.tx.upstream != nil {
+			return queryRows(cn.tx.upstream.QueryContext(ctx, query, values(args)...))
+		}
+
+		return queryRows(cn.c.upstream.QueryContext(ctx, query, values(args)...))
+	}
+
+	if err := cn.c.fresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return queryRows(cn.c.local.QueryContext(ctx, sqliteQuery(query, args), values(args)...))
+}
+
+func (cn *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if cn.c.upstream == nil {
+		return nil, ErrReadOnly
+	}
+
+	if cn.tx != nil {
+		if cn.tx.upstream == nil {
+			return nil, ErrReadOnly
+		}
+
+		return cn.tx.upstream.ExecContext(ctx, query, values(args)...)
+	}
+
+	return cn.c.upstream.ExecContext(ctx, query, values(args)...)
+}
+
+// sqliteQuery rewrites the $n placeholders for sqlite.
+func sqliteQuery(query string, args []driver.NamedValue) string {
+	if len(args) == 0 {
+		return query
+	}
+
+	return pgwire.SQLiteParams(query)
+}
+
+func values(args []driver.NamedValue) []any {
+	out := make([]any, len(args))
+	for i, a := range args {
+		out[i] = a.Value
+	}
+
+	return out
+}
+
+type stmt struct {
+	cn    *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), named(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.cn.ExecContext(ctx, s.query, args)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.cn.QueryContext(ctx, s.query, args)
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+
+	return out
+}
+
+// tx is a transaction on the upstream, which is nil for read only transactions.
+// Like the proxy, reads in the transaction are served locally, so they don't
+// see the transaction's uncommitted writes.
+type tx struct {
+	cn       *conn
+	upstream *sql.Tx
+}
+
+func (t *tx) Commit() error {
+	t.cn.tx = nil
+
+	if t.upstream == nil {
+		return nil
+	}
+
+	return t.upstream.Commit()
+}
+
+func (t *tx) Rollback() error {
+	t.cn.tx = nil
+
+	if t.upstream == nil {
+		return nil
+	}
+
+	return t.upstream.Rollback()
+}
+
+// rows adapts the local or upstream *sql.Rows to driver.Rows.
+type rows struct {
+	rows *sql.Rows
+	cols []string
+}
+
+func queryRows(r *sql.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	cols, err := r.Columns()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return &rows{rows: r, cols: cols}, nil
+}
+
+func (r *rows) Columns() []string {
+	return r.cols
+}
+
+func (r *rows) Close() error {
+	return r.rows.Close()
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+
+		return io.EOF
+	}
+
+	vals := make([]any, len(dest))
+	ptrs := make([]any, len(dest))
+
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+
+	if err := r.rows.Scan(ptrs...); err != nil {
+		return err
+	}
+
+	for i, v := range vals {
+		dest[i] = v
+	}
+
+	return nil
+}
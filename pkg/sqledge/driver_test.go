@@ -0,0 +1,80 @@
+package sqledge_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqledge"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriver(t *testing.T) {
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge"}
+
+	path := filepath.Join(t.TempDir(), "sqledge.db")
+
+	local, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { local.Close() })
+
+	require.NoError(t, sqlgen.NewSqliteDriver(cfg, local).InitPositionTable())
+
+	for _, stmt := range []string{
+		"CREATE TABLE names (id integer, name text, PRIMARY KEY (id));",
+		"INSERT INTO names VALUES (1, 'Hello'), (2, 'World');",
+		sqlgen.NewSqlite(cfg, nil).Pos("0/16B3748"),
+	} {
+		_, err := local.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	db, err := sql.Open("sqledge", path+"?wait=50ms")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+
+	var name string
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT name FROM names WHERE id = $1", 2).Scan(&name))
+	assert.Equal(t, "World", name)
+
+	lsn, err := sqledge.Position(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, pglogrepl.LSN(0x16B3748), lsn)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr error
+	}{
+		{name: "applied", ctx: sqledge.WithMinLSN(ctx, 0x16B3748)},
+		{name: "not applied", ctx: sqledge.WithMinLSN(ctx, 0x16B3749), wantErr: sqledge.ErrStale},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+
+			err := db.QueryRowContext(tc.ctx, "SELECT name FROM names WHERE id = 1").Scan(&name)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "Hello", name)
+		})
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO names VALUES (3, 'Again')")
+	assert.ErrorIs(t, err, sqledge.ErrReadOnly)
+}
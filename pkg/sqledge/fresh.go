@@ -0,0 +1,157 @@
+package sqledge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// ErrStale is returned for reads when the local replica doesn't
+// catch up with the required position in time.
+var ErrStale = errors.New("sqledge: local replica is stale")
+
+const pollInterval = 20 * time.Millisecond
+
+type minLSNKey struct{}
+
+// WithMinLSN makes reads using the context wait until the local replica
+// has applied lsn, e.g. the upstream's pg_current_wal_lsn() after a write,
+// so the app reads its own writes.
+func WithMinLSN(ctx context.Context, lsn pglogrepl.LSN) context.Context {
+	return context.WithValue(ctx, minLSNKey{}, lsn)
+}
+
+// Position returns the upstream position applied to the local database, it
+// takes the sqledge local database, or a database opened with this driver.
+func Position(ctx context.Context, db *sql.DB) (pglogrepl.LSN, error) {
+	if _, ok := db.Driver().(*Driver); ok {
+		sc, err := db.Conn(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer sc.Close()
+
+		var lsn pglogrepl.LSN
+
+		err = sc.Raw(func(dc any) error {
+			lsn, err = dc.(*conn).c.position(ctx)
+			return err
+		})
+
+		return lsn, err
+	}
+
+	return localPosition(ctx, db)
+}
+
+// localPosition reads the furthest position recorded in postgres_pos.
+func localPosition(ctx context.Context, db *sql.DB) (pglogrepl.LSN, error) {
+	rows, err := db.QueryContext(ctx, "SELECT pos FROM postgres_pos")
+	if err != nil {
+		return 0, fmt.Errorf("read position: %w", err)
+	}
+	defer rows.Close()
+
+	var lsn pglogrepl.LSN
+
+	for rows.Next() {
+		var pos string
+		if err := rows.Scan(&pos); err != nil {
+			return 0, fmt.Errorf("read position: %w", err)
+		}
+
+		p, err := pglogrepl.ParseLSN(pos)
+		if err != nil {
+			return 0, fmt.Errorf("parse position %q: %w", pos, err)
+		}
+
+		lsn = max(lsn, p)
+	}
+
+	return lsn, rows.Err()
+}
+
+func (c *Connector) position(ctx context.Context) (pglogrepl.LSN, error) {
+	return localPosition(ctx, c.local)
+}
+
+// fresh waits until the local replica is fresh enough to read from; it has
+// applied the context's minimum position, and is within max_lag bytes of the
+// upstream.
+func (c *Connector) fresh(ctx context.Context) error {
+	minLSN, _ := ctx.Value(minLSNKey{}).(pglogrepl.LSN)
+
+	if c.maxLag > 0 {
+		serverLSN, err := c.lag.serverLSN(ctx, c.upstream, c.lagCheck)
+		if err != nil {
+			return err
+		}
+
+		if serverLSN > pglogrepl.LSN(c.maxLag) {
+			minLSN = max(minLSN, serverLSN-pglogrepl.LSN(c.maxLag))
+		}
+	}
+
+	if minLSN == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(c.wait)
+
+	for {
+		lsn, err := c.position(ctx)
+		if err != nil {
+			return err
+		}
+
+		if lsn >= minLSN {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: at %s, need %s", ErrStale, lsn, minLSN)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// lagCache holds the upstream's WAL position, so every read
+// doesn't make a round trip to the upstream.
+type lagCache struct {
+	mu        sync.Mutex
+	lsn       pglogrepl.LSN
+	checkedAt time.Time
+}
+
+func (l *lagCache) serverLSN(ctx context.Context, upstream *sql.DB, every time.Duration) (pglogrepl.LSN, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.checkedAt) < every {
+		return l.lsn, nil
+	}
+
+	var pos string
+	if err := upstream.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&pos); err != nil {
+		return 0, fmt.Errorf("sqledge: read upstream position: %w", err)
+	}
+
+	lsn, err := pglogrepl.ParseLSN(pos)
+	if err != nil {
+		return 0, fmt.Errorf("sqledge: parse upstream position %q: %w", pos, err)
+	}
+
+	l.lsn, l.checkedAt = lsn, time.Now()
+
+	return lsn, nil
+}
@@ -4,11 +4,23 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 type SqliteDriver struct {
 	db  *sql.DB
 	cfg SqliteConfig
+
+	// prepared are the statements of the bound row changes, by table
+	// and then by sql, so hot tables' changes are prepared once.
+	prepared map[string]map[string][]preparedStmt
+}
+
+// preparedStmt is one statement of a bound row change's sql, and the
+// number of its args it takes.
+type preparedStmt struct {
+	stmt   *sql.Stmt
+	params int
 }
 
 func NewSqliteDriver(cfg SqliteConfig, db *sql.DB) *SqliteDriver {
@@ -23,8 +35,141 @@ func (s *SqliteDriver) Execute(query string) error {
 	return err
 }
 
+// ExecuteStatement executes the statement with its args bound, using
+// the statements prepared for its table's changes with the same sql.
+func (s *SqliteDriver) ExecuteStatement(stmt Statement) error {
+	if stmt.Table == "" {
+		_, err := s.db.Exec(stmt.Query, stmt.Args...)
+		return err
+	}
+
+	prepared, err := s.prepare(stmt.Table, stmt.Query)
+	if err != nil {
+		return err
+	}
+
+	args := stmt.Args
+
+	for _, p := range prepared {
+		if p.params > len(args) {
+			return fmt.Errorf("statement of %s takes %d args, %d left", stmt.Table, p.params, len(args))
+		}
+
+		if _, err := p.stmt.Exec(args[:p.params]...); err != nil {
+			return err
+		}
+
+		args = args[p.params:]
+	}
+
+	return nil
+}
+
+// prepare returns the prepared statements of the query, preparing
+// them the first time the table's changes are applied with it.
+func (s *SqliteDriver) prepare(table, query string) ([]preparedStmt, error) {
+	if p, ok := s.prepared[table][query]; ok {
+		return p, nil
+	}
+
+	var out []preparedStmt
+
+	for _, q := range splitStatements(query) {
+		stmt, err := s.db.Prepare(q)
+		if err != nil {
+			closeStmts(out)
+			return nil, fmt.Errorf("prepare statement of %s: %w", table, err)
+		}
+
+		out = append(out, preparedStmt{stmt: stmt, params: strings.Count(q, "?")})
+	}
+
+	if s.prepared == nil {
+		s.prepared = make(map[string]map[string][]preparedStmt)
+	}
+
+	if s.prepared[table] == nil {
+		s.prepared[table] = make(map[string][]preparedStmt)
+	}
+
+	s.prepared[table][query] = out
+
+	return out, nil
+}
+
+// Invalidate closes the statements prepared for the table's changes,
+// once its schema has changed or it's been dropped.
+func (s *SqliteDriver) Invalidate(table string) {
+	for _, p := range s.prepared[table] {
+		closeStmts(p)
+	}
+
+	delete(s.prepared, table)
+}
+
+func closeStmts(stmts []preparedStmt) {
+	for _, p := range stmts {
+		p.stmt.Close()
+	}
+}
+
+// splitStatements splits the sql of a bound row change into its
+// statements. The values are bound, so the only quoted text in it
+// are identifiers.
+func splitStatements(query string) []string {
+	var (
+		out   []string
+		quote byte
+		start int
+	)
+
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == ';':
+			if q := strings.TrimSpace(query[start : i+1]); q != ";" {
+				out = append(out, q)
+			}
+
+			start = i + 1
+		}
+	}
+
+	if q := strings.TrimSpace(query[start:]); q != "" {
+		out = append(out, q)
+	}
+
+	return out
+}
+
 func (s *SqliteDriver) Pos() (string, error) {
-	query := `SELECT pos 
+	p, err := s.Positions()
+	return p.Streaming, err
+}
+
+// Positions are the positions recorded in postgres_pos,
+// empty when they haven't been recorded yet.
+type Positions struct {
+	// Snapshot is the consistent position of the snapshot the
+	// local database was copied or bootstrapped from.
+	Snapshot string
+	// Streaming is the position of the last committed transaction.
+	Streaming string
+	// Acked is the last position acknowledged to the upstream.
+	Acked string
+	// CommitTime is the upstream commit time of the transaction at the
+	// streaming position, in RFC 3339, see SqliteConfig.CommitTimes.
+	CommitTime string
+}
+
+// Positions reads the recorded positions.
+func (s *SqliteDriver) Positions() (Positions, error) {
+	query := `SELECT coalesce(pos, ''), coalesce(snapshot_lsn, ''), coalesce(acked_lsn, ''), coalesce(commit_time, '')
     FROM postgres_pos 
 	WHERE source_db = ? 
 	AND plugin = ?
@@ -32,17 +177,17 @@ func (s *SqliteDriver) Pos() (string, error) {
 
 	row := s.db.QueryRow(query, s.cfg.SourceDB, s.cfg.Plugin, s.cfg.Publication)
 
-	var pos string
+	var p Positions
 
-	if err := row.Scan(&pos); err != nil {
+	if err := row.Scan(&p.Streaming, &p.Snapshot, &p.Acked, &p.CommitTime); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", nil
+			return Positions{}, nil
 		}
 
-		return "", fmt.Errorf("read position: %w", err)
+		return Positions{}, fmt.Errorf("read position: %w", err)
 	}
 
-	return pos, nil
+	return p, nil
 }
 
 func (s *SqliteDriver) InitPositionTable() error {
@@ -51,15 +196,231 @@ func (s *SqliteDriver) InitPositionTable() error {
 		plugin text, 
 		publication text, 
 		pos text, 
+		snapshot_lsn text,
+		acked_lsn text,
+		commit_time text,
 		PRIMARY KEY (source_db, plugin, publication)
 	)`)
 	if err != nil {
 		return fmt.Errorf("create lsn table: %w", err)
 	}
 
+	// tables created before the snapshot and acked positions and
+	// the commit times were recorded are missing their columns.
+	return s.addMissingColumns("postgres_pos", "snapshot_lsn text", "acked_lsn text", "commit_time text")
+}
+
+// addMissingColumns adds the columns, each "name type", that the
+// table created by an earlier version doesn't have yet.
+func (s *SqliteDriver) addMissingColumns(table string, cols ...string) error {
+	rows, err := s.db.Query(`SELECT name FROM pragma_table_info(?);`, table)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", table, err)
+	}
+
+	existing := map[string]bool{}
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("read %s: %w", table, err)
+		}
+
+		existing[name] = true
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return fmt.Errorf("read %s: %w", table, err)
+	}
+
+	for _, col := range cols {
+		name, _, _ := strings.Cut(col, " ")
+		if existing[name] {
+			continue
+		}
+
+		if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", table, col)); err != nil {
+			return fmt.Errorf("add %s to %s: %w", name, table, err)
+		}
+	}
+
+	return nil
+}
+
+// InitPreparedTable creates the tables used to stage the changes of
+// prepared transactions until they're committed, or to undo them when
+// they're applied as soon as they're prepared.
+func (s *SqliteDriver) InitPreparedTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS postgres_prepared (
+		gid text,
+		seq integer,
+		query text,
+		PRIMARY KEY (gid, seq)
+	)`)
+	if err != nil {
+		return fmt.Errorf("create prepared table: %w", err)
+	}
+
+	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS postgres_prepared_undo (
+		id integer PRIMARY KEY,
+		gid text,
+		query text
+	)`)
+	if err != nil {
+		return fmt.Errorf("create prepared undo table: %w", err)
+	}
+
+	return nil
+}
+
+// InitPendingCopiesTable creates the table recording the tables added to
+// the publication that haven't been copied yet. They're recorded before
+// they're added, so they're still copied when sqledge stops before the
+// copy finishes, after which they're already published.
+func (s *SqliteDriver) InitPendingCopiesTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS postgres_pending_copies (
+		source_db text,
+		publication text,
+		table_name text,
+		PRIMARY KEY (source_db, publication, table_name)
+	)`)
+	if err != nil {
+		return fmt.Errorf("create pending copies table: %w", err)
+	}
+
+	return nil
+}
+
+// PendingCopies returns the tables waiting to be copied, in order.
+func (s *SqliteDriver) PendingCopies() ([]string, error) {
+	rows, err := s.db.Query(`SELECT table_name FROM postgres_pending_copies
+		WHERE source_db = ? AND publication = ? ORDER BY table_name;`, s.cfg.SourceDB, s.cfg.Publication)
+	if err != nil {
+		return nil, fmt.Errorf("query pending copies: %w", err)
+	}
+	defer rows.Close()
+
+	var out []string
+
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, fmt.Errorf("scan pending copies: %w", err)
+		}
+
+		out = append(out, table)
+	}
+
+	return out, rows.Err()
+}
+
+// AddPendingCopies records the tables as waiting to be copied.
+func (s *SqliteDriver) AddPendingCopies(tables []string) error {
+	for _, table := range tables {
+		if _, err := s.db.Exec(`INSERT OR IGNORE INTO postgres_pending_copies VALUES (?, ?, ?);`,
+			s.cfg.SourceDB, s.cfg.Publication, table); err != nil {
+			return fmt.Errorf("add pending copy of %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// RemovePendingCopies forgets the tables, once they're copied.
+func (s *SqliteDriver) RemovePendingCopies(tables []string) error {
+	for _, table := range tables {
+		if _, err := s.db.Exec(`DELETE FROM postgres_pending_copies WHERE source_db = ? AND publication = ? AND table_name = ?;`,
+			s.cfg.SourceDB, s.cfg.Publication, table); err != nil {
+			return fmt.Errorf("remove pending copy of %s: %w", table, err)
+		}
+	}
+
 	return nil
 }
 
+// InitProvenanceTable creates the table recording the source of the
+// last change to each row, see SqliteConfig.Provenance.
+func (s *SqliteDriver) InitProvenanceTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS postgres_provenance (
+		table_name text,
+		row_key text,
+		op text,
+		lsn text,
+		xid integer,
+		commit_time text,
+		origin text,
+		version integer,
+		PRIMARY KEY (table_name, row_key)
+	)`)
+	if err != nil {
+		return fmt.Errorf("create provenance table: %w", err)
+	}
+
+	return s.addMissingColumns("postgres_provenance", "origin text", "version integer")
+}
+
+// InitMessagesTable creates the table recording logical decoding
+// messages, see SqliteConfig.MessagePrefixes.
+func (s *SqliteDriver) InitMessagesTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS postgres_messages (
+		lsn text,
+		prefix text,
+		content text,
+		transactional integer
+	)`)
+	if err != nil {
+		return fmt.Errorf("create messages table: %w", err)
+	}
+
+	return nil
+}
+
+// PreparedQueries returns the staged queries for the prepared transaction, in order.
+func (s *SqliteDriver) PreparedQueries(gid string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT query FROM postgres_prepared WHERE gid = ? ORDER BY seq;`, gid)
+	if err != nil {
+		return nil, fmt.Errorf("query prepared: %w", err)
+	}
+	defer rows.Close()
+
+	var out []string
+
+	for rows.Next() {
+		var query string
+		if err := rows.Scan(&query); err != nil {
+			return nil, fmt.Errorf("scan prepared: %w", err)
+		}
+
+		out = append(out, query)
+	}
+
+	return out, rows.Err()
+}
+
+// PreparedUndo returns the queries undoing the changes of the prepared
+// transaction already applied, newest first.
+func (s *SqliteDriver) PreparedUndo(gid string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT query FROM postgres_prepared_undo WHERE gid = ? ORDER BY id DESC;`, gid)
+	if err != nil {
+		return nil, fmt.Errorf("query prepared undo: %w", err)
+	}
+	defer rows.Close()
+
+	var out []string
+
+	for rows.Next() {
+		var query string
+		if err := rows.Scan(&query); err != nil {
+			return nil, fmt.Errorf("scan prepared undo: %w", err)
+		}
+
+		out = append(out, query)
+	}
+
+	return out, rows.Err()
+}
+
 func (s *SqliteDriver) CurrentSchema() (map[string]map[string]ColDef, error) {
 	// tableName -> colName -> colDef
 	out := make(map[string]map[string]ColDef)
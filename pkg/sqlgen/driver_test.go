@@ -0,0 +1,420 @@
+package sqlgen_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPositions(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge"}
+	gen := sqlgen.NewSqlite(cfg, nil)
+
+	// a position table from before the snapshot and acked positions
+	for _, stmt := range []string{
+		"CREATE TABLE postgres_pos (source_db text, plugin text, publication text, pos text, PRIMARY KEY (source_db, plugin, publication));",
+		"INSERT INTO postgres_pos VALUES ('app', 'pgoutput', 'sqledge', '0/10');",
+	} {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	driver := sqlgen.NewSqliteDriver(cfg, db)
+	require.NoError(t, driver.InitPositionTable())
+
+	got, err := driver.Positions()
+	require.NoError(t, err)
+	assert.Equal(t, sqlgen.Positions{Streaming: "0/10"}, got)
+
+	for _, stmt := range []string{
+		gen.SnapshotPos("0/8"),
+		gen.Pos("0/20"),
+		gen.AckedPos("0/18"),
+	} {
+		require.NoError(t, driver.Execute(stmt))
+	}
+
+	got, err = driver.Positions()
+	require.NoError(t, err)
+	assert.Equal(t, sqlgen.Positions{Snapshot: "0/8", Streaming: "0/20", Acked: "0/18"}, got)
+
+	pos, err := driver.Pos()
+	require.NoError(t, err)
+	assert.Equal(t, "0/20", pos)
+}
+
+func TestPendingCopies(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	driver := sqlgen.NewSqliteDriver(sqlgen.SqliteConfig{SourceDB: "app", Publication: "sqledge"}, db)
+	require.NoError(t, driver.InitPendingCopiesTable())
+
+	require.NoError(t, driver.AddPendingCopies([]string{"orders", "customers"}))
+	// recorded again by a run that stopped before copying them
+	require.NoError(t, driver.AddPendingCopies([]string{"orders"}))
+
+	// another publication's
+	other := sqlgen.NewSqliteDriver(sqlgen.SqliteConfig{SourceDB: "app", Publication: "other"}, db)
+	require.NoError(t, other.AddPendingCopies([]string{"items"}))
+
+	pending, err := driver.PendingCopies()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"customers", "orders"}, pending)
+
+	require.NoError(t, driver.RemovePendingCopies([]string{"orders"}))
+
+	pending, err = driver.PendingCopies()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"customers"}, pending)
+}
+
+func TestProvenance(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge", Provenance: true}
+	gen := sqlgen.NewSqlite(cfg, map[string]map[string]sqlgen.ColDef{})
+
+	driver := sqlgen.NewSqliteDriver(cfg, db)
+	require.NoError(t, driver.InitPositionTable())
+	require.NoError(t, driver.InitProvenanceTable())
+
+	commitTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	update := &pglogrepl.UpdateMessageV2{
+		UpdateMessage: pglogrepl.UpdateMessage{
+			RelationID: 1,
+			NewTuple: &pglogrepl.TupleData{
+				Columns: []*pglogrepl.TupleDataColumn{
+					{DataType: 't', Data: []byte("1")},
+					{DataType: 't', Data: []byte("world")},
+				},
+			},
+		},
+	}
+
+	for _, step := range []func() (string, error){
+		func() (string, error) { return gen.Relation(namesRelation()) },
+		func() (string, error) {
+			return gen.Begin(&pglogrepl.BeginMessage{FinalLSN: 0x20, CommitTime: commitTime, Xid: 7})
+		},
+		func() (string, error) { return gen.Insert(namesInsert()) },
+		func() (string, error) { return gen.Commit(nil) },
+		func() (string, error) {
+			return gen.Begin(&pglogrepl.BeginMessage{FinalLSN: 0x40, CommitTime: commitTime.Add(time.Second), Xid: 8})
+		},
+		func() (string, error) { return gen.Origin(&pglogrepl.OriginMessage{Name: "pg_16390"}) },
+		func() (string, error) { return gen.Update(update) },
+		func() (string, error) { return gen.Commit(nil) },
+	} {
+		query, err := step()
+		require.NoError(t, err)
+		require.NoError(t, driver.Execute(query))
+	}
+
+	var table, key, op, lsn, at, origin string
+	var xid, version int
+
+	require.NoError(t, db.QueryRow("SELECT table_name, row_key, op, lsn, xid, commit_time, origin, version FROM postgres_provenance").
+		Scan(&table, &key, &op, &lsn, &xid, &at, &origin, &version))
+
+	assert.Equal(t, "names", table)
+	assert.Equal(t, `{"id":"1"}`, key)
+	assert.Equal(t, "update", op)
+	assert.Equal(t, "0/40", lsn)
+	assert.Equal(t, 8, xid)
+	assert.Equal(t, "2024-05-01T12:00:01Z", at)
+	// the update was replicated into the upstream from another node
+	assert.Equal(t, "pg_16390", origin)
+	assert.Equal(t, 2, version)
+}
+
+func TestBindMatchesText(t *testing.T) {
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge", Provenance: true}
+
+	update := &pglogrepl.UpdateMessageV2{
+		UpdateMessage: pglogrepl.UpdateMessage{
+			RelationID: 1,
+			NewTuple: &pglogrepl.TupleData{
+				Columns: []*pglogrepl.TupleDataColumn{
+					{DataType: 't', Data: []byte("1")},
+					{DataType: 't', Data: []byte("world")},
+				},
+			},
+		},
+	}
+
+	insert := &pglogrepl.InsertMessageV2{
+		InsertMessage: pglogrepl.InsertMessage{
+			RelationID: 1,
+			Tuple: &pglogrepl.TupleData{
+				Columns: []*pglogrepl.TupleDataColumn{
+					{DataType: 't', Data: []byte("2")},
+					{DataType: 'n'},
+				},
+			},
+		},
+	}
+
+	del := &pglogrepl.DeleteMessageV2{
+		DeleteMessage: pglogrepl.DeleteMessage{
+			RelationID: 1,
+			OldTuple: &pglogrepl.TupleData{
+				Columns: []*pglogrepl.TupleDataColumn{
+					{DataType: 't', Data: []byte("2")},
+					{DataType: 'n'},
+				},
+			},
+		},
+	}
+
+	// applies the changes, with their values bound or formatted into
+	// their sql, and returns the rows they left.
+	run := func(t *testing.T, bind bool) []string {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+
+		gen := sqlgen.NewSqlite(cfg, map[string]map[string]sqlgen.ColDef{})
+		driver := sqlgen.NewSqliteDriver(cfg, db)
+		require.NoError(t, driver.InitPositionTable())
+		require.NoError(t, driver.InitProvenanceTable())
+
+		exec := func(query string, err error) {
+			require.NoError(t, err)
+			require.NoError(t, driver.Execute(query))
+		}
+
+		execStmt := func(stmt sqlgen.Statement, err error) {
+			require.NoError(t, err)
+			require.NoError(t, driver.ExecuteStatement(stmt))
+		}
+
+		exec(gen.Relation(namesRelation()))
+		exec(gen.Begin(&pglogrepl.BeginMessage{FinalLSN: 0x20, CommitTime: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Xid: 7}))
+
+		if bind {
+			execStmt(gen.BindInsert(namesInsert()))
+			execStmt(gen.BindUpdate(update))
+			execStmt(gen.BindInsert(insert))
+			execStmt(gen.BindDelete(del))
+		} else {
+			exec(gen.Insert(namesInsert()))
+			exec(gen.Update(update))
+			exec(gen.Insert(insert))
+			exec(gen.Delete(del))
+		}
+
+		exec(gen.Commit(nil))
+
+		rows, err := db.Query(`SELECT id, typeof(id), quote(name) FROM names
+			UNION ALL SELECT table_name, row_key, op || lsn || xid || commit_time || coalesce(origin, '') || version FROM postgres_provenance`)
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var out []string
+
+		for rows.Next() {
+			var a, b, c string
+			require.NoError(t, rows.Scan(&a, &b, &c))
+			out = append(out, a+"|"+b+"|"+c)
+		}
+
+		require.NoError(t, rows.Err())
+
+		return out
+	}
+
+	text, bound := run(t, false), run(t, true)
+	assert.Equal(t, []string{"1|integer|'world'", `names|{"id":"1"}|update0/207` + "2024-05-01T12:00:00Z2", `names|{"id":"2"}|delete0/207` + "2024-05-01T12:00:00Z2"}, text)
+	assert.Equal(t, text, bound)
+}
+
+func TestPreparedStatements(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	cfg := sqlgen.SqliteConfig{Provenance: true}
+	gen := sqlgen.NewSqlite(cfg, map[string]map[string]sqlgen.ColDef{})
+	driver := sqlgen.NewSqliteDriver(cfg, db)
+	require.NoError(t, driver.InitProvenanceTable())
+
+	query, err := gen.Relation(namesRelation())
+	require.NoError(t, err)
+	require.NoError(t, driver.Execute(query))
+
+	insert := func(id string) {
+		stmt, err := gen.BindInsert(&pglogrepl.InsertMessageV2{
+			InsertMessage: pglogrepl.InsertMessage{
+				RelationID: 1,
+				Tuple: &pglogrepl.TupleData{
+					Columns: []*pglogrepl.TupleDataColumn{
+						{DataType: 't', Data: []byte(id)},
+						{DataType: 't', Data: []byte("name " + id)},
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "names", stmt.Table)
+		require.NoError(t, driver.ExecuteStatement(stmt))
+	}
+
+	// the second insert reuses the statements prepared for the first
+	insert("1")
+	insert("2")
+
+	// the table is recreated with the names column last, the
+	// statements prepared for the old table are dropped with it
+	require.NoError(t, driver.Execute("DROP TABLE names; CREATE TABLE names (id integer PRIMARY KEY, extra text, name text);"))
+	driver.Invalidate("names")
+
+	insert("3")
+
+	var names []string
+
+	rows, err := db.Query("SELECT name FROM names")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"name 3"}, names)
+}
+
+func TestPosCommitTime(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge", CommitTimes: true}
+	gen := sqlgen.NewSqlite(cfg, nil)
+
+	driver := sqlgen.NewSqliteDriver(cfg, db)
+	require.NoError(t, driver.InitPositionTable())
+
+	// positions recorded outside a transaction have no commit time
+	require.NoError(t, driver.Execute(gen.Pos("0/10")))
+
+	got, err := driver.Positions()
+	require.NoError(t, err)
+	assert.Equal(t, sqlgen.Positions{Streaming: "0/10"}, got)
+
+	_, err = gen.Begin(&pglogrepl.BeginMessage{FinalLSN: 0x20, CommitTime: time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)})
+	require.NoError(t, err)
+	require.NoError(t, driver.Execute(gen.Pos("0/20")))
+
+	got, err = driver.Positions()
+	require.NoError(t, err)
+	assert.Equal(t, sqlgen.Positions{Streaming: "0/20", CommitTime: "2024-05-01T12:00:00.0000005Z"}, got)
+}
+
+func TestPreparedRollback(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	cfg := sqlgen.SqliteConfig{Provenance: true, PreparedVisibility: sqlgen.PreparedVisibilityPrepared}
+	gen := sqlgen.NewSqlite(cfg, map[string]map[string]sqlgen.ColDef{})
+	driver := sqlgen.NewSqliteDriver(cfg, db)
+	require.NoError(t, driver.InitPositionTable())
+	require.NoError(t, driver.InitProvenanceTable())
+	require.NoError(t, driver.InitPreparedTable())
+
+	query, err := gen.Relation(namesRelation())
+	require.NoError(t, err)
+	require.NoError(t, driver.Execute(query))
+	require.NoError(t, driver.Execute("INSERT INTO names (id, name) VALUES (2, 'two'), (3, 'three'), (4, 'four');"))
+
+	tuple := func(id, name string) *pglogrepl.TupleData {
+		return &pglogrepl.TupleData{
+			Columns: []*pglogrepl.TupleDataColumn{
+				{DataType: 't', Data: []byte(id)},
+				{DataType: 't', Data: []byte(name)},
+			},
+		}
+	}
+
+	var queries []string
+
+	generate := func(query string, err error) {
+		require.NoError(t, err)
+		queries = append(queries, query)
+	}
+
+	generate(gen.BeginPrepare(&pgoutput.BeginPrepareMessage{Gid: "tx'1"}))
+	generate(gen.Insert(namesInsert()))
+	generate(gen.Update(&pglogrepl.UpdateMessageV2{
+		UpdateMessage: pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("2", "deux")},
+	}))
+	// the key changes too
+	generate(gen.Update(&pglogrepl.UpdateMessageV2{
+		UpdateMessage: pglogrepl.UpdateMessage{RelationID: 1, OldTupleType: 'K', OldTuple: tuple("3", ""), NewTuple: tuple("5", "trois")},
+	}))
+	generate(gen.Delete(&pglogrepl.DeleteMessageV2{
+		DeleteMessage: pglogrepl.DeleteMessage{RelationID: 1, OldTupleType: 'K', OldTuple: tuple("4", "")},
+	}))
+	generate(gen.Prepare(&pgoutput.PrepareMessage{Gid: "tx'1"}))
+
+	for _, query := range queries {
+		require.NoError(t, driver.Execute(query), query)
+	}
+
+	names := func() []string {
+		rows, err := db.Query("SELECT id || ' ' || name FROM names ORDER BY id")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var names []string
+
+		for rows.Next() {
+			var name string
+			require.NoError(t, rows.Scan(&name))
+			names = append(names, name)
+		}
+
+		require.NoError(t, rows.Err())
+
+		return names
+	}
+
+	// the prepared changes are visible
+	assert.Equal(t, []string{"1 hello", "2 deux", "5 trois"}, names())
+
+	undo, err := driver.PreparedUndo("tx'1")
+	require.NoError(t, err)
+	require.NotEmpty(t, undo)
+
+	query, err = gen.RollbackPrepared(&pgoutput.RollbackPreparedMessage{Gid: "tx'1"}, undo)
+	require.NoError(t, err)
+	require.NoError(t, driver.Execute(query))
+
+	assert.Equal(t, []string{"2 two", "3 three", "4 four"}, names())
+
+	var provenance, left int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM postgres_provenance").Scan(&provenance))
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM postgres_prepared_undo").Scan(&left))
+	assert.Zero(t, provenance)
+	assert.Zero(t, left)
+}
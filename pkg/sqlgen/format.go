@@ -0,0 +1,194 @@
+package sqlgen
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FormatVersion is the version of the local database's on-disk format,
+// the tables sqledge keeps its state in and how the replicated rows are
+// stored. It's bumped by changes an older binary would misread, with a
+// migration from the previous version in formatMigrations.
+const FormatVersion = 1
+
+// unstampedFormat is the format of local databases created before
+// they were stamped with one.
+const unstampedFormat = 1
+
+// ErrIncompatibleFormat is returned for local databases in a format
+// this binary can't use, e.g. one written by a newer release.
+var ErrIncompatibleFormat = errors.New("incompatible local database format")
+
+// formatMigrations upgrade a local database from the format version
+// they're keyed by to the next one, in the transaction.
+var formatMigrations = map[int]func(tx *sql.Tx) error{}
+
+// Format is the on-disk format a local database is stamped with.
+type Format struct {
+	Version int
+	// CreatedBy is the version of the sqledge binary that created the
+	// database, and WrittenBy of the last one that opened it to write.
+	CreatedBy string
+	WrittenBy string
+}
+
+// Format reads the format the local database is stamped with, it's
+// false when the database isn't stamped yet.
+func (s *SqliteDriver) Format() (Format, bool, error) {
+	if exists, err := s.tableExists("postgres_meta"); err != nil || !exists {
+		return Format{}, false, err
+	}
+
+	rows, err := s.db.Query(`SELECT key, value FROM postgres_meta;`)
+	if err != nil {
+		return Format{}, false, fmt.Errorf("read format: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		f       Format
+		stamped bool
+	)
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return Format{}, false, fmt.Errorf("read format: %w", err)
+		}
+
+		switch key {
+		case "format_version":
+			if f.Version, err = strconv.Atoi(value); err != nil {
+				return Format{}, false, fmt.Errorf("read format: version %q: %w", value, err)
+			}
+
+			stamped = true
+		case "created_by":
+			f.CreatedBy = value
+		case "written_by":
+			f.WrittenBy = value
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return Format{}, false, fmt.Errorf("read format: %w", err)
+	}
+
+	return f, stamped, nil
+}
+
+// CheckFormat checks that the local database's format is one this
+// binary, of version binary, can write, and stamps it with the binary.
+// Databases in an older format are migrated, those in a newer one, or
+// one without a migration, are refused with ErrIncompatibleFormat.
+func (s *SqliteDriver) CheckFormat(binary string) (Format, error) {
+	f, stamped, err := s.Format()
+	if err != nil {
+		return Format{}, err
+	}
+
+	if !stamped {
+		f = Format{Version: FormatVersion, CreatedBy: binary}
+
+		// a database with positions was created before the
+		// format was stamped, rather than just now
+		if existing, err := s.tableExists("postgres_pos"); err != nil {
+			return Format{}, err
+		} else if existing {
+			f = Format{Version: unstampedFormat, CreatedBy: "unknown"}
+		}
+	}
+
+	if f.Version > FormatVersion {
+		return Format{}, fmt.Errorf("%w: the local database is in format %d, written by sqledge %s, this binary writes format %d",
+			ErrIncompatibleFormat, f.Version, f.WrittenBy, FormatVersion)
+	}
+
+	if stamped && f.WrittenBy != binary {
+		log.Info().Msgf("local database in format %d was written by sqledge %s, opening it with %s", f.Version, f.WrittenBy, binary)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Format{}, fmt.Errorf("stamp format: %w", err)
+	}
+	defer tx.Rollback()
+
+	for ; f.Version < FormatVersion; f.Version++ {
+		migrate, ok := formatMigrations[f.Version]
+		if !ok {
+			return Format{}, fmt.Errorf("%w: no migration from format %d to %d", ErrIncompatibleFormat, f.Version, f.Version+1)
+		}
+
+		if err := migrate(tx); err != nil {
+			return Format{}, fmt.Errorf("migrate format %d to %d: %w", f.Version, f.Version+1, err)
+		}
+
+		log.Info().Msgf("migrated the local database from format %d to %d", f.Version, f.Version+1)
+	}
+
+	f.WrittenBy = binary
+
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS postgres_meta (key text PRIMARY KEY, value text)`); err != nil {
+		return Format{}, fmt.Errorf("create meta table: %w", err)
+	}
+
+	for key, value := range map[string]string{
+		"format_version": strconv.Itoa(f.Version),
+		"created_by":     f.CreatedBy,
+		"written_by":     f.WrittenBy,
+	} {
+		if _, err := tx.Exec(`INSERT INTO postgres_meta (key, value) VALUES (?, ?)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value;`, key, value); err != nil {
+			return Format{}, fmt.Errorf("stamp format: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Format{}, fmt.Errorf("stamp format: %w", err)
+	}
+
+	return f, nil
+}
+
+// Meta reads the value of the key in the postgres_meta table CheckFormat
+// creates, it's empty when the key isn't set.
+func (s *SqliteDriver) Meta(key string) (string, error) {
+	if exists, err := s.tableExists("postgres_meta"); err != nil || !exists {
+		return "", err
+	}
+
+	var value string
+
+	err := s.db.QueryRow(`SELECT value FROM postgres_meta WHERE key = ?;`, key).Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("read %s: %w", key, err)
+	}
+
+	return value, nil
+}
+
+// SetMeta sets the key to the value in the postgres_meta table.
+func (s *SqliteDriver) SetMeta(key, value string) error {
+	_, err := s.db.Exec(`INSERT INTO postgres_meta (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value;`, key, value)
+	if err != nil {
+		return fmt.Errorf("set %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *SqliteDriver) tableExists(table string) (bool, error) {
+	var n int
+
+	if err := s.db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, table).Scan(&n); err != nil {
+		return false, fmt.Errorf("read %s: %w", table, err)
+	}
+
+	return n > 0, nil
+}
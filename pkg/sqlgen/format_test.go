@@ -0,0 +1,62 @@
+package sqlgen_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFormat(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	driver := sqlgen.NewSqliteDriver(sqlgen.SqliteConfig{}, db)
+
+	_, stamped, err := driver.Format()
+	require.NoError(t, err)
+	assert.False(t, stamped)
+
+	f, err := driver.CheckFormat("v1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, sqlgen.Format{Version: sqlgen.FormatVersion, CreatedBy: "v1.0.0", WrittenBy: "v1.0.0"}, f)
+
+	// an upgraded binary keeps the creator
+	f, err = driver.CheckFormat("v1.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, sqlgen.Format{Version: sqlgen.FormatVersion, CreatedBy: "v1.0.0", WrittenBy: "v1.1.0"}, f)
+
+	got, stamped, err := driver.Format()
+	require.NoError(t, err)
+	assert.True(t, stamped)
+	assert.Equal(t, f, got)
+
+	// a newer release wrote a format this binary doesn't know
+	_, err = db.Exec(`UPDATE postgres_meta SET value = ? WHERE key = 'format_version';`, sqlgen.FormatVersion+1)
+	require.NoError(t, err)
+
+	_, err = driver.CheckFormat("v1.0.0")
+	assert.ErrorIs(t, err, sqlgen.ErrIncompatibleFormat)
+
+	got, _, err = driver.Format()
+	require.NoError(t, err)
+	assert.Equal(t, "v1.1.0", got.WrittenBy)
+}
+
+func TestCheckFormatUnstamped(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "local.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	driver := sqlgen.NewSqliteDriver(sqlgen.SqliteConfig{}, db)
+	require.NoError(t, driver.InitPositionTable())
+
+	// created by a release from before the format was stamped
+	f, err := driver.CheckFormat("v1.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, sqlgen.Format{Version: sqlgen.FormatVersion, CreatedBy: "unknown", WrittenBy: "v1.1.0"}, f)
+}
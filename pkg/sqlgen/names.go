@@ -0,0 +1,94 @@
+package sqlgen
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxIdentifierLength is the longest identifier postgres keeps, in bytes.
+// Longer identifiers are truncated, so upstream names never exceed it.
+const MaxIdentifierLength = 63
+
+// ErrNameCollision is returned for upstream tables or columns whose local
+// names collide. SQLite compares names case-insensitively, local tables
+// aren't qualified by their schema, and some table names are sqledge's.
+var ErrNameCollision = errors.New("local name collision")
+
+// NodeTables are the local tables tracking the node's own replication
+// rather than its rows, they're left out of the copies of the database
+// for a new node or a tenant.
+var NodeTables = []string{"postgres_pos", "postgres_prepared", "postgres_prepared_undo", "postgres_meta", "postgres_pending_copies", "postgres_tenant_pos"}
+
+// InternalTables are the local tables sqledge keeps its own state in:
+// the NodeTables, and the provenance and messages of the rows.
+var InternalTables = append([]string{"postgres_provenance", "postgres_messages"}, NodeTables...)
+
+// Internal reports whether the local table is one of the InternalTables.
+func Internal(table string) bool {
+	return slices.Contains(InternalTables, table)
+}
+
+// TruncateIdentifier truncates the identifier as postgres does, to at
+// most MaxIdentifierLength bytes without splitting a character.
+func TruncateIdentifier(name string) string {
+	if len(name) <= MaxIdentifierLength {
+		return name
+	}
+
+	n := MaxIdentifierLength
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+
+	return name[:n]
+}
+
+// QuoteIdentifier quotes the name as an identifier for sqlite and postgres.
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// claimTable records the upstream table as the owner of its local table,
+// returning an error when another upstream table already owns it.
+func (s *Sqlite) claimTable(schema, table string) error {
+	local := strings.ToLower(table)
+
+	if Internal(local) {
+		return fmt.Errorf("%w: table %s.%s has the name of a table sqledge keeps its state in", ErrNameCollision, schema, table)
+	}
+
+	if s.owners == nil {
+		s.owners = make(map[string]string)
+	}
+
+	upstream := schema + "." + table
+
+	if owner, ok := s.owners[local]; ok && owner != upstream {
+		return fmt.Errorf("%w: tables %s and %s are both %s locally", ErrNameCollision, owner, upstream, local)
+	}
+
+	s.owners[local] = upstream
+
+	return nil
+}
+
+// checkColumns returns an error when two of the table's columns have
+// the same local name.
+func checkColumns(table string, columns []string) error {
+	seen := make(map[string]string, len(columns))
+
+	for _, col := range columns {
+		local := strings.ToLower(col)
+
+		if other, ok := seen[local]; ok {
+			return fmt.Errorf("%w: columns %q and %q of %s are both %s locally", ErrNameCollision, other, col, table, local)
+		}
+
+		seen[local] = col
+	}
+
+	return nil
+}
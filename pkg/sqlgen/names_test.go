@@ -0,0 +1,89 @@
+package sqlgen_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateIdentifier(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "names", want: "names"},
+		{name: strings.Repeat("a", 70), want: strings.Repeat("a", 63)},
+		// the 2 byte é doesn't fit whole in 63 bytes
+		{name: strings.Repeat("a", 62) + "éb", want: strings.Repeat("a", 62)},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, sqlgen.TruncateIdentifier(test.name))
+	}
+}
+
+func TestNameCollisions(t *testing.T) {
+	relation := func(id uint32, schema, table string, columns ...string) *pglogrepl.RelationMessageV2 {
+		rel := &pglogrepl.RelationMessageV2{
+			RelationMessage: pglogrepl.RelationMessage{RelationID: id, Namespace: schema, RelationName: table},
+		}
+
+		for _, col := range columns {
+			rel.Columns = append(rel.Columns, &pglogrepl.RelationMessageColumn{Name: col, DataType: 25})
+		}
+
+		return rel
+	}
+
+	tests := []struct {
+		name      string
+		relations []*pglogrepl.RelationMessageV2
+		err       bool
+	}{
+		{
+			name:      "same table again",
+			relations: []*pglogrepl.RelationMessageV2{relation(1, "public", "names", "id"), relation(1, "public", "names", "id", "name")},
+		},
+		{
+			name:      "other schema",
+			relations: []*pglogrepl.RelationMessageV2{relation(1, "public", "names", "id"), relation(2, "archive", "names", "id")},
+			err:       true,
+		},
+		{
+			name:      "case only",
+			relations: []*pglogrepl.RelationMessageV2{relation(1, "public", "names", "id"), relation(2, "public", "Names", "id")},
+			err:       true,
+		},
+		{
+			name:      "columns",
+			relations: []*pglogrepl.RelationMessageV2{relation(1, "public", "names", "id", "ID")},
+			err:       true,
+		},
+		{
+			name:      "reserved",
+			relations: []*pglogrepl.RelationMessageV2{relation(1, "public", "postgres_pos", "id")},
+			err:       true,
+		},
+	}
+
+	for _, test := range tests {
+		gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+		var err error
+
+		for _, rel := range test.relations {
+			if _, err = gen.Relation(rel); err != nil {
+				break
+			}
+		}
+
+		if test.err {
+			assert.ErrorIs(t, err, sqlgen.ErrNameCollision, test.name)
+		} else {
+			assert.NoError(t, err, test.name)
+		}
+	}
+}
@@ -36,18 +36,20 @@ type ColType string
 
 const (
 	// TODO: this is not all the types, missing: datetime, etc
-	PgColTypeText      ColType = "text"
-	PgColTypeInt2      ColType = "int2"
-	PgColTypeInt4      ColType = "int4"
-	PgColTypeInt8      ColType = "int8"
-	PgColTypeNum       ColType = "numeric"
-	PgColTypeFloat4    ColType = "float4"
-	PgColTypeFloat8    ColType = "float8"
-	PgColTypeBytea     ColType = "bytea"
-	PgColTypeJson      ColType = "json"
-	PgColTypeJsonB     ColType = "jsonb"
-	PgColTypeBool      ColType = "bool"
-	PgColTypeTimestamp ColType = "timestamp"
+	PgColTypeText        ColType = "text"
+	PgColTypeInt2        ColType = "int2"
+	PgColTypeInt4        ColType = "int4"
+	PgColTypeInt8        ColType = "int8"
+	PgColTypeNum         ColType = "numeric"
+	PgColTypeFloat4      ColType = "float4"
+	PgColTypeFloat8      ColType = "float8"
+	PgColTypeBytea       ColType = "bytea"
+	PgColTypeJson        ColType = "json"
+	PgColTypeJsonB       ColType = "jsonb"
+	PgColTypeBool        ColType = "bool"
+	PgColTypeTimestamp   ColType = "timestamp"
+	PgColTypeTimestamptz ColType = "timestamptz"
+	PgColTypeInterval    ColType = "interval"
 
 	SQLiteColTypeInteger ColType = "integer"
 	SQLiteColTypeReal    ColType = "real"
@@ -65,6 +67,12 @@ func (c ColType) PgType() (oid, size int) {
 		return 700, 4
 	case SQLiteColTypeBlob:
 		return 17, -1
+	case PgColTypeInterval:
+		return 1186, 16
+	}
+
+	if rt, ok := rangeTypes[c]; ok {
+		return int(rt.oid), -1
 	}
 
 	return -1, -1
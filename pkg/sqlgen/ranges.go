@@ -0,0 +1,544 @@
+package sqlgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// rangeType is a range or multirange type, stored as JSON.
+type rangeType struct {
+	oid uint32
+	// numeric bounds are stored as JSON numbers, others as strings.
+	numeric bool
+	multi   bool
+}
+
+var rangeTypes = map[ColType]rangeType{
+	"int4range":      {oid: pgtype.Int4rangeOID, numeric: true},
+	"int8range":      {oid: pgtype.Int8rangeOID, numeric: true},
+	"numrange":       {oid: pgtype.NumrangeOID, numeric: true},
+	"daterange":      {oid: pgtype.DaterangeOID},
+	"tsrange":        {oid: pgtype.TsrangeOID},
+	"tstzrange":      {oid: pgtype.TstzrangeOID},
+	"int4multirange": {oid: pgtype.Int4multirangeOID, numeric: true, multi: true},
+	"int8multirange": {oid: pgtype.Int8multirangeOID, numeric: true, multi: true},
+	"nummultirange":  {oid: pgtype.NummultirangeOID, numeric: true, multi: true},
+	"datemultirange": {oid: pgtype.DatemultirangeOID, multi: true},
+	"tsmultirange":   {oid: pgtype.TsmultirangeOID, multi: true},
+	"tstzmultirange": {oid: pgtype.TstzmultirangeOID, multi: true},
+}
+
+// Structured reports whether the type is interval, a range or a
+// multirange, which are stored in a format of their own rather than
+// postgres' text format. Their local columns are declared with the
+// postgres type, so the proxy sends them with its OID.
+func (c ColType) Structured() bool {
+	_, ok := rangeTypes[c]
+	return ok || c == PgColTypeInterval
+}
+
+// structured returns the text of an interval, range or multirange
+// column's value as it's stored locally, from postgres' text format:
+// intervals as ISO 8601 durations, e.g. "P1Y2M3DT4H5M6.5S", ranges as
+// JSON objects of their bounds, e.g. {"lower":1,"upper":5,"lower_inc":true,
+// "upper_inc":false} or {"empty":true}, and multiranges as JSON arrays of
+// them. Other values, and those that can't be parsed, are returned
+// unchanged.
+func (s *Sqlite) structured(t ColType, text string) string {
+	if t == PgColTypeInterval {
+		var iv pgtype.Interval
+		if err := s.typeMap.Scan(pgtype.IntervalOID, pgtype.TextFormatCode, []byte(text), &iv); err != nil || !iv.Valid {
+			return text
+		}
+
+		return isoInterval(iv)
+	}
+
+	rt, ok := rangeTypes[t]
+	if !ok {
+		return text
+	}
+
+	if !rt.multi {
+		r, ok := parseRange(text)
+		if !ok {
+			return text
+		}
+
+		return string(r.json(rt.numeric))
+	}
+
+	ranges, ok := parseMultirange(text)
+	if !ok {
+		return text
+	}
+
+	out := make([]json.RawMessage, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.json(rt.numeric)
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return text
+	}
+
+	return string(b)
+}
+
+// PostgresText returns postgres' text format of an interval, range or
+// multirange value stored in a local column of the type, for sending it
+// with the type's OID. Other values, and those stored in postgres' format
+// before their columns were typed, are returned unchanged.
+func PostgresText(t ColType, stored string) string {
+	if t == PgColTypeInterval {
+		iv, ok := parseISOInterval(stored)
+		if !ok {
+			return stored
+		}
+
+		return postgresInterval(iv)
+	}
+
+	rt, ok := rangeTypes[t]
+	if !ok {
+		return stored
+	}
+
+	if !rt.multi {
+		r, ok := jsonRange(json.RawMessage(stored))
+		if !ok {
+			return stored
+		}
+
+		return r.String()
+	}
+
+	var raws []json.RawMessage
+	if err := json.Unmarshal([]byte(stored), &raws); err != nil {
+		return stored
+	}
+
+	texts := make([]string, len(raws))
+
+	for i, raw := range raws {
+		r, ok := jsonRange(raw)
+		if !ok {
+			return stored
+		}
+
+		texts[i] = r.String()
+	}
+
+	return "{" + strings.Join(texts, ",") + "}"
+}
+
+// isoInterval formats the interval as an ISO 8601 duration, the same as
+// postgres' iso_8601 IntervalStyle.
+func isoInterval(iv pgtype.Interval) string {
+	years, months := iv.Months/12, iv.Months%12
+	hours, minutes, seconds, micros := splitMicroseconds(iv.Microseconds)
+
+	if iv.Months == 0 && iv.Days == 0 && iv.Microseconds == 0 {
+		return "PT0S"
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("P")
+
+	for _, part := range []struct {
+		v    int64
+		unit string
+	}{{int64(years), "Y"}, {int64(months), "M"}, {int64(iv.Days), "D"}} {
+		if part.v != 0 {
+			fmt.Fprintf(b, "%d%s", part.v, part.unit)
+		}
+	}
+
+	if iv.Microseconds == 0 {
+		return b.String()
+	}
+
+	b.WriteString("T")
+
+	if hours != 0 {
+		fmt.Fprintf(b, "%dH", hours)
+	}
+
+	if minutes != 0 {
+		fmt.Fprintf(b, "%dM", minutes)
+	}
+
+	if seconds != 0 || micros != 0 {
+		if seconds < 0 || micros < 0 {
+			b.WriteString("-")
+		}
+
+		fmt.Fprintf(b, "%d%sS", abs(seconds), fraction(micros))
+	}
+
+	return b.String()
+}
+
+var isoIntervalPattern = regexp.MustCompile(`^P(?:(-?\d+)Y)?(?:(-?\d+)M)?(?:(-?\d+)D)?(?:T(?:(-?\d+)H)?(?:(-?\d+)M)?(?:(-?\d+(?:\.\d{1,6})?)S)?)?$`)
+
+// parseISOInterval parses an ISO 8601 duration formatted by isoInterval.
+func parseISOInterval(text string) (pgtype.Interval, bool) {
+	m := isoIntervalPattern.FindStringSubmatch(text)
+	if m == nil || text == "P" || strings.HasSuffix(text, "T") {
+		return pgtype.Interval{}, false
+	}
+
+	n := make([]int64, 5)
+	for i := range n {
+		if m[i+1] != "" {
+			n[i], _ = strconv.ParseInt(m[i+1], 10, 64)
+		}
+	}
+
+	var micros int64
+
+	if sec := m[6]; sec != "" {
+		whole, frac, _ := strings.Cut(sec, ".")
+		w, _ := strconv.ParseInt(whole, 10, 64)
+		f, _ := strconv.ParseInt((frac + "000000")[:6], 10, 64)
+
+		if strings.HasPrefix(whole, "-") {
+			f = -f
+		}
+
+		micros = w*1e6 + f
+	}
+
+	return pgtype.Interval{
+		Months:       int32(n[0]*12 + n[1]),
+		Days:         int32(n[2]),
+		Microseconds: n[3]*3600e6 + n[4]*60e6 + micros,
+		Valid:        true,
+	}, true
+}
+
+// postgresInterval formats the interval as postgres' default IntervalStyle
+// does, e.g. "1 year 2 mons -3 days +04:05:06.5".
+func postgresInterval(iv pgtype.Interval) string {
+	var parts []string
+
+	// a positive part after a negative one is signed
+	negative := false
+
+	for _, part := range []struct {
+		v    int64
+		unit string
+	}{{int64(iv.Months / 12), "year"}, {int64(iv.Months % 12), "mon"}, {int64(iv.Days), "day"}} {
+		if part.v == 0 {
+			continue
+		}
+
+		sign, plural := "", "s"
+		if negative && part.v > 0 {
+			sign = "+"
+		}
+
+		if part.v == 1 {
+			plural = ""
+		}
+
+		parts = append(parts, fmt.Sprintf("%s%d %s%s", sign, part.v, part.unit, plural))
+		negative = part.v < 0
+	}
+
+	if len(parts) == 0 || iv.Microseconds != 0 {
+		hours, minutes, seconds, micros := splitMicroseconds(iv.Microseconds)
+
+		sign := ""
+		if iv.Microseconds < 0 {
+			sign = "-"
+		} else if negative {
+			sign = "+"
+		}
+
+		parts = append(parts, fmt.Sprintf("%s%02d:%02d:%02d%s", sign, abs(hours), abs(minutes), abs(seconds), fraction(micros)))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func splitMicroseconds(us int64) (hours, minutes, seconds, micros int64) {
+	return us / 3600e6, us % 3600e6 / 60e6, us % 60e6 / 1e6, us % 1e6
+}
+
+// fraction formats the microseconds as a fraction of a second, without
+// trailing zeros, or "" without any.
+func fraction(micros int64) string {
+	if micros == 0 {
+		return ""
+	}
+
+	return strings.TrimRight(fmt.Sprintf(".%06d", abs(micros)), "0")
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+
+	return v
+}
+
+// bounds are the bounds of a range, as the text of their values.
+type bounds struct {
+	empty              bool
+	lower, upper       *string
+	lowerInc, upperInc bool
+}
+
+// parseRange parses the text format of a range, e.g. "[1,5)" or
+// `["2024-01-01 00:00:00","2024-02-01 00:00:00")`.
+func parseRange(text string) (bounds, bool) {
+	if strings.EqualFold(text, "empty") {
+		return bounds{empty: true}, true
+	}
+
+	if len(text) < 3 {
+		return bounds{}, false
+	}
+
+	first, last := text[0], text[len(text)-1]
+	if (first != '[' && first != '(') || (last != ']' && last != ')') {
+		return bounds{}, false
+	}
+
+	inner := text[1 : len(text)-1]
+
+	lower, n := rangeBound(inner)
+	if n == len(inner) {
+		return bounds{}, false
+	}
+
+	upper, m := rangeBound(inner[n+1:])
+	if n+1+m != len(inner) {
+		return bounds{}, false
+	}
+
+	return bounds{lower: lower, upper: upper, lowerInc: first == '[', upperInc: last == ']'}, true
+}
+
+// rangeBound reads the bound at the start of a range's text, up to the
+// comma after it, returning it, or nil when it's unbounded, and where it
+// ends.
+func rangeBound(text string) (*string, int) {
+	b := &strings.Builder{}
+	quoted, inQuotes := false, false
+
+	i := 0
+	for ; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case c == '\\' && i+1 < len(text):
+			i++
+			b.WriteByte(text[i])
+		case c == '"' && inQuotes && i+1 < len(text) && text[i+1] == '"':
+			i++
+			b.WriteByte('"')
+		case c == '"':
+			quoted, inQuotes = true, !inQuotes
+		case c == ',' && !inQuotes:
+			return boundValue(b.String(), quoted), i
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return boundValue(b.String(), quoted), i
+}
+
+func boundValue(v string, quoted bool) *string {
+	if v == "" && !quoted {
+		return nil
+	}
+
+	return &v
+}
+
+// parseMultirange parses the text format of a multirange, e.g.
+// "{[1,3),[5,7)}".
+func parseMultirange(text string) ([]bounds, bool) {
+	if len(text) < 2 || text[0] != '{' || text[len(text)-1] != '}' {
+		return nil, false
+	}
+
+	inner := text[1 : len(text)-1]
+	out := []bounds{}
+
+	for len(inner) > 0 {
+		end, inQuotes := -1, false
+
+		for i := 0; i < len(inner) && end < 0; i++ {
+			switch c := inner[i]; {
+			case c == '\\':
+				i++
+			case c == '"':
+				inQuotes = !inQuotes
+			case (c == ']' || c == ')') && !inQuotes:
+				end = i
+			}
+		}
+
+		if end < 0 {
+			return nil, false
+		}
+
+		r, ok := parseRange(strings.TrimSpace(inner[:end+1]))
+		if !ok {
+			return nil, false
+		}
+
+		out = append(out, r)
+		inner = strings.TrimPrefix(strings.TrimSpace(inner[end+1:]), ",")
+	}
+
+	return out, true
+}
+
+// storedRange is the JSON a range is stored as.
+type storedRange struct {
+	Empty    bool            `json:"empty,omitempty"`
+	Lower    json.RawMessage `json:"lower,omitempty"`
+	Upper    json.RawMessage `json:"upper,omitempty"`
+	LowerInc bool            `json:"lower_inc"`
+	UpperInc bool            `json:"upper_inc"`
+}
+
+func (r bounds) json(numeric bool) json.RawMessage {
+	if r.empty {
+		return json.RawMessage(`{"empty":true}`)
+	}
+
+	b, _ := json.Marshal(storedRange{
+		Lower:    boundJSON(r.lower, numeric),
+		Upper:    boundJSON(r.upper, numeric),
+		LowerInc: r.lowerInc,
+		UpperInc: r.upperInc,
+	})
+
+	return b
+}
+
+func boundJSON(v *string, numeric bool) json.RawMessage {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+
+	if numeric && *v != "" && (*v)[0] != '"' && json.Valid([]byte(*v)) {
+		return json.RawMessage(*v)
+	}
+
+	b, _ := json.Marshal(*v)
+
+	return b
+}
+
+// jsonRange parses a range stored as JSON.
+func jsonRange(raw json.RawMessage) (bounds, bool) {
+	var sr storedRange
+	if err := json.Unmarshal(raw, &sr); err != nil {
+		return bounds{}, false
+	}
+
+	if sr.Empty {
+		return bounds{empty: true}, true
+	}
+
+	if sr.Lower == nil || sr.Upper == nil {
+		return bounds{}, false
+	}
+
+	lower, ok := jsonBound(sr.Lower)
+	if !ok {
+		return bounds{}, false
+	}
+
+	upper, ok := jsonBound(sr.Upper)
+	if !ok {
+		return bounds{}, false
+	}
+
+	return bounds{lower: lower, upper: upper, lowerInc: sr.LowerInc, upperInc: sr.UpperInc}, true
+}
+
+func jsonBound(raw json.RawMessage) (*string, bool) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, false
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return &v, true
+	case float64:
+		text := string(raw)
+		return &text, true
+	}
+
+	return nil, false
+}
+
+// String formats the range as postgres' text format.
+func (r bounds) String() string {
+	if r.empty {
+		return "empty"
+	}
+
+	b := &strings.Builder{}
+
+	if r.lowerInc {
+		b.WriteByte('[')
+	} else {
+		b.WriteByte('(')
+	}
+
+	writeBound(b, r.lower)
+	b.WriteByte(',')
+	writeBound(b, r.upper)
+
+	if r.upperInc {
+		b.WriteByte(']')
+	} else {
+		b.WriteByte(')')
+	}
+
+	return b.String()
+}
+
+// writeBound writes the bound, quoted as postgres quotes them when it's
+// empty or has characters in it that are special in a range.
+func writeBound(b *strings.Builder, v *string) {
+	if v == nil {
+		return
+	}
+
+	if *v != "" && !strings.ContainsAny(*v, "\"\\()[],{} \t\n\r") {
+		b.WriteString(*v)
+		return
+	}
+
+	b.WriteByte('"')
+
+	for i := 0; i < len(*v); i++ {
+		if c := (*v)[i]; c == '"' || c == '\\' {
+			b.WriteByte(c)
+		}
+
+		b.WriteByte((*v)[i])
+	}
+
+	b.WriteByte('"')
+}
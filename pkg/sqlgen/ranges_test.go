@@ -0,0 +1,90 @@
+package sqlgen_test
+
+import (
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStructuredTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		oid    uint32
+		typ    sqlgen.ColType
+		text   string
+		stored string
+	}{
+		{name: "interval", oid: 1186, typ: "interval", text: "1 year 2 mons 3 days 04:05:06.5", stored: "P1Y2M3DT4H5M6.5S"},
+		{name: "negative interval", oid: 1186, typ: "interval", text: "-3 days +04:05:06", stored: "P-3DT4H5M6S"},
+		{name: "negative time", oid: 1186, typ: "interval", text: "-00:00:00.25", stored: "PT-0.25S"},
+		{name: "zero interval", oid: 1186, typ: "interval", text: "00:00:00", stored: "PT0S"},
+		{
+			name:   "int4range",
+			oid:    3904,
+			typ:    "int4range",
+			text:   "[1,5)",
+			stored: `{"lower":1,"upper":5,"lower_inc":true,"upper_inc":false}`,
+		},
+		{
+			name:   "unbounded tsrange",
+			oid:    3908,
+			typ:    "tsrange",
+			text:   `["2024-05-01 12:00:00",)`,
+			stored: `{"lower":"2024-05-01 12:00:00","upper":null,"lower_inc":true,"upper_inc":false}`,
+		},
+		{name: "empty range", oid: 3904, typ: "int4range", text: "empty", stored: `{"empty":true}`},
+		{
+			name: "multirange",
+			oid:  4451,
+			typ:  "int4multirange",
+			text: "{[1,3),[5,7)}",
+			stored: `[{"lower":1,"upper":3,"lower_inc":true,"upper_inc":false},` +
+				`{"lower":5,"upper":7,"lower_inc":true,"upper_inc":false}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+			create, err := gen.Relation(&pglogrepl.RelationMessageV2{
+				RelationMessage: pglogrepl.RelationMessage{
+					RelationID:   1,
+					Namespace:    "public",
+					RelationName: "things",
+					Columns: []*pglogrepl.RelationMessageColumn{
+						{Flags: 1, Name: "id", DataType: 23},
+						{Name: "v", DataType: test.oid},
+					},
+				},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "CREATE TABLE IF NOT EXISTS things (id integer, v "+string(test.typ)+", PRIMARY KEY (id) );", create)
+
+			got, err := gen.Insert(&pglogrepl.InsertMessageV2{
+				InsertMessage: pglogrepl.InsertMessage{
+					RelationID: 1,
+					Tuple: &pglogrepl.TupleData{
+						Columns: []*pglogrepl.TupleDataColumn{
+							{DataType: 't', Data: []byte("1")},
+							{DataType: 't', Data: []byte(test.text)},
+						},
+					},
+				},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "INSERT INTO things (id, v) VALUES ('1', '"+test.stored+"');", got)
+
+			assert.Equal(t, test.text, sqlgen.PostgresText(test.typ, test.stored))
+		})
+	}
+}
+
+func TestPostgresTextUnstructured(t *testing.T) {
+	// values stored in postgres' format before their columns were typed
+	assert.Equal(t, "1 day", sqlgen.PostgresText("interval", "1 day"))
+	assert.Equal(t, "[1,5)", sqlgen.PostgresText("int4range", "[1,5)"))
+	assert.Equal(t, "hello", sqlgen.PostgresText("text", "hello"))
+}
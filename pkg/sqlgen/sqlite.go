@@ -2,18 +2,150 @@ package sqlgen
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
 	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// PreparedVisibilityNever stages the changes of prepared transactions,
+	// and only applies them on COMMIT PREPARED.
+	PreparedVisibilityNever = "never"
+	// PreparedVisibilityPrepared applies the changes of prepared transactions
+	// as soon as they're prepared, recording how to undo them in case they're
+	// rolled back with ROLLBACK PREPARED.
+	PreparedVisibilityPrepared = "prepared"
+)
+
+const (
+	// DeliveryExactlyOnce commits the streaming position with the changes
+	// of each transaction, so a transaction is never applied twice.
+	DeliveryExactlyOnce = "exactly-once"
+	// DeliveryAtLeastOnce records the position between transactions every
+	// so often instead, saving a write per transaction. The transactions
+	// since are applied again after a crash, so inserts replace existing
+	// rows to keep that idempotent.
+	DeliveryAtLeastOnce = "at-least-once"
+)
+
+var (
+	// ErrUnknownRelation is returned for changes to a relation
+	// that no relation message described.
+	ErrUnknownRelation = errors.New("unknown relation")
+	// ErrUnknownType is returned for columns of a type that
+	// isn't known.
+	ErrUnknownType = errors.New("unknown type")
+	// ErrNoKey is returned for updates and deletes of a table
+	// without key columns, when the old row wasn't sent either.
+	ErrNoKey = errors.New("no key to match the row by")
 )
 
 type SqliteConfig struct {
 	SourceDB    string
 	Plugin      string
 	Publication string
+	// Publish is the list of operations the publication publishes,
+	// when empty all operations are assumed to be published.
+	Publish []string
+	// PreparedVisibility is one of the PreparedVisibility constants,
+	// defaulting to PreparedVisibilityNever.
+	PreparedVisibility string
+	// Provenance records the source LSN, xid and commit time of the
+	// last change to each row in the postgres_provenance table.
+	Provenance bool
+	// MessagePrefixes records the logical decoding messages with one of
+	// these prefixes in the postgres_messages table.
+	MessagePrefixes []string
+	// Delivery is one of the Delivery constants, defaulting to
+	// DeliveryExactlyOnce.
+	Delivery string
+	// Keys are the key columns of tables, by name, used instead of
+	// their replica identity. Rows of tables without key columns are
+	// matched by all of their old values.
+	Keys map[string][]string
+	// Timestamps is one of the Timestamps constants, defaulting to
+	// TimestampsPostgres.
+	Timestamps string
+	// CommitTimes records the upstream commit time of the transaction
+	// at each streaming position recorded with Pos, which a failover
+	// reconciles the secondary's transactions with.
+	CommitTimes bool
+}
+
+// ParseKeys parses the key columns of tables, each of the form
+// table=column,column, e.g. "events=device_id,seq".
+func ParseKeys(specs []string) (map[string][]string, error) {
+	keys := make(map[string][]string, len(specs))
+
+	for _, spec := range specs {
+		table, cols, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		if !ok || table == "" || cols == "" {
+			return nil, fmt.Errorf("invalid table key %q, expected table=column,column", spec)
+		}
+
+		// matched against the upstream's names, which are truncated
+		table = TruncateIdentifier(table)
+
+		for _, col := range strings.Split(cols, ",") {
+			if col = strings.TrimSpace(col); col == "" {
+				return nil, fmt.Errorf("invalid table key %q: empty column", spec)
+			}
+
+			keys[table] = append(keys[table], TruncateIdentifier(col))
+		}
+	}
+
+	return keys, nil
+}
+
+// key reports whether the relation's column is one of its key columns,
+// either designated in Keys or of its replica identity.
+func (c SqliteConfig) key(rel *pglogrepl.RelationMessageV2, idx int) bool {
+	if cols, ok := c.Keys[rel.RelationName]; ok {
+		return slices.Contains(cols, rel.Columns[idx].Name)
+	}
+
+	return rel.Columns[idx].Flags == 1
+}
+
+// upsertInserts reports whether inserts should replace existing rows.
+// When updates or deletes aren't published a key can be inserted more
+// than once, e.g. in insert-only event mirroring, and the latest insert wins.
+// With at-least-once delivery an insert can be applied again after a crash.
+func (c SqliteConfig) upsertInserts() bool {
+	if c.Delivery == DeliveryAtLeastOnce {
+		return true
+	}
+
+	if len(c.Publish) == 0 {
+		return false
+	}
+
+	var update, del bool
+
+	for _, op := range c.Publish {
+		switch op {
+		case "update":
+			update = true
+		case "delete":
+			del = true
+		}
+	}
+
+	return !update || !del
 }
 
 type Sqlite struct {
@@ -27,6 +159,29 @@ type Sqlite struct {
 	// TODO: move these to the parent
 	// tx  bool
 	pos pglogrepl.LSN
+
+	// xid and commit time of the transaction being applied,
+	// recorded with its changes when Provenance is enabled.
+	xid        uint32
+	commitTime time.Time
+	// origin is the replication origin the transaction was
+	// written through upstream, empty for local writes there.
+	origin string
+
+	// gid of the prepared transaction being staged, and
+	// the sequence number of the next staged query.
+	staging    string
+	stagingSeq int
+	// undoing is the gid of the prepared transaction being applied
+	// with PreparedVisibilityPrepared, whose changes record their undo.
+	undoing string
+
+	// backfills are the tables copied from the upstream while streaming,
+	// and the positions they were copied at.
+	backfills map[string]pglogrepl.LSN
+	// owners are the upstream tables of the local tables, by their
+	// lowercased local name.
+	owners map[string]string
 }
 
 func NewSqlite(cfg SqliteConfig, current map[string]map[string]ColDef) *Sqlite {
@@ -70,13 +225,41 @@ var mappedSqLiteTypes = map[ColType]ColType{
 	PgColTypeBool:   SQLiteColTypeText,
 }
 
+// colType returns the local type of columns of the postgres type.
+func (s *Sqlite) colType(t ColType) ColType {
+	if isTimestamp(t) && s.cfg.Timestamps == TimestampsEpoch {
+		return SQLiteColTypeInteger
+	}
+
+	if t.Structured() {
+		return t
+	}
+
+	if mt, ok := mappedSqLiteTypes[t]; ok {
+		return mt
+	}
+
+	return SQLiteColTypeText
+}
+
 func (s *Sqlite) Relation(msg *pglogrepl.RelationMessageV2) (string, error) {
+	if err := s.claimTable(msg.Namespace, msg.RelationName); err != nil {
+		return "", err
+	}
+
+	names := make([]string, len(msg.Columns))
+	for i, col := range msg.Columns {
+		names[i] = col.Name
+	}
+
+	if err := checkColumns(msg.RelationName, names); err != nil {
+		return "", err
+	}
+
 	s.relations[msg.RelationID] = msg
 
 	ccols, exists := s.current[msg.RelationName]
 	if !exists {
-		// TODO (bug): tables created in the initial copy
-		// aren't updated in this objects column definitions
 		// CREATE TABLE
 		// doesn't exist as current table
 		currentCols := map[string]ColDef{}
@@ -87,20 +270,16 @@ func (s *Sqlite) Relation(msg *pglogrepl.RelationMessageV2) (string, error) {
 		for idx, col := range msg.Columns {
 			dt, ok := s.typeMap.TypeForOID(col.DataType)
 			if !ok {
-				return "", errors.New("unknown type")
+				return "", ErrUnknownType
 			}
 
-			mappedType := SQLiteColTypeText
-
-			if mt, ok := mappedSqLiteTypes[ColType(dt.Name)]; ok {
-				mappedType = mt
-			}
+			mappedType := s.colType(ColType(dt.Name))
 
 			cd := ColDef{
 				Type: mappedType,
 			}
 
-			if col.Flags == 1 {
+			if s.cfg.key(msg, idx) {
 				pk = append(pk, col.Name)
 				cd.PrimaryKey = true
 			}
@@ -140,19 +319,15 @@ func (s *Sqlite) Relation(msg *pglogrepl.RelationMessageV2) (string, error) {
 		colsCovered[k] = v
 	}
 
-	for _, col := range msg.Columns {
+	for idx, col := range msg.Columns {
 		delete(colsCovered, col.Name)
 
 		dt, ok := s.typeMap.TypeForOID(col.DataType)
 		if !ok {
-			return "", errors.New("unknown type")
+			return "", ErrUnknownType
 		}
 
-		mappedType := SQLiteColTypeText
-
-		if mt, ok := mappedSqLiteTypes[ColType(dt.Name)]; ok {
-			mappedType = mt
-		}
+		mappedType := s.colType(ColType(dt.Name))
 
 		ccol, ok := ccols[col.Name]
 		if !ok {
@@ -164,7 +339,7 @@ func (s *Sqlite) Relation(msg *pglogrepl.RelationMessageV2) (string, error) {
 			continue
 		}
 
-		pk := col.Flags == 1
+		pk := s.cfg.key(msg, idx)
 
 		if ccol.PrimaryKey && !pk {
 			// TODO: DROP PK
@@ -191,13 +366,141 @@ func (s *Sqlite) Relation(msg *pglogrepl.RelationMessageV2) (string, error) {
 	return strings.Join(statements, " "), nil
 }
 
+// DropTable drops the local table, and forgets its column definitions
+// and relations, once the upstream has dropped it.
+func (s *Sqlite) DropTable(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("drop table: empty table name")
+	}
+
+	delete(s.current, name)
+
+	for id, rel := range s.relations {
+		if rel.RelationName == name {
+			delete(s.relations, id)
+		}
+	}
+
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s;", name), nil
+}
+
 // Insert represents a single row insert.
 // Multiple VALUES (...) inserted at once
 // would be multiple calls to this Insert method.
+// buffers build the statements of the changes, which are generated
+// one row at a time.
+var buffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	buf := buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	return buf
+}
+
+// putBuffer pools the buffer, unless a wide row grew it.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= 64<<10 {
+		buffers.Put(buf)
+	}
+}
+
 func (s *Sqlite) Insert(msg *pglogrepl.InsertMessageV2) (string, error) {
+	query, err := s.insert(msg, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return s.stage(query), nil
+}
+
+func (s *Sqlite) Update(msg *pglogrepl.UpdateMessageV2) (string, error) {
+	query, err := s.update(msg, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return s.stage(query), nil
+}
+
+func (s *Sqlite) Delete(msg *pglogrepl.DeleteMessageV2) (string, error) {
+	query, err := s.delete(msg, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return s.stage(query), nil
+}
+
+// Statement is sql with the values of a row change bound as its
+// parameters, instead of formatted into it.
+type Statement struct {
+	// Table is the changed table, the statement's sql is the same
+	// for its changes to the same columns.
+	Table string
+	Query string
+	Args  []any
+}
+
+// BindInsert is Insert with the row's values bound as parameters.
+// Changes of prepared transactions are staged, or record their undo,
+// as text, so they're returned without parameters.
+func (s *Sqlite) BindInsert(msg *pglogrepl.InsertMessageV2) (Statement, error) {
+	if s.staging != "" || s.undoing != "" {
+		query, err := s.Insert(msg)
+		return Statement{Query: query}, err
+	}
+
+	var args []any
+
+	query, err := s.insert(msg, &args)
+
+	return Statement{Table: s.table(msg.RelationID), Query: query, Args: args}, err
+}
+
+// BindUpdate is Update with the row's values bound as parameters.
+func (s *Sqlite) BindUpdate(msg *pglogrepl.UpdateMessageV2) (Statement, error) {
+	if s.staging != "" || s.undoing != "" {
+		query, err := s.Update(msg)
+		return Statement{Query: query}, err
+	}
+
+	var args []any
+
+	query, err := s.update(msg, &args)
+
+	return Statement{Table: s.table(msg.RelationID), Query: query, Args: args}, err
+}
+
+// BindDelete is Delete with the row's key bound as parameters.
+func (s *Sqlite) BindDelete(msg *pglogrepl.DeleteMessageV2) (Statement, error) {
+	if s.staging != "" || s.undoing != "" {
+		query, err := s.Delete(msg)
+		return Statement{Query: query}, err
+	}
+
+	var args []any
+
+	query, err := s.delete(msg, &args)
+
+	return Statement{Table: s.table(msg.RelationID), Query: query, Args: args}, err
+}
+
+// table returns the name of the relation, empty when it's unknown.
+func (s *Sqlite) table(id uint32) string {
+	if rel, ok := s.relations[id]; ok {
+		return rel.RelationName
+	}
+
+	return ""
+}
+
+// insert returns the sql of the insert, with the values formatted into
+// it, or bound as parameters appended to args when args isn't nil.
+func (s *Sqlite) insert(msg *pglogrepl.InsertMessageV2, args *[]any) (string, error) {
 	rel, ok := s.relations[msg.RelationID]
 	if !ok {
-		return "", errors.New("unknown relation")
+		return "", ErrUnknownRelation
 	}
 
 	cols, err := s.parseColums(rel, msg.Tuple.Columns)
@@ -205,12 +508,13 @@ func (s *Sqlite) Insert(msg *pglogrepl.InsertMessageV2) (string, error) {
 		return "", fmt.Errorf("insert: %w", err)
 	}
 
-	cBuf := &bytes.Buffer{}
-	vBuf := &bytes.Buffer{}
+	cBuf, vBuf := getBuffer(), getBuffer()
+	defer putBuffer(cBuf)
+	defer putBuffer(vBuf)
 
 	for idx, col := range cols {
 		cBuf.WriteString(col.name)
-		fmt.Fprintf(vBuf, "%v", col.val())
+		col.write(vBuf, args)
 
 		if idx < len(cols)-1 {
 			cBuf.WriteString(", ")
@@ -218,18 +522,56 @@ func (s *Sqlite) Insert(msg *pglogrepl.InsertMessageV2) (string, error) {
 		}
 	}
 
-	return fmt.Sprintf(
-		"INSERT INTO %s (%s) VALUES (%s);",
+	insert := "INSERT"
+	if s.cfg.upsertInserts() || s.backfilled(rel.RelationName) {
+		insert = "INSERT OR REPLACE"
+	}
+
+	var replaced string
+
+	if s.undoing != "" {
+		// the rows an upsert replaces are restored too
+		if where, err := s.where(rel, cols, false, nil); err == nil {
+			replaced = s.undoRows(rel.RelationName, columnNames(rel), where)
+		}
+	}
+
+	return replaced + fmt.Sprintf(
+		"%s INTO %s (%s) VALUES (%s);",
+		insert,
 		rel.RelationName,
 		cBuf.String(),
 		vBuf.String(),
-	), nil
+	) + s.undoInsert(rel.RelationName) + s.provenance(rel, "insert", cols, args), nil
 }
 
-func (s *Sqlite) Update(msg *pglogrepl.UpdateMessageV2) (string, error) {
+// Backfilling records the table's rows were copied from the upstream at
+// lsn while streaming. Inserts into it replace the copied rows until the
+// transactions before lsn, which the copy already has, are applied.
+func (s *Sqlite) Backfilling(table string, lsn pglogrepl.LSN) {
+	if s.backfills == nil {
+		s.backfills = make(map[string]pglogrepl.LSN)
+	}
+
+	s.backfills[table] = lsn
+}
+
+// backfilled reports whether the table's copy already has the changes
+// of the transaction being applied.
+func (s *Sqlite) backfilled(table string) bool {
+	lsn, ok := s.backfills[table]
+	if ok && s.pos >= lsn {
+		delete(s.backfills, table)
+		return false
+	}
+
+	return ok
+}
+
+func (s *Sqlite) update(msg *pglogrepl.UpdateMessageV2, args *[]any) (string, error) {
 	rel, ok := s.relations[msg.RelationID]
 	if !ok {
-		return "", errors.New("unknown relation")
+		return "", ErrUnknownRelation
 	}
 
 	cols, err := s.parseColums(rel, msg.NewTuple.Columns)
@@ -247,38 +589,47 @@ func (s *Sqlite) Update(msg *pglogrepl.UpdateMessageV2) (string, error) {
 		}
 	}
 
-	buf := &bytes.Buffer{}
+	buf := getBuffer()
+	defer putBuffer(buf)
+
 	for _, col := range cols {
 		if col.key && msg.OldTuple == nil {
 			continue
 		}
 
-		fmt.Fprint(buf, col.kvSql(), ",")
+		col.writeKV(buf, args)
+		buf.WriteString(",")
+	}
+
+	set := buf.String()[:buf.Len()-1]
 
+	where, err := s.where(rel, whereCols, msg.OldTupleType == pglogrepl.UpdateMessageTupleTypeOld, args)
+	if err != nil {
+		return "", err
 	}
 
-	kBuf := &bytes.Buffer{}
+	var undoKey string
 
-	for _, col := range whereCols {
-		if !col.key {
-			continue
+	if s.undoing != "" && msg.OldTuple != nil {
+		// the restored row doesn't replace the updated one when its
+		// key, which can be its rowid, changed
+		if newWhere, err := s.where(rel, cols, false, nil); err == nil {
+			undoKey = s.undo(quote(fmt.Sprintf("DELETE FROM %s WHERE %s;", rel.RelationName, newWhere)))
 		}
-
-		fmt.Fprint(kBuf, col.kvSql(), " AND ")
 	}
 
-	return fmt.Sprintf(
+	return s.undoRows(rel.RelationName, columnNames(rel), where) + fmt.Sprintf(
 		"UPDATE %s SET %s WHERE %s;",
 		rel.RelationName,
-		buf.String()[:len(buf.String())-1],
-		kBuf.String()[:len(kBuf.String())-5],
-	), nil
+		set,
+		where,
+	) + undoKey + s.provenance(rel, "update", cols, args), nil
 }
 
-func (s *Sqlite) Delete(msg *pglogrepl.DeleteMessageV2) (string, error) {
+func (s *Sqlite) delete(msg *pglogrepl.DeleteMessageV2, args *[]any) (string, error) {
 	rel, ok := s.relations[msg.RelationID]
 	if !ok {
-		return "", errors.New("unknown relation")
+		return "", ErrUnknownRelation
 	}
 
 	cols, err := s.parseColums(rel, msg.OldTuple.Columns)
@@ -286,21 +637,62 @@ func (s *Sqlite) Delete(msg *pglogrepl.DeleteMessageV2) (string, error) {
 		return "", fmt.Errorf("new: %w", err)
 	}
 
-	kBuf := &bytes.Buffer{}
+	where, err := s.where(rel, cols, msg.OldTupleType == pglogrepl.DeleteMessageTupleTypeOld, args)
+	if err != nil {
+		return "", err
+	}
+
+	return s.undoRows(rel.RelationName, columnNames(rel), where) + fmt.Sprintf(
+		"DELETE FROM %s WHERE %s;",
+		rel.RelationName,
+		where,
+	) + s.provenance(rel, "delete", cols, args), nil
+}
+
+// where returns the condition matching the row by its key columns. When
+// the table has none and old is set, cols being the whole old row, the
+// row is matched by all of its values instead, and only one of identical
+// rows is matched.
+func (s *Sqlite) where(rel *pglogrepl.RelationMessageV2, cols []*column, old bool, args *[]any) (string, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
 
 	for _, col := range cols {
-		if !col.key {
+		if col == nil || !col.key {
 			continue
 		}
 
-		fmt.Fprint(kBuf, col.kvSql(), " AND ")
+		if buf.Len() > 0 {
+			buf.WriteString(" AND ")
+		}
+
+		col.writeKV(buf, args)
 	}
 
-	return fmt.Sprintf(
-		"DELETE FROM %s WHERE %s;",
-		rel.RelationName,
-		kBuf.String()[:len(kBuf.String())-5],
-	), nil
+	if buf.Len() > 0 {
+		return buf.String(), nil
+	}
+
+	if !old {
+		return "", fmt.Errorf("%w: %s", ErrNoKey, rel.RelationName)
+	}
+
+	for _, col := range cols {
+		if col == nil {
+			continue
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteString(" AND ")
+		}
+
+		// IS matches nulls too
+		buf.WriteString(col.name)
+		buf.WriteString(" IS ")
+		col.write(buf, args)
+	}
+
+	return fmt.Sprintf("rowid = (SELECT rowid FROM %s WHERE %s LIMIT 1)", rel.RelationName, buf.String()), nil
 }
 
 func (s *Sqlite) Truncate(msg *pglogrepl.TruncateMessageV2) (string, error) {
@@ -309,17 +701,50 @@ func (s *Sqlite) Truncate(msg *pglogrepl.TruncateMessageV2) (string, error) {
 	for _, id := range msg.RelationIDs {
 		rel, ok := s.relations[id]
 		if !ok {
-			return "", errors.New("unknown relation")
+			return "", ErrUnknownRelation
 		}
 
+		buf.WriteString(s.undoRows(rel.RelationName, columnNames(rel), "1"))
 		fmt.Fprintf(buf, "DELETE FROM %s; ", rel.RelationName)
 	}
 
-	return buf.String(), nil
+	return s.stage(buf.String()), nil
+}
+
+// Message records a logical decoding message emitted upstream with
+// pg_logical_emit_message, when its prefix is one of MessagePrefixes.
+func (s *Sqlite) Message(msg *pglogrepl.LogicalDecodingMessageV2) (string, error) {
+	for _, prefix := range s.cfg.MessagePrefixes {
+		if !strings.HasPrefix(msg.Prefix, prefix) {
+			continue
+		}
+
+		return s.stage(fmt.Sprintf(
+			"INSERT INTO postgres_messages (lsn, prefix, content, transactional) VALUES (%s, %s, %s, %t);"+s.undoInsert("postgres_messages"),
+			quote(msg.LSN.String()),
+			quote(msg.Prefix),
+			quote(string(msg.Content)),
+			msg.Transactional,
+		)), nil
+	}
+
+	return "", nil
+}
+
+// Origin records the replication origin of the transaction being applied,
+// pgoutput sends it after Begin for transactions that were replicated into
+// the upstream from another node.
+func (s *Sqlite) Origin(msg *pglogrepl.OriginMessage) (string, error) {
+	s.origin = msg.Name
+	return "", nil
 }
 
 func (s *Sqlite) Begin(msg *pglogrepl.BeginMessage) (string, error) {
 	s.pos = msg.FinalLSN
+	s.xid = msg.Xid
+	s.commitTime = msg.CommitTime
+	s.origin = ""
+
 	return "BEGIN TRANSACTION;", nil
 }
 
@@ -339,52 +764,305 @@ func (s *Sqlite) StreamAbort(msg *pglogrepl.StreamAbortMessageV2) (string, error
 	return "ROLLBACK;", nil
 }
 
-func (s *Sqlite) Commit(_ *pglogrepl.CommitMessage) (string, error) {
+func (s *Sqlite) BeginPrepare(msg *pgoutput.BeginPrepareMessage) (string, error) {
+	s.pos = msg.PrepareLSN
+	s.xid = msg.Xid
+	s.commitTime = msg.PrepareTime
+	s.origin = ""
+
+	if s.cfg.PreparedVisibility != PreparedVisibilityPrepared {
+		s.staging = msg.Gid
+		s.stagingSeq = 0
+	} else {
+		s.undoing = msg.Gid
+	}
+
+	return "BEGIN TRANSACTION;", nil
+}
+
+func (s *Sqlite) Prepare(msg *pgoutput.PrepareMessage) (string, error) {
+	s.staging = ""
+	s.undoing = ""
+
+	return s.Commit(nil)
+}
+
+func (s *Sqlite) CommitPrepared(msg *pgoutput.CommitPreparedMessage, staged []string) (string, error) {
+	s.pos = msg.CommitLSN
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("BEGIN TRANSACTION;\n")
+
+	for _, query := range staged {
+		buf.WriteString(query)
+		buf.WriteString("\n")
+	}
+
+	fmt.Fprintf(buf, "DELETE FROM postgres_prepared WHERE gid = %s;\n", quote(msg.Gid))
+	fmt.Fprintf(buf, "DELETE FROM postgres_prepared_undo WHERE gid = %s;\n", quote(msg.Gid))
+
+	commit, err := s.Commit(nil)
+	if err != nil {
+		return "", err
+	}
+
+	buf.WriteString(commit)
+
+	return buf.String(), nil
+}
+
+// RollbackPrepared drops the staged changes of the prepared transaction, or
+// runs the undo queries of its changes already applied, newest first.
+func (s *Sqlite) RollbackPrepared(msg *pgoutput.RollbackPreparedMessage, undo []string) (string, error) {
+	if len(undo) > 0 {
+		log.Info().Msgf("prepared transaction %q rolled back after being applied locally, undoing its changes", msg.Gid)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("BEGIN TRANSACTION;\n")
+
+	for _, query := range undo {
+		buf.WriteString(query)
+		buf.WriteString("\n")
+	}
+
+	fmt.Fprintf(buf, "DELETE FROM postgres_prepared WHERE gid = %s;\n", quote(msg.Gid))
+	fmt.Fprintf(buf, "DELETE FROM postgres_prepared_undo WHERE gid = %s;\n", quote(msg.Gid))
+	buf.WriteString("COMMIT;")
+
+	return buf.String(), nil
+}
+
+// stage returns the query unchanged outside of prepared transactions,
+// otherwise it returns a query that stores it until COMMIT PREPARED.
+func (s *Sqlite) stage(query string) string {
+	if s.staging == "" {
+		return query
+	}
+
+	seq := s.stagingSeq
+	s.stagingSeq++
+
 	return fmt.Sprintf(
-		"INSERT OR REPLACE INTO postgres_pos (source_db, plugin, publication, pos) VALUES ('%s', '%s', '%s', '%s');\n COMMIT;",
-		s.cfg.SourceDB, s.cfg.Plugin, s.cfg.Publication, s.pos,
-	), nil
+		"INSERT INTO postgres_prepared (gid, seq, query) VALUES (%s, %d, %s);",
+		quote(s.staging), seq, quote(query),
+	)
 }
 
+// provenance returns the query recording the change to the row with
+// the key columns of cols, or nothing when Provenance isn't enabled.
+// Its values are bound as parameters appended to args when args isn't nil.
+func (s *Sqlite) provenance(rel *pglogrepl.RelationMessageV2, op string, cols []*column, args *[]any) string {
+	if !s.cfg.Provenance {
+		return ""
+	}
+
+	key := make([]string, 0, len(cols))
+
+	for _, col := range cols {
+		if col == nil || !col.key {
+			continue
+		}
+
+		name, _ := json.Marshal(col.name)
+
+		var value []byte
+
+		switch {
+		case col.value == "null":
+			value = []byte("null")
+		default:
+			// integers decoded from the binary format as their text
+			value, _ = json.Marshal(fmt.Sprint(col.value))
+		}
+
+		key = append(key, string(name)+":"+string(value))
+	}
+
+	var origin any
+	if s.origin != "" {
+		origin = s.origin
+	}
+
+	values := []any{
+		rel.RelationName,
+		"{" + strings.Join(key, ",") + "}",
+		op,
+		s.pos.String(),
+		int64(s.xid),
+		s.commitTime.UTC().Format(time.RFC3339Nano),
+		origin,
+	}
+
+	var placeholders string
+
+	if args != nil {
+		*args = append(*args, values...)
+		placeholders = "?, ?, ?, ?, ?, ?, ?"
+	} else {
+		literals := make([]string, len(values))
+
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+				literals[i] = "NULL"
+			case string:
+				literals[i] = quote(v)
+			default:
+				literals[i] = fmt.Sprint(v)
+			}
+		}
+
+		placeholders = strings.Join(literals, ", ")
+	}
+
+	// version counts the changes applied to the row locally, it
+	// isn't comparable with another node's.
+	return s.undoProvenance(rel.RelationName, values[1].(string)) +
+		"\n INSERT INTO postgres_provenance (table_name, row_key, op, lsn, xid, commit_time, origin, version) VALUES (" + placeholders + ", 1)" +
+		" ON CONFLICT (table_name, row_key) DO UPDATE SET op = excluded.op, lsn = excluded.lsn, xid = excluded.xid," +
+		" commit_time = excluded.commit_time, origin = excluded.origin, version = coalesce(postgres_provenance.version, 0) + 1;"
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func (s *Sqlite) Commit(_ *pglogrepl.CommitMessage) (string, error) {
+	if s.cfg.Delivery == DeliveryAtLeastOnce {
+		// the position is recorded between transactions
+		return "COMMIT;", nil
+	}
+
+	return s.setPos("pos", s.pos) + "\n COMMIT;", nil
+}
+
+// Pos records p as the last committed streaming position, with the
+// commit time of the last transaction begun when CommitTimes is set.
 func (s *Sqlite) Pos(p string) string {
 	s.pos, _ = pglogrepl.ParseLSN(p)
 
+	if s.cfg.CommitTimes && !s.commitTime.IsZero() {
+		return s.setPos("pos", s.pos) + fmt.Sprintf(
+			"\n UPDATE postgres_pos SET commit_time = '%s' WHERE source_db = '%s' AND plugin = '%s' AND publication = '%s';",
+			s.commitTime.UTC().Format(time.RFC3339Nano), s.cfg.SourceDB, s.cfg.Plugin, s.cfg.Publication,
+		)
+	}
+
+	return s.setPos("pos", s.pos)
+}
+
+// SnapshotPos records p as the consistent position of the
+// snapshot the local database was copied or bootstrapped from.
+func (s *Sqlite) SnapshotPos(p string) string {
+	lsn, _ := pglogrepl.ParseLSN(p)
+
+	return s.setPos("snapshot_lsn", lsn)
+}
+
+// AckedPos records p as the last position acknowledged to the upstream.
+func (s *Sqlite) AckedPos(p string) string {
+	lsn, _ := pglogrepl.ParseLSN(p)
+
+	return s.setPos("acked_lsn", lsn)
+}
+
+// setPos sets one of the positions, leaving the others as they are.
+func (s *Sqlite) setPos(column string, lsn pglogrepl.LSN) string {
 	return fmt.Sprintf(
-		"INSERT OR REPLACE INTO postgres_pos (source_db, plugin, publication, pos) VALUES ('%s', '%s', '%s', '%s');",
-		s.cfg.SourceDB, s.cfg.Plugin, s.cfg.Publication, s.pos,
+		"INSERT INTO postgres_pos (source_db, plugin, publication, %[1]s) VALUES ('%[2]s', '%[3]s', '%[4]s', '%[5]s') "+
+			"ON CONFLICT (source_db, plugin, publication) DO UPDATE SET %[1]s = excluded.%[1]s;",
+		column, s.cfg.SourceDB, s.cfg.Plugin, s.cfg.Publication, lsn,
 	)
 }
 
 func (s *Sqlite) CopyCreateTable(schema, tableName string, colDefs []ColDef) (string, error) {
+	if err := s.claimTable(schema, tableName); err != nil {
+		return "", err
+	}
+
+	names := make([]string, len(colDefs))
+	for i, col := range colDefs {
+		names[i] = col.Name
+	}
+
+	if err := checkColumns(tableName, names); err != nil {
+		return "", err
+	}
+
 	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` ( `
 
+	// the copied columns are known, so the table's relation message
+	// only alters the columns that changed since the copy.
+	currentCols := make(map[string]ColDef, len(colDefs))
+
 	for i, col := range colDefs {
 
 		mt := SQLiteColTypeText
 
-		if t, ok := mappedSqLiteTypes[col.Type]; ok && !col.Array {
-			mt = t
+		if !col.Array {
+			mt = s.colType(col.Type)
 		}
 
 		query += fmt.Sprintf("%s %s", col.Name, mt)
 		if i < len(colDefs)-1 {
 			query += ", "
 		}
+
+		currentCols[col.Name] = ColDef{Name: col.Name, Type: mt}
 	}
 
 	query += ");"
 
+	if _, ok := s.current[tableName]; !ok {
+		s.current[tableName] = currentCols
+	}
+
 	return query, nil
 }
 
+// ConvertSchema returns the CREATE TABLE statements of the local tables
+// created for the postgres tables when they're copied, ordered by name.
+func ConvertSchema(schema string, tables map[string][]ColDef) []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	s := NewSqlite(SqliteConfig{}, map[string]map[string]ColDef{})
+	out := make([]string, 0, len(names))
+
+	for _, name := range names {
+		stmt, _ := s.CopyCreateTable(schema, name, tables[name])
+		out = append(out, stmt)
+	}
+
+	return out
+}
+
+var createObject = regexp.MustCompile(`(?i)^(\s*create\s+(?:unique\s+)?(?:table|index))\s+(?:if\s+not\s+exists\s+)?`)
+
+// IfNotExists guards a CREATE TABLE or CREATE INDEX statement with IF NOT
+// EXISTS, so it can be applied again, e.g. after a restart or a replay.
+func IfNotExists(stmt string) string {
+	return createObject.ReplaceAllString(stmt, "$1 IF NOT EXISTS ")
+}
+
 func (s *Sqlite) InsertCopyRow(schema, tableName string, colDefs []ColDef, rowValues []string) (string, error) {
 	query := `INSERT INTO %s VALUES ( %s );`
 
 	var row string
 	for i, v := range rowValues {
-		if v == "null" {
+		switch {
+		case v == "null":
 			row += "null"
-		} else {
+		case i < len(colDefs) && isTimestamp(colDefs[i].Type) && !colDefs[i].Array:
+			row += "'" + s.copiedTimestamp(colDefs[i].Type, v) + "'"
+		case i < len(colDefs) && colDefs[i].Type.Structured() && !colDefs[i].Array:
+			row += "'" + s.structured(colDefs[i].Type, v) + "'"
+		default:
 			row += "'" + v + "'"
 		}
 
@@ -397,14 +1075,38 @@ func (s *Sqlite) InsertCopyRow(schema, tableName string, colDefs []ColDef, rowVa
 }
 
 type column struct {
-	name   string
-	value  interface{}
-	binary []byte
-	key    bool
+	name  string
+	value interface{}
+	key   bool
 }
 
-func (c *column) kvSql() string {
-	return c.name + "=" + c.val()
+// write writes the column's value to buf, or a placeholder for it
+// when args isn't nil, appending the value to args.
+func (c *column) write(buf *bytes.Buffer, args *[]any) {
+	if args == nil {
+		buf.WriteString(c.val())
+		return
+	}
+
+	buf.WriteByte('?')
+	*args = append(*args, c.arg())
+}
+
+func (c *column) writeKV(buf *bytes.Buffer, args *[]any) {
+	buf.WriteString(c.name)
+	buf.WriteByte('=')
+	c.write(buf, args)
+}
+
+// arg is the column's value bound as a parameter, bound as text like
+// the literals of val, so the columns' affinity applies the same, or as
+// the integer or float a binary value decoded to.
+func (c *column) arg() any {
+	if c.value == "null" {
+		return nil
+	}
+
+	return c.value
 }
 
 func (c *column) val() string {
@@ -412,11 +1114,46 @@ func (c *column) val() string {
 		return "null"
 	}
 
-	if c.binary != nil {
-		return fmt.Sprintf("x'%v'", c.binary)
+	return fmt.Sprintf("'%v'", c.value)
+}
+
+// binaryValue returns the value of a column sent in the binary format as
+// it's stored locally, the same as its text format is. The common types
+// are bound as the Go values they decode to, the others are decoded
+// through their text format. It's false for values that can't be decoded.
+func (s *Sqlite) binaryValue(oid uint32, data []byte) (any, bool) {
+	if v, ok := pgoutput.DecodeBinary(oid, data); ok {
+		switch v := v.(type) {
+		case bool:
+			if v {
+				return "t", true
+			}
+
+			return "f", true
+		case int64, string:
+			return v, true
+		case float32:
+			// NaN and infinities are stored as their text
+			if f := float64(v); !math.IsNaN(f) && !math.IsInf(f, 0) {
+				// the float8 the float4's text parses to
+				f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'g', -1, 32), 64)
+				return f, true
+			}
+		case float64:
+			if !math.IsNaN(v) && !math.IsInf(v, 0) {
+				return v, true
+			}
+		case time.Time:
+			return FormatTimestamp(s.cfg.Timestamps, v, oid == pgtype.TimestamptzOID), true
+		}
+	}
+
+	text, ok := pgoutput.BinaryToText(oid, data)
+	if !ok {
+		return nil, false
 	}
 
-	return fmt.Sprintf("'%v'", c.value)
+	return s.value(oid, string(text), false), true
 }
 
 func (s *Sqlite) parseColums(rel *pglogrepl.RelationMessageV2, cols []*pglogrepl.TupleDataColumn) ([]*column, error) {
@@ -428,7 +1165,7 @@ func (s *Sqlite) parseColums(rel *pglogrepl.RelationMessageV2, cols []*pglogrepl
 			out[idx] = &column{
 				name:  rel.Columns[idx].Name,
 				value: "null",
-				key:   rel.Columns[idx].Flags == 1,
+				key:   s.cfg.key(rel, idx),
 			}
 		case 'u':
 			// unchanged
@@ -437,14 +1174,21 @@ func (s *Sqlite) parseColums(rel *pglogrepl.RelationMessageV2, cols []*pglogrepl
 
 			out[idx] = &column{
 				name:  rel.Columns[idx].Name,
-				value: string(data),
-				key:   rel.Columns[idx].Flags == 1,
+				value: s.value(rel.Columns[idx].DataType, string(data), true),
+				key:   s.cfg.key(rel, idx),
 			}
 		case 'b':
+			// sent with the binary option, stored the same as the text format
+			value, ok := s.binaryValue(rel.Columns[idx].DataType, col.Data)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s.%s can't be decoded from the binary format, stream it as text",
+					ErrUnknownType, rel.RelationName, rel.Columns[idx].Name)
+			}
+
 			out[idx] = &column{
-				name:   rel.Columns[idx].Name,
-				binary: col.Data,
-				key:    rel.Columns[idx].Flags == 1,
+				name:  rel.Columns[idx].Name,
+				value: value,
+				key:   s.cfg.key(rel, idx),
 			}
 		}
 	}
@@ -0,0 +1,360 @@
+package sqlgen_test
+
+import (
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func namesRelation() *pglogrepl.RelationMessageV2 {
+	return &pglogrepl.RelationMessageV2{
+		RelationMessage: pglogrepl.RelationMessage{
+			RelationID:   1,
+			Namespace:    "public",
+			RelationName: "names",
+			Columns: []*pglogrepl.RelationMessageColumn{
+				{Flags: 1, Name: "id", DataType: 23},
+				{Name: "name", DataType: 25},
+			},
+		},
+	}
+}
+
+func namesInsert() *pglogrepl.InsertMessageV2 {
+	return &pglogrepl.InsertMessageV2{
+		InsertMessage: pglogrepl.InsertMessage{
+			RelationID: 1,
+			Tuple: &pglogrepl.TupleData{
+				Columns: []*pglogrepl.TupleDataColumn{
+					{DataType: 't', Data: []byte("1")},
+					{DataType: 't', Data: []byte("hello")},
+				},
+			},
+		},
+	}
+}
+
+func TestInsert(t *testing.T) {
+	tests := []struct {
+		name     string
+		publish  []string
+		delivery string
+		want     string
+	}{
+		{
+			name: "default publish",
+			want: "INSERT INTO names (id, name) VALUES ('1', 'hello');",
+		},
+		{
+			name:    "all operations",
+			publish: []string{"insert", "update", "delete", "truncate"},
+			want:    "INSERT INTO names (id, name) VALUES ('1', 'hello');",
+		},
+		{
+			name:    "insert only",
+			publish: []string{"insert"},
+			want:    "INSERT OR REPLACE INTO names (id, name) VALUES ('1', 'hello');",
+		},
+		{
+			name:    "no deletes",
+			publish: []string{"insert", "update"},
+			want:    "INSERT OR REPLACE INTO names (id, name) VALUES ('1', 'hello');",
+		},
+		{
+			name:     "at-least-once",
+			delivery: sqlgen.DeliveryAtLeastOnce,
+			want:     "INSERT OR REPLACE INTO names (id, name) VALUES ('1', 'hello');",
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{Publish: test.publish, Delivery: test.delivery}, map[string]map[string]sqlgen.ColDef{})
+
+			_, err := gen.Relation(namesRelation())
+			assert.NoError(t, err)
+
+			got, err := gen.Insert(namesInsert())
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestDeliveryCommit(t *testing.T) {
+	tests := []struct {
+		delivery string
+		want     string
+	}{
+		{
+			delivery: sqlgen.DeliveryExactlyOnce,
+			want: "INSERT INTO postgres_pos (source_db, plugin, publication, pos) VALUES ('db', 'pgoutput', 'pub', '0/16B3748') " +
+				"ON CONFLICT (source_db, plugin, publication) DO UPDATE SET pos = excluded.pos;\n COMMIT;",
+		},
+		{
+			delivery: sqlgen.DeliveryAtLeastOnce,
+			want:     "COMMIT;",
+		},
+	}
+
+	for _, test := range tests {
+		gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{
+			SourceDB:    "db",
+			Plugin:      "pgoutput",
+			Publication: "pub",
+			Delivery:    test.delivery,
+		}, map[string]map[string]sqlgen.ColDef{})
+
+		_, err := gen.Begin(&pglogrepl.BeginMessage{FinalLSN: 0x16B3748})
+		assert.NoError(t, err)
+
+		got, err := gen.Commit(&pglogrepl.CommitMessage{CommitLSN: 0x16B3748})
+		assert.NoError(t, err)
+		assert.Equal(t, test.want, got, test.delivery)
+	}
+}
+
+func TestBackfilling(t *testing.T) {
+	gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+	_, err := gen.Relation(namesRelation())
+	assert.NoError(t, err)
+
+	gen.Backfilling("names", 0x200)
+
+	for _, test := range []struct {
+		pos  pglogrepl.LSN
+		want string
+	}{
+		// the copy already has the row
+		{pos: 0x100, want: "INSERT OR REPLACE INTO names (id, name) VALUES ('1', 'hello');"},
+		{pos: 0x200, want: "INSERT INTO names (id, name) VALUES ('1', 'hello');"},
+	} {
+		_, err := gen.Begin(&pglogrepl.BeginMessage{FinalLSN: test.pos})
+		assert.NoError(t, err)
+
+		got, err := gen.Insert(namesInsert())
+		assert.NoError(t, err)
+		assert.Equal(t, test.want, got)
+	}
+}
+
+func TestTableKeys(t *testing.T) {
+	rel := &pglogrepl.RelationMessageV2{
+		RelationMessage: pglogrepl.RelationMessage{
+			RelationID:   2,
+			Namespace:    "public",
+			RelationName: "readings",
+			Columns: []*pglogrepl.RelationMessageColumn{
+				{Name: "device", DataType: 25},
+				{Name: "seq", DataType: 23},
+				{Name: "value", DataType: 25},
+			},
+		},
+	}
+
+	tuple := func(values ...string) *pglogrepl.TupleData {
+		data := &pglogrepl.TupleData{}
+
+		for _, v := range values {
+			if v == "" {
+				data.Columns = append(data.Columns, &pglogrepl.TupleDataColumn{DataType: 'n'})
+				continue
+			}
+
+			data.Columns = append(data.Columns, &pglogrepl.TupleDataColumn{DataType: 't', Data: []byte(v)})
+		}
+
+		return data
+	}
+
+	keyed := sqlgen.NewSqlite(sqlgen.SqliteConfig{Keys: map[string][]string{"readings": {"device", "seq"}}}, map[string]map[string]sqlgen.ColDef{})
+
+	got, err := keyed.Relation(rel)
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS readings (device text, seq integer, value text, PRIMARY KEY (device, seq) );", got)
+
+	got, err = keyed.Update(&pglogrepl.UpdateMessageV2{UpdateMessage: pglogrepl.UpdateMessage{
+		RelationID: 2,
+		NewTuple:   tuple("a", "1", "on"),
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "UPDATE readings SET value='on' WHERE device='a' AND seq='1';", got)
+
+	keyless := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+	_, err = keyless.Relation(rel)
+	assert.NoError(t, err)
+
+	// without a key, rows are matched by their old values
+	got, err = keyless.Delete(&pglogrepl.DeleteMessageV2{DeleteMessage: pglogrepl.DeleteMessage{
+		RelationID:   2,
+		OldTupleType: pglogrepl.DeleteMessageTupleTypeOld,
+		OldTuple:     tuple("a", "1", ""),
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "DELETE FROM readings WHERE rowid = (SELECT rowid FROM readings WHERE device IS 'a' AND seq IS '1' AND value IS null LIMIT 1);", got)
+
+	_, err = keyless.Update(&pglogrepl.UpdateMessageV2{UpdateMessage: pglogrepl.UpdateMessage{
+		RelationID: 2,
+		NewTuple:   tuple("a", "1", "on"),
+	}})
+	assert.ErrorIs(t, err, sqlgen.ErrNoKey)
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := sqlgen.ParseKeys([]string{"readings=device, seq", "events=id"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"readings": {"device", "seq"}, "events": {"id"}}, keys)
+
+	for _, spec := range []string{"readings", "=id", "readings=", "readings=device,"} {
+		_, err := sqlgen.ParseKeys([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestPreparedStaging(t *testing.T) {
+	gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+	_, err := gen.Relation(namesRelation())
+	assert.NoError(t, err)
+
+	_, err = gen.BeginPrepare(&pgoutput.BeginPrepareMessage{Gid: "tx'1"})
+	assert.NoError(t, err)
+
+	got, err := gen.Insert(namesInsert())
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		"INSERT INTO postgres_prepared (gid, seq, query) VALUES ('tx''1', 0, 'INSERT INTO names (id, name) VALUES (''1'', ''hello'');');",
+		got,
+	)
+
+	_, err = gen.Prepare(&pgoutput.PrepareMessage{Gid: "tx'1"})
+	assert.NoError(t, err)
+
+	got, err = gen.Insert(namesInsert())
+	assert.NoError(t, err)
+	assert.Equal(t, "INSERT INTO names (id, name) VALUES ('1', 'hello');", got)
+}
+
+func TestDropTable(t *testing.T) {
+	gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+	_, err := gen.Relation(namesRelation())
+	assert.NoError(t, err)
+
+	got, err := gen.DropTable("names")
+	assert.NoError(t, err)
+	assert.Equal(t, "DROP TABLE IF EXISTS names;", got)
+
+	// a table created again with the same name is created locally
+	got, err = gen.Relation(namesRelation())
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS names (id integer, name text, PRIMARY KEY (id) );", got)
+}
+
+func TestCopiedTableRelation(t *testing.T) {
+	gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+	_, err := gen.CopyCreateTable("public", "names", []sqlgen.ColDef{
+		{Name: "id", Type: sqlgen.PgColTypeInt4},
+		{Name: "name", Type: sqlgen.PgColTypeText},
+	})
+	assert.NoError(t, err)
+
+	// the copied table is already up to date
+	got, err := gen.Relation(namesRelation())
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+
+	rel := namesRelation()
+	rel.Columns = append(rel.Columns, &pglogrepl.RelationMessageColumn{Name: "email", DataType: 25})
+
+	got, err = gen.Relation(rel)
+	assert.NoError(t, err)
+	assert.Equal(t, "ALTER TABLE names ADD COLUMN email text;", got)
+}
+
+func TestIfNotExists(t *testing.T) {
+	for _, test := range []struct {
+		stmt string
+		want string
+	}{
+		{
+			stmt: "CREATE TABLE names (id integer)",
+			want: "CREATE TABLE IF NOT EXISTS names (id integer)",
+		},
+		{
+			stmt: "CREATE UNIQUE INDEX names_id ON names (id)",
+			want: "CREATE UNIQUE INDEX IF NOT EXISTS names_id ON names (id)",
+		},
+		{
+			stmt: "create index if not exists names_id on names (id)",
+			want: "create index IF NOT EXISTS names_id on names (id)",
+		},
+		{
+			stmt: "INSERT INTO names VALUES (1)",
+			want: "INSERT INTO names VALUES (1)",
+		},
+	} {
+		assert.Equal(t, test.want, sqlgen.IfNotExists(test.stmt))
+	}
+}
+
+func TestBinaryInsert(t *testing.T) {
+	gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+	_, err := gen.Relation(namesRelation())
+	assert.NoError(t, err)
+
+	// values sent in the binary format are stored as if sent as text
+	got, err := gen.Insert(&pglogrepl.InsertMessageV2{
+		InsertMessage: pglogrepl.InsertMessage{
+			RelationID: 1,
+			Tuple: &pglogrepl.TupleData{
+				Columns: []*pglogrepl.TupleDataColumn{
+					{DataType: 'b', Data: []byte{0, 0, 0, 1}},
+					{DataType: 'b', Data: []byte("hello")},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "INSERT INTO names (id, name) VALUES ('1', 'hello');", got)
+}
+
+func TestBindBinaryInsert(t *testing.T) {
+	gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{}, map[string]map[string]sqlgen.ColDef{})
+
+	_, err := gen.Relation(namesRelation())
+	require.NoError(t, err)
+
+	insert := func(id []byte) (sqlgen.Statement, error) {
+		return gen.BindInsert(&pglogrepl.InsertMessageV2{
+			InsertMessage: pglogrepl.InsertMessage{
+				RelationID: 1,
+				Tuple: &pglogrepl.TupleData{
+					Columns: []*pglogrepl.TupleDataColumn{
+						{DataType: 'b', Data: id},
+						{DataType: 'b', Data: []byte("hello")},
+					},
+				},
+			},
+		})
+	}
+
+	// bound as the values they decode to, without their text format
+	got, err := insert([]byte{0, 0, 0, 1})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(1), "hello"}, got.Args)
+
+	// rather than stored as the bytes of the binary format
+	_, err = insert([]byte{0, 1})
+	assert.ErrorIs(t, err, sqlgen.ErrUnknownType)
+}
@@ -0,0 +1,109 @@
+package sqlgen
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	// TimestampsPostgres stores timestamps in postgres' text format, e.g.
+	// "2024-05-01 12:00:00.5+00", timestamptz values copied or sent in
+	// binary in UTC.
+	TimestampsPostgres = "postgres"
+	// TimestampsUTC stores timestamps as RFC 3339 text in UTC, e.g.
+	// "2024-05-01T12:00:00.5Z".
+	TimestampsUTC = "utc"
+	// TimestampsEpoch stores timestamps as integer microseconds since
+	// 1970-01-01 UTC, in INTEGER columns.
+	TimestampsEpoch = "epoch"
+	// TimestampsLocal stores timestamps as RFC 3339 text in the node's
+	// time zone, e.g. "2024-05-01T14:00:00.5+02:00".
+	TimestampsLocal = "local"
+)
+
+// FormatTimestamp formats the time as the policy, one of the Timestamps
+// constants, stores timestamps. tz is set for timestamptz values, those
+// without a time zone are taken as UTC.
+func FormatTimestamp(policy string, t time.Time, tz bool) string {
+	switch policy {
+	case TimestampsUTC:
+		return t.UTC().Format(time.RFC3339Nano)
+	case TimestampsEpoch:
+		return strconv.FormatInt(t.UnixMicro(), 10)
+	case TimestampsLocal:
+		return t.Local().Format(time.RFC3339Nano)
+	}
+
+	text := t.UTC().Format("2006-01-02 15:04:05.999999")
+	if tz {
+		text += "+00"
+	}
+
+	return text
+}
+
+// value returns the text of a column's value as it's stored locally,
+// with timestamps stored as the Timestamps policy has them, and
+// intervals and ranges as structured does.
+func (s *Sqlite) value(oid uint32, text string, sent bool) string {
+	if oid == pgtype.TimestampOID || oid == pgtype.TimestamptzOID {
+		return s.timestamp(oid, text, sent)
+	}
+
+	if dt, ok := s.typeMap.TypeForOID(oid); ok && ColType(dt.Name).Structured() {
+		return s.structured(ColType(dt.Name), text)
+	}
+
+	return text
+}
+
+// isTimestamp reports whether the type is timestamp or timestamptz.
+func isTimestamp(t ColType) bool {
+	return t == PgColTypeTimestamp || t == PgColTypeTimestamptz
+}
+
+// timestamp returns the text of a timestamp or timestamptz column's value
+// as the Timestamps policy stores it, other values are returned unchanged.
+// Text sent by postgres is already in its format. Values that can't be
+// parsed, such as infinity, are stored as they are.
+func (s *Sqlite) timestamp(oid uint32, text string, sent bool) string {
+	if oid != pgtype.TimestampOID && oid != pgtype.TimestamptzOID {
+		return text
+	}
+
+	if sent && (s.cfg.Timestamps == "" || s.cfg.Timestamps == TimestampsPostgres) {
+		return text
+	}
+
+	var ts pgtype.Timestamptz
+
+	if oid == pgtype.TimestampOID {
+		var t pgtype.Timestamp
+		if err := s.typeMap.Scan(oid, pgtype.TextFormatCode, []byte(text), &t); err != nil {
+			return text
+		}
+
+		ts = pgtype.Timestamptz{Time: t.Time, InfinityModifier: t.InfinityModifier, Valid: t.Valid}
+	} else if err := s.typeMap.Scan(oid, pgtype.TextFormatCode, []byte(text), &ts); err != nil {
+		return text
+	}
+
+	if !ts.Valid || ts.InfinityModifier != pgtype.Finite {
+		return text
+	}
+
+	return FormatTimestamp(s.cfg.Timestamps, ts.Time, oid == pgtype.TimestamptzOID)
+}
+
+// copiedTimestamp returns the copied value of a timestamp or timestamptz
+// column, in RFC 3339, as the Timestamps policy stores it.
+func (s *Sqlite) copiedTimestamp(t ColType, text string) string {
+	parsed, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return text
+	}
+
+	return FormatTimestamp(s.cfg.Timestamps, parsed, t == PgColTypeTimestamptz)
+}
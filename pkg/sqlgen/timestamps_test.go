@@ -0,0 +1,101 @@
+package sqlgen_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatTimestamp(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 14, 0, 0, 500000000, time.FixedZone("", 2*60*60))
+
+	tests := []struct {
+		policy string
+		tz     bool
+		want   string
+	}{
+		{policy: sqlgen.TimestampsPostgres, want: "2024-05-01 12:00:00.5"},
+		{policy: sqlgen.TimestampsPostgres, tz: true, want: "2024-05-01 12:00:00.5+00"},
+		{policy: "", tz: true, want: "2024-05-01 12:00:00.5+00"},
+		{policy: sqlgen.TimestampsUTC, tz: true, want: "2024-05-01T12:00:00.5Z"},
+		{policy: sqlgen.TimestampsEpoch, tz: true, want: "1714564800500000"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, sqlgen.FormatTimestamp(test.policy, ts, test.tz), test.policy)
+	}
+}
+
+func TestTimestampPolicy(t *testing.T) {
+	relation := &pglogrepl.RelationMessageV2{
+		RelationMessage: pglogrepl.RelationMessage{
+			RelationID:   1,
+			Namespace:    "public",
+			RelationName: "events",
+			Columns: []*pglogrepl.RelationMessageColumn{
+				{Flags: 1, Name: "id", DataType: 23},
+				{Name: "at", DataType: 1184},
+			},
+		},
+	}
+
+	insert := &pglogrepl.InsertMessageV2{
+		InsertMessage: pglogrepl.InsertMessage{
+			RelationID: 1,
+			Tuple: &pglogrepl.TupleData{
+				Columns: []*pglogrepl.TupleDataColumn{
+					{DataType: 't', Data: []byte("1")},
+					{DataType: 't', Data: []byte("2024-05-01 14:00:00.5+02")},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		policy string
+		create string
+		insert string
+		copied string
+	}{
+		{
+			policy: sqlgen.TimestampsPostgres,
+			create: "CREATE TABLE IF NOT EXISTS events (id integer, at text, PRIMARY KEY (id) );",
+			insert: "INSERT INTO events (id, at) VALUES ('1', '2024-05-01 14:00:00.5+02');",
+			copied: "INSERT INTO events VALUES ( '1','2024-05-01 12:00:00.5+00' );",
+		},
+		{
+			policy: sqlgen.TimestampsUTC,
+			create: "CREATE TABLE IF NOT EXISTS events (id integer, at text, PRIMARY KEY (id) );",
+			insert: "INSERT INTO events (id, at) VALUES ('1', '2024-05-01T12:00:00.5Z');",
+			copied: "INSERT INTO events VALUES ( '1','2024-05-01T12:00:00.5Z' );",
+		},
+		{
+			policy: sqlgen.TimestampsEpoch,
+			create: "CREATE TABLE IF NOT EXISTS events (id integer, at integer, PRIMARY KEY (id) );",
+			insert: "INSERT INTO events (id, at) VALUES ('1', '1714564800500000');",
+			copied: "INSERT INTO events VALUES ( '1','1714564800500000' );",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			gen := sqlgen.NewSqlite(sqlgen.SqliteConfig{Timestamps: test.policy}, map[string]map[string]sqlgen.ColDef{})
+
+			create, err := gen.Relation(relation)
+			assert.NoError(t, err)
+			assert.Equal(t, test.create, create)
+
+			got, err := gen.Insert(insert)
+			assert.NoError(t, err)
+			assert.Equal(t, test.insert, got)
+
+			cols := []sqlgen.ColDef{{Name: "id", Type: sqlgen.PgColTypeInt4}, {Name: "at", Type: sqlgen.PgColTypeTimestamptz}}
+			copied, err := gen.InsertCopyRow("public", "events", cols, []string{"1", "2024-05-01T12:00:00.5Z"})
+			assert.NoError(t, err)
+			assert.Equal(t, test.copied, copied)
+		})
+	}
+}
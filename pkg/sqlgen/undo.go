@@ -0,0 +1,71 @@
+package sqlgen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// provenanceColumns are the columns of postgres_provenance.
+var provenanceColumns = []string{"table_name", "row_key", "op", "lsn", "xid", "commit_time", "origin", "version"}
+
+// undoRows returns the sql recording how to restore the rows of the table
+// matching where as they are now, before the prepared transaction being
+// applied changes them, or nothing outside of one. The rows are restored
+// with their rowid, so it also undoes updates of their key.
+func (s *Sqlite) undoRows(table string, columns []string, where string) string {
+	if s.undoing == "" {
+		return ""
+	}
+
+	values := make([]string, len(columns))
+	for i, c := range columns {
+		values[i] = "quote(" + c + ")"
+	}
+
+	restore := fmt.Sprintf("%s || rowid || ', ' || %s || ');'",
+		quote(fmt.Sprintf("INSERT OR REPLACE INTO %s (rowid, %s) VALUES (", table, strings.Join(columns, ", "))),
+		strings.Join(values, " || ', ' || "),
+	)
+
+	return fmt.Sprintf("\n INSERT INTO postgres_prepared_undo (gid, query) SELECT %s, %s FROM %s WHERE %s;",
+		quote(s.undoing), restore, table, where)
+}
+
+// undo returns the sql recording the query, an sql expression of its text,
+// undoing a change of the prepared transaction being applied, or nothing
+// outside of one.
+func (s *Sqlite) undo(query string) string {
+	if s.undoing == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("\n INSERT INTO postgres_prepared_undo (gid, query) VALUES (%s, %s);", quote(s.undoing), query)
+}
+
+// undoInsert returns the sql recording how to delete the row just inserted
+// into the table.
+func (s *Sqlite) undoInsert(table string) string {
+	return s.undo(quote("DELETE FROM "+table+" WHERE rowid = ") + " || last_insert_rowid() || ';'")
+}
+
+// undoProvenance returns the sql recording how to restore the provenance
+// of the row with the key, before it's recorded again.
+func (s *Sqlite) undoProvenance(table, key string) string {
+	where := fmt.Sprintf("table_name = %s AND row_key = %s", quote(table), quote(key))
+
+	// undone in reverse, the provenance is deleted and then restored
+	return s.undoRows("postgres_provenance", provenanceColumns, where) +
+		s.undo(quote("DELETE FROM postgres_provenance WHERE "+where+";"))
+}
+
+// columnNames returns the names of the relation's columns.
+func columnNames(rel *pglogrepl.RelationMessageV2) []string {
+	names := make([]string, len(rel.Columns))
+	for i, c := range rel.Columns {
+		names[i] = c.Name
+	}
+
+	return names
+}
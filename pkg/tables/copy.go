@@ -18,17 +18,30 @@ type Conn interface {
 }
 
 func Copy(ctx context.Context, table string, def []sqlgen.ColDef, c Conn) ([][]string, error) {
-	var err error
 	// no position stored
 	// copy the entire database
+	return copyQuery(ctx, fmt.Sprintf(`COPY %s TO STDOUT WITH BINARY;`, table), def, c)
+}
+
+// CopyRange copies the rows stored in the table's pages from startPage up to,
+// but not including, endPage. A negative endPage copies to the end of the table.
+func CopyRange(ctx context.Context, table string, def []sqlgen.ColDef, c Conn, startPage, endPage int64) ([][]string, error) {
+	where := fmt.Sprintf(`ctid >= '(%d,0)'::tid`, startPage)
+	if endPage >= 0 {
+		where += fmt.Sprintf(` AND ctid < '(%d,0)'::tid`, endPage)
+	}
+
+	return copyQuery(ctx, fmt.Sprintf(`COPY (SELECT * FROM %s WHERE %s) TO STDOUT WITH BINARY;`, table, where), def, c)
+}
+
+func copyQuery(ctx context.Context, query string, def []sqlgen.ColDef, c Conn) ([][]string, error) {
 	b := &bytes.Buffer{}
 
-	query := fmt.Sprintf(`COPY %s TO STDOUT WITH BINARY;`, table)
 	log.Debug().Msg(query)
 
-	_, err = c.CopyTo(ctx, b, query)
-	if err != nil {
+	if _, err := c.CopyTo(ctx, b, query); err != nil {
 		log.Error().Err(err).Msg("copy error")
+		return nil, fmt.Errorf("copy to: %w", err)
 	}
 
 	buf := buf(b.Bytes())
@@ -41,9 +54,6 @@ func Copy(ctx context.Context, table string, def []sqlgen.ColDef, c Conn) ([][]s
 	_ = buf.popInt32()
 
 	decs := decoders(def)
-	if err != nil {
-		return nil, fmt.Errorf("build decs: %w", err)
-	}
 
 	cols := [][]string{}
 
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
 	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
 	"github.com/rs/zerolog/log"
 )
@@ -46,10 +47,17 @@ func decoders(def []sqlgen.ColDef) []FieldDecoder {
 			out[i] = new(jsonb)
 		case sqlgen.PgColTypeBool:
 			out[i] = new(boolean)
-		case sqlgen.PgColTypeTimestamp:
+		case sqlgen.PgColTypeTimestamp, sqlgen.PgColTypeTimestamptz:
 			out[i] = new(timestamp)
 		default:
 			out[i] = new(str)
+
+			// intervals and ranges are decoded into postgres' text format,
+			// which sqlgen stores as their local format
+			if d.Type.Structured() {
+				oid, _ := d.Type.PgType()
+				out[i] = &text{oid: uint32(oid)}
+			}
 		}
 
 		if d.Array {
@@ -151,6 +159,21 @@ type str struct{}
 func (s *str) numeric() bool          { return false }
 func (s *str) Decode(b []byte) string { return string(b) }
 
+// text decodes the types pgtype knows by their OID.
+type text struct {
+	oid uint32
+}
+
+func (t *text) numeric() bool { return false }
+func (t *text) Decode(b []byte) string {
+	v, ok := pgoutput.BinaryToText(t.oid, b)
+	if !ok {
+		log.Error().Msgf("error decoding a value of type %d", t.oid)
+	}
+
+	return string(v)
+}
+
 type jsonb struct{}
 
 func (j *jsonb) numeric() bool          { return false }
@@ -255,6 +278,6 @@ func (t *timestamp) Decode(b []byte) string {
 	// Add the microseconds to the epoch
 	decodedTime := postgresEpoch.Add(time.Duration(microsecondsSinceEpoch) * time.Microsecond)
 
-	// TODO: How to make format configurable
+	// stored as the local config's timestamp policy has it by sqlgen
 	return decodedTime.Format(time.RFC3339Nano)
 }
@@ -0,0 +1,216 @@
+package tables
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+)
+
+var createTable = regexp.MustCompile(`(?i)\bCREATE\s+(?:UNLOGGED\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?((?:"[^"]+"|\w+)(?:\.(?:"[^"]+"|\w+))?)\s*\(`)
+
+// dumpTypes are the udt names of the type names pg_dump writes,
+// for the types sqlgen maps to something other than text.
+var dumpTypes = map[string]sqlgen.ColType{
+	"smallint":         sqlgen.PgColTypeInt2,
+	"smallserial":      sqlgen.PgColTypeInt2,
+	"integer":          sqlgen.PgColTypeInt4,
+	"int":              sqlgen.PgColTypeInt4,
+	"serial":           sqlgen.PgColTypeInt4,
+	"bigint":           sqlgen.PgColTypeInt8,
+	"bigserial":        sqlgen.PgColTypeInt8,
+	"numeric":          sqlgen.PgColTypeNum,
+	"decimal":          sqlgen.PgColTypeNum,
+	"real":             sqlgen.PgColTypeFloat4,
+	"double precision": sqlgen.PgColTypeFloat8,
+	"boolean":          sqlgen.PgColTypeBool,
+}
+
+// columnEnd is the first word after a column's type.
+var columnEnd = regexp.MustCompile(`(?i)\s+(?:NOT|NULL|DEFAULT|CONSTRAINT|COLLATE|GENERATED|PRIMARY|UNIQUE|CHECK|REFERENCES)\b`)
+
+// DumpColDefs reads the column definitions of schema's tables from the
+// CREATE TABLE statements of a pg_dump schema, e.g. pg_dump --schema-only.
+// Unqualified tables are taken to be in schema.
+func DumpColDefs(r io.Reader, schema string) (map[string][]sqlgen.ColDef, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read dump: %w", err)
+	}
+
+	dump := string(b)
+	out := make(map[string][]sqlgen.ColDef)
+
+	for _, loc := range createTable.FindAllStringSubmatchIndex(dump, -1) {
+		tableSchema, name := schema, unquoteIdent(dump[loc[2]:loc[3]])
+		if s, n, ok := splitQualified(dump[loc[2]:loc[3]]); ok {
+			tableSchema, name = s, n
+		}
+
+		body, ok := parenthesized(dump[loc[1]:])
+		if !ok {
+			return nil, fmt.Errorf("table %q: unterminated column list", name)
+		}
+
+		if tableSchema != schema {
+			continue
+		}
+
+		var defs []sqlgen.ColDef
+
+		for _, elem := range splitTopLevel(body) {
+			def, ok := dumpColDef(elem)
+			if ok {
+				defs = append(defs, def)
+			}
+		}
+
+		out[name] = defs
+	}
+
+	return out, nil
+}
+
+// dumpColDef returns the column of an element of a table's column list,
+// it's false for table constraints.
+func dumpColDef(elem string) (sqlgen.ColDef, bool) {
+	elem = strings.TrimSpace(elem)
+
+	fields := strings.Fields(elem)
+	if len(fields) < 2 {
+		return sqlgen.ColDef{}, false
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN", "EXCLUDE", "LIKE":
+		return sqlgen.ColDef{}, false
+	}
+
+	var name string
+
+	if strings.HasPrefix(elem, `"`) {
+		end := strings.Index(elem[1:], `"`)
+		if end < 0 {
+			return sqlgen.ColDef{}, false
+		}
+
+		name, elem = elem[1:end+1], elem[end+2:]
+	} else {
+		name, elem = fields[0], strings.TrimSpace(strings.TrimPrefix(elem, fields[0]))
+	}
+
+	typ := strings.TrimSpace(elem)
+	if loc := columnEnd.FindStringIndex(typ); loc != nil {
+		typ = typ[:loc[0]]
+	}
+
+	def := sqlgen.ColDef{Name: name}
+
+	if strings.HasSuffix(typ, "[]") {
+		typ = strings.TrimSuffix(typ, "[]")
+		def.Array = true
+	}
+
+	// drop modifiers, like character varying(255) or numeric(10,2)
+	if i := strings.Index(typ, "("); i >= 0 {
+		if j := strings.Index(typ[i:], ")"); j >= 0 {
+			typ = strings.TrimSpace(typ[:i] + typ[i+j+1:])
+		}
+	}
+
+	// types in other schemas, like extensions' types
+	if i := strings.LastIndex(typ, "."); i >= 0 {
+		typ = typ[i+1:]
+	}
+
+	typ = strings.ToLower(strings.Join(strings.Fields(typ), " "))
+	def.Type = sqlgen.ColType(typ)
+
+	if t, ok := dumpTypes[typ]; ok {
+		def.Type = t
+	}
+
+	return def, true
+}
+
+// parenthesized returns s up to the parenthesis closing the one before it.
+func parenthesized(s string) (string, bool) {
+	depth := 1
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return s[:i], true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// splitTopLevel splits a column list on the commas outside of
+// parentheses and quotes.
+func splitTopLevel(s string) []string {
+	var (
+		out   []string
+		depth int
+		quote byte
+		start int
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(out, s[start:])
+}
+
+func splitQualified(name string) (string, string, bool) {
+	if strings.HasPrefix(name, `"`) {
+		end := strings.Index(name[1:], `"`)
+		if end+2 < len(name) && name[end+2] == '.' {
+			return unquoteIdent(name[:end+2]), unquoteIdent(name[end+3:]), true
+		}
+
+		return "", "", false
+	}
+
+	schema, table, ok := strings.Cut(name, ".")
+
+	return unquoteIdent(schema), unquoteIdent(table), ok
+}
+
+func unquoteIdent(name string) string {
+	if strings.HasPrefix(name, `"`) && strings.HasSuffix(name, `"`) {
+		return name[1 : len(name)-1]
+	}
+
+	return strings.ToLower(name)
+}
@@ -0,0 +1,61 @@
+package tables_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/gemini-kenshi/pgreplsql/pkg/tables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dump = `
+--
+-- Name: orders; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.orders (
+    id bigint NOT NULL,
+    "Customer" character varying(255) DEFAULT 'a, b'::character varying,
+    total numeric(10,2),
+    tags text[],
+    paid boolean DEFAULT false NOT NULL,
+    created_at timestamp(3) with time zone DEFAULT now(),
+    CONSTRAINT orders_total_check CHECK ((total >= (0)::numeric))
+);
+
+CREATE TABLE audit.log (
+    id integer
+);
+
+CREATE UNLOGGED TABLE events (
+    payload jsonb,
+    ratio double precision
+);
+`
+
+func TestDumpColDefs(t *testing.T) {
+	defs, err := tables.DumpColDefs(strings.NewReader(dump), "public")
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]sqlgen.ColDef{
+		"orders": {
+			{Name: "id", Type: sqlgen.PgColTypeInt8},
+			{Name: "Customer", Type: "character varying"},
+			{Name: "total", Type: sqlgen.PgColTypeNum},
+			{Name: "tags", Type: sqlgen.PgColTypeText, Array: true},
+			{Name: "paid", Type: sqlgen.PgColTypeBool},
+			{Name: "created_at", Type: "timestamp with time zone"},
+		},
+		"events": {
+			{Name: "payload", Type: sqlgen.PgColTypeJsonB},
+			{Name: "ratio", Type: sqlgen.PgColTypeFloat8},
+		},
+	}, defs)
+
+	assert.Equal(t, []string{
+		"CREATE TABLE IF NOT EXISTS events ( payload text, ratio real);",
+		"CREATE TABLE IF NOT EXISTS orders ( id integer, Customer text, total real, tags text, paid text, created_at text);",
+	}, sqlgen.ConvertSchema("public", defs))
+}
@@ -0,0 +1,160 @@
+package tables
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TableStats are the planner statistics postgres holds for a table.
+type TableStats struct {
+	// Rows is the estimated number of rows.
+	Rows int64
+	// Pages is the number of pages the table takes on disk.
+	Pages int64
+	// RowWidth is the average width of a row in bytes,
+	// or zero when the table hasn't been analyzed.
+	RowWidth int64
+}
+
+// Stats reads the statistics for the table from pg_class and pg_stats.
+// Tables that have never been analyzed are analyzed first.
+func Stats(db Querier, schema, table string) (TableStats, error) {
+	stats, analyzed, err := readStats(db, schema, table)
+	if err != nil {
+		return stats, err
+	}
+
+	if analyzed {
+		return stats, nil
+	}
+
+	log.Debug().Msgf("analyzing %s.%s", schema, table)
+
+	rows, err := db.Query(fmt.Sprintf(`ANALYZE %s.%s;`, schema, table))
+	if err != nil {
+		// the stats are only a hint, so copy without them
+		log.Warn().Err(err).Msgf("failed to analyze %s.%s", schema, table)
+		return stats, nil
+	}
+	rows.Close()
+
+	stats, _, err = readStats(db, schema, table)
+
+	return stats, err
+}
+
+func readStats(db Querier, schema, table string) (TableStats, bool, error) {
+	query := `SELECT c.reltuples::bigint, c.relpages::bigint,
+		COALESCE((
+			SELECT sum(s.avg_width)
+			FROM pg_stats s
+			WHERE s.schemaname = n.nspname AND s.tablename = c.relname
+		), 0)::bigint
+	FROM pg_class c
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE n.nspname = $1 AND c.relname = $2;`
+
+	rows, err := db.Query(query, schema, table)
+	if err != nil {
+		return TableStats{}, false, fmt.Errorf("query stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats TableStats
+
+	if !rows.Next() {
+		return stats, false, fmt.Errorf("no stats for %s.%s", schema, table)
+	}
+
+	if err := rows.Scan(&stats.Rows, &stats.Pages, &stats.RowWidth); err != nil {
+		return stats, false, fmt.Errorf("scan stats: %w", err)
+	}
+
+	// reltuples is -1 for tables that have never been vacuumed or analyzed
+	analyzed := stats.Rows >= 0
+	if stats.Rows < 0 {
+		stats.Rows = 0
+	}
+
+	return stats, analyzed, nil
+}
+
+// CopyPlan describes how a table's copy is split up.
+type CopyPlan struct {
+	// PagesPerChunk is the number of table pages copied in each chunk,
+	// zero means the table is copied in a single chunk.
+	PagesPerChunk int64
+	// Chunks is the number of chunks.
+	Chunks int
+	// Workers is the number of chunks to copy in parallel.
+	Workers int
+}
+
+// Range returns the pages covered by the chunk. The last
+// chunk is open ended, in case the table has grown.
+func (p CopyPlan) Range(chunk int) (startPage, endPage int64) {
+	startPage = int64(chunk) * p.PagesPerChunk
+	if chunk == p.Chunks-1 {
+		return startPage, -1
+	}
+
+	return startPage, startPage + p.PagesPerChunk
+}
+
+const (
+	// used when the table hasn't got column stats
+	defaultRowWidth = 128
+	// per row header and alignment overhead once decoded
+	rowOverhead = 24
+)
+
+// PlanCopy sizes the chunks of a table's copy so that each holds about
+// chunkBytes of row data, copying up to maxWorkers chunks at once.
+func PlanCopy(stats TableStats, chunkBytes int64, maxWorkers int) CopyPlan {
+	single := CopyPlan{Chunks: 1, Workers: 1}
+
+	if chunkBytes <= 0 || stats.Rows <= 0 || stats.Pages <= 0 {
+		return single
+	}
+
+	width := stats.RowWidth
+	if width <= 0 {
+		width = defaultRowWidth
+	}
+
+	chunkRows := chunkBytes / (width + rowOverhead)
+	if chunkRows >= stats.Rows {
+		return single
+	}
+
+	rowsPerPage := stats.Rows / stats.Pages
+	if rowsPerPage < 1 {
+		rowsPerPage = 1
+	}
+
+	pagesPerChunk := chunkRows / rowsPerPage
+	if pagesPerChunk < 1 {
+		pagesPerChunk = 1
+	}
+
+	chunks := int((stats.Pages + pagesPerChunk - 1) / pagesPerChunk)
+	if chunks <= 1 {
+		return single
+	}
+
+	workers := maxWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	if workers > chunks {
+		workers = chunks
+	}
+
+	return CopyPlan{
+		PagesPerChunk: pagesPerChunk,
+		Chunks:        chunks,
+		Workers:       workers,
+	}
+}
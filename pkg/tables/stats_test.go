@@ -0,0 +1,67 @@
+package tables_test
+
+import (
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/tables"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanCopy(t *testing.T) {
+	tests := []struct {
+		name       string
+		stats      tables.TableStats
+		chunkBytes int64
+		maxWorkers int
+		want       tables.CopyPlan
+	}{
+		{
+			name:       "never analyzed",
+			stats:      tables.TableStats{},
+			chunkBytes: 1 << 20,
+			maxWorkers: 4,
+			want:       tables.CopyPlan{Chunks: 1, Workers: 1},
+		},
+		{
+			name:       "fits in one chunk",
+			stats:      tables.TableStats{Rows: 1000, Pages: 10, RowWidth: 40},
+			chunkBytes: 1 << 20,
+			maxWorkers: 4,
+			want:       tables.CopyPlan{Chunks: 1, Workers: 1},
+		},
+		{
+			name:       "chunked",
+			stats:      tables.TableStats{Rows: 100000, Pages: 1000, RowWidth: 76},
+			chunkBytes: 1000000,
+			maxWorkers: 4,
+			// 10000 rows per chunk at 100 rows per page
+			want: tables.CopyPlan{PagesPerChunk: 100, Chunks: 10, Workers: 4},
+		},
+		{
+			name:       "fewer chunks than workers",
+			stats:      tables.TableStats{Rows: 100000, Pages: 1000, RowWidth: 76},
+			chunkBytes: 5000000,
+			maxWorkers: 4,
+			want:       tables.CopyPlan{PagesPerChunk: 500, Chunks: 2, Workers: 2},
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, tables.PlanCopy(test.stats, test.chunkBytes, test.maxWorkers))
+		})
+	}
+}
+
+func TestCopyPlanRange(t *testing.T) {
+	plan := tables.CopyPlan{PagesPerChunk: 100, Chunks: 3, Workers: 2}
+
+	start, end := plan.Range(1)
+	assert.Equal(t, int64(100), start)
+	assert.Equal(t, int64(200), end)
+
+	start, end = plan.Range(2)
+	assert.Equal(t, int64(200), start)
+	assert.Equal(t, int64(-1), end)
+}
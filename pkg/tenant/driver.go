@@ -0,0 +1,559 @@
+package tenant
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/pgoutput"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pglogrepl"
+	"github.com/rs/zerolog/log"
+)
+
+// Driver applies the replicated changes, writing the rows of tables with
+// the tenant column to the tenant's database, and everything else to the
+// main database. Every tenant database has the main database's tables,
+// so schema changes and truncates apply to all of them.
+//
+// The tenants' changes are committed before the main database's, which
+// records the position. Each tenant database records the position of the
+// last transaction committed to it too, so after a crash between the two
+// the transaction is applied again only to the databases that missed it.
+type Driver struct {
+	*sqlgen.SqliteDriver
+
+	main   *sql.DB
+	column string
+	files  *Files
+
+	// relations holds the index of the tenant column in each relation,
+	// or -1 when the relation doesn't have it.
+	relations map[uint32]int
+	// types holds the type of the tenant column in each relation.
+	types map[uint32]uint32
+	// keys holds whether the tenant column is in each relation's
+	// replica identity, and tables the relations' table names.
+	keys   map[uint32]bool
+	tables map[uint32]string
+	txs    map[string]*sql.Tx
+
+	// lsn is the commit position of the transaction being applied, zero
+	// outside transactions. applied holds the tenants that already
+	// committed it, whose changes are skipped.
+	lsn     pglogrepl.LSN
+	applied map[string]bool
+}
+
+// NewDriver returns a driver partitioning rows by the tenant column,
+// it opens the tenant databases already in the files' directory.
+func NewDriver(main *sqlgen.SqliteDriver, mainDB *sql.DB, column string, files *Files) (*Driver, error) {
+	d := &Driver{
+		SqliteDriver: main,
+		main:         mainDB,
+		column:       column,
+		files:        files,
+		relations:    make(map[uint32]int),
+		types:        make(map[uint32]uint32),
+		keys:         make(map[uint32]bool),
+		tables:       make(map[uint32]string),
+		txs:          make(map[string]*sql.Tx),
+		applied:      make(map[string]bool),
+	}
+
+	names, err := files.Names()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		db, _, err := files.Open(name, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := d.copySchema(db); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+	}
+
+	return d, nil
+}
+
+// Apply executes the message's query on the databases the message's rows belong to.
+func (d *Driver) Apply(msg pglogrepl.Message, query string) error {
+	switch msg := msg.(type) {
+	case *pglogrepl.BeginMessage:
+		d.lsn = msg.FinalLSN
+	case *pglogrepl.RelationMessageV2:
+		d.relations[msg.RelationID] = -1
+		d.tables[msg.RelationID] = msg.RelationName
+
+		for i, col := range msg.Columns {
+			if col.Name == d.column {
+				d.relations[msg.RelationID] = i
+				d.types[msg.RelationID] = col.DataType
+				d.keys[msg.RelationID] = col.Flags&1 == 1
+			}
+		}
+
+		return d.all(query)
+	case *pglogrepl.InsertMessageV2:
+		return d.row(msg.RelationID, msg.Tuple, query)
+	case *pglogrepl.UpdateMessageV2:
+		return d.update(msg, query)
+	case *pglogrepl.DeleteMessageV2:
+		return d.row(msg.RelationID, msg.OldTuple, query)
+	case *pglogrepl.TruncateMessageV2:
+		return d.all(query)
+	case *pglogrepl.LogicalDecodingMessageV2:
+		// tables dropped upstream are dropped from every database,
+		// outside a transaction there's no commit to wait for.
+		if err := d.all(query); err != nil {
+			return err
+		}
+
+		if !msg.Transactional {
+			return d.commit()
+		}
+
+		return nil
+	case *pglogrepl.CommitMessage:
+		if err := d.commit(); err != nil {
+			return err
+		}
+
+		return d.Execute(query)
+	}
+
+	return d.Execute(query)
+}
+
+// row applies the query to the tenant of the row. The query applies to
+// every database when the row's tenant isn't known, e.g. a delete without
+// the tenant column in the replica identity.
+func (d *Driver) row(relationID uint32, tuple *pglogrepl.TupleData, query string) error {
+	idx, ok := d.relations[relationID]
+	if !ok || idx < 0 {
+		return d.Execute(query)
+	}
+
+	name, ok := d.tenant(relationID, tuple)
+	if !ok {
+		return d.all(query)
+	}
+
+	return d.exec(name, query)
+}
+
+// update applies the update to the tenant of the new row. When the update
+// may have changed the row's tenant, it's applied to the old tenant's
+// database too, or every database when the old tenant isn't known, and
+// the row is moved from there to the new tenant's database.
+func (d *Driver) update(msg *pglogrepl.UpdateMessageV2, query string) error {
+	idx, ok := d.relations[msg.RelationID]
+	if !ok || idx < 0 {
+		return d.Execute(query)
+	}
+
+	name, ok := d.tenant(msg.RelationID, msg.NewTuple)
+	if !ok {
+		return d.all(query)
+	}
+
+	if msg.OldTuple == nil && d.keys[msg.RelationID] {
+		// the key, and so the tenant, is unchanged
+		return d.exec(name, query)
+	}
+
+	var from []string
+
+	if old, ok := d.tenant(msg.RelationID, msg.OldTuple); ok {
+		from = []string{old}
+	} else {
+		names, err := d.files.Names()
+		if err != nil {
+			return err
+		}
+
+		from = names
+	}
+
+	if err := d.exec(name, query); err != nil {
+		return err
+	}
+
+	for _, old := range from {
+		if old == name {
+			continue
+		}
+
+		if err := d.exec(old, query); err != nil {
+			return err
+		}
+
+		if err := d.move(d.tables[msg.RelationID], old, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tenant returns the tenant of the row, false when it isn't known, e.g.
+// the tenant column is null or missing from the tuple.
+func (d *Driver) tenant(relationID uint32, tuple *pglogrepl.TupleData) (string, bool) {
+	idx := d.relations[relationID]
+
+	if tuple == nil || idx < 0 || idx >= len(tuple.Columns) {
+		return "", false
+	}
+
+	name, ok := pgoutput.TupleText(d.types[relationID], tuple.Columns[idx])
+
+	return string(name), ok
+}
+
+// move moves the table's rows of tenant to from the from tenant's
+// database to to's. The rows are copied as SQL literals, so their values
+// keep their storage classes.
+func (d *Driver) move(table, from, to string) error {
+	if d.applied[from] {
+		return nil
+	}
+
+	src, err := d.tx(from)
+	if err != nil {
+		return err
+	}
+
+	dst, err := d.tx(to)
+	if err != nil {
+		return err
+	}
+
+	cols, err := columns(src, table)
+	if err != nil {
+		return fmt.Errorf("tenant %q: %w", from, err)
+	}
+
+	names, quoted := make([]string, len(cols)), make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = sqlgen.QuoteIdentifier(col)
+		quoted[i] = "quote(" + sqlgen.QuoteIdentifier(col) + ")"
+	}
+
+	rows, err := src.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", strings.Join(quoted, ", "), sqlgen.QuoteIdentifier(table), sqlgen.QuoteIdentifier(d.column)), to)
+	if err != nil {
+		return fmt.Errorf("read moved rows of tenant %q: %w", from, err)
+	}
+
+	var inserts []string
+
+	for rows.Next() {
+		vals := make([]string, len(cols))
+		ptrs := make([]any, len(cols))
+
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+
+		if err := rows.Scan(ptrs...); err != nil {
+			rows.Close()
+			return fmt.Errorf("read moved rows of tenant %q: %w", from, err)
+		}
+
+		inserts = append(inserts, fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (%s);",
+			sqlgen.QuoteIdentifier(table), strings.Join(names, ", "), strings.Join(vals, ", ")))
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return fmt.Errorf("read moved rows of tenant %q: %w", from, err)
+	}
+
+	if len(inserts) == 0 {
+		return nil
+	}
+
+	for _, insert := range inserts {
+		if d.applied[to] {
+			// moved before the restart
+			break
+		}
+
+		if _, err := dst.Exec(insert); err != nil {
+			return fmt.Errorf("move row to tenant %q: %w", to, err)
+		}
+	}
+
+	if _, err := src.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", sqlgen.QuoteIdentifier(table), sqlgen.QuoteIdentifier(d.column)), to); err != nil {
+		return fmt.Errorf("move rows from tenant %q: %w", from, err)
+	}
+
+	return nil
+}
+
+// columns returns the table's column names.
+func columns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, fmt.Errorf("read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var out []string
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("read columns of %s: %w", table, err)
+		}
+
+		out = append(out, name)
+	}
+
+	return out, rows.Err()
+}
+
+// all applies the query to the main database and every tenant's.
+func (d *Driver) all(query string) error {
+	if err := d.Execute(query); err != nil {
+		return err
+	}
+
+	names, err := d.files.Names()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := d.exec(name, query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exec applies the query to the tenant's database, unless the tenant
+// already committed the transaction before a restart.
+func (d *Driver) exec(name, query string) error {
+	tx, err := d.tx(name)
+	if err != nil {
+		return err
+	}
+
+	if d.applied[name] {
+		return nil
+	}
+
+	if _, err := tx.Exec(query); err != nil {
+		return fmt.Errorf("apply to tenant %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// tx returns the tenant's transaction, beginning it on first use.
+func (d *Driver) tx(name string) (*sql.Tx, error) {
+	if tx, ok := d.txs[name]; ok {
+		return tx, nil
+	}
+
+	db, created, err := d.files.Open(name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if created {
+		log.Debug().Msgf("created database for tenant %q", name)
+
+		if err := d.copySchema(db); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", name, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin tenant %q: %w", name, err)
+	}
+
+	d.txs[name] = tx
+
+	if d.lsn == 0 {
+		return tx, nil
+	}
+
+	var pos string
+	if err := tx.QueryRow("SELECT coalesce(max(pos), '') FROM postgres_tenant_pos").Scan(&pos); err != nil {
+		return nil, fmt.Errorf("read position of tenant %q: %w", name, err)
+	}
+
+	if lsn, err := pglogrepl.ParseLSN(pos); err == nil && lsn >= d.lsn {
+		log.Debug().Msgf("tenant %q already committed %s", name, d.lsn)
+
+		d.applied[name] = true
+	}
+
+	return tx, nil
+}
+
+// commit commits the tenants' transactions, recording the position of
+// the transaction in each tenant's database.
+func (d *Driver) commit() error {
+	var errs []error
+
+	for name, tx := range d.txs {
+		if d.lsn != 0 && !d.applied[name] {
+			if _, err := tx.Exec("INSERT OR REPLACE INTO postgres_tenant_pos (id, pos) VALUES (1, ?)", d.lsn.String()); err != nil {
+				errs = append(errs, fmt.Errorf("record position of tenant %q: %w", name, err))
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			errs = append(errs, fmt.Errorf("commit tenant %q: %w", name, err))
+		}
+
+		delete(d.txs, name)
+		delete(d.applied, name)
+	}
+
+	d.lsn = 0
+
+	return errors.Join(errs...)
+}
+
+// CopyTable creates a table of the initial copy in the main database and
+// every tenant's.
+func (d *Driver) CopyTable(query string) error {
+	if err := d.Execute(query); err != nil {
+		return err
+	}
+
+	names, err := d.files.Names()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		db, _, err := d.files.Open(name, false)
+		if err != nil {
+			return err
+		}
+
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("create in tenant %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// CopyRow inserts a row of the initial copy into its tenant's database.
+// Rows of tables without the tenant column go to the main database, and
+// rows without a tenant to every database, like their changes.
+func (d *Driver) CopyRow(columns []sqlgen.ColDef, row []string, query string) error {
+	idx := slices.IndexFunc(columns, func(col sqlgen.ColDef) bool { return col.Name == d.column })
+	if idx < 0 || idx >= len(row) {
+		return d.Execute(query)
+	}
+
+	names := []string{row[idx]}
+
+	if row[idx] == "null" {
+		if err := d.Execute(query); err != nil {
+			return err
+		}
+
+		var err error
+		if names, err = d.files.Names(); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		db, created, err := d.files.Open(name, true)
+		if err != nil {
+			return err
+		}
+
+		if created {
+			log.Debug().Msgf("created database for tenant %q", name)
+
+			if err := d.copySchema(db); err != nil {
+				return fmt.Errorf("tenant %q: %w", name, err)
+			}
+		}
+
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("copy to tenant %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// copySchema creates the main database's tables and indexes that are
+// missing from the tenant's database.
+func (d *Driver) copySchema(db *sql.DB) error {
+	existing := make(map[string]bool)
+
+	rows, err := db.Query("SELECT name FROM sqlite_schema")
+	if err != nil {
+		return fmt.Errorf("read schema: %w", err)
+	}
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("read schema: %w", err)
+		}
+
+		existing[name] = true
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return fmt.Errorf("read schema: %w", err)
+	}
+
+	rows, err = d.main.QueryContext(context.Background(), `SELECT name, tbl_name, sql FROM sqlite_schema
+		WHERE type IN ('table', 'index') AND sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+		ORDER BY type = 'index'`)
+	if err != nil {
+		return fmt.Errorf("read main schema: %w", err)
+	}
+
+	var stmts []string
+
+	for rows.Next() {
+		var name, table, stmt string
+		if err := rows.Scan(&name, &table, &stmt); err != nil {
+			rows.Close()
+			return fmt.Errorf("read main schema: %w", err)
+		}
+
+		// the replication's own state is only in the main database
+		if !existing[name] && !slices.Contains(sqlgen.NodeTables, table) {
+			stmts = append(stmts, sqlgen.IfNotExists(stmt))
+		}
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return fmt.Errorf("read main schema: %w", err)
+	}
+
+	// the position of the last transaction committed to the tenant
+	stmts = append(stmts, "CREATE TABLE IF NOT EXISTS postgres_tenant_pos (id integer PRIMARY KEY, pos text)")
+
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("copy schema: %w", err)
+		}
+	}
+
+	return nil
+}
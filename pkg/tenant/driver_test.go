@@ -0,0 +1,283 @@
+package tenant_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/gemini-kenshi/pgreplsql/pkg/tenant"
+	"github.com/jackc/pglogrepl"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func insert(tenantID, name string) *pglogrepl.InsertMessageV2 {
+	return &pglogrepl.InsertMessageV2{
+		InsertMessage: pglogrepl.InsertMessage{RelationID: 1, Tuple: tuple(tenantID, name)},
+	}
+}
+
+func names(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query("SELECT name FROM names ORDER BY name")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var out []string
+
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+
+		out = append(out, name)
+	}
+
+	return out
+}
+
+type driver struct {
+	*tenant.Driver
+
+	main  *sql.DB
+	files *tenant.Files
+	gen   *sqlgen.Sqlite
+}
+
+func newDriver(t *testing.T) *driver {
+	dir := t.TempDir()
+
+	main, err := sql.Open("sqlite3", filepath.Join(dir, "main.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { main.Close() })
+
+	main.SetMaxOpenConns(1)
+
+	cfg := sqlgen.SqliteConfig{SourceDB: "app", Plugin: "pgoutput", Publication: "sqledge"}
+	mainDriver := sqlgen.NewSqliteDriver(cfg, main)
+	require.NoError(t, mainDriver.InitPositionTable())
+
+	files := tenant.NewFiles(filepath.Join(dir, "tenants"), "sqlite3")
+	t.Cleanup(func() { files.Close() })
+
+	d, err := tenant.NewDriver(mainDriver, main, "tenant_id", files)
+	require.NoError(t, err)
+
+	return &driver{Driver: d, main: main, files: files, gen: sqlgen.NewSqlite(cfg, map[string]map[string]sqlgen.ColDef{})}
+}
+
+// apply generates the messages' sql and applies it.
+func (d *driver) apply(t *testing.T, msgs ...pglogrepl.Message) {
+	for _, msg := range msgs {
+		var (
+			query string
+			err   error
+		)
+
+		switch msg := msg.(type) {
+		case *pglogrepl.BeginMessage:
+			query, err = d.gen.Begin(msg)
+		case *pglogrepl.RelationMessageV2:
+			query, err = d.gen.Relation(msg)
+		case *pglogrepl.InsertMessageV2:
+			query, err = d.gen.Insert(msg)
+		case *pglogrepl.UpdateMessageV2:
+			query, err = d.gen.Update(msg)
+		case *pglogrepl.CommitMessage:
+			query, err = d.gen.Commit(msg)
+		}
+
+		require.NoError(t, err)
+		require.NoError(t, d.Apply(msg, query))
+	}
+}
+
+func (d *driver) names(t *testing.T, name string) []string {
+	db, _, err := d.files.Open(name, false)
+	require.NoError(t, err)
+
+	return names(t, db)
+}
+
+func tuple(tenantID, name string) *pglogrepl.TupleData {
+	return &pglogrepl.TupleData{
+		Columns: []*pglogrepl.TupleDataColumn{
+			{DataType: 't', Data: []byte(tenantID)},
+			{DataType: 't', Data: []byte(name)},
+		},
+	}
+}
+
+func TestDriver(t *testing.T) {
+	d := newDriver(t)
+
+	d.apply(t,
+		&pglogrepl.BeginMessage{FinalLSN: 100},
+		&pglogrepl.RelationMessageV2{
+			RelationMessage: pglogrepl.RelationMessage{
+				RelationID:   1,
+				Namespace:    "public",
+				RelationName: "names",
+				Columns: []*pglogrepl.RelationMessageColumn{
+					{Flags: 1, Name: "tenant_id", DataType: 25},
+					{Flags: 1, Name: "name", DataType: 25},
+				},
+			},
+		},
+		insert("acme", "a"),
+		insert("globex", "g"),
+		insert("acme", "b"),
+		&pglogrepl.CommitMessage{CommitLSN: 100, TransactionEndLSN: 120},
+	)
+
+	assert.Equal(t, []string{"a", "b"}, d.names(t, "acme"))
+	assert.Equal(t, []string{"g"}, d.names(t, "globex"))
+
+	// the main database keeps the schema and position, but not the rows
+	assert.Empty(t, names(t, d.main))
+
+	pos, err := d.Pos()
+	require.NoError(t, err)
+	assert.Equal(t, "0/64", pos)
+
+	_, _, err = d.files.Open("initech", false)
+	assert.ErrorIs(t, err, tenant.ErrUnknownTenant)
+}
+
+func TestPath(t *testing.T) {
+	assert.Equal(t, filepath.Join("dir", "acme.db"), tenant.Path("dir", "acme"))
+	assert.Equal(t, filepath.Join("dir", "x-2e2e2f65746322.db"), tenant.Path("dir", `../etc"`))
+}
+
+func TestDriverMove(t *testing.T) {
+	d := newDriver(t)
+
+	relation := &pglogrepl.RelationMessageV2{
+		RelationMessage: pglogrepl.RelationMessage{
+			RelationID:   1,
+			Namespace:    "public",
+			RelationName: "names",
+			Columns: []*pglogrepl.RelationMessageColumn{
+				{Name: "tenant_id", DataType: 25},
+				{Flags: 1, Name: "name", DataType: 25},
+			},
+		},
+	}
+
+	d.apply(t,
+		&pglogrepl.BeginMessage{FinalLSN: 100},
+		relation,
+		insert("acme", "a"),
+		insert("acme", "b"),
+		insert("globex", "g"),
+		&pglogrepl.CommitMessage{CommitLSN: 100},
+	)
+
+	// the old tenant isn't in the replica identity
+	d.apply(t,
+		&pglogrepl.BeginMessage{FinalLSN: 200},
+		&pglogrepl.UpdateMessageV2{UpdateMessage: pglogrepl.UpdateMessage{RelationID: 1, NewTuple: tuple("globex", "a")}},
+		&pglogrepl.CommitMessage{CommitLSN: 200},
+	)
+
+	assert.Equal(t, []string{"b"}, d.names(t, "acme"))
+	assert.Equal(t, []string{"a", "g"}, d.names(t, "globex"))
+
+	// it is with replica identity full, and the row moves to a new tenant
+	d.apply(t,
+		&pglogrepl.BeginMessage{FinalLSN: 300},
+		&pglogrepl.UpdateMessageV2{UpdateMessage: pglogrepl.UpdateMessage{
+			RelationID:   1,
+			OldTupleType: pglogrepl.UpdateMessageTupleTypeOld,
+			OldTuple:     tuple("globex", "g"),
+			NewTuple:     tuple("initech", "g"),
+		}},
+		&pglogrepl.CommitMessage{CommitLSN: 300},
+	)
+
+	assert.Equal(t, []string{"a"}, d.names(t, "globex"))
+	assert.Equal(t, []string{"g"}, d.names(t, "initech"))
+	assert.Equal(t, []string{"b"}, d.names(t, "acme"))
+}
+
+func TestDriverReapply(t *testing.T) {
+	d := newDriver(t)
+
+	relation := &pglogrepl.RelationMessageV2{
+		RelationMessage: pglogrepl.RelationMessage{
+			RelationID:   1,
+			Namespace:    "public",
+			RelationName: "names",
+			Columns: []*pglogrepl.RelationMessageColumn{
+				{Flags: 1, Name: "tenant_id", DataType: 25},
+				{Flags: 1, Name: "name", DataType: 25},
+			},
+		},
+	}
+
+	d.apply(t,
+		&pglogrepl.BeginMessage{FinalLSN: 100},
+		relation,
+		insert("acme", "a"),
+		&pglogrepl.CommitMessage{CommitLSN: 100},
+	)
+
+	// the transaction is applied again after a crash before the main
+	// database recorded it, acme already has it but globex doesn't
+	d.apply(t,
+		&pglogrepl.BeginMessage{FinalLSN: 100},
+		insert("acme", "a"),
+		insert("globex", "g"),
+		&pglogrepl.CommitMessage{CommitLSN: 100},
+	)
+
+	assert.Equal(t, []string{"a"}, d.names(t, "acme"))
+	assert.Equal(t, []string{"g"}, d.names(t, "globex"))
+
+	d.apply(t,
+		&pglogrepl.BeginMessage{FinalLSN: 200},
+		insert("acme", "b"),
+		&pglogrepl.CommitMessage{CommitLSN: 200},
+	)
+
+	assert.Equal(t, []string{"a", "b"}, d.names(t, "acme"))
+}
+
+func TestDriverCopy(t *testing.T) {
+	d := newDriver(t)
+
+	columns := []sqlgen.ColDef{
+		{Name: "tenant_id", Type: sqlgen.PgColTypeText},
+		{Name: "name", Type: sqlgen.PgColTypeText},
+	}
+
+	// acme's database exists before the table is copied
+	d.apply(t,
+		&pglogrepl.BeginMessage{FinalLSN: 100},
+		&pglogrepl.RelationMessageV2{RelationMessage: pglogrepl.RelationMessage{
+			RelationID:   2,
+			Namespace:    "public",
+			RelationName: "other",
+			Columns:      []*pglogrepl.RelationMessageColumn{{Flags: 1, Name: "tenant_id", DataType: 25}},
+		}},
+		&pglogrepl.InsertMessageV2{InsertMessage: pglogrepl.InsertMessage{
+			RelationID: 2,
+			Tuple:      &pglogrepl.TupleData{Columns: []*pglogrepl.TupleDataColumn{{DataType: 't', Data: []byte("acme")}}},
+		}},
+		&pglogrepl.CommitMessage{CommitLSN: 100},
+	)
+
+	create, err := d.gen.CopyCreateTable("public", "names", columns)
+	require.NoError(t, err)
+	require.NoError(t, d.CopyTable(create))
+
+	for _, row := range [][]string{{"acme", "a"}, {"globex", "g"}, {"acme", "b"}} {
+		query, err := d.gen.InsertCopyRow("public", "names", columns, row)
+		require.NoError(t, err)
+		require.NoError(t, d.CopyRow(columns, row, query))
+	}
+
+	assert.Equal(t, []string{"a", "b"}, d.names(t, "acme"))
+	assert.Equal(t, []string{"g"}, d.names(t, "globex"))
+	assert.Empty(t, names(t, d.main))
+}
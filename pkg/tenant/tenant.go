@@ -0,0 +1,145 @@
+// Package tenant partitions the replicated rows of a multi-tenant upstream
+// across local database files, one per tenant, by a tenant column.
+package tenant
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownTenant is returned when a tenant has no local database.
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+var plainName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+const ext = ".db"
+
+// Path returns the tenant's database file in dir. Tenant names that
+// aren't safe as a file name are hex encoded.
+func Path(dir, name string) string {
+	if !plainName.MatchString(name) {
+		name = "x-" + hex.EncodeToString([]byte(name))
+	}
+
+	return filepath.Join(dir, name+ext)
+}
+
+// nameOf is the tenant name of a database file in the directory.
+func nameOf(file string) (string, bool) {
+	name, ok := strings.CutSuffix(filepath.Base(file), ext)
+	if !ok {
+		return "", false
+	}
+
+	if encoded, ok := strings.CutPrefix(name, "x-"); ok {
+		b, err := hex.DecodeString(encoded)
+		if err != nil {
+			return "", false
+		}
+
+		return string(b), true
+	}
+
+	return name, plainName.MatchString(name)
+}
+
+// Files keeps the tenants' databases open.
+type Files struct {
+	dir      string
+	driver   string
+	readOnly bool
+
+	mu  sync.Mutex
+	dbs map[string]*sql.DB
+}
+
+// NewFiles opens the databases in dir with the sql driver.
+func NewFiles(dir, driverName string) *Files {
+	return &Files{dir: dir, driver: driverName, dbs: make(map[string]*sql.DB)}
+}
+
+// NewReadOnlyFiles opens the databases in dir read only, for serving
+// reads. Databases aren't created for tenants without one.
+func NewReadOnlyFiles(dir, driverName string) *Files {
+	return &Files{dir: dir, driver: driverName, readOnly: true, dbs: make(map[string]*sql.DB)}
+}
+
+// Names returns the tenants with a database in the directory.
+func (f *Files) Names() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(f.dir, "*"+ext))
+	if err != nil {
+		return nil, fmt.Errorf("list tenants: %w", err)
+	}
+
+	var names []string
+
+	for _, m := range matches {
+		if name, ok := nameOf(m); ok {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Open returns the tenant's database. Unless create is set it fails with
+// ErrUnknownTenant when the tenant has no database, created reports
+// whether the database file was created.
+func (f *Files) Open(name string, create bool) (db *sql.DB, created bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if db, ok := f.dbs[name]; ok {
+		return db, false, nil
+	}
+
+	path := Path(f.dir, name)
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if !create || f.readOnly {
+			return nil, false, fmt.Errorf("%w: %q", ErrUnknownTenant, name)
+		}
+
+		if err := os.MkdirAll(f.dir, 0o755); err != nil {
+			return nil, false, fmt.Errorf("create tenant dir: %w", err)
+		}
+
+		created = true
+	}
+
+	dsn := path
+	if f.readOnly {
+		dsn = "file:" + path + "?mode=ro"
+	}
+
+	db, err = sql.Open(f.driver, dsn)
+	if err != nil {
+		return nil, false, fmt.Errorf("open tenant %q: %w", name, err)
+	}
+
+	f.dbs[name] = db
+
+	return db, created, nil
+}
+
+// Close closes the open databases.
+func (f *Files) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var errs []error
+
+	for name, db := range f.dbs {
+		errs = append(errs, db.Close())
+		delete(f.dbs, name)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,20 @@
+package verify
+
+import (
+	"context"
+	"database/sql"
+)
+
+// NewTable returns the table, with an integer key split into ranges
+// when integer is set.
+func NewTable(schema, name string, key []string, columns []Column, integer bool) *Table {
+	return &Table{Schema: schema, Name: name, Key: key, Columns: columns, integer: integer}
+}
+
+func (t *Table) Ranges(ctx context.Context, upstream, local *sql.DB, chunk int64) ([]Range, error) {
+	return t.ranges(ctx, upstream, local, chunk)
+}
+
+func (t *Table) LocalHash(ctx context.Context, db *sql.DB, r Range) (string, error) {
+	return t.localHash(ctx, db, r)
+}
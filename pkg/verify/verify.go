@@ -0,0 +1,462 @@
+// Package verify compares the local tables with the upstream's, a range of
+// keys at a time, and repairs the ranges that diverged by copying them
+// from the upstream again.
+package verify
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/jackc/pgx/v5"
+)
+
+// null is how a null column is written in a row's text.
+const null = `\N`
+
+// Range is a range of a table's keys, from Low to High inclusive. Whole
+// ranges cover the entire table, for tables without a single integer key.
+type Range struct {
+	Table     string
+	Low, High int64
+	Whole     bool
+}
+
+func (r Range) String() string {
+	if r.Whole {
+		return r.Table
+	}
+
+	return fmt.Sprintf("%s [%d, %d]", r.Table, r.Low, r.High)
+}
+
+// Table is a local table and the upstream's primary key of it.
+type Table struct {
+	Schema  string
+	Name    string
+	Key     []string
+	Columns []Column
+
+	// integer is set when the key is a single integer column,
+	// which is split into ranges.
+	integer bool
+}
+
+// Column is a column of the local table.
+type Column struct {
+	Name string
+	Type sqlgen.ColType
+}
+
+// Describe reads the local table's columns and the upstream table's
+// primary key.
+func Describe(ctx context.Context, upstream, local *sql.DB, schema, name string) (*Table, error) {
+	t := &Table{Schema: schema, Name: name}
+
+	rows, err := local.QueryContext(ctx, "SELECT name, lower(type) FROM pragma_table_info(?) ORDER BY cid", name)
+	if err != nil {
+		return nil, fmt.Errorf("read local columns: %w", err)
+	}
+
+	for rows.Next() {
+		var c Column
+		if err := rows.Scan(&c.Name, &c.Type); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("read local columns: %w", err)
+		}
+
+		t.Columns = append(t.Columns, c)
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, fmt.Errorf("read local columns: %w", err)
+	}
+
+	if len(t.Columns) == 0 {
+		return nil, fmt.Errorf("local table %q not found", name)
+	}
+
+	rows, err = upstream.QueryContext(ctx, `SELECT a.attname, a.atttypid IN ('int2'::regtype, 'int4'::regtype, 'int8'::regtype)
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = format('%I.%I', $1::text, $2::text)::regclass AND i.indisprimary
+		ORDER BY array_position(i.indkey, a.attnum)`, schema, name)
+	if err != nil {
+		return nil, fmt.Errorf("read upstream primary key: %w", err)
+	}
+
+	var integer bool
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key, &integer); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("read upstream primary key: %w", err)
+		}
+
+		t.Key = append(t.Key, key)
+	}
+
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, fmt.Errorf("read upstream primary key: %w", err)
+	}
+
+	if len(t.Key) == 0 {
+		return nil, fmt.Errorf("upstream table %s.%s has no primary key", schema, name)
+	}
+
+	t.integer = len(t.Key) == 1 && integer
+
+	return t, nil
+}
+
+// Diff returns the ranges of the table, of up to chunk keys, whose rows
+// differ between the upstream and the local database.
+func Diff(ctx context.Context, upstream, local *sql.DB, t *Table, chunk int64) ([]Range, error) {
+	ranges, err := t.ranges(ctx, upstream, local, chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	var diverged []Range
+
+	for _, r := range ranges {
+		want, err := t.upstreamHash(ctx, upstream, r)
+		if err != nil {
+			return nil, fmt.Errorf("hash upstream %s: %w", r, err)
+		}
+
+		got, err := t.localHash(ctx, local, r)
+		if err != nil {
+			return nil, fmt.Errorf("hash local %s: %w", r, err)
+		}
+
+		if want != got {
+			diverged = append(diverged, r)
+		}
+	}
+
+	return diverged, nil
+}
+
+// Repair replaces the local rows of the range with the upstream's, in a
+// single local transaction, and returns the number of rows copied.
+func Repair(ctx context.Context, upstream, local *sql.DB, t *Table, r Range) (int, error) {
+	rows, err := upstream.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM %s%s", t.upstreamColumns(", "), t.upstreamName(), t.upstreamWhere(r)),
+		t.args(r)...)
+	if err != nil {
+		return 0, fmt.Errorf("read upstream %s: %w", r, err)
+	}
+	defer rows.Close()
+
+	tx, err := local.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+t.localName()+t.localWhere(r), t.args(r)...); err != nil {
+		return 0, fmt.Errorf("delete local %s: %w", r, err)
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		t.localName(), t.localColumns(), strings.TrimSuffix(strings.Repeat("?, ", len(t.Columns)), ", "))
+
+	var n int
+
+	for rows.Next() {
+		text := make([]sql.NullString, len(t.Columns))
+		dest := make([]any, len(t.Columns))
+
+		for i := range text {
+			dest[i] = &text[i]
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return 0, fmt.Errorf("read upstream %s: %w", r, err)
+		}
+
+		values := make([]any, len(t.Columns))
+
+		for i, v := range text {
+			values[i], err = t.Columns[i].value(v)
+			if err != nil {
+				return 0, fmt.Errorf("column %s: %w", t.Columns[i].Name, err)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, insert, values...); err != nil {
+			return 0, fmt.Errorf("insert local %s: %w", r, err)
+		}
+
+		n++
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("read upstream %s: %w", r, err)
+	}
+
+	return n, tx.Commit()
+}
+
+// ranges splits the union of the upstream's and local database's keys
+// into ranges of chunk keys.
+func (t *Table) ranges(ctx context.Context, upstream, local *sql.DB, chunk int64) ([]Range, error) {
+	if !t.integer || chunk <= 0 {
+		return []Range{{Table: t.Name, Whole: true}}, nil
+	}
+
+	var low, high sql.NullInt64
+
+	for _, side := range []struct {
+		db    *sql.DB
+		query string
+	}{
+		{upstream, fmt.Sprintf("SELECT min(%[1]s), max(%[1]s) FROM %[2]s", pgx.Identifier{t.Key[0]}.Sanitize(), t.upstreamName())},
+		{local, fmt.Sprintf("SELECT min(%[1]s), max(%[1]s) FROM %[2]s", sqlgen.QuoteIdentifier(t.Key[0]), t.localName())},
+	} {
+		var lo, hi sql.NullInt64
+		if err := side.db.QueryRowContext(ctx, side.query).Scan(&lo, &hi); err != nil {
+			return nil, fmt.Errorf("read key range of %s: %w", t.Name, err)
+		}
+
+		if lo.Valid && (!low.Valid || lo.Int64 < low.Int64) {
+			low = lo
+		}
+
+		if hi.Valid && (!high.Valid || hi.Int64 > high.Int64) {
+			high = hi
+		}
+	}
+
+	if !low.Valid {
+		return nil, nil
+	}
+
+	var ranges []Range
+
+	for lo := low.Int64; lo <= high.Int64; lo += chunk {
+		hi := lo + chunk - 1
+		if hi > high.Int64 || hi < lo {
+			hi = high.Int64
+		}
+
+		ranges = append(ranges, Range{Table: t.Name, Low: lo, High: hi})
+
+		if hi == high.Int64 {
+			break
+		}
+	}
+
+	return ranges, nil
+}
+
+func (t *Table) upstreamHash(ctx context.Context, db *sql.DB, r Range) (string, error) {
+	query := fmt.Sprintf(`SELECT coalesce(md5(string_agg(%s, E'\n' ORDER BY %s)), '') FROM %s%s`,
+		t.upstreamColumns(` || E'\t' || `), t.upstreamOrder(), t.upstreamName(), t.upstreamWhere(r))
+
+	var hash string
+	if err := db.QueryRowContext(ctx, query, t.args(r)...).Scan(&hash); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+func (t *Table) localHash(ctx context.Context, db *sql.DB, r Range) (string, error) {
+	rows, err := db.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s", t.localColumns(), t.localName(), t.localWhere(r), t.localOrder()),
+		t.args(r)...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	h := md5.New()
+	values := make([]any, len(t.Columns))
+	dest := make([]any, len(t.Columns))
+
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	var n int
+
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+
+		if n > 0 {
+			h.Write([]byte{'\n'})
+		}
+
+		h.Write([]byte(RowText(t.Columns, values)))
+		n++
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if n == 0 {
+		return "", nil
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RowText writes a local row the way the upstream's row is written when
+// it's hashed: the columns separated by tabs, null as \N, reals in their
+// shortest form and blobs in hex.
+func RowText(columns []Column, values []any) string {
+	text := make([]string, len(values))
+
+	for i, v := range values {
+		var blob bool
+		if i < len(columns) {
+			blob = columns[i].Type == sqlgen.SQLiteColTypeBlob
+		}
+
+		switch v := v.(type) {
+		case nil:
+			text[i] = null
+		case int64:
+			text[i] = strconv.FormatInt(v, 10)
+		case float64:
+			text[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		case []byte:
+			if blob {
+				text[i] = hex.EncodeToString(v)
+			} else {
+				text[i] = string(v)
+			}
+		case string:
+			if blob {
+				// replicated byteas are written in postgres' hex format
+				text[i] = strings.TrimPrefix(v, `\x`)
+			} else {
+				text[i] = v
+			}
+		default:
+			text[i] = fmt.Sprint(v)
+		}
+	}
+
+	return strings.Join(text, "\t")
+}
+
+// upstreamColumns selects the columns as the text RowText writes the
+// local columns as, joined by sep.
+func (t *Table) upstreamColumns(sep string) string {
+	cols := make([]string, len(t.Columns))
+
+	for i, c := range t.Columns {
+		name := pgx.Identifier{c.Name}.Sanitize()
+
+		// format %s writes values with their output function, as
+		// they're replicated, e.g. booleans as t and f.
+		text := fmt.Sprintf("format('%%s', %s)", name)
+
+		switch c.Type {
+		case sqlgen.SQLiteColTypeReal:
+			text = name + "::float8::text"
+		case sqlgen.SQLiteColTypeBlob:
+			text = fmt.Sprintf("encode(%s, 'hex')", name)
+		}
+
+		cols[i] = fmt.Sprintf(`CASE WHEN %s IS NULL THEN '%s' ELSE %s END`, name, null, text)
+	}
+
+	return strings.Join(cols, sep)
+}
+
+// upstreamOrder and localOrder order the rows the same way on both sides,
+// integer keys by value and other keys by the bytes of their text.
+func (t *Table) upstreamOrder() string {
+	if t.integer {
+		return pgx.Identifier{t.Key[0]}.Sanitize()
+	}
+
+	keys := make([]string, len(t.Key))
+	for i, k := range t.Key {
+		keys[i] = fmt.Sprintf(`format('%%s', %s) COLLATE "C"`, pgx.Identifier{k}.Sanitize())
+	}
+
+	return strings.Join(keys, ", ")
+}
+
+func (t *Table) localOrder() string {
+	if t.integer {
+		return sqlgen.QuoteIdentifier(t.Key[0])
+	}
+
+	keys := make([]string, len(t.Key))
+	for i, k := range t.Key {
+		keys[i] = fmt.Sprintf("CAST(%s AS TEXT)", sqlgen.QuoteIdentifier(k))
+	}
+
+	return strings.Join(keys, ", ")
+}
+
+func (t *Table) upstreamName() string {
+	return pgx.Identifier{t.Schema, t.Name}.Sanitize()
+}
+
+func (t *Table) localName() string {
+	return sqlgen.QuoteIdentifier(t.Name)
+}
+
+// localColumns lists the local columns, quoted, in the table's order.
+func (t *Table) localColumns() string {
+	names := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		names[i] = sqlgen.QuoteIdentifier(c.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func (t *Table) upstreamWhere(r Range) string {
+	if r.Whole {
+		return ""
+	}
+
+	return fmt.Sprintf(" WHERE %s BETWEEN $1 AND $2", pgx.Identifier{t.Key[0]}.Sanitize())
+}
+
+func (t *Table) localWhere(r Range) string {
+	if r.Whole {
+		return ""
+	}
+
+	return fmt.Sprintf(" WHERE %s BETWEEN ? AND ?", sqlgen.QuoteIdentifier(t.Key[0]))
+}
+
+func (t *Table) args(r Range) []any {
+	if r.Whole {
+		return nil
+	}
+
+	return []any{r.Low, r.High}
+}
+
+// value converts the upstream's text of the column to the local value.
+func (c Column) value(text sql.NullString) (any, error) {
+	if !text.Valid || text.String == null {
+		return nil, nil
+	}
+
+	if c.Type == sqlgen.SQLiteColTypeBlob {
+		return hex.DecodeString(text.String)
+	}
+
+	return text.String, nil
+}
@@ -0,0 +1,145 @@
+package verify_test
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/gemini-kenshi/pgreplsql/pkg/verify"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// columns of the "Order Items" table, whose names need quoting.
+var columns = []verify.Column{
+	{Name: "Item ID", Type: sqlgen.SQLiteColTypeInteger},
+	{Name: "name", Type: sqlgen.SQLiteColTypeText},
+}
+
+func newDB(t *testing.T, schema string, stmts ...string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	// one connection, so the attached schema is there for every query
+	db.SetMaxOpenConns(1)
+
+	if schema != "" {
+		_, err := db.Exec("ATTACH DATABASE ':memory:' AS " + schema)
+		require.NoError(t, err)
+	}
+
+	for _, stmt := range stmts {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err, stmt)
+	}
+
+	return db
+}
+
+// newUpstream returns a database with the table in the public schema,
+// standing in for the upstream where the queries are the same in SQLite.
+func newUpstream(t *testing.T, stmts ...string) *sql.DB {
+	t.Helper()
+
+	return newDB(t, "public", append([]string{`CREATE TABLE public."Order Items" ("Item ID" integer primary key, name text)`}, stmts...)...)
+}
+
+func newLocal(t *testing.T, stmts ...string) *sql.DB {
+	t.Helper()
+
+	return newDB(t, "", append([]string{`CREATE TABLE "Order Items" ("Item ID" integer primary key, name text)`}, stmts...)...)
+}
+
+func TestRanges(t *testing.T) {
+	ctx := context.Background()
+	table := verify.NewTable("public", "Order Items", []string{"Item ID"}, columns, true)
+
+	// the keys of both sides are covered
+	upstream := newUpstream(t, `INSERT INTO public."Order Items" VALUES (3, 'a'), (12, 'b')`)
+	local := newLocal(t, `INSERT INTO "Order Items" VALUES (1, 'a'), (7, 'b')`)
+
+	ranges, err := table.Ranges(ctx, upstream, local, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []verify.Range{
+		{Table: "Order Items", Low: 1, High: 5},
+		{Table: "Order Items", Low: 6, High: 10},
+		{Table: "Order Items", Low: 11, High: 12},
+	}, ranges)
+
+	ranges, err = table.Ranges(ctx, newUpstream(t), newLocal(t), 5)
+	require.NoError(t, err)
+	assert.Empty(t, ranges)
+
+	// tables without an integer key are compared whole
+	text := verify.NewTable("public", "Order Items", []string{"name"}, columns, false)
+
+	ranges, err = text.Ranges(ctx, upstream, local, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []verify.Range{{Table: "Order Items", Whole: true}}, ranges)
+}
+
+func TestLocalHash(t *testing.T) {
+	ctx := context.Background()
+	table := verify.NewTable("public", "Order Items", []string{"Item ID"}, columns, true)
+
+	local := newLocal(t, `INSERT INTO "Order Items" VALUES (2, NULL), (1, 'a'), (9, 'c')`)
+
+	// the rows in key order, as the upstream's string_agg writes them
+	sum := md5.Sum([]byte(strings.Join([]string{"1\ta", "2\t\\N"}, "\n")))
+
+	hash, err := table.LocalHash(ctx, local, verify.Range{Table: "Order Items", Low: 1, High: 5})
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), hash)
+
+	// empty ranges hash as the upstream's coalesce of no rows
+	hash, err = table.LocalHash(ctx, local, verify.Range{Table: "Order Items", Low: 3, High: 5})
+	require.NoError(t, err)
+	assert.Empty(t, hash)
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	table := verify.NewTable("public", "Order Items", []string{"Item ID"}, columns, true)
+
+	upstream := newUpstream(t, `INSERT INTO public."Order Items" VALUES (1, 'a'), (2, NULL), (3, 'c'), (8, 'h')`)
+	local := newLocal(t, `INSERT INTO "Order Items" VALUES (1, 'stale'), (4, 'deleted'), (8, 'outside')`)
+
+	n, err := verify.Repair(ctx, upstream, local, table, verify.Range{Table: "Order Items", Low: 1, High: 5})
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	rows, err := local.Query(`SELECT "Item ID", name FROM "Order Items" ORDER BY "Item ID"`)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var got []string
+
+	for rows.Next() {
+		var id int64
+		var name sql.NullString
+		require.NoError(t, rows.Scan(&id, &name))
+
+		got = append(got, verify.RowText(columns, []any{id, nullable(name)}))
+	}
+
+	require.NoError(t, rows.Err())
+
+	// the range is replaced, the rows outside it are left alone
+	assert.Equal(t, []string{"1\ta", "2\t\\N", "3\tc", "8\toutside"}, got)
+}
+
+func nullable(s sql.NullString) any {
+	if !s.Valid {
+		return nil
+	}
+
+	return s.String
+}
@@ -13,8 +13,13 @@ import (
 	"time"
 
 	"github.com/gemini-kenshi/pgreplsql/pkg/config"
+	"github.com/gemini-kenshi/pgreplsql/pkg/leader"
+	"github.com/gemini-kenshi/pgreplsql/pkg/lint"
 	"github.com/gemini-kenshi/pgreplsql/pkg/queryproxy"
 	"github.com/gemini-kenshi/pgreplsql/pkg/replicate"
+	"github.com/gemini-kenshi/pgreplsql/pkg/sqlgen"
+	"github.com/gemini-kenshi/pgreplsql/pkg/verify"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/mattn/go-sqlite3"
@@ -134,6 +139,109 @@ func TestInitialCopy(t *testing.T) {
 	wg.Wait()
 }
 
+func TestMilestones(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+	cfg.Replication.MilestoneTable = "sqledge_milestones"
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	execStatements(
+		t,
+		upstream,
+		"CREATE TABLE sqledge_milestones (node text, event text, lsn pg_lsn, at timestamptz DEFAULT now());",
+		"CREATE TABLE names (id serial not null primary key, name text);",
+		"INSERT INTO names (name) VALUES ('hello')",
+	)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		if err := replicate.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+			assert.NoError(t, err)
+		}
+	}()
+
+	<-time.After(2 * time.Second)
+
+	var node, event string
+
+	err := upstream.QueryRow("SELECT node, event FROM sqledge_milestones").Scan(&node, &event)
+	assert.NoError(t, err)
+	assert.Equal(t, "sqledge_test_slot", node)
+	assert.Equal(t, "snapshot", event)
+
+	cancel()
+	wg.Wait()
+}
+
+func TestDeliveryRestart(t *testing.T) {
+	t.Parallel()
+
+	for _, delivery := range []string{"exactly-once", "at-least-once"} {
+		delivery := delivery
+
+		t.Run(delivery, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+
+			container := newDB(ctx, t)
+			upstream := newSQLConn(ctx, t, container)
+			cfg := defaultConfig(ctx, t, container)
+			cfg.Replication.Delivery = delivery
+			// the slot outlives the first run
+			cfg.Replication.Temporary = false
+			local := newSQLiteConn(ctx, t, cfg)
+
+			execStatements(
+				t,
+				upstream,
+				"CREATE TABLE names (id serial not null primary key, name text);",
+				"INSERT INTO names (name) VALUES ('hello')",
+			)
+
+			run := func(statements ...string) {
+				ctx, cancel := context.WithCancel(ctx)
+
+				wg := sync.WaitGroup{}
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+					// a transaction applied twice fails on the primary key
+					if err := replicate.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+						assert.NoError(t, err)
+					}
+				}()
+
+				<-time.After(2 * time.Second)
+
+				execStatements(t, upstream, statements...)
+
+				<-time.After(2 * time.Second)
+
+				cancel()
+				wg.Wait()
+			}
+
+			run("INSERT INTO names (name) VALUES ('world')")
+			run("INSERT INTO names (name) VALUES ('again')")
+
+			assert.Equal(t, []nameRow{
+				{id: 1, name: "hello"},
+				{id: 2, name: "world"},
+				{id: 3, name: "again"},
+			}, readAllNameRows(t, local))
+		})
+	}
+}
+
 func TestWriteForwarding(t *testing.T) {
 	t.Parallel()
 	ctx := context.Background()
@@ -205,6 +313,523 @@ func TestWriteForwarding(t *testing.T) {
 	wg.Wait()
 }
 
+func TestWriteBatching(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+	cfg.Proxy.WriteBatchSize = 50
+
+	execStatements(t, upstream, "CREATE TABLE names (id serial not null primary key, name text);")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := queryproxy.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+		assert.NoError(t, err)
+	}
+
+	<-time.After(1 * time.Second)
+
+	conn, err := pgx.Connect(ctx, fmt.Sprintf(
+		"user=postgres host=0.0.0.0 port=%d database=%s sslmode=disable",
+		cfg.Proxy.Port,
+		cfg.Upstream.DBName,
+	))
+	assert.NoError(t, err)
+	defer conn.Close(ctx)
+
+	batch := &pgx.Batch{}
+	for i := 1; i <= 120; i++ {
+		batch.Queue("INSERT INTO names (id, name) VALUES ($1, $2)", i, fmt.Sprintf("name %d", i))
+	}
+
+	assert.NoError(t, conn.SendBatch(ctx, batch).Close())
+	assert.Len(t, readAllNameRows(t, upstream), 120)
+
+	// a failing insert fails the whole pipeline
+	batch = &pgx.Batch{}
+	batch.Queue("INSERT INTO names (id, name) VALUES ($1, $2)", 121, "new")
+	batch.Queue("INSERT INTO names (id, name) VALUES ($1, $2)", 1, "duplicate")
+
+	assert.Error(t, conn.SendBatch(ctx, batch).Close())
+	assert.Len(t, readAllNameRows(t, upstream), 120)
+}
+
+func TestDropTableForwarding(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+	local := newSQLiteConn(ctx, t, cfg)
+
+	execStatements(t, upstream, "CREATE TABLE names (id serial not null primary key, name text);")
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer wg.Done()
+		if err := replicate.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+			assert.NoError(t, err)
+		}
+	}()
+
+	if err := queryproxy.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+		assert.NoError(t, err)
+	}
+
+	<-time.After(1 * time.Second)
+
+	db, err := sql.Open("pgx", fmt.Sprintf(
+		"user=postgres host=0.0.0.0 port=%d database=%s sslmode=disable",
+		cfg.Proxy.Port,
+		cfg.Upstream.DBName,
+	))
+	assert.NoError(t, err)
+
+	execStatements(t, db, "DROP TABLE names;")
+
+	<-time.After(1 * time.Second)
+
+	var n int
+	assert.NoError(t, local.QueryRow("SELECT count(*) FROM sqlite_schema WHERE name = 'names';").Scan(&n))
+	assert.Equal(t, 0, n)
+
+	cancel()
+	wg.Wait()
+}
+
+func TestNoticeRelay(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+
+	execStatements(
+		t,
+		upstream,
+		"CREATE TABLE names (id serial not null primary key, name text);",
+		`CREATE FUNCTION names_notice() RETURNS trigger AS $$
+		BEGIN
+			RAISE NOTICE 'inserted %', NEW.name;
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;`,
+		"CREATE TRIGGER names_notice BEFORE INSERT ON names FOR EACH ROW EXECUTE FUNCTION names_notice();",
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := queryproxy.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+		assert.NoError(t, err)
+	}
+
+	<-time.After(1 * time.Second)
+
+	proxyCfg, err := pgx.ParseConfig(fmt.Sprintf(
+		"user=postgres host=0.0.0.0 port=%d database=%s sslmode=disable",
+		cfg.Proxy.Port,
+		cfg.Upstream.DBName,
+	))
+	assert.NoError(t, err)
+
+	var notices []string
+
+	proxyCfg.OnNotice = func(_ *pgconn.PgConn, n *pgconn.Notice) {
+		notices = append(notices, n.Message)
+	}
+
+	conn, err := pgx.ConnectConfig(ctx, proxyCfg)
+	assert.NoError(t, err)
+
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "INSERT INTO names (name) VALUES ('hello')")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"inserted hello"}, notices)
+}
+
+func TestTransactionForwarding(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+
+	execStatements(t, upstream, "CREATE TABLE names (id serial not null primary key, name text);")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := queryproxy.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+		assert.NoError(t, err)
+	}
+
+	<-time.After(1 * time.Second)
+
+	db, err := sql.Open("pgx", fmt.Sprintf(
+		"user=postgres host=0.0.0.0 port=%d database=%s sslmode=disable",
+		cfg.Proxy.Port,
+		cfg.Upstream.DBName,
+	))
+	assert.NoError(t, err)
+
+	// both writes are in the same upstream transaction,
+	// so the rollback removes them both.
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+
+	_, err = tx.Exec("INSERT INTO names (name) VALUES ('hello')")
+	assert.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO names (name) VALUES ('world')")
+	assert.NoError(t, err)
+
+	assert.NoError(t, tx.Rollback())
+	assert.Empty(t, readAllNameRows(t, upstream))
+
+	tx, err = db.Begin()
+	assert.NoError(t, err)
+
+	_, err = tx.Exec("INSERT INTO names (id, name) VALUES (1, 'hello')")
+	assert.NoError(t, err)
+
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, []nameRow{{id: 1, name: "hello"}}, readAllNameRows(t, upstream))
+}
+
+func TestDDLLockTimeout(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+	cfg.Proxy.DDLLockTimeout = 100 * time.Millisecond
+	cfg.Proxy.DDLRetries = 2
+	cfg.Proxy.DDLRetryBackoff = 50 * time.Millisecond
+
+	execStatements(t, upstream, "CREATE TABLE names (id serial not null primary key, name text);")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := queryproxy.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+		assert.NoError(t, err)
+	}
+
+	<-time.After(1 * time.Second)
+
+	db, err := sql.Open("pgx", fmt.Sprintf(
+		"user=postgres host=0.0.0.0 port=%d database=%s sslmode=disable",
+		cfg.Proxy.Port,
+		cfg.Upstream.DBName,
+	))
+	assert.NoError(t, err)
+
+	// a long transaction holds the table
+	lock, err := upstream.Begin()
+	assert.NoError(t, err)
+	_, err = lock.Exec("LOCK TABLE names IN ACCESS EXCLUSIVE MODE")
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = db.Exec("ALTER TABLE names ADD COLUMN age int")
+
+	var pgErr *pgconn.PgError
+	if assert.ErrorAs(t, err, &pgErr) {
+		assert.Equal(t, "55P03", pgErr.Code)
+	}
+
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	assert.NoError(t, lock.Rollback())
+
+	_, err = db.Exec("ALTER TABLE names ADD COLUMN age int")
+	assert.NoError(t, err)
+}
+
+func TestVerifyRepair(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+	local := newSQLiteConn(ctx, t, cfg)
+
+	_, err := upstream.Exec(`CREATE TABLE names (id int PRIMARY KEY, name text, score float8, active bool);
+		INSERT INTO names SELECT i, 'name ' || i, i / 4.0, i % 2 = 0 FROM generate_series(1, 100) i;`)
+	assert.NoError(t, err)
+
+	_, err = local.Exec(`CREATE TABLE names (id integer, name text, score real, active text);
+		WITH RECURSIVE s(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM s WHERE i < 100)
+		INSERT INTO names SELECT i, 'name ' || i, i / 4.0, CASE WHEN i % 2 = 0 THEN 't' ELSE 'f' END FROM s;`)
+	assert.NoError(t, err)
+
+	table, err := verify.Describe(ctx, upstream, local, "public", "names")
+	assert.NoError(t, err)
+
+	ranges, err := verify.Diff(ctx, upstream, local, table, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, ranges)
+
+	_, err = local.Exec(`UPDATE names SET name = 'diverged' WHERE id = 15; DELETE FROM names WHERE id = 97;`)
+	assert.NoError(t, err)
+
+	ranges, err = verify.Diff(ctx, upstream, local, table, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []verify.Range{
+		{Table: "names", Low: 11, High: 20},
+		{Table: "names", Low: 91, High: 100},
+	}, ranges)
+
+	for _, r := range ranges {
+		_, err := verify.Repair(ctx, upstream, local, table, r)
+		assert.NoError(t, err)
+	}
+
+	ranges, err = verify.Diff(ctx, upstream, local, table, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, ranges)
+}
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+
+	_, err := upstream.Exec(`CREATE TABLE names (id int PRIMARY KEY, name text, price numeric(10, 2), area point, tags text[]);
+		CREATE TABLE events (at timestamptz, payload jsonb);`)
+	assert.NoError(t, err)
+
+	warnings, err := lint.Check(ctx, upstream, lint.Config{Schema: "public", Publication: "sqledge"})
+	assert.NoError(t, err)
+
+	var got []string
+	for _, w := range warnings {
+		got = append(got, w.Table+"."+w.Column)
+	}
+
+	assert.Equal(t, []string{"events.", "names.price", "names.area", "names.tags"}, got)
+}
+
+func TestLeaderElection(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	cfg := defaultConfig(ctx, t, container)
+
+	key := leader.Key(cfg.Replication.SlotName)
+
+	leaderCtx, stopLeader := context.WithCancel(ctx)
+	defer stopLeader()
+
+	first := leader.New(cfg.PostgresConnString(), key, 100*time.Millisecond)
+	lost, err := first.Acquire(leaderCtx)
+	assert.NoError(t, err)
+	assert.True(t, first.IsLeader())
+
+	standby := leader.New(cfg.PostgresConnString(), key, 100*time.Millisecond)
+	acquired := make(chan struct{})
+
+	go func() {
+		if _, err := standby.Acquire(ctx); err == nil {
+			close(acquired)
+		}
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("standby acquired the lock held by the leader")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// the leader stopping releases the lock to the standby
+	stopLeader()
+	<-lost
+
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby didn't take over")
+	}
+
+	assert.False(t, first.IsLeader())
+	assert.True(t, standby.IsLeader())
+}
+
+func TestPendingCopy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+	cfg.Replication.Tables = []string{"names"}
+	// the slot outlives the first run
+	cfg.Replication.Temporary = false
+	local := newSQLiteConn(ctx, t, cfg)
+
+	execStatements(
+		t,
+		upstream,
+		"CREATE TABLE names (id serial not null primary key, name text);",
+		"CREATE TABLE others (id serial not null primary key, name text);",
+		"INSERT INTO names (name) VALUES ('hello')",
+		"INSERT INTO others (name) VALUES ('world')",
+	)
+
+	run := func() {
+		ctx, cancel := context.WithCancel(ctx)
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			if err := replicate.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+				assert.NoError(t, err)
+			}
+		}()
+
+		<-time.After(2 * time.Second)
+
+		cancel()
+		wg.Wait()
+	}
+
+	run()
+
+	cfg.Replication.Tables = []string{"names", "others"}
+	connStr := cfg.UpstreamConnString("replication") + "&replication=database"
+
+	// sqledge stops after adding others to the publication, before copying it
+	conn, err := replicate.NewConn(ctx, connStr, cfg.Replication.Publication)
+	assert.NoError(t, err)
+
+	driver := sqlgen.NewSqliteDriver(replicate.LocalConfig(cfg), local)
+	assert.NoError(t, driver.InitPendingCopiesTable())
+
+	_, err = conn.EnsurePublication(replicate.PublicationConfig{
+		Schema:  cfg.Upstream.Schema,
+		Tables:  cfg.Replication.Tables,
+		Pending: driver.AddPendingCopies,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	run()
+
+	var name string
+	assert.NoError(t, local.QueryRow("SELECT name FROM others;").Scan(&name))
+	assert.Equal(t, "world", name)
+
+	pending, err := driver.PendingCopies()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// nodes creating the same publication at once
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			conn, err := replicate.NewConn(ctx, connStr, "concurrent_publication")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			_, err = conn.EnsurePublication(replicate.PublicationConfig{Schema: cfg.Upstream.Schema, Tables: []string{"names"}})
+			assert.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestLostSlot(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	container := newDB(ctx, t)
+	upstream := newSQLConn(ctx, t, container)
+	cfg := defaultConfig(ctx, t, container)
+	// the slot outlives the first run
+	cfg.Replication.Temporary = false
+	local := newSQLiteConn(ctx, t, cfg)
+
+	execStatements(
+		t,
+		upstream,
+		"CREATE TABLE names (id serial not null primary key, name text);",
+		"INSERT INTO names (name) VALUES ('hello'), ('world')",
+	)
+
+	run := func() {
+		ctx, cancel := context.WithCancel(ctx)
+
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			if err := replicate.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
+				assert.NoError(t, err)
+			}
+		}()
+
+		<-time.After(2 * time.Second)
+
+		cancel()
+		wg.Wait()
+	}
+
+	run()
+
+	assert.Equal(t, []nameRow{{1, "hello"}, {2, "world"}}, readAllNameRows(t, local))
+
+	// the slot guard drops the slot while the node is offline
+	execStatements(
+		t,
+		upstream,
+		"SELECT pg_drop_replication_slot('sqledge_test_slot')",
+		"DELETE FROM names WHERE id = 1",
+		"INSERT INTO names (name) VALUES ('again')",
+	)
+
+	// the lost slot is created again
+	cfg.Replication.CreateSlotIfNoExists = false
+
+	run()
+
+	assert.Equal(t, []nameRow{{2, "world"}, {3, "again"}}, readAllNameRows(t, local))
+
+	driver := sqlgen.NewSqliteDriver(replicate.LocalConfig(cfg), local)
+
+	pending, err := driver.PendingCopies()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
 func newDB(ctx context.Context, t *testing.T) *postgres.PostgresContainer {
 	pgContainer, err := postgres.RunContainer(ctx,
 		testcontainers.WithImage("postgres:15.3-alpine"),